@@ -0,0 +1,532 @@
+package wasi
+
+import (
+	"context"
+	"sync"
+)
+
+// ResourceUsage accumulates the resources consumed by the guests of systems
+// wrapped by Account, which platform operators can use to bill or monitor
+// tenants.
+//
+// The same ResourceUsage can account for multiple systems, in which case the
+// values are aggregated across all of them. It is safe to read the usage
+// while the systems are in use.
+type ResourceUsage struct {
+	mutex sync.Mutex
+	stats Stats
+}
+
+// Stats is a snapshot of the resources consumed by guests.
+type Stats struct {
+	// Syscalls is the number of system calls made by the guests.
+	Syscalls int
+	// Errors is the number of system calls which returned an error.
+	Errors int
+	// Files is the I/O on regular files.
+	Files IOStats
+	// Sockets is the I/O on sockets.
+	Sockets IOStats
+	// Other is the I/O on the other file descriptors, e.g. the pipes or
+	// terminals of stdio.
+	Other IOStats
+	// OpenFDs is the number of file descriptors opened by the guests and not
+	// yet closed (preopens and stdio are not included).
+	OpenFDs int
+	// Connections is the number of socket connections established by the
+	// guests, counting the successful calls to sock_accept and sock_connect
+	// (including connections in progress).
+	Connections int
+}
+
+// IOStats is the number of bytes read and written on a class of file
+// descriptors.
+type IOStats struct {
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Stats returns the resources consumed so far.
+func (u *ResourceUsage) Stats() Stats {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.stats
+}
+
+func (u *ResourceUsage) syscall(errno Errno) {
+	u.mutex.Lock()
+	u.stats.Syscalls++
+	if errno != ESUCCESS {
+		u.stats.Errors++
+	}
+	u.mutex.Unlock()
+}
+
+func (u *ResourceUsage) update(f func(*Stats)) {
+	u.mutex.Lock()
+	f(&u.stats)
+	u.mutex.Unlock()
+}
+
+// Account wraps a System to record the resources consumed by the guest in
+// usage.
+//
+// To classify the I/O of file descriptors, the wrapper queries the file type
+// of each file descriptor with fd_fdstat_get the first time that it is read
+// from or written to; these calls are not accounted for.
+func Account(system System, usage *ResourceUsage) System {
+	return &accountant{
+		system: system,
+		usage:  usage,
+		fds:    make(map[FD]accountedFD),
+	}
+}
+
+type accountant struct {
+	system System
+	usage  *ResourceUsage
+	mutex  sync.Mutex
+	fds    map[FD]accountedFD
+}
+
+type accountedFD struct {
+	// stats points to the field of Stats that the I/O of the file descriptor
+	// is accounted to, or nil if the file type is not known yet.
+	stats func(*Stats) *IOStats
+	// opened is true if the file descriptor was opened by the guest.
+	opened bool
+}
+
+func filesStats(s *Stats) *IOStats   { return &s.Files }
+func socketsStats(s *Stats) *IOStats { return &s.Sockets }
+func otherStats(s *Stats) *IOStats   { return &s.Other }
+
+func (a *accountant) open(fd FD, stats func(*Stats) *IOStats) {
+	a.mutex.Lock()
+	a.fds[fd] = accountedFD{stats: stats, opened: true}
+	a.mutex.Unlock()
+	a.usage.update(func(s *Stats) { s.OpenFDs++ })
+}
+
+func (a *accountant) account(ctx context.Context, fd FD, read, written Size) {
+	if read == 0 && written == 0 {
+		return
+	}
+	a.mutex.Lock()
+	f := a.fds[fd]
+	a.mutex.Unlock()
+
+	if f.stats == nil {
+		f.stats = otherStats
+		if stat, errno := a.system.FDStatGet(ctx, fd); errno == ESUCCESS {
+			switch stat.FileType {
+			case RegularFileType:
+				f.stats = filesStats
+			case SocketStreamType, SocketDGramType:
+				f.stats = socketsStats
+			}
+		}
+		a.mutex.Lock()
+		if g, ok := a.fds[fd]; !ok || g.stats == nil {
+			g.stats = f.stats
+			a.fds[fd] = g
+		}
+		a.mutex.Unlock()
+	}
+
+	a.usage.update(func(s *Stats) {
+		io := f.stats(s)
+		io.BytesRead += int64(read)
+		io.BytesWritten += int64(written)
+	})
+}
+
+func (a *accountant) FDClose(ctx context.Context, fd FD) Errno {
+	errno := a.system.FDClose(ctx, fd)
+	a.usage.syscall(errno)
+	if errno == ESUCCESS {
+		a.mutex.Lock()
+		f := a.fds[fd]
+		delete(a.fds, fd)
+		a.mutex.Unlock()
+		if f.opened {
+			a.usage.update(func(s *Stats) { s.OpenFDs-- })
+		}
+	}
+	return errno
+}
+
+func (a *accountant) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := a.system.FDRenumber(ctx, from, to)
+	a.usage.syscall(errno)
+	if errno == ESUCCESS && from != to {
+		// The file descriptor that was renumbered over is closed.
+		a.mutex.Lock()
+		f := a.fds[to]
+		a.fds[to] = a.fds[from]
+		delete(a.fds, from)
+		a.mutex.Unlock()
+		if f.opened {
+			a.usage.update(func(s *Stats) { s.OpenFDs-- })
+		}
+	}
+	return errno
+}
+
+func (a *accountant) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	newfd, errno := a.system.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	a.usage.syscall(errno)
+	if errno == ESUCCESS {
+		// The file type is determined on first use, since path_open may
+		// open files, directories, or sockets (e.g. unix.PathOpenSockets).
+		a.open(newfd, nil)
+	}
+	return newfd, errno
+}
+
+func (a *accountant) SockOpen(ctx context.Context, pf ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	fd, errno := a.system.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	a.usage.syscall(errno)
+	if errno == ESUCCESS {
+		a.open(fd, socketsStats)
+	}
+	return fd, errno
+}
+
+func (a *accountant) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	newfd, peer, addr, errno := a.system.SockAccept(ctx, fd, flags)
+	a.usage.syscall(errno)
+	if errno == ESUCCESS {
+		a.open(newfd, socketsStats)
+		a.usage.update(func(s *Stats) { s.Connections++ })
+	}
+	return newfd, peer, addr, errno
+}
+
+func (a *accountant) SockConnect(ctx context.Context, fd FD, peer SocketAddress) (SocketAddress, Errno) {
+	addr, errno := a.system.SockConnect(ctx, fd, peer)
+	a.usage.syscall(errno)
+	if errno == ESUCCESS || errno == EINPROGRESS {
+		a.usage.update(func(s *Stats) { s.Connections++ })
+	}
+	return addr, errno
+}
+
+func (a *accountant) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	argCount, stringBytes, errno := a.system.ArgsSizesGet(ctx)
+	a.usage.syscall(errno)
+	return argCount, stringBytes, errno
+}
+
+func (a *accountant) ArgsGet(ctx context.Context) ([]string, Errno) {
+	args, errno := a.system.ArgsGet(ctx)
+	a.usage.syscall(errno)
+	return args, errno
+}
+
+func (a *accountant) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	envCount, stringBytes, errno := a.system.EnvironSizesGet(ctx)
+	a.usage.syscall(errno)
+	return envCount, stringBytes, errno
+}
+
+func (a *accountant) EnvironGet(ctx context.Context) ([]string, Errno) {
+	environ, errno := a.system.EnvironGet(ctx)
+	a.usage.syscall(errno)
+	return environ, errno
+}
+
+func (a *accountant) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	precision, errno := a.system.ClockResGet(ctx, id)
+	a.usage.syscall(errno)
+	return precision, errno
+}
+
+func (a *accountant) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	timestamp, errno := a.system.ClockTimeGet(ctx, id, precision)
+	a.usage.syscall(errno)
+	return timestamp, errno
+}
+
+func (a *accountant) FDAdvise(ctx context.Context, fd FD, offset, length FileSize, advice Advice) Errno {
+	errno := a.system.FDAdvise(ctx, fd, offset, length, advice)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	errno := a.system.FDAllocate(ctx, fd, offset, length)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDDataSync(ctx context.Context, fd FD) Errno {
+	errno := a.system.FDDataSync(ctx, fd)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	fdstat, errno := a.system.FDStatGet(ctx, fd)
+	a.usage.syscall(errno)
+	return fdstat, errno
+}
+
+func (a *accountant) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	errno := a.system.FDStatSetFlags(ctx, fd, flags)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
+	errno := a.system.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	filestat, errno := a.system.FDFileStatGet(ctx, fd)
+	a.usage.syscall(errno)
+	return filestat, errno
+}
+
+func (a *accountant) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	errno := a.system.FDFileStatSetSize(ctx, fd, size)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	errno := a.system.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	n, errno := a.system.FDPread(ctx, fd, iovecs, offset)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, n, 0)
+	return n, errno
+}
+
+func (a *accountant) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	prestat, errno := a.system.FDPreStatGet(ctx, fd)
+	a.usage.syscall(errno)
+	return prestat, errno
+}
+
+func (a *accountant) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	name, errno := a.system.FDPreStatDirName(ctx, fd)
+	a.usage.syscall(errno)
+	return name, errno
+}
+
+func (a *accountant) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	n, errno := a.system.FDPwrite(ctx, fd, iovecs, offset)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, 0, n)
+	return n, errno
+}
+
+func (a *accountant) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n, errno := a.system.FDRead(ctx, fd, iovecs)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, n, 0)
+	return n, errno
+}
+
+func (a *accountant) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	n, errno := a.system.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	a.usage.syscall(errno)
+	return n, errno
+}
+
+func (a *accountant) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	result, errno := a.system.FDSeek(ctx, fd, offset, whence)
+	a.usage.syscall(errno)
+	return result, errno
+}
+
+func (a *accountant) FDSync(ctx context.Context, fd FD) Errno {
+	errno := a.system.FDSync(ctx, fd)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	result, errno := a.system.FDTell(ctx, fd)
+	a.usage.syscall(errno)
+	return result, errno
+}
+
+func (a *accountant) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n, errno := a.system.FDWrite(ctx, fd, iovecs)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, 0, n)
+	return n, errno
+}
+
+func (a *accountant) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	errno := a.system.PathCreateDirectory(ctx, fd, path)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	filestat, errno := a.system.PathFileStatGet(ctx, fd, lookupFlags, path)
+	a.usage.syscall(errno)
+	return filestat, errno
+}
+
+func (a *accountant) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	errno := a.system.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	errno := a.system.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	n, errno := a.system.PathReadLink(ctx, fd, path, buffer)
+	a.usage.syscall(errno)
+	return n, errno
+}
+
+func (a *accountant) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	errno := a.system.PathRemoveDirectory(ctx, fd, path)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	errno := a.system.PathRename(ctx, fd, oldPath, newFD, newPath)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	errno := a.system.PathSymlink(ctx, oldPath, fd, newPath)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	errno := a.system.PathUnlinkFile(ctx, fd, path)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	n, errno := a.system.PollOneOff(ctx, subscriptions, events)
+	a.usage.syscall(errno)
+	return n, errno
+}
+
+func (a *accountant) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	// ProcExit is not expected to return, the call is counted before
+	// calling the underlying system.
+	a.usage.syscall(ESUCCESS)
+	return a.system.ProcExit(ctx, exitCode)
+}
+
+func (a *accountant) ProcRaise(ctx context.Context, signal Signal) Errno {
+	errno := a.system.ProcRaise(ctx, signal)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) SchedYield(ctx context.Context) Errno {
+	errno := a.system.SchedYield(ctx)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) RandomGet(ctx context.Context, b []byte) Errno {
+	errno := a.system.RandomGet(ctx, b)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	errno := a.system.SockShutdown(ctx, fd, flags)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, Errno) {
+	n, oflags, errno := a.system.SockRecv(ctx, fd, iovecs, iflags)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, n, 0)
+	return n, oflags, errno
+}
+
+func (a *accountant) SockSend(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags) (Size, Errno) {
+	n, errno := a.system.SockSend(ctx, fd, iovecs, iflags)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, 0, n)
+	return n, errno
+}
+
+func (a *accountant) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	result, errno := a.system.SockBind(ctx, fd, addr)
+	a.usage.syscall(errno)
+	return result, errno
+}
+
+func (a *accountant) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	errno := a.system.SockListen(ctx, fd, backlog)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags, addr SocketAddress) (Size, Errno) {
+	n, errno := a.system.SockSendTo(ctx, fd, iovecs, iflags, addr)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, 0, n)
+	return n, errno
+}
+
+func (a *accountant) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	n, oflags, addr, errno := a.system.SockRecvFrom(ctx, fd, iovecs, iflags)
+	a.usage.syscall(errno)
+	a.account(ctx, fd, n, 0)
+	return n, oflags, addr, errno
+}
+
+func (a *accountant) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	value, errno := a.system.SockGetOpt(ctx, fd, option)
+	a.usage.syscall(errno)
+	return value, errno
+}
+
+func (a *accountant) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	errno := a.system.SockSetOpt(ctx, fd, option, value)
+	a.usage.syscall(errno)
+	return errno
+}
+
+func (a *accountant) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	addr, errno := a.system.SockLocalAddress(ctx, fd)
+	a.usage.syscall(errno)
+	return addr, errno
+}
+
+func (a *accountant) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	addr, errno := a.system.SockRemoteAddress(ctx, fd)
+	a.usage.syscall(errno)
+	return addr, errno
+}
+
+func (a *accountant) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	n, errno := a.system.SockAddressInfo(ctx, name, service, hints, results)
+	a.usage.syscall(errno)
+	return n, errno
+}
+
+func (a *accountant) Close(ctx context.Context) error {
+	return a.system.Close(ctx)
+}
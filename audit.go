@@ -0,0 +1,424 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Denial is an operation rejected by a system because the file descriptor
+// did not have the rights that it required, or because it was prohibited by
+// the sandbox (e.g. a path escaping the preopened directories).
+type Denial struct {
+	// Syscall is the name of the WASI function, e.g. path_open.
+	Syscall string
+	// FD is the file descriptor that the operation was made on, or -1 if the
+	// operation was not made on a file descriptor (e.g. sock_open).
+	FD FD
+	// Path is the path that the operation was made on, if any.
+	Path string
+	// Address is the socket address that the operation was made on, if any.
+	Address SocketAddress
+	// Rights are the base rights that the operation required on FD.
+	Rights Rights
+	// RightsInheriting are the inheriting rights that the operation required
+	// on FD (e.g. the rights requested for the file opened by path_open).
+	RightsInheriting Rights
+	// Stat is the status of FD at the time of the denial, which holds the
+	// rights that the file descriptor had. It is zero if FD is -1 or the
+	// status could not be retrieved.
+	Stat FDStat
+	// Errno is the error returned to the guest, either ENOTCAPABLE or EPERM.
+	Errno Errno
+}
+
+// MissingRights returns the rights required by the operation that the file
+// descriptor did not have. Both values are zero when the operation was denied
+// by the sandbox rather than for lack of rights.
+func (d *Denial) MissingRights() (base, inheriting Rights) {
+	return d.Rights &^ d.Stat.RightsBase, d.RightsInheriting &^ d.Stat.RightsInheriting
+}
+
+func (d Denial) String() string {
+	var s strings.Builder
+	s.WriteString(d.Syscall)
+	s.WriteString("(")
+	if d.FD >= 0 {
+		fmt.Fprintf(&s, "%d", d.FD)
+	}
+	if d.Path != "" {
+		if d.FD >= 0 {
+			s.WriteString(", ")
+		}
+		fmt.Fprintf(&s, "%q", d.Path)
+	}
+	if d.Address != nil {
+		if d.FD >= 0 || d.Path != "" {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.Address.String())
+	}
+	s.WriteString("): ")
+	s.WriteString(d.Errno.Name())
+	base, inheriting := d.MissingRights()
+	if base != 0 {
+		fmt.Fprintf(&s, ", missing rights %s", base)
+	}
+	if inheriting != 0 {
+		fmt.Fprintf(&s, ", missing inheriting rights %s", inheriting)
+	}
+	return s.String()
+}
+
+// Audit wraps a System to call audit with each operation that it denies, so
+// capability grants can be tuned without tracing all the system calls of the
+// guest.
+//
+// Operations are reported when they fail with ENOTCAPABLE or EPERM. Since
+// EPERM may also be returned by the host (e.g. when unlinking a directory),
+// not all the reported operations are necessarily sandbox denials; the
+// rights of the file descriptor, and the rights that the operation required,
+// distinguish the two.
+func Audit(system System, audit func(context.Context, Denial)) System {
+	return &auditor{System: system, audit: audit}
+}
+
+type auditor struct {
+	System
+	audit func(context.Context, Denial)
+}
+
+func isDenial(errno Errno) bool {
+	return errno == ENOTCAPABLE || errno == EPERM
+}
+
+func (a *auditor) deny(ctx context.Context, denial Denial) {
+	if denial.FD >= 0 {
+		denial.Stat, _ = a.System.FDStatGet(ctx, denial.FD)
+	}
+	a.audit(ctx, denial)
+}
+
+// fdSeekRights returns the rights required by fd_seek, which only needs
+// FDTellRight when the offset is unchanged.
+func fdSeekRights(offset FileDelta, whence Whence) Rights {
+	if offset == 0 && whence == SeekCurrent {
+		return FDTellRight
+	}
+	return FDSeekRight
+}
+
+func (a *auditor) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	errno := a.System.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	if isDenial(errno) {
+		a.denyPair(ctx, errno, "path_link", oldFD, oldPath, PathLinkSourceRight, newFD, newPath, PathLinkTargetRight)
+	}
+	return errno
+}
+
+func (a *auditor) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	errno := a.System.PathRename(ctx, fd, oldPath, newFD, newPath)
+	if isDenial(errno) {
+		a.denyPair(ctx, errno, "path_rename", fd, oldPath, PathRenameSourceRight, newFD, newPath, PathRenameTargetRight)
+	}
+	return errno
+}
+
+// denyPair reports the denial of an operation on two directories, blaming
+// the source directory unless it had the rights required by the operation.
+func (a *auditor) denyPair(ctx context.Context, errno Errno, syscall string, oldFD FD, oldPath string, oldRights Rights, newFD FD, newPath string, newRights Rights) {
+	denial := Denial{Syscall: syscall, FD: oldFD, Path: oldPath, Rights: oldRights, Errno: errno}
+	denial.Stat, _ = a.System.FDStatGet(ctx, oldFD)
+	if denial.Stat.RightsBase.Has(oldRights) {
+		if stat, errno := a.System.FDStatGet(ctx, newFD); errno == ESUCCESS && !stat.RightsBase.Has(newRights) {
+			denial.FD, denial.Path, denial.Rights, denial.Stat = newFD, newPath, newRights, stat
+		}
+	}
+	a.audit(ctx, denial)
+}
+
+func (a *auditor) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	newfd, errno := a.System.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	if isDenial(errno) {
+		rights := PathOpenRight
+		if openFlags.Has(OpenCreate) {
+			rights |= PathCreateFileRight
+		}
+		if openFlags.Has(OpenTruncate) {
+			rights |= PathFileStatSetSizeRight
+		}
+		a.deny(ctx, Denial{
+			Syscall:          "path_open",
+			FD:               fd,
+			Path:             path,
+			Rights:           rights,
+			RightsInheriting: (rightsBase | rightsInheriting) & AllRights,
+			Errno:            errno,
+		})
+	}
+	return newfd, errno
+}
+
+func (a *auditor) SockOpen(ctx context.Context, pf ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	fd, errno := a.System.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_open", FD: -1, Errno: errno})
+	}
+	return fd, errno
+}
+
+func (a *auditor) FDAdvise(ctx context.Context, fd FD, offset, length FileSize, advice Advice) Errno {
+	errno := a.System.FDAdvise(ctx, fd, offset, length, advice)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_advise", FD: fd, Errno: errno, Rights: FDAdviseRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	errno := a.System.FDAllocate(ctx, fd, offset, length)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_allocate", FD: fd, Errno: errno, Rights: FDAllocateRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDDataSync(ctx context.Context, fd FD) Errno {
+	errno := a.System.FDDataSync(ctx, fd)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_datasync", FD: fd, Errno: errno, Rights: FDDataSyncRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	errno := a.System.FDStatSetFlags(ctx, fd, flags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_fdstat_set_flags", FD: fd, Errno: errno, Rights: FDStatSetFlagsRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
+	errno := a.System.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_fdstat_set_rights", FD: fd, Errno: errno, Rights: rightsBase, RightsInheriting: rightsInheriting})
+	}
+	return errno
+}
+
+func (a *auditor) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	filestat, errno := a.System.FDFileStatGet(ctx, fd)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_filestat_get", FD: fd, Errno: errno, Rights: FDFileStatGetRight})
+	}
+	return filestat, errno
+}
+
+func (a *auditor) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	errno := a.System.FDFileStatSetSize(ctx, fd, size)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_filestat_set_size", FD: fd, Errno: errno, Rights: FDFileStatSetSizeRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	errno := a.System.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_filestat_set_times", FD: fd, Errno: errno, Rights: FDFileStatSetTimesRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	n, errno := a.System.FDPread(ctx, fd, iovecs, offset)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_pread", FD: fd, Errno: errno, Rights: FDReadRight | FDSeekRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	n, errno := a.System.FDPwrite(ctx, fd, iovecs, offset)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_pwrite", FD: fd, Errno: errno, Rights: FDWriteRight | FDSeekRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n, errno := a.System.FDRead(ctx, fd, iovecs)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_read", FD: fd, Errno: errno, Rights: FDReadRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	n, errno := a.System.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_readdir", FD: fd, Errno: errno, Rights: FDReadDirRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	result, errno := a.System.FDSeek(ctx, fd, offset, whence)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_seek", FD: fd, Errno: errno, Rights: fdSeekRights(offset, whence)})
+	}
+	return result, errno
+}
+
+func (a *auditor) FDSync(ctx context.Context, fd FD) Errno {
+	errno := a.System.FDSync(ctx, fd)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_sync", FD: fd, Errno: errno, Rights: FDSyncRight})
+	}
+	return errno
+}
+
+func (a *auditor) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	result, errno := a.System.FDTell(ctx, fd)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_tell", FD: fd, Errno: errno, Rights: FDTellRight})
+	}
+	return result, errno
+}
+
+func (a *auditor) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n, errno := a.System.FDWrite(ctx, fd, iovecs)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "fd_write", FD: fd, Errno: errno, Rights: FDWriteRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	errno := a.System.PathCreateDirectory(ctx, fd, path)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_create_directory", FD: fd, Errno: errno, Path: path, Rights: PathCreateDirectoryRight})
+	}
+	return errno
+}
+
+func (a *auditor) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	filestat, errno := a.System.PathFileStatGet(ctx, fd, lookupFlags, path)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_filestat_get", FD: fd, Errno: errno, Path: path, Rights: PathFileStatGetRight})
+	}
+	return filestat, errno
+}
+
+func (a *auditor) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	errno := a.System.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_filestat_set_times", FD: fd, Errno: errno, Path: path, Rights: PathFileStatSetTimesRight})
+	}
+	return errno
+}
+
+func (a *auditor) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	n, errno := a.System.PathReadLink(ctx, fd, path, buffer)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_readlink", FD: fd, Errno: errno, Path: path, Rights: PathReadLinkRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	errno := a.System.PathRemoveDirectory(ctx, fd, path)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_remove_directory", FD: fd, Errno: errno, Path: path, Rights: PathRemoveDirectoryRight})
+	}
+	return errno
+}
+
+func (a *auditor) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	errno := a.System.PathSymlink(ctx, oldPath, fd, newPath)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_symlink", FD: fd, Errno: errno, Path: newPath, Rights: PathSymlinkRight})
+	}
+	return errno
+}
+
+func (a *auditor) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	errno := a.System.PathUnlinkFile(ctx, fd, path)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "path_unlink_file", FD: fd, Errno: errno, Path: path, Rights: PathUnlinkFileRight})
+	}
+	return errno
+}
+
+func (a *auditor) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	newfd, peer, addr, errno := a.System.SockAccept(ctx, fd, flags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_accept", FD: fd, Errno: errno, Rights: SockAcceptRight})
+	}
+	return newfd, peer, addr, errno
+}
+
+func (a *auditor) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	errno := a.System.SockShutdown(ctx, fd, flags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_shutdown", FD: fd, Errno: errno, Rights: SockShutdownRight})
+	}
+	return errno
+}
+
+func (a *auditor) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, Errno) {
+	n, oflags, errno := a.System.SockRecv(ctx, fd, iovecs, iflags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_recv", FD: fd, Errno: errno, Rights: FDReadRight})
+	}
+	return n, oflags, errno
+}
+
+func (a *auditor) SockSend(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags) (Size, Errno) {
+	n, errno := a.System.SockSend(ctx, fd, iovecs, iflags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_send", FD: fd, Errno: errno, Rights: FDWriteRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	result, errno := a.System.SockBind(ctx, fd, addr)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_bind", FD: fd, Errno: errno, Address: addr, Rights: SockAcceptRight})
+	}
+	return result, errno
+}
+
+func (a *auditor) SockConnect(ctx context.Context, fd FD, peer SocketAddress) (SocketAddress, Errno) {
+	addr, errno := a.System.SockConnect(ctx, fd, peer)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_connect", FD: fd, Errno: errno, Address: peer})
+	}
+	return addr, errno
+}
+
+func (a *auditor) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	errno := a.System.SockListen(ctx, fd, backlog)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_listen", FD: fd, Errno: errno, Rights: SockAcceptRight})
+	}
+	return errno
+}
+
+func (a *auditor) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags, addr SocketAddress) (Size, Errno) {
+	n, errno := a.System.SockSendTo(ctx, fd, iovecs, iflags, addr)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_send_to", FD: fd, Errno: errno, Address: addr, Rights: FDWriteRight})
+	}
+	return n, errno
+}
+
+func (a *auditor) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	n, oflags, addr, errno := a.System.SockRecvFrom(ctx, fd, iovecs, iflags)
+	if isDenial(errno) {
+		a.deny(ctx, Denial{Syscall: "sock_recv_from", FD: fd, Errno: errno, Rights: FDReadRight})
+	}
+	return n, oflags, addr, errno
+}
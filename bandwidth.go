@@ -0,0 +1,305 @@
+package wasi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bandwidth configures the rates at which LimitBandwidth lets guests send and
+// receive data on their sockets, in bytes per second. Zero values mean that
+// the rate is not limited.
+type Bandwidth struct {
+	// Send and Receive limit the rates across all the sockets of the guest.
+	Send    int64
+	Receive int64
+
+	// SocketSend and SocketReceive limit the rates of each socket.
+	SocketSend    int64
+	SocketReceive int64
+}
+
+// LimitBandwidth wraps a System to limit the rates at which the guest sends
+// and receives data on sockets, so a single guest cannot saturate the network
+// interfaces of the host.
+//
+// The limits are implemented with token buckets which hold up to one second
+// worth of data; guests may send or receive in bursts of this size, after
+// which system calls are delayed until the rate falls back under the limit.
+// Calls are not truncated, since it would break the boundaries of datagrams:
+// a call transferring more than the bucket holds succeeds, and the following
+// calls are delayed until the excess is repaid.
+//
+// The limits apply to sock_send, sock_recv, the sock_send_to and
+// sock_recv_from extensions, and to fd_read and fd_write on sockets. To find
+// which file descriptors are sockets, the wrapper queries their file type
+// with fd_fdstat_get the first time that they are read from or written to.
+func LimitBandwidth(system System, bandwidth Bandwidth) System {
+	return &bandwidthLimiter{
+		System:    system,
+		bandwidth: bandwidth,
+		send:      newTokenBucket(bandwidth.Send),
+		recv:      newTokenBucket(bandwidth.Receive),
+		sockets:   make(map[FD]*socketBandwidth),
+	}
+}
+
+type bandwidthLimiter struct {
+	System
+	bandwidth Bandwidth
+	send      *tokenBucket
+	recv      *tokenBucket
+	mutex     sync.Mutex
+	// sockets maps file descriptors to the buckets of the socket, or to nil
+	// if the file descriptor is not a socket.
+	sockets map[FD]*socketBandwidth
+}
+
+type socketBandwidth struct {
+	send *tokenBucket
+	recv *tokenBucket
+}
+
+func (l *bandwidthLimiter) newSocket(fd FD) {
+	l.mutex.Lock()
+	l.sockets[fd] = &socketBandwidth{
+		send: newTokenBucket(l.bandwidth.SocketSend),
+		recv: newTokenBucket(l.bandwidth.SocketReceive),
+	}
+	l.mutex.Unlock()
+}
+
+// socket returns the buckets of the socket fd, or nil if fd is not a socket.
+func (l *bandwidthLimiter) socket(ctx context.Context, fd FD) *socketBandwidth {
+	l.mutex.Lock()
+	s, ok := l.sockets[fd]
+	l.mutex.Unlock()
+	if ok {
+		return s
+	}
+	stat, errno := l.System.FDStatGet(ctx, fd)
+	if errno != ESUCCESS {
+		return nil
+	}
+	if stat.FileType == SocketStreamType || stat.FileType == SocketDGramType {
+		l.newSocket(fd)
+	} else {
+		l.mutex.Lock()
+		l.sockets[fd] = nil
+		l.mutex.Unlock()
+	}
+	return l.socket(ctx, fd)
+}
+
+func (l *bandwidthLimiter) waitSend(ctx context.Context, s *socketBandwidth) Errno {
+	if err := l.send.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	if err := s.send.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	return ESUCCESS
+}
+
+func (l *bandwidthLimiter) waitRecv(ctx context.Context, s *socketBandwidth) Errno {
+	if err := l.recv.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	if err := s.recv.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	return ESUCCESS
+}
+
+func (l *bandwidthLimiter) sent(s *socketBandwidth, size Size) {
+	l.send.take(size)
+	s.send.take(size)
+}
+
+func (l *bandwidthLimiter) received(s *socketBandwidth, size Size) {
+	l.recv.take(size)
+	s.recv.take(size)
+}
+
+func (l *bandwidthLimiter) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	s := l.socket(ctx, fd)
+	if s == nil {
+		return l.System.FDRead(ctx, fd, iovecs)
+	}
+	if errno := l.waitRecv(ctx, s); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.FDRead(ctx, fd, iovecs)
+	l.received(s, size)
+	return size, errno
+}
+
+func (l *bandwidthLimiter) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	s := l.socket(ctx, fd)
+	if s == nil {
+		return l.System.FDWrite(ctx, fd, iovecs)
+	}
+	if errno := l.waitSend(ctx, s); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.FDWrite(ctx, fd, iovecs)
+	l.sent(s, size)
+	return size, errno
+}
+
+func (l *bandwidthLimiter) FDClose(ctx context.Context, fd FD) Errno {
+	errno := l.System.FDClose(ctx, fd)
+	if errno == ESUCCESS {
+		l.mutex.Lock()
+		delete(l.sockets, fd)
+		l.mutex.Unlock()
+	}
+	return errno
+}
+
+func (l *bandwidthLimiter) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := l.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS && from != to {
+		l.mutex.Lock()
+		s, ok := l.sockets[from]
+		delete(l.sockets, from)
+		delete(l.sockets, to)
+		if ok {
+			l.sockets[to] = s
+		}
+		l.mutex.Unlock()
+	}
+	return errno
+}
+
+func (l *bandwidthLimiter) SockOpen(ctx context.Context, pf ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	fd, errno := l.System.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	if errno == ESUCCESS {
+		l.newSocket(fd)
+	}
+	return fd, errno
+}
+
+func (l *bandwidthLimiter) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	newfd, peer, addr, errno := l.System.SockAccept(ctx, fd, flags)
+	if errno == ESUCCESS {
+		l.newSocket(newfd)
+	}
+	return newfd, peer, addr, errno
+}
+
+func (l *bandwidthLimiter) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	s := l.socket(ctx, fd)
+	if s == nil {
+		return l.System.SockRecv(ctx, fd, iovecs, flags)
+	}
+	if errno := l.waitRecv(ctx, s); errno != ESUCCESS {
+		return 0, 0, errno
+	}
+	size, oflags, errno := l.System.SockRecv(ctx, fd, iovecs, flags)
+	l.received(s, size)
+	return size, oflags, errno
+}
+
+func (l *bandwidthLimiter) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	s := l.socket(ctx, fd)
+	if s == nil {
+		return l.System.SockSend(ctx, fd, iovecs, flags)
+	}
+	if errno := l.waitSend(ctx, s); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.SockSend(ctx, fd, iovecs, flags)
+	l.sent(s, size)
+	return size, errno
+}
+
+func (l *bandwidthLimiter) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	s := l.socket(ctx, fd)
+	if s == nil {
+		return l.System.SockRecvFrom(ctx, fd, iovecs, flags)
+	}
+	if errno := l.waitRecv(ctx, s); errno != ESUCCESS {
+		return 0, 0, nil, errno
+	}
+	size, oflags, addr, errno := l.System.SockRecvFrom(ctx, fd, iovecs, flags)
+	l.received(s, size)
+	return size, oflags, addr, errno
+}
+
+func (l *bandwidthLimiter) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	s := l.socket(ctx, fd)
+	if s == nil {
+		return l.System.SockSendTo(ctx, fd, iovecs, flags, addr)
+	}
+	if errno := l.waitSend(ctx, s); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.SockSendTo(ctx, fd, iovecs, flags, addr)
+	l.sent(s, size)
+	return size, errno
+}
+
+// tokenBucket limits the rate of a flow of bytes. The bucket holds up to one
+// second worth of tokens, and may go in debt when more tokens are taken than
+// it holds. A nil bucket does not limit the rate.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last refill. The mutex must
+// be held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// wait blocks until the bucket is not in debt, or ctx is canceled.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	b.refill(time.Now())
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take removes n tokens from the bucket.
+func (b *tokenBucket) take(n Size) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mutex.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	b.mutex.Unlock()
+}
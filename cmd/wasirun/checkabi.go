@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stealthrocket/wasi-go/imports"
+	"github.com/tetratelabs/wazero"
+)
+
+func printCheckABIUsage() {
+	fmt.Printf(`wasirun check-abi - Verify that a module's WASI imports can be satisfied
+
+USAGE:
+   wasirun check-abi [OPTIONS]... <MODULE>
+
+ARGS:
+   <MODULE>
+      The path of the WebAssembly module to check
+
+OPTIONS:
+   --sockets <NAME>
+      Check against a sockets extension, either {none, auto,
+      path_open, wasmedgev1, wasmedgev2}
+
+   -h, --help
+      Show this usage information
+
+The command exits with a non-zero status if any of the functions that the
+module imports from wasi_snapshot_preview1 are missing or have a mismatched
+signature.
+`)
+}
+
+func checkABI(args []string) error {
+	flagSet := flag.NewFlagSet("wasirun check-abi", flag.ExitOnError)
+	flagSet.Usage = printCheckABIUsage
+	flagSet.StringVar(&socketExt, "sockets", "auto", "")
+	flagSet.Parse(args)
+
+	args = flagSet.Args()
+	if len(args) != 1 {
+		printCheckABIUsage()
+		os.Exit(1)
+	}
+
+	wasmFile := args[0]
+	wasmCode, err := os.ReadFile(wasmFile)
+	if err != nil {
+		return fmt.Errorf("could not read WASM file '%s': %w", wasmFile, err)
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	wasmModule, err := runtime.CompileModule(ctx, wasmCode)
+	if err != nil {
+		return err
+	}
+	defer wasmModule.Close(ctx)
+
+	mismatches, err := imports.NewBuilder().
+		WithSocketsExtension(socketExt, wasmModule).
+		CheckImports(wasmModule)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s: %d unsatisfied import(s)", wasmFile, len(mismatches))
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/wasirun"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+func printDaemonUsage() {
+	fmt.Printf(`wasirun daemon - Supervise WebAssembly modules started with an API
+
+USAGE:
+   wasirun daemon [OPTIONS]...
+
+OPTIONS:
+   --control <ADDR>
+      Address that the control API listens on, a unix socket given
+      as unix:PATH which only the current user can connect to. The
+      API is not authenticated, and lets its clients access the files
+      of the host: TCP addresses are rejected (required)
+
+   --grace <DURATION>
+      Time given to the instances to exit after they are asked to
+      stop, before they are forcefully terminated (default: 5s)
+
+   -h, --help
+      Show this usage information
+
+The control API is a JSON API served over HTTP:
+
+   GET    /instances          list the instances
+   POST   /instances          start an instance, the body of the request
+                              is its specification (see below)
+   GET    /instances/<ID>     inspect an instance
+   POST   /instances/<ID>/stop
+                              ask an instance to exit, like SIGTERM
+   DELETE /instances/<ID>     stop an instance and forget it
+
+Instances are specified with JSON objects of the form:
+
+   {
+     "module": "app.wasm",
+     "name": "app",
+     "args": ["--port", "8080"],
+     "env": ["KEY=VALUE"],
+     "dirs": ["/var/lib/app:/data"],
+     "listens": [":8080"],
+     "dials": [],
+     "preloads": [],
+     "sha256": ""
+   }
+
+where module is the only required field, and may also be an oci:// reference
+or an https:// URL. The instances write to the standard output and error of
+the daemon. For example:
+
+   curl --unix-socket wasirun.sock http://wasirun/instances \
+      -d '{"module":"app.wasm","listens":[":8080"]}'
+
+The daemon stops all instances when it receives SIGINT or SIGTERM.
+`)
+}
+
+func runDaemon(args []string) error {
+	var control string
+	var grace time.Duration
+
+	flagSet := flag.NewFlagSet("wasirun daemon", flag.ExitOnError)
+	flagSet.Usage = printDaemonUsage
+	flagSet.StringVar(&control, "control", "", "")
+	flagSet.DurationVar(&grace, "grace", 5*time.Second, "")
+	flagSet.Parse(args)
+
+	if control == "" {
+		printDaemonUsage()
+		os.Exit(1)
+	}
+
+	d := &daemon{
+		instances: make(map[int]*daemonInstance),
+		grace:     grace,
+	}
+	l, err := listenControl(control)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	server := &http.Server{Handler: d}
+	go server.Serve(l)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	<-signals
+
+	server.Close()
+	d.stopAll()
+	return nil
+}
+
+// listenControl listens on the unix socket of addr, which must be prefixed
+// with unix:. The control API is not authenticated and lets its clients run
+// modules with access to the files of the host, so it is only served on unix
+// sockets, which only the user running the daemon can connect to.
+func listenControl(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return nil, fmt.Errorf("the control API must listen on a unix socket given as unix:PATH, not %q: it is not authenticated and grants access to the host", addr)
+	}
+	return listenUnix(path)
+}
+
+// listenUnix listens on a unix socket at path, which only the current user
+// can connect to.
+func listenUnix(path string) (net.Listener, error) {
+	// Remove the socket left behind by a previous process, but never
+	// another type of file which may have been passed by mistake.
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		os.Remove(path)
+	}
+	// The socket is created in a directory that only the current user can
+	// access, and moved to path once its permissions are 0600, so that
+	// there is no window during which other users can connect.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".wasirun-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "control.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by unixListener.Close, the listener only knows
+	// of its temporary path.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener removes the socket at path when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// daemon supervises the module instances started with its control API.
+type daemon struct {
+	mutex     sync.Mutex
+	nextID    int
+	instances map[int]*daemonInstance
+	grace     time.Duration
+}
+
+// daemonSpec is the specification of an instance started by the daemon.
+type daemonSpec struct {
+	Module   string   `json:"module"`
+	Name     string   `json:"name,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Env      []string `json:"env,omitempty"`
+	Dirs     []string `json:"dirs,omitempty"`
+	Listens  []string `json:"listens,omitempty"`
+	Dials    []string `json:"dials,omitempty"`
+	Preloads []string `json:"preloads,omitempty"`
+	SHA256   string   `json:"sha256,omitempty"`
+}
+
+type daemonInstance struct {
+	id        int
+	spec      daemonSpec
+	started   time.Time
+	summary   wasi.SyscallSummary
+	interrupt chan struct{}
+	stopOnce  sync.Once
+	cancel    context.CancelFunc
+	done      chan struct{}
+	// The fields below are set when the instance has exited, and read after
+	// the done channel is closed.
+	exited   time.Time
+	exitCode *uint32
+	err      error
+}
+
+func (d *daemon) start(spec daemonSpec) *daemonInstance {
+	ctx, cancel := context.WithCancel(context.Background())
+	i := &daemonInstance{
+		spec:      spec,
+		started:   time.Now(),
+		interrupt: make(chan struct{}),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	d.mutex.Lock()
+	d.nextID++
+	i.id = d.nextID
+	d.instances[i.id] = i
+	d.mutex.Unlock()
+
+	go func() {
+		defer close(i.done)
+		defer cancel()
+		err := wasirun.Run(ctx, wasirun.Options{
+			Module:    spec.Module,
+			Name:      spec.Name,
+			Args:      spec.Args,
+			Env:       spec.Env,
+			Dirs:      spec.Dirs,
+			Listens:   spec.Listens,
+			Dials:     spec.Dials,
+			Preloads:  spec.Preloads,
+			SHA256:    spec.SHA256,
+			Stdin:     strings.NewReader(""),
+			Interrupt: i.interrupt,
+			Wrappers: []func(wasi.System) wasi.System{
+				func(s wasi.System) wasi.System { return wasi.Summarize(s, &i.summary) },
+			},
+		})
+		var exitErr *sys.ExitError
+		switch {
+		case err == nil:
+			code := uint32(0)
+			i.exitCode = &code
+		case errors.As(err, &exitErr):
+			code := exitErr.ExitCode()
+			i.exitCode = &code
+		default:
+			i.err = err
+		}
+		i.exited = time.Now()
+	}()
+	return i
+}
+
+// stop asks the instance to exit, and terminates it if it did not exit
+// within the grace period.
+func (d *daemon) stop(i *daemonInstance) {
+	i.stopOnce.Do(func() {
+		close(i.interrupt)
+		go func() {
+			timer := time.NewTimer(d.grace)
+			defer timer.Stop()
+			select {
+			case <-i.done:
+			case <-timer.C:
+				i.cancel()
+			}
+		}()
+	})
+}
+
+func (d *daemon) stopAll() {
+	for _, i := range d.list() {
+		d.stop(i)
+	}
+	for _, i := range d.list() {
+		<-i.done
+	}
+}
+
+func (d *daemon) lookup(id int) *daemonInstance {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.instances[id]
+}
+
+func (d *daemon) remove(i *daemonInstance) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.instances, i.id)
+}
+
+func (d *daemon) list() []*daemonInstance {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	instances := make([]*daemonInstance, 0, len(d.instances))
+	for _, i := range d.instances {
+		instances = append(instances, i)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].id < instances[j].id
+	})
+	return instances
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "instances" {
+		d.handleInstances(w, r)
+		return
+	}
+	rest, ok := strings.CutPrefix(path, "instances/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	i := d.lookup(n)
+	if i == nil {
+		http.Error(w, fmt.Sprintf("instance %d not found", n), http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "":
+		if !allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			d.stop(i)
+			d.remove(i)
+		}
+		writeJSON(w, http.StatusOK, i.describe(true))
+	case "stop":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		d.stop(i)
+		writeJSON(w, http.StatusAccepted, i.describe(false))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *daemon) handleInstances(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var spec daemonSpec
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			http.Error(w, "invalid instance specification: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if spec.Module == "" {
+			http.Error(w, "invalid instance specification: missing module", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, d.start(spec).describe(false))
+		return
+	}
+	instances := []daemonInstanceInfo{}
+	for _, i := range d.list() {
+		instances = append(instances, i.describe(false))
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+type daemonInstanceInfo struct {
+	ID       int                  `json:"id"`
+	Spec     daemonSpec           `json:"spec"`
+	State    string               `json:"state"`
+	Started  time.Time            `json:"started"`
+	Uptime   float64              `json:"uptime_s"`
+	Exited   *time.Time           `json:"exited,omitempty"`
+	ExitCode *uint32              `json:"exit_code,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	Syscalls []daemonSyscallStats `json:"syscalls,omitempty"`
+}
+
+type daemonSyscallStats struct {
+	Syscall string  `json:"syscall"`
+	Calls   int     `json:"calls"`
+	Errors  int     `json:"errors"`
+	Time    float64 `json:"time_s"`
+}
+
+// describe returns the state of the instance exposed by the API, including
+// its system call statistics if stats is true.
+func (i *daemonInstance) describe(stats bool) daemonInstanceInfo {
+	info := daemonInstanceInfo{
+		ID:      i.id,
+		Spec:    i.spec,
+		State:   "running",
+		Started: i.started,
+	}
+	select {
+	case <-i.done:
+		info.State = "exited"
+		info.Exited = &i.exited
+		info.ExitCode = i.exitCode
+		info.Uptime = i.exited.Sub(i.started).Seconds()
+		if i.err != nil {
+			info.State = "failed"
+			info.Error = i.err.Error()
+		}
+	default:
+		info.Uptime = time.Since(i.started).Seconds()
+		select {
+		case <-i.interrupt:
+			info.State = "stopping"
+		default:
+		}
+	}
+	if stats {
+		for _, st := range i.summary.Stats() {
+			info.Syscalls = append(info.Syscalls, daemonSyscallStats{
+				Syscall: st.Syscall,
+				Calls:   st.Calls,
+				Errors:  st.Errors,
+				Time:    st.Time.Seconds(),
+			})
+		}
+	}
+	return info
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenControl(t *testing.T) {
+	if _, err := listenControl("127.0.0.1:0"); err == nil {
+		t.Error("the control API was served on a TCP address")
+	}
+
+	path := filepath.Join(t.TempDir(), "wasirun.sock")
+	l, err := listenControl("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("wrong permissions of the control socket: want=0600 got=%o", perm)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("the temporary directory of the control socket was not removed: %v", entries)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the control socket was not removed: %v", err)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wasirun.sock")
+	l, err := listenControl("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{
+		instances: make(map[int]*daemonInstance),
+		grace:     time.Second,
+	}
+	server := &http.Server{Handler: d}
+	go server.Serve(l)
+	defer d.stopAll()
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	do := func(method, url, body string, status int, value any) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://wasirun"+url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s %s: wrong status: want=%d got=%d", method, url, status, res.StatusCode)
+		}
+		if value != nil {
+			if err := json.NewDecoder(res.Body).Decode(value); err != nil {
+				t.Fatalf("%s %s: %v", method, url, err)
+			}
+		}
+	}
+
+	do("POST", "/instances", `{"module":"../../testdata/c/hello_world.wasm","unknown":true}`, http.StatusBadRequest, nil)
+	do("POST", "/instances", `{}`, http.StatusBadRequest, nil)
+	do("GET", "/instances/1", "", http.StatusNotFound, nil)
+
+	var started daemonInstanceInfo
+	do("POST", "/instances", `{"module":"../../testdata/c/hello_world.wasm","name":"hello"}`, http.StatusCreated, &started)
+	if started.ID != 1 || started.Spec.Name != "hello" {
+		t.Errorf("wrong instance started: %+v", started)
+	}
+
+	var instance daemonInstanceInfo
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		do("GET", "/instances/1", "", http.StatusOK, &instance)
+		if instance.State != "running" || time.Now().After(deadline) {
+			break
+		}
+	}
+	if instance.State != "exited" || instance.ExitCode == nil || *instance.ExitCode != 0 {
+		t.Errorf("wrong state of the instance after it exited: %+v", instance)
+	}
+	if len(instance.Syscalls) == 0 {
+		t.Error("no system call statistics were reported")
+	}
+
+	var instances []daemonInstanceInfo
+	do("GET", "/instances", "", http.StatusOK, &instances)
+	if len(instances) != 1 || instances[0].ID != 1 {
+		t.Errorf("wrong list of instances: %+v", instances)
+	}
+
+	do("DELETE", "/instances/1", "", http.StatusOK, nil)
+	do("GET", "/instances", "", http.StatusOK, &instances)
+	if len(instances) != 0 {
+		t.Errorf("the instance was not removed: %+v", instances)
+	}
+}
@@ -2,19 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
-	"path/filepath"
 	"runtime/debug"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stealthrocket/wasi-go"
-	"github.com/stealthrocket/wasi-go/imports"
-	"github.com/stealthrocket/wasi-go/imports/wasi_http"
-	"github.com/tetratelabs/wazero"
+	"github.com/stealthrocket/wasi-go/internal/proxy"
+	"github.com/stealthrocket/wasi-go/internal/sockets"
+	"github.com/stealthrocket/wasi-go/promwasi"
+	"github.com/stealthrocket/wasi-go/wasirun"
 	"github.com/tetratelabs/wazero/sys"
 )
 
@@ -23,47 +32,291 @@ func printUsage() {
 
 USAGE:
    wasirun [OPTIONS]... <MODULE> [--] [ARGS]...
+   wasirun check-abi [OPTIONS]... <MODULE>
+   wasirun wasi-testsuite [OPTIONS]... <SUITE>...
+   wasirun daemon --control <ADDR> [OPTIONS]...
 
 ARGS:
    <MODULE>
-      The path of the WebAssembly module to run
+      The path of the WebAssembly module to run; the module may be
+      compressed with zstd (e.g. app.wasm.zst), or packaged in a
+      bundle, which is a tar archive (optionally compressed with
+      zstd) holding the module, its configuration in wasirun.json,
+      and its assets; modules stored in OCI registries are pulled
+      from references such as oci://ghcr.io/org/app:v1, with the
+      credentials of the docker configuration, and cached locally;
+      modules are also downloaded from HTTPS URLs (e.g.
+      https://example.com/app.wasm), and cached locally
 
    [ARGS]...
-      Arguments to pass to the module
+      Arguments to pass to the module, or to the function called
+      with --invoke
 
 OPTIONS:
    --dir <DIR>
-      Grant access to the specified host directory
+      Grant access to the specified host directory, either as a
+      path or as HOST:GUEST[:ro] to expose the directory to the
+      module at a different path, and optionally read-only
+
+   --mapdir <GUEST::HOST>
+      Grant access to the host directory HOST at the path GUEST,
+      like --dir HOST:GUEST (compatible with wasmtime)
+
+   --sha256 <HASH>
+      Verify that the SHA-256 checksum of the module file is HASH;
+      modules downloaded from URLs with a checksum are only
+      downloaded once, and shared by the URLs serving them
+
+   --invoke <FUNCTION>
+      Call the function exported by the module instead of starting
+      it, with the arguments parsed according to the types of its
+      parameters, and print its results; the module is initialized
+      as a WASI reactor (calling _initialize if it is exported)
+
+   --coredump-on-trap <PATH>
+      Write a wasm coredump of the memory, globals, and call stack
+      of the module to PATH when it traps, which can be inspected
+      with debuggers such as wasmgdb; this slows down function calls
+
+   --profile-cpu <PATH>
+      Write a CPU profile of the module to PATH in the pprof format
+      (e.g. out.pb.gz) when it exits, sampling the call stacks of the
+      guest functions; this slows down function calls
+
+   --memory-report
+      Print the memory usage of the module when it exits: the size
+      of the linear memory of each instance, and the memory that
+      the host allocated to run them
+
+   --instances <N>
+      Run N instances of the module concurrently, sharing its
+      compiled code; each instance has its own system, and the
+      WASIRUN_INSTANCE environment variable set to its index
+      (from 0). wasirun exits when all instances have exited,
+      with the exit code of the first instance which failed
+      (default: 1)
+
+   --preload <NAME=MODULE>
+      Instantiate the WebAssembly module as a library before the main
+      module, which can import its exports from the module NAME; this
+      option can be repeated, each library can import the exports of
+      the libraries preloaded before it
 
    --listen <ADDR:PORT>
-      Grant access to a socket listening on the specified address
+      Grant access to a socket listening on the specified address,
+      or on the unix socket at the path given as unix:PATH; the
+      sockets passed by systemd socket activation (LISTEN_FDS) are
+      always granted. IPv6 addresses are enclosed in brackets (e.g.
+      [::1]:8080), addresses without a host (e.g. :8080) listen on
+      both IPv4 and IPv6
+
+   --tcplisten <ADDR:PORT>
+      Alias of --listen (compatible with wasmtime)
+
+   --listen-tls <ADDR:PORT>
+      Grant access to a socket listening on the specified address,
+      on which the host accepts TLS connections with the certificate
+      of --tls-cert and --tls-key, and passes the plaintext streams
+      to the module
+
+   --tls-cert <PATH>
+      Path to the PEM encoded certificate of --listen-tls sockets
+
+   --tls-key <PATH>
+      Path to the PEM encoded private key of --listen-tls sockets
+
+   --publish <GUEST_PORT:[HOST_IP:]HOST_PORT[/tcp|/udp]>
+      Listen on the host address when the module binds sockets to
+      the guest port (e.g. 8080:127.0.0.1:9090)
+
+   --max-connections <N>
+      Limit the number of connections accepted by the module which
+      can be open at the same time
+
+   --max-backlog <N>
+      Limit the length of the queues of pending connections of the
+      sockets that the module listens on
 
    --dial <ADDR:PORT>
-      Grant access to a socket connected to the specified address
+      Grant access to a socket connected to the specified address,
+      or to the unix socket at the path given as unix:PATH
+
+   --dial-tls <ADDR:PORT>
+      Grant access to a socket connected to the specified address,
+      on which the host establishes a TLS connection and passes the
+      plaintext stream to the module
+
+   --tls-ca <PATH>
+      Path to the PEM encoded certificates of the authorities that
+      --dial-tls servers are verified with, instead of those of
+      the system
 
    --dns-server <ADDR:PORT>
       Sets the address of the DNS server to use for name resolution
 
+   --proxy <URL>
+      Route the outbound TCP connections of the module through a
+      SOCKS5 (socks5://HOST:PORT) or HTTP CONNECT (http://HOST:PORT)
+      proxy server
+
    --env-inherit
       Inherits all environment variables from the calling process
 
    --env <NAME=VAL>
       Pass an environment variable to the module. Overrides
-      any inherited environment variables from --env-inherit
+      any inherited environment variables from --env-inherit;
+      the value of the variable on the host is passed when only
+      the name is given (e.g. --env HOME)
 
    --sockets <NAME>
       Enable a sockets extension, either {none, auto, path_open,
       wasmedgev1, wasmedgev2}
 
-   --pprof-addr <ADDR:PORT>
-      Start a pprof server listening on the specified address
+   --engine <NAME>
+      Select the WebAssembly engine, either {auto, compiler,
+      interpreter}
 
-   --trace
-      Enable logging of system calls (like strace)
+   --pprof-addr <ADDR:PORT>
+      Start a pprof server listening on the specified address; the
+      memory usage of the instances of the module is served as a
+      profile at /debug/pprof/wasm_memory
+
+   --metrics-addr <ADDR:PORT>
+      Expose Prometheus metrics of the system calls made by the
+      module, and of its memory usage, on the specified address
+      (at /metrics)
+
+   --manage-socket <PATH>
+      Serve a management API on a unix socket, to list the running
+      instances, get their system call statistics, enable or disable
+      tracing, or drain the instances without restarting wasirun
+
+   --trace[=FORMAT]
+      Enable logging of system calls (like strace), either in
+      human-readable format {text}, as one JSON object per
+      system call {json}, or as a table of system call counts
+      printed at exit {summary} (default: text)
+
+   --trace-filter <PATTERNS>
+      Only trace the system calls matching a comma-separated list
+      of glob patterns (e.g. fd_read,sock_*), patterns prefixed
+      with ! exclude system calls (e.g. !poll_oneoff)
+
+   --trace-output <FILE>
+      Write the trace to a file instead of stderr
+
+   --trace-max-size <SIZE>
+      Rotate the trace output file when its size exceeds the limit
+      (e.g. 512K, 100M, 1G); disabled by default
+
+   --trace-max-files <N>
+      Number of rotated trace output files to keep (default: 3)
+
+   --policy <FILE>
+      Enforce the policy declared in a JSON file, restricting the
+      paths, network addresses, and environment variables that the
+      module can access (see wasi.Policy)
+
+   --deny-path <PATTERN>
+      Deny access to the paths matching a glob pattern inside the
+      directories granted with --dir, where ** matches any number
+      of directories (e.g. **/.ssh, *.key)
+
+   --allow-command <NAME>
+      Allow the module to spawn the host program NAME as a child
+      process, looked up in PATH unless it is an absolute path
+      (can be repeated)
+
+   --shared-memory <SIZE>
+      Let the module share named memory segments with its other
+      instances, up to SIZE bytes in total (e.g. 64M)
+
+   --child-modules
+      Allow the module to spawn the WebAssembly modules (*.wasm) of
+      its directories as child processes
+
+   --allow-dial <ADDR:PORT>
+      Only allow the module to connect to the addresses matching
+      the pattern, which may be an IP address, a CIDR block, or a
+      host name pattern, with a port, a port range, or * for any
+      port (e.g. 10.0.0.0/8:443, *.example.com:*)
+
+   --audit
+      Log the operations denied to the module for lack of rights
+      or by the sandbox to stderr, with the rights that were missing
 
    --non-blocking-stdio
       Enable non-blocking stdio
 
+   --io-uring
+      Perform the I/O of the module with io_uring on Linux, falling
+      back to the classic system calls if it is not available
+
+   --dir-cache <size>
+      Number of directory handles cached to speed up opening files
+      in deep directory trees (default: 0, disabled)
+
+   --yield-every <n>
+      Yield the goroutine running the module every n system calls,
+      to share the host fairly between instances (default: 0, only
+      when the module calls sched_yield)
+
+   --parallel-workers <n>
+      Number of workers running the kernels of modules using
+      wasi-parallel concurrently (default: number of CPUs)
+
+   --dry-run
+      Apply changes made by the module to the mounted directories
+      to an in-memory overlay only, and print the list of changes
+      when the module exits
+
+   --deterministic
+      Make the execution of the module reproducible: clocks are
+      virtual and only advanced by poll timeouts, random bytes are
+      generated from a seed, and directory entries are sorted
+
+   --seed <N>
+      Seed of the random source in deterministic mode (default: 0)
+
+   --on-suspend <POLICY>
+      Behavior of the monotonic clock and timeouts when the host is
+      suspended, either {pause} to stop the clock and delay timeouts,
+      or {fire} to keep the clock running and fire the timeouts that
+      expired when the host resumes (default: pause)
+
+   --signal-action <SIGNAL=ACTION>
+      Action taken when the module raises SIGNAL with proc_raise
+      (e.g. SIGUSR1=ignore), either {default, terminate, ignore};
+      terminated modules exit with 128 plus the number of the
+      signal (e.g. 134 for SIGABRT). This option can be repeated
+
+   --record <FILE>
+      Record the system calls made by the module and their results
+      to a file, which can be replayed with --replay
+
+   --replay <FILE>
+      Replay the system calls recorded with --record instead of
+      accessing the host, to reproduce the execution of the module
+
+   --windows-paths
+      Translate Windows-style paths used by the module (with
+      backslashes and drive letters) to paths of the mounted
+      directories
+
+   --signal-grace <DURATION>
+      Time given to the module to exit after wasirun receives SIGINT
+      or SIGTERM, before the module is forcefully terminated. Blocking
+      calls made by the module are canceled when the first signal is
+      received, a second signal terminates the module immediately
+      (default: 5s)
+
+   --watch
+      Restart the module each time the module file changes
+
+   --watch-dirs
+      When --watch is set, also restart the module when files in
+      the directories granted with --dir change
+
    --http <MODE>
       Optionally enable wasi-http client support and select a
       version {none, auto, v1}
@@ -77,45 +330,192 @@ OPTIONS:
 }
 
 var (
-	envInherit       bool
-	envs             stringList
-	dirs             stringList
-	listens          stringList
-	dials            stringList
-	dnsServer        string
-	socketExt        string
-	pprofAddr        string
-	wasiHttp         string
-	trace            bool
-	nonBlockingStdio bool
-	version          bool
+	envInherit        bool
+	envs              stringList
+	dirs              stringList
+	preloads          stringList
+	invoke            string
+	checksum          string
+	instances         int
+	coreDump          string
+	profileCPU        string
+	memoryReport      bool
+	listens           stringList
+	dials             stringList
+	publish           stringList
+	maxConnections    int
+	maxBacklog        int
+	tlsListens        stringList
+	tlsCert           string
+	tlsKey            string
+	tlsDials          stringList
+	tlsCA             string
+	dnsServer         string
+	proxyURL          string
+	socketExt         string
+	engine            string
+	pprofAddr         string
+	metricsAddr       string
+	manageSocket      string
+	wasiHttp          string
+	trace             traceFlag
+	traceFilter       string
+	traceOutput       string
+	traceMaxSize      string
+	traceMaxFiles     int
+	policyFile        string
+	denyPaths         stringList
+	allowDials        stringList
+	allowCommands     stringList
+	childModules      bool
+	sharedMemorySize  string
+	audit             bool
+	nonBlockingStdio  bool
+	ioURing           bool
+	dirCache          int
+	yieldEvery        int
+	parallelWorkers   int
+	windowsPaths      bool
+	dryRun            bool
+	deterministic     bool
+	seed              int64
+	onSuspend         string
+	signalActionFlags stringList
+	suspendPolicy     wasi.SuspendPolicy
+	signalActions     map[wasi.Signal]wasi.SignalAction
+	recordFile        string
+	replayFile        string
+	signalGrace       time.Duration
+	watch             bool
+	watchDirs         bool
+	version           bool
 )
 
+// accessPolicy is the policy loaded from the file specified with --policy.
+var accessPolicy *wasi.Policy
+
+// resolver resolves the host names that the module connects to with the
+// server specified with --dns-server, or is nil to use the system resolver.
+var resolver func(context.Context, string) ([]net.IP, error)
+
+// outboundProxy is the proxy server specified with --proxy, or nil.
+var outboundProxy *url.URL
+
+// portMappings are the mappings specified with --publish.
+var portMappings []wasi.PortMapping
+
+// tlsConfig is the configuration of the --listen-tls sockets.
+var tlsConfig *tls.Config
+
+// tlsDialConfig is the configuration of the --dial-tls connections, or nil
+// to use the default.
+var tlsDialConfig *tls.Config
+
+// wrappers are the wasi.System wrappers applied to the system of each run.
+var wrappers []func(wasi.System) wasi.System
+
+var memoryMonitor *wasirun.MemoryMonitor
+
+// traceWriter is where the trace is written, either stderr or the file
+// specified with --trace-output.
+var traceWriter io.Writer = os.Stderr
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-abi" {
+		if err := checkABI(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		if err := runDaemon(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "wasi-testsuite" {
+		if err := runTestSuite(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flagSet := flag.NewFlagSet("wasirun", flag.ExitOnError)
 	flagSet.Usage = printUsage
 
 	flagSet.BoolVar(&envInherit, "env-inherit", false, "")
 	flagSet.Var(&envs, "env", "")
 	flagSet.Var(&dirs, "dir", "")
+	flagSet.Func("mapdir", "", func(value string) error {
+		guest, host, ok := strings.Cut(value, "::")
+		if !ok {
+			return fmt.Errorf("invalid directory mapping '%s', expected GUEST::HOST", value)
+		}
+		return dirs.Set(host + ":" + guest)
+	})
+	flagSet.Var(&preloads, "preload", "")
+	flagSet.StringVar(&invoke, "invoke", "", "")
+	flagSet.StringVar(&checksum, "sha256", "", "")
+	flagSet.IntVar(&instances, "instances", 1, "")
+	flagSet.StringVar(&coreDump, "coredump-on-trap", "", "")
+	flagSet.StringVar(&profileCPU, "profile-cpu", "", "")
+	flagSet.BoolVar(&memoryReport, "memory-report", false, "")
 	flagSet.Var(&listens, "listen", "")
+	flagSet.Var(&listens, "tcplisten", "")
 	flagSet.Var(&dials, "dial", "")
+	flagSet.Var(&publish, "publish", "")
+	flagSet.IntVar(&maxConnections, "max-connections", 0, "")
+	flagSet.IntVar(&maxBacklog, "max-backlog", 0, "")
+	flagSet.Var(&tlsListens, "listen-tls", "")
+	flagSet.StringVar(&tlsCert, "tls-cert", "", "")
+	flagSet.StringVar(&tlsKey, "tls-key", "", "")
+	flagSet.Var(&tlsDials, "dial-tls", "")
+	flagSet.StringVar(&tlsCA, "tls-ca", "", "")
 	flagSet.StringVar(&dnsServer, "dns-server", "", "")
+	flagSet.StringVar(&proxyURL, "proxy", "", "")
 	flagSet.StringVar(&socketExt, "sockets", "auto", "")
+	flagSet.StringVar(&engine, "engine", "auto", "")
 	flagSet.StringVar(&pprofAddr, "pprof-addr", "", "")
+	flagSet.StringVar(&metricsAddr, "metrics-addr", "", "")
+	flagSet.StringVar(&manageSocket, "manage-socket", "", "")
 	flagSet.StringVar(&wasiHttp, "http", "auto", "")
-	flagSet.BoolVar(&trace, "trace", false, "")
+	flagSet.Var(&trace, "trace", "")
+	flagSet.StringVar(&traceFilter, "trace-filter", "", "")
+	flagSet.StringVar(&traceOutput, "trace-output", "", "")
+	flagSet.StringVar(&traceMaxSize, "trace-max-size", "", "")
+	flagSet.IntVar(&traceMaxFiles, "trace-max-files", 3, "")
+	flagSet.StringVar(&policyFile, "policy", "", "")
+	flagSet.Var(&denyPaths, "deny-path", "")
+	flagSet.Var(&allowDials, "allow-dial", "")
+	flagSet.Var(&allowCommands, "allow-command", "")
+	flagSet.BoolVar(&childModules, "child-modules", false, "")
+	flagSet.StringVar(&sharedMemorySize, "shared-memory", "", "")
+	flagSet.BoolVar(&audit, "audit", false, "")
 	flagSet.BoolVar(&nonBlockingStdio, "non-blocking-stdio", false, "")
+	flagSet.BoolVar(&ioURing, "io-uring", false, "")
+	flagSet.IntVar(&dirCache, "dir-cache", 0, "")
+	flagSet.IntVar(&yieldEvery, "yield-every", 0, "")
+	flagSet.IntVar(&parallelWorkers, "parallel-workers", 0, "")
+	flagSet.BoolVar(&windowsPaths, "windows-paths", false, "")
+	flagSet.BoolVar(&dryRun, "dry-run", false, "")
+	flagSet.BoolVar(&deterministic, "deterministic", false, "")
+	flagSet.Int64Var(&seed, "seed", 0, "")
+	flagSet.StringVar(&onSuspend, "on-suspend", "pause", "")
+	flagSet.Var(&signalActionFlags, "signal-action", "")
+	flagSet.StringVar(&recordFile, "record", "", "")
+	flagSet.StringVar(&replayFile, "replay", "", "")
+	flagSet.DurationVar(&signalGrace, "signal-grace", 5*time.Second, "")
+	flagSet.BoolVar(&watch, "watch", false, "")
+	flagSet.BoolVar(&watchDirs, "watch-dirs", false, "")
 	flagSet.BoolVar(&version, "version", false, "")
 	flagSet.BoolVar(&version, "v", false, "")
 	flagSet.Parse(os.Args[1:])
 
 	if version {
-		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" {
-			fmt.Println("wasirun", info.Main.Version)
-		} else {
-			fmt.Println("wasirun", "devel")
-		}
+		fmt.Println("wasirun", wasirunVersion())
 		os.Exit(0)
 	}
 
@@ -125,102 +525,431 @@ func main() {
 		os.Exit(1)
 	}
 
+	policy, err := wasi.ParseSuspendPolicy(onSuspend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: --on-suspend: %v\n", err)
+		os.Exit(1)
+	}
+	suspendPolicy = policy
+
+	for _, s := range signalActionFlags {
+		name, value, _ := strings.Cut(s, "=")
+		signal, err := wasi.ParseSignal(name)
+		if err == nil {
+			var action wasi.SignalAction
+			action, err = wasi.ParseSignalAction(value)
+			if signalActions == nil {
+				signalActions = make(map[wasi.Signal]wasi.SignalAction)
+			}
+			signalActions[signal] = action
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --signal-action: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if policyFile != "" {
+		b, err := os.ReadFile(policyFile)
+		if err == nil {
+			accessPolicy, err = wasi.ParsePolicy(b)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --policy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Like wasmtime, variables given by name only take their value on the
+	// host, and are omitted when they are not set.
+	explicitEnvs := envs[:0]
+	for _, env := range envs {
+		if !strings.Contains(env, "=") {
+			value, ok := os.LookupEnv(env)
+			if !ok {
+				continue
+			}
+			env += "=" + value
+		}
+		explicitEnvs = append(explicitEnvs, env)
+	}
+	envs = explicitEnvs
+
 	if envInherit {
-		envs = append(append([]string{}, os.Environ()...), envs...)
+		// Sockets passed by systemd are preopened for the module, the
+		// variables describing them only apply to this process.
+		var inherited []string
+		for _, env := range os.Environ() {
+			if !sockets.IsActivationEnv(env) {
+				inherited = append(inherited, env)
+			}
+		}
+		envs = append(inherited, envs...)
 	}
 
 	if dnsServer != "" {
-		_, dnsServerPort, _ := net.SplitHostPort(dnsServer)
-		net.DefaultResolver.PreferGo = true
-		net.DefaultResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-			var d net.Dialer
-			if dnsServerPort != "" {
-				address = dnsServer
-			} else {
-				_, port, err := net.SplitHostPort(address)
-				if err != nil {
-					return nil, net.InvalidAddrError(address)
-				}
-				address = net.JoinHostPort(dnsServer, port)
+		resolver = dnsServerResolver(dnsServer)
+	}
+
+	for _, p := range publish {
+		m, err := wasi.ParsePortMapping(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --publish: %v\n", err)
+			os.Exit(1)
+		}
+		portMappings = append(portMappings, m)
+	}
+
+	if len(tlsListens) > 0 {
+		if tlsCert == "" || tlsKey == "" {
+			fmt.Fprintf(os.Stderr, "error: --listen-tls requires --tls-cert and --tls-key\n")
+			os.Exit(1)
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --tls-cert: %v\n", err)
+			os.Exit(1)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if tlsCA != "" {
+		b, err := os.ReadFile(tlsCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --tls-ca: %v\n", err)
+			os.Exit(1)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			fmt.Fprintf(os.Stderr, "error: --tls-ca: no certificates found in %s\n", tlsCA)
+			os.Exit(1)
+		}
+		tlsDialConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if proxyURL != "" {
+		outboundProxy, err = proxy.Parse(proxyURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --proxy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if memoryReport || pprofAddr != "" || metricsAddr != "" {
+		memoryMonitor = wasirun.NewMemoryMonitor()
+	}
+
+	if pprofAddr != "" {
+		http.Handle("/debug/pprof/wasm_memory", memoryMonitor)
+		go http.ListenAndServe(pprofAddr, nil)
+	}
+
+	if metricsAddr != "" {
+		metrics, err := promwasi.NewMetrics(prometheus.DefaultRegisterer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		wrappers = append(wrappers, metrics.Instrument)
+		if err := registerMemoryMetrics(prometheus.DefaultRegisterer, memoryMonitor); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go http.ListenAndServe(metricsAddr, mux)
+	}
+
+	if manageSocket != "" {
+		management = newManager()
+		// Install the tracer so it can be enabled at runtime, but only
+		// enable it if it was requested on the command line.
+		if trace == "" {
+			trace = "text"
+			management.trace.Disable()
+		}
+		l, err := management.listen(manageSocket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+	}
+
+	if traceOutput != "" {
+		var maxSize int64
+		if traceMaxSize != "" {
+			size, err := parseSize(traceMaxSize)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: --trace-max-size: %v\n", err)
+				os.Exit(1)
 			}
-			return d.DialContext(ctx, network, address)
+			maxSize = size
+		}
+		f, err := openTraceFile(traceOutput, maxSize, traceMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
 		}
+		defer f.Close()
+		traceWriter = f
 	}
 
-	if err := run(args[0], args[1:]); err != nil {
+	ctx := handleSignals(context.Background(), signalGrace)
+
+	if watch {
+		if err := runWatch(ctx, args[0], args[1:]); err != nil {
+			if exitCode, ok := interruptExitCode(); ok {
+				os.Exit(exitCode)
+			}
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(ctx, args[0], args[1:]); err != nil {
+		if instances > 1 {
+			exitCode := reportInstanceErrors(err)
+			if code, ok := interruptExitCode(); ok {
+				exitCode = code
+			}
+			os.Exit(exitCode)
+		}
 		if exitErr, ok := err.(*sys.ExitError); ok {
-			os.Exit(int(exitErr.ExitCode()))
+			switch exitErr.ExitCode() {
+			case sys.ExitCodeContextCanceled, sys.ExitCodeDeadlineExceeded:
+			default:
+				os.Exit(int(exitErr.ExitCode()))
+			}
+		}
+		if exitCode, ok := interruptExitCode(); ok {
+			os.Exit(exitCode)
 		}
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run(wasmFile string, args []string) error {
-	wasmName := filepath.Base(wasmFile)
-	wasmCode, err := os.ReadFile(wasmFile)
-	if err != nil {
-		return fmt.Errorf("could not read WASM file '%s': %w", wasmFile, err)
+// reportInstanceErrors prints the errors of the instances run with
+// --instances, and returns the exit code of wasirun, which is the exit code of
+// the first instance which failed, or 1 if it did not exit.
+func reportInstanceErrors(err error) int {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
 	}
-
-	if len(args) > 0 && args[0] == "--" {
-		args = args[1:]
+	exitCode := 0
+	for _, err := range errs {
+		instance := -1
+		var instanceErr *wasirun.InstanceError
+		if errors.As(err, &instanceErr) {
+			instance, err = instanceErr.Instance, instanceErr.Err
+		}
+		code := 1
+		if exitErr, ok := err.(*sys.ExitError); ok {
+			code = int(exitErr.ExitCode())
+			fmt.Fprintf(os.Stderr, "wasirun: instance %d exited with code %d\n", instance, code)
+		} else if instance >= 0 {
+			fmt.Fprintf(os.Stderr, "wasirun: instance %d: error: %v\n", instance, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		if exitCode == 0 {
+			exitCode = code
+		}
 	}
+	fmt.Fprintf(os.Stderr, "wasirun: %d of %d instances failed\n", len(errs), instances)
+	return exitCode
+}
 
-	if pprofAddr != "" {
-		go http.ListenAndServe(pprofAddr, nil)
+func wasirunVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" {
+		return info.Main.Version
 	}
+	return "devel"
+}
 
-	ctx := context.Background()
-	runtime := wazero.NewRuntime(ctx)
-	defer runtime.Close(ctx)
-
-	wasmModule, err := runtime.CompileModule(ctx, wasmCode)
-	if err != nil {
-		return err
-	}
-	defer wasmModule.Close(ctx)
-
-	builder := imports.NewBuilder().
-		WithName(wasmName).
-		WithArgs(args...).
-		WithEnv(envs...).
-		WithDirs(dirs...).
-		WithListens(listens...).
-		WithDials(dials...).
-		WithNonBlockingStdio(nonBlockingStdio).
-		WithSocketsExtension(socketExt, wasmModule).
-		WithTracer(trace, os.Stderr)
-
-	var system wasi.System
-	ctx, system, err = builder.Instantiate(ctx, runtime)
-	if err != nil {
-		return err
-	}
-	defer system.Close(ctx)
-
-	importWasi := false
-	switch wasiHttp {
-	case "auto":
-		importWasi = wasi_http.DetectWasiHttp(wasmModule)
-	case "v1":
-		importWasi = true
-	case "none":
-		importWasi = false
-	default:
-		return fmt.Errorf("invalid value for -http '%v', expected 'auto', 'v1' or 'none'", wasiHttp)
+func run(ctx context.Context, wasmFile string, args []string) error {
+	var record io.Writer
+	if recordFile != "" {
+		f, err := os.Create(recordFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		record = f
 	}
-	if importWasi {
-		if err := wasi_http.Instantiate(ctx, runtime); err != nil {
+	var replay io.Reader
+	if replayFile != "" {
+		f, err := os.Open(replayFile)
+		if err != nil {
 			return err
 		}
+		defer f.Close()
+		replay = f
+	}
+	wrappers := wrappers
+	var traceSwitch *wasi.TraceSwitch
+	if management != nil {
+		instance := management.register(wasmFile, args)
+		defer management.unregister(instance)
+		wrappers = append(wrappers[:len(wrappers):len(wrappers)], func(s wasi.System) wasi.System {
+			return wasi.Summarize(s, &instance.summary)
+		})
+		traceSwitch = &management.trace
+	}
+	if memoryReport {
+		defer func() { memoryMonitor.Report().WriteTo(os.Stderr) }()
+	}
+	var sharedMemory *wasi.SharedMemory
+	if sharedMemorySize != "" {
+		size, err := parseSize(sharedMemorySize)
+		if err != nil {
+			return fmt.Errorf("--shared-memory: %w", err)
+		}
+		sharedMemory = wasi.NewSharedMemory(wasi.SharedMemoryLimits{MaxTotalSize: size})
+	}
+	var auditLog func(context.Context, wasi.Denial)
+	if audit {
+		auditLog = func(ctx context.Context, denial wasi.Denial) {
+			fmt.Fprintf(os.Stderr, "audit: %s\n", denial)
+		}
 	}
+	return wasirun.Run(ctx, wasirun.Options{
+		Module:           wasmFile,
+		SHA256:           checksum,
+		Instances:        instances,
+		CoreDump:         coreDump,
+		ProfileCPU:       profileCPU,
+		MemoryMonitor:    memoryMonitor,
+		Args:             args,
+		Invoke:           invoke,
+		Env:              envs,
+		Dirs:             dirs,
+		Preloads:         preloads,
+		Listens:          listens,
+		Dials:            dials,
+		Publish:          portMappings,
+		SocketActivation: os.Getenv("LISTEN_FDS") != "",
+		ConnectionLimits: wasi.ConnectionLimits{
+			MaxConnections: maxConnections,
+			MaxBacklog:     maxBacklog,
+		},
+		TLSListens:       tlsListens,
+		TLSConfig:        tlsConfig,
+		TLSDials:         tlsDials,
+		TLSDialConfig:    tlsDialConfig,
+		Resolver:         resolver,
+		Proxy:            outboundProxy,
+		Sockets:          socketExt,
+		Engine:           engine,
+		HTTP:             wasiHttp,
+		Trace:            string(trace),
+		TraceFilter:      traceFilter,
+		TraceSwitch:      traceSwitch,
+		TraceOutput:      traceWriter,
+		NonBlockingStdio: nonBlockingStdio,
+		IOURing:          ioURing,
+		DirCache:         dirCache,
+		YieldEvery:       yieldEvery,
+		ParallelWorkers:  parallelWorkers,
+		WindowsPaths:     windowsPaths,
+		DryRun:           dryRun,
+		Deterministic:    deterministic,
+		Seed:             seed,
+		SuspendPolicy:    suspendPolicy,
+		SignalActions:    signalActions,
+		Record:           record,
+		Replay:           replay,
+		Policy:           accessPolicy,
+		DenyPaths:        denyPaths,
+		AllowDials:       allowDials,
+		Commands:         allowCommands,
+		ChildModules:     childModules,
+		SharedMemory:     sharedMemory,
+		Audit:            auditLog,
+		Wrappers:         wrappers,
+		Interrupt:        interrupted,
+	})
+}
 
-	instance, err := runtime.InstantiateModule(ctx, wasmModule, wazero.NewModuleConfig())
-	if err != nil {
-		return err
+// registerMemoryMetrics registers the metrics of the memory usage sampled by
+// the monitor against registerer.
+func registerMemoryMetrics(registerer prometheus.Registerer, monitor *wasirun.MemoryMonitor) error {
+	for _, c := range []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "wasirun",
+			Name:      "linear_memory_bytes",
+			Help:      "Size of the linear memories of the running instances.",
+		}, func() float64 { return float64(monitor.LinearMemory()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "wasirun",
+			Name:      "host_memory_bytes",
+			Help:      "Memory allocated by the host, excluding the linear memories.",
+		}, func() float64 { return float64(monitor.Report().HostMemory) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "wasirun",
+			Name:      "host_memory_peak_bytes",
+			Help:      "Peak of the memory allocated by the host, excluding the linear memories.",
+		}, func() float64 { return float64(monitor.Report().PeakHostMemory) }),
+	} {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
 	}
-	return instance.Close(ctx)
+	return nil
+}
+
+// dnsServerResolver returns a function resolving host names with the DNS
+// server at addr. The port defaults to the one of the system configuration
+// when addr only has a host.
+func dnsServerResolver(addr string) func(context.Context, string) ([]net.IP, error) {
+	_, port, _ := net.SplitHostPort(addr)
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			if port != "" {
+				address = addr
+			} else {
+				_, port, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, net.InvalidAddrError(address)
+				}
+				address = net.JoinHostPort(addr, port)
+			}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	return func(ctx context.Context, name string) ([]net.IP, error) {
+		return r.LookupIP(ctx, "ip", name)
+	}
+}
+
+// traceFlag is the value of the --trace flag, which can either be used as a
+// boolean flag or be given the name of the trace format.
+type traceFlag string
+
+func (t traceFlag) String() string {
+	return string(t)
+}
+
+func (t *traceFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*t = "text"
+	case "false":
+		*t = ""
+	default:
+		*t = traceFlag(value)
+	}
+	return nil
+}
+
+func (t traceFlag) IsBoolFlag() bool {
+	return true
 }
 
 type stringList []string
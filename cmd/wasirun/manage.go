@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+)
+
+// management is the state exposed by the management API, or nil when the
+// API is disabled.
+var management *manager
+
+// manager tracks the module instances run by wasirun, and serves the
+// management API on a unix socket.
+//
+// The API is made of the following endpoints:
+//
+//	GET  /instances   list the running instances
+//	GET  /stats       system call statistics of each instance (?format=text
+//	                  for tables similar to --trace=summary)
+//	GET  /trace       report whether tracing is enabled
+//	POST /trace       enable or disable tracing (?enabled=true|false)
+//	POST /drain       ask the instances to exit, like SIGTERM
+//
+// For example:
+//
+//	curl --unix-socket wasirun.sock http://wasirun/instances
+type manager struct {
+	mutex     sync.Mutex
+	nextID    int
+	instances map[int]*managedInstance
+	trace     wasi.TraceSwitch
+}
+
+type managedInstance struct {
+	id      int
+	module  string
+	args    []string
+	started time.Time
+	summary wasi.SyscallSummary
+}
+
+func newManager() *manager {
+	return &manager{instances: make(map[int]*managedInstance)}
+}
+
+func (m *manager) register(module string, args []string) *managedInstance {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nextID++
+	i := &managedInstance{
+		id:      m.nextID,
+		module:  module,
+		args:    args,
+		started: time.Now(),
+	}
+	m.instances[i.id] = i
+	return i
+}
+
+func (m *manager) unregister(i *managedInstance) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.instances, i.id)
+}
+
+func (m *manager) list() []*managedInstance {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	instances := make([]*managedInstance, 0, len(m.instances))
+	for _, i := range m.instances {
+		instances = append(instances, i)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].id < instances[j].id
+	})
+	return instances
+}
+
+// listen starts serving the management API on a unix socket at path.
+func (m *manager) listen(path string) (io.Closer, error) {
+	l, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instances", m.handleInstances)
+	mux.HandleFunc("/stats", m.handleStats)
+	mux.HandleFunc("/trace", m.handleTrace)
+	mux.HandleFunc("/drain", m.handleDrain)
+	go http.Serve(l, mux)
+	return l, nil
+}
+
+func (m *manager) handleInstances(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	type instance struct {
+		ID      int       `json:"id"`
+		Module  string    `json:"module"`
+		Args    []string  `json:"args"`
+		Started time.Time `json:"started"`
+		Uptime  float64   `json:"uptime_s"`
+	}
+	instances := []instance{}
+	for _, i := range m.list() {
+		instances = append(instances, instance{
+			ID:      i.id,
+			Module:  i.module,
+			Args:    i.args,
+			Started: i.started,
+			Uptime:  time.Since(i.started).Seconds(),
+		})
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func (m *manager) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, i := range m.list() {
+			fmt.Fprintf(w, "instance %d (%s)\n", i.id, i.module)
+			i.summary.WriteTo(w)
+			fmt.Fprintln(w)
+		}
+		return
+	}
+	type syscall struct {
+		Syscall string  `json:"syscall"`
+		Calls   int     `json:"calls"`
+		Errors  int     `json:"errors"`
+		Time    float64 `json:"time_s"`
+	}
+	type instance struct {
+		ID       int       `json:"id"`
+		Syscalls []syscall `json:"syscalls"`
+	}
+	instances := []instance{}
+	for _, i := range m.list() {
+		stats := i.summary.Stats()
+		syscalls := make([]syscall, len(stats))
+		for j, st := range stats {
+			syscalls[j] = syscall{
+				Syscall: st.Syscall,
+				Calls:   st.Calls,
+				Errors:  st.Errors,
+				Time:    st.Time.Seconds(),
+			}
+		}
+		instances = append(instances, instance{ID: i.id, Syscalls: syscalls})
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func (m *manager) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "invalid value of the enabled parameter, expected true or false", http.StatusBadRequest)
+			return
+		}
+		if enabled {
+			m.trace.Enable()
+		} else {
+			m.trace.Disable()
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": m.trace.Enabled()})
+}
+
+func (m *manager) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	interrupt()
+	writeJSON(w, http.StatusAccepted, map[string]bool{"draining": true})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	for _, method := range methods {
+		w.Header().Add("Allow", method)
+	}
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
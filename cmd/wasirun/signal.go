@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// interrupted is closed when wasirun receives SIGINT or SIGTERM. Instances
+// watch this channel to shut down their system, which causes blocking calls
+// such as poll_oneoff to return ECANCELED and gives the guest a chance to
+// flush its state and exit on its own.
+var interrupted = make(chan struct{})
+
+var interruptOnce sync.Once
+
+// interrupt closes the interrupted channel, asking the instances to exit.
+func interrupt() {
+	interruptOnce.Do(func() { close(interrupted) })
+}
+
+// interruptSignal is the signal that closed the interrupted channel.
+var interruptSignal atomic.Value
+
+// handleSignals installs the signal handlers and returns a context which is
+// canceled when the guest did not exit within the grace period following the
+// first signal, or immediately when a second signal is received.
+func handleSignals(ctx context.Context, grace time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		// The instances may also be asked to exit by the management API,
+		// in which case the same grace period applies.
+		reason := "being drained"
+		select {
+		case sig := <-signals:
+			interruptSignal.Store(sig)
+			interrupt()
+			reason = "receiving " + sig.String()
+		case <-interrupted:
+		}
+
+		if grace > 0 {
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			select {
+			case <-signals:
+			case <-timer.C:
+				fmt.Fprintf(os.Stderr, "wasirun: module did not exit within %s of %s\n", grace, reason)
+			}
+		}
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	return ctx
+}
+
+// interruptExitCode returns the exit code that the shell convention assigns
+// to processes terminated by a signal, and whether a signal was received.
+func interruptExitCode() (int, bool) {
+	sig, ok := interruptSignal.Load().(syscall.Signal)
+	if !ok {
+		return 0, false
+	}
+	return 128 + int(sig), true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/stealthrocket/wasi-go/internal/testsuite"
+)
+
+func printTestSuiteUsage() {
+	fmt.Printf(`wasirun wasi-testsuite - Run test suites of WebAssembly/wasi-testsuite
+
+USAGE:
+   wasirun wasi-testsuite [OPTIONS]... <SUITE>...
+
+ARGS:
+   <SUITE>...
+      The paths of the test suite directories, each containing the
+      WebAssembly modules of the tests and their JSON specification
+      (e.g. tests/c/testsuite)
+
+OPTIONS:
+   --exclude <FILE>
+      Skip the tests listed in a JSON file mapping test names to the
+      reason they are excluded; may be repeated
+
+   --json-output <FILE>
+      Write the report of the test results in JSON format
+
+   -h, --help
+      Show this usage information
+
+The tests are run by the wasirun command, with the arguments, environment
+variables and directories described in the specification of each test. The
+command exits with a non-zero status if any of the tests failed.
+`)
+}
+
+type testResult struct {
+	Name     string              `json:"name"`
+	Executed bool                `json:"executed"`
+	Duration float64             `json:"duration_s"`
+	Failures []testsuite.Failure `json:"failures"`
+}
+
+type testSuiteResult struct {
+	Name     string       `json:"name"`
+	Duration float64      `json:"duration_s"`
+	Failed   int          `json:"failed"`
+	Passed   int          `json:"passed"`
+	Skipped  int          `json:"skipped"`
+	Tests    []testResult `json:"tests"`
+}
+
+type testReport struct {
+	Runtime struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"runtime"`
+	Results []testSuiteResult `json:"results"`
+}
+
+func runTestSuite(args []string) error {
+	var excludes stringList
+	var jsonOutput string
+
+	flagSet := flag.NewFlagSet("wasirun wasi-testsuite", flag.ExitOnError)
+	flagSet.Usage = printTestSuiteUsage
+	flagSet.Var(&excludes, "exclude", "")
+	flagSet.StringVar(&jsonOutput, "json-output", "", "")
+	flagSet.Parse(args)
+
+	args = flagSet.Args()
+	if len(args) == 0 {
+		printTestSuiteUsage()
+		os.Exit(1)
+	}
+
+	excluded := make(map[string]string)
+	for _, path := range excludes {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &excluded); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	wasirun, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	report := testReport{}
+	report.Runtime.Name = "wasirun"
+	report.Runtime.Version = wasirunVersion()
+
+	failed := 0
+	for _, dir := range args {
+		suite, err := runTests(wasirun, dir, excluded)
+		if err != nil {
+			return err
+		}
+		printTestSuiteResult(os.Stdout, suite)
+		report.Results = append(report.Results, *suite)
+		failed += suite.Failed
+	}
+
+	if jsonOutput != "" {
+		b, err := json.MarshalIndent(&report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(jsonOutput, append(b, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d test(s) failed", failed)
+	}
+	return nil
+}
+
+func runTests(wasirun, dir string, excluded map[string]string) (*testSuiteResult, error) {
+	name, err := testsuite.Name(dir)
+	if err != nil {
+		return nil, err
+	}
+	tests, err := testsuite.Tests(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := &testSuiteResult{Name: name}
+	start := time.Now()
+	for _, name := range tests {
+		if _, skip := excluded[name]; skip {
+			suite.Tests = append(suite.Tests, testResult{Name: name, Failures: []testsuite.Failure{}})
+			suite.Skipped++
+			continue
+		}
+
+		result, err := runTest(wasirun, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		suite.Tests = append(suite.Tests, *result)
+		if len(result.Failures) > 0 {
+			suite.Failed++
+		} else {
+			suite.Passed++
+		}
+	}
+	suite.Duration = time.Since(start).Seconds()
+	return suite, nil
+}
+
+func runTest(wasirun, dir, name string) (*testResult, error) {
+	spec, err := testsuite.ReadSpec(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, d := range spec.Dirs {
+		args = append(args, "--dir", d)
+	}
+	for _, env := range spec.Environ() {
+		args = append(args, "--env", env)
+	}
+	args = append(args, name+".wasm", "--")
+	args = append(args, spec.Args...)
+
+	stdout := new(bytes.Buffer)
+	cmd := exec.Command(wasirun, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	defer spec.Cleanup(dir)
+
+	start := time.Now()
+	err = cmd.Run()
+	duration := time.Since(start)
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	return &testResult{
+		Name:     name,
+		Executed: true,
+		Duration: duration.Seconds(),
+		Failures: spec.Compare(exitCode, stdout.String()),
+	}, nil
+}
+
+func printTestSuiteResult(w io.Writer, suite *testSuiteResult) {
+	fmt.Fprintf(w, "===== Test results =====\n")
+	fmt.Fprintf(w, "Suite: %s\n", suite.Name)
+	fmt.Fprintf(w, "  Total:   %d\n", len(suite.Tests))
+	fmt.Fprintf(w, "  Passed:  %d\n", suite.Passed)
+	fmt.Fprintf(w, "  Failed:  %d\n", suite.Failed)
+	fmt.Fprintf(w, "  Skipped: %d\n", suite.Skipped)
+	for _, test := range suite.Tests {
+		if len(test.Failures) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "Test %s failed\n", test.Name)
+		for _, failure := range test.Failures {
+			fmt.Fprintf(w, "  [%s] %s\n", failure.Type, failure.Message)
+		}
+	}
+	fmt.Fprintln(w)
+}
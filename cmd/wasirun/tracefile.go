@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// traceFile is an io.Writer appending trace output to a file, which is
+// rotated when its size exceeds a limit.
+//
+// Rotated files are renamed with a numeric suffix (trace.log.1 is the most
+// recent), and only the last maxFiles rotated files are kept. Rotation only
+// happens at line boundaries so that trace entries are never split across
+// two files.
+type traceFile struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+	newline  bool
+}
+
+func openTraceFile(path string, maxSize int64, maxFiles int) (*traceFile, error) {
+	t := &traceFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *traceFile) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.file, t.size, t.newline = f, s.Size(), true
+	return nil
+}
+
+func (t *traceFile) Write(b []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var rotateErr error
+	if t.maxSize > 0 && t.size >= t.maxSize && t.newline {
+		rotateErr = t.rotate()
+	}
+	n, err := t.file.Write(b)
+	t.size += int64(n)
+	if n > 0 {
+		t.newline = b[n-1] == '\n'
+	}
+	if rotateErr != nil {
+		return n, rotateErr
+	}
+	return n, err
+}
+
+// rotate renames the file and opens a new one. The file is reopened even if
+// it could not be renamed, so the trace keeps being written to it, and the
+// next rotation is attempted after maxSize more bytes were written, so the
+// error is returned once.
+func (t *traceFile) rotate() error {
+	err := t.file.Close()
+	if err == nil {
+		err = t.rename()
+	}
+	if openErr := t.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		t.size = 0
+	}
+	return err
+}
+
+func (t *traceFile) rename() error {
+	if t.maxFiles <= 0 {
+		return os.Remove(t.path)
+	}
+	for i := t.maxFiles - 1; i > 0; i-- {
+		os.Rename(t.rotatedPath(i), t.rotatedPath(i+1))
+	}
+	return os.Rename(t.path, t.rotatedPath(1))
+}
+
+func (t *traceFile) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", t.path, i)
+}
+
+func (t *traceFile) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.file.Close()
+}
+
+// parseSize parses a size in bytes, with an optional K, M, or G suffix
+// (powers of 1024).
+func parseSize(s string) (int64, error) {
+	scale := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		scale, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		scale, s = 1<<20, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "G"):
+		scale, s = 1<<30, strings.TrimSuffix(s, "G")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTraceFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.log")
+	f, err := openTraceFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Rotation happens at line boundaries, the line written in two parts is
+	// not split across files even though the first part exceeds the limit.
+	for _, line := range []string{"0123456789\n", "line ", "1\n", "line 2\n", "line 3\n", "line 4\n", "line 5\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		path    string
+		content string
+	}{
+		{path, "line 5\n"},
+		{path + ".1", "line 3\nline 4\n"},
+		{path + ".2", "line 1\nline 2\n"},
+	} {
+		if content := readFile(t, test.path); content != test.content {
+			t.Errorf("%s: wrong content: want=%q got=%q", test.path, test.content, content)
+		}
+	}
+	// Only the last maxFiles rotated files are kept.
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3: the oldest trace file was not removed: %v", path, err)
+	}
+}
+
+func TestTraceFileRotateError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.log")
+	f, err := openTraceFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The file cannot be renamed onto a directory which is not empty.
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("0123456789\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The error of the rotation is returned once, the trace keeps being
+	// written to the file.
+	if _, err := f.Write([]byte("line 1\n")); err == nil {
+		t.Error("the rotation of the trace file did not fail")
+	}
+	if _, err := f.Write([]byte("line 2\n")); err != nil {
+		t.Errorf("the trace file was not reopened after the rotation failed: %v", err)
+	}
+	if content, want := readFile(t, path), "0123456789\nline 1\nline 2\n"; content != want {
+		t.Errorf("wrong content: want=%q got=%q", want, content)
+	}
+
+	// The rotation is attempted again after maxSize more bytes.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("line 3\n")); err != nil {
+		t.Fatal(err)
+	}
+	if content, want := readFile(t, path), "line 3\n"; content != want {
+		t.Errorf("wrong content after rotation: want=%q got=%q", want, content)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// watchInterval is the period at which watched files are checked for changes.
+//
+// Polling keeps the implementation portable and free of dependencies; the
+// interval is short enough to feel instantaneous in an edit-compile-run loop.
+const watchInterval = 250 * time.Millisecond
+
+// runWatch runs the module, restarting it each time the module file (and the
+// mounted directories when --watch-dirs is set) changes. It only returns when
+// the module file cannot be watched anymore, or wasirun was interrupted.
+func runWatch(ctx context.Context, wasmFile string, args []string) error {
+	paths := []string{wasmFile}
+	if watchDirs {
+		for _, dir := range dirs {
+			dir, _, _ = strings.Cut(strings.TrimSuffix(dir, ":ro"), ":")
+			paths = append(paths, dir)
+		}
+	}
+
+	snapshot, err := watchSnapshot(paths)
+	if err != nil {
+		return err
+	}
+
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() { done <- run(runCtx, wasmFile, args) }()
+
+		running := true
+		for running {
+			select {
+			case err := <-done:
+				running = false
+				reportWatchExit(err)
+				// Do not restart the module after it was asked to exit.
+				select {
+				case <-interrupted:
+					cancel()
+					return nil
+				default:
+				}
+				// Wait for the next change before restarting the module.
+				if snapshot, err = watchChange(ctx, paths, snapshot); err != nil {
+					cancel()
+					return err
+				}
+			case <-time.After(watchInterval):
+				next, err := watchSnapshot(paths)
+				if err != nil {
+					// The file may be in the middle of being rewritten by
+					// the compiler, try again on the next tick.
+					continue
+				}
+				if next == snapshot {
+					continue
+				}
+				snapshot = next
+				running = false
+				cancel()
+				<-done
+			}
+		}
+		cancel()
+		fmt.Fprintf(os.Stderr, "wasirun: change detected, restarting %s\n", filepath.Base(wasmFile))
+	}
+}
+
+// watchChange blocks until the snapshot of the watched paths differs from
+// the one passed as argument, and returns the new snapshot.
+func watchChange(ctx context.Context, paths []string, snapshot string) (string, error) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return snapshot, ctx.Err()
+		case <-interrupted:
+			return snapshot, context.Canceled
+		case <-ticker.C:
+			next, err := watchSnapshot(paths)
+			if err == nil && next != snapshot {
+				return next, nil
+			}
+		}
+	}
+}
+
+// watchSnapshot returns a string summarizing the size and modification time
+// of all files under the given paths; two snapshots are different if any of
+// the files were created, removed, or modified.
+func watchSnapshot(paths []string) (string, error) {
+	var b strings.Builder
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "%s:%d:%d\n", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("unable to watch %q: %w", path, err)
+		}
+	}
+	return b.String(), nil
+}
+
+func reportWatchExit(err error) {
+	var exitErr *sys.ExitError
+	switch {
+	case err == nil:
+		fmt.Fprintf(os.Stderr, "wasirun: module exited, waiting for changes\n")
+	case errors.As(err, &exitErr):
+		fmt.Fprintf(os.Stderr, "wasirun: module exited with code %d, waiting for changes\n", exitErr.ExitCode())
+	default:
+		fmt.Fprintf(os.Stderr, "wasirun: error: %v, waiting for changes\n", err)
+	}
+}
@@ -0,0 +1,103 @@
+package wasi
+
+import (
+	"context"
+	"sync"
+)
+
+// ConnectionLimits configures the limits that LimitConnections applies to the
+// sockets of guests. Zero values mean that there is no limit.
+type ConnectionLimits struct {
+	// MaxConnections is the maximum number of connections accepted by the
+	// guest which can be open at the same time.
+	MaxConnections int
+	// MaxBacklog is the maximum length of the queues of pending connections
+	// of the sockets that the guest listens on.
+	MaxBacklog int
+}
+
+// LimitConnections wraps a System to limit the connections that the guest
+// accepts, so a spike of traffic on one guest cannot exhaust the resources of
+// the host.
+//
+// The backlog passed to sock_listen is capped to MaxBacklog. When the guest
+// has MaxConnections accepted connections open, sock_accept leaves pending
+// connections in the queue of the listening socket, where they apply
+// backpressure on the clients, and fails with EAGAIN for non-blocking
+// sockets, or with EMFILE for blocking sockets, which would otherwise wait
+// for one of the connections to be closed by the guest itself. The limit does
+// not apply to the sockets that the guest connects.
+func LimitConnections(system System, limits ConnectionLimits) System {
+	return &connectionLimiter{
+		System:   system,
+		limits:   limits,
+		accepted: make(map[FD]struct{}),
+	}
+}
+
+type connectionLimiter struct {
+	System
+	limits ConnectionLimits
+	mutex  sync.Mutex
+	// accepted is the set of file descriptors of the accepted connections
+	// which are open.
+	accepted map[FD]struct{}
+}
+
+func (l *connectionLimiter) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	if l.limits.MaxBacklog > 0 && (backlog <= 0 || backlog > l.limits.MaxBacklog) {
+		backlog = l.limits.MaxBacklog
+	}
+	return l.System.SockListen(ctx, fd, backlog)
+}
+
+func (l *connectionLimiter) full() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limits.MaxConnections > 0 && len(l.accepted) >= l.limits.MaxConnections
+}
+
+func (l *connectionLimiter) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	if l.full() {
+		stat, errno := l.System.FDStatGet(ctx, fd)
+		if errno != ESUCCESS {
+			return -1, nil, nil, errno
+		}
+		if stat.Flags.Has(NonBlock) {
+			return -1, nil, nil, EAGAIN
+		}
+		return -1, nil, nil, EMFILE
+	}
+	newfd, peer, local, errno := l.System.SockAccept(ctx, fd, flags)
+	if errno == ESUCCESS {
+		l.mutex.Lock()
+		l.accepted[newfd] = struct{}{}
+		l.mutex.Unlock()
+	}
+	return newfd, peer, local, errno
+}
+
+func (l *connectionLimiter) FDClose(ctx context.Context, fd FD) Errno {
+	errno := l.System.FDClose(ctx, fd)
+	if errno == ESUCCESS {
+		l.mutex.Lock()
+		delete(l.accepted, fd)
+		l.mutex.Unlock()
+	}
+	return errno
+}
+
+func (l *connectionLimiter) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := l.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS && from != to {
+		l.mutex.Lock()
+		_, ok := l.accepted[from]
+		delete(l.accepted, from)
+		delete(l.accepted, to)
+		if ok {
+			l.accepted[to] = struct{}{}
+		}
+		l.mutex.Unlock()
+	}
+	return errno
+}
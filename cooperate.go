@@ -0,0 +1,62 @@
+package wasi
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Cooperate wraps a System to call yield when the guest calls sched_yield,
+// and before every n-th system call made by the guest since it last yielded
+// when n is positive. Embedders running many instances on a scheduler of
+// their own can use the hook to implement cooperative preemption, account
+// for the share of the host that each guest receives, or batch calls to
+// runtime.Gosched.
+//
+// The yield function replaces the sched_yield of the underlying system. When
+// it returns an error, the system call which triggered it fails with the
+// errno of the error, which allows the hook to interrupt guests (e.g. when
+// their context is canceled). The hook may be called concurrently if the
+// guest makes system calls from multiple threads.
+//
+// The wrapper intercepts the system calls (see Intercept), so it has a cost
+// when n is positive; n should be large enough to amortize the cost of the
+// hook across many system calls.
+func Cooperate(system System, n int, yield func(context.Context) error) System {
+	c := &cooperator{yield: yield}
+	if n > 0 {
+		c.every = uint64(n)
+	}
+	return Intercept(system, Hooks{Before: c.before})
+}
+
+type cooperator struct {
+	every uint64
+	calls atomic.Uint64
+	yield func(context.Context) error
+}
+
+func (c *cooperator) before(ctx context.Context, call *Call) {
+	if call.Syscall == "sched_yield" {
+		c.calls.Store(0)
+		call.Return(c.call(ctx))
+		return
+	}
+	if c.every == 0 {
+		return
+	}
+	if c.calls.Add(1)%c.every == 0 {
+		if errno := c.call(ctx); errno != ESUCCESS {
+			call.Return(errno)
+		}
+	}
+}
+
+func (c *cooperator) call(ctx context.Context) Errno {
+	if c.yield == nil {
+		return ESUCCESS
+	}
+	if err := c.yield(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	return ESUCCESS
+}
@@ -0,0 +1,89 @@
+package wasi
+
+import (
+	"context"
+	"sync"
+)
+
+// FileCopier is implemented by systems which can copy data between files on
+// the host, without passing it through the memory of the guest (e.g. with
+// sendfile(2) or splice(2) on Linux).
+type FileCopier interface {
+	// FDCopy copies up to size bytes from the current position of the file
+	// descriptor in to the file descriptor out, and returns the number of
+	// bytes copied, which is zero when in is at the end of the file.
+	//
+	// The method returns ENOTSUP if the system cannot copy data between the
+	// two files, in which case the caller may copy the data itself.
+	FDCopy(ctx context.Context, out, in FD, size FileSize) (FileSize, Errno)
+}
+
+// copyBufferSize is the maximum number of bytes copied by FDCopy when the
+// system does not implement FileCopier.
+const copyBufferSize = 64 * 1024
+
+var copyBufferPool sync.Pool // *[copyBufferSize]byte
+
+// FDCopy copies up to size bytes from the file descriptor in to out.
+//
+// The copy is delegated to the system if it implements FileCopier, otherwise
+// the data is read and written with FDRead and FDWrite through a buffer of the
+// host. In that case, the data read from in cannot be put back when out
+// accepts only part of it, so FDCopy returns ENOTSUP if in is not seekable and
+// out is non-blocking.
+func FDCopy(ctx context.Context, system System, out, in FD, size FileSize) (FileSize, Errno) {
+	if copier, ok := system.(FileCopier); ok {
+		n, errno := copier.FDCopy(ctx, out, in, size)
+		if errno != ENOTSUP {
+			return n, errno
+		}
+	}
+
+	inStat, errno := system.FDStatGet(ctx, in)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	outStat, errno := system.FDStatGet(ctx, out)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	seekable := inStat.FileType == RegularFileType || inStat.FileType == BlockDeviceType
+	if !seekable && outStat.Flags.Has(NonBlock) {
+		return 0, ENOTSUP
+	}
+
+	if size > copyBufferSize {
+		size = copyBufferSize
+	}
+	b, _ := copyBufferPool.Get().(*[copyBufferSize]byte)
+	if b == nil {
+		b = new([copyBufferSize]byte)
+	}
+	defer copyBufferPool.Put(b)
+	buffer := b[:size]
+	n, errno := system.FDRead(ctx, in, []IOVec{buffer})
+	if errno != ESUCCESS || n == 0 {
+		return 0, errno
+	}
+
+	written := Size(0)
+	for written < n {
+		w, errno := system.FDWrite(ctx, out, []IOVec{buffer[written:n]})
+		if errno == ESUCCESS && w == 0 {
+			errno = EIO
+		}
+		if errno != ESUCCESS {
+			// Rewind the input so the data which was not written is copied
+			// again by the next call.
+			if seekable {
+				system.FDSeek(ctx, in, FileDelta(written)-FileDelta(n), SeekCurrent)
+			}
+			if written > 0 {
+				break
+			}
+			return 0, errno
+		}
+		written += w
+	}
+	return FileSize(written), ESUCCESS
+}
@@ -0,0 +1,245 @@
+package wasi
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// DeterministicEpoch is the time value of the clocks when a deterministic
+// system starts, in nanoseconds since the Unix epoch (2020-01-01T00:00:00Z).
+//
+// The monotonic clock does not start at zero because some guests (e.g. the
+// Go runtime) consider this value invalid.
+const DeterministicEpoch Timestamp = 1577836800e9
+
+// Deterministic wraps a System so that identical runs of a guest observe
+// identical behaviors of the system, which is useful for testing, or to
+// reach consensus between multiple executions of the same program.
+//
+// The wrapper makes the following sources of non-determinism reproducible:
+//
+//   - The clocks are virtual, they start at DeterministicEpoch and are only
+//     advanced by the timeouts of calls to poll_oneoff. Instead of sleeping,
+//     the clocks advance to the earliest deadline when no other events are
+//     ready.
+//   - random_get returns bytes generated from a pseudo-random source
+//     initialized with the seed.
+//   - fd_readdir returns directory entries sorted by name, instead of the
+//     order in which they are stored by the host file system.
+//
+// The data read from files and sockets, or the readiness of file
+// descriptors, are not controlled by the wrapper; they must also be
+// deterministic for the execution of the guest to be reproducible.
+func Deterministic(system System, seed int64) System {
+	return &deterministic{
+		System: system,
+		random: rand.New(rand.NewSource(seed)),
+		dirs:   make(map[FD][]DirEntry),
+		now:    DeterministicEpoch,
+	}
+}
+
+type deterministic struct {
+	System
+	mutex  sync.Mutex
+	random *rand.Rand
+	dirs   map[FD][]DirEntry
+	now    Timestamp // value of all the clocks
+}
+
+func (d *deterministic) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	if id > ThreadCPUTimeID {
+		return 0, EINVAL
+	}
+	return 1, ESUCCESS
+}
+
+func (d *deterministic) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if id > ThreadCPUTimeID {
+		return 0, EINVAL
+	}
+	return d.now, ESUCCESS
+}
+
+func (d *deterministic) RandomGet(ctx context.Context, b []byte) Errno {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.random.Read(b)
+	return ESUCCESS
+}
+
+func (d *deterministic) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	if len(subscriptions) == 0 || len(events) < len(subscriptions) {
+		return 0, EINVAL
+	}
+
+	d.mutex.Lock()
+	now := d.now
+	d.mutex.Unlock()
+
+	// Compute the deadlines of clock subscriptions, and collect the file
+	// descriptor subscriptions.
+	var fdSubscriptions []Subscription
+	var deadlines []Timestamp
+	var deadline Timestamp
+	var hasDeadline bool
+	for i := range subscriptions {
+		s := &subscriptions[i]
+		if s.EventType != ClockEvent {
+			fdSubscriptions = append(fdSubscriptions, *s)
+			continue
+		}
+		c := s.GetClock()
+		t := c.Timeout
+		if !c.Flags.Has(Abstime) {
+			t += now
+		}
+		deadlines = append(deadlines, t)
+		if !hasDeadline || t < deadline {
+			deadline, hasDeadline = t, true
+		}
+	}
+
+	if !hasDeadline {
+		// Without timeouts, the guest is blocked until a file descriptor
+		// becomes ready, which does not depend on the clocks.
+		return d.System.PollOneOff(ctx, subscriptions, events)
+	}
+
+	if len(fdSubscriptions) > 0 && deadline > now {
+		// Check whether file descriptors are ready before advancing the
+		// clocks, the zero timeout prevents the call from blocking.
+		fdSubscriptions = append(fdSubscriptions, MakeSubscriptionClock(0, SubscriptionClock{
+			ID: Monotonic,
+		}))
+		fdEvents := make([]Event, len(fdSubscriptions))
+		n, errno := d.System.PollOneOff(ctx, fdSubscriptions, fdEvents)
+		if errno != ESUCCESS {
+			return n, errno
+		}
+		numEvents := 0
+		for _, e := range fdEvents[:n] {
+			if e.EventType != ClockEvent {
+				events[numEvents] = e
+				numEvents++
+			}
+		}
+		if numEvents > 0 {
+			return numEvents, ESUCCESS
+		}
+	}
+
+	if deadline > now {
+		d.mutex.Lock()
+		if deadline > d.now {
+			d.now = deadline
+		}
+		d.mutex.Unlock()
+	}
+
+	numEvents := 0
+	for i := range subscriptions {
+		s := &subscriptions[i]
+		if s.EventType != ClockEvent {
+			continue
+		}
+		if deadlines[0] <= deadline {
+			events[numEvents] = Event{UserData: s.UserData, EventType: ClockEvent}
+			numEvents++
+		}
+		deadlines = deadlines[1:]
+	}
+	return numEvents, ESUCCESS
+}
+
+func (d *deterministic) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	if len(entries) == 0 {
+		return 0, EINVAL
+	}
+
+	d.mutex.Lock()
+	dir, ok := d.dirs[fd]
+	d.mutex.Unlock()
+
+	// The directory is listed when the guest starts reading it from the
+	// beginning, so changes made since the last listing are observed.
+	if !ok || cookie == 0 {
+		var errno Errno
+		dir, errno = d.readDir(ctx, fd)
+		if errno != ESUCCESS {
+			return 0, errno
+		}
+		d.mutex.Lock()
+		d.dirs[fd] = dir
+		d.mutex.Unlock()
+	}
+
+	if cookie >= DirCookie(len(dir)) {
+		return 0, ESUCCESS
+	}
+	n := 0
+	for _, entry := range dir[cookie:] {
+		if n == len(entries) {
+			break
+		}
+		entries[n] = entry
+		n++
+		bufferSizeBytes -= SizeOfDirent + len(entry.Name)
+		if bufferSizeBytes <= 0 {
+			break
+		}
+	}
+	return n, ESUCCESS
+}
+
+// readDir returns the entries of the directory sorted by name, with cookies
+// set to the index of the next entry.
+func (d *deterministic) readDir(ctx context.Context, fd FD) ([]DirEntry, Errno) {
+	var dir []DirEntry
+	var cookie DirCookie
+	buffer := make([]DirEntry, 64)
+	for {
+		n, errno := d.System.FDReadDir(ctx, fd, buffer, cookie, 64*1024)
+		if errno != ESUCCESS {
+			return nil, errno
+		}
+		if n == 0 {
+			break
+		}
+		for _, entry := range buffer[:n] {
+			entry.Name = append([]byte(nil), entry.Name...)
+			dir = append(dir, entry)
+		}
+		cookie = buffer[n-1].Next
+	}
+	sort.Slice(dir, func(i, j int) bool {
+		return bytes.Compare(dir[i].Name, dir[j].Name) < 0
+	})
+	for i := range dir {
+		dir[i].Next = DirCookie(i + 1)
+	}
+	return dir, ESUCCESS
+}
+
+func (d *deterministic) FDClose(ctx context.Context, fd FD) Errno {
+	d.mutex.Lock()
+	delete(d.dirs, fd)
+	d.mutex.Unlock()
+	return d.System.FDClose(ctx, fd)
+}
+
+func (d *deterministic) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := d.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS {
+		d.mutex.Lock()
+		delete(d.dirs, from)
+		delete(d.dirs, to)
+		d.mutex.Unlock()
+	}
+	return errno
+}
@@ -0,0 +1,1012 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DryRun wraps a System so that mutating filesystem operations succeed from
+// the guest's perspective, but are only applied to an in-memory overlay and
+// never reach the underlying system.
+//
+// Files opened for writing are copied to the overlay, and directories,
+// links, renames and removals are all recorded in the overlay as well, so
+// that the guest observes a consistent view of the file system. When the
+// System is closed, a manifest of the changes that the guest attempted is
+// written to the given io.Writer, one change per line in the order they
+// occurred:
+//
+//	create  data/new.txt (12 bytes)
+//	write   data/log.txt (4096 bytes)
+//	mkdir   data/tmp
+//	rename  data/a -> data/b
+//	remove  data/old.txt
+//
+// This lets users preview what an untrusted module would do to their mounts
+// before granting it real write access.
+//
+// Renaming a directory of the underlying system fails with EXDEV, which
+// prompts most programs to fall back to copying the directory tree.
+func DryRun(system System, manifest io.Writer) System {
+	return &dryRun{
+		System:   system,
+		manifest: manifest,
+		dirs:     make(map[FD]string),
+		nodes:    make(map[string]*shadowNode),
+		files:    make(map[FD]*shadowFile),
+		nextFD:   dryRunFDBase,
+	}
+}
+
+const (
+	// File descriptors of files in the overlay are allocated above this
+	// number so they do not collide with those of the underlying system.
+	dryRunFDBase FD = 1 << 24
+
+	// Directory entries of the overlay are listed after those of the
+	// underlying system, with cookies starting at this value.
+	dryRunCookieBase DirCookie = 1 << 62
+
+	// Inode numbers of files created in the overlay.
+	dryRunINodeBase INode = 1 << 62
+)
+
+type dryRun struct {
+	System
+	manifest io.Writer
+	// Paths of the directories opened on the underlying system.
+	dirs map[FD]string
+	// The overlay, indexed by path. Removed files are represented by nodes
+	// with the removed field set, which hide the files of the underlying
+	// system.
+	nodes   map[string]*shadowNode
+	files   map[FD]*shadowFile
+	nextFD  FD
+	inode   INode
+	changes []shadowChange
+}
+
+type shadowNode struct {
+	fileType   FileType
+	removed    bool
+	written    bool
+	data       []byte
+	target     string
+	inode      INode
+	accessTime Timestamp
+	modifyTime Timestamp
+	changeTime Timestamp
+}
+
+func (n *shadowNode) stat() FileStat {
+	stat := FileStat{
+		INode:      n.inode,
+		FileType:   n.fileType,
+		NLink:      1,
+		AccessTime: n.accessTime,
+		ModifyTime: n.modifyTime,
+		ChangeTime: n.changeTime,
+	}
+	switch n.fileType {
+	case RegularFileType:
+		stat.Size = FileSize(len(n.data))
+	case SymbolicLinkType:
+		stat.Size = FileSize(len(n.target))
+	}
+	return stat
+}
+
+type shadowFile struct {
+	node   *shadowNode
+	path   string
+	offset int64
+	stat   FDStat
+}
+
+type shadowChange struct {
+	op     string
+	path   string
+	target string
+	node   *shadowNode
+}
+
+func (c shadowChange) String() string {
+	s := fmt.Sprintf("%-7s %s", c.op, c.path)
+	if c.target != "" {
+		s += " -> " + c.target
+	}
+	if c.node != nil {
+		s += fmt.Sprintf(" (%d bytes)", len(c.node.data))
+	}
+	return s
+}
+
+func (d *dryRun) record(op, path, target string, node *shadowNode) {
+	d.changes = append(d.changes, shadowChange{op: op, path: path, target: target, node: node})
+}
+
+func (d *dryRun) now() Timestamp {
+	return Timestamp(time.Now().UnixNano())
+}
+
+func (d *dryRun) newNode(fileType FileType) *shadowNode {
+	d.inode++
+	now := d.now()
+	return &shadowNode{
+		fileType:   fileType,
+		inode:      dryRunINodeBase + d.inode,
+		accessTime: now,
+		modifyTime: now,
+		changeTime: now,
+	}
+}
+
+// modified records the first modification of a file loaded from the
+// underlying system.
+func (d *dryRun) modified(key string, node *shadowNode) {
+	node.modifyTime = d.now()
+	node.changeTime = node.modifyTime
+	if !node.written {
+		node.written = true
+		d.record("write", key, "", node)
+	}
+}
+
+// resolve returns the path of p relative to the directory fd, which is used
+// as key in the overlay.
+func (d *dryRun) resolve(ctx context.Context, fd FD, p string) string {
+	if f, ok := d.files[fd]; ok {
+		return path.Join(f.path, p)
+	}
+	base, ok := d.dirs[fd]
+	if !ok {
+		name, errno := d.System.FDPreStatDirName(ctx, fd)
+		if errno == ESUCCESS {
+			base = name
+		} else {
+			base = fmt.Sprintf("<fd %d>", fd)
+		}
+		d.dirs[fd] = base
+	}
+	return path.Join(base, p)
+}
+
+// lookup returns the overlay node at the given path. When shadowed is true
+// the path is hidden by the overlay, and a nil node means that it does not
+// exist. Otherwise, the underlying system must be consulted.
+func (d *dryRun) lookup(key string) (node *shadowNode, shadowed bool) {
+	if n, ok := d.nodes[key]; ok {
+		if n.removed {
+			return nil, true
+		}
+		return n, true
+	}
+	for k := key; ; {
+		parent := path.Dir(k)
+		if parent == k {
+			return nil, false
+		}
+		k = parent
+		if _, ok := d.nodes[k]; ok {
+			// The parent was either removed, or created in the overlay
+			// and cannot have children on the underlying system.
+			return nil, true
+		}
+	}
+}
+
+// load copies a file of the underlying system to the overlay.
+func (d *dryRun) load(ctx context.Context, fd FD, flags LookupFlags, p string, stat FileStat, truncate bool) (*shadowNode, Errno) {
+	node := &shadowNode{
+		fileType:   stat.FileType,
+		inode:      stat.INode,
+		accessTime: stat.AccessTime,
+		modifyTime: stat.ModifyTime,
+		changeTime: stat.ChangeTime,
+	}
+	switch {
+	case stat.FileType == SymbolicLinkType:
+		buf := make([]byte, stat.Size+1)
+		n, errno := d.System.PathReadLink(ctx, fd, p, buf)
+		if errno != ESUCCESS {
+			return nil, errno
+		}
+		node.target = string(buf[:n])
+	case truncate:
+	default:
+		f, errno := d.System.PathOpen(ctx, fd, flags, p, 0, FDReadRight, 0, 0)
+		if errno != ESUCCESS {
+			return nil, errno
+		}
+		defer d.System.FDClose(ctx, f)
+		buf := make([]byte, 32*1024)
+		for {
+			n, errno := d.System.FDRead(ctx, f, []IOVec{buf})
+			if errno != ESUCCESS {
+				return nil, errno
+			}
+			if n == 0 {
+				break
+			}
+			node.data = append(node.data, buf[:n]...)
+		}
+	}
+	return node, ESUCCESS
+}
+
+// checkParent verifies that the parent directory of p exists.
+func (d *dryRun) checkParent(ctx context.Context, fd FD, p string) Errno {
+	dir := path.Dir(strings.TrimSuffix(p, "/"))
+	if dir == "." {
+		return ESUCCESS
+	}
+	stat, errno := d.PathFileStatGet(ctx, fd, SymlinkFollow, dir)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if stat.FileType != DirectoryType {
+		return ENOTDIR
+	}
+	return ESUCCESS
+}
+
+// create adds a file to the overlay, failing if it already exists.
+func (d *dryRun) create(ctx context.Context, fd FD, p string, node *shadowNode) Errno {
+	if errno := d.checkParent(ctx, fd, p); errno != ESUCCESS {
+		return errno
+	}
+	switch _, errno := d.PathFileStatGet(ctx, fd, 0, p); errno {
+	case ESUCCESS:
+		return EEXIST
+	case ENOENT:
+	default:
+		return errno
+	}
+	d.nodes[d.resolve(ctx, fd, p)] = node
+	return ESUCCESS
+}
+
+func (d *dryRun) openFile(key string, node *shadowNode, fdstat FDStat) FD {
+	fd := d.nextFD
+	d.nextFD++
+	fdstat.FileType = node.fileType
+	d.files[fd] = &shadowFile{node: node, path: key, stat: fdstat}
+	return fd
+}
+
+func (d *dryRun) lookupFile(fd FD, rights Rights) (*shadowFile, bool, Errno) {
+	f, ok := d.files[fd]
+	if !ok {
+		return nil, false, ESUCCESS
+	}
+	if !f.stat.RightsBase.Has(rights) {
+		return nil, true, ENOTCAPABLE
+	}
+	return f, true, ESUCCESS
+}
+
+func (d *dryRun) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, p string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	if fd < 0 {
+		return d.System.PathOpen(ctx, fd, dirFlags, p, openFlags, rightsBase, rightsInheriting, fdFlags)
+	}
+	key := d.resolve(ctx, fd, p)
+	fdstat := FDStat{Flags: fdFlags, RightsBase: rightsBase, RightsInheriting: rightsInheriting}
+
+	node, shadowed := d.lookup(key)
+	if !shadowed {
+		// Files are only written through descriptors opened with the
+		// FDWriteRight, other rights are not granted by the underlying
+		// system on read-only descriptors.
+		mutating := openFlags.Has(OpenCreate) || openFlags.Has(OpenTruncate) || rightsBase.Has(FDWriteRight)
+		var stat FileStat
+		var errno Errno
+		if mutating {
+			stat, errno = d.System.PathFileStatGet(ctx, fd, dirFlags, p)
+		}
+		switch {
+		case !mutating || (errno == ESUCCESS && stat.FileType != RegularFileType && stat.FileType != SymbolicLinkType):
+			// Directories are only mutated through the path functions, and
+			// writes to devices are not file system changes.
+			newfd, errno := d.System.PathOpen(ctx, fd, dirFlags, p, openFlags, rightsBase, rightsInheriting, fdFlags)
+			if errno == ESUCCESS && d.isDir(ctx, newfd, fd, dirFlags, p) {
+				d.dirs[newfd] = key
+			}
+			return newfd, errno
+		case errno == ENOENT:
+			if !openFlags.Has(OpenCreate) {
+				return -1, ENOENT
+			}
+		case errno != ESUCCESS:
+			return -1, errno
+		case openFlags.Has(OpenCreate | OpenExclusive):
+			return -1, EEXIST
+		default:
+			node, errno = d.load(ctx, fd, dirFlags, p, stat, openFlags.Has(OpenTruncate))
+			if errno != ESUCCESS {
+				return -1, errno
+			}
+			d.nodes[key] = node
+		}
+	}
+
+	switch {
+	case node == nil:
+		if !openFlags.Has(OpenCreate) {
+			return -1, ENOENT
+		}
+		if openFlags.Has(OpenDirectory) {
+			return -1, EINVAL
+		}
+		node = d.newNode(RegularFileType)
+		if errno := d.create(ctx, fd, p, node); errno != ESUCCESS {
+			return -1, errno
+		}
+		node.written = true
+		d.record("create", key, "", node)
+		return d.openFile(key, node, fdstat), ESUCCESS
+	case openFlags.Has(OpenCreate | OpenExclusive):
+		return -1, EEXIST
+	case node.fileType == SymbolicLinkType:
+		if !dirFlags.Has(SymlinkFollow) || strings.HasPrefix(node.target, "/") {
+			return -1, ELOOP
+		}
+		target := path.Join(path.Dir(p), node.target)
+		return d.PathOpen(ctx, fd, dirFlags, target, openFlags, rightsBase, rightsInheriting, fdFlags)
+	case openFlags.Has(OpenDirectory) && node.fileType != DirectoryType:
+		return -1, ENOTDIR
+	}
+	if openFlags.Has(OpenTruncate) && node.fileType == RegularFileType {
+		node.data = node.data[:0]
+		d.modified(key, node)
+	}
+	return d.openFile(key, node, fdstat), ESUCCESS
+}
+
+// isDir returns true if the file opened at p is a directory. The file type
+// in the descriptor stat is not used because systems may not determine it
+// when the OpenDirectory flag is not set.
+func (d *dryRun) isDir(ctx context.Context, fd, dirfd FD, dirFlags LookupFlags, p string) bool {
+	stat, errno := d.System.FDFileStatGet(ctx, fd)
+	if errno != ESUCCESS {
+		stat, errno = d.System.PathFileStatGet(ctx, dirfd, dirFlags, p)
+	}
+	return errno == ESUCCESS && stat.FileType == DirectoryType
+}
+
+func (d *dryRun) PathCreateDirectory(ctx context.Context, fd FD, p string) Errno {
+	key := d.resolve(ctx, fd, p)
+	if errno := d.create(ctx, fd, p, d.newNode(DirectoryType)); errno != ESUCCESS {
+		return errno
+	}
+	d.record("mkdir", key, "", nil)
+	return ESUCCESS
+}
+
+func (d *dryRun) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, p string) (FileStat, Errno) {
+	key := d.resolve(ctx, fd, p)
+	node, shadowed := d.lookup(key)
+	if !shadowed {
+		return d.System.PathFileStatGet(ctx, fd, lookupFlags, p)
+	}
+	if node == nil {
+		return FileStat{}, ENOENT
+	}
+	if node.fileType == SymbolicLinkType && lookupFlags.Has(SymlinkFollow) {
+		if strings.HasPrefix(node.target, "/") {
+			return FileStat{}, ENOTCAPABLE
+		}
+		return d.PathFileStatGet(ctx, fd, lookupFlags, path.Join(path.Dir(p), node.target))
+	}
+	return node.stat(), ESUCCESS
+}
+
+func (d *dryRun) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, p string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	if _, errno := d.PathFileStatGet(ctx, fd, lookupFlags, p); errno != ESUCCESS {
+		return errno
+	}
+	key := d.resolve(ctx, fd, p)
+	if node, _ := d.lookup(key); node != nil {
+		node.setTimes(d.now(), accessTime, modifyTime, flags)
+	}
+	d.record("chtimes", key, "", nil)
+	return ESUCCESS
+}
+
+func (n *shadowNode) setTimes(now, accessTime, modifyTime Timestamp, flags FSTFlags) {
+	switch {
+	case flags.Has(AccessTimeNow):
+		n.accessTime = now
+	case flags.Has(AccessTime):
+		n.accessTime = accessTime
+	}
+	switch {
+	case flags.Has(ModifyTimeNow):
+		n.modifyTime = now
+	case flags.Has(ModifyTime):
+		n.modifyTime = modifyTime
+	}
+	n.changeTime = now
+}
+
+func (d *dryRun) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	stat, errno := d.PathFileStatGet(ctx, oldFD, oldFlags, oldPath)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if stat.FileType == DirectoryType {
+		return EPERM
+	}
+	oldKey := d.resolve(ctx, oldFD, oldPath)
+	node, _ := d.lookup(oldKey)
+	if node == nil {
+		if node, errno = d.load(ctx, oldFD, oldFlags, oldPath, stat, false); errno != ESUCCESS {
+			return errno
+		}
+	}
+	// Nodes of the overlay are shared by all their links, just like inodes.
+	if errno := d.create(ctx, newFD, newPath, node); errno != ESUCCESS {
+		return errno
+	}
+	d.record("link", d.resolve(ctx, newFD, newPath), oldKey, nil)
+	return ESUCCESS
+}
+
+func (d *dryRun) PathReadLink(ctx context.Context, fd FD, p string, buffer []byte) (int, Errno) {
+	node, shadowed := d.lookup(d.resolve(ctx, fd, p))
+	switch {
+	case !shadowed:
+		return d.System.PathReadLink(ctx, fd, p, buffer)
+	case node == nil:
+		return 0, ENOENT
+	case node.fileType != SymbolicLinkType:
+		return 0, EINVAL
+	}
+	return copy(buffer, node.target), ESUCCESS
+}
+
+func (d *dryRun) PathRemoveDirectory(ctx context.Context, fd FD, p string) Errno {
+	stat, errno := d.PathFileStatGet(ctx, fd, 0, p)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if stat.FileType != DirectoryType {
+		return ENOTDIR
+	}
+	key := d.resolve(ctx, fd, p)
+	if errno := d.checkEmpty(ctx, fd, p, key); errno != ESUCCESS {
+		return errno
+	}
+	d.nodes[key] = &shadowNode{removed: true}
+	d.record("rmdir", key, "", nil)
+	return ESUCCESS
+}
+
+// checkEmpty returns ENOTEMPTY if the directory at p contains files, either
+// in the overlay or on the underlying system.
+func (d *dryRun) checkEmpty(ctx context.Context, fd FD, p, key string) Errno {
+	if len(d.children(key)) > 0 {
+		return ENOTEMPTY
+	}
+	if _, shadowed := d.lookup(key); shadowed {
+		return ESUCCESS
+	}
+	dir, errno := d.System.PathOpen(ctx, fd, 0, p, OpenDirectory, FDReadDirRight, 0, 0)
+	if errno != ESUCCESS {
+		return errno
+	}
+	defer d.System.FDClose(ctx, dir)
+
+	entries := make([]DirEntry, 16)
+	cookie := DirCookie(0)
+	for {
+		n, errno := d.System.FDReadDir(ctx, dir, entries, cookie, 4096)
+		if errno != ESUCCESS {
+			return errno
+		}
+		if n == 0 {
+			return ESUCCESS
+		}
+		for _, entry := range entries[:n] {
+			name := string(entry.Name)
+			if name != "." && name != ".." {
+				if _, shadowed := d.lookup(path.Join(key, name)); !shadowed {
+					return ENOTEMPTY
+				}
+			}
+			cookie = entry.Next
+		}
+	}
+}
+
+// children returns the sorted names of the files in the overlay directory.
+func (d *dryRun) children(key string) []string {
+	var names []string
+	for k, node := range d.nodes {
+		if !node.removed && k != key && path.Dir(k) == key {
+			names = append(names, path.Base(k))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *dryRun) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	stat, errno := d.PathFileStatGet(ctx, fd, 0, oldPath)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if errno := d.checkParent(ctx, newFD, newPath); errno != ESUCCESS {
+		return errno
+	}
+	oldKey := d.resolve(ctx, fd, oldPath)
+	newKey := d.resolve(ctx, newFD, newPath)
+	if oldKey == newKey {
+		return ESUCCESS
+	}
+	if strings.HasPrefix(newKey, oldKey+"/") {
+		return EINVAL
+	}
+
+	switch target, errno := d.PathFileStatGet(ctx, newFD, 0, newPath); {
+	case errno == ENOENT:
+	case errno != ESUCCESS:
+		return errno
+	case target.FileType == DirectoryType && stat.FileType != DirectoryType:
+		return EISDIR
+	case target.FileType != DirectoryType && stat.FileType == DirectoryType:
+		return ENOTDIR
+	case target.FileType == DirectoryType:
+		if errno := d.checkEmpty(ctx, newFD, newPath, newKey); errno != ESUCCESS {
+			return errno
+		}
+	}
+
+	node, _ := d.lookup(oldKey)
+	if node == nil {
+		if stat.FileType != RegularFileType && stat.FileType != SymbolicLinkType {
+			return EXDEV
+		}
+		if node, errno = d.load(ctx, fd, 0, oldPath, stat, false); errno != ESUCCESS {
+			return errno
+		}
+	}
+	if node.fileType == DirectoryType {
+		for k, n := range d.nodes {
+			if strings.HasPrefix(k, oldKey+"/") {
+				delete(d.nodes, k)
+				d.nodes[newKey+strings.TrimPrefix(k, oldKey)] = n
+			}
+		}
+	}
+	d.nodes[newKey] = node
+	d.nodes[oldKey] = &shadowNode{removed: true}
+	for _, f := range d.files {
+		if f.path == oldKey || strings.HasPrefix(f.path, oldKey+"/") {
+			f.path = newKey + strings.TrimPrefix(f.path, oldKey)
+		}
+	}
+	d.record("rename", oldKey, newKey, nil)
+	return ESUCCESS
+}
+
+func (d *dryRun) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	node := d.newNode(SymbolicLinkType)
+	node.target = oldPath
+	if errno := d.create(ctx, fd, newPath, node); errno != ESUCCESS {
+		return errno
+	}
+	d.record("symlink", d.resolve(ctx, fd, newPath), oldPath, nil)
+	return ESUCCESS
+}
+
+func (d *dryRun) PathUnlinkFile(ctx context.Context, fd FD, p string) Errno {
+	stat, errno := d.PathFileStatGet(ctx, fd, 0, p)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if stat.FileType == DirectoryType {
+		return EISDIR
+	}
+	key := d.resolve(ctx, fd, p)
+	d.nodes[key] = &shadowNode{removed: true}
+	d.record("remove", key, "", nil)
+	return ESUCCESS
+}
+
+func (d *dryRun) FDAdvise(ctx context.Context, fd FD, offset, length FileSize, advice Advice) Errno {
+	if _, ok, errno := d.lookupFile(fd, FDAdviseRight); ok {
+		return errno
+	}
+	return d.System.FDAdvise(ctx, fd, offset, length, advice)
+}
+
+func (d *dryRun) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	f, ok, errno := d.lookupFile(fd, FDAllocateRight)
+	if !ok {
+		return d.System.FDAllocate(ctx, fd, offset, length)
+	}
+	if errno != ESUCCESS {
+		return errno
+	}
+	if f.node.fileType != RegularFileType {
+		return EBADF
+	}
+	if size := int(offset + length); size > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, size-len(f.node.data))...)
+		d.modified(f.path, f.node)
+	}
+	return ESUCCESS
+}
+
+func (d *dryRun) FDClose(ctx context.Context, fd FD) Errno {
+	if _, ok := d.files[fd]; ok {
+		delete(d.files, fd)
+		return ESUCCESS
+	}
+	delete(d.dirs, fd)
+	return d.System.FDClose(ctx, fd)
+}
+
+func (d *dryRun) FDDataSync(ctx context.Context, fd FD) Errno {
+	if _, ok, errno := d.lookupFile(fd, FDDataSyncRight); ok {
+		return errno
+	}
+	return d.System.FDDataSync(ctx, fd)
+}
+
+func (d *dryRun) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	if f, ok := d.files[fd]; ok {
+		return f.stat, ESUCCESS
+	}
+	return d.System.FDStatGet(ctx, fd)
+}
+
+func (d *dryRun) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	f, ok, errno := d.lookupFile(fd, FDStatSetFlagsRight)
+	if !ok {
+		return d.System.FDStatSetFlags(ctx, fd, flags)
+	}
+	if errno == ESUCCESS {
+		f.stat.Flags = flags
+	}
+	return errno
+}
+
+func (d *dryRun) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
+	f, ok := d.files[fd]
+	if !ok {
+		return d.System.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	}
+	if !f.stat.RightsBase.Has(rightsBase) || !f.stat.RightsInheriting.Has(rightsInheriting) {
+		return ENOTCAPABLE
+	}
+	f.stat.RightsBase = rightsBase
+	f.stat.RightsInheriting = rightsInheriting
+	return ESUCCESS
+}
+
+func (d *dryRun) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDFileStatGetRight)
+	if !ok {
+		return d.System.FDFileStatGet(ctx, fd)
+	}
+	if errno != ESUCCESS {
+		return FileStat{}, errno
+	}
+	return f.node.stat(), ESUCCESS
+}
+
+func (d *dryRun) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	f, ok, errno := d.lookupFile(fd, FDFileStatSetSizeRight)
+	if !ok {
+		return d.System.FDFileStatSetSize(ctx, fd, size)
+	}
+	if errno != ESUCCESS {
+		return errno
+	}
+	if f.node.fileType != RegularFileType {
+		return EINVAL
+	}
+	if int(size) <= len(f.node.data) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, int(size)-len(f.node.data))...)
+	}
+	d.modified(f.path, f.node)
+	return ESUCCESS
+}
+
+func (d *dryRun) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	f, ok, errno := d.lookupFile(fd, FDFileStatSetTimesRight)
+	if !ok {
+		stat, errno := d.System.FDStatGet(ctx, fd)
+		if errno != ESUCCESS {
+			return errno
+		}
+		if !stat.RightsBase.Has(FDFileStatSetTimesRight) {
+			return ENOTCAPABLE
+		}
+		path, ok := d.dirs[fd]
+		if !ok {
+			path = fmt.Sprintf("<fd %d>", fd)
+		}
+		d.record("chtimes", path, "", nil)
+		return ESUCCESS
+	}
+	if errno != ESUCCESS {
+		return errno
+	}
+	f.node.setTimes(d.now(), accessTime, modifyTime, flags)
+	d.record("chtimes", f.path, "", nil)
+	return ESUCCESS
+}
+
+func (d *dryRun) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDReadRight|FDSeekRight)
+	if !ok {
+		return d.System.FDPread(ctx, fd, iovecs, offset)
+	}
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return f.readAt(iovecs, int64(offset))
+}
+
+func (d *dryRun) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDWriteRight|FDSeekRight)
+	if !ok {
+		return d.System.FDPwrite(ctx, fd, iovecs, offset)
+	}
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	n, errno := f.writeAt(iovecs, int64(offset))
+	if n > 0 {
+		d.modified(f.path, f.node)
+	}
+	return n, errno
+}
+
+func (d *dryRun) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDReadRight)
+	if !ok {
+		return d.System.FDRead(ctx, fd, iovecs)
+	}
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	n, errno := f.readAt(iovecs, f.offset)
+	f.offset += int64(n)
+	return n, errno
+}
+
+func (d *dryRun) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDWriteRight)
+	if !ok {
+		return d.System.FDWrite(ctx, fd, iovecs)
+	}
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	if f.stat.Flags.Has(Append) {
+		f.offset = int64(len(f.node.data))
+	}
+	n, errno := f.writeAt(iovecs, f.offset)
+	f.offset += int64(n)
+	if n > 0 {
+		d.modified(f.path, f.node)
+	}
+	return n, errno
+}
+
+func (f *shadowFile) readAt(iovecs []IOVec, offset int64) (Size, Errno) {
+	if f.node.fileType == DirectoryType {
+		return 0, EISDIR
+	}
+	var n Size
+	for _, iovec := range iovecs {
+		if offset >= int64(len(f.node.data)) {
+			break
+		}
+		c := copy(iovec, f.node.data[offset:])
+		offset += int64(c)
+		n += Size(c)
+	}
+	return n, ESUCCESS
+}
+
+func (f *shadowFile) writeAt(iovecs []IOVec, offset int64) (Size, Errno) {
+	if f.node.fileType == DirectoryType {
+		return 0, EISDIR
+	}
+	var n Size
+	for _, iovec := range iovecs {
+		if end := offset + int64(len(iovec)); end > int64(len(f.node.data)) {
+			f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+		}
+		copy(f.node.data[offset:], iovec)
+		offset += int64(len(iovec))
+		n += Size(len(iovec))
+	}
+	return n, ESUCCESS
+}
+
+func (d *dryRun) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	if f, ok, errno := d.lookupFile(fd, FDReadDirRight); ok {
+		if errno != ESUCCESS {
+			return 0, errno
+		}
+		if f.node.fileType != DirectoryType {
+			return 0, ENOTDIR
+		}
+		names := append([]string{".", ".."}, d.children(f.path)...)
+		return d.readDirNames(f.path, names, entries, cookie, 0, bufferSizeBytes), ESUCCESS
+	}
+	key, ok := d.dirs[fd]
+	if !ok {
+		return d.System.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	}
+	names := d.children(key)
+	if cookie >= dryRunCookieBase {
+		return d.readDirNames(key, names, entries, cookie, dryRunCookieBase, bufferSizeBytes), ESUCCESS
+	}
+	for {
+		n, errno := d.System.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+		if errno != ESUCCESS {
+			return n, errno
+		}
+		if n == 0 {
+			return d.readDirNames(key, names, entries, dryRunCookieBase, dryRunCookieBase, bufferSizeBytes), ESUCCESS
+		}
+		// Entries hidden by the overlay are removed from the results, the
+		// files that replaced them are listed after the underlying
+		// directory entries.
+		i := 0
+		for _, entry := range entries[:n] {
+			cookie = entry.Next
+			name := string(entry.Name)
+			if name != "." && name != ".." {
+				if _, shadowed := d.lookup(path.Join(key, name)); shadowed {
+					continue
+				}
+			}
+			entries[i] = entry
+			i++
+		}
+		if i > 0 {
+			return i, ESUCCESS
+		}
+	}
+}
+
+func (d *dryRun) readDirNames(key string, names []string, entries []DirEntry, cookie, base DirCookie, bufferSizeBytes int) int {
+	n, size := 0, 0
+	for i := int(cookie - base); i < len(names) && n < len(entries); i++ {
+		name := names[i]
+		if n > 0 && size+SizeOfDirent+len(name) > bufferSizeBytes {
+			break
+		}
+		size += SizeOfDirent + len(name)
+		entry := DirEntry{Next: base + DirCookie(i+1), Type: DirectoryType, Name: []byte(name)}
+		if name != "." && name != ".." {
+			node := d.nodes[path.Join(key, name)]
+			entry.INode, entry.Type = node.inode, node.fileType
+		}
+		entries[n] = entry
+		n++
+	}
+	return n
+}
+
+func (d *dryRun) FDRenumber(ctx context.Context, from, to FD) Errno {
+	if _, ok := d.files[from]; ok {
+		if _, ok := d.files[to]; !ok {
+			return ENOTSUP
+		}
+		d.files[to] = d.files[from]
+		delete(d.files, from)
+		return ESUCCESS
+	}
+	if _, ok := d.files[to]; ok {
+		return ENOTSUP
+	}
+	errno := d.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS {
+		if key, ok := d.dirs[from]; ok {
+			d.dirs[to] = key
+		} else {
+			delete(d.dirs, to)
+		}
+		delete(d.dirs, from)
+	}
+	return errno
+}
+
+func (d *dryRun) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDSeekRight)
+	if !ok {
+		return d.System.FDSeek(ctx, fd, offset, whence)
+	}
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	var position int64
+	switch whence {
+	case SeekStart:
+		position = int64(offset)
+	case SeekCurrent:
+		position = f.offset + int64(offset)
+	case SeekEnd:
+		position = int64(len(f.node.data)) + int64(offset)
+	default:
+		return 0, EINVAL
+	}
+	if position < 0 {
+		return 0, EINVAL
+	}
+	f.offset = position
+	return FileSize(position), ESUCCESS
+}
+
+func (d *dryRun) FDSync(ctx context.Context, fd FD) Errno {
+	if _, ok, errno := d.lookupFile(fd, FDSyncRight); ok {
+		return errno
+	}
+	return d.System.FDSync(ctx, fd)
+}
+
+func (d *dryRun) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	f, ok, errno := d.lookupFile(fd, FDTellRight)
+	if !ok {
+		return d.System.FDTell(ctx, fd)
+	}
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return FileSize(f.offset), ESUCCESS
+}
+
+func (d *dryRun) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	if _, ok := d.files[fd]; ok {
+		return PreStat{}, EBADF
+	}
+	return d.System.FDPreStatGet(ctx, fd)
+}
+
+func (d *dryRun) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	if _, ok := d.files[fd]; ok {
+		return "", EBADF
+	}
+	return d.System.FDPreStatDirName(ctx, fd)
+}
+
+func (d *dryRun) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	// Files of the overlay are always ready for reading and writing.
+	n := 0
+	for i := range subscriptions {
+		s := &subscriptions[i]
+		if s.EventType != FDReadEvent && s.EventType != FDWriteEvent {
+			continue
+		}
+		if _, ok := d.files[s.GetFDReadWrite().FD]; ok && n < len(events) {
+			events[n] = Event{UserData: s.UserData, EventType: s.EventType}
+			n++
+		}
+	}
+	if n > 0 {
+		return n, ESUCCESS
+	}
+	return d.System.PollOneOff(ctx, subscriptions, events)
+}
+
+func (d *dryRun) Close(ctx context.Context) error {
+	for _, change := range d.changes {
+		fmt.Fprintln(d.manifest, change)
+	}
+	return d.System.Close(ctx)
+}
@@ -0,0 +1,30 @@
+//go:build !darwin && !linux
+
+package wasi
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// syscallErrnoToWASI maps the errors of platforms which do not have the POSIX
+// error codes to the few errno values that the fs package can classify, so
+// the package can be used on these platforms with systems which do not make
+// system calls to the host (e.g. systems/memory).
+func syscallErrnoToWASI(err syscall.Errno) Errno {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return EPERM
+	case err.Timeout():
+		return ETIMEDOUT
+	case err.Temporary():
+		return EAGAIN
+	default:
+		return EIO
+	}
+}
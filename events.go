@@ -0,0 +1,45 @@
+package wasi
+
+import "context"
+
+// EventHandle is the host end of an event handle, a file descriptor that the
+// guest adds to the subscriptions of poll_oneoff (with EventTypeFDRead) to
+// wait for events of the host, such as the notifications of host extensions,
+// the messages of a queue, or the arrival of signals. Guests integrate the
+// events with their event loop instead of busy polling the host.
+//
+// Each message sent on the handle is received by the guest with a single read
+// of the file descriptor, as on a datagram socket; the file descriptor is
+// ready for reading while messages are queued.
+type EventHandle interface {
+	// Send queues a message for the guest. It returns EAGAIN if the queue
+	// is full, and an error if the guest closed the file descriptor.
+	Send(msg []byte) Errno
+
+	// Notify queues a message of one byte, dropping it if the queue is
+	// full, which makes the handle behave like an eventfd: the guest only
+	// needs to know that events occurred, not how many.
+	Notify()
+
+	// Close closes the host end of the handle, after which the guest reads
+	// EOF from the file descriptor once it received the queued messages.
+	Close() error
+}
+
+// EventHandles is implemented by systems which create event handles.
+type EventHandles interface {
+	// EventHandleOpen opens an event handle, returning the file descriptor
+	// of the guest and the host end of the handle.
+	EventHandleOpen(ctx context.Context) (FD, EventHandle, Errno)
+}
+
+// EventHandleOpen opens an event handle on the system.
+//
+// It returns ENOSYS if the system does not implement EventHandles, in which
+// case host extensions must fall back to having guests poll them.
+func EventHandleOpen(ctx context.Context, system System) (FD, EventHandle, Errno) {
+	if h, ok := system.(EventHandles); ok {
+		return h.EventHandleOpen(ctx)
+	}
+	return -1, nil, ENOSYS
+}
@@ -1,6 +1,10 @@
 package wasi
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // ExitCode is the exit code generated by a process when exiting.
 type ExitCode uint32
@@ -114,6 +118,133 @@ const (
 	SIGSYS
 )
 
+// SignalAction is the action taken by the host when a guest raises a signal
+// with proc_raise.
+type SignalAction uint8
+
+const (
+	// SignalDefault takes the default action of the signal (see
+	// Signal.DefaultAction).
+	SignalDefault SignalAction = iota
+
+	// SignalTerminate terminates the guest with the exit code of the signal
+	// (see Signal.ExitCode).
+	SignalTerminate
+
+	// SignalIgnore ignores the signal, proc_raise returns successfully.
+	SignalIgnore
+
+	// SignalHandle calls a function of the host with the signal.
+	SignalHandle
+)
+
+func (a SignalAction) String() string {
+	switch a {
+	case SignalDefault:
+		return "default"
+	case SignalTerminate:
+		return "terminate"
+	case SignalIgnore:
+		return "ignore"
+	case SignalHandle:
+		return "handle"
+	default:
+		return fmt.Sprintf("SignalAction(%d)", a)
+	}
+}
+
+// ParseSignalAction parses the name of a signal action, either "default",
+// "terminate", or "ignore". The handle action has no name since it requires a
+// function of the host.
+func ParseSignalAction(name string) (SignalAction, error) {
+	switch name {
+	case "default":
+		return SignalDefault, nil
+	case "terminate":
+		return SignalTerminate, nil
+	case "ignore":
+		return SignalIgnore, nil
+	default:
+		return 0, fmt.Errorf("invalid signal action %q, expected default, terminate, or ignore", name)
+	}
+}
+
+// DefaultAction returns the action that POSIX systems take by default when a
+// process receives the signal. Since guests cannot be stopped and continued,
+// the signals which stop processes are ignored.
+func (s Signal) DefaultAction() SignalAction {
+	switch s {
+	case SIGNONE, SIGCHLD, SIGCONT, SIGURG, SIGWINCH, SIGSTOP, SIGTSTP, SIGTTIN, SIGTTOU:
+		return SignalIgnore
+	default:
+		return SignalTerminate
+	}
+}
+
+// ExitCode returns the exit code of a guest terminated by the signal, which
+// is 128 plus the number of the signal on Linux, like the exit status that
+// shells report for processes terminated by signals (e.g. 134 for SIGABRT).
+func (s Signal) ExitCode() ExitCode {
+	if int(s) < len(signalNumbers) {
+		return 128 + ExitCode(signalNumbers[s])
+	}
+	return 128 + ExitCode(s)
+}
+
+// signalNumbers are the numbers of the signals on Linux, which differ from
+// the WASI numbering after SIGTERM.
+var signalNumbers = [...]uint8{
+	SIGNONE:   0,
+	SIGHUP:    1,
+	SIGINT:    2,
+	SIGQUIT:   3,
+	SIGILL:    4,
+	SIGTRAP:   5,
+	SIGABRT:   6,
+	SIGBUS:    7,
+	SIGFPE:    8,
+	SIGKILL:   9,
+	SIGUSR1:   10,
+	SIGSEGV:   11,
+	SIGUSR2:   12,
+	SIGPIPE:   13,
+	SIGALRM:   14,
+	SIGTERM:   15,
+	SIGCHLD:   17,
+	SIGCONT:   18,
+	SIGSTOP:   19,
+	SIGTSTP:   20,
+	SIGTTIN:   21,
+	SIGTTOU:   22,
+	SIGURG:    23,
+	SIGXCPU:   24,
+	SIGXFSZ:   25,
+	SIGVTALRM: 26,
+	SIGPROF:   27,
+	SIGWINCH:  28,
+	SIGPOLL:   29,
+	SIGPWR:    30,
+	SIGSYS:    31,
+}
+
+// ParseSignal parses a signal from its name (e.g. SIGUSR1 or USR1), or its
+// number in the WASI numbering.
+func ParseSignal(s string) (Signal, error) {
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for i, n := range signalNames {
+		if n == name {
+			return Signal(i), nil
+		}
+	}
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil && n < uint64(len(signalNames)) {
+		return Signal(n), nil
+	}
+	return 0, fmt.Errorf("invalid signal: %q", s)
+}
+
 func (s Signal) String() string {
 	if int(s) < len(signalStrings) {
 		return signalStrings[s]
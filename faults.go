@@ -0,0 +1,200 @@
+package wasi
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+)
+
+// IOFaults configures the faults injected by InjectIOFaults.
+//
+// Rates are probabilities between 0 and 1 that a fault is injected in a
+// system call.
+type IOFaults struct {
+	// ShortRead is the rate at which reads are limited to a random fraction
+	// of the size of the buffers passed by the guest.
+	ShortRead float64
+
+	// ShortWrite is the rate at which writes are limited to a random
+	// fraction of the size of the buffers passed by the guest.
+	ShortWrite float64
+
+	// SplitIOVecs is the rate at which reads and writes only transfer data
+	// to or from the first non-empty buffer of vectored I/O operations.
+	SplitIOVecs float64
+
+	// EAGAIN is the rate at which I/O operations on non-blocking file
+	// descriptors fail with EAGAIN without reaching the underlying system.
+	EAGAIN float64
+
+	// EAGAINBurst is the number of following I/O operations on the same file
+	// descriptor which also fail with EAGAIN after one was injected,
+	// simulating storms of spurious wake ups.
+	EAGAINBurst int
+
+	// Rand is the source of randomness. When nil, a source with a fixed seed
+	// is used so that the faults are reproducible.
+	Rand *rand.Rand
+}
+
+// InjectIOFaults wraps a System to force short reads and writes, partial
+// handling of vectored I/O, and spurious EAGAIN errors at configurable rates.
+//
+// The wrapper is intended for testing: guests are exercised against worst
+// case behaviors of the host which are permitted by the specification of
+// the system calls, but rarely occur naturally (e.g. with fast local disks).
+// Data is never lost; reads and writes are limited before reaching the
+// underlying system.
+func InjectIOFaults(system System, faults IOFaults) System {
+	if faults.Rand == nil {
+		faults.Rand = rand.New(rand.NewSource(0))
+	}
+	return &ioFaults{
+		System: system,
+		faults: faults,
+		bursts: make(map[FD]int),
+	}
+}
+
+type ioFaults struct {
+	System
+	faults IOFaults
+	mutex  sync.Mutex
+	bursts map[FD]int
+}
+
+func (f *ioFaults) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.faults.Rand.Float64() < rate
+}
+
+func (f *ioFaults) intn(n int) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.faults.Rand.Intn(n)
+}
+
+// eagain returns true if the I/O operation on fd must fail with EAGAIN.
+func (f *ioFaults) eagain(ctx context.Context, fd FD) bool {
+	f.mutex.Lock()
+	if f.bursts[fd] > 0 {
+		f.bursts[fd]--
+		f.mutex.Unlock()
+		return true
+	}
+	f.mutex.Unlock()
+
+	if !f.roll(f.faults.EAGAIN) {
+		return false
+	}
+	if stat, errno := f.System.FDStatGet(ctx, fd); errno != ESUCCESS || !stat.Flags.Has(NonBlock) {
+		return false
+	}
+	if f.faults.EAGAINBurst > 0 {
+		f.mutex.Lock()
+		f.bursts[fd] = f.faults.EAGAINBurst
+		f.mutex.Unlock()
+	}
+	return true
+}
+
+// limit returns the buffers that the I/O operation is restricted to.
+func (f *ioFaults) limit(iovecs []IOVec, shortRate float64) []IOVec {
+	if f.roll(f.faults.SplitIOVecs) {
+		for i, iovec := range iovecs {
+			if len(iovec) > 0 {
+				iovecs = iovecs[i : i+1]
+				break
+			}
+		}
+	}
+	if !f.roll(shortRate) {
+		return iovecs
+	}
+	size := 0
+	for _, iovec := range iovecs {
+		size += len(iovec)
+	}
+	if size < 2 {
+		return iovecs
+	}
+	limit := 1 + f.intn(size-1)
+	limited := make([]IOVec, 0, len(iovecs))
+	for _, iovec := range iovecs {
+		if len(iovec) >= limit {
+			limited = append(limited, iovec[:limit])
+			break
+		}
+		limited = append(limited, iovec)
+		limit -= len(iovec)
+	}
+	return limited
+}
+
+func (f *ioFaults) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	if f.eagain(ctx, fd) {
+		return 0, EAGAIN
+	}
+	return f.System.FDRead(ctx, fd, f.limit(iovecs, f.faults.ShortRead))
+}
+
+func (f *ioFaults) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	return f.System.FDPread(ctx, fd, f.limit(iovecs, f.faults.ShortRead), offset)
+}
+
+func (f *ioFaults) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	if f.eagain(ctx, fd) {
+		return 0, EAGAIN
+	}
+	return f.System.FDWrite(ctx, fd, f.limit(iovecs, f.faults.ShortWrite))
+}
+
+func (f *ioFaults) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	return f.System.FDPwrite(ctx, fd, f.limit(iovecs, f.faults.ShortWrite), offset)
+}
+
+func (f *ioFaults) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	if f.eagain(ctx, fd) {
+		return -1, nil, nil, EAGAIN
+	}
+	return f.System.SockAccept(ctx, fd, flags)
+}
+
+func (f *ioFaults) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	if f.eagain(ctx, fd) {
+		return 0, 0, EAGAIN
+	}
+	return f.System.SockRecv(ctx, fd, f.limit(iovecs, f.faults.ShortRead), flags)
+}
+
+func (f *ioFaults) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	if f.eagain(ctx, fd) {
+		return 0, EAGAIN
+	}
+	return f.System.SockSend(ctx, fd, f.limit(iovecs, f.faults.ShortWrite), flags)
+}
+
+func (f *ioFaults) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	if f.eagain(ctx, fd) {
+		return 0, 0, nil, EAGAIN
+	}
+	return f.System.SockRecvFrom(ctx, fd, f.limit(iovecs, f.faults.ShortRead), flags)
+}
+
+func (f *ioFaults) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	if f.eagain(ctx, fd) {
+		return 0, EAGAIN
+	}
+	return f.System.SockSendTo(ctx, fd, f.limit(iovecs, f.faults.ShortWrite), flags, addr)
+}
+
+func (f *ioFaults) FDClose(ctx context.Context, fd FD) Errno {
+	f.mutex.Lock()
+	delete(f.bursts, fd)
+	f.mutex.Unlock()
+	return f.System.FDClose(ctx, fd)
+}
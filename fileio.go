@@ -0,0 +1,164 @@
+package wasi
+
+import (
+	"context"
+	"sync"
+)
+
+// FileIOLimits configures the rates at which LimitFileIO lets guests read and
+// write regular files. Zero values mean that the rate is not limited.
+type FileIOLimits struct {
+	// ReadOps and WriteOps limit the numbers of read and write operations
+	// per second.
+	ReadOps  int64
+	WriteOps int64
+
+	// ReadBytes and WriteBytes limit the numbers of bytes read and written
+	// per second.
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+// LimitFileIO wraps a System to limit the rates at which the guest reads and
+// writes regular files, so batch guests do not starve co-tenants of disk
+// bandwidth.
+//
+// The limits apply to fd_read, fd_write, fd_pread and fd_pwrite across all
+// the files of the guest. As with LimitBandwidth, system calls are delayed
+// when the rates exceed the limits, but never truncated. To find which file
+// descriptors are regular files, the wrapper queries their file type with
+// fd_fdstat_get the first time that they are read from or written to.
+func LimitFileIO(system System, limits FileIOLimits) System {
+	return &fileIOLimiter{
+		System:     system,
+		readOps:    newTokenBucket(limits.ReadOps),
+		writeOps:   newTokenBucket(limits.WriteOps),
+		readBytes:  newTokenBucket(limits.ReadBytes),
+		writeBytes: newTokenBucket(limits.WriteBytes),
+		files:      make(map[FD]bool),
+	}
+}
+
+type fileIOLimiter struct {
+	System
+	readOps    *tokenBucket
+	writeOps   *tokenBucket
+	readBytes  *tokenBucket
+	writeBytes *tokenBucket
+	mutex      sync.Mutex
+	// files maps file descriptors to true if they are regular files.
+	files map[FD]bool
+}
+
+func (l *fileIOLimiter) isFile(ctx context.Context, fd FD) bool {
+	l.mutex.Lock()
+	file, ok := l.files[fd]
+	l.mutex.Unlock()
+	if ok {
+		return file
+	}
+	stat, errno := l.System.FDStatGet(ctx, fd)
+	if errno != ESUCCESS {
+		return false
+	}
+	file = stat.FileType == RegularFileType
+	l.mutex.Lock()
+	l.files[fd] = file
+	l.mutex.Unlock()
+	return file
+}
+
+func (l *fileIOLimiter) waitRead(ctx context.Context) Errno {
+	l.readOps.take(1)
+	if err := l.readOps.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	if err := l.readBytes.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	return ESUCCESS
+}
+
+func (l *fileIOLimiter) waitWrite(ctx context.Context) Errno {
+	l.writeOps.take(1)
+	if err := l.writeOps.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	if err := l.writeBytes.wait(ctx); err != nil {
+		return MakeErrno(err)
+	}
+	return ESUCCESS
+}
+
+func (l *fileIOLimiter) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	if !l.isFile(ctx, fd) {
+		return l.System.FDRead(ctx, fd, iovecs)
+	}
+	if errno := l.waitRead(ctx); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.FDRead(ctx, fd, iovecs)
+	l.readBytes.take(size)
+	return size, errno
+}
+
+func (l *fileIOLimiter) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	if !l.isFile(ctx, fd) {
+		return l.System.FDPread(ctx, fd, iovecs, offset)
+	}
+	if errno := l.waitRead(ctx); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.FDPread(ctx, fd, iovecs, offset)
+	l.readBytes.take(size)
+	return size, errno
+}
+
+func (l *fileIOLimiter) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	if !l.isFile(ctx, fd) {
+		return l.System.FDWrite(ctx, fd, iovecs)
+	}
+	if errno := l.waitWrite(ctx); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.FDWrite(ctx, fd, iovecs)
+	l.writeBytes.take(size)
+	return size, errno
+}
+
+func (l *fileIOLimiter) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	if !l.isFile(ctx, fd) {
+		return l.System.FDPwrite(ctx, fd, iovecs, offset)
+	}
+	if errno := l.waitWrite(ctx); errno != ESUCCESS {
+		return 0, errno
+	}
+	size, errno := l.System.FDPwrite(ctx, fd, iovecs, offset)
+	l.writeBytes.take(size)
+	return size, errno
+}
+
+func (l *fileIOLimiter) FDClose(ctx context.Context, fd FD) Errno {
+	errno := l.System.FDClose(ctx, fd)
+	if errno == ESUCCESS {
+		l.mutex.Lock()
+		delete(l.files, fd)
+		l.mutex.Unlock()
+	}
+	return errno
+}
+
+func (l *fileIOLimiter) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := l.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS && from != to {
+		l.mutex.Lock()
+		file, ok := l.files[from]
+		delete(l.files, from)
+		delete(l.files, to)
+		if ok {
+			l.files[to] = file
+		}
+		l.mutex.Unlock()
+	}
+	return errno
+}
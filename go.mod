@@ -3,9 +3,25 @@ module github.com/stealthrocket/wasi-go
 go 1.20
 
 require (
+	github.com/prometheus/client_golang v1.17.0
 	github.com/stealthrocket/wazergo v0.19.1
 	github.com/tetratelabs/wazero v1.2.0
-	golang.org/x/sys v0.8.0
+	golang.org/x/sys v0.11.0
 )
 
-require golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1
+require (
+	github.com/klauspost/compress v1.17.4
+	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
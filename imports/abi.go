@@ -0,0 +1,311 @@
+package imports
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stealthrocket/wasi-go/imports/wasi_snapshot_preview1"
+	"github.com/stealthrocket/wazergo/types"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ImportMismatch describes a function imported by a WebAssembly module from
+// the WASI host module which cannot be satisfied by the host.
+type ImportMismatch struct {
+	// Name is the name of the imported function.
+	Name string
+	// Params and Results are the signature that the module expects.
+	Params  []api.ValueType
+	Results []api.ValueType
+	// HostParams and HostResults are the signature of the function exported
+	// by the host. Both are nil when the function is missing.
+	HostParams  []api.ValueType
+	HostResults []api.ValueType
+	// Missing is true if the host does not export the function at all.
+	Missing bool
+	// Extension is the name of an extension to WASI preview 1 exporting the
+	// function with the signature that the module expects, or the empty
+	// string if there are none (see Builder.Check).
+	Extension string
+}
+
+func (m ImportMismatch) String() string {
+	want := formatSignature(m.Params, m.Results)
+	hint := ""
+	if ext := findExtension(m.Extension); ext != nil {
+		hint = fmt.Sprintf(" (provided by the %s extension, enable with Builder.%s)", ext.name, ext.option)
+	}
+	if m.Missing {
+		return fmt.Sprintf("%s.%s%s: missing%s", wasi_snapshot_preview1.HostModuleName, m.Name, want, hint)
+	}
+	have := formatSignature(m.HostParams, m.HostResults)
+	return fmt.Sprintf("%s.%s%s: signature mismatch (host has %s)%s", wasi_snapshot_preview1.HostModuleName, m.Name, want, have, hint)
+}
+
+type knownExtension struct {
+	name      string
+	extension *wasi_snapshot_preview1.Extension
+	option    string              // the Builder method enabling the extension
+	enabled   func(*Builder) bool // whether the builder enables the extension
+}
+
+// knownExtensions is the list of extensions that the builder can enable,
+// in order of preference when multiple extensions export a function.
+var knownExtensions = []knownExtension{
+	{"wasmedgev2", &wasi_snapshot_preview1.WasmEdgeV2, "WithSocketsExtension", func(b *Builder) bool {
+		return b.socketsExtension == &wasi_snapshot_preview1.WasmEdgeV2
+	}},
+	{"wasmedgev1", &wasi_snapshot_preview1.WasmEdgeV1, "WithSocketsExtension", func(b *Builder) bool {
+		return b.socketsExtension == &wasi_snapshot_preview1.WasmEdgeV1
+	}},
+	{"cancellation", &wasi_snapshot_preview1.Cancellation, "WithCancellation", func(b *Builder) bool {
+		return b.cancellation != nil
+	}},
+	{"copy", &wasi_snapshot_preview1.FileCopy, "WithFileCopy", func(b *Builder) bool {
+		return b.fileCopy
+	}},
+	{"mmap", &wasi_snapshot_preview1.FileMmap, "WithFileMmap", func(b *Builder) bool {
+		return b.fileMmap
+	}},
+	{"terminal", &wasi_snapshot_preview1.Terminal, "WithTerminal", func(b *Builder) bool {
+		return b.terminal
+	}},
+	{"signals", &wasi_snapshot_preview1.Signals, "WithSignals", func(b *Builder) bool {
+		return b.signals
+	}},
+	{"process", &wasi_snapshot_preview1.Process, "WithCommands", func(b *Builder) bool {
+		return len(b.commands) > 0 || b.childModules != nil
+	}},
+	{"shm", &wasi_snapshot_preview1.SharedMemory, "WithSharedMemory", func(b *Builder) bool {
+		return b.sharedMemory != nil
+	}},
+}
+
+func findExtension(name string) *knownExtension {
+	for i := range knownExtensions {
+		if knownExtensions[i].name == name {
+			return &knownExtensions[i]
+		}
+	}
+	return nil
+}
+
+// providingExtension returns the first of the known extensions exporting the
+// function with the given name and signature, or nil if there are none.
+func providingExtension(name string, params, results []api.ValueType) *knownExtension {
+	for i, known := range knownExtensions {
+		fn, ok := (*known.extension)[name]
+		if ok && equalValueTypes(params, valueTypes(fn.Params)) && equalValueTypes(results, valueTypes(fn.Results)) {
+			return &knownExtensions[i]
+		}
+	}
+	return nil
+}
+
+// extensions returns the known extensions enabled by the configuration of
+// the builder.
+func (b *Builder) extensions() []*knownExtension {
+	var extensions []*knownExtension
+	for i, known := range knownExtensions {
+		if known.enabled(b) {
+			extensions = append(extensions, &knownExtensions[i])
+		}
+	}
+	return extensions
+}
+
+// hostExtensions returns the extensions that the host module instantiated by
+// the builder exports functions from.
+func (b *Builder) hostExtensions() []wasi_snapshot_preview1.Extension {
+	var extensions []wasi_snapshot_preview1.Extension
+	for _, known := range b.extensions() {
+		extensions = append(extensions, *known.extension)
+	}
+	return extensions
+}
+
+// CheckImports verifies that the functions imported by a module from the
+// WASI host module are satisfied by WASI preview 1 and the given extensions,
+// without instantiating the module.
+//
+// The function returns the list of imports which are either missing from the
+// host module or have a different signature, sorted by name. An empty list
+// means that instantiation will not fail due to unresolved WASI imports.
+//
+// Imports from modules other than wasi_snapshot_preview1 are not checked.
+func CheckImports(module wazero.CompiledModule, extensions ...wasi_snapshot_preview1.Extension) []ImportMismatch {
+	host := wasi_snapshot_preview1.NewHostModule(extensions...).Functions()
+
+	var mismatches []ImportMismatch
+	for _, f := range module.ImportedFunctions() {
+		moduleName, name, ok := f.Import()
+		if !ok || moduleName != wasi_snapshot_preview1.HostModuleName {
+			continue
+		}
+		mismatch := ImportMismatch{
+			Name:    name,
+			Params:  f.ParamTypes(),
+			Results: f.ResultTypes(),
+		}
+		fn, ok := host[name]
+		if ok {
+			mismatch.HostParams = valueTypes(fn.Params)
+			mismatch.HostResults = valueTypes(fn.Results)
+			if equalValueTypes(mismatch.Params, mismatch.HostParams) &&
+				equalValueTypes(mismatch.Results, mismatch.HostResults) {
+				continue
+			}
+		} else {
+			mismatch.Missing = true
+		}
+		if known := providingExtension(name, mismatch.Params, mismatch.Results); known != nil {
+			mismatch.Extension = known.name
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Name < mismatches[j].Name
+	})
+	return mismatches
+}
+
+// CheckImports verifies that the functions imported by a module from the WASI
+// host module are satisfied by the extensions configured on the builder.
+//
+// See the package-level CheckImports function for details.
+func (b *Builder) CheckImports(module wazero.CompiledModule) ([]ImportMismatch, error) {
+	if len(b.errors) > 0 {
+		return nil, errors.Join(b.errors...)
+	}
+	return CheckImports(module, b.hostExtensions()...), nil
+}
+
+// CheckReport describes the WASI imports of a module, and how they are
+// satisfied by the configuration of a Builder.
+type CheckReport struct {
+	// Imports is the sorted list of functions that the module imports from
+	// the WASI host module.
+	Imports []string
+	// Required is the list of extensions to WASI preview 1 that the module
+	// imports functions from.
+	Required []string
+	// Provided is the list of extensions to WASI preview 1 enabled by the
+	// configuration of the builder.
+	Provided []string
+	// Mismatches is the list of imports which cannot be satisfied by the
+	// configuration of the builder (see CheckImports).
+	Mismatches []ImportMismatch
+}
+
+// Err returns an error listing the unsatisfied imports of the module, or nil
+// if the module can be instantiated with the configuration of the builder.
+func (r *CheckReport) Err() error {
+	if len(r.Mismatches) == 0 {
+		return nil
+	}
+	var s strings.Builder
+	fmt.Fprintf(&s, "%d unsatisfied WASI import(s):", len(r.Mismatches))
+	for _, m := range r.Mismatches {
+		s.WriteString("\n\t")
+		s.WriteString(m.String())
+	}
+	return errors.New(s.String())
+}
+
+// Check inspects the WASI imports of a compiled module and reports which
+// functions and extensions the module needs, and which of them are provided
+// by the configuration of the builder. The module is not instantiated.
+//
+// Hosts can use the method to fail early with an error describing how to
+// configure the builder (see CheckReport.Err), instead of failing to
+// instantiate the module.
+func (b *Builder) Check(module wazero.CompiledModule) (*CheckReport, error) {
+	mismatches, err := b.CheckImports(module)
+	if err != nil {
+		return nil, err
+	}
+	report := &CheckReport{Mismatches: mismatches}
+
+	base := wasi_snapshot_preview1.NewHostModule().Functions()
+	required := make(map[*knownExtension]bool)
+	for _, f := range module.ImportedFunctions() {
+		moduleName, name, ok := f.Import()
+		if !ok || moduleName != wasi_snapshot_preview1.HostModuleName {
+			continue
+		}
+		report.Imports = append(report.Imports, name)
+
+		params, results := f.ParamTypes(), f.ResultTypes()
+		if fn, ok := base[name]; ok &&
+			equalValueTypes(params, valueTypes(fn.Params)) &&
+			equalValueTypes(results, valueTypes(fn.Results)) {
+			continue
+		}
+		if known := providingExtension(name, params, results); known != nil {
+			required[known] = true
+		}
+	}
+	sort.Strings(report.Imports)
+
+	for i := range knownExtensions {
+		if known := &knownExtensions[i]; required[known] {
+			report.Required = append(report.Required, known.name)
+		}
+	}
+	for _, known := range b.extensions() {
+		report.Provided = append(report.Provided, known.name)
+	}
+	return report, nil
+}
+
+func valueTypes(values []types.Value) []api.ValueType {
+	valueTypes := []api.ValueType{}
+	for _, v := range values {
+		valueTypes = append(valueTypes, v.ValueTypes()...)
+	}
+	return valueTypes
+}
+
+func equalValueTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatSignature(params, results []api.ValueType) string {
+	var b strings.Builder
+	b.WriteString("(")
+	for i, p := range params {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(api.ValueTypeName(p))
+	}
+	b.WriteString(")")
+	switch len(results) {
+	case 0:
+	case 1:
+		b.WriteString(" ")
+		b.WriteString(api.ValueTypeName(results[0]))
+	default:
+		b.WriteString(" (")
+		for i, r := range results {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(api.ValueTypeName(r))
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
@@ -2,8 +2,12 @@ package imports
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
+	"net/url"
 	"strings"
 	"time"
 
@@ -17,27 +21,76 @@ type Builder struct {
 	name               string
 	args               []string
 	env                []string
-	mounts             []mount
+	mounts             []Mount
+	rootFS             fs.FS
 	listens            []string
 	dials              []string
+	socketActivation   bool
+	publish            []wasi.PortMapping
+	listenFDs          []int
+	listeners          []net.Listener
+	tlsListens         []string
+	tlsConfig          *tls.Config
+	tlsDials           []string
+	tlsDialConfig      *tls.Config
 	customStdio        bool
 	stdin              int
 	stdout             int
 	stderr             int
+	stdinReader        io.Reader
+	stdoutWriter       io.Writer
+	stderrWriter       io.Writer
 	realtime           func(context.Context) (uint64, error)
 	realtimePrecision  time.Duration
 	monotonic          func(context.Context) (uint64, error)
 	monotonicPrecision time.Duration
+	suspendPolicy      wasi.SuspendPolicy
 	yield              func(context.Context) error
+	yieldEvery         int
 	exit               func(context.Context, int) error
 	raise              func(context.Context, int) error
+	signalActions      map[wasi.Signal]wasi.SignalAction
+	signalHandler      func(context.Context, wasi.Signal) error
 	rand               io.Reader
+	resolver           func(context.Context, string) ([]net.IP, error)
+	resolverCacheTTL   time.Duration
+	proxy              *url.URL
+	network            *VirtualNetwork
 	socketsExtension   *wasi_snapshot_preview1.Extension
 	pathOpenSockets    bool
 	nonBlockingStdio   bool
+	ioURing            bool
+	dirCacheSize       int
+	windowsPaths       bool
+	writeScanner       wasi.WriteScanner
+	dryRun             io.Writer
+	deterministic      bool
+	seed               int64
+	record             io.Writer
+	replay             io.Reader
 	tracer             io.Writer
+	tracerFormat       string
+	tracerFilter       *wasi.TraceFilter
+	tracerSwitch       *wasi.TraceSwitch
+	resourceUsage      *wasi.ResourceUsage
+	bandwidth          wasi.Bandwidth
+	fileIOLimits       wasi.FileIOLimits
+	connectionLimits   wasi.ConnectionLimits
+	audit              func(context.Context, wasi.Denial)
+	policy             *wasi.Policy
+	denyPaths          []string
+	allowDials         []string
 	decorators         []wasi_snapshot_preview1.Decorator
 	wrappers           []func(wasi.System) wasi.System
+	preloads           []Preload
+	cancellation       context.Context
+	fileCopy           bool
+	fileMmap           bool
+	terminal           bool
+	signals            bool
+	commands           []string
+	childModules       wazero.RuntimeConfig
+	sharedMemory       *wasi.SharedMemory
 	errors             []error
 }
 
@@ -46,9 +99,38 @@ func NewBuilder() *Builder {
 	return &Builder{}
 }
 
-type mount struct {
-	dir  string
-	mode int
+// Clone returns a copy of the Builder, which can be modified without
+// affecting b (e.g. to set the arguments or environment of an instance).
+//
+// The values set by the options are shallow copied: the io.Reader and
+// io.Writer values (e.g. of WithStdioStreams or WithTracer), the trace
+// switch, and the functions, are shared by the builders.
+func (b *Builder) Clone() *Builder {
+	c := *b
+	// Clip the slices that options append to, so appending to the copy
+	// does not write to the backing arrays of b.
+	c.mounts = b.mounts[:len(b.mounts):len(b.mounts)]
+	c.preloads = b.preloads[:len(b.preloads):len(b.preloads)]
+	c.errors = b.errors[:len(b.errors):len(b.errors)]
+	return &c
+}
+
+// Mount is a directory of the host preopened for the guest.
+type Mount struct {
+	// HostPath is the path of the directory on the host.
+	HostPath string
+	// GuestPath is the path that the directory is exposed as to the guest.
+	// Defaults to HostPath.
+	GuestPath string
+	// ReadOnly removes the rights to modify the directory and the files
+	// opened from it.
+	ReadOnly bool
+	// Rights are the rights of the directory. Defaults to
+	// wasi.DirectoryRights.
+	Rights wasi.Rights
+	// RightsInheriting are the rights of the files and directories opened
+	// from the directory. Defaults to wasi.DirectoryRights|wasi.FileRights.
+	RightsInheriting wasi.Rights
 }
 
 // WithName sets the name of the module, which is exposed to the module
@@ -72,36 +154,58 @@ func (b *Builder) WithEnv(env ...string) *Builder {
 
 // WithDirs specifies a set of directories to preopen.
 //
-// The directory can either be a path, or a string of the form "path:path[:ro]"
-// for compatibility with wazero's WASI preview 1 host module. Since virtual
-// file systems are not supported by this implementation, the two paths must
-// be the same when using this syntax. The optional ":ro" prefix means that
-// this directory is read-only.
+// The directory can either be a path, or a string of the form
+// "host:guest[:ro]" for compatibility with wazero's WASI preview 1 host
+// module, where guest is the path that the directory is exposed as to the
+// guest. The optional ":ro" suffix means that this directory is read-only.
 func (b *Builder) WithDirs(dirs ...string) *Builder {
 	for _, dir := range dirs {
-		mode := int('r' + 'w')
 		prefix, readOnly := strings.CutSuffix(dir, ":ro")
-		if readOnly {
-			mode = 'r'
-		}
 		parts := strings.Split(prefix, ":")
-		switch {
-		case len(parts) == 1:
-			dir = parts[0]
-		case len(parts) == 2 && parts[0] == parts[1]:
-			dir = parts[0]
-		case len(parts) == 2:
-			b.errors = append(b.errors, fmt.Errorf("virtual filesystems are not supported (cannot mount %q)", dir))
+		m := Mount{ReadOnly: readOnly}
+		switch len(parts) {
+		case 1:
+			m.HostPath = parts[0]
+		case 2:
+			m.HostPath, m.GuestPath = parts[0], parts[1]
 		default:
 			b.errors = append(b.errors, fmt.Errorf("invalid directory %q", dir))
+			continue
+		}
+		b.mounts = append(b.mounts, m)
+	}
+	return b
+}
+
+// WithMounts specifies a set of directories to preopen, like WithDirs but
+// with the options of each directory expressed as fields of Mount.
+func (b *Builder) WithMounts(mounts ...Mount) *Builder {
+	for _, m := range mounts {
+		if m.HostPath == "" {
+			b.errors = append(b.errors, fmt.Errorf("invalid mount of %q: missing host path", m.GuestPath))
+			continue
 		}
-		b.mounts = append(b.mounts, mount{dir: dir, mode: mode})
+		b.mounts = append(b.mounts, m)
 	}
 	return b
 }
 
+// WithFS sets the file system exposed to the guest as its root directory
+// ("/"), instead of a directory of the host.
+//
+// The file system is read-only unless it implements the interfaces of the
+// iofs package supporting modifications (e.g. iofs.OpenFileFS). Directories
+// of the host set with WithDirs remain accessible to the guest.
+func (b *Builder) WithFS(fsys fs.FS) *Builder {
+	b.rootFS = fsys
+	return b
+}
+
 // WithListens specifies a list of addresses to listen on before starting
 // the module. The listener sockets are added to the set of preopens.
+//
+// Addresses are either host:port addresses of TCP sockets, or paths of unix
+// sockets prefixed with unix: (e.g. unix:/tmp/app.sock).
 func (b *Builder) WithListens(listens ...string) *Builder {
 	b.listens = listens
 	return b
@@ -109,11 +213,109 @@ func (b *Builder) WithListens(listens ...string) *Builder {
 
 // WithDials specifies a list of addresses to dial before starting
 // the module. The connection sockets are added to the set of preopens.
+// The addresses have the same format as those of WithListens.
 func (b *Builder) WithDials(dials ...string) *Builder {
 	b.dials = dials
 	return b
 }
 
+// WithListenFDs specifies a list of sockets listening for connections that
+// are added to the set of preopens, for embedding servers which already hold
+// listening sockets (e.g. inherited from a supervisor) instead of addresses
+// that the module must listen on. Bound datagram sockets are also accepted.
+//
+// The file descriptors are duplicated, the caller remains responsible for
+// closing them; since the duplicates share the file status flags, the
+// sockets are put in non-blocking mode. The preopens are named after the
+// local addresses of the sockets.
+func (b *Builder) WithListenFDs(fds ...int) *Builder {
+	b.listenFDs = fds
+	return b
+}
+
+// WithListeners is like WithListenFDs but takes the sockets as net.Listener
+// values, which must expose their file descriptors with syscall.Conn (e.g.
+// *net.TCPListener or *net.UnixListener). The caller remains responsible
+// for closing the listeners.
+func (b *Builder) WithListeners(listeners ...net.Listener) *Builder {
+	b.listeners = listeners
+	return b
+}
+
+// WithPublish maps the ports that the module binds sockets to onto the
+// addresses that the host listens on instead (see wasi.PublishPorts).
+func (b *Builder) WithPublish(ports ...wasi.PortMapping) *Builder {
+	b.publish = ports
+	return b
+}
+
+// WithSocketActivation enables preopening the sockets passed to the process
+// with the systemd socket activation protocol (LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES), so modules can be run as services managed by systemd
+// socket units. The sockets are named after LISTEN_FDNAMES.
+//
+// The file descriptors of the process are duplicated, they remain open after
+// the module exits and may be passed to the next instances.
+func (b *Builder) WithSocketActivation(enable bool) *Builder {
+	b.socketActivation = enable
+	return b
+}
+
+// WithTLSListens specifies a list of addresses to listen on for TLS
+// connections before starting the module, with the certificate set by
+// WithTLSCertificate or WithTLSConfig.
+//
+// The connections are terminated on the host, and the module accepts the
+// plaintext connections on the listener sockets added to the set of
+// preopens. This lets modules without a TLS stack serve HTTPS. The peer
+// addresses of the connections accepted by the module are loopback
+// addresses.
+func (b *Builder) WithTLSListens(listens ...string) *Builder {
+	b.tlsListens = listens
+	return b
+}
+
+// WithTLSCertificate loads the certificate and private key of the TLS
+// listeners from a pair of PEM encoded files.
+func (b *Builder) WithTLSCertificate(certFile, keyFile string) *Builder {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		b.errors = append(b.errors, fmt.Errorf("invalid TLS certificate: %w", err))
+		return b
+	}
+	b.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return b
+}
+
+// WithTLSConfig sets the configuration of the TLS listeners.
+func (b *Builder) WithTLSConfig(config *tls.Config) *Builder {
+	b.tlsConfig = config
+	return b
+}
+
+// WithTLSDials specifies a list of addresses to establish TLS connections
+// to before starting the module, with the configuration set by
+// WithTLSDialConfig. The addresses have the same format as those of
+// WithDials, and the connections are made through the proxy set by
+// WithProxy, if any.
+//
+// The connections are originated on the host, and the module exchanges the
+// plaintext streams on sockets added to the set of preopens. This lets
+// modules without a TLS stack reach TLS-only upstreams. The sockets of the
+// module are unix sockets.
+func (b *Builder) WithTLSDials(dials ...string) *Builder {
+	b.tlsDials = dials
+	return b
+}
+
+// WithTLSDialConfig sets the configuration of the TLS connections made for
+// WithTLSDials. When nil, or when the ServerName is empty, the certificates
+// of the servers are verified for the host of the dial addresses.
+func (b *Builder) WithTLSDialConfig(config *tls.Config) *Builder {
+	b.tlsDialConfig = config
+	return b
+}
+
 // WithStdio sets stdio file descriptors.
 //
 // Note that the file descriptors will be duplicated before the module takes
@@ -127,7 +329,37 @@ func (b *Builder) WithStdio(stdin, stdout, stderr int) *Builder {
 	return b
 }
 
+// WithStdioStreams sets the streams that the module reads its standard input
+// from, and writes its standard output and error to. A nil stream leaves
+// the corresponding file descriptor to its default, or to the value set by
+// WithStdio.
+//
+// Streams which are not *os.File are connected to the module with pipes,
+// data is copied between the pipes and the streams by goroutines. The
+// system returned by Instantiate waits for all the output of the module to
+// be written to stdout and stderr when it is closed; the goroutine reading
+// from stdin may outlive the system if the reader blocks.
+//
+// The writes to stdout and stderr are made by different goroutines. When
+// stdout and stderr are the same writer, the writes are serialized, so the
+// writer does not need to be safe for concurrent use; otherwise the writers
+// must not share state without synchronizing access to it.
+func (b *Builder) WithStdioStreams(stdin io.Reader, stdout, stderr io.Writer) *Builder {
+	b.stdinReader = stdin
+	b.stdoutWriter = stdout
+	b.stderrWriter = stderr
+	return b
+}
+
 // WithRealtimeClock sets the realtime clock and precision.
+//
+// The clock returns the number of nanoseconds since the Unix epoch, and the
+// precision is reported to the module by clock_res_get. By default, the
+// clock is read with time.Now and has a precision of one microsecond.
+//
+// The clock is also used to compute the deadlines of the absolute timeouts
+// passed to poll_oneoff, so overriding it virtualizes the time observed by
+// the module.
 func (b *Builder) WithRealtimeClock(clock func(context.Context) (uint64, error), precision time.Duration) *Builder {
 	b.realtime = clock
 	b.realtimePrecision = precision
@@ -135,30 +367,129 @@ func (b *Builder) WithRealtimeClock(clock func(context.Context) (uint64, error),
 }
 
 // WithMonotonicClock sets the monotonic clock and precision.
+//
+// The clock returns a number of nanoseconds since an arbitrary point in
+// time, and must never decrease. By default, the clock measures the time
+// elapsed since the program started with a precision of one nanosecond.
+//
+// A clock set by this method takes precedence over the clock selected by
+// WithSuspendPolicy.
 func (b *Builder) WithMonotonicClock(clock func(context.Context) (uint64, error), precision time.Duration) *Builder {
 	b.monotonic = clock
 	b.monotonicPrecision = precision
 	return b
 }
 
+// WithSuspendPolicy sets the behavior of the monotonic clock and of the
+// timeouts observed by the module when the host is suspended and resumed.
+//
+// With wasi.FireOnResume, the default monotonic clock is replaced by one
+// which keeps advancing during suspension (unix.BootTime), and the timeouts
+// that expired while the host was suspended fire within a second after it
+// resumes (see wasi.FireTimersOnResume).
+func (b *Builder) WithSuspendPolicy(policy wasi.SuspendPolicy) *Builder {
+	b.suspendPolicy = policy
+	return b
+}
+
 // WithYield sets the sched_yield function.
 func (b *Builder) WithYield(fn func(context.Context) error) *Builder {
 	b.yield = fn
 	return b
 }
 
+// WithYieldEvery sets the number of system calls after which the sched_yield
+// function is called, as if the module had yielded (see wasi.Cooperate).
+// The function is only called on sched_yield when zero.
+func (b *Builder) WithYieldEvery(n int) *Builder {
+	b.yieldEvery = n
+	return b
+}
+
 // WithExit sets the proc_exit function.
 func (b *Builder) WithExit(fn func(context.Context, int) error) *Builder {
 	b.exit = fn
 	return b
 }
 
-// WithRaise sets the proc_raise function.
+// WithRaise sets the proc_raise function, which replaces the actions set with
+// WithSignalAction.
 func (b *Builder) WithRaise(fn func(context.Context, int) error) *Builder {
 	b.raise = fn
 	return b
 }
 
+// WithSignalAction sets the action taken when the guest raises the signals
+// with proc_raise (e.g. when it calls abort or raise), instead of their
+// default action (see wasi.Signal.DefaultAction). Signals that terminate the
+// guest exit with the exit code of the signal (see wasi.Signal.ExitCode), and
+// signals handled by the host call the function set with WithSignalHandler.
+func (b *Builder) WithSignalAction(action wasi.SignalAction, signals ...wasi.Signal) *Builder {
+	actions := make(map[wasi.Signal]wasi.SignalAction, len(b.signalActions)+len(signals))
+	for signal, action := range b.signalActions {
+		actions[signal] = action
+	}
+	for _, signal := range signals {
+		actions[signal] = action
+	}
+	b.signalActions = actions
+	return b
+}
+
+// WithSignalHandler sets the function called with the signals raised by the
+// guest that have the action wasi.SignalHandle. The error returned by the
+// function is returned to the guest by proc_raise.
+func (b *Builder) WithSignalHandler(fn func(context.Context, wasi.Signal) error) *Builder {
+	b.signalHandler = fn
+	return b
+}
+
+// WithRandSource sets the source of the random bytes returned by random_get.
+// The default is crypto/rand.Reader.
+//
+// Errors returned by the reader, including io.EOF, fail the system call with
+// EIO. WithDeterministic takes precedence over this option.
+func (b *Builder) WithRandSource(r io.Reader) *Builder {
+	b.rand = r
+	return b
+}
+
+// WithResolver sets the function resolving the host names of the addresses
+// passed to sock_getaddrinfo, WithDials and WithListens, and of the sockets
+// opened with path_open. The default is net.DefaultResolver.
+func (b *Builder) WithResolver(resolver func(ctx context.Context, name string) ([]net.IP, error)) *Builder {
+	b.resolver = resolver
+	return b
+}
+
+// WithResolverCache caches the addresses that host names resolve to for the
+// duration of ttl, so guests repeatedly connecting to the same hosts do not
+// pay the cost of name resolution each time. Caching is disabled by default.
+func (b *Builder) WithResolverCache(ttl time.Duration) *Builder {
+	b.resolverCacheTTL = ttl
+	return b
+}
+
+// WithProxy routes the outbound TCP connections of the guest through the
+// SOCKS5 (socks5://) or HTTP CONNECT (http://) proxy server at proxy,
+// transparently to the guest. It applies to the connections made with
+// sock_connect and path_open, and to the addresses passed to WithDials,
+// which are then connected before the module starts.
+func (b *Builder) WithProxy(proxy *url.URL) *Builder {
+	b.proxy = proxy
+	return b
+}
+
+// WithVirtualNetwork connects the module to the virtual network shared with
+// other module instances. The TCP sockets that the module binds to loopback
+// or wildcard addresses are then only reachable from the instances of the
+// network, which reach them by connecting to loopback addresses, without
+// using the network stack of the host.
+func (b *Builder) WithVirtualNetwork(network *VirtualNetwork) *Builder {
+	b.network = network
+	return b
+}
+
 // WithSocketsExtension enables a sockets extension.
 //
 // The name can be one of:
@@ -194,6 +525,73 @@ func (b *Builder) WithNonBlockingStdio(enable bool) *Builder {
 	return b
 }
 
+// WithIOURing enables or disables the io_uring(7) implementation of
+// fd_read, fd_write, poll_oneoff, and sock_accept on Linux, which cuts the
+// overhead of each operation for modules making a lot of I/O. The module
+// falls back to the classic system calls when io_uring is not available.
+func (b *Builder) WithIOURing(enable bool) *Builder {
+	b.ioURing = enable
+	return b
+}
+
+// WithDirCache sets the number of directory handles cached to resolve the
+// paths opened by the module (see unix.System.DirCacheSize), which speeds up
+// opening files in deep directory trees. Caching is disabled when zero.
+func (b *Builder) WithDirCache(size int) *Builder {
+	b.dirCacheSize = size
+	return b
+}
+
+// WithWindowsPaths enables or disables the translation of Windows-style
+// paths passed by the guest (see wasi.WindowsPaths).
+func (b *Builder) WithWindowsPaths(enable bool) *Builder {
+	b.windowsPaths = enable
+	return b
+}
+
+// WithWriteScanner sets a function called with the content of the files
+// written by the guest when they are closed or synced (see wasi.ScanWrites).
+func (b *Builder) WithWriteScanner(scan wasi.WriteScanner) *Builder {
+	b.writeScanner = scan
+	return b
+}
+
+// WithDryRun enables the dry-run mode, where changes to the file system are
+// only applied to an in-memory overlay (see wasi.DryRun). The manifest of
+// changes is written to the specified io.Writer when the system is closed.
+func (b *Builder) WithDryRun(enable bool, w io.Writer) *Builder {
+	if !enable {
+		w = nil
+	}
+	b.dryRun = w
+	return b
+}
+
+// WithDeterministic enables or disables the deterministic mode, where the
+// clocks are virtual and only advanced by poll timeouts, random bytes are
+// generated from the seed, and directory entries are sorted by name (see
+// wasi.Deterministic).
+func (b *Builder) WithDeterministic(enable bool, seed int64) *Builder {
+	b.deterministic = enable
+	b.seed = seed
+	return b
+}
+
+// WithRecord enables the recording of the system calls made by the guest
+// and their results to the specified io.Writer (see wasi.Record).
+func (b *Builder) WithRecord(w io.Writer) *Builder {
+	b.record = w
+	return b
+}
+
+// WithReplay answers the system calls made by the guest with the results
+// read from a recording made with WithRecord, instead of accessing the host
+// (see wasi.Replay).
+func (b *Builder) WithReplay(r io.Reader) *Builder {
+	b.replay = r
+	return b
+}
+
 // WithTracer enables the Tracer, and instructs it to write to the
 // specified io.Writer.
 func (b *Builder) WithTracer(enable bool, w io.Writer) *Builder {
@@ -204,6 +602,185 @@ func (b *Builder) WithTracer(enable bool, w io.Writer) *Builder {
 	return b
 }
 
+// WithTracerFormat sets the format of the output produced by the Tracer.
+//
+// The format can be one of:
+// - text: human-readable format, similar to strace (default)
+// - json: one JSON object per system call (see wasi.TraceJSON)
+// - summary: table of system call counts, printed at exit (see wasi.TraceSummary)
+func (b *Builder) WithTracerFormat(format string) *Builder {
+	switch strings.ToLower(format) {
+	case "text", "":
+		b.tracerFormat = "text"
+	case "json":
+		b.tracerFormat = "json"
+	case "summary":
+		b.tracerFormat = "summary"
+	default:
+		b.errors = append(b.errors, fmt.Errorf("invalid tracer format %q", format))
+	}
+	return b
+}
+
+// WithTracerFilter restricts the system calls logged by the Tracer to those
+// matching the comma-separated list of patterns (see wasi.ParseTraceFilter).
+func (b *Builder) WithTracerFilter(filter string) *Builder {
+	if filter == "" {
+		b.tracerFilter = nil
+		return b
+	}
+	f, err := wasi.ParseTraceFilter(filter)
+	if err != nil {
+		b.errors = append(b.errors, err)
+	}
+	b.tracerFilter = f
+	return b
+}
+
+// WithTracerSwitch sets a switch to enable or disable the Tracer at runtime.
+func (b *Builder) WithTracerSwitch(sw *wasi.TraceSwitch) *Builder {
+	b.tracerSwitch = sw
+	return b
+}
+
+// WithResourceUsage records the resources consumed by the guest in usage
+// (see wasi.Account). The same usage can be passed to multiple builders to
+// aggregate the consumption of several instances, e.g. of a tenant.
+func (b *Builder) WithResourceUsage(usage *wasi.ResourceUsage) *Builder {
+	b.resourceUsage = usage
+	return b
+}
+
+// WithBandwidth limits the rates at which the guest sends and receives data
+// on sockets (see wasi.LimitBandwidth).
+func (b *Builder) WithBandwidth(bandwidth wasi.Bandwidth) *Builder {
+	b.bandwidth = bandwidth
+	return b
+}
+
+// WithFileIOLimits limits the rates at which the guest reads and writes
+// regular files (see wasi.LimitFileIO).
+func (b *Builder) WithFileIOLimits(limits wasi.FileIOLimits) *Builder {
+	b.fileIOLimits = limits
+	return b
+}
+
+// WithConnectionLimits limits the connections that the guest accepts and the
+// backlog of the sockets that it listens on (see wasi.LimitConnections).
+func (b *Builder) WithConnectionLimits(limits wasi.ConnectionLimits) *Builder {
+	b.connectionLimits = limits
+	return b
+}
+
+// WithPolicy enforces a policy restricting the paths, network addresses, and
+// environment variables that the guest can access (see wasi.Enforce).
+func (b *Builder) WithPolicy(policy *wasi.Policy) *Builder {
+	b.policy = policy
+	return b
+}
+
+// WithDenyPaths denies the guest access to the paths matching the glob
+// patterns, even when they are in the directories granted to the guest
+// (e.g. "**/.ssh" or "*.key"). See wasi.Policy for the syntax of patterns.
+func (b *Builder) WithDenyPaths(patterns ...string) *Builder {
+	b.denyPaths = patterns
+	return b
+}
+
+// WithAllowDials restricts the destinations that the guest can connect or
+// send datagrams to, with the sockets extensions, to the addresses matching
+// the patterns (e.g. 10.0.0.0/8:443 or *.example.com:*). See
+// wasi.NetworkRule for the syntax of patterns.
+//
+// Destinations are unrestricted when no patterns are set.
+func (b *Builder) WithAllowDials(patterns ...string) *Builder {
+	b.allowDials = patterns
+	return b
+}
+
+// WithAudit sets a function called with each operation denied to the guest
+// for lack of rights or by the sandbox (see wasi.Audit).
+func (b *Builder) WithAudit(audit func(context.Context, wasi.Denial)) *Builder {
+	b.audit = audit
+	return b
+}
+
+// WithCancellation enables the cancellation extension, which gives the guest
+// a handle that it can poll to be notified when ctx is canceled or the system
+// is shut down.
+//
+// The host keeps a reference to ctx until it is canceled, the context should
+// therefore be canceled when the module has completed its work.
+func (b *Builder) WithCancellation(ctx context.Context) *Builder {
+	b.cancellation = ctx
+	return b
+}
+
+// WithFileCopy enables or disables the file copy extension, which lets the
+// guest copy data between file descriptors on the host without passing it
+// through its memory (see wasi_snapshot_preview1.FileCopy).
+func (b *Builder) WithFileCopy(enable bool) *Builder {
+	b.fileCopy = enable
+	return b
+}
+
+// WithFileMmap enables or disables the file mapping extension, which lets the
+// guest map the content of files in its memory (see
+// wasi_snapshot_preview1.FileMmap).
+func (b *Builder) WithFileMmap(enable bool) *Builder {
+	b.fileMmap = enable
+	return b
+}
+
+// WithTerminal enables or disables the terminal extension, which lets the
+// guest control the terminals that its file descriptors refer to, for example
+// to switch them to raw mode, and be notified when the window of the terminal
+// of the host is resized (see wasi_snapshot_preview1.Terminal).
+func (b *Builder) WithTerminal(enable bool) *Builder {
+	b.terminal = enable
+	return b
+}
+
+// WithSignals enables or disables the signals extension, which lets the guest
+// receive the signals of the host process on handles that it polls (see
+// wasi_snapshot_preview1.Signals).
+func (b *Builder) WithSignals(enable bool) *Builder {
+	b.signals = enable
+	return b
+}
+
+// WithCommands enables the process extension, which lets the guest spawn the
+// host programs named by the commands as child processes, with their stdio
+// connected to pipes (see wasi_snapshot_preview1.Process). Commands which are
+// not absolute paths are looked up in the PATH of the host, and the programs
+// run with the environment variables of the guest (see unix.CommandSpawner).
+func (b *Builder) WithCommands(commands ...string) *Builder {
+	b.commands = commands
+	return b
+}
+
+// WithChildModules enables the process extension, which lets the guest spawn
+// the WebAssembly modules of its preopened directories as child processes,
+// with the programs whose names end in .wasm (see
+// wasi_snapshot_preview1.Process). Each child runs in a runtime created with
+// the configuration, with a system of its own, and inherits the environment
+// variables, directories, commands, and restrictions (e.g. WithPolicy,
+// WithDenyPaths, WithAllowDials, or the limits) of the guest. Child modules
+// are disabled when the configuration is nil.
+func (b *Builder) WithChildModules(config wazero.RuntimeConfig) *Builder {
+	b.childModules = config
+	return b
+}
+
+// WithSharedMemory enables the shared memory extension, which lets the guest
+// open the named segments of memory, shared with the other guests configured
+// with the same segments (see wasi_snapshot_preview1.SharedMemory). The
+// extension is disabled when memory is nil.
+func (b *Builder) WithSharedMemory(memory *wasi.SharedMemory) *Builder {
+	b.sharedMemory = memory
+	return b
+}
+
 // WithDecorators sets the host module decorators.
 func (b *Builder) WithDecorators(decorators ...wasi_snapshot_preview1.Decorator) *Builder {
 	b.decorators = decorators
@@ -215,3 +792,27 @@ func (b *Builder) WithWrappers(wrappers ...func(wasi.System) wasi.System) *Build
 	b.wrappers = wrappers
 	return b
 }
+
+// Preload is a WebAssembly module instantiated as a library before the main
+// module, which can import the functions, memories, tables, and globals
+// that it exports.
+type Preload struct {
+	// Name is the module name that the exports of the library are imported
+	// from (e.g. "env" or "libpython").
+	Name string
+	// Module is the compiled module of the library. It must have been
+	// compiled by the runtime passed to Instantiate.
+	Module wazero.CompiledModule
+}
+
+// WithPreloads sets the libraries instantiated after the WASI host module, in
+// order, so they can import WASI and the exports of the libraries before them.
+// Libraries are not started, their _initialize function is called if they
+// export one (the WASI reactor model).
+//
+// This enables dynamic-linking style setups, for example with a language
+// runtime shared by multiple modules.
+func (b *Builder) WithPreloads(preloads ...Preload) *Builder {
+	b.preloads = preloads
+	return b
+}
@@ -0,0 +1,125 @@
+package imports_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/imports"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestBuilderPolicyWindowsPaths(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	for _, dir := range []string{".ssh", "data", "other"} {
+		if err := os.Mkdir(filepath.Join(tmp, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{".ssh/id_rsa", "data/file", "other/file"} {
+		if err := os.WriteFile(filepath.Join(tmp, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	for _, policy := range []*wasi.Policy{
+		// Deny rules only.
+		{},
+		// Deny rules and allowed paths.
+		{Paths: []wasi.PathRule{
+			{Path: "/data", Access: []string{"read"}},
+			{Path: "/.ssh", Access: []string{"read"}},
+		}},
+	} {
+		ctx, system, err := imports.NewBuilder().
+			WithDirs(tmp+":/").
+			WithPolicy(policy).
+			WithDenyPaths("**/.ssh/*").
+			WithWindowsPaths(true).
+			Instantiate(ctx, runtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer system.Close(ctx)
+
+		const root = 3
+		if name, errno := system.FDPreStatDirName(ctx, root); errno != wasi.ESUCCESS || name != "/" {
+			t.Fatalf("fd_prestat_dir_name: %q %s", name, errno)
+		}
+
+		for _, test := range []struct {
+			path string
+			// errno is the expected error with the deny rules only, and
+			// restricted the one when access is also restricted to paths.
+			errno, restricted wasi.Errno
+		}{
+			{`data\file`, wasi.ESUCCESS, wasi.ESUCCESS},
+			{`.ssh/id_rsa`, wasi.EPERM, wasi.EPERM},
+			{`.ssh\id_rsa`, wasi.EPERM, wasi.EPERM},
+			{`C:\.ssh\id_rsa`, wasi.EPERM, wasi.EPERM},
+			{`data/..\other\file`, wasi.ESUCCESS, wasi.EPERM},
+			{`data\..\other\file`, wasi.ESUCCESS, wasi.EPERM},
+		} {
+			want := test.errno
+			if len(policy.Paths) > 0 {
+				want = test.restricted
+			}
+			fd, errno := system.PathOpen(ctx, root, 0, test.path, 0, wasi.FDReadRight, 0, 0)
+			if errno != want {
+				t.Errorf("path_open(%q): wrong errno: want=%s got=%s", test.path, want, errno)
+			}
+			if errno == wasi.ESUCCESS {
+				system.FDClose(ctx, fd)
+			}
+		}
+	}
+}
+
+func TestBuilderStdioStreamsSameWriter(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	// bytes.Buffer is not safe for concurrent use, the output of the module
+	// is lost or the race detector fails the test if the goroutines copying
+	// stdout and stderr write to it at the same time.
+	output := new(bytes.Buffer)
+	ctx, system, err := imports.NewBuilder().
+		WithStdioStreams(nil, output, output).
+		Instantiate(ctx, runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writes = 1000
+	var wg sync.WaitGroup
+	for _, fd := range []wasi.FD{1, 2} {
+		wg.Add(1)
+		go func(fd wasi.FD) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if _, errno := system.FDWrite(ctx, fd, []wasi.IOVec{[]byte("hello\n")}); errno != wasi.ESUCCESS {
+					t.Error("fd_write:", errno)
+					return
+				}
+			}
+		}(fd)
+	}
+	wg.Wait()
+	if err := system.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := strings.Repeat("hello\n", 2*writes); output.String() != want {
+		t.Errorf("wrong output: want %d bytes, got %d", len(want), output.Len())
+	}
+}
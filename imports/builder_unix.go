@@ -6,12 +6,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sync"
 	"syscall"
 
 	"github.com/stealthrocket/wasi-go"
 	"github.com/stealthrocket/wasi-go/imports/wasi_snapshot_preview1"
 	"github.com/stealthrocket/wasi-go/internal/descriptor"
 	"github.com/stealthrocket/wasi-go/internal/sockets"
+	"github.com/stealthrocket/wasi-go/systems/iofs"
 	"github.com/stealthrocket/wasi-go/systems/unix"
 	"github.com/stealthrocket/wazergo"
 	"github.com/tetratelabs/wazero"
@@ -19,10 +25,20 @@ import (
 
 // Instantiate compiles and instantiates the WASI module and binds it to
 // the specified context.
+//
+// The returned system has a Shutdown method, which may be called
+// asynchronously to unblock the calls that the module is waiting on (see
+// unix.System.Shutdown), even when the system is wrapped.
 func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxret context.Context, sys wasi.System, err error) {
 	if len(b.errors) > 0 {
 		return ctx, nil, errors.Join(b.errors...)
 	}
+	if len(b.tlsListens) > 0 && b.tlsConfig == nil {
+		return ctx, nil, errors.New("TLS listeners require a certificate")
+	}
+	if b.record != nil && b.replay != nil {
+		return ctx, nil, errors.New("system calls cannot be both recorded and replayed")
+	}
 
 	name := defaultName
 	if b.name != "" {
@@ -43,6 +59,9 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 		realtimePrecision = b.realtimePrecision
 	}
 	monotonic := defaultMonotonic
+	if b.suspendPolicy == wasi.FireOnResume {
+		monotonic = unix.BootTime
+	}
 	if b.monotonic != nil {
 		monotonic = b.monotonic
 	}
@@ -55,30 +74,40 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 	if b.yield != nil {
 		yield = b.yield
 	}
-	raise := defaultRaise
-	if b.raise != nil {
-		raise = b.raise
-	}
 	exit := defaultExit
 	if b.exit != nil {
 		exit = b.exit
 	}
+	raise := signalRaise(b.signalActions, b.signalHandler, exit)
+	if b.raise != nil {
+		raise = b.raise
+	}
 	rand := defaultRand
 	if b.rand != nil {
 		rand = b.rand
 	}
 
 	unixSystem := &unix.System{
-		Args:               append([]string{name}, b.args...),
-		Environ:            b.env,
-		Realtime:           realtime,
-		RealtimePrecision:  realtimePrecision,
-		Monotonic:          monotonic,
-		MonotonicPrecision: monotonicPrecision,
-		Yield:              yield,
-		Raise:              raise,
-		Rand:               rand,
-		Exit:               exit,
+		Args:                    append([]string{name}, b.args...),
+		Environ:                 b.env,
+		Realtime:                realtime,
+		RealtimePrecision:       realtimePrecision,
+		Monotonic:               monotonic,
+		MonotonicPrecision:      monotonicPrecision,
+		ProcessCPUTime:          unix.ProcessCPUTime,
+		ProcessCPUTimePrecision: defaultCPUTimePrecision,
+		ThreadCPUTime:           unix.NewThreadCPUTime(),
+		ThreadCPUTimePrecision:  defaultCPUTimePrecision,
+		Yield:                   yield,
+		Raise:                   raise,
+		Rand:                    rand,
+		Resolver:                b.resolver,
+		ResolverCacheTTL:        b.resolverCacheTTL,
+		Proxy:                   b.proxy,
+		Network:                 b.network,
+		IOUring:                 b.ioURing,
+		DirCacheSize:            b.dirCacheSize,
+		Exit:                    exit,
 	}
 	system := wasi.System(unixSystem)
 	defer func() {
@@ -90,24 +119,118 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 	if b.pathOpenSockets {
 		system = &unix.PathOpenSockets{System: unixSystem}
 	}
+	if b.rootFS != nil {
+		fsSystem := new(iofs.System)
+		fsSystem.Mount(b.rootFS, "/")
+		system = wasi.Mux(wasi.Routes{Default: system, Files: fsSystem})
+	}
+	if b.yieldEvery > 0 {
+		system = wasi.Cooperate(system, b.yieldEvery, yield)
+	}
+	if len(b.publish) > 0 {
+		system = wasi.PublishPorts(system, b.publish...)
+	}
+	if b.suspendPolicy == wasi.FireOnResume {
+		system = wasi.FireTimersOnResume(system, resumeInterval)
+	}
+	if b.dryRun != nil {
+		system = wasi.DryRun(system, b.dryRun)
+	}
+	if b.writeScanner != nil {
+		system = wasi.ScanWrites(system, b.writeScanner)
+	}
+	if b.deterministic {
+		system = wasi.Deterministic(system, b.seed)
+	}
+	if b.record != nil {
+		system = wasi.Record(system, b.record)
+	}
+	if b.replay != nil {
+		system = wasi.Replay(system, b.replay)
+	}
+	if b.bandwidth != (wasi.Bandwidth{}) {
+		system = wasi.LimitBandwidth(system, b.bandwidth)
+	}
+	if b.fileIOLimits != (wasi.FileIOLimits{}) {
+		system = wasi.LimitFileIO(system, b.fileIOLimits)
+	}
+	if b.connectionLimits != (wasi.ConnectionLimits{}) {
+		system = wasi.LimitConnections(system, b.connectionLimits)
+	}
+	if b.policy != nil || len(b.denyPaths) > 0 || len(b.allowDials) > 0 {
+		var policy wasi.Policy
+		if b.policy != nil {
+			policy = *b.policy
+		}
+		policy.Deny = append(policy.Deny[:len(policy.Deny):len(policy.Deny)], b.denyPaths...)
+		if len(b.allowDials) > 0 {
+			policy = policy.AllowDials(b.allowDials...)
+		}
+		enforced, err := wasi.Enforce(system, &policy)
+		if err != nil {
+			return ctx, nil, err
+		}
+		system = enforced
+	}
+	// Paths are translated before the policy is enforced, otherwise the
+	// Windows spelling of the paths would not match the rules.
+	if b.windowsPaths {
+		system = wasi.WindowsPaths(system)
+	}
 	if b.tracer != nil {
-		system = wasi.Trace(b.tracer, system)
+		var options []wasi.TraceOption
+		if b.tracerFilter != nil {
+			options = append(options, wasi.WithTraceFilter(b.tracerFilter))
+		}
+		if b.tracerSwitch != nil {
+			options = append(options, wasi.WithTraceSwitch(b.tracerSwitch))
+		}
+		switch b.tracerFormat {
+		case "json":
+			system = wasi.TraceJSON(b.tracer, system, options...)
+		case "summary":
+			system = wasi.TraceSummary(b.tracer, system, options...)
+		default:
+			system = wasi.Trace(b.tracer, system, options...)
+		}
+	}
+	if b.audit != nil {
+		system = wasi.Audit(system, b.audit)
+	}
+	if b.resourceUsage != nil {
+		system = wasi.Account(system, b.resourceUsage)
 	}
 	for _, wrap := range b.wrappers {
 		system = wrap(system)
 	}
 
+	// When stdout and stderr are the same writer, the two goroutines copying
+	// the output of the module write to it concurrently.
+	stdoutWriter, stderrWriter := b.stdoutWriter, b.stderrWriter
+	if sameWriter(stdoutWriter, stderrWriter) {
+		w := &lockedWriter{writer: stdoutWriter}
+		stdoutWriter, stderrWriter = w, w
+	}
+
+	var copies *sync.WaitGroup
 	for fd, stdio := range []struct {
-		fd   int
-		open int
-		path string
+		fd     int
+		open   int
+		path   string
+		reader io.Reader
+		writer io.Writer
 	}{
-		{stdin, syscall.O_RDONLY, "/dev/stdin"},
-		{stdout, syscall.O_WRONLY, "/dev/stdout"},
-		{stderr, syscall.O_WRONLY, "/dev/stderr"},
+		{stdin, syscall.O_RDONLY, "/dev/stdin", b.stdinReader, nil},
+		{stdout, syscall.O_WRONLY, "/dev/stdout", nil, stdoutWriter},
+		{stderr, syscall.O_WRONLY, "/dev/stderr", nil, stderrWriter},
 	} {
 		var err error
-		if stdio.fd < 0 {
+		if stdio.reader != nil || stdio.writer != nil {
+			if copies == nil {
+				copies = new(sync.WaitGroup)
+			}
+			stdio.fd, err = stdioPipe(stdio.reader, stdio.writer, copies)
+		} else if stdio.fd < 0 {
 			stdio.fd, err = syscall.Open(stdio.path, stdio.open, 0)
 			// Some systems may not allow opening stdio files on /dev, fallback
 			// duplicating the process file descriptors which comes with the
@@ -124,13 +247,18 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 		if err != nil {
 			return ctx, nil, fmt.Errorf("unable to open %s: %w", stdio.path, err)
 		}
-		rights := wasi.FileRights
-		if descriptor.IsATTY(stdio.fd) {
-			rights = wasi.TTYRights
-		}
+		// Guests tell that stdio is a terminal when it is a character device
+		// without the rights to seek (e.g. isatty in wasi-libc). Files
+		// redirected to stdio are reported as regular files, and the other
+		// files, such as pipes, as character devices with the rights to seek.
 		stat := wasi.FDStat{
 			FileType:   wasi.CharacterDeviceType,
-			RightsBase: rights,
+			RightsBase: wasi.FileRights,
+		}
+		if descriptor.IsATTY(stdio.fd) {
+			stat.RightsBase = wasi.TTYRights
+		} else if isRegularFile(stdio.fd) {
+			stat.FileType = wasi.RegularFileType
 		}
 		if b.nonBlockingStdio {
 			if err := syscall.SetNonblock(stdio.fd, true); err != nil {
@@ -141,18 +269,32 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 		unixSystem.Preopen(unix.FD(stdio.fd), stdio.path, stat)
 	}
 
+	if copies != nil {
+		system = &stdioSystem{System: system, copies: copies}
+	}
+
 	for _, m := range b.mounts {
-		fd, err := syscall.Open(m.dir, syscall.O_DIRECTORY, 0)
+		fd, err := syscall.Open(m.HostPath, syscall.O_DIRECTORY, 0)
 		if err != nil {
-			return ctx, nil, fmt.Errorf("unable to preopen directory %q: %w", m.dir, err)
+			return ctx, nil, fmt.Errorf("unable to preopen directory %q: %w", m.HostPath, err)
 		}
 		rightsBase := wasi.DirectoryRights
+		if m.Rights != 0 {
+			rightsBase = m.Rights
+		}
 		rightsInheriting := wasi.DirectoryRights | wasi.FileRights
-		if m.mode == 'r' {
+		if m.RightsInheriting != 0 {
+			rightsInheriting = m.RightsInheriting
+		}
+		if m.ReadOnly {
 			rightsBase &^= wasi.WriteRights
 			rightsInheriting &^= wasi.WriteRights
 		}
-		unixSystem.Preopen(unix.FD(fd), m.dir, wasi.FDStat{
+		guestPath := m.GuestPath
+		if guestPath == "" {
+			guestPath = m.HostPath
+		}
+		unixSystem.Preopen(unix.FD(fd), guestPath, wasi.FDStat{
 			FileType:         wasi.DirectoryType,
 			RightsBase:       rightsBase,
 			RightsInheriting: rightsInheriting,
@@ -160,10 +302,57 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 	}
 
 	for _, addr := range b.listens {
-		fd, err := sockets.Listen(addr)
+		fd, err := sockets.Listen(ctx, addr, b.resolver)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("unable to listen on %q: %w", addr, err)
+		}
+		stat := wasi.FDStat{
+			FileType:         wasi.SocketStreamType,
+			Flags:            wasi.NonBlock,
+			RightsBase:       wasi.SockListenRights,
+			RightsInheriting: wasi.SockConnectionRights,
+		}
+		if sockets.IsDatagram(addr) {
+			// Datagram sockets are bound, and receive messages instead
+			// of accepting connections.
+			stat.FileType = wasi.SocketDGramType
+			stat.RightsBase = wasi.SockConnectionRights
+			stat.RightsInheriting = 0
+		}
+		unixSystem.Preopen(unix.FD(fd), addr, stat)
+	}
+	for _, fd := range b.listenFDs {
+		if err := preopenSocket(unixSystem, fd, sockets.Name(fd)); err != nil {
+			return ctx, nil, fmt.Errorf("unable to preopen socket %d: %w", fd, err)
+		}
+	}
+	for _, l := range b.listeners {
+		if err := preopenListener(unixSystem, l); err != nil {
+			return ctx, nil, fmt.Errorf("unable to preopen listener %s: %w", l.Addr(), err)
+		}
+	}
+	if b.socketActivation {
+		activated, err := sockets.Activated()
+		if err != nil {
+			return ctx, nil, err
+		}
+		for _, s := range activated {
+			if err := preopenSocket(unixSystem, s.FD, s.Name); err != nil {
+				return ctx, nil, fmt.Errorf("unable to preopen socket %q: %w", s.Name, err)
+			}
+		}
+	}
+	var tlsSys *tlsSystem
+	if len(b.tlsListens) > 0 || len(b.tlsDials) > 0 {
+		tlsSys = &tlsSystem{System: system}
+		system = tlsSys
+	}
+	for _, addr := range b.tlsListens {
+		fd, listener, err := sockets.ListenTLS(ctx, addr, b.tlsConfig, b.resolver)
 		if err != nil {
 			return ctx, nil, fmt.Errorf("unable to listen on %q: %w", addr, err)
 		}
+		tlsSys.closers = append(tlsSys.closers, listener)
 		unixSystem.Preopen(unix.FD(fd), addr, wasi.FDStat{
 			FileType:         wasi.SocketStreamType,
 			Flags:            wasi.NonBlock,
@@ -171,36 +360,263 @@ func (b *Builder) Instantiate(ctx context.Context, runtime wazero.Runtime) (ctxr
 			RightsInheriting: wasi.SockConnectionRights,
 		})
 	}
+	for _, addr := range b.tlsDials {
+		fd, conn, err := sockets.DialTLS(ctx, addr, b.tlsDialConfig, b.proxy, b.resolver)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("unable to dial %q: %w", addr, err)
+		}
+		tlsSys.closers = append(tlsSys.closers, conn)
+		unixSystem.Preopen(unix.FD(fd), addr, wasi.FDStat{
+			FileType:   wasi.SocketStreamType,
+			Flags:      wasi.NonBlock,
+			RightsBase: wasi.SockConnectionRights,
+		})
+	}
 	for _, addr := range b.dials {
-		fd, err := sockets.Dial(addr)
+		var fd int
+		var err error
+		if b.proxy != nil {
+			fd, err = sockets.DialProxy(ctx, addr, b.proxy, b.resolver)
+		} else {
+			fd, err = sockets.Dial(ctx, addr, b.resolver)
+		}
 		if err != nil && err != sockets.EINPROGRESS {
 			return ctx, nil, fmt.Errorf("unable to dial %q: %w", addr, err)
 		}
+		fileType := wasi.SocketStreamType
+		if sockets.IsDatagram(addr) {
+			fileType = wasi.SocketDGramType
+		}
 		unixSystem.Preopen(unix.FD(fd), addr, wasi.FDStat{
-			FileType:   wasi.SocketStreamType,
+			FileType:   fileType,
 			Flags:      wasi.NonBlock,
 			RightsBase: wasi.SockConnectionRights,
 		})
 	}
 
-	var extensions []wasi_snapshot_preview1.Extension
-	if b.socketsExtension != nil {
-		extensions = append(extensions, *b.socketsExtension)
+	options := []wasi_snapshot_preview1.Option{
+		wasi_snapshot_preview1.WithWASI(system),
+	}
+	if b.cancellation != nil {
+		options = append(options, wasi_snapshot_preview1.WithCancellation(unixSystem.CancellationFD))
+		if done := b.cancellation.Done(); done != nil {
+			go func() { <-done; unixSystem.Cancel() }()
+		}
+	}
+	if b.terminal {
+		options = append(options, wasi_snapshot_preview1.WithTerminalResize(unixSystem.WindowResizeFD))
+	}
+	if b.signals {
+		options = append(options, wasi_snapshot_preview1.WithSignalHandle(unixSystem.SignalHandleOpen))
+	}
+	if b.sharedMemory != nil {
+		options = append(options, wasi_snapshot_preview1.WithSharedMemory(b.sharedMemory))
+	}
+	if len(b.commands) > 0 || b.childModules != nil {
+		unixSystem.Spawn = b.spawner(system)
+		options = append(options, wasi_snapshot_preview1.WithProcesses(unixSystem))
 	}
 
-	hostModule := wasi_snapshot_preview1.NewHostModule(extensions...)
+	hostModule := wasi_snapshot_preview1.NewHostModule(b.hostExtensions()...)
 
 	instance := wazergo.MustInstantiate(ctx, runtime,
 		wazergo.Decorate(hostModule, b.decorators...),
-		wasi_snapshot_preview1.WithWASI(system),
+		options...,
 	)
 
 	ctx = wazergo.WithModuleInstance(ctx, instance)
+
+	for _, preload := range b.preloads {
+		config := wazero.NewModuleConfig().
+			WithName(preload.Name).
+			WithStartFunctions("_initialize")
+		if _, err := runtime.InstantiateModule(ctx, preload.Module, config); err != nil {
+			// Closing the host module instance also closes the system.
+			instance.Close(ctx)
+			system = nil
+			return ctx, nil, fmt.Errorf("unable to preload %q: %w", preload.Name, err)
+		}
+	}
+
 	sys = system
+	if sys != wasi.System(unixSystem) {
+		sys = &shutdownSystem{System: sys, unix: unixSystem}
+	}
 	system = nil
 	return ctx, sys, nil
 }
 
+// stdioPipe returns a file descriptor reading from r or writing to w. The
+// file descriptor of streams that are files is duplicated, a pipe is
+// created for other streams, with a goroutine copying the data between the
+// pipe and the stream.
+func stdioPipe(r io.Reader, w io.Writer, copies *sync.WaitGroup) (int, error) {
+	if f, ok := r.(*os.File); ok {
+		return dup(int(f.Fd()))
+	}
+	if f, ok := w.(*os.File); ok {
+		return dup(int(f.Fd()))
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return -1, err
+	}
+	if r != nil {
+		defer pr.Close()
+		go func() {
+			io.Copy(pw, r)
+			pw.Close()
+		}()
+		return dup(int(pr.Fd()))
+	}
+	defer pw.Close()
+	fd, err := dup(int(pw.Fd()))
+	if err != nil {
+		pr.Close()
+		return -1, err
+	}
+	// The copy completes when the module closes its end of the pipe, which
+	// happens at the latest when the system is closed.
+	copies.Add(1)
+	go func() {
+		defer copies.Done()
+		defer pr.Close()
+		io.Copy(w, pr)
+	}()
+	return fd, nil
+}
+
+// sameWriter returns true if stdout and stderr are the same writer, which is
+// not a file (the file descriptors of files are duplicated instead of being
+// copied to).
+func sameWriter(stdout, stderr io.Writer) bool {
+	if stdout == nil || stderr == nil {
+		return false
+	}
+	if _, ok := stdout.(*os.File); ok {
+		return false
+	}
+	// Comparing interfaces panics if their dynamic type is not comparable.
+	if t := reflect.TypeOf(stdout); t != reflect.TypeOf(stderr) || !t.Comparable() {
+		return false
+	}
+	return stdout == stderr
+}
+
+// lockedWriter serializes the writes to a writer shared by stdout and stderr.
+type lockedWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Write(b)
+}
+
+// stdioSystem is the system returned when the module stdio are connected to
+// streams, it waits for the output of the module to be copied to the
+// streams when closed.
+type stdioSystem struct {
+	wasi.System
+	copies *sync.WaitGroup
+}
+
+func (s *stdioSystem) Close(ctx context.Context) error {
+	err := s.System.Close(ctx)
+	s.copies.Wait()
+	return err
+}
+
+// preopenSocket adds a duplicate of the socket fd to the preopens of the
+// system, with the file type and rights matching the type of the socket and
+// whether it is listening for connections.
+func preopenSocket(system *unix.System, fd int, name string) error {
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return err
+	}
+	stat := wasi.FDStat{
+		Flags:      wasi.NonBlock,
+		RightsBase: wasi.SockConnectionRights,
+	}
+	switch sotype {
+	case syscall.SOCK_STREAM:
+		stat.FileType = wasi.SocketStreamType
+		listening, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return err
+		}
+		if listening != 0 {
+			stat.RightsBase = wasi.SockListenRights
+			stat.RightsInheriting = wasi.SockConnectionRights
+		}
+	case syscall.SOCK_DGRAM:
+		stat.FileType = wasi.SocketDGramType
+	default:
+		return fmt.Errorf("unsupported socket type %d", sotype)
+	}
+	newfd, err := dup(fd)
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(newfd, true); err != nil {
+		syscall.Close(newfd)
+		return err
+	}
+	system.Preopen(unix.FD(newfd), name, stat)
+	return nil
+}
+
+// preopenListener adds a duplicate of the socket of l to the preopens of the
+// system.
+func preopenListener(system *unix.System, l net.Listener) error {
+	c, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T does not expose its file descriptor", l)
+	}
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var preopenErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		preopenErr = preopenSocket(system, int(fd), sockets.Name(int(fd)))
+	}); err != nil {
+		return err
+	}
+	return preopenErr
+}
+
+// tlsSystem is the system returned when TLS connections are terminated or
+// originated on the host for the module, it closes the TLS listeners and
+// connections when closed.
+type tlsSystem struct {
+	wasi.System
+	closers []io.Closer
+}
+
+func (s *tlsSystem) Close(ctx context.Context) error {
+	err := s.System.Close(ctx)
+	for _, c := range s.closers {
+		c.Close()
+	}
+	return err
+}
+
+// shutdownSystem is the system returned when the unix system is wrapped, it
+// exposes the Shutdown method of the unix system which the wrappers hide, so
+// callers can unblock the calls that the module is waiting on.
+type shutdownSystem struct {
+	wasi.System
+	unix *unix.System
+}
+
+func (s *shutdownSystem) Shutdown(ctx context.Context) error {
+	return s.unix.Shutdown(ctx)
+}
+
 func dup(fd int) (int, error) {
 	syscall.ForkLock.Lock()
 	defer syscall.ForkLock.Unlock()
@@ -212,3 +628,8 @@ func dup(fd int) (int, error) {
 	syscall.CloseOnExec(newfd)
 	return newfd, nil
 }
+
+func isRegularFile(fd int) bool {
+	var stat syscall.Stat_t
+	return syscall.Fstat(fd, &stat) == nil && (stat.Mode&syscall.S_IFMT) == syscall.S_IFREG
+}
@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/stealthrocket/wasi-go"
 	"github.com/tetratelabs/wazero/sys"
 )
 
@@ -13,6 +14,11 @@ const (
 	defaultName               = "wasirun-wasm-module"
 	defaultRealtimePrecision  = time.Microsecond
 	defaultMonotonicPrecision = time.Nanosecond
+	defaultCPUTimePrecision   = time.Nanosecond
+
+	// resumeInterval is the maximum delay to fire the timeouts which expired
+	// while the host was suspended, with the wasi.FireOnResume policy.
+	resumeInterval = time.Second
 )
 
 var defaultRand = rand.Reader
@@ -32,7 +38,31 @@ func defaultYield(ctx context.Context) error {
 	return nil
 }
 
-var defaultRaise func(ctx context.Context, signal int) error = nil
+// signalRaise returns a proc_raise function taking the actions of the signals,
+// which calls exit with the exit code of the signals terminating the guest.
+func signalRaise(actions map[wasi.Signal]wasi.SignalAction, handler func(context.Context, wasi.Signal) error, exit func(context.Context, int) error) func(context.Context, int) error {
+	return func(ctx context.Context, signal int) error {
+		s := wasi.Signal(signal)
+		if s > wasi.SIGSYS {
+			return wasi.EINVAL
+		}
+		action := actions[s]
+		if action == wasi.SignalDefault {
+			action = s.DefaultAction()
+		}
+		switch action {
+		case wasi.SignalTerminate:
+			return exit(ctx, int(s.ExitCode()))
+		case wasi.SignalHandle:
+			if handler == nil {
+				return wasi.ENOSYS
+			}
+			return handler(ctx, s)
+		default:
+			return nil
+		}
+	}
+}
 
 func defaultExit(ctx context.Context, exitCode int) error {
 	panic(sys.NewExitError(uint32(exitCode)))
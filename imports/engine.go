@@ -0,0 +1,53 @@
+package imports
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// NewRuntimeConfig returns a wazero runtime configuration which uses the
+// named engine.
+//
+// The engine can be one of:
+// - compiler: compile WebAssembly modules to native code ahead of time
+// - interpreter: interpret WebAssembly modules, which trades execution speed
+// for faster startup and portability
+// - auto: use the compiler when supported by the platform, otherwise fallback
+// to the interpreter
+//
+// An error is returned if the engine name is invalid, or if the compiler is
+// explicitly requested on a platform where it is not supported.
+func NewRuntimeConfig(engine string) (wazero.RuntimeConfig, error) {
+	switch strings.ToLower(engine) {
+	case "auto", "":
+		return wazero.NewRuntimeConfig(), nil
+	case "compiler":
+		if !compilerSupported() {
+			return nil, fmt.Errorf("the compiler engine is not supported on GOOS=%s GOARCH=%s", runtime.GOOS, runtime.GOARCH)
+		}
+		return wazero.NewRuntimeConfigCompiler(), nil
+	case "interpreter":
+		return wazero.NewRuntimeConfigInterpreter(), nil
+	default:
+		return nil, fmt.Errorf("invalid engine %q", engine)
+	}
+}
+
+// compilerSupported mirrors the platform checks performed by wazero, which
+// panics when attempting to use the compiler on unsupported platforms.
+func compilerSupported() bool {
+	switch runtime.GOOS {
+	case "darwin", "windows", "linux", "freebsd":
+	default:
+		return false
+	}
+	switch runtime.GOARCH {
+	case "amd64", "arm64":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package imports
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type VirtualNetwork struct{}
+
+func NewVirtualNetwork() (*VirtualNetwork, error) {
+	return nil, fmt.Errorf("virtual networks are not available on GOOS=%s", runtime.GOOS)
+}
+
+func (n *VirtualNetwork) Close() error { return nil }
@@ -0,0 +1,15 @@
+//go:build unix
+
+package imports
+
+import "github.com/stealthrocket/wasi-go/systems/unix"
+
+// VirtualNetwork is an in-process loopback network which connects the module
+// instances that share it (see Builder.WithVirtualNetwork).
+type VirtualNetwork = unix.VirtualNetwork
+
+// NewVirtualNetwork creates a virtual network. The network must be closed
+// once the module instances which use it have exited.
+func NewVirtualNetwork() (*VirtualNetwork, error) {
+	return unix.NewVirtualNetwork()
+}
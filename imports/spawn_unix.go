@@ -0,0 +1,229 @@
+//go:build unix
+
+package imports
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/systems/unix"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// spawner returns the function spawning the child processes of the guest,
+// which runs the WebAssembly modules read from the file system of the guest
+// if child modules are enabled, and the host programs allowed by
+// WithCommands.
+func (b *Builder) spawner(system wasi.System) unix.Spawner {
+	var commands unix.Spawner
+	if len(b.commands) > 0 {
+		commands = unix.CommandSpawner(b.env, b.commands...)
+	}
+	children := childModules{
+		runtimeConfig: b.childModules,
+		parent:        b.Clone(),
+	}
+	return func(ctx context.Context, args []string, stdio [3]*os.File) (unix.Process, error) {
+		if children.runtimeConfig != nil && strings.HasSuffix(args[0], ".wasm") {
+			return children.spawn(ctx, system, args, stdio)
+		}
+		if commands == nil {
+			return nil, wasi.EACCES
+		}
+		return commands(ctx, args, stdio)
+	}
+}
+
+// childModules is the configuration of the child modules spawned by a guest.
+// Each child runs in its own runtime, with its own system, configured like
+// the guest: it inherits the environment variables, directories, commands,
+// and the restrictions (policy, limits, proxy, etc.) of the guest, so that
+// spawning a module cannot be used to escape the sandbox.
+type childModules struct {
+	runtimeConfig wazero.RuntimeConfig
+	parent        *Builder
+}
+
+// builder returns the builder of a child module, which is a copy of the
+// builder of the guest without the options that only apply to the instance
+// of the guest (arguments, stdio, sockets, exit and signal handlers, traces,
+// etc.).
+func (c *childModules) builder(args []string, stdio [3]*os.File, module wazero.CompiledModule) *Builder {
+	b := c.parent.Clone()
+	b.name, b.args = args[0], args[1:]
+	b.listens, b.dials, b.socketActivation, b.publish = nil, nil, false, nil
+	b.listenFDs, b.listeners, b.tlsListens, b.tlsDials = nil, nil, nil, nil
+	b.stdinReader, b.stdoutWriter, b.stderrWriter = nil, nil, nil
+	b.exit, b.raise, b.signalActions, b.signalHandler = nil, nil, nil, nil
+	b.rand, b.record, b.replay = nil, nil, nil
+	b.tracer, b.tracerFormat, b.tracerFilter, b.tracerSwitch = nil, "", nil, nil
+	b.signals, b.preloads, b.errors = false, nil, nil
+	b = b.WithStdio(int(stdio[0].Fd()), int(stdio[1].Fd()), int(stdio[2].Fd()))
+	if b.socketsExtension != nil {
+		b = b.WithSocketsExtension("auto", module)
+	}
+	return b
+}
+
+func (c *childModules) spawn(ctx context.Context, parent wasi.System, args []string, stdio [3]*os.File) (unix.Process, error) {
+	bytecode, errno := readGuestFile(ctx, parent, args[0])
+	if errno != wasi.ESUCCESS {
+		return nil, errno
+	}
+
+	// The child outlives the call which spawned it, it is only interrupted
+	// when it is killed.
+	childCtx, cancel := context.WithCancel(context.Background())
+	runtime := wazero.NewRuntimeWithConfig(childCtx, c.runtimeConfig.WithCloseOnContextDone(true))
+	module, err := runtime.CompileModule(childCtx, bytecode)
+	if err != nil {
+		runtime.Close(childCtx)
+		cancel()
+		return nil, wasi.ENOEXEC
+	}
+
+	builder := c.builder(args, stdio, module)
+
+	childCtx, system, err := builder.Instantiate(childCtx, runtime)
+	if err != nil {
+		runtime.Close(childCtx)
+		cancel()
+		return nil, err
+	}
+	p := &childModule{
+		runtime: runtime,
+		system:  system,
+		// The systems returned by the builder can always be shut down,
+		// even when they are wrapped.
+		shutdown: system.(interface{ Shutdown(context.Context) error }).Shutdown,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go p.run(childCtx, module)
+	return p, nil
+}
+
+// readGuestFile reads a file from the directories preopened in the system,
+// resolving the path like wasi-libc does, with the longest matching preopen.
+func readGuestFile(ctx context.Context, system wasi.System, filePath string) ([]byte, wasi.Errno) {
+	filePath = path.Clean(filePath)
+	dirfd, relPath := wasi.FD(-1), ""
+	longest := -1
+	for fd := wasi.FD(3); ; fd++ {
+		_, errno := system.FDPreStatGet(ctx, fd)
+		if errno == wasi.EBADF {
+			break
+		}
+		if errno != wasi.ESUCCESS {
+			continue
+		}
+		dir, errno := system.FDPreStatDirName(ctx, fd)
+		if errno != wasi.ESUCCESS {
+			continue
+		}
+		dir = path.Clean(dir)
+		rel, ok := "", false
+		switch {
+		case dir == filePath:
+			rel, ok = ".", true
+		case dir == "/" || dir == ".":
+			rel, ok = strings.TrimPrefix(filePath, "/"), true
+		case strings.HasPrefix(filePath, dir+"/"):
+			rel, ok = filePath[len(dir)+1:], true
+		}
+		if ok && len(dir) > longest {
+			dirfd, relPath, longest = fd, rel, len(dir)
+		}
+	}
+	if dirfd < 0 {
+		return nil, wasi.ENOENT
+	}
+
+	fd, errno := system.PathOpen(ctx, dirfd, wasi.SymlinkFollow, relPath, 0, wasi.FDReadRight, 0, 0)
+	if errno != wasi.ESUCCESS {
+		return nil, errno
+	}
+	defer system.FDClose(ctx, fd)
+
+	var content []byte
+	buffer := make([]byte, 64*1024)
+	for {
+		n, errno := system.FDRead(ctx, fd, []wasi.IOVec{buffer})
+		if errno != wasi.ESUCCESS {
+			return nil, errno
+		}
+		if n == 0 {
+			return content, wasi.ESUCCESS
+		}
+		content = append(content, buffer[:n]...)
+	}
+}
+
+// childModule is an instance of a WebAssembly module running as a child
+// process of a guest.
+type childModule struct {
+	runtime  wazero.Runtime
+	system   wasi.System
+	shutdown func(context.Context) error
+	cancel   context.CancelFunc
+	done     chan struct{}
+	code     wasi.ExitCode
+	mutex    sync.Mutex
+	killed   wasi.Signal
+}
+
+func (p *childModule) run(ctx context.Context, module wazero.CompiledModule) {
+	defer close(p.done)
+	defer p.cancel()
+	defer p.runtime.Close(context.Background())
+	defer p.system.Close(context.Background())
+
+	_, err := p.runtime.InstantiateModule(ctx, module, wazero.NewModuleConfig())
+	var exitErr *sys.ExitError
+	switch {
+	case err == nil:
+		p.code = 0
+	case errors.As(err, &exitErr):
+		p.code = wasi.ExitCode(exitErr.ExitCode())
+	default:
+		// The module trapped, which is how wasi-libc implements abort.
+		p.code = wasi.SIGABRT.ExitCode()
+	}
+
+	p.mutex.Lock()
+	if p.killed != wasi.SIGNONE {
+		p.code = p.killed.ExitCode()
+	}
+	p.mutex.Unlock()
+}
+
+func (p *childModule) Wait() (wasi.ExitCode, error) {
+	<-p.done
+	return p.code, nil
+}
+
+// Signal terminates the module if the default action of the signal is to
+// terminate the process; the other signals are ignored since modules cannot
+// handle them.
+func (p *childModule) Signal(signal wasi.Signal) error {
+	if signal.DefaultAction() != wasi.SignalTerminate {
+		return nil
+	}
+	p.mutex.Lock()
+	if p.killed == wasi.SIGNONE {
+		p.killed = signal
+	}
+	p.mutex.Unlock()
+
+	p.cancel()
+	// Unblock the calls that the module may be waiting on, which are not
+	// interrupted by the cancellation of the context.
+	p.shutdown(context.Background())
+	return nil
+}
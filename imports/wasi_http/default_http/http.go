@@ -2,16 +2,37 @@ package default_http
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/tetratelabs/wazero"
 )
 
 const ModuleName = "default-outgoing-HTTP"
 
-func Instantiate(ctx context.Context, r wazero.Runtime) error {
+type client struct {
+	client *http.Client
+}
+
+// Option configures the host module.
+type Option func(*client)
+
+// WithClient sets the client used to send the requests of the guest.
+// http.DefaultClient is used by default, or if httpClient is nil.
+func WithClient(httpClient *http.Client) Option {
+	return func(c *client) { c.client = httpClient }
+}
+
+func Instantiate(ctx context.Context, r wazero.Runtime, options ...Option) error {
+	c := new(client)
+	for _, option := range options {
+		option(c)
+	}
+	if c.client == nil {
+		c.client = http.DefaultClient
+	}
 	_, err := r.NewHostModuleBuilder(ModuleName).
 		NewFunctionBuilder().WithFunc(requestFn).Export("request").
-		NewFunctionBuilder().WithFunc(handleFn).Export("handle").
+		NewFunctionBuilder().WithFunc(c.handleFn).Export("handle").
 		Instantiate(ctx)
 	return err
 }
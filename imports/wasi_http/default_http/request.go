@@ -15,13 +15,13 @@ func requestFn(_ context.Context, mod api.Module, a, b, c, d, e, f, g, h, j, k,
 
 // Handle handles HTTP client calls.
 // The remaining parameters (b..h) are for the HTTP Options, currently unimplemented.
-func handleFn(_ context.Context, mod api.Module, request, b, c, d, e, f, g, h uint32) uint32 {
+func (c *client) handleFn(ctx context.Context, mod api.Module, request, b, _, d, e, f, g, h uint32) uint32 {
 	req, ok := types.GetRequest(request)
 	if !ok {
 		log.Printf("Failed to get request: %v\n", request)
 		return 0
 	}
-	r, err := req.MakeRequest()
+	r, err := req.MakeRequestWithClient(ctx, c.client)
 	if err != nil {
 		log.Println(err.Error())
 		return 0
@@ -2,6 +2,7 @@ package wasi_http
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/stealthrocket/wasi-go/imports/wasi_http/default_http"
 	"github.com/stealthrocket/wasi-go/imports/wasi_http/streams"
@@ -9,14 +10,31 @@ import (
 	"github.com/tetratelabs/wazero"
 )
 
-func Instantiate(ctx context.Context, rt wazero.Runtime) error {
+// Option configures the wasi-http host modules.
+type Option func(*config)
+
+type config struct {
+	client *http.Client
+}
+
+// WithClient sets the client used to send the HTTP requests of the guest.
+// http.DefaultClient is used by default.
+func WithClient(client *http.Client) Option {
+	return func(c *config) { c.client = client }
+}
+
+func Instantiate(ctx context.Context, rt wazero.Runtime, options ...Option) error {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
 	if err := types.Instantiate(ctx, rt); err != nil {
 		return err
 	}
 	if err := streams.Instantiate(ctx, rt); err != nil {
 		return err
 	}
-	if err := default_http.Instantiate(ctx, rt); err != nil {
+	if err := default_http.Instantiate(ctx, rt, default_http.WithClient(c.client)); err != nil {
 		return err
 	}
 	return nil
@@ -51,11 +51,17 @@ func GetRequest(handle uint32) (*Request, bool) {
 }
 
 func (request *Request) MakeRequest() (*http.Response, error) {
+	return request.MakeRequestWithClient(context.Background(), http.DefaultClient)
+}
+
+// MakeRequestWithClient sends the request with the given client, the request
+// is canceled when ctx is done.
+func (request *Request) MakeRequestWithClient(ctx context.Context, client *http.Client) (*http.Response, error) {
 	var body io.Reader = nil
 	if request.BodyBuffer != nil {
 		body = bytes.NewReader(request.BodyBuffer.Bytes())
 	}
-	r, err := http.NewRequest(request.Method, request.Url(), body)
+	r, err := http.NewRequestWithContext(ctx, request.Method, request.Url(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +70,7 @@ func (request *Request) MakeRequest() (*http.Response, error) {
 		r.Header = http.Header(fields)
 	}
 
-	return http.DefaultClient.Do(r)
+	return client.Do(r)
 }
 
 func newOutgoingRequestFn(_ context.Context, mod api.Module,
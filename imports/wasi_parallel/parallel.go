@@ -0,0 +1,491 @@
+// Package wasi_parallel implements the wasi-parallel proposal, which lets
+// compute-heavy guests fan work out across the cores of the host.
+//
+// Guests create buffers on a device, copy data in and out of them, and run
+// kernels over them with parallel_exec. On the host, the kernels run on a
+// pool of workers, each being an instance of the guest module with its own
+// memory, called from its own goroutine.
+package wasi_parallel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ModuleName is the name of the wasi-parallel host module.
+const ModuleName = "wasi_ephemeral_parallel"
+
+// TableName is the name of the function table that guests must export (e.g.
+// with the --export-table flag of wasm-ld) for the kernels they pass to
+// parallel_exec to be called.
+const TableName = "__indirect_function_table"
+
+// Device hints of get_device.
+const (
+	DefaultDevice uint32 = iota
+	CPUDevice
+	DiscreteGPUDevice
+	IntegratedGPUDevice
+)
+
+// Access modes of create_buffer, from the point of view of the kernels.
+const (
+	ReadAccess uint32 = iota
+	WriteAccess
+	ReadWriteAccess
+)
+
+// maxBuffers is the maximum number of input and output buffers of a call to
+// parallel_exec, which bounds the number of parameters of the kernels.
+const maxBuffers = 64
+
+// cpuDevice is the handle of the only device, which runs the kernels on the
+// CPUs of the host.
+const cpuDevice = 1
+
+// Option configures the wasi-parallel host module.
+type Option func(*config)
+
+type config struct {
+	workers int
+}
+
+// WithWorkers sets the number of workers which run the kernels of the guest
+// concurrently. Defaults to the number of CPUs of the host.
+func WithWorkers(workers int) Option {
+	return func(c *config) { c.workers = workers }
+}
+
+// Instantiate instantiates the wasi-parallel host module, which runs the
+// kernels of the given module. It must be called before the module is
+// instantiated.
+//
+// The kernels are the functions of the table exported by the module as
+// TableName, with the signature:
+//
+//	kernel(thread_id: u32, num_threads: u32, block_size: u32, in_ptr: *u8, in_len: u32, ..., out_ptr: *u8, out_len: u32, ...)
+//
+// where each input and output buffer passed to parallel_exec is a pointer and
+// length in the memory of the worker running the kernel. The workers are
+// instances of the module on which the start function is not run, they share
+// no memory with the guest: kernels must only depend on their buffers, and
+// must not make system calls. Kernels running concurrently must write to
+// disjoint ranges of the output buffers.
+func Instantiate(ctx context.Context, rt wazero.Runtime, module wazero.CompiledModule, options ...Option) error {
+	c := config{workers: runtime.NumCPU()}
+	for _, option := range options {
+		option(&c)
+	}
+	if c.workers < 1 {
+		return fmt.Errorf("invalid number of wasi-parallel workers: %d", c.workers)
+	}
+	p := &parallel{
+		runtime: rt,
+		module:  module,
+		size:    c.workers,
+		buffers: make(map[uint32]*buffer),
+	}
+	_, err := rt.NewHostModuleBuilder(ModuleName).
+		NewFunctionBuilder().WithFunc(p.getDeviceFn).Export("get_device").
+		NewFunctionBuilder().WithFunc(p.createBufferFn).Export("create_buffer").
+		NewFunctionBuilder().WithFunc(p.writeBufferFn).Export("write_buffer").
+		NewFunctionBuilder().WithFunc(p.readBufferFn).Export("read_buffer").
+		NewFunctionBuilder().WithFunc(p.parallelExecFn).Export("parallel_exec").
+		Instantiate(ctx)
+	return err
+}
+
+// DetectWasiParallel returns true if the module imports wasi-parallel.
+func DetectWasiParallel(module wazero.CompiledModule) bool {
+	for _, f := range module.ImportedFunctions() {
+		if moduleName, _, ok := f.Import(); ok && moduleName == ModuleName {
+			return true
+		}
+	}
+	return false
+}
+
+type parallel struct {
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	size    int
+
+	mutex      sync.Mutex
+	buffers    map[uint32]*buffer
+	nextBuffer uint32
+	workers    []*worker
+}
+
+type buffer struct {
+	access uint32
+	data   []byte
+}
+
+func (p *parallel) getDeviceFn(ctx context.Context, mod api.Module, hint, device uint32) uint32 {
+	if hint > IntegratedGPUDevice {
+		return uint32(wasi.EINVAL)
+	}
+	// There are no GPU devices, the hint is only a preference.
+	if !mod.Memory().WriteUint32Le(device, cpuDevice) {
+		return uint32(wasi.EFAULT)
+	}
+	return uint32(wasi.ESUCCESS)
+}
+
+func (p *parallel) createBufferFn(ctx context.Context, mod api.Module, device, size, access, handle uint32) uint32 {
+	if device != cpuDevice {
+		return uint32(wasi.EBADF)
+	}
+	if access > ReadWriteAccess {
+		return uint32(wasi.EINVAL)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		p.nextBuffer++
+		if _, used := p.buffers[p.nextBuffer]; !used && p.nextBuffer != 0 {
+			break
+		}
+	}
+	if !mod.Memory().WriteUint32Le(handle, p.nextBuffer) {
+		return uint32(wasi.EFAULT)
+	}
+	p.buffers[p.nextBuffer] = &buffer{access: access, data: make([]byte, size)}
+	return uint32(wasi.ESUCCESS)
+}
+
+func (p *parallel) writeBufferFn(ctx context.Context, mod api.Module, data, dataLen, handle uint32) uint32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b, ok := p.buffers[handle]
+	if !ok {
+		return uint32(wasi.EBADF)
+	}
+	if dataLen > uint32(len(b.data)) {
+		return uint32(wasi.EINVAL)
+	}
+	src, ok := mod.Memory().Read(data, dataLen)
+	if !ok {
+		return uint32(wasi.EFAULT)
+	}
+	copy(b.data, src)
+	return uint32(wasi.ESUCCESS)
+}
+
+func (p *parallel) readBufferFn(ctx context.Context, mod api.Module, handle, data, dataLen uint32) uint32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b, ok := p.buffers[handle]
+	if !ok {
+		return uint32(wasi.EBADF)
+	}
+	if dataLen > uint32(len(b.data)) {
+		return uint32(wasi.EINVAL)
+	}
+	if !mod.Memory().Write(data, b.data[:dataLen]) {
+		return uint32(wasi.EFAULT)
+	}
+	return uint32(wasi.ESUCCESS)
+}
+
+// parallelExecFn runs the kernel num_threads times, distributing the calls
+// across the workers. The outputs of the kernels are merged into the output
+// buffers when all the calls completed. A trap in a kernel traps the guest.
+func (p *parallel) parallelExecFn(ctx context.Context, mod api.Module, device, kernel, numThreads, blockSize, inBuffers, inLen, outBuffers, outLen uint32) uint32 {
+	if device != cpuDevice {
+		return uint32(wasi.EBADF)
+	}
+	if numThreads == 0 || inLen+outLen > maxBuffers {
+		return uint32(wasi.EINVAL)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	inputs, errno := p.lookupBuffers(mod, inBuffers, inLen, WriteAccess)
+	if errno != wasi.ESUCCESS {
+		return uint32(errno)
+	}
+	outputs, errno := p.lookupBuffers(mod, outBuffers, outLen, ReadAccess)
+	if errno != wasi.ESUCCESS {
+		return uint32(errno)
+	}
+	buffers := append(inputs, outputs...)
+	// The kernels see the initial content of the output buffers, the
+	// changes they make are detected by comparing with it.
+	initial := make([][]byte, len(outputs))
+	for i, b := range outputs {
+		initial[i] = append([]byte{}, b.data...)
+	}
+
+	workers := p.size
+	if uint32(workers) > numThreads {
+		workers = int(numThreads)
+	}
+	for len(p.workers) < workers {
+		w, err := p.newWorker(ctx)
+		if errno, ok := err.(wasi.Errno); ok {
+			return uint32(errno)
+		}
+		if err != nil {
+			panic(err)
+		}
+		p.workers = append(p.workers, w)
+	}
+
+	var (
+		next   atomic.Uint32
+		failed atomic.Bool
+		wg     sync.WaitGroup
+	)
+	errs := make([]error, workers)
+	for i, w := range p.workers[:workers] {
+		wg.Add(1)
+		go func(i int, w *worker) {
+			defer wg.Done()
+			if errs[i] = w.exec(ctx, kernel, numThreads, blockSize, buffers, &next, &failed); errs[i] != nil {
+				failed.Store(true)
+			}
+		}(i, w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if errno, ok := err.(wasi.Errno); ok {
+			return uint32(errno)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, w := range p.workers[:workers] {
+		w.merge(outputs, initial)
+	}
+	return uint32(wasi.ESUCCESS)
+}
+
+// lookupBuffers loads the list of buffer handles at the given address, the
+// buffers must not have the given access mode only.
+func (p *parallel) lookupBuffers(mod api.Module, list, length uint32, denied uint32) ([]*buffer, wasi.Errno) {
+	handles, ok := mod.Memory().Read(list, 4*length)
+	if !ok {
+		return nil, wasi.EFAULT
+	}
+	buffers := make([]*buffer, length)
+	for i := range buffers {
+		b, ok := p.buffers[binary.LittleEndian.Uint32(handles[4*i:])]
+		if !ok {
+			return nil, wasi.EBADF
+		}
+		if b.access == denied {
+			return nil, wasi.EACCES
+		}
+		buffers[i] = b
+	}
+	return buffers, wasi.ESUCCESS
+}
+
+// workerID makes the names of the worker instances unique in a runtime.
+var workerID atomic.Uint64
+
+// worker is an instance of the guest module running kernels.
+type worker struct {
+	runtime  wazero.Runtime
+	instance api.Module
+	// kernels are the functions calling the kernels of the instance with a
+	// given number of parameters.
+	kernels map[int]api.Function
+	// base and size are the region of the memory of the instance where
+	// the buffers are copied.
+	base, size uint32
+	offsets    []uint32
+}
+
+func (p *parallel) newWorker(ctx context.Context) (*worker, error) {
+	name := fmt.Sprintf("%s.worker.%d", ModuleName, workerID.Add(1))
+	instance, err := p.runtime.InstantiateModule(ctx, p.module,
+		wazero.NewModuleConfig().WithName(name).WithStartFunctions())
+	if err != nil {
+		return nil, err
+	}
+	// Reactors are initialized, commands only have their static data.
+	if initialize := instance.ExportedFunction("_initialize"); initialize != nil {
+		if _, err := initialize.Call(ctx); err != nil {
+			instance.Close(ctx)
+			return nil, err
+		}
+	}
+	if instance.Memory() == nil {
+		instance.Close(ctx)
+		return nil, wasi.ENOTSUP
+	}
+	return &worker{
+		runtime:  p.runtime,
+		instance: instance,
+		kernels:  make(map[int]api.Function),
+	}, nil
+}
+
+// exec copies the buffers to the memory of the worker, and calls the kernel
+// for each thread id taken from next until all threads ran, or another worker
+// failed.
+func (w *worker) exec(ctx context.Context, kernel, numThreads, blockSize uint32, buffers []*buffer, next *atomic.Uint32, failed *atomic.Bool) error {
+	params := 3 + 2*len(buffers)
+	call, err := w.kernel(ctx, params)
+	if err != nil {
+		return err
+	}
+	if errno := w.copyBuffers(buffers); errno != wasi.ESUCCESS {
+		return errno
+	}
+	stack := make([]uint64, 1+params)
+	for {
+		threadID := next.Add(1) - 1
+		if threadID >= numThreads || failed.Load() {
+			return nil
+		}
+		stack = stack[:1+params]
+		stack[0] = uint64(kernel)
+		stack[1] = uint64(threadID)
+		stack[2] = uint64(numThreads)
+		stack[3] = uint64(blockSize)
+		for i, b := range buffers {
+			stack[4+2*i] = uint64(w.offsets[i])
+			stack[5+2*i] = uint64(len(b.data))
+		}
+		if err := call.CallWithStack(ctx, stack); err != nil {
+			return err
+		}
+	}
+}
+
+// copyBuffers copies the content of the buffers to the memory of the worker,
+// growing it if needed.
+func (w *worker) copyBuffers(buffers []*buffer) wasi.Errno {
+	const align = 16
+	w.offsets = w.offsets[:0]
+	size := uint64(0)
+	for _, b := range buffers {
+		w.offsets = append(w.offsets, uint32(size))
+		size += (uint64(len(b.data)) + align - 1) &^ (align - 1)
+	}
+	memory := w.instance.Memory()
+	if size > uint64(w.size) {
+		const pageSize = 65536
+		pages := (size + pageSize - 1) / pageSize
+		if pages > 65536 {
+			return wasi.ENOMEM
+		}
+		// The region is at the end of the memory, which the allocator of
+		// the guest does not use until it grows the memory itself.
+		base, ok := memory.Grow(uint32(pages))
+		if !ok {
+			return wasi.ENOMEM
+		}
+		w.base, w.size = base*pageSize, uint32(pages*pageSize)
+	}
+	for i, b := range buffers {
+		w.offsets[i] += w.base
+		memory.Write(w.offsets[i], b.data)
+	}
+	return wasi.ESUCCESS
+}
+
+// merge copies the bytes of the outputs that the kernels changed in the
+// memory of the worker to the output buffers.
+func (w *worker) merge(outputs []*buffer, initial [][]byte) {
+	offsets := w.offsets[len(w.offsets)-len(outputs):]
+	for i, b := range outputs {
+		data, _ := w.instance.Memory().Read(offsets[i], uint32(len(b.data)))
+		for j, c := range data {
+			if c != initial[i][j] {
+				b.data[j] = c
+			}
+		}
+	}
+}
+
+// kernel returns a function calling the kernels of the worker which have
+// the given number of parameters, by index in the table of the worker.
+func (w *worker) kernel(ctx context.Context, params int) (api.Function, error) {
+	if call, ok := w.kernels[params]; ok {
+		return call, nil
+	}
+	name := w.instance.Name() + fmt.Sprintf(".kernel.%d", params)
+	instance, err := w.runtime.InstantiateWithConfig(ctx, kernelModule(w.instance.Name(), params),
+		wazero.NewModuleConfig().WithName(name))
+	if err != nil {
+		// The guest does not export its table of functions.
+		return nil, wasi.ENOTSUP
+	}
+	call := instance.ExportedFunction("call")
+	w.kernels[params] = call
+	return call, nil
+}
+
+// kernelModule generates the bytecode of a module which imports the table of
+// the given module, and exports a function "call" calling the function at the
+// index passed as first parameter with the remaining parameters:
+//
+//	(module
+//	  (type $kernel (func (param i32 ...)))
+//	  (import "<module>" "__indirect_function_table" (table 0 funcref))
+//	  (func (export "call") (param i32 i32 ...)
+//	    (call_indirect (type $kernel) (local.get 1) ... (local.get 0))))
+func kernelModule(module string, params int) []byte {
+	section := func(b []byte, id byte, content []byte) []byte {
+		b = append(b, id)
+		b = binary.AppendUvarint(b, uint64(len(content)))
+		return append(b, content...)
+	}
+	name := func(b []byte, s string) []byte {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		return append(b, s...)
+	}
+	funcType := func(b []byte, params int) []byte {
+		b = append(b, 0x60)
+		b = binary.AppendUvarint(b, uint64(params))
+		for i := 0; i < params; i++ {
+			b = append(b, 0x7f) // i32
+		}
+		return append(b, 0x00) // no results
+	}
+
+	types := []byte{0x02}
+	types = funcType(types, params)
+	types = funcType(types, params+1)
+
+	imports := name([]byte{0x01}, module)
+	imports = name(imports, TableName)
+	imports = append(imports, 0x01, 0x70, 0x00, 0x00) // table funcref, min 0
+
+	exports := name([]byte{0x01}, "call")
+	exports = append(exports, 0x00, 0x00) // func 0
+
+	var body []byte
+	body = append(body, 0x00) // no locals
+	for i := 1; i <= params; i++ {
+		body = append(body, 0x20) // local.get
+		body = binary.AppendUvarint(body, uint64(i))
+	}
+	body = append(body, 0x20, 0x00)       // local.get 0
+	body = append(body, 0x11, 0x00, 0x00) // call_indirect type 0, table 0
+	body = append(body, 0x0b)             // end
+	code := []byte{0x01}
+	code = binary.AppendUvarint(code, uint64(len(body)))
+	code = append(code, body...)
+
+	b := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	b = section(b, 1, types)
+	b = section(b, 2, imports)
+	b = section(b, 3, []byte{0x01, 0x01}) // func 0 of type 1
+	b = section(b, 7, exports)
+	b = section(b, 10, code)
+	return b
+}
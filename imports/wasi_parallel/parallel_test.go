@@ -0,0 +1,116 @@
+package wasi_parallel
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// kernelGuest runs a kernel doubling each byte of a 16 bytes buffer, with one
+// thread per byte:
+//
+//	(module
+//	  (import "wasi_ephemeral_parallel" "get_device" (func $get_device (param i32 i32) (result i32)))
+//	  (import "wasi_ephemeral_parallel" "create_buffer" (func $create_buffer (param i32 i32 i32 i32) (result i32)))
+//	  (import "wasi_ephemeral_parallel" "write_buffer" (func $write_buffer (param i32 i32 i32) (result i32)))
+//	  (import "wasi_ephemeral_parallel" "read_buffer" (func $read_buffer (param i32 i32 i32) (result i32)))
+//	  (import "wasi_ephemeral_parallel" "parallel_exec" (func $parallel_exec (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+//	  (table (export "__indirect_function_table") 1 funcref)
+//	  (memory (export "memory") 1)
+//	  (elem (i32.const 0) $double)
+//	  (data (i32.const 100) "\01\02\03\04\05\06\07\08\09\0a\0b\0c\0d\0e\0f\10")
+//	  (func $double (param $tid i32) (param i32 i32) (param $in i32) (param i32) (param $out i32) (param i32)
+//	    (i32.store8 (i32.add (local.get $out) (local.get $tid))
+//	      (i32.shl (i32.load8_u (i32.add (local.get $in) (local.get $tid))) (i32.const 1))))
+//	  (func (export "run") (result i32)
+//	    ;; device at 0, input buffer at 4, output buffer at 8, the
+//	    ;; errors of all calls are or-ed in the result
+//	    (call $get_device (i32.const 0) (i32.const 0))
+//	    (call $create_buffer (i32.load (i32.const 0)) (i32.const 16) (i32.const 0) (i32.const 4)) i32.or
+//	    (call $create_buffer (i32.load (i32.const 0)) (i32.const 16) (i32.const 1) (i32.const 8)) i32.or
+//	    (call $write_buffer (i32.const 100) (i32.const 16) (i32.load (i32.const 4))) i32.or
+//	    (i32.store (i32.const 200) (i32.load (i32.const 4)))
+//	    (i32.store (i32.const 204) (i32.load (i32.const 8)))
+//	    (call $parallel_exec (i32.load (i32.const 0)) (i32.const 0) (i32.const 16) (i32.const 1)
+//	      (i32.const 200) (i32.const 1) (i32.const 204) (i32.const 1)) i32.or
+//	    (call $read_buffer (i32.load (i32.const 8)) (i32.const 300) (i32.const 16)) i32.or))
+var kernelGuest = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x30, 0x06, 0x60,
+	0x02, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01,
+	0x7f, 0x60, 0x03, 0x7f, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x08, 0x7f, 0x7f,
+	0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x07, 0x7f, 0x7f,
+	0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x00, 0x60, 0x00, 0x01, 0x7f, 0x02, 0xc3,
+	0x01, 0x05, 0x17, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x65, 0x70, 0x68, 0x65,
+	0x6d, 0x65, 0x72, 0x61, 0x6c, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6c, 0x6c,
+	0x65, 0x6c, 0x0a, 0x67, 0x65, 0x74, 0x5f, 0x64, 0x65, 0x76, 0x69, 0x63,
+	0x65, 0x00, 0x00, 0x17, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x65, 0x70, 0x68,
+	0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6c,
+	0x6c, 0x65, 0x6c, 0x0d, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x5f, 0x62,
+	0x75, 0x66, 0x66, 0x65, 0x72, 0x00, 0x01, 0x17, 0x77, 0x61, 0x73, 0x69,
+	0x5f, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x5f, 0x70,
+	0x61, 0x72, 0x61, 0x6c, 0x6c, 0x65, 0x6c, 0x0c, 0x77, 0x72, 0x69, 0x74,
+	0x65, 0x5f, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x00, 0x02, 0x17, 0x77,
+	0x61, 0x73, 0x69, 0x5f, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61,
+	0x6c, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6c, 0x6c, 0x65, 0x6c, 0x0b, 0x72,
+	0x65, 0x61, 0x64, 0x5f, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x00, 0x02,
+	0x17, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65,
+	0x72, 0x61, 0x6c, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6c, 0x6c, 0x65, 0x6c,
+	0x0d, 0x70, 0x61, 0x72, 0x61, 0x6c, 0x6c, 0x65, 0x6c, 0x5f, 0x65, 0x78,
+	0x65, 0x63, 0x00, 0x03, 0x03, 0x03, 0x02, 0x04, 0x05, 0x04, 0x04, 0x01,
+	0x70, 0x00, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01, 0x07, 0x2c, 0x03, 0x06,
+	0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x19, 0x5f, 0x5f, 0x69,
+	0x6e, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x5f, 0x66, 0x75, 0x6e, 0x63,
+	0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x61, 0x62, 0x6c, 0x65, 0x01, 0x00,
+	0x03, 0x72, 0x75, 0x6e, 0x00, 0x06, 0x09, 0x07, 0x01, 0x00, 0x41, 0x00,
+	0x0b, 0x01, 0x05, 0x0a, 0x84, 0x01, 0x02, 0x15, 0x00, 0x20, 0x05, 0x20,
+	0x00, 0x6a, 0x20, 0x03, 0x20, 0x00, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0x01,
+	0x74, 0x3a, 0x00, 0x00, 0x0b, 0x6c, 0x00, 0x41, 0x00, 0x41, 0x00, 0x10,
+	0x00, 0x41, 0x00, 0x28, 0x02, 0x00, 0x41, 0x10, 0x41, 0x00, 0x41, 0x04,
+	0x10, 0x01, 0x72, 0x41, 0x00, 0x28, 0x02, 0x00, 0x41, 0x10, 0x41, 0x01,
+	0x41, 0x08, 0x10, 0x01, 0x72, 0x41, 0xe4, 0x00, 0x41, 0x10, 0x41, 0x04,
+	0x28, 0x02, 0x00, 0x10, 0x02, 0x72, 0x41, 0xc8, 0x01, 0x41, 0x04, 0x28,
+	0x02, 0x00, 0x36, 0x02, 0x00, 0x41, 0xcc, 0x01, 0x41, 0x08, 0x28, 0x02,
+	0x00, 0x36, 0x02, 0x00, 0x41, 0x00, 0x28, 0x02, 0x00, 0x41, 0x00, 0x41,
+	0x10, 0x41, 0x01, 0x41, 0xc8, 0x01, 0x41, 0x01, 0x41, 0xcc, 0x01, 0x41,
+	0x01, 0x10, 0x04, 0x72, 0x41, 0x08, 0x28, 0x02, 0x00, 0x41, 0xac, 0x02,
+	0x41, 0x10, 0x10, 0x03, 0x72, 0x0b, 0x0b, 0x17, 0x01, 0x00, 0x41, 0xe4,
+	0x00, 0x0b, 0x10, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09,
+	0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+}
+
+func TestParallelExec(t *testing.T) {
+	for _, workers := range []int{1, 4, 32} {
+		ctx := context.Background()
+		runtime := wazero.NewRuntime(ctx)
+		defer runtime.Close(ctx)
+
+		module, err := runtime.CompileModule(ctx, kernelGuest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !DetectWasiParallel(module) {
+			t.Fatal("wasi-parallel not detected")
+		}
+		if err := Instantiate(ctx, runtime, module, WithWorkers(workers)); err != nil {
+			t.Fatal(err)
+		}
+		instance, err := runtime.InstantiateModule(ctx, module, wazero.NewModuleConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := instance.ExportedFunction("run").Call(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0] != 0 {
+			t.Fatalf("workers=%d: errno %d", workers, results[0])
+		}
+		output, _ := instance.Memory().Read(300, 16)
+		want := []byte{2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32}
+		if !bytes.Equal(output, want) {
+			t.Errorf("workers=%d: wrong output: %v", workers, output)
+		}
+	}
+}
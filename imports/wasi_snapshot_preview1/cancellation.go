@@ -0,0 +1,42 @@
+package wasi_snapshot_preview1
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// Cancellation is an extension to WASI preview 1 which gives guests a handle
+// that becomes ready for reading when the host cancels the work that the
+// guest is performing (e.g. the request was aborted, or the host is shutting
+// down).
+//
+// The handle is a file descriptor which can be added to poll_oneoff
+// subscriptions, allowing cooperative guests to stop early and release
+// resources instead of being terminated.
+//
+// The extension requires the host module to be configured with the
+// WithCancellation option.
+var Cancellation = Extension{
+	"cancellation_handle": wazergo.F1((*Module).CancellationHandle),
+}
+
+// WithCancellation sets the function used to obtain the cancellation handle
+// returned to the guest by the Cancellation extension.
+func WithCancellation(handle func(context.Context) (wasi.FD, wasi.Errno)) Option {
+	return wazergo.OptionFunc(func(m *Module) { m.cancellation = handle })
+}
+
+func (m *Module) CancellationHandle(ctx context.Context, fd Pointer[Int32]) Errno {
+	if m.cancellation == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	result, errno := m.cancellation(ctx)
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	fd.Store(Int32(result))
+	return Errno(wasi.ESUCCESS)
+}
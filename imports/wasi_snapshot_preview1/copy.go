@@ -0,0 +1,32 @@
+package wasi_snapshot_preview1
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// FileCopy is an extension to WASI preview 1 which lets guests copy data
+// between two file descriptors without passing it through their memory, for
+// example to serve static files over sockets:
+//
+//	fd_copy(out: fd, in: fd, size: u64, ncopied: *u64) -> errno
+//
+// The function copies up to size bytes from the current position of in to
+// out, and stores the number of bytes copied to ncopied, which is zero when in
+// is at the end of the file. The copy is made with sendfile(2) or splice(2)
+// when the system supports it (see wasi.FDCopy).
+var FileCopy = Extension{
+	"fd_copy": wazergo.F4((*Module).FDCopy),
+}
+
+func (m *Module) FDCopy(ctx context.Context, out, in Int32, size Uint64, ncopied Pointer[Uint64]) Errno {
+	n, errno := wasi.FDCopy(ctx, m.WASI, wasi.FD(out), wasi.FD(in), wasi.FileSize(size))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	ncopied.Store(Uint64(n))
+	return Errno(wasi.ESUCCESS)
+}
@@ -0,0 +1,40 @@
+package wasi_snapshot_preview1
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// FileMmap is an extension to WASI preview 1 which lets guests map the
+// content of files in their memory, for example to access large data files
+// at random offsets without a system call for each read:
+//
+//	fd_mmap(fd: fd, offset: u64, buf: *u8, len: u32, nmapped: *u32) -> errno
+//
+// The function maps len bytes of the file at offset to the region of memory
+// at buf, and stores the number of bytes mapped to nmapped, which is less than
+// len when the region extends past the end of the file. The mapping is
+// private and read-only: changes made by the guest to the region are not
+// written to the file, and changes made to the file afterwards are not
+// reflected in the region.
+//
+// The memory of WebAssembly modules cannot be remapped by the host, so the
+// content is copied to the region from a mapping of the file that the host
+// keeps until the file descriptor is closed (see wasi.FDMmap). This avoids
+// the system calls and the intermediary copies that fd_read makes, and the
+// host can share the pages of the file with other processes mapping it.
+var FileMmap = Extension{
+	"fd_mmap": wazergo.F4((*Module).FDMmap),
+}
+
+func (m *Module) FDMmap(ctx context.Context, fd Int32, offset Uint64, buf Bytes, nmapped Pointer[Uint32]) Errno {
+	n, errno := wasi.FDMmap(ctx, m.WASI, wasi.FD(fd), wasi.FileSize(offset), buf)
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	nmapped.Store(Uint32(n))
+	return Errno(wasi.ESUCCESS)
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/stealthrocket/wasi-go"
 	"github.com/stealthrocket/wazergo"
 	. "github.com/stealthrocket/wazergo/types"
+	"github.com/stealthrocket/wazergo/wasm"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/sys"
 )
@@ -136,6 +138,15 @@ type Module struct {
 	inet6addr wasi.Inet6Address
 	unixaddr  wasi.UnixAddress
 	addrinfo  []wasi.AddressInfo
+
+	cancellation   func(context.Context) (wasi.FD, wasi.Errno)
+	terminalResize func(context.Context) (wasi.FD, wasi.Errno)
+	signalHandle   func(context.Context, ...wasi.Signal) (wasi.FD, wasi.Errno)
+	processes      wasi.Processes
+
+	sharedMemory      *wasi.SharedMemory
+	sharedSegments    map[uint32]*wasi.SharedSegment
+	nextSharedSegment uint32
 }
 
 func (m *Module) ArgsGet(ctx context.Context, argv Pointer[Uint32], buf Pointer[Uint8]) Errno {
@@ -438,10 +449,14 @@ func (m *Module) PollOneOff(ctx context.Context, in Pointer[wasi.Subscription],
 	if nSubscriptions <= 0 {
 		return Errno(wasi.EINVAL)
 	}
-	n, errno := m.WASI.PollOneOff(ctx,
-		in.UnsafeSlice(int(nSubscriptions)),
-		out.UnsafeSlice(int(nSubscriptions)),
-	)
+	subscriptions := unsafeSlice(in, int(nSubscriptions))
+	events := unsafeSlice(out, int(nSubscriptions))
+	// Systems read the subscriptions while writing events, the subscriptions
+	// are copied when the guest passed overlapping buffers.
+	if overlap(in.Offset(), sizeOf(subscriptions), out.Offset(), sizeOf(events)) {
+		subscriptions = append([]wasi.Subscription(nil), subscriptions...)
+	}
+	n, errno := m.WASI.PollOneOff(ctx, subscriptions, events)
 	if errno != wasi.ESUCCESS {
 		return Errno(errno)
 	}
@@ -449,6 +464,26 @@ func (m *Module) PollOneOff(ctx context.Context, in Pointer[wasi.Subscription],
 	return Errno(wasi.ESUCCESS)
 }
 
+// unsafeSlice is like Pointer.UnsafeSlice, but traps when the size of the
+// slice does not fit in 32 bits instead of reading a truncated range of the
+// memory.
+func unsafeSlice[T Object[T]](p Pointer[T], count int) []T {
+	var typ T
+	if size := uint64(count) * uint64(typ.ObjectSize()); size > math.MaxUint32 {
+		panic(wasm.SEGFAULT{Offset: p.Offset(), Length: math.MaxUint32})
+	}
+	return p.UnsafeSlice(count)
+}
+
+func sizeOf[T Object[T]](s []T) uint64 {
+	var typ T
+	return uint64(len(s)) * uint64(typ.ObjectSize())
+}
+
+func overlap(offset1 uint32, size1 uint64, offset2 uint32, size2 uint64) bool {
+	return uint64(offset1) < uint64(offset2)+size2 && uint64(offset2) < uint64(offset1)+size1
+}
+
 func (m *Module) ProcExit(ctx context.Context, mod api.Module, exitCode Int32) {
 	// Give the implementation a chance to exit.
 	m.WASI.ProcExit(ctx, wasi.ExitCode(exitCode))
@@ -509,6 +544,7 @@ func (m *Module) SockShutdown(ctx context.Context, fd Int32, flags Int32) Errno
 }
 
 func (m *Module) Close(ctx context.Context) error {
+	m.closeSharedSegments()
 	return m.WASI.Close(ctx)
 }
 
@@ -0,0 +1,287 @@
+package wasi_snapshot_preview1_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/imports/wasi_snapshot_preview1"
+	"github.com/stealthrocket/wasi-go/systems/unix"
+	"github.com/stealthrocket/wazergo"
+	"github.com/stealthrocket/wazergo/wasm"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+	sysunix "golang.org/x/sys/unix"
+)
+
+// FuzzHostModule calls the functions of the host module with arbitrary
+// parameters and memory, and verifies that malformed inputs are reported as
+// errors or traps instead of crashing the host, and that the guest cannot
+// access files outside of its preopened directory.
+func FuzzHostModule(f *testing.F) {
+	ctx := context.Background()
+
+	hostModule := wasi_snapshot_preview1.NewHostModule(
+		wasi_snapshot_preview1.WasmEdgeV2,
+		wasi_snapshot_preview1.FileCopy,
+		wasi_snapshot_preview1.FileMmap,
+	)
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	compiledHostModule, err := wazergo.Compile(ctx, runtime, hostModule)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	var functions []api.FunctionDefinition
+	for name, fn := range compiledHostModule.ExportedFunctions() {
+		// proc_exit closes the guest module, which is reused across calls.
+		if name != "proc_exit" {
+			functions = append(functions, fn)
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name() < functions[j].Name()
+	})
+	index := func(name string) uint8 {
+		for i, fn := range functions {
+			if fn.Name() == name {
+				return uint8(i)
+			}
+		}
+		f.Fatalf("function not found: %s", name)
+		return 0
+	}
+
+	tmp := f.TempDir()
+	rootFS := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{rootFS, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		f.Fatal(err)
+	}
+	if err := os.Symlink("../outside/secret", filepath.Join(rootFS, "secret")); err != nil {
+		f.Fatal(err)
+	}
+
+	// The guest module exports a trampoline for each function, since the
+	// functions of the host module can only access the memory of the module
+	// which calls them. The host module must be instantiated first, the
+	// systems of the following instances are bound to the calls with the
+	// context.
+	instance, err := compiledHostModule.Instantiate(ctx, wasi_snapshot_preview1.WithWASI(newSystem(f, rootFS)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	instance.Close(ctx)
+	guest, err := runtime.Instantiate(ctx, trampolineModule(functions))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	params := func(values ...uint32) []byte {
+		b := make([]byte, 4*len(values))
+		for i, v := range values {
+			binary.LittleEndian.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	memory := func(chunks ...[]byte) []byte {
+		var b []byte
+		for _, chunk := range chunks {
+			b = append(b, chunk...)
+		}
+		return b
+	}
+	f.Add(index("fd_write"), params(1, 0, 1, 16), memory(params(32, 5), make([]byte, 24), []byte("hello")))
+	f.Add(index("fd_read"), params(0, 0, 2, 16), memory(params(32, 8, 40, 1<<20)))
+	f.Add(index("path_open"), params(3, 0, 0, 6, 0, 0xFFFFFFFF, 0, 0xFFFFFFFF, 0, 0, 8), []byte("secret"))
+	f.Add(index("path_open"), params(3, 1, 0, 17, 1, 0xFFFFFFFF, 0, 0xFFFFFFFF, 0, 0, 24), []byte("../outside/secret"))
+	f.Add(index("path_readlink"), params(3, 0, 6, 16, 64, 8), []byte("secret"))
+	f.Add(index("poll_oneoff"), params(0, 64, 3, 128), make([]byte, 64))
+	f.Add(index("fd_readdir"), params(3, 0, 1024, 0, 0, 2048), []byte{})
+	f.Add(index("sock_bind"), params(0, 0, 8), memory(params(16, 0), []byte{0, 2, 0, 80}))
+	f.Add(index("sock_send_to"), params(1, 0, 1, 16, 0, 32), memory(params(64, 4, 0, 0, 72, 16), make([]byte, 40), []byte{0, 1}))
+
+	f.Fuzz(func(t *testing.T, fn uint8, params, memory []byte) {
+		function := functions[int(fn)%len(functions)]
+		name := function.Name()
+		// The stack holds the parameters and then the results of the call.
+		stack := make([]uint64, len(function.ParamTypes())+len(function.ResultTypes()))
+		for i, typ := range function.ParamTypes() {
+			var b [8]byte
+			size := 4
+			if typ == api.ValueTypeI64 {
+				size = 8
+			}
+			params = params[copy(b[:size], params):]
+			stack[i] = binary.LittleEndian.Uint64(b[:])
+		}
+
+		page := make([]byte, wasm.PageSize)
+		copy(page, memory)
+		guest.Memory().Write(0, page)
+
+		system := newSystem(t, rootFS)
+		instance, err := compiledHostModule.Instantiate(ctx, wasi_snapshot_preview1.WithWASI(system))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer instance.Close(ctx)
+
+		// Calls blocking on the clock are interrupted.
+		timer := time.AfterFunc(100*time.Millisecond, func() { system.Shutdown(ctx) })
+		defer timer.Stop()
+
+		err = guest.ExportedFunction(name).CallWithStack(wazergo.WithModuleInstance(ctx, instance), stack)
+		if err != nil && !isGuestError(err) {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		entries, err := os.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%s: files were created outside of the root directory", name)
+		}
+		if b, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(b) != "secret" {
+			t.Fatalf("%s: a file outside of the root directory was modified", name)
+		}
+	})
+}
+
+// isGuestError reports whether err is the result of inputs of the guest that
+// the host module rejected by trapping, as opposed to a crash of the host.
+func isGuestError(err error) bool {
+	var exitErr *sys.ExitError
+	var segfault wasm.SEGFAULT
+	var runtimeErr runtime.Error
+	switch {
+	case errors.As(err, &exitErr), errors.As(err, &segfault):
+		return true
+	case errors.As(err, &runtimeErr):
+		return false
+	}
+	// Lists decoded from the memory of the guest trap when their length
+	// exceeds the memory.
+	return strings.Contains(err.Error(), ": index out of bounds (")
+}
+
+func newSystem(t testing.TB, rootFS string) *unix.System {
+	s := &unix.System{
+		Monotonic: func(context.Context) (uint64, error) {
+			return uint64(time.Now().UnixNano()), nil
+		},
+		MonotonicPrecision: time.Nanosecond,
+		Realtime: func(context.Context) (uint64, error) {
+			return uint64(time.Now().UnixNano()), nil
+		},
+		RealtimePrecision: time.Nanosecond,
+	}
+	for _, stdio := range []struct {
+		name  string
+		flags int
+	}{
+		{"/dev/stdin", sysunix.O_RDONLY},
+		{"/dev/stdout", sysunix.O_WRONLY},
+		{"/dev/stderr", sysunix.O_WRONLY},
+	} {
+		fd, err := sysunix.Open(os.DevNull, stdio.flags|sysunix.O_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Preopen(unix.FD(fd), stdio.name, wasi.FDStat{
+			FileType:   wasi.CharacterDeviceType,
+			RightsBase: wasi.AllRights,
+		})
+	}
+	fd, err := sysunix.Open(rootFS, sysunix.O_DIRECTORY|sysunix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Preopen(unix.FD(fd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	return s
+}
+
+// trampolineModule returns the binary of a WebAssembly module with one page
+// of memory, which exports a function calling each of the functions.
+func trampolineModule(functions []api.FunctionDefinition) []byte {
+	var types, imports, funcs, exports, code []byte
+	for i, fn := range functions {
+		typ := []byte{0x60}
+		typ = appendValueTypes(typ, fn.ParamTypes())
+		typ = appendValueTypes(typ, fn.ResultTypes())
+		types = append(types, typ...)
+
+		imports = appendName(imports, wasi_snapshot_preview1.HostModuleName)
+		imports = appendName(imports, fn.Name())
+		imports = append(imports, 0x00) // func
+		imports = binary.AppendUvarint(imports, uint64(i))
+
+		funcs = binary.AppendUvarint(funcs, uint64(i))
+
+		exports = appendName(exports, fn.Name())
+		exports = append(exports, 0x00) // func
+		exports = binary.AppendUvarint(exports, uint64(len(functions)+i))
+
+		body := []byte{0x00} // no locals
+		for j := range fn.ParamTypes() {
+			body = append(body, 0x20) // local.get
+			body = binary.AppendUvarint(body, uint64(j))
+		}
+		body = append(body, 0x10) // call
+		body = binary.AppendUvarint(body, uint64(i))
+		body = append(body, 0x0b) // end
+		code = binary.AppendUvarint(code, uint64(len(body)))
+		code = append(code, body...)
+	}
+	exports = appendName(exports, "memory")
+	exports = append(exports, 0x02, 0x00) // memory 0
+
+	n := uint64(len(functions))
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	b = appendSection(b, 1, n, types)
+	b = appendSection(b, 2, n, imports)
+	b = appendSection(b, 3, n, funcs)
+	b = appendSection(b, 5, 1, []byte{0x00, 0x01}) // min 1 page
+	b = appendSection(b, 7, n+1, exports)
+	b = appendSection(b, 10, n, code)
+	return b
+}
+
+func appendValueTypes(b []byte, types []api.ValueType) []byte {
+	b = binary.AppendUvarint(b, uint64(len(types)))
+	return append(b, types...)
+}
+
+func appendName(b []byte, name string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+func appendSection(b []byte, id byte, count uint64, content []byte) []byte {
+	section := binary.AppendUvarint(nil, count)
+	section = append(section, content...)
+	b = append(b, id)
+	b = binary.AppendUvarint(b, uint64(len(section)))
+	return append(b, section...)
+}
@@ -0,0 +1,84 @@
+package wasi_snapshot_preview1
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// Process is an extension to WASI preview 1 which lets guests spawn child
+// processes, under the policy of the host (see wasi.Processes):
+//
+//	proc_spawn(args: *u8, args_len: u32, stdio: *fd, pid: *u32) -> errno
+//	proc_wait(pid: u32, flags: u32, status: *u32) -> errno
+//	proc_kill(pid: u32, signal: u32) -> errno
+//
+// The arguments of proc_spawn are NUL-terminated strings laid out one after
+// the other, the first argument names the program to run. The file
+// descriptors of the stdin, stdout, and stderr of the child are stored in
+// the array of three file descriptors pointed to by stdio.
+//
+// With the flag WNOHANG (1), proc_wait returns EAGAIN instead of blocking
+// when the child has not exited yet. The status is the exit code of the
+// child, or 128 plus the number of the signal that terminated it.
+//
+// The extension requires the host module to be configured with the
+// WithProcesses option.
+var Process = Extension{
+	"proc_spawn": wazergo.F3((*Module).ProcSpawn),
+	"proc_wait":  wazergo.F3((*Module).ProcWait),
+	"proc_kill":  wazergo.F2((*Module).ProcKill),
+}
+
+// WithProcesses sets the implementation of the child processes spawned by the
+// guest with the Process extension.
+func WithProcesses(processes wasi.Processes) Option {
+	return wazergo.OptionFunc(func(m *Module) { m.processes = processes })
+}
+
+func (m *Module) ProcSpawn(ctx context.Context, args Bytes, stdio Pointer[Int32], pid Pointer[Uint32]) Errno {
+	if m.processes == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	if len(args) == 0 || args[len(args)-1] != 0 {
+		return Errno(wasi.EINVAL)
+	}
+	var argv []string
+	for _, arg := range bytes.Split(args[:len(args)-1], []byte{0}) {
+		argv = append(argv, string(arg))
+	}
+	p, fds, errno := m.processes.ProcSpawn(ctx, argv)
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	for i, fd := range fds {
+		stdio.Index(i).Store(Int32(fd))
+	}
+	pid.Store(Uint32(p))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) ProcWait(ctx context.Context, pid Uint32, flags Uint32, status Pointer[Uint32]) Errno {
+	if m.processes == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	code, errno := m.processes.ProcWait(ctx, wasi.ProcessID(pid), wasi.WaitFlags(flags))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	status.Store(Uint32(code))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) ProcKill(ctx context.Context, pid Uint32, signal Uint32) Errno {
+	if m.processes == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	if signal > Uint32(wasi.SIGSYS) {
+		return Errno(wasi.EINVAL)
+	}
+	return Errno(m.processes.ProcKill(ctx, wasi.ProcessID(pid), wasi.Signal(signal)))
+}
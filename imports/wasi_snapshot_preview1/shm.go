@@ -0,0 +1,109 @@
+package wasi_snapshot_preview1
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// SharedMemory is an extension to WASI preview 1 which lets guests exchange
+// data through named memory segments shared with the other guests of the host
+// (see wasi.SharedMemory):
+//
+//	shm_open(name: string, size: u64, flags: u32, handle: *u32, actual_size: *u64) -> errno
+//	shm_read(handle: u32, offset: u64, buf: *u8, buf_len: u32, nread: *u32) -> errno
+//	shm_write(handle: u32, offset: u64, buf: *u8, buf_len: u32, nwritten: *u32) -> errno
+//	shm_close(handle: u32) -> errno
+//
+// The flags of shm_open are O_CREAT (1), which creates the segment with the
+// given size if it does not exist, and O_EXCL (2). The actual size is the
+// size of the segment, which differs from the requested size when opening an
+// existing segment. Reads and writes copy at most the bytes up to the end of
+// the segment. The handles are released when the guest exits.
+//
+// The extension requires the host module to be configured with the
+// WithSharedMemory option.
+var SharedMemory = Extension{
+	"shm_open":  wazergo.F5((*Module).SharedMemoryOpen),
+	"shm_read":  wazergo.F4((*Module).SharedMemoryRead),
+	"shm_write": wazergo.F4((*Module).SharedMemoryWrite),
+	"shm_close": wazergo.F1((*Module).SharedMemoryClose),
+}
+
+// WithSharedMemory sets the shared memory segments that the guest opens with
+// the SharedMemory extension.
+func WithSharedMemory(memory *wasi.SharedMemory) Option {
+	return wazergo.OptionFunc(func(m *Module) { m.sharedMemory = memory })
+}
+
+func (m *Module) SharedMemoryOpen(ctx context.Context, name String, size Uint64, flags Uint32, handle Pointer[Uint32], actualSize Pointer[Uint64]) Errno {
+	if m.sharedMemory == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	if int64(size) < 0 {
+		return Errno(wasi.EINVAL)
+	}
+	segment, errno := m.sharedMemory.Open(string(name), int64(size), wasi.SharedMemoryFlags(flags))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	if m.sharedSegments == nil {
+		m.sharedSegments = make(map[uint32]*wasi.SharedSegment)
+	}
+	for {
+		m.nextSharedSegment++
+		if _, used := m.sharedSegments[m.nextSharedSegment]; !used && m.nextSharedSegment != 0 {
+			break
+		}
+	}
+	m.sharedSegments[m.nextSharedSegment] = segment
+	handle.Store(Uint32(m.nextSharedSegment))
+	actualSize.Store(Uint64(segment.Size()))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) SharedMemoryRead(ctx context.Context, handle Uint32, offset Uint64, buf Bytes, nread Pointer[Uint32]) Errno {
+	segment, ok := m.sharedSegments[uint32(handle)]
+	if !ok {
+		return Errno(wasi.EBADF)
+	}
+	n, errno := segment.ReadAt(buf, int64(offset))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	nread.Store(Uint32(n))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) SharedMemoryWrite(ctx context.Context, handle Uint32, offset Uint64, buf Bytes, nwritten Pointer[Uint32]) Errno {
+	segment, ok := m.sharedSegments[uint32(handle)]
+	if !ok {
+		return Errno(wasi.EBADF)
+	}
+	n, errno := segment.WriteAt(buf, int64(offset))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	nwritten.Store(Uint32(n))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) SharedMemoryClose(ctx context.Context, handle Uint32) Errno {
+	segment, ok := m.sharedSegments[uint32(handle)]
+	if !ok {
+		return Errno(wasi.EBADF)
+	}
+	delete(m.sharedSegments, uint32(handle))
+	segment.Close()
+	return Errno(wasi.ESUCCESS)
+}
+
+// closeSharedSegments releases the segments that the guest did not close.
+func (m *Module) closeSharedSegments() {
+	for handle, segment := range m.sharedSegments {
+		delete(m.sharedSegments, handle)
+		segment.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package wasi_snapshot_preview1
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// Signals is an extension to WASI preview 1 which lets guests receive the
+// signals of the host process from their event loop:
+//
+//	signal_handle(signals: u64, fd: *fd) -> errno
+//
+// The signals are a bit set, where bit N selects the signal numbered N in
+// WASI (e.g. 1<<SIGHUP). The handle is a file descriptor which can be added
+// to poll_oneoff subscriptions; each signal is read from it as a message of
+// one byte holding the number of the signal (see wasi.EventHandle).
+//
+// The extension requires the host module to be configured with the
+// WithSignalHandle option.
+var Signals = Extension{
+	"signal_handle": wazergo.F2((*Module).SignalHandle),
+}
+
+// WithSignalHandle sets the function used to open the signal handles returned
+// to the guest by the Signals extension.
+func WithSignalHandle(handle func(context.Context, ...wasi.Signal) (wasi.FD, wasi.Errno)) Option {
+	return wazergo.OptionFunc(func(m *Module) { m.signalHandle = handle })
+}
+
+func (m *Module) SignalHandle(ctx context.Context, signals Uint64, fd Pointer[Int32]) Errno {
+	if m.signalHandle == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	var set []wasi.Signal
+	for s := wasi.SIGHUP; s <= wasi.SIGSYS; s++ {
+		if (signals & (1 << s)) != 0 {
+			set = append(set, s)
+		}
+	}
+	if len(set) == 0 || (signals>>(wasi.SIGSYS+1)) != 0 {
+		return Errno(wasi.EINVAL)
+	}
+	result, errno := m.signalHandle(ctx, set...)
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	fd.Store(Int32(result))
+	return Errno(wasi.ESUCCESS)
+}
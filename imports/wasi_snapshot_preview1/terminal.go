@@ -0,0 +1,78 @@
+package wasi_snapshot_preview1
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wazergo"
+	. "github.com/stealthrocket/wazergo/types"
+)
+
+// Terminal is an extension to WASI preview 1 which lets interactive guests
+// (shells, editors, REPLs) control the terminals that their file descriptors
+// refer to, for example to switch stdin to raw mode and read single
+// keystrokes:
+//
+//	fd_tcgetattr(fd: fd, flags: *u32) -> errno
+//	fd_tcsetattr(fd: fd, flags: u32) -> errno
+//	fd_tcgetwinsize(fd: fd, rows: *u32, cols: *u32) -> errno
+//	terminal_resize_handle(fd: *fd) -> errno
+//
+// The flags emulate a subset of the termios(3) modes (see wasi.TerminalFlags);
+// zero puts the terminal in raw mode. The functions return ENOTTY when the
+// file descriptor does not refer to a terminal. The modes of the terminal are
+// restored when the guest closes its file descriptors (see wasi.Terminal).
+//
+// The resize handle is a file descriptor which becomes ready for reading when
+// the window of the terminal is resized (the equivalent of SIGWINCH), which
+// can be added to poll_oneoff subscriptions; guests read it to wait for the
+// next notification, and call fd_tcgetwinsize to get the new size. The
+// function requires the host module to be configured with the
+// WithTerminalResize option.
+var Terminal = Extension{
+	"fd_tcgetattr":           wazergo.F2((*Module).FDTermGet),
+	"fd_tcsetattr":           wazergo.F2((*Module).FDTermSet),
+	"fd_tcgetwinsize":        wazergo.F3((*Module).FDTermSize),
+	"terminal_resize_handle": wazergo.F1((*Module).TerminalResizeHandle),
+}
+
+// WithTerminalResize sets the function used to obtain the resize handle
+// returned to the guest by the Terminal extension.
+func WithTerminalResize(handle func(context.Context) (wasi.FD, wasi.Errno)) Option {
+	return wazergo.OptionFunc(func(m *Module) { m.terminalResize = handle })
+}
+
+func (m *Module) FDTermGet(ctx context.Context, fd Int32, flags Pointer[Uint32]) Errno {
+	f, errno := wasi.FDTermGet(ctx, m.WASI, wasi.FD(fd))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	flags.Store(Uint32(f))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) FDTermSet(ctx context.Context, fd Int32, flags Uint32) Errno {
+	return Errno(wasi.FDTermSet(ctx, m.WASI, wasi.FD(fd), wasi.TerminalFlags(flags)))
+}
+
+func (m *Module) FDTermSize(ctx context.Context, fd Int32, rows, cols Pointer[Uint32]) Errno {
+	size, errno := wasi.FDTermSize(ctx, m.WASI, wasi.FD(fd))
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	rows.Store(Uint32(size.Rows))
+	cols.Store(Uint32(size.Columns))
+	return Errno(wasi.ESUCCESS)
+}
+
+func (m *Module) TerminalResizeHandle(ctx context.Context, fd Pointer[Int32]) Errno {
+	if m.terminalResize == nil {
+		return Errno(wasi.ENOSYS)
+	}
+	result, errno := m.terminalResize(ctx)
+	if errno != wasi.ESUCCESS {
+		return Errno(errno)
+	}
+	fd.Store(Int32(result))
+	return Errno(wasi.ESUCCESS)
+}
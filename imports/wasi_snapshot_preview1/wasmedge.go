@@ -88,9 +88,14 @@ func (m *Module) WasmEdgeSockListen(ctx context.Context, fd Int32, backlog Int32
 }
 
 func (m *Module) WasmEdgeSockSendTo(ctx context.Context, fd Int32, iovecs List[wasi.IOVec], addr Pointer[wasmEdgeAddress], port Int32, flags Uint32, nwritten Pointer[Int32]) Errno {
-	socketAddr, ok := m.wasmEdgeGetSocketAddress(addr.Load(), int(port))
-	if !ok {
-		return Errno(wasi.EINVAL)
+	// An empty address sends to the peer of a connected socket.
+	var socketAddr wasi.SocketAddress
+	if b := addr.Load(); len(b) > 0 {
+		sa, ok := m.wasmEdgeGetSocketAddress(b, int(port))
+		if !ok {
+			return Errno(wasi.EINVAL)
+		}
+		socketAddr = sa
 	}
 	m.iovecs = iovecs.Append(m.iovecs[:0])
 	size, errno := m.WASI.SockSendTo(ctx, wasi.FD(fd), m.iovecs, wasi.SIFlags(flags), socketAddr)
@@ -143,7 +148,11 @@ func (m *Module) WasmEdgeSockSetOpt(ctx context.Context, fd Int32, level Int32,
 		wasi.RecvBufferSize,
 		wasi.KeepAlive,
 		wasi.OOBInline,
-		wasi.TcpNoDelay:
+		wasi.TcpNoDelay,
+		wasi.TcpKeepIdle,
+		wasi.TcpKeepInterval,
+		wasi.TcpKeepCount,
+		wasi.IPv6Only:
 
 		if len(value) != 4 {
 			return Errno(wasi.EINVAL)
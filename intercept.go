@@ -0,0 +1,727 @@
+package wasi
+
+import "context"
+
+// Call is a system call intercepted by the hooks passed to Intercept.
+type Call struct {
+	// Syscall is the name of the WASI function, e.g. fd_read.
+	Syscall string
+	// Args are the arguments of the system call, in the order of the
+	// parameters of the System method, excluding the context.
+	Args []any
+	// Results are the values returned by the system call, in the order of
+	// the results of the System method, excluding the errno.
+	Results []any
+	// Errno is the error returned by the system call.
+	Errno Errno
+	// Done is true if the system call was completed, either because the
+	// underlying system was called, or because a Before hook called Return.
+	Done bool
+}
+
+// Return completes the call with the given errno and results, which are
+// returned to the guest instead of calling the underlying system when it
+// is called from a Before hook.
+func (c *Call) Return(errno Errno, results ...any) {
+	c.Errno, c.Results, c.Done = errno, results, true
+}
+
+// Hooks are functions called by the System returned by Intercept.
+//
+// Hooks may replace the arguments and results of calls, but the values must
+// have the same types as the original ones; the system call panics if a value
+// has a different type.
+type Hooks struct {
+	// Before is called before each system call. Calling Return on the call
+	// skips the underlying system, which is useful to deny access to
+	// resources (e.g. call.Return(EPERM)) or to override the behavior of
+	// the system.
+	Before func(ctx context.Context, call *Call)
+	// After is called after each system call, including calls that were
+	// completed by the Before hook, with the results of the call.
+	After func(ctx context.Context, call *Call)
+}
+
+// Intercept wraps a System to call hooks before and after each system call,
+// allowing embedders to implement cross-cutting concerns (e.g. access
+// control, quotas, or logging) without implementing the System interface.
+//
+// Intercepting system calls has a cost, since arguments and results are
+// boxed in interfaces; wrappers implementing the System interface should be
+// preferred on hot paths.
+func Intercept(system System, hooks Hooks) System {
+	return &interceptor{system: system, hooks: hooks}
+}
+
+type interceptor struct {
+	system System
+	hooks  Hooks
+}
+
+// before calls the Before hook, and returns true if the underlying system
+// must be called.
+func (i *interceptor) before(ctx context.Context, call *Call) bool {
+	if i.hooks.Before != nil {
+		i.hooks.Before(ctx, call)
+	}
+	if call.Done {
+		if i.hooks.After != nil {
+			i.hooks.After(ctx, call)
+		}
+		return false
+	}
+	return true
+}
+
+func (i *interceptor) after(ctx context.Context, call *Call, errno Errno, results ...any) {
+	call.Return(errno, results...)
+	if i.hooks.After != nil {
+		i.hooks.After(ctx, call)
+	}
+}
+
+func (i *interceptor) Close(ctx context.Context) error {
+	return i.system.Close(ctx)
+}
+
+func (i *interceptor) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	call := &Call{Syscall: "args_sizes_get"}
+	if i.before(ctx, call) {
+		v0, v1, errno := i.system.ArgsSizesGet(ctx)
+		i.after(ctx, call, errno, v0, v1)
+	}
+	return valueAt[int](call.Results, 0), valueAt[int](call.Results, 1), call.Errno
+}
+
+func (i *interceptor) ArgsGet(ctx context.Context) ([]string, Errno) {
+	call := &Call{Syscall: "args_get"}
+	if i.before(ctx, call) {
+		v0, errno := i.system.ArgsGet(ctx)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[[]string](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	call := &Call{Syscall: "environ_sizes_get"}
+	if i.before(ctx, call) {
+		v0, v1, errno := i.system.EnvironSizesGet(ctx)
+		i.after(ctx, call, errno, v0, v1)
+	}
+	return valueAt[int](call.Results, 0), valueAt[int](call.Results, 1), call.Errno
+}
+
+func (i *interceptor) EnvironGet(ctx context.Context) ([]string, Errno) {
+	call := &Call{Syscall: "environ_get"}
+	if i.before(ctx, call) {
+		v0, errno := i.system.EnvironGet(ctx)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[[]string](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	call := &Call{Syscall: "clock_res_get", Args: []any{id}}
+	if i.before(ctx, call) {
+		id = valueAt[ClockID](call.Args, 0)
+		v0, errno := i.system.ClockResGet(ctx, id)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Timestamp](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	call := &Call{Syscall: "clock_time_get", Args: []any{id, precision}}
+	if i.before(ctx, call) {
+		id = valueAt[ClockID](call.Args, 0)
+		precision = valueAt[Timestamp](call.Args, 1)
+		v0, errno := i.system.ClockTimeGet(ctx, id, precision)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Timestamp](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDAdvise(ctx context.Context, fd FD, offset FileSize, length FileSize, advice Advice) Errno {
+	call := &Call{Syscall: "fd_advise", Args: []any{fd, offset, length, advice}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		offset = valueAt[FileSize](call.Args, 1)
+		length = valueAt[FileSize](call.Args, 2)
+		advice = valueAt[Advice](call.Args, 3)
+		errno := i.system.FDAdvise(ctx, fd, offset, length, advice)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDAllocate(ctx context.Context, fd FD, offset FileSize, length FileSize) Errno {
+	call := &Call{Syscall: "fd_allocate", Args: []any{fd, offset, length}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		offset = valueAt[FileSize](call.Args, 1)
+		length = valueAt[FileSize](call.Args, 2)
+		errno := i.system.FDAllocate(ctx, fd, offset, length)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDClose(ctx context.Context, fd FD) Errno {
+	call := &Call{Syscall: "fd_close", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		errno := i.system.FDClose(ctx, fd)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDDataSync(ctx context.Context, fd FD) Errno {
+	call := &Call{Syscall: "fd_datasync", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		errno := i.system.FDDataSync(ctx, fd)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	call := &Call{Syscall: "fd_fdstat_get", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.FDStatGet(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FDStat](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	call := &Call{Syscall: "fd_fdstat_set_flags", Args: []any{fd, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		flags = valueAt[FDFlags](call.Args, 1)
+		errno := i.system.FDStatSetFlags(ctx, fd, flags)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDStatSetRights(ctx context.Context, fd FD, rightsBase Rights, rightsInheriting Rights) Errno {
+	call := &Call{Syscall: "fd_fdstat_set_rights", Args: []any{fd, rightsBase, rightsInheriting}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		rightsBase = valueAt[Rights](call.Args, 1)
+		rightsInheriting = valueAt[Rights](call.Args, 2)
+		errno := i.system.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	call := &Call{Syscall: "fd_filestat_get", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.FDFileStatGet(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FileStat](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	call := &Call{Syscall: "fd_filestat_set_size", Args: []any{fd, size}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		size = valueAt[FileSize](call.Args, 1)
+		errno := i.system.FDFileStatSetSize(ctx, fd, size)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	call := &Call{Syscall: "fd_filestat_set_times", Args: []any{fd, accessTime, modifyTime, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		accessTime = valueAt[Timestamp](call.Args, 1)
+		modifyTime = valueAt[Timestamp](call.Args, 2)
+		flags = valueAt[FSTFlags](call.Args, 3)
+		errno := i.system.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	call := &Call{Syscall: "fd_pread", Args: []any{fd, iovecs, offset}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		offset = valueAt[FileSize](call.Args, 2)
+		v0, errno := i.system.FDPread(ctx, fd, iovecs, offset)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Size](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	call := &Call{Syscall: "fd_prestat_get", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.FDPreStatGet(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[PreStat](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	call := &Call{Syscall: "fd_prestat_dir_name", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.FDPreStatDirName(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[string](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	call := &Call{Syscall: "fd_pwrite", Args: []any{fd, iovecs, offset}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		offset = valueAt[FileSize](call.Args, 2)
+		v0, errno := i.system.FDPwrite(ctx, fd, iovecs, offset)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Size](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	call := &Call{Syscall: "fd_read", Args: []any{fd, iovecs}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		v0, errno := i.system.FDRead(ctx, fd, iovecs)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Size](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	call := &Call{Syscall: "fd_readdir", Args: []any{fd, entries, cookie, bufferSizeBytes}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		entries = valueAt[[]DirEntry](call.Args, 1)
+		cookie = valueAt[DirCookie](call.Args, 2)
+		bufferSizeBytes = valueAt[int](call.Args, 3)
+		v0, errno := i.system.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[int](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDRenumber(ctx context.Context, from FD, to FD) Errno {
+	call := &Call{Syscall: "fd_renumber", Args: []any{from, to}}
+	if i.before(ctx, call) {
+		from = valueAt[FD](call.Args, 0)
+		to = valueAt[FD](call.Args, 1)
+		errno := i.system.FDRenumber(ctx, from, to)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	call := &Call{Syscall: "fd_seek", Args: []any{fd, offset, whence}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		offset = valueAt[FileDelta](call.Args, 1)
+		whence = valueAt[Whence](call.Args, 2)
+		v0, errno := i.system.FDSeek(ctx, fd, offset, whence)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FileSize](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDSync(ctx context.Context, fd FD) Errno {
+	call := &Call{Syscall: "fd_sync", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		errno := i.system.FDSync(ctx, fd)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	call := &Call{Syscall: "fd_tell", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.FDTell(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FileSize](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	call := &Call{Syscall: "fd_write", Args: []any{fd, iovecs}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		v0, errno := i.system.FDWrite(ctx, fd, iovecs)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Size](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	call := &Call{Syscall: "path_create_directory", Args: []any{fd, path}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		path = valueAt[string](call.Args, 1)
+		errno := i.system.PathCreateDirectory(ctx, fd, path)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	call := &Call{Syscall: "path_filestat_get", Args: []any{fd, lookupFlags, path}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		lookupFlags = valueAt[LookupFlags](call.Args, 1)
+		path = valueAt[string](call.Args, 2)
+		v0, errno := i.system.PathFileStatGet(ctx, fd, lookupFlags, path)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FileStat](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	call := &Call{Syscall: "path_filestat_set_times", Args: []any{fd, lookupFlags, path, accessTime, modifyTime, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		lookupFlags = valueAt[LookupFlags](call.Args, 1)
+		path = valueAt[string](call.Args, 2)
+		accessTime = valueAt[Timestamp](call.Args, 3)
+		modifyTime = valueAt[Timestamp](call.Args, 4)
+		flags = valueAt[FSTFlags](call.Args, 5)
+		errno := i.system.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	call := &Call{Syscall: "path_link", Args: []any{oldFD, oldFlags, oldPath, newFD, newPath}}
+	if i.before(ctx, call) {
+		oldFD = valueAt[FD](call.Args, 0)
+		oldFlags = valueAt[LookupFlags](call.Args, 1)
+		oldPath = valueAt[string](call.Args, 2)
+		newFD = valueAt[FD](call.Args, 3)
+		newPath = valueAt[string](call.Args, 4)
+		errno := i.system.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase Rights, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	call := &Call{Syscall: "path_open", Args: []any{fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		dirFlags = valueAt[LookupFlags](call.Args, 1)
+		path = valueAt[string](call.Args, 2)
+		openFlags = valueAt[OpenFlags](call.Args, 3)
+		rightsBase = valueAt[Rights](call.Args, 4)
+		rightsInheriting = valueAt[Rights](call.Args, 5)
+		fdFlags = valueAt[FDFlags](call.Args, 6)
+		v0, errno := i.system.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FD](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	call := &Call{Syscall: "path_readlink", Args: []any{fd, path, buffer}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		path = valueAt[string](call.Args, 1)
+		buffer = valueAt[[]byte](call.Args, 2)
+		v0, errno := i.system.PathReadLink(ctx, fd, path, buffer)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[int](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	call := &Call{Syscall: "path_remove_directory", Args: []any{fd, path}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		path = valueAt[string](call.Args, 1)
+		errno := i.system.PathRemoveDirectory(ctx, fd, path)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	call := &Call{Syscall: "path_rename", Args: []any{fd, oldPath, newFD, newPath}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		oldPath = valueAt[string](call.Args, 1)
+		newFD = valueAt[FD](call.Args, 2)
+		newPath = valueAt[string](call.Args, 3)
+		errno := i.system.PathRename(ctx, fd, oldPath, newFD, newPath)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	call := &Call{Syscall: "path_symlink", Args: []any{oldPath, fd, newPath}}
+	if i.before(ctx, call) {
+		oldPath = valueAt[string](call.Args, 0)
+		fd = valueAt[FD](call.Args, 1)
+		newPath = valueAt[string](call.Args, 2)
+		errno := i.system.PathSymlink(ctx, oldPath, fd, newPath)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	call := &Call{Syscall: "path_unlink_file", Args: []any{fd, path}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		path = valueAt[string](call.Args, 1)
+		errno := i.system.PathUnlinkFile(ctx, fd, path)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	call := &Call{Syscall: "poll_oneoff", Args: []any{subscriptions, events}}
+	if i.before(ctx, call) {
+		subscriptions = valueAt[[]Subscription](call.Args, 0)
+		events = valueAt[[]Event](call.Args, 1)
+		v0, errno := i.system.PollOneOff(ctx, subscriptions, events)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[int](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	call := &Call{Syscall: "proc_exit", Args: []any{exitCode}}
+	if i.before(ctx, call) {
+		exitCode = valueAt[ExitCode](call.Args, 0)
+		errno := i.system.ProcExit(ctx, exitCode)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) ProcRaise(ctx context.Context, signal Signal) Errno {
+	call := &Call{Syscall: "proc_raise", Args: []any{signal}}
+	if i.before(ctx, call) {
+		signal = valueAt[Signal](call.Args, 0)
+		errno := i.system.ProcRaise(ctx, signal)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) SchedYield(ctx context.Context) Errno {
+	call := &Call{Syscall: "sched_yield"}
+	if i.before(ctx, call) {
+		errno := i.system.SchedYield(ctx)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) RandomGet(ctx context.Context, b []byte) Errno {
+	call := &Call{Syscall: "random_get", Args: []any{b}}
+	if i.before(ctx, call) {
+		b = valueAt[[]byte](call.Args, 0)
+		errno := i.system.RandomGet(ctx, b)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) SockOpen(ctx context.Context, family ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase Rights, rightsInheriting Rights) (FD, Errno) {
+	call := &Call{Syscall: "sock_open", Args: []any{family, socketType, protocol, rightsBase, rightsInheriting}}
+	if i.before(ctx, call) {
+		family = valueAt[ProtocolFamily](call.Args, 0)
+		socketType = valueAt[SocketType](call.Args, 1)
+		protocol = valueAt[Protocol](call.Args, 2)
+		rightsBase = valueAt[Rights](call.Args, 3)
+		rightsInheriting = valueAt[Rights](call.Args, 4)
+		v0, errno := i.system.SockOpen(ctx, family, socketType, protocol, rightsBase, rightsInheriting)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[FD](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	call := &Call{Syscall: "sock_bind", Args: []any{fd, addr}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		addr = valueAt[SocketAddress](call.Args, 1)
+		v0, errno := i.system.SockBind(ctx, fd, addr)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[SocketAddress](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockConnect(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	call := &Call{Syscall: "sock_connect", Args: []any{fd, addr}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		addr = valueAt[SocketAddress](call.Args, 1)
+		v0, errno := i.system.SockConnect(ctx, fd, addr)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[SocketAddress](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	call := &Call{Syscall: "sock_listen", Args: []any{fd, backlog}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		backlog = valueAt[int](call.Args, 1)
+		errno := i.system.SockListen(ctx, fd, backlog)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	call := &Call{Syscall: "sock_accept", Args: []any{fd, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		flags = valueAt[FDFlags](call.Args, 1)
+		v0, v1, v2, errno := i.system.SockAccept(ctx, fd, flags)
+		i.after(ctx, call, errno, v0, v1, v2)
+	}
+	return valueAt[FD](call.Results, 0), valueAt[SocketAddress](call.Results, 1), valueAt[SocketAddress](call.Results, 2), call.Errno
+}
+
+func (i *interceptor) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	call := &Call{Syscall: "sock_recv", Args: []any{fd, iovecs, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		flags = valueAt[RIFlags](call.Args, 2)
+		v0, v1, errno := i.system.SockRecv(ctx, fd, iovecs, flags)
+		i.after(ctx, call, errno, v0, v1)
+	}
+	return valueAt[Size](call.Results, 0), valueAt[ROFlags](call.Results, 1), call.Errno
+}
+
+func (i *interceptor) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	call := &Call{Syscall: "sock_send", Args: []any{fd, iovecs, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		flags = valueAt[SIFlags](call.Args, 2)
+		v0, errno := i.system.SockSend(ctx, fd, iovecs, flags)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Size](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	call := &Call{Syscall: "sock_send_to", Args: []any{fd, iovecs, flags, addr}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		flags = valueAt[SIFlags](call.Args, 2)
+		addr = valueAt[SocketAddress](call.Args, 3)
+		v0, errno := i.system.SockSendTo(ctx, fd, iovecs, flags, addr)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[Size](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	call := &Call{Syscall: "sock_recv_from", Args: []any{fd, iovecs, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		iovecs = valueAt[[]IOVec](call.Args, 1)
+		flags = valueAt[RIFlags](call.Args, 2)
+		v0, v1, v2, errno := i.system.SockRecvFrom(ctx, fd, iovecs, flags)
+		i.after(ctx, call, errno, v0, v1, v2)
+	}
+	return valueAt[Size](call.Results, 0), valueAt[ROFlags](call.Results, 1), valueAt[SocketAddress](call.Results, 2), call.Errno
+}
+
+func (i *interceptor) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	call := &Call{Syscall: "sock_getsockopt", Args: []any{fd, option}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		option = valueAt[SocketOption](call.Args, 1)
+		v0, errno := i.system.SockGetOpt(ctx, fd, option)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[SocketOptionValue](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	call := &Call{Syscall: "sock_setsockopt", Args: []any{fd, option, value}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		option = valueAt[SocketOption](call.Args, 1)
+		value = valueAt[SocketOptionValue](call.Args, 2)
+		errno := i.system.SockSetOpt(ctx, fd, option, value)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
+
+func (i *interceptor) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	call := &Call{Syscall: "sock_getlocaladdr", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.SockLocalAddress(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[SocketAddress](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	call := &Call{Syscall: "sock_getpeeraddr", Args: []any{fd}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		v0, errno := i.system.SockRemoteAddress(ctx, fd)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[SocketAddress](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockAddressInfo(ctx context.Context, name string, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	call := &Call{Syscall: "sock_getaddrinfo", Args: []any{name, service, hints, results}}
+	if i.before(ctx, call) {
+		name = valueAt[string](call.Args, 0)
+		service = valueAt[string](call.Args, 1)
+		hints = valueAt[AddressInfo](call.Args, 2)
+		results = valueAt[[]AddressInfo](call.Args, 3)
+		v0, errno := i.system.SockAddressInfo(ctx, name, service, hints, results)
+		i.after(ctx, call, errno, v0)
+	}
+	return valueAt[int](call.Results, 0), call.Errno
+}
+
+func (i *interceptor) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	call := &Call{Syscall: "sock_shutdown", Args: []any{fd, flags}}
+	if i.before(ctx, call) {
+		fd = valueAt[FD](call.Args, 0)
+		flags = valueAt[SDFlags](call.Args, 1)
+		errno := i.system.SockShutdown(ctx, fd, flags)
+		i.after(ctx, call, errno)
+	}
+	return call.Errno
+}
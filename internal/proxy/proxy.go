@@ -0,0 +1,290 @@
+// Package proxy implements the client side of the SOCKS5 and HTTP CONNECT
+// proxy protocols, used to route the outbound connections of guests through
+// a proxy server.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DialFunc is the signature of functions establishing connections to the
+// proxy servers, such as net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Parse parses the URL of a proxy server. The scheme is socks5 (or socks5h)
+// for SOCKS5 proxies, or http for HTTP CONNECT proxies. Credentials may be
+// passed in the user information of the URL.
+func Parse(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy URL '%s': %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("bad proxy URL '%s': unsupported scheme '%s'", rawURL, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("bad proxy URL '%s': missing host", rawURL)
+	}
+	return u, nil
+}
+
+// Dial connects to address, in the host:port form, through the proxy server
+// at proxy. The connection to the proxy is established with dial.
+//
+// Host names are sent to the proxy server, which resolves them. The protocol
+// handshake does not read past the reply of the proxy server, so the file
+// descriptor of the returned connection may be handed over to the guest.
+//
+// Errors reported by the proxy server are converted to the syscall.Errno
+// values that connect(2) would have returned (e.g. ECONNREFUSED).
+func Dial(ctx context.Context, proxy *url.URL, address string, dial DialFunc) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in address '%s': %w", address, err)
+	}
+
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		defaultPort := "1080"
+		if proxy.Scheme == "http" {
+			defaultPort = "80"
+		}
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), defaultPort)
+	}
+	conn, err := dial(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unblock the handshake when the context is canceled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, proxy.User, host, uint16(portNum))
+	case "http":
+		err = httpConnect(conn, proxy.User, address)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme '%s'", proxy.Scheme)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, &net.OpError{Op: "proxy", Net: "tcp", Addr: proxyAddr(address), Err: err}
+	}
+	return conn, nil
+}
+
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "tcp" }
+func (a proxyAddr) String() string  { return string(a) }
+
+const (
+	socks5Version      = 5
+	socks5CmdConnect   = 1
+	socks5NoAuth       = 0
+	socks5PasswordAuth = 2
+	socks5IPv4         = 1
+	socks5DomainName   = 3
+	socks5IPv6         = 4
+)
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = []byte{socks5PasswordAuth}
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5PasswordAuth:
+		if user == nil {
+			return syscall.EACCES
+		}
+		if err := socks5Authenticate(conn, user); err != nil {
+			return err
+		}
+	default:
+		return syscall.EACCES
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return syscall.EINVAL
+		}
+		req = append(req, socks5DomainName, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", head[0])
+	}
+	if head[1] != 0 {
+		return socks5Errno(head[1])
+	}
+	// Discard the bound address, the reply must be read entirely so the
+	// next bytes are those of the destination.
+	var size int
+	switch head[3] {
+	case socks5IPv4:
+		size = net.IPv4len
+	case socks5IPv6:
+		size = net.IPv6len
+	case socks5DomainName:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		size = int(n[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return syscall.EINVAL
+	}
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+func socks5Errno(reply byte) syscall.Errno {
+	switch reply {
+	case 2: // connection not allowed by ruleset
+		return syscall.EACCES
+	case 3: // network unreachable
+		return syscall.ENETUNREACH
+	case 4: // host unreachable
+		return syscall.EHOSTUNREACH
+	case 6: // TTL expired
+		return syscall.ETIMEDOUT
+	case 7: // command not supported
+		return syscall.EOPNOTSUPP
+	case 8: // address type not supported
+		return syscall.EAFNOSUPPORT
+	default: // general failure, connection refused
+		return syscall.ECONNREFUSED
+	}
+}
+
+// maxHeaderSize is the maximum size of the response headers that HTTP
+// proxies may send.
+const maxHeaderSize = 64 * 1024
+
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) error {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+
+	// Read the response one byte at a time; buffering would consume the
+	// first bytes sent by the destination.
+	header := make([]byte, 0, 512)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) == maxHeaderSize {
+			return errors.New("proxy response headers too large")
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusForbidden, res.StatusCode == http.StatusProxyAuthRequired:
+		return syscall.EACCES
+	case res.StatusCode == http.StatusGatewayTimeout:
+		return syscall.ETIMEDOUT
+	default:
+		return syscall.ECONNREFUSED
+	}
+}
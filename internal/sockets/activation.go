@@ -0,0 +1,70 @@
+package sockets
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed with the systemd socket
+// activation protocol.
+const listenFDsStart = 3
+
+// ActivatedSocket is a socket passed to the process by a service manager.
+type ActivatedSocket struct {
+	FD   int
+	Name string
+}
+
+// Activated returns the sockets passed to the process with the systemd socket
+// activation protocol (see sd_listen_fds(3)), or nil if the LISTEN_PID and
+// LISTEN_FDS environment variables are not set for the process.
+//
+// The names of the sockets are those of LISTEN_FDNAMES, or "unknown" when
+// they are not set, like systemd does.
+func Activated() ([]ActivatedSocket, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	sockets := make([]ActivatedSocket, n)
+	for i := range sockets {
+		fd := listenFDsStart + i
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		if _, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE); err != nil {
+			return nil, fmt.Errorf("LISTEN_FDS: file descriptor %d (%s) is not a socket: %w", fd, name, err)
+		}
+		syscall.CloseOnExec(fd)
+		sockets[i] = ActivatedSocket{FD: fd, Name: name}
+	}
+	return sockets, nil
+}
+
+// IsActivationEnv returns true if the environment variable assignment
+// (NAME=VALUE) is one of the variables of the systemd socket activation
+// protocol, which must not be passed on to the children of the process.
+func IsActivationEnv(env string) bool {
+	name, _, _ := strings.Cut(env, "=")
+	switch name {
+	case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,33 @@
+package sockets
+
+import (
+	"testing"
+)
+
+func TestActivatedOtherProcess(t *testing.T) {
+	// The sockets are passed to a different process, they must be ignored.
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	sockets, err := Activated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockets != nil {
+		t.Fatalf("unexpected sockets: %v", sockets)
+	}
+}
+
+func TestIsActivationEnv(t *testing.T) {
+	for env, want := range map[string]bool{
+		"LISTEN_PID=42":      true,
+		"LISTEN_FDS=2":       true,
+		"LISTEN_FDNAMES=a:b": true,
+		"LISTEN_FDS_START=3": false,
+		"PATH=/usr/bin":      false,
+		"LISTEN_ADDR=:8080":  false,
+	} {
+		if got := IsActivationEnv(env); got != want {
+			t.Errorf("IsActivationEnv(%q) = %t, want %t", env, got, want)
+		}
+	}
+}
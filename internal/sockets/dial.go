@@ -1,21 +1,58 @@
 package sockets
 
-import "syscall"
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"syscall"
+
+	"github.com/stealthrocket/wasi-go/internal/proxy"
+)
 
 const EINPROGRESS = syscall.EINPROGRESS
 
-// Dial creates a socket and connects to the specified address.
-func Dial(rawAddr string) (int, error) {
-	addr, sa, fd, err := Socket(rawAddr)
+// Dial creates a socket and connects to the specified address. Connecting
+// datagram sockets sets the destination of the messages sent on them.
+//
+// When the host name of a TCP address resolves to multiple IP addresses, the
+// connection attempts are made in parallel (see DialTCP), and the connection
+// is complete when the function returns.
+func Dial(ctx context.Context, rawAddr string, resolver Resolver) (int, error) {
+	u, err := parseAddress(rawAddr)
 	if err != nil {
 		return -1, err
 	}
-	opt := addr.Query()
-	noDelay := intopt(opt, "nodelay", 1)
-	if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, noDelay); err != nil {
-		Close(fd)
+	if isStream(u) && isHostName(u.Hostname()) {
+		ips, port, err := lookupTCP(ctx, u, resolver)
+		if err != nil {
+			return -1, err
+		}
+		if len(ips) > 1 {
+			conn, err := dialParallel(ctx, ips, port)
+			if err != nil {
+				return -1, err
+			}
+			defer conn.Close()
+			return connFD(conn, u)
+		}
+		// Do not resolve the name again when creating the socket.
+		u.Host = net.JoinHostPort(ips[0].String(), strconv.Itoa(port))
+		rawAddr = u.String()
+	}
+
+	addr, sa, fd, err := Socket(ctx, rawAddr, resolver)
+	if err != nil {
 		return -1, err
 	}
+	opt := addr.Query()
+	if !isUnix(addr) && !isDatagram(addr) {
+		noDelay := intopt(opt, "nodelay", 1)
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, noDelay); err != nil {
+			Close(fd)
+			return -1, err
+		}
+	}
 	nonBlock := boolopt(opt, "nonblock", true)
 	if err := syscall.SetNonblock(fd, nonBlock); err != nil {
 		Close(fd)
@@ -28,3 +65,62 @@ func Dial(rawAddr string) (int, error) {
 	}
 	return fd, err
 }
+
+// DialProxy is like Dial, but TCP connections are established through the
+// proxy server at proxyURL. Unlike Dial, the connection is complete when the
+// function returns. Host names are resolved by the proxy server.
+func DialProxy(ctx context.Context, rawAddr string, proxyURL *url.URL, resolver Resolver) (int, error) {
+	u, err := parseAddress(rawAddr)
+	if err != nil {
+		return -1, err
+	}
+	if isUnix(u) || isDatagram(u) {
+		return Dial(ctx, rawAddr, resolver)
+	}
+	dialer := &net.Dialer{}
+	conn, err := proxy.Dial(ctx, proxyURL, u.Host, dialer.DialContext)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	return connFD(conn, u)
+}
+
+// connFD returns a duplicate of the file descriptor of conn, configured with
+// the options of the address u.
+func connFD(conn net.Conn, u *url.URL) (int, error) {
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if ctrlErr := rawConn.Control(func(sysfd uintptr) {
+		fd, err = dup(int(sysfd))
+	}); ctrlErr != nil {
+		return -1, ctrlErr
+	}
+	if err != nil {
+		return -1, err
+	}
+	opt := u.Query()
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, intopt(opt, "nodelay", 1)); err != nil {
+		Close(fd)
+		return -1, err
+	}
+	if err := syscall.SetNonblock(fd, boolopt(opt, "nonblock", true)); err != nil {
+		Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func dup(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	newfd, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(newfd)
+	return newfd, nil
+}
@@ -0,0 +1,165 @@
+package sockets
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectionAttemptDelay is the delay after which the next connection attempt
+// starts when the previous ones are still in progress (RFC 8305, section 5).
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// DialTCP establishes a TCP connection to the address u, which has the format
+// of the addresses passed to Dial.
+//
+// The connection attempts follow the Happy Eyeballs algorithm (RFC 8305): the
+// addresses that the host name resolves to are sorted to alternate between
+// IPv6 and IPv4, starting with the family of the first address returned by
+// the resolver, and a new attempt starts every 250ms, or as soon as the
+// previous attempt fails, until one of them succeeds. This prevents stalling
+// on broken IPv6 (or IPv4) routes.
+func DialTCP(ctx context.Context, u *url.URL, resolver Resolver) (net.Conn, error) {
+	ips, port, err := lookupTCP(ctx, u, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return dialParallel(ctx, ips, port)
+}
+
+func isStream(u *url.URL) bool { return strings.HasPrefix(u.Scheme, "tcp") }
+
+func isHostName(host string) bool { return host != "" && net.ParseIP(host) == nil }
+
+// lookupTCP returns the IP addresses and port of the TCP address u, sorted in
+// the order of the connection attempts.
+func lookupTCP(ctx context.Context, u *url.URL, resolver Resolver) ([]net.IP, int, error) {
+	network, host := u.Scheme, u.Hostname()
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, 0, fmt.Errorf("unsupported network: %v", network)
+	}
+	port, err := net.LookupPort(network, u.Port())
+	if err != nil {
+		return nil, 0, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil || host == "" {
+		ips = []net.IP{ip}
+		if host == "" {
+			ips[0] = net.IPv6loopback
+			if network == "tcp4" {
+				ips[0] = net.IPv4(127, 0, 0, 1)
+			}
+		}
+	} else if ips, err = resolver.lookupIP(ctx, host); err != nil {
+		return nil, 0, err
+	}
+	version := network[3:]
+	filtered := ips[:0:0]
+	for _, ip := range ips {
+		isIPv4 := ip.To4() != nil && !strings.Contains(host, ":")
+		if (version == "4" && !isIPv4) || (version == "6" && isIPv4) {
+			continue
+		}
+		filtered = append(filtered, ip)
+	}
+	if len(filtered) == 0 {
+		return nil, 0, fmt.Errorf("no IPs for network %s and host: %s", network, host)
+	}
+	return interleave(filtered), port, nil
+}
+
+// interleave sorts the addresses to alternate between the IP versions,
+// starting with the version of the first address (RFC 8305, section 4).
+func interleave(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	firstIsIPv4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIsIPv4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			sorted, first = append(sorted, first[0]), first[1:]
+		}
+		if len(second) > 0 {
+			sorted, second = append(sorted, second[0]), second[1:]
+		}
+	}
+	return sorted
+}
+
+func dialParallel(ctx context.Context, ips []net.IP, port int) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	dialer := &net.Dialer{}
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close the connections of the attempts which may complete
+				// concurrently.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,60 @@
+package sockets
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterleave(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+	}
+	want := []net.IP{ips[0], ips[3], ips[1], ips[4], ips[2]}
+	if got := interleave(ips); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong order: got %v, want %v", got, want)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	// The first addresses are not routable (TEST-NET-1), the attempts either
+	// fail or stall until the last address accepts the connection.
+	resolver := func(ctx context.Context, name string) ([]net.IP, error) {
+		return []net.IP{
+			net.ParseIP("192.0.2.1"),
+			net.ParseIP("192.0.2.2"),
+			net.ParseIP("127.0.0.1"),
+		}, nil
+	}
+	start := time.Now()
+	fd, err := Dial(context.Background(), "tcp://example.test:"+port+"?nonblock=false", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(fd)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection took %s", elapsed)
+	}
+	sa, err := syscall.Getpeername(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer := sockaddrString(sa); peer != "127.0.0.1:"+port {
+		t.Errorf("wrong peer address: %s", peer)
+	}
+}
@@ -1,18 +1,24 @@
 package sockets
 
-import "syscall"
+import (
+	"context"
+	"syscall"
+)
 
-// Listen creates a socket that listens on the specified address.
-func Listen(rawAddr string) (int, error) {
-	addr, sa, fd, err := Socket(rawAddr)
+// Listen creates a socket that listens on the specified address. Datagram
+// sockets are only bound to the address.
+func Listen(ctx context.Context, rawAddr string, resolver Resolver) (int, error) {
+	addr, sa, fd, err := Socket(ctx, rawAddr, resolver)
 	if err != nil {
 		return -1, err
 	}
 	opt := addr.Query()
-	reuseAddr := intopt(opt, "reuseaddr", 1)
-	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, reuseAddr); err != nil {
-		Close(fd)
-		return -1, err
+	if !isUnix(addr) {
+		reuseAddr := intopt(opt, "reuseaddr", 1)
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, reuseAddr); err != nil {
+			Close(fd)
+			return -1, err
+		}
 	}
 	if err := syscall.Bind(fd, sa); err != nil {
 		Close(fd)
@@ -23,6 +29,9 @@ func Listen(rawAddr string) (int, error) {
 		Close(fd)
 		return -1, err
 	}
+	if isDatagram(addr) {
+		return fd, nil
+	}
 	backlog := intopt(opt, "backlog", 128)
 	if err := syscall.Listen(fd, backlog); err != nil {
 		Close(fd)
@@ -1,8 +1,10 @@
 package sockets
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"runtime/debug"
 	"strconv"
@@ -10,22 +12,56 @@ import (
 	"syscall"
 )
 
-// Socket prepares a socket for the specified address.
-func Socket(rawAddr string) (u *url.URL, sa syscall.Sockaddr, fd int, err error) {
-	if !strings.Contains(rawAddr, "://") {
-		rawAddr = "tcp://" + rawAddr
+// Resolver resolves host names to IP addresses. When nil, names are resolved
+// with net.DefaultResolver.
+type Resolver func(ctx context.Context, name string) ([]net.IP, error)
+
+func (r Resolver) lookupIP(ctx context.Context, name string) ([]net.IP, error) {
+	// IP addresses are not passed to the resolver.
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
 	}
-	u, err = url.Parse(rawAddr)
-	if err != nil {
-		return nil, nil, -1, fmt.Errorf("bad address '%s': %w", rawAddr, err)
+	if r == nil {
+		return net.DefaultResolver.LookupIP(ctx, "ip", name)
 	}
-	family, sa, err := socketAddress(u.Scheme, u.Host)
+	return r(ctx, name)
+}
+
+// Socket prepares a socket for the specified address, which is either a
+// host:port address optionally prefixed with the network (e.g.
+// tcp6://[::1]:8080 or udp://:8125), or the path of a unix socket prefixed
+// with unix: (e.g. unix:/var/run/docker.sock). TCP is the default network.
+//
+// Addresses without a host (e.g. :8080) are the wildcard addresses of both
+// IPv4 and IPv6 (dual-stack) for the tcp and udp networks, or of one IP
+// version for the networks with a suffix. IPv6 sockets accept connections
+// from IPv4 peers, which have v4-mapped addresses (e.g. ::ffff:127.0.0.1),
+// unless the v6only option is set (e.g. tcp://[::]:8080?v6only=true).
+func Socket(ctx context.Context, rawAddr string, resolver Resolver) (u *url.URL, sa syscall.Sockaddr, fd int, err error) {
+	u, err = parseAddress(rawAddr)
 	if err != nil {
 		return nil, nil, -1, err
 	}
-	opt := u.Query()
-	fd, err = syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	var family int
+	if isUnix(u) {
+		family, sa, err = unixSocketAddress(u)
+	} else {
+		family, sa, err = socketAddress(ctx, u.Scheme, u.Host, resolver)
+	}
 	if err != nil {
+		return nil, nil, -1, err
+	}
+	sotype := syscall.SOCK_STREAM
+	if isDatagram(u) {
+		sotype = syscall.SOCK_DGRAM
+	}
+	fd, err = syscall.Socket(family, sotype, 0)
+	if err == syscall.EAFNOSUPPORT && isDualStack(u) {
+		// IPv6 is disabled on the host, fall back to the IPv4 wildcard.
+		family, sa = syscall.AF_INET, &syscall.SockaddrInet4{Port: sa.(*syscall.SockaddrInet6).Port}
+		fd, err = syscall.Socket(family, sotype, 0)
+	}
+	if err != nil || isUnix(u) {
 		return
 	}
 	defer func() {
@@ -34,12 +70,60 @@ func Socket(rawAddr string) (u *url.URL, sa syscall.Sockaddr, fd int, err error)
 			fd = -1
 		}
 	}()
-	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, intopt(opt, "reuseaddr", 1)); err != nil {
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, intopt(u.Query(), "reuseaddr", 1)); err != nil {
 		return
 	}
+	if family == syscall.AF_INET6 {
+		v6only := 0
+		if boolopt(u.Query(), "v6only", false) {
+			v6only = 1
+		}
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only); err != nil {
+			return
+		}
+	}
 	return u, sa, fd, err
 }
 
+// isDualStack returns true if u is the wildcard address of both IPv4 and
+// IPv6.
+func isDualStack(u *url.URL) bool {
+	return (u.Scheme == "tcp" || u.Scheme == "udp") && u.Hostname() == ""
+}
+
+func parseAddress(rawAddr string) (*url.URL, error) {
+	if !strings.Contains(rawAddr, "://") && !strings.HasPrefix(rawAddr, "unix:") {
+		rawAddr = "tcp://" + rawAddr
+	}
+	u, err := url.Parse(rawAddr)
+	if err != nil {
+		return nil, fmt.Errorf("bad address '%s': %w", rawAddr, err)
+	}
+	return u, nil
+}
+
+// IsDatagram returns true if the address passed to Socket, Listen or Dial
+// is the one of a datagram (UDP) socket.
+func IsDatagram(rawAddr string) bool {
+	return strings.HasPrefix(rawAddr, "udp") && strings.Contains(rawAddr, "://")
+}
+
+func isDatagram(u *url.URL) bool { return strings.HasPrefix(u.Scheme, "udp") }
+
+func isUnix(u *url.URL) bool { return u.Scheme == "unix" }
+
+func unixSocketAddress(u *url.URL) (int, syscall.Sockaddr, error) {
+	// unix:/path has a path, unix:path is opaque.
+	name := u.Path
+	if name == "" {
+		name = u.Opaque
+	}
+	if name == "" {
+		return -1, nil, fmt.Errorf("missing path of unix socket: %v", u)
+	}
+	return syscall.AF_UNIX, &syscall.SockaddrUnix{Name: name}, nil
+}
+
 // Close closes a file descriptor created with Socket, Listen or Dial.
 func Close(fd int) error {
 	if fd < 0 {
@@ -55,11 +139,11 @@ func Close(fd int) error {
 	return err
 }
 
-func socketAddress(network, addr string) (int, syscall.Sockaddr, error) {
+func socketAddress(ctx context.Context, network, addr string, resolver Resolver) (int, syscall.Sockaddr, error) {
 	switch network {
-	case "tcp", "tcp4", "tcp6":
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
 	default:
-		return -1, nil, fmt.Errorf("unsupported --Listen network: %v", network)
+		return -1, nil, fmt.Errorf("unsupported network: %v", network)
 	}
 	host, portstr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -69,18 +153,28 @@ func socketAddress(network, addr string) (int, syscall.Sockaddr, error) {
 	if err != nil {
 		return 0, nil, err
 	}
+	// The IP version is selected by the suffix of the network, if any.
+	version := network[3:]
+	// IPv6 literals select IPv6 sockets, including v4-mapped addresses
+	// which are otherwise indistinguishable from IPv4 addresses once parsed.
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Is6() && ip.Zone() == "" {
+		if version == "4" {
+			return 0, nil, fmt.Errorf("IPv6 address for network %s: %s", network, addr)
+		}
+		return syscall.AF_INET6, &syscall.SockaddrInet6{Port: port, Addr: ip.As16()}, nil
+	}
 	var ips []net.IP
-	if host == "" && network == "tcp6" {
+	if host == "" && version != "4" {
 		ips = []net.IP{net.IPv6zero}
 	} else if host == "" {
 		ips = []net.IP{net.IPv4zero}
 	} else {
-		ips, err = net.LookupIP(host)
+		ips, err = resolver.lookupIP(ctx, host)
 		if err != nil {
 			return 0, nil, err
 		}
 	}
-	if network == "tcp" || network == "tcp4" {
+	if version != "6" {
 		for _, ip := range ips {
 			if ipv4 := ip.To4(); ipv4 != nil {
 				return syscall.AF_INET, &syscall.SockaddrInet4{
@@ -89,12 +183,13 @@ func socketAddress(network, addr string) (int, syscall.Sockaddr, error) {
 				}, nil
 			}
 		}
-	} else if network == "tcp" || network == "tcp6" {
+	}
+	if version != "4" {
 		for _, ip := range ips {
-			if ipv6 := ip.To16(); ipv6 != nil {
+			if ip.To4() == nil {
 				return syscall.AF_INET6, &syscall.SockaddrInet6{
 					Port: port,
-					Addr: ([16]byte)(ipv6),
+					Addr: ([16]byte)(ip.To16()),
 				}, nil
 			}
 		}
@@ -128,3 +223,21 @@ func boolopt(q url.Values, key string, defaultValue bool) bool {
 		return defaultValue
 	}
 }
+
+// Name returns the name of the socket fd, which is its local address in the
+// format accepted by Listen (e.g. 127.0.0.1:8080 or unix:/tmp/app.sock), or
+// fd:N when the address cannot be determined.
+func Name(fd int) string {
+	sa, err := syscall.Getsockname(fd)
+	if err == nil {
+		switch a := sa.(type) {
+		case *syscall.SockaddrInet4, *syscall.SockaddrInet6:
+			return sockaddrString(a)
+		case *syscall.SockaddrUnix:
+			if a.Name != "" {
+				return "unix:" + a.Name
+			}
+		}
+	}
+	return "fd:" + strconv.Itoa(fd)
+}
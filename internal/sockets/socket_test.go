@@ -0,0 +1,81 @@
+package sockets
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	unixPath := filepath.Join(t.TempDir(), "app.sock")
+	for addr, want := range map[string]string{
+		"127.0.0.1:0":       "127.0.0.1:",
+		"tcp6://[::1]:0":    "[::1]:",
+		"udp://127.0.0.1:0": "127.0.0.1:",
+		"unix:" + unixPath:  "unix:" + unixPath,
+	} {
+		fd, err := Listen(context.Background(), addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := Name(fd)
+		Close(fd)
+
+		// The names have the ports assigned by the system.
+		if !strings.HasPrefix(name, want) || strings.HasSuffix(name, ":0") {
+			t.Errorf("wrong name for %s: %s", addr, name)
+		}
+	}
+	if name := Name(-1); name != "fd:-1" {
+		t.Errorf("wrong name for invalid file descriptor: %s", name)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	fd, err := Listen(context.Background(), "tcp://:0?nonblock=false", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(fd)
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inet6, ok := sa.(*syscall.SockaddrInet6)
+	if !ok {
+		t.Skipf("IPv6 is not available: listening on %s", Name(fd))
+	}
+
+	// The wildcard address accepts connections over both IP versions.
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(inet6.Port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		accepted, _, err := syscall.Accept(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Close(accepted)
+	}
+
+	// v4-mapped addresses create IPv6 sockets.
+	fd6, err := Listen(context.Background(), "tcp6://[::ffff:127.0.0.1]:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(fd6)
+	if sa, _ := syscall.Getsockname(fd6); sa == nil {
+		t.Fatal("no local address")
+	} else if _, ok := sa.(*syscall.SockaddrInet6); !ok {
+		t.Errorf("wrong socket family for v4-mapped address: %T", sa)
+	}
+	if _, err := Listen(context.Background(), "tcp4://[::1]:0", nil); err == nil {
+		t.Error("IPv6 address accepted for tcp4")
+	}
+}
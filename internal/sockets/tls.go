@@ -0,0 +1,278 @@
+package sockets
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stealthrocket/wasi-go/internal/proxy"
+)
+
+// tlsHandshakeTimeout is the maximum duration of TLS handshakes, after which
+// the connections are closed.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// ListenTLS listens for TLS connections on the specified address, which has
+// the same format as the addresses passed to Listen, except that datagram
+// sockets are not supported.
+//
+// The TLS connections are terminated on the host: the function returns the
+// file descriptor of a socket listening on an ephemeral port of the loopback
+// interface, on which the plaintext connections are accepted. The peer
+// addresses of these connections are thus loopback addresses.
+//
+// The returned io.Closer stops listening for TLS connections, and closes the
+// connections which are still open.
+func ListenTLS(ctx context.Context, rawAddr string, config *tls.Config, resolver Resolver) (int, io.Closer, error) {
+	u, err := parseAddress(rawAddr)
+	if err != nil {
+		return -1, nil, err
+	}
+	if isDatagram(u) {
+		return -1, nil, fmt.Errorf("unsupported network for TLS: %v", u.Scheme)
+	}
+	publicFD, err := Listen(ctx, rawAddr, resolver)
+	if err != nil {
+		return -1, nil, err
+	}
+	f := os.NewFile(uintptr(publicFD), rawAddr)
+	public, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// The plaintext socket is created with the options of the address (e.g.
+	// backlog or nonblock), but always listens on the loopback interface.
+	opt := u.Query()
+	plaintextAddr := "tcp://127.0.0.1:0?" + opt.Encode()
+	fd, err := Listen(ctx, plaintextAddr, nil)
+	if err != nil {
+		public.Close()
+		return -1, nil, err
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		Close(fd)
+		public.Close()
+		return -1, nil, err
+	}
+	port := sa.(*syscall.SockaddrInet4).Port
+
+	t := &tlsTerminator{
+		listener:  tls.NewListener(public, config),
+		plaintext: fmt.Sprintf("127.0.0.1:%d", port),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	go t.serve()
+	return fd, t, nil
+}
+
+type tlsTerminator struct {
+	listener  net.Listener
+	plaintext string
+	mutex     sync.Mutex
+	closed    bool
+	conns     map[net.Conn]struct{}
+}
+
+func (t *tlsTerminator) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Temporary errors such as EMFILE; retry after a short delay
+			// like net/http does.
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go t.handle(conn.(*tls.Conn))
+	}
+}
+
+func (t *tlsTerminator) track(conn net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *tlsTerminator) untrack(conn net.Conn) {
+	t.mutex.Lock()
+	delete(t.conns, conn)
+	t.mutex.Unlock()
+}
+
+func (t *tlsTerminator) handle(conn *tls.Conn) {
+	defer conn.Close()
+	if !t.track(conn) {
+		return
+	}
+	defer t.untrack(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+
+	plaintext, err := net.Dial("tcp", t.plaintext)
+	if err != nil {
+		return
+	}
+	defer plaintext.Close()
+	if !t.track(plaintext) {
+		return
+	}
+	defer t.untrack(plaintext)
+
+	relay(conn, plaintext.(*net.TCPConn))
+}
+
+type closeWriter interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// relay copies data between the TLS connection and the plaintext connection
+// until both directions reach EOF, propagating half-closes.
+func relay(conn *tls.Conn, plaintext closeWriter) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(plaintext, conn)
+		plaintext.CloseWrite()
+	}()
+	io.Copy(conn, plaintext)
+	conn.CloseWrite()
+	<-done
+}
+
+func (t *tlsTerminator) Close() error {
+	t.mutex.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = nil
+	t.mutex.Unlock()
+	err := t.listener.Close()
+	for conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+// DialTLS establishes a TLS connection to the specified address, which has
+// the same format as the addresses passed to Dial, except that datagram
+// sockets are not supported. The connection is made through the proxy
+// server at proxyURL if it is not nil.
+//
+// The TLS connection is originated on the host: the function returns the
+// file descriptor of one end of a unix socket pair, on which the plaintext
+// stream is exchanged. When the ServerName of config is empty, the host of
+// the address is used to verify the certificate of the server.
+//
+// The returned io.Closer closes the TLS connection.
+func DialTLS(ctx context.Context, rawAddr string, config *tls.Config, proxyURL *url.URL, resolver Resolver) (int, io.Closer, error) {
+	u, err := parseAddress(rawAddr)
+	if err != nil {
+		return -1, nil, err
+	}
+	if isDatagram(u) {
+		return -1, nil, fmt.Errorf("unsupported network for TLS: %v", u.Scheme)
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	switch {
+	case isUnix(u):
+		var sa syscall.Sockaddr
+		_, sa, err = unixSocketAddress(u)
+		if err == nil {
+			conn, err = dialer.DialContext(ctx, "unix", sa.(*syscall.SockaddrUnix).Name)
+		}
+	case proxyURL != nil:
+		conn, err = proxy.Dial(ctx, proxyURL, u.Host, dialer.DialContext)
+	default:
+		conn, err = DialTCP(ctx, u, resolver)
+	}
+	if err != nil {
+		return -1, nil, err
+	}
+
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" && !isUnix(u) {
+		config = config.Clone()
+		config.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return -1, nil, err
+	}
+
+	fds, err := socketpair()
+	if err != nil {
+		tlsConn.Close()
+		return -1, nil, err
+	}
+	f := os.NewFile(uintptr(fds[1]), rawAddr)
+	plaintext, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		Close(fds[0])
+		tlsConn.Close()
+		return -1, nil, err
+	}
+	if err := syscall.SetNonblock(fds[0], boolopt(u.Query(), "nonblock", true)); err != nil {
+		Close(fds[0])
+		plaintext.Close()
+		tlsConn.Close()
+		return -1, nil, err
+	}
+	go func() {
+		defer plaintext.Close()
+		defer tlsConn.Close()
+		relay(tlsConn, plaintext.(*net.UnixConn))
+	}()
+	return fds[0], tlsConn, nil
+}
+
+func socketpair() ([2]int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return fds, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	return fds, nil
+}
+
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch a := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,140 @@
+package sockets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenTLS(t *testing.T) {
+	fd, closer, err := ListenTLS(context.Background(), "127.0.0.1:0?nonblock=false", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCertificate(t)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(fd)
+	defer closer.Close()
+
+	addr := closer.(*tlsTerminator).listener.Addr().String()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is accepted in plaintext on the socket of the guest.
+	plaintext, _, err := syscall.Accept(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(plaintext)
+	buf := make([]byte, 16)
+	n, err := syscall.Read(plaintext, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("wrong data received: %q", buf[:n])
+	}
+	if _, err := syscall.Write(plaintext, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Fatalf("wrong data received: %q", buf[:n])
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	cert := selfSignedCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(conn, buf); err == nil && string(buf) == "hello" {
+					io.WriteString(conn, "world")
+				}
+			}()
+		}
+	}()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	fd, closer, err := DialTLS(context.Background(), l.Addr().String()+"?nonblock=false", &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(fd)
+	defer closer.Close()
+
+	// The plaintext stream is exchanged on the socket of the guest.
+	if _, err := syscall.Write(fd, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Fatalf("wrong data received: %q", buf[:n])
+	}
+
+	// Servers are verified for the host of the address by default.
+	if _, _, err := DialTLS(context.Background(), l.Addr().String(), &tls.Config{RootCAs: roots}, nil, nil); err == nil {
+		t.Fatal("certificate for localhost accepted for 127.0.0.1")
+	}
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
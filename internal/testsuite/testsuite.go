@@ -0,0 +1,127 @@
+// Package testsuite reads the test suites of WebAssembly/wasi-testsuite, and
+// compares the results of their tests to the specifications of the tests. It
+// is shared by the wasitest package, which runs the suites in process, and by
+// the wasirun wasi-testsuite command, which runs them with wasirun.
+package testsuite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Name returns the name of the test suite in dir, which is read from its
+// manifest if it has one, and is the name of the directory otherwise.
+func Name(dir string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.Base(dir), nil
+		}
+		return "", err
+	}
+	var manifest struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return "", fmt.Errorf("%s: %w", dir, err)
+	}
+	if manifest.Name == "" {
+		return filepath.Base(dir), nil
+	}
+	return manifest.Name, nil
+}
+
+// Tests returns the names of the tests of the suite in dir, which are the
+// names of its WebAssembly modules without the .wasm extension, sorted.
+func Tests(dir string) ([]string, error) {
+	modules, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(modules))
+	for i, module := range modules {
+		names[i] = strings.TrimSuffix(filepath.Base(module), ".wasm")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Spec is the specification of a test, read from the JSON file which has
+// the same name as the module of the test.
+type Spec struct {
+	Args     []string          `json:"args"`
+	Dirs     []string          `json:"dirs"`
+	Env      map[string]string `json:"env"`
+	ExitCode int               `json:"exit_code"`
+	Stdout   *string           `json:"stdout"`
+}
+
+// ReadSpec reads the specification of the test name of the suite in dir.
+// Tests without a specification are expected to exit with status zero.
+func ReadSpec(dir, name string) (Spec, error) {
+	spec := Spec{}
+	b, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &spec); err != nil {
+			return spec, fmt.Errorf("%s: %w", name, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return spec, err
+	}
+	return spec, nil
+}
+
+// Environ returns the environment variables of the test, in the KEY=VALUE
+// form, sorted.
+func (s *Spec) Environ() []string {
+	env := make([]string, 0, len(s.Env))
+	for k, v := range s.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Failure is a difference between the result of a test and its
+// specification.
+type Failure struct {
+	// Type is the part of the result which differs: exit_code or stdout.
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// Compare compares the exit code and output of a test to its specification,
+// and returns the failures of the test, which passed if there are none.
+func (s *Spec) Compare(exitCode int, stdout string) []Failure {
+	failures := []Failure{}
+	if exitCode != s.ExitCode {
+		failures = append(failures, Failure{
+			Type:    "exit_code",
+			Message: fmt.Sprintf("expected %d, got %d", s.ExitCode, exitCode),
+		})
+	}
+	if s.Stdout != nil && stdout != *s.Stdout {
+		failures = append(failures, Failure{
+			Type:    "stdout",
+			Message: fmt.Sprintf("expected %q, got %q", *s.Stdout, stdout),
+		})
+	}
+	return failures
+}
+
+// Cleanup removes the files that the test left in its directories, which are
+// suffixed with .cleanup and must be removed for the next runs to succeed.
+func (s *Spec) Cleanup(dir string) {
+	for _, d := range s.Dirs {
+		leftovers, _ := filepath.Glob(filepath.Join(dir, d, "*.cleanup"))
+		for _, path := range leftovers {
+			os.RemoveAll(path)
+		}
+	}
+}
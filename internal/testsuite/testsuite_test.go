@@ -0,0 +1,166 @@
+package testsuite
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	for _, test := range []struct {
+		dir  string
+		name string
+	}{
+		{"testdata/suite", "fixture suite"},
+		{"testdata/unnamed", "unnamed"},
+	} {
+		name, err := Name(test.dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.dir, err)
+		} else if name != test.name {
+			t.Errorf("%s: wrong name: want=%q got=%q", test.dir, test.name, name)
+		}
+	}
+}
+
+func TestTests(t *testing.T) {
+	tests, err := Tests("testdata/suite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"args", "invalid", "nospec"}; !reflect.DeepEqual(tests, want) {
+		t.Errorf("wrong tests: want=%q got=%q", want, tests)
+	}
+}
+
+func TestReadSpec(t *testing.T) {
+	stdout := "hello\n"
+	for _, test := range []struct {
+		name    string
+		spec    Spec
+		environ []string
+		err     bool
+	}{
+		{
+			name: "args",
+			spec: Spec{
+				Args:     []string{"-v", "file"},
+				Dirs:     []string{"fs-tests.dir"},
+				Env:      map[string]string{"TZ": "UTC", "HOME": "/home/user"},
+				ExitCode: 3,
+				Stdout:   &stdout,
+			},
+			environ: []string{"HOME=/home/user", "TZ=UTC"},
+		},
+		{
+			// Tests without a specification are expected to succeed.
+			name:    "nospec",
+			spec:    Spec{},
+			environ: []string{},
+		},
+		{
+			name: "invalid",
+			err:  true,
+		},
+	} {
+		spec, err := ReadSpec("testdata/suite", test.name)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: invalid specification read without error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec, test.spec) {
+			t.Errorf("%s: wrong specification:\nwant = %+v\ngot  = %+v", test.name, test.spec, spec)
+		}
+		if environ := spec.Environ(); !reflect.DeepEqual(environ, test.environ) {
+			t.Errorf("%s: wrong environment: want=%q got=%q", test.name, test.environ, environ)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	stdout := "hello\n"
+	for _, test := range []struct {
+		scenario string
+		spec     Spec
+		exitCode int
+		stdout   string
+		failures []Failure
+	}{
+		{
+			scenario: "the exit code and output match",
+			spec:     Spec{ExitCode: 3, Stdout: &stdout},
+			exitCode: 3,
+			stdout:   "hello\n",
+			failures: []Failure{},
+		},
+		{
+			scenario: "the output is not compared when it is not specified",
+			spec:     Spec{},
+			stdout:   "anything",
+			failures: []Failure{},
+		},
+		{
+			scenario: "the exit code differs",
+			spec:     Spec{ExitCode: 0},
+			exitCode: 1,
+			failures: []Failure{
+				{Type: "exit_code", Message: "expected 0, got 1"},
+			},
+		},
+		{
+			scenario: "an empty output is specified",
+			spec:     Spec{Stdout: new(string)},
+			stdout:   "hello\n",
+			failures: []Failure{
+				{Type: "stdout", Message: `expected "", got "hello\n"`},
+			},
+		},
+		{
+			scenario: "the exit code and output differ",
+			spec:     Spec{ExitCode: 3, Stdout: &stdout},
+			exitCode: 134,
+			stdout:   "hell",
+			failures: []Failure{
+				{Type: "exit_code", Message: "expected 3, got 134"},
+				{Type: "stdout", Message: `expected "hello\n", got "hell"`},
+			},
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			failures := test.spec.Compare(test.exitCode, test.stdout)
+			if !reflect.DeepEqual(failures, test.failures) {
+				t.Errorf("wrong failures:\nwant = %+v\ngot  = %+v", test.failures, failures)
+			}
+		})
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "fs-tests.dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file.cleanup", "dir.cleanup", "file"} {
+		if err := os.WriteFile(filepath.Join(dir, "fs-tests.dir", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spec := Spec{Dirs: []string{"fs-tests.dir"}}
+	spec.Cleanup(dir)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "fs-tests.dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file" {
+		t.Errorf("the files left by the test were not removed: %v", entries)
+	}
+}
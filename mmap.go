@@ -0,0 +1,47 @@
+package wasi
+
+import "context"
+
+// FileMapper is implemented by systems which can map files in the memory of
+// the host (e.g. with mmap(2)), so the content of large files can be read
+// repeatedly without making a system call each time.
+type FileMapper interface {
+	// FDMmap copies the content of the file fd at offset to buffer, from a
+	// read-only mapping of the file that the system keeps for the file
+	// descriptor until it is closed. It returns the number of bytes copied,
+	// which is less than len(buffer) when the range extends past the end of
+	// the file.
+	//
+	// The method returns ENOTSUP if the file cannot be mapped, in which case
+	// the caller may read the file instead.
+	FDMmap(ctx context.Context, fd FD, offset FileSize, buffer []byte) (Size, Errno)
+}
+
+// FDMmap copies the content of the file fd at offset to buffer.
+//
+// The content is read from a mapping of the file if the system implements
+// FileMapper, otherwise it is read with FDPread.
+func FDMmap(ctx context.Context, system System, fd FD, offset FileSize, buffer []byte) (Size, Errno) {
+	if mapper, ok := system.(FileMapper); ok {
+		n, errno := mapper.FDMmap(ctx, fd, offset, buffer)
+		if errno != ENOTSUP {
+			return n, errno
+		}
+	}
+
+	var size Size
+	for size < Size(len(buffer)) {
+		n, errno := system.FDPread(ctx, fd, []IOVec{buffer[size:]}, offset+FileSize(size))
+		if errno != ESUCCESS {
+			if size > 0 {
+				break
+			}
+			return 0, errno
+		}
+		if n == 0 {
+			break
+		}
+		size += n
+	}
+	return size, ESUCCESS
+}
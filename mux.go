@@ -0,0 +1,732 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stealthrocket/wasi-go/internal/descriptor"
+)
+
+// Routes are the systems that the System returned by Mux routes system calls
+// to, grouped by family. Default is required, and receives the calls of
+// families which are not routed to a specific system.
+type Routes struct {
+	// Default receives args_*, environ_*, proc_* and sched_yield, and the
+	// calls of families which have no system configured.
+	Default System
+	// Files receives path_open and the other path_* functions on the
+	// preopened directories of the system.
+	Files System
+	// Sockets receives sock_open and sock_getaddrinfo.
+	Sockets System
+	// Clocks receives clock_res_get, clock_time_get, and the calls to
+	// poll_oneoff which only subscribe to clock events.
+	Clocks System
+	// Random receives random_get.
+	Random System
+}
+
+// muxProbeLimit is the number of consecutive closed file descriptors after
+// which Mux stops looking for the file descriptors opened in a system.
+const muxProbeLimit = 64
+
+// muxPollInterval is the maximum duration that poll_oneoff blocks on the
+// file descriptors of one system when the guest subscribes to file
+// descriptors of multiple systems.
+const muxPollInterval = 10 * time.Millisecond
+
+// Mux returns a System which routes system calls to different systems
+// depending on their family, for example to combine the sockets of the unix
+// system with an in-memory file system in a single instance.
+//
+// The mux owns the table of file descriptors seen by the guest. Calls on a
+// file descriptor are routed to the system that it was opened from, with the
+// file descriptor number translated to the number used by that system;
+// files opened with path_open belong to the system of the directory that
+// they were opened from, and sockets created by sock_open or sock_accept to
+// the Sockets system.
+//
+// The file descriptors already opened in the systems (e.g. stdio, preopened
+// directories or listening sockets) are exposed to the guest the first time
+// that it makes a system call. Those of the Default system keep their
+// numbers, then those of the Files and Sockets systems are assigned the
+// same numbers if they are available, or the lowest numbers available
+// otherwise.
+//
+// Linking or renaming files across systems fails with EXDEV. When the guest
+// polls file descriptors of multiple systems, the mux polls each system in
+// turn, which increases the latency of the events by up to 10ms.
+func Mux(routes Routes) System {
+	m := &mux{routes: routes}
+	if m.routes.Files == nil {
+		m.routes.Files = routes.Default
+	}
+	if m.routes.Sockets == nil {
+		m.routes.Sockets = routes.Default
+	}
+	if m.routes.Clocks == nil {
+		m.routes.Clocks = routes.Default
+	}
+	if m.routes.Random == nil {
+		m.routes.Random = routes.Default
+	}
+	for _, s := range []System{m.routes.Default, m.routes.Files, m.routes.Sockets, m.routes.Clocks, m.routes.Random} {
+		if !m.hasSystem(s) {
+			m.systems = append(m.systems, s)
+		}
+	}
+	return m
+}
+
+type mux struct {
+	routes  Routes
+	systems []System // distinct systems, in the order of Routes
+	once    sync.Once
+	mutex   sync.Mutex
+	fds     descriptor.Table[FD, muxFD]
+}
+
+// muxFD is a file descriptor of the guest, opened in one of the systems.
+type muxFD struct {
+	system System
+	fd     FD
+}
+
+func (m *mux) hasSystem(system System) bool {
+	for _, s := range m.systems {
+		if s == system {
+			return true
+		}
+	}
+	return false
+}
+
+// init exposes the file descriptors opened in the systems to the guest.
+func (m *mux) init(ctx context.Context) {
+	m.once.Do(func() {
+		var moved []muxFD
+		for _, s := range []System{m.routes.Default, m.routes.Files, m.routes.Sockets} {
+			for fd, closed := FD(0), 0; closed < muxProbeLimit; fd++ {
+				if _, errno := s.FDStatGet(ctx, fd); errno == EBADF {
+					closed++
+					continue
+				}
+				closed = 0
+				if f, ok := m.fds.Lookup(fd); ok {
+					if f.system != s {
+						moved = append(moved, muxFD{system: s, fd: fd})
+					}
+					continue
+				}
+				m.fds.Assign(fd, muxFD{system: s, fd: fd})
+			}
+		}
+		for _, f := range moved {
+			m.fds.Insert(f)
+		}
+	})
+}
+
+func (m *mux) lookup(fd FD) (System, FD, Errno) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, ok := m.fds.Lookup(fd)
+	if !ok {
+		return nil, -1, EBADF
+	}
+	return f.system, f.fd, ESUCCESS
+}
+
+func (m *mux) lookupContext(ctx context.Context, fd FD) (System, FD, Errno) {
+	m.init(ctx)
+	return m.lookup(fd)
+}
+
+func (m *mux) insert(system System, fd FD) FD {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.fds.Insert(muxFD{system: system, fd: fd})
+}
+
+func (m *mux) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	return m.routes.Default.ArgsSizesGet(ctx)
+}
+
+func (m *mux) ArgsGet(ctx context.Context) ([]string, Errno) {
+	return m.routes.Default.ArgsGet(ctx)
+}
+
+func (m *mux) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	return m.routes.Default.EnvironSizesGet(ctx)
+}
+
+func (m *mux) EnvironGet(ctx context.Context) ([]string, Errno) {
+	return m.routes.Default.EnvironGet(ctx)
+}
+
+func (m *mux) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	return m.routes.Clocks.ClockResGet(ctx, id)
+}
+
+func (m *mux) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	return m.routes.Clocks.ClockTimeGet(ctx, id, precision)
+}
+
+func (m *mux) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	return m.routes.Default.ProcExit(ctx, exitCode)
+}
+
+func (m *mux) ProcRaise(ctx context.Context, signal Signal) Errno {
+	return m.routes.Default.ProcRaise(ctx, signal)
+}
+
+func (m *mux) SchedYield(ctx context.Context) Errno {
+	return m.routes.Default.SchedYield(ctx)
+}
+
+func (m *mux) RandomGet(ctx context.Context, b []byte) Errno {
+	return m.routes.Random.RandomGet(ctx, b)
+}
+
+func (m *mux) FDClose(ctx context.Context, fd FD) Errno {
+	s, sfd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if errno := s.FDClose(ctx, sfd); errno != ESUCCESS {
+		return errno
+	}
+	m.mutex.Lock()
+	m.fds.Delete(fd)
+	m.mutex.Unlock()
+	return ESUCCESS
+}
+
+func (m *mux) FDRenumber(ctx context.Context, from, to FD) Errno {
+	s, sfd, errno := m.lookupContext(ctx, from)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if _, errno := s.FDPreStatGet(ctx, sfd); errno == ESUCCESS {
+		return ENOTSUP
+	}
+	if target, targetfd, errno := m.lookup(to); errno == ESUCCESS {
+		if _, errno := target.FDPreStatGet(ctx, targetfd); errno == ESUCCESS {
+			return ENOTSUP
+		}
+		target.FDClose(ctx, targetfd)
+	}
+	m.mutex.Lock()
+	m.fds.Assign(to, muxFD{system: s, fd: sfd})
+	m.fds.Delete(from)
+	m.mutex.Unlock()
+	return ESUCCESS
+}
+
+func (m *mux) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return -1, errno
+	}
+	newfd, errno := s.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	if errno != ESUCCESS {
+		return -1, errno
+	}
+	return m.insert(s, newfd), ESUCCESS
+}
+
+func (m *mux) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	s, oldFD, errno := m.lookupContext(ctx, oldFD)
+	if errno != ESUCCESS {
+		return errno
+	}
+	t, newFD, errno := m.lookup(newFD)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if s != t {
+		return EXDEV
+	}
+	return s.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+}
+
+func (m *mux) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	t, newFD, errno := m.lookup(newFD)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if s != t {
+		return EXDEV
+	}
+	return s.PathRename(ctx, fd, oldPath, newFD, newPath)
+}
+
+func (m *mux) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.PathSymlink(ctx, oldPath, fd, newPath)
+}
+
+func (m *mux) SockOpen(ctx context.Context, family ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	m.init(ctx)
+	s := m.routes.Sockets
+	fd, errno := s.SockOpen(ctx, family, socketType, protocol, rightsBase, rightsInheriting)
+	if errno != ESUCCESS {
+		return -1, errno
+	}
+	return m.insert(s, fd), ESUCCESS
+}
+
+func (m *mux) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return -1, nil, nil, errno
+	}
+	newfd, peer, addr, errno := s.SockAccept(ctx, fd, flags)
+	if errno != ESUCCESS {
+		return -1, nil, nil, errno
+	}
+	return m.insert(s, newfd), peer, addr, ESUCCESS
+}
+
+func (m *mux) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	return m.routes.Sockets.SockAddressInfo(ctx, name, service, hints, results)
+}
+
+// muxPoll is the group of subscriptions of poll_oneoff routed to a system.
+type muxPoll struct {
+	system        System
+	subscriptions []Subscription
+}
+
+func (m *mux) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	if len(subscriptions) == 0 || len(events) < len(subscriptions) {
+		return 0, EINVAL
+	}
+	m.init(ctx)
+
+	var polls []muxPoll
+	var clocks []Subscription
+	// Subscriptions with the file descriptor numbers of the routed systems,
+	// in the original order so the events are reported in the same order
+	// when the call is forwarded to a single system.
+	routed := make([]Subscription, 0, len(subscriptions))
+	numEvents := 0
+	for i := range subscriptions {
+		sub := subscriptions[i]
+		if sub.EventType == ClockEvent {
+			clocks = append(clocks, sub)
+			routed = append(routed, sub)
+			continue
+		}
+		s, fd, errno := m.lookup(sub.GetFDReadWrite().FD)
+		if errno != ESUCCESS {
+			events[numEvents] = Event{UserData: sub.UserData, EventType: sub.EventType, Errno: errno}
+			numEvents++
+			continue
+		}
+		sub.SetFDReadWrite(SubscriptionFDReadWrite{FD: fd})
+		routed = append(routed, sub)
+		j := 0
+		for j < len(polls) && polls[j].system != s {
+			j++
+		}
+		if j == len(polls) {
+			polls = append(polls, muxPoll{system: s})
+		}
+		polls[j].subscriptions = append(polls[j].subscriptions, sub)
+	}
+	if numEvents > 0 {
+		return numEvents, ESUCCESS
+	}
+
+	switch len(polls) {
+	case 0:
+		return m.routes.Clocks.PollOneOff(ctx, clocks, events)
+	case 1:
+		return polls[0].system.PollOneOff(ctx, routed, events)
+	}
+
+	// The file descriptors belong to multiple systems, which cannot be
+	// waited on together. Each system is polled in turn, only blocking on
+	// the last one for a short period of time.
+	deadlines := make([]time.Time, len(clocks))
+	var deadline time.Time
+	for i := range clocks {
+		c := clocks[i].GetClock()
+		timeout := c.Timeout
+		if c.Flags.Has(Abstime) {
+			now, errno := m.routes.Clocks.ClockTimeGet(ctx, c.ID, 1)
+			if errno != ESUCCESS {
+				return 0, errno
+			}
+			if timeout > now {
+				timeout -= now
+			} else {
+				timeout = 0
+			}
+		}
+		deadlines[i] = time.Now().Add(timeout.Duration())
+		if deadline.IsZero() || deadlines[i].Before(deadline) {
+			deadline = deadlines[i]
+		}
+	}
+
+	buffer := make([]Event, len(subscriptions)+1)
+	for {
+		for i := range polls {
+			p := &polls[i]
+			wait := Timestamp(0)
+			if i == len(polls)-1 {
+				wait = Timestamp(muxPollInterval)
+				if !deadline.IsZero() {
+					if remain := Timestamp(time.Until(deadline)); remain < wait {
+						wait = remain
+					}
+				}
+			}
+			subs := append(p.subscriptions, MakeSubscriptionClock(0, SubscriptionClock{
+				ID:      Monotonic,
+				Timeout: wait,
+			}))
+			n, errno := p.system.PollOneOff(ctx, subs, buffer[:len(subs)])
+			if errno != ESUCCESS {
+				return 0, errno
+			}
+			for _, e := range buffer[:n] {
+				if e.EventType != ClockEvent {
+					events[numEvents] = e
+					numEvents++
+				}
+			}
+		}
+		if numEvents > 0 {
+			return numEvents, ESUCCESS
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			now := time.Now()
+			for i, d := range deadlines {
+				if !now.Before(d) {
+					events[numEvents] = Event{UserData: clocks[i].UserData, EventType: ClockEvent}
+					numEvents++
+				}
+			}
+			return numEvents, ESUCCESS
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, MakeErrno(err)
+		}
+	}
+}
+
+func (m *mux) Close(ctx context.Context) error {
+	errs := make([]error, len(m.systems))
+	for i, s := range m.systems {
+		errs[i] = s.Close(ctx)
+	}
+	return errors.Join(errs...)
+}
+
+func (m *mux) FDAdvise(ctx context.Context, fd FD, offset FileSize, length FileSize, advice Advice) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDAdvise(ctx, fd, offset, length, advice)
+}
+
+func (m *mux) FDAllocate(ctx context.Context, fd FD, offset FileSize, length FileSize) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDAllocate(ctx, fd, offset, length)
+}
+
+func (m *mux) FDDataSync(ctx context.Context, fd FD) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDDataSync(ctx, fd)
+}
+
+func (m *mux) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return FDStat{}, errno
+	}
+	return s.FDStatGet(ctx, fd)
+}
+
+func (m *mux) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDStatSetFlags(ctx, fd, flags)
+}
+
+func (m *mux) FDStatSetRights(ctx context.Context, fd FD, rightsBase Rights, rightsInheriting Rights) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+}
+
+func (m *mux) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return FileStat{}, errno
+	}
+	return s.FDFileStatGet(ctx, fd)
+}
+
+func (m *mux) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDFileStatSetSize(ctx, fd, size)
+}
+
+func (m *mux) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+}
+
+func (m *mux) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDPread(ctx, fd, iovecs, offset)
+}
+
+func (m *mux) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return PreStat{}, errno
+	}
+	return s.FDPreStatGet(ctx, fd)
+}
+
+func (m *mux) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return "", errno
+	}
+	return s.FDPreStatDirName(ctx, fd)
+}
+
+func (m *mux) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDPwrite(ctx, fd, iovecs, offset)
+}
+
+func (m *mux) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDRead(ctx, fd, iovecs)
+}
+
+func (m *mux) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+}
+
+func (m *mux) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDSeek(ctx, fd, offset, whence)
+}
+
+func (m *mux) FDSync(ctx context.Context, fd FD) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.FDSync(ctx, fd)
+}
+
+func (m *mux) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDTell(ctx, fd)
+}
+
+func (m *mux) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.FDWrite(ctx, fd, iovecs)
+}
+
+func (m *mux) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.PathCreateDirectory(ctx, fd, path)
+}
+
+func (m *mux) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return FileStat{}, errno
+	}
+	return s.PathFileStatGet(ctx, fd, lookupFlags, path)
+}
+
+func (m *mux) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+}
+
+func (m *mux) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.PathReadLink(ctx, fd, path, buffer)
+}
+
+func (m *mux) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.PathRemoveDirectory(ctx, fd, path)
+}
+
+func (m *mux) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.PathUnlinkFile(ctx, fd, path)
+}
+
+func (m *mux) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	return s.SockBind(ctx, fd, addr)
+}
+
+func (m *mux) SockConnect(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	return s.SockConnect(ctx, fd, addr)
+}
+
+func (m *mux) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.SockListen(ctx, fd, backlog)
+}
+
+func (m *mux) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, 0, errno
+	}
+	return s.SockRecv(ctx, fd, iovecs, flags)
+}
+
+func (m *mux) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.SockSend(ctx, fd, iovecs, flags)
+}
+
+func (m *mux) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	return s.SockSendTo(ctx, fd, iovecs, flags, addr)
+}
+
+func (m *mux) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return 0, 0, nil, errno
+	}
+	return s.SockRecvFrom(ctx, fd, iovecs, flags)
+}
+
+func (m *mux) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	return s.SockGetOpt(ctx, fd, option)
+}
+
+func (m *mux) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.SockSetOpt(ctx, fd, option, value)
+}
+
+func (m *mux) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	return s.SockLocalAddress(ctx, fd)
+}
+
+func (m *mux) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	return s.SockRemoteAddress(ctx, fd)
+}
+
+func (m *mux) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	s, fd, errno := m.lookupContext(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	return s.SockShutdown(ctx, fd, flags)
+}
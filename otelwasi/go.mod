@@ -0,0 +1,22 @@
+module github.com/stealthrocket/wasi-go/otelwasi
+
+go 1.20
+
+require (
+	github.com/stealthrocket/wasi-go v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.19.0
+	go.opentelemetry.io/otel/sdk v1.19.0
+	go.opentelemetry.io/otel/trace v1.19.0
+)
+
+require (
+	github.com/go-logr/logr v1.2.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/stealthrocket/wazergo v0.19.1 // indirect
+	github.com/tetratelabs/wazero v1.2.0 // indirect
+	go.opentelemetry.io/otel/metric v1.19.0 // indirect
+	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
+
+replace github.com/stealthrocket/wasi-go => ../
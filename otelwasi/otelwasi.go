@@ -0,0 +1,549 @@
+// Package otelwasi instruments WASI systems with OpenTelemetry, so that the
+// system calls made by guests show up in the distributed traces of the host
+// platform.
+package otelwasi
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/stealthrocket/wasi-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/stealthrocket/wasi-go/otelwasi"
+
+// Option configures the instrumentation.
+type Option func(*config)
+
+type config struct {
+	provider    trace.TracerProvider
+	propagators propagation.TextMapPropagator
+	filter      *wasi.TraceFilter
+}
+
+func newConfig(options []Option) *config {
+	c := &config{
+		provider:    otel.GetTracerProvider(),
+		propagators: otel.GetTextMapPropagator(),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// WithTracerProvider sets the provider of the tracer used to create spans.
+// The global provider is used by default.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) { c.provider = provider }
+}
+
+// WithPropagators sets the propagators used to inject the span context in
+// outgoing HTTP requests. The global propagators are used by default.
+func WithPropagators(propagators propagation.TextMapPropagator) Option {
+	return func(c *config) { c.propagators = propagators }
+}
+
+// WithFilter restricts the system calls which create spans to those matched
+// by the filter. It is common to exclude system calls like clock_time_get or
+// poll_oneoff, which would otherwise produce a lot of spans.
+func WithFilter(filter *wasi.TraceFilter) Option {
+	return func(c *config) { c.filter = filter }
+}
+
+// Instrument wraps a System to create a span for each system call.
+//
+// The spans are children of the span in the context passed to the methods
+// of the System, which for modules run by wazero is the context that the
+// exported function was called with. They are named after the WASI
+// function (e.g. "fd_read"), and carry the file descriptors and paths passed
+// to the system call, as well as the errno that it returned.
+func Instrument(s wasi.System, options ...Option) wasi.System {
+	c := newConfig(options)
+	return &system{
+		System: s,
+		tracer: c.provider.Tracer(instrumentationName),
+		filter: c.filter,
+	}
+}
+
+type system struct {
+	wasi.System
+	tracer trace.Tracer
+	filter *wasi.TraceFilter
+}
+
+func (s *system) start(ctx context.Context, syscall string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !s.filter.Match(syscall) {
+		return ctx, nil
+	}
+	return s.tracer.Start(ctx, syscall, trace.WithAttributes(attrs...))
+}
+
+func (s *system) end(span trace.Span, errno wasi.Errno) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(attribute.String("wasi.errno", errno.Name()))
+	if errno != wasi.ESUCCESS {
+		span.SetStatus(codes.Error, errno.Error())
+	}
+	span.End()
+}
+
+func (s *system) ArgsSizesGet(ctx context.Context) (int, int, wasi.Errno) {
+	ctx, span := s.start(ctx, "args_sizes_get")
+	argCount, stringBytes, errno := s.System.ArgsSizesGet(ctx)
+	s.end(span, errno)
+	return argCount, stringBytes, errno
+}
+
+func (s *system) ArgsGet(ctx context.Context) ([]string, wasi.Errno) {
+	ctx, span := s.start(ctx, "args_get")
+	args, errno := s.System.ArgsGet(ctx)
+	s.end(span, errno)
+	return args, errno
+}
+
+func (s *system) EnvironSizesGet(ctx context.Context) (int, int, wasi.Errno) {
+	ctx, span := s.start(ctx, "environ_sizes_get")
+	envCount, stringBytes, errno := s.System.EnvironSizesGet(ctx)
+	s.end(span, errno)
+	return envCount, stringBytes, errno
+}
+
+func (s *system) EnvironGet(ctx context.Context) ([]string, wasi.Errno) {
+	ctx, span := s.start(ctx, "environ_get")
+	environ, errno := s.System.EnvironGet(ctx)
+	s.end(span, errno)
+	return environ, errno
+}
+
+func (s *system) ClockResGet(ctx context.Context, id wasi.ClockID) (wasi.Timestamp, wasi.Errno) {
+	ctx, span := s.start(ctx, "clock_res_get")
+	precision, errno := s.System.ClockResGet(ctx, id)
+	s.end(span, errno)
+	return precision, errno
+}
+
+func (s *system) ClockTimeGet(ctx context.Context, id wasi.ClockID, precision wasi.Timestamp) (wasi.Timestamp, wasi.Errno) {
+	ctx, span := s.start(ctx, "clock_time_get")
+	timestamp, errno := s.System.ClockTimeGet(ctx, id, precision)
+	s.end(span, errno)
+	return timestamp, errno
+}
+
+func (s *system) FDAdvise(ctx context.Context, fd wasi.FD, offset, length wasi.FileSize, advice wasi.Advice) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_advise", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDAdvise(ctx, fd, offset, length, advice)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDAllocate(ctx context.Context, fd wasi.FD, offset, length wasi.FileSize) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_allocate", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDAllocate(ctx, fd, offset, length)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDClose(ctx context.Context, fd wasi.FD) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_close", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDClose(ctx, fd)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDDataSync(ctx context.Context, fd wasi.FD) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_datasync", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDDataSync(ctx, fd)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDStatGet(ctx context.Context, fd wasi.FD) (wasi.FDStat, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_fdstat_get", attribute.Int("wasi.fd", int(fd)))
+	fdstat, errno := s.System.FDStatGet(ctx, fd)
+	s.end(span, errno)
+	return fdstat, errno
+}
+
+func (s *system) FDStatSetFlags(ctx context.Context, fd wasi.FD, flags wasi.FDFlags) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_fdstat_set_flags", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDStatSetFlags(ctx, fd, flags)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDStatSetRights(ctx context.Context, fd wasi.FD, rightsBase, rightsInheriting wasi.Rights) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_fdstat_set_rights", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDFileStatGet(ctx context.Context, fd wasi.FD) (wasi.FileStat, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_filestat_get", attribute.Int("wasi.fd", int(fd)))
+	filestat, errno := s.System.FDFileStatGet(ctx, fd)
+	s.end(span, errno)
+	return filestat, errno
+}
+
+func (s *system) FDFileStatSetSize(ctx context.Context, fd wasi.FD, size wasi.FileSize) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_filestat_set_size", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDFileStatSetSize(ctx, fd, size)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDFileStatSetTimes(ctx context.Context, fd wasi.FD, accessTime, modifyTime wasi.Timestamp, flags wasi.FSTFlags) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_filestat_set_times", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDPread(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, offset wasi.FileSize) (wasi.Size, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_pread", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.FDPread(ctx, fd, iovecs, offset)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) FDPreStatGet(ctx context.Context, fd wasi.FD) (wasi.PreStat, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_prestat_get", attribute.Int("wasi.fd", int(fd)))
+	prestat, errno := s.System.FDPreStatGet(ctx, fd)
+	s.end(span, errno)
+	return prestat, errno
+}
+
+func (s *system) FDPreStatDirName(ctx context.Context, fd wasi.FD) (string, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_prestat_dir_name", attribute.Int("wasi.fd", int(fd)))
+	name, errno := s.System.FDPreStatDirName(ctx, fd)
+	s.end(span, errno)
+	return name, errno
+}
+
+func (s *system) FDPwrite(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, offset wasi.FileSize) (wasi.Size, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_pwrite", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.FDPwrite(ctx, fd, iovecs, offset)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) FDRead(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_read", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.FDRead(ctx, fd, iovecs)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) FDReadDir(ctx context.Context, fd wasi.FD, entries []wasi.DirEntry, cookie wasi.DirCookie, bufferSizeBytes int) (int, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_readdir", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) FDRenumber(ctx context.Context, from, to wasi.FD) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_renumber", attribute.Int("wasi.from", int(from)), attribute.Int("wasi.to", int(to)))
+	errno := s.System.FDRenumber(ctx, from, to)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDSeek(ctx context.Context, fd wasi.FD, offset wasi.FileDelta, whence wasi.Whence) (wasi.FileSize, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_seek", attribute.Int("wasi.fd", int(fd)))
+	result, errno := s.System.FDSeek(ctx, fd, offset, whence)
+	s.end(span, errno)
+	return result, errno
+}
+
+func (s *system) FDSync(ctx context.Context, fd wasi.FD) wasi.Errno {
+	ctx, span := s.start(ctx, "fd_sync", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.FDSync(ctx, fd)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) FDTell(ctx context.Context, fd wasi.FD) (wasi.FileSize, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_tell", attribute.Int("wasi.fd", int(fd)))
+	result, errno := s.System.FDTell(ctx, fd)
+	s.end(span, errno)
+	return result, errno
+}
+
+func (s *system) FDWrite(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	ctx, span := s.start(ctx, "fd_write", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.FDWrite(ctx, fd, iovecs)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) PathCreateDirectory(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	ctx, span := s.start(ctx, "path_create_directory", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	errno := s.System.PathCreateDirectory(ctx, fd, path)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PathFileStatGet(ctx context.Context, fd wasi.FD, lookupFlags wasi.LookupFlags, path string) (wasi.FileStat, wasi.Errno) {
+	ctx, span := s.start(ctx, "path_filestat_get", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	filestat, errno := s.System.PathFileStatGet(ctx, fd, lookupFlags, path)
+	s.end(span, errno)
+	return filestat, errno
+}
+
+func (s *system) PathFileStatSetTimes(ctx context.Context, fd wasi.FD, lookupFlags wasi.LookupFlags, path string, accessTime, modifyTime wasi.Timestamp, flags wasi.FSTFlags) wasi.Errno {
+	ctx, span := s.start(ctx, "path_filestat_set_times", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	errno := s.System.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PathLink(ctx context.Context, oldFD wasi.FD, oldFlags wasi.LookupFlags, oldPath string, newFD wasi.FD, newPath string) wasi.Errno {
+	ctx, span := s.start(ctx, "path_link", attribute.Int("wasi.old_fd", int(oldFD)), attribute.String("wasi.old_path", oldPath), attribute.Int("wasi.new_fd", int(newFD)), attribute.String("wasi.new_path", newPath))
+	errno := s.System.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PathOpen(ctx context.Context, fd wasi.FD, dirFlags wasi.LookupFlags, path string, openFlags wasi.OpenFlags, rightsBase, rightsInheriting wasi.Rights, fdFlags wasi.FDFlags) (wasi.FD, wasi.Errno) {
+	ctx, span := s.start(ctx, "path_open", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	newfd, errno := s.System.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	s.end(span, errno)
+	return newfd, errno
+}
+
+func (s *system) PathReadLink(ctx context.Context, fd wasi.FD, path string, buffer []byte) (int, wasi.Errno) {
+	ctx, span := s.start(ctx, "path_readlink", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	n, errno := s.System.PathReadLink(ctx, fd, path, buffer)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) PathRemoveDirectory(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	ctx, span := s.start(ctx, "path_remove_directory", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	errno := s.System.PathRemoveDirectory(ctx, fd, path)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PathRename(ctx context.Context, fd wasi.FD, oldPath string, newFD wasi.FD, newPath string) wasi.Errno {
+	ctx, span := s.start(ctx, "path_rename", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.old_path", oldPath), attribute.Int("wasi.new_fd", int(newFD)), attribute.String("wasi.new_path", newPath))
+	errno := s.System.PathRename(ctx, fd, oldPath, newFD, newPath)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PathSymlink(ctx context.Context, oldPath string, fd wasi.FD, newPath string) wasi.Errno {
+	ctx, span := s.start(ctx, "path_symlink", attribute.String("wasi.old_path", oldPath), attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.new_path", newPath))
+	errno := s.System.PathSymlink(ctx, oldPath, fd, newPath)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PathUnlinkFile(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	ctx, span := s.start(ctx, "path_unlink_file", attribute.Int("wasi.fd", int(fd)), attribute.String("wasi.path", path))
+	errno := s.System.PathUnlinkFile(ctx, fd, path)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) PollOneOff(ctx context.Context, subscriptions []wasi.Subscription, events []wasi.Event) (int, wasi.Errno) {
+	ctx, span := s.start(ctx, "poll_oneoff")
+	n, errno := s.System.PollOneOff(ctx, subscriptions, events)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) ProcExit(ctx context.Context, exitCode wasi.ExitCode) wasi.Errno {
+	_, span := s.start(ctx, "proc_exit", attribute.Int("wasi.exit_code", int(exitCode)))
+	// ProcExit is not expected to return, the span is ended before
+	// calling the underlying system.
+	s.end(span, wasi.ESUCCESS)
+	return s.System.ProcExit(ctx, exitCode)
+}
+
+func (s *system) ProcRaise(ctx context.Context, signal wasi.Signal) wasi.Errno {
+	ctx, span := s.start(ctx, "proc_raise")
+	errno := s.System.ProcRaise(ctx, signal)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) SchedYield(ctx context.Context) wasi.Errno {
+	ctx, span := s.start(ctx, "sched_yield")
+	errno := s.System.SchedYield(ctx)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) RandomGet(ctx context.Context, b []byte) wasi.Errno {
+	ctx, span := s.start(ctx, "random_get")
+	errno := s.System.RandomGet(ctx, b)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) SockAccept(ctx context.Context, fd wasi.FD, flags wasi.FDFlags) (wasi.FD, wasi.SocketAddress, wasi.SocketAddress, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_accept", attribute.Int("wasi.fd", int(fd)))
+	newfd, peer, addr, errno := s.System.SockAccept(ctx, fd, flags)
+	s.end(span, errno)
+	return newfd, peer, addr, errno
+}
+
+func (s *system) SockShutdown(ctx context.Context, fd wasi.FD, flags wasi.SDFlags) wasi.Errno {
+	ctx, span := s.start(ctx, "sock_shutdown", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.SockShutdown(ctx, fd, flags)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) SockRecv(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.RIFlags) (wasi.Size, wasi.ROFlags, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_recv", attribute.Int("wasi.fd", int(fd)))
+	n, oflags, errno := s.System.SockRecv(ctx, fd, iovecs, iflags)
+	s.end(span, errno)
+	return n, oflags, errno
+}
+
+func (s *system) SockSend(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.SIFlags) (wasi.Size, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_send", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.SockSend(ctx, fd, iovecs, iflags)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) SockOpen(ctx context.Context, pf wasi.ProtocolFamily, socketType wasi.SocketType, protocol wasi.Protocol, rightsBase, rightsInheriting wasi.Rights) (wasi.FD, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_open")
+	fd, errno := s.System.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	s.end(span, errno)
+	return fd, errno
+}
+
+func (s *system) SockBind(ctx context.Context, fd wasi.FD, addr wasi.SocketAddress) (wasi.SocketAddress, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_bind", attribute.Int("wasi.fd", int(fd)))
+	result, errno := s.System.SockBind(ctx, fd, addr)
+	s.end(span, errno)
+	return result, errno
+}
+
+func (s *system) SockConnect(ctx context.Context, fd wasi.FD, peer wasi.SocketAddress) (wasi.SocketAddress, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_connect", attribute.Int("wasi.fd", int(fd)))
+	addr, errno := s.System.SockConnect(ctx, fd, peer)
+	s.end(span, errno)
+	return addr, errno
+}
+
+func (s *system) SockListen(ctx context.Context, fd wasi.FD, backlog int) wasi.Errno {
+	ctx, span := s.start(ctx, "sock_listen", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.SockListen(ctx, fd, backlog)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) SockSendTo(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.SIFlags, addr wasi.SocketAddress) (wasi.Size, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_send_to", attribute.Int("wasi.fd", int(fd)))
+	n, errno := s.System.SockSendTo(ctx, fd, iovecs, iflags, addr)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) SockRecvFrom(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.RIFlags) (wasi.Size, wasi.ROFlags, wasi.SocketAddress, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_recv_from", attribute.Int("wasi.fd", int(fd)))
+	n, oflags, addr, errno := s.System.SockRecvFrom(ctx, fd, iovecs, iflags)
+	s.end(span, errno)
+	return n, oflags, addr, errno
+}
+
+func (s *system) SockGetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketOption) (wasi.SocketOptionValue, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_getsockopt", attribute.Int("wasi.fd", int(fd)))
+	value, errno := s.System.SockGetOpt(ctx, fd, option)
+	s.end(span, errno)
+	return value, errno
+}
+
+func (s *system) SockSetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketOption, value wasi.SocketOptionValue) wasi.Errno {
+	ctx, span := s.start(ctx, "sock_setsockopt", attribute.Int("wasi.fd", int(fd)))
+	errno := s.System.SockSetOpt(ctx, fd, option, value)
+	s.end(span, errno)
+	return errno
+}
+
+func (s *system) SockLocalAddress(ctx context.Context, fd wasi.FD) (wasi.SocketAddress, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_getlocaladdr", attribute.Int("wasi.fd", int(fd)))
+	addr, errno := s.System.SockLocalAddress(ctx, fd)
+	s.end(span, errno)
+	return addr, errno
+}
+
+func (s *system) SockRemoteAddress(ctx context.Context, fd wasi.FD) (wasi.SocketAddress, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_getpeeraddr", attribute.Int("wasi.fd", int(fd)))
+	addr, errno := s.System.SockRemoteAddress(ctx, fd)
+	s.end(span, errno)
+	return addr, errno
+}
+
+func (s *system) SockAddressInfo(ctx context.Context, name, service string, hints wasi.AddressInfo, results []wasi.AddressInfo) (int, wasi.Errno) {
+	ctx, span := s.start(ctx, "sock_getaddrinfo", attribute.String("wasi.name", name), attribute.String("wasi.service", service))
+	n, errno := s.System.SockAddressInfo(ctx, name, service, hints, results)
+	s.end(span, errno)
+	return n, errno
+}
+
+func (s *system) Close(ctx context.Context) error {
+	return s.System.Close(ctx)
+}
+
+// Transport wraps an http.RoundTripper to create a client span for each
+// request, and inject the span context in the request headers. It is
+// intended to instrument the HTTP requests made by guests through wasi-http
+// (see wasi_http.WithClient).
+func Transport(base http.RoundTripper, options ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c := newConfig(options)
+	return &transport{
+		base:        base,
+		tracer:      c.provider.Tracer(instrumentationName),
+		propagators: c.propagators,
+	}
+}
+
+type transport struct {
+	base        http.RoundTripper
+	tracer      trace.Tracer
+	propagators propagation.TextMapPropagator
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	t.propagators.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, res.Status)
+	}
+	return res, nil
+}
@@ -0,0 +1,182 @@
+package otelwasi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/otelwasi"
+	"github.com/stealthrocket/wasi-go/wasitest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(span.Attributes))
+	for _, attr := range span.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestInstrument(t *testing.T) {
+	provider, exporter := newProvider()
+
+	mock := wasitest.NewMockSystem(t)
+	mock.On("path_open").Return(wasi.ESUCCESS, wasi.FD(4))
+	mock.On("fd_write").Return(wasi.ESUCCESS, wasi.Size(5))
+	mock.On("fd_close").Return(wasi.EBADF)
+	mock.On("clock_time_get").Return(wasi.ESUCCESS, wasi.Timestamp(42))
+
+	filter, err := wasi.ParseTraceFilter("!clock_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := otelwasi.Instrument(mock, otelwasi.WithTracerProvider(provider), otelwasi.WithFilter(filter))
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	if fd, errno := s.PathOpen(ctx, 3, 0, "data.txt", wasi.OpenCreate, wasi.AllRights, wasi.AllRights, 0); errno != wasi.ESUCCESS || fd != 4 {
+		t.Fatalf("path_open: %d %s", fd, errno)
+	}
+	if n, errno := s.FDWrite(ctx, 4, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS || n != 5 {
+		t.Fatalf("fd_write: %d %s", n, errno)
+	}
+	if errno := s.FDClose(ctx, 5); errno != wasi.EBADF {
+		t.Fatalf("fd_close: wrong errno: %s", errno)
+	}
+	if _, errno := s.ClockTimeGet(ctx, wasi.Monotonic, 1); errno != wasi.ESUCCESS {
+		t.Fatalf("clock_time_get: %s", errno)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("wrong number of spans: want=4 got=%d", len(spans))
+	}
+
+	for i, test := range []struct {
+		name   string
+		attrs  map[attribute.Key]attribute.Value
+		status codes.Code
+	}{
+		{
+			name: "path_open",
+			attrs: map[attribute.Key]attribute.Value{
+				"wasi.fd":    attribute.IntValue(3),
+				"wasi.path":  attribute.StringValue("data.txt"),
+				"wasi.errno": attribute.StringValue("ESUCCESS"),
+			},
+			status: codes.Unset,
+		},
+		{
+			name: "fd_write",
+			attrs: map[attribute.Key]attribute.Value{
+				"wasi.fd":    attribute.IntValue(4),
+				"wasi.errno": attribute.StringValue("ESUCCESS"),
+			},
+			status: codes.Unset,
+		},
+		{
+			name: "fd_close",
+			attrs: map[attribute.Key]attribute.Value{
+				"wasi.fd":    attribute.IntValue(5),
+				"wasi.errno": attribute.StringValue("EBADF"),
+			},
+			status: codes.Error,
+		},
+	} {
+		span := spans[i]
+		if span.Name != test.name {
+			t.Errorf("span %d: wrong name: want=%s got=%s", i, test.name, span.Name)
+			continue
+		}
+		if attrs := attributes(span); !reflect.DeepEqual(attrs, test.attrs) {
+			t.Errorf("%s: wrong attributes:\nwant: %v\ngot:  %v", test.name, test.attrs, attrs)
+		}
+		if span.Status.Code != test.status {
+			t.Errorf("%s: wrong status: want=%s got=%s", test.name, test.status, span.Status.Code)
+		}
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s: the span is not a child of the span of the context", test.name)
+		}
+	}
+	// The spans of the system calls excluded by the filter are not created.
+	if name := spans[3].Name; name != "parent" {
+		t.Errorf("the span of a filtered system call was created: %s", name)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	provider, exporter := newProvider()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: otelwasi.Transport(nil,
+			otelwasi.WithTracerProvider(provider),
+			otelwasi.WithPropagators(propagation.TraceContext{}),
+		),
+	}
+
+	for _, test := range []struct {
+		path       string
+		statusCode int
+		status     codes.Code
+	}{
+		{"/", http.StatusOK, codes.Unset},
+		{"/error", http.StatusBadGateway, codes.Error},
+	} {
+		exporter.Reset()
+		traceparent = ""
+
+		res, err := client.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		spans := exporter.GetSpans()
+		if len(spans) != 1 {
+			t.Fatalf("%s: wrong number of spans: want=1 got=%d", test.path, len(spans))
+		}
+		span := spans[0]
+		if span.Name != "HTTP GET" || span.SpanKind != trace.SpanKindClient {
+			t.Errorf("%s: wrong span: %s (%s)", test.path, span.Name, span.SpanKind)
+		}
+		want := map[attribute.Key]attribute.Value{
+			"http.method":      attribute.StringValue("GET"),
+			"http.url":         attribute.StringValue(server.URL + test.path),
+			"http.status_code": attribute.IntValue(test.statusCode),
+		}
+		if attrs := attributes(span); !reflect.DeepEqual(attrs, want) {
+			t.Errorf("%s: wrong attributes:\nwant: %v\ngot:  %v", test.path, want, attrs)
+		}
+		if span.Status.Code != test.status {
+			t.Errorf("%s: wrong status: want=%s got=%s", test.path, test.status, span.Status.Code)
+		}
+		// The span context is propagated to the server.
+		wantTraceparent := "00-" + span.SpanContext.TraceID().String() + "-" + span.SpanContext.SpanID().String() + "-01"
+		if traceparent != wantTraceparent {
+			t.Errorf("%s: wrong traceparent header: want=%q got=%q", test.path, wantTraceparent, traceparent)
+		}
+	}
+}
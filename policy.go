@@ -0,0 +1,912 @@
+package wasi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Policy is a declarative description of the resources that a guest is
+// allowed to access, enforced by the System returned by Enforce.
+//
+// Each section of the policy restricts one class of resources. Sections that
+// are omitted (nil) leave the resources unrestricted, while empty sections
+// deny all access to them. For example, the following policy grants read
+// access to /data, read-write access to /data/out, HTTPS connections to the
+// hosts of example.com, and access to the HOME and LANG environment
+// variables:
+//
+//	{
+//	  "paths": [
+//	    {"path": "/data", "access": ["read"]},
+//	    {"path": "/data/out", "access": ["read", "write", "create", "delete"]}
+//	  ],
+//	  "network": [
+//	    {"address": "*.example.com:443", "access": ["connect"]}
+//	  ],
+//	  "env": ["HOME", "LANG"]
+//	}
+//
+// The policy restricts what the guest can do with the resources that the
+// system exposes to it: a path that is not in a preopened directory cannot
+// be granted by the policy.
+//
+// Deny rules take precedence over the paths granted by the policy, and over
+// the preopened directories when the policy has no paths section, which
+// withholds files from the guest without listing all the others (e.g. the
+// private keys of a home directory):
+//
+//	{"deny": ["**/.ssh", "*.key"]}
+type Policy struct {
+	// Paths are the paths of the guest file system that the guest is allowed
+	// to access.
+	Paths []PathRule `json:"paths" yaml:"paths"`
+	// Network are the network addresses that the guest is allowed to access.
+	Network []NetworkRule `json:"network" yaml:"network"`
+	// Env are the names of the environment variables exposed to the guest,
+	// which may be glob patterns (e.g. "AWS_*").
+	Env []string `json:"env" yaml:"env"`
+	// Deny are glob patterns of the paths that the guest is denied access
+	// to, with the syntax of path.Match extended with ** to match any number
+	// of directories. Patterns which are not absolute match at any depth
+	// (e.g. "*.key" matches /data/server.key), and denying a directory also
+	// denies access to the files beneath it.
+	Deny []string `json:"deny" yaml:"deny"`
+}
+
+// PathRule grants access to a path of the guest file system, and the files
+// and directories beneath it. When multiple rules match a path, the rule
+// with the longest path applies, which allows rules to restrict access to
+// parts of the directories granted by other rules.
+//
+// Paths are matched lexically: symbolic links existing in the directories
+// are followed by the system, the policy cannot restrict access to their
+// targets. The targets of the links created by the guest are checked when
+// the links are created: they must be relative, and granted the read and
+// write access of the links.
+type PathRule struct {
+	// Path is the absolute path in the guest file system.
+	Path string `json:"path" yaml:"path"`
+	// Access is the list of operations allowed on the path:
+	//
+	//   - read: open files for reading, list directories, read links, and
+	//     get the status of files
+	//   - write: open files for writing, truncate files, and change their
+	//     size or times
+	//   - create: create files, directories, and links
+	//   - delete: remove files and directories, and rename them
+	Access []string `json:"access" yaml:"access"`
+}
+
+// NetworkRule grants access to network addresses.
+type NetworkRule struct {
+	// Address is the pattern of addresses that the rule applies to, in the
+	// form HOST:PORT where HOST is one of:
+	//
+	//   - an IP address (e.g. 192.168.0.1 or [::1])
+	//   - a CIDR block (e.g. 10.0.0.0/8 or [fd00::/8])
+	//   - a host name, which may be a glob pattern (e.g. *.example.com);
+	//     the rule grants access to the addresses that sock_address_info
+	//     returned for names matching the pattern
+	//   - * to match all hosts
+	//
+	// PORT is a port number, a range of ports (e.g. 8000-8999), or * to
+	// match all ports. Unix sockets are matched with unix:PATH, where PATH
+	// may be a glob pattern with the syntax of Policy.Deny (e.g. unix:** to
+	// match all unix sockets).
+	Address string `json:"address" yaml:"address"`
+	// Access is the list of operations allowed on the addresses:
+	//
+	//   - connect: connect sockets, and send datagrams to the addresses
+	//   - listen: bind sockets to the addresses
+	Access []string `json:"access" yaml:"access"`
+}
+
+// AllowDials returns a copy of the policy which also allows connecting to the
+// addresses, with the syntax of NetworkRule.Address (e.g. 10.0.0.0/8:443 or
+// *.example.com:*).
+//
+// When the policy has no network section, the copy only restricts the
+// destinations of connections and datagrams: sockets may still be bound to
+// any address, so the guest can act as a server.
+func (p Policy) AllowDials(addresses ...string) Policy {
+	network := p.Network[:len(p.Network):len(p.Network)]
+	if network == nil {
+		network = []NetworkRule{
+			{Address: "*:*", Access: []string{"listen"}},
+			{Address: "unix:**", Access: []string{"listen"}},
+		}
+	}
+	for _, addr := range addresses {
+		network = append(network, NetworkRule{Address: addr, Access: []string{"connect"}})
+	}
+	p.Network = network
+	return p
+}
+
+// AllowsDial returns true if the policy allows connecting to address, in the
+// form host:port where host is either an IP address or a host name. Hosts
+// can use it to apply the policy to the connections that they make on behalf
+// of the guest (e.g. the requests of wasi-http).
+//
+// Host names are only matched against the host name patterns of the policy;
+// to match the rules granting access to IP addresses, the names must be
+// resolved and the addresses checked individually.
+func (p *Policy) AllowsDial(address string) bool {
+	c, err := compilePolicy(p)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	return c.allowsHostPort(host, portNum, connectAccess)
+}
+
+// ParsePolicy parses a policy from its JSON representation, and validates
+// it. Unknown fields are rejected, so misspelled sections do not silently
+// leave resources unrestricted.
+func ParsePolicy(data []byte) (*Policy, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	p := new(Policy)
+	if err := d.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if _, err := compilePolicy(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Enforce wraps a System to enforce policy on the system calls of the guest.
+// The calls denied by the policy fail with EPERM, and the environment
+// variables that the policy does not allow are hidden from the guest.
+//
+// Paths are matched as the system resolves them, with "/" as separator;
+// wrappers translating the paths of the guest (e.g. WindowsPaths) must wrap
+// the returned system, not the other way around.
+//
+// An error is returned if the policy is invalid.
+func Enforce(system System, policy *Policy) (System, error) {
+	p, err := compilePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	return &policyEnforcer{
+		System:   system,
+		policy:   p,
+		paths:    make(map[FD]string),
+		resolved: make(map[netip.Addr][]*networkRule),
+	}, nil
+}
+
+type policyAccess uint8
+
+const (
+	readAccess policyAccess = 1 << iota
+	writeAccess
+	createAccess
+	deleteAccess
+	connectAccess
+	listenAccess
+)
+
+func (a policyAccess) has(b policyAccess) bool { return (a & b) == b }
+
+func parseAccess(names []string, allowed map[string]policyAccess) (policyAccess, error) {
+	var a policyAccess
+	for _, name := range names {
+		b, ok := allowed[name]
+		if !ok {
+			return 0, fmt.Errorf("invalid access %q", name)
+		}
+		a |= b
+	}
+	return a, nil
+}
+
+var (
+	pathAccess = map[string]policyAccess{
+		"read":   readAccess,
+		"write":  writeAccess,
+		"create": createAccess,
+		"delete": deleteAccess,
+	}
+	networkAccess = map[string]policyAccess{
+		"connect": connectAccess,
+		"listen":  listenAccess,
+	}
+)
+
+type compiledPolicy struct {
+	paths   []pathRule // sorted by decreasing path length
+	network []*networkRule
+	env     []string
+	deny    [][]string // patterns split in path segments
+
+	restrictPaths   bool
+	restrictNetwork bool
+	restrictEnv     bool
+}
+
+type pathRule struct {
+	path   string
+	access policyAccess
+}
+
+type networkRule struct {
+	// Exactly one of prefix, name, or unix is set, or none of them if the
+	// rule matches all hosts.
+	prefix netip.Prefix
+	name   string
+	unix   string
+	ports  [2]int
+	access policyAccess
+}
+
+func compilePolicy(policy *Policy) (*compiledPolicy, error) {
+	p := &compiledPolicy{
+		env:             policy.Env,
+		restrictPaths:   policy.Paths != nil,
+		restrictNetwork: policy.Network != nil,
+		restrictEnv:     policy.Env != nil,
+	}
+
+	for _, r := range policy.Paths {
+		if !path.IsAbs(r.Path) {
+			return nil, fmt.Errorf("invalid policy: path %q is not absolute", r.Path)
+		}
+		access, err := parseAccess(r.Access, pathAccess)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy: path %q: %w", r.Path, err)
+		}
+		p.paths = append(p.paths, pathRule{path: path.Clean(r.Path), access: access})
+	}
+	sort.SliceStable(p.paths, func(i, j int) bool {
+		return len(p.paths[i].path) > len(p.paths[j].path)
+	})
+
+	for _, r := range policy.Network {
+		rule, err := parseNetworkRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy: address %q: %w", r.Address, err)
+		}
+		p.network = append(p.network, rule)
+	}
+
+	for _, name := range policy.Env {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("invalid policy: env %q: %w", name, err)
+		}
+	}
+
+	for _, pattern := range policy.Deny {
+		name := pattern
+		if !path.IsAbs(name) {
+			name = "/**/" + name
+		}
+		segments := strings.Split(path.Clean(name), "/")
+		for _, s := range segments {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("invalid policy: deny %q: %w", pattern, err)
+			}
+		}
+		p.deny = append(p.deny, segments)
+	}
+	return p, nil
+}
+
+func parseNetworkRule(r NetworkRule) (*networkRule, error) {
+	access, err := parseAccess(r.Access, networkAccess)
+	if err != nil {
+		return nil, err
+	}
+	rule := &networkRule{access: access}
+
+	if name, ok := strings.CutPrefix(r.Address, "unix:"); ok {
+		for _, s := range strings.Split(name, "/") {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, err
+			}
+		}
+		rule.unix = name
+		return rule, nil
+	}
+
+	host, port, err := net.SplitHostPort(r.Address)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case host == "*":
+	case strings.Contains(host, "/"):
+		if rule.prefix, err = netip.ParsePrefix(host); err != nil {
+			return nil, err
+		}
+		rule.prefix = rule.prefix.Masked()
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else if _, err := path.Match(host, ""); err != nil {
+			return nil, err
+		} else {
+			rule.name = strings.ToLower(host)
+		}
+	}
+
+	if port == "*" {
+		rule.ports = [2]int{0, 65535}
+	} else {
+		lo, hi, isRange := strings.Cut(port, "-")
+		if rule.ports[0], err = parsePort(lo); err != nil {
+			return nil, err
+		}
+		rule.ports[1] = rule.ports[0]
+		if isRange {
+			if rule.ports[1], err = parsePort(hi); err != nil {
+				return nil, err
+			}
+			if rule.ports[1] < rule.ports[0] {
+				return nil, fmt.Errorf("invalid port range %q", port)
+			}
+		}
+	}
+	return rule, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return int(port), nil
+}
+
+// checkPaths returns true if the policy restricts access to the file system.
+func (p *compiledPolicy) checkPaths() bool {
+	return p.restrictPaths || len(p.deny) > 0
+}
+
+// pathAccess returns the access granted to a path of the guest file system.
+func (p *compiledPolicy) pathAccess(name string) policyAccess {
+	if p.denied(name) {
+		return 0
+	}
+	if !p.restrictPaths {
+		return readAccess | writeAccess | createAccess | deleteAccess
+	}
+	for _, r := range p.paths {
+		if r.path == "/" || name == r.path || strings.HasPrefix(name, r.path+"/") {
+			return r.access
+		}
+	}
+	return 0
+}
+
+// denied returns true if a deny rule matches the path, or one of its parent
+// directories.
+func (p *compiledPolicy) denied(name string) bool {
+	if len(p.deny) == 0 {
+		return false
+	}
+	segments := strings.Split(name, "/")
+	for _, pattern := range p.deny {
+		for i := 2; i <= len(segments); i++ {
+			if matchSegments(pattern, segments[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSegments matches the segments of a path against those of a pattern,
+// where ** matches any number of segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func (p *compiledPolicy) allowsAddress(addr SocketAddress, access policyAccess, resolved []*networkRule) bool {
+	for _, r := range p.network {
+		if r.access.has(access) && r.match(addr, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHostPort returns true if the policy grants access to host:port,
+// where host is either an IP address or a host name.
+func (p *compiledPolicy) allowsHostPort(host string, port int, access policyAccess) bool {
+	if !p.restrictNetwork {
+		return true
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		var addr SocketAddress
+		if ip = ip.Unmap(); ip.Is4() {
+			addr = &Inet4Address{Addr: ip.As4(), Port: port}
+		} else {
+			addr = &Inet6Address{Addr: ip.As16(), Port: port}
+		}
+		return p.allowsAddress(addr, access, nil)
+	}
+	host = strings.ToLower(host)
+	for _, r := range p.network {
+		if r.access.has(access) && r.matchName(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *compiledPolicy) envAllowed(name string) bool {
+	for _, pattern := range p.env {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns true if the rule matches the address; resolved are the name
+// rules that the address was resolved from.
+func (r *networkRule) match(addr SocketAddress, resolved []*networkRule) bool {
+	var ip netip.Addr
+	var port int
+	switch a := addr.(type) {
+	case *Inet4Address:
+		ip, port = netip.AddrFrom4(a.Addr), a.Port
+	case *Inet6Address:
+		ip, port = netip.AddrFrom16(a.Addr).Unmap(), a.Port
+	case *UnixAddress:
+		if r.unix == "" {
+			return false
+		}
+		return matchSegments(strings.Split(r.unix, "/"), strings.Split(a.Name, "/"))
+	default:
+		return false
+	}
+	if r.unix != "" || port < r.ports[0] || port > r.ports[1] {
+		return false
+	}
+	switch {
+	case r.prefix.IsValid():
+		return r.prefix.Contains(ip)
+	case r.name != "":
+		for _, rule := range resolved {
+			if rule == r {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// matchName returns true if the rule matches a host name and port.
+func (r *networkRule) matchName(host string, port int) bool {
+	if r.unix != "" || r.prefix.IsValid() || port < r.ports[0] || port > r.ports[1] {
+		return false
+	}
+	if r.name == "" {
+		return true
+	}
+	ok, _ := path.Match(r.name, host)
+	return ok
+}
+
+type policyEnforcer struct {
+	System
+	policy *compiledPolicy
+
+	mutex sync.Mutex
+	// paths are the guest paths of the directories and files opened by the
+	// guest, and of the preopens that it used.
+	paths map[FD]string
+	// resolved are the name rules matching the names that the addresses
+	// were resolved from.
+	resolved map[netip.Addr][]*networkRule
+}
+
+// fdPath returns the guest path of a file descriptor.
+func (p *policyEnforcer) fdPath(ctx context.Context, fd FD) (string, Errno) {
+	p.mutex.Lock()
+	name, ok := p.paths[fd]
+	p.mutex.Unlock()
+	if ok {
+		return name, ESUCCESS
+	}
+	// The file descriptors that the guest did not open through the wrapper
+	// are either preopens, or not directories.
+	name, errno := p.System.FDPreStatDirName(ctx, fd)
+	if errno != ESUCCESS {
+		stat, errno := p.System.FDStatGet(ctx, fd)
+		if errno != ESUCCESS {
+			return "", errno
+		}
+		if stat.FileType != DirectoryType {
+			return "", ENOTDIR
+		}
+		return "", EPERM
+	}
+	name = path.Join("/", name)
+	p.mutex.Lock()
+	p.paths[fd] = name
+	p.mutex.Unlock()
+	return name, ESUCCESS
+}
+
+// check returns ESUCCESS if the policy grants access to the path relative to
+// the directory fd.
+func (p *policyEnforcer) check(ctx context.Context, fd FD, name string, access policyAccess) Errno {
+	if !p.policy.checkPaths() {
+		return ESUCCESS
+	}
+	dir, errno := p.fdPath(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	if !p.policy.pathAccess(path.Join(dir, name)).has(access) {
+		return EPERM
+	}
+	return ESUCCESS
+}
+
+func (p *policyEnforcer) checkAddress(addr SocketAddress, access policyAccess) Errno {
+	if !p.policy.restrictNetwork {
+		return ESUCCESS
+	}
+	var resolved []*networkRule
+	if ip, ok := socketAddressIP(addr); ok {
+		p.mutex.Lock()
+		resolved = p.resolved[ip]
+		p.mutex.Unlock()
+	}
+	if !p.policy.allowsAddress(addr, access, resolved) {
+		return EPERM
+	}
+	return ESUCCESS
+}
+
+// checkSocketURI checks the addresses that path_open connects or binds
+// sockets to with the unix.PathOpenSockets extension, in the form
+// <network>+<dial|listen>://<host>:<port>.
+func (p *policyEnforcer) checkSocketURI(uri string) Errno {
+	if !p.policy.restrictNetwork {
+		return ESUCCESS
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ESUCCESS
+	}
+	access := connectAccess
+	network, op, _ := strings.Cut(u.Scheme, "+")
+	switch op {
+	case "dial":
+	case "listen":
+		access = listenAccess
+	default:
+		return ESUCCESS
+	}
+	if network == "unix" {
+		if !p.policy.allowsAddress(&UnixAddress{Name: u.Path}, access, nil) {
+			return EPERM
+		}
+		return ESUCCESS
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || !p.policy.allowsHostPort(u.Hostname(), port, access) {
+		return EPERM
+	}
+	return ESUCCESS
+}
+
+func socketAddressIP(addr SocketAddress) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *Inet4Address:
+		return netip.AddrFrom4(a.Addr), true
+	case *Inet6Address:
+		return netip.AddrFrom16(a.Addr).Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+func (p *policyEnforcer) environ(ctx context.Context) ([]string, Errno) {
+	environ, errno := p.System.EnvironGet(ctx)
+	if errno != ESUCCESS || !p.policy.restrictEnv {
+		return environ, errno
+	}
+	allowed := make([]string, 0, len(environ))
+	for _, env := range environ {
+		name, _, _ := strings.Cut(env, "=")
+		if p.policy.envAllowed(name) {
+			allowed = append(allowed, env)
+		}
+	}
+	return allowed, ESUCCESS
+}
+
+func (p *policyEnforcer) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	environ, errno := p.environ(ctx)
+	if errno != ESUCCESS {
+		return 0, 0, errno
+	}
+	envCount, stringBytes := SizesGet(environ)
+	return envCount, stringBytes, ESUCCESS
+}
+
+func (p *policyEnforcer) EnvironGet(ctx context.Context) ([]string, Errno) {
+	return p.environ(ctx)
+}
+
+const (
+	policyReadRights  = FDReadRight | FDReadDirRight
+	policyWriteRights = FDWriteRight | FDAllocateRight | FDFileStatSetSizeRight | FDFileStatSetTimesRight
+)
+
+func (p *policyEnforcer) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, name string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	if fd < 0 {
+		// Negative file descriptors are not directories, but path_open may
+		// be used to open sockets (see unix.PathOpenSockets).
+		if errno := p.checkSocketURI(name); errno != ESUCCESS {
+			return -1, errno
+		}
+		return p.System.PathOpen(ctx, fd, dirFlags, name, openFlags, rightsBase, rightsInheriting, fdFlags)
+	}
+	var newPath string
+	if p.policy.checkPaths() {
+		dir, errno := p.fdPath(ctx, fd)
+		if errno != ESUCCESS {
+			return -1, errno
+		}
+		newPath = path.Join(dir, name)
+		access := p.policy.pathAccess(newPath)
+		switch {
+		case access == 0:
+			return -1, EPERM
+		case openFlags.Has(OpenCreate) && !access.has(createAccess):
+			return -1, EPERM
+		case openFlags.Has(OpenTruncate) && !access.has(writeAccess):
+			return -1, EPERM
+		}
+		// Guests commonly request more rights than they use, the rights
+		// that the policy does not grant are removed rather than failing
+		// the call, so the file descriptor is only denied the operations
+		// that the guest attempts.
+		if !access.has(readAccess) {
+			rightsBase &^= policyReadRights
+		}
+		if !access.has(writeAccess) {
+			rightsBase &^= policyWriteRights
+		}
+	}
+	newfd, errno := p.System.PathOpen(ctx, fd, dirFlags, name, openFlags, rightsBase, rightsInheriting, fdFlags)
+	if errno == ESUCCESS && p.policy.checkPaths() {
+		p.mutex.Lock()
+		p.paths[newfd] = newPath
+		p.mutex.Unlock()
+	}
+	return newfd, errno
+}
+
+func (p *policyEnforcer) FDClose(ctx context.Context, fd FD) Errno {
+	errno := p.System.FDClose(ctx, fd)
+	if errno == ESUCCESS {
+		p.mutex.Lock()
+		delete(p.paths, fd)
+		p.mutex.Unlock()
+	}
+	return errno
+}
+
+func (p *policyEnforcer) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := p.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS && from != to {
+		p.mutex.Lock()
+		if name, ok := p.paths[from]; ok {
+			p.paths[to] = name
+		} else {
+			delete(p.paths, to)
+		}
+		delete(p.paths, from)
+		p.mutex.Unlock()
+	}
+	return errno
+}
+
+func (p *policyEnforcer) PathCreateDirectory(ctx context.Context, fd FD, name string) Errno {
+	if errno := p.check(ctx, fd, name, createAccess); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathCreateDirectory(ctx, fd, name)
+}
+
+func (p *policyEnforcer) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, name string) (FileStat, Errno) {
+	if errno := p.check(ctx, fd, name, readAccess); errno != ESUCCESS {
+		return FileStat{}, errno
+	}
+	return p.System.PathFileStatGet(ctx, fd, lookupFlags, name)
+}
+
+func (p *policyEnforcer) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, name string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	if errno := p.check(ctx, fd, name, writeAccess); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathFileStatSetTimes(ctx, fd, lookupFlags, name, accessTime, modifyTime, flags)
+}
+
+func (p *policyEnforcer) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	if errno := p.check(ctx, oldFD, oldPath, readAccess); errno != ESUCCESS {
+		return errno
+	}
+	if errno := p.check(ctx, newFD, newPath, createAccess); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+}
+
+func (p *policyEnforcer) PathReadLink(ctx context.Context, fd FD, name string, buffer []byte) (int, Errno) {
+	if errno := p.check(ctx, fd, name, readAccess); errno != ESUCCESS {
+		return 0, errno
+	}
+	return p.System.PathReadLink(ctx, fd, name, buffer)
+}
+
+func (p *policyEnforcer) PathRemoveDirectory(ctx context.Context, fd FD, name string) Errno {
+	if errno := p.check(ctx, fd, name, deleteAccess); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathRemoveDirectory(ctx, fd, name)
+}
+
+func (p *policyEnforcer) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	if errno := p.check(ctx, fd, oldPath, deleteAccess); errno != ESUCCESS {
+		return errno
+	}
+	if errno := p.check(ctx, newFD, newPath, createAccess); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathRename(ctx, fd, oldPath, newFD, newPath)
+}
+
+func (p *policyEnforcer) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	if errno := p.check(ctx, fd, newPath, createAccess); errno != ESUCCESS {
+		return errno
+	}
+	if errno := p.checkSymlinkTarget(ctx, oldPath, fd, newPath); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathSymlink(ctx, oldPath, fd, newPath)
+}
+
+// checkSymlinkTarget returns ESUCCESS if the policy grants access to the
+// target of a symbolic link created by the guest, which would otherwise let
+// the guest open files that the policy denies by following the link. The
+// target must be granted at least the read and write access that the link
+// would give.
+func (p *policyEnforcer) checkSymlinkTarget(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	if !p.policy.checkPaths() {
+		return ESUCCESS
+	}
+	// Absolute targets are resolved by the host, outside of the guest file
+	// system that the policy applies to.
+	if path.IsAbs(oldPath) {
+		return EPERM
+	}
+	dir, errno := p.fdPath(ctx, fd)
+	if errno != ESUCCESS {
+		return errno
+	}
+	link := path.Join(dir, newPath)
+	target := path.Join(path.Dir(link), oldPath)
+	access := p.policy.pathAccess(target)
+	if access == 0 || !access.has(p.policy.pathAccess(link)&(readAccess|writeAccess)) {
+		return EPERM
+	}
+	return ESUCCESS
+}
+
+func (p *policyEnforcer) PathUnlinkFile(ctx context.Context, fd FD, name string) Errno {
+	if errno := p.check(ctx, fd, name, deleteAccess); errno != ESUCCESS {
+		return errno
+	}
+	return p.System.PathUnlinkFile(ctx, fd, name)
+}
+
+func (p *policyEnforcer) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	if errno := p.checkAddress(addr, listenAccess); errno != ESUCCESS {
+		return nil, errno
+	}
+	return p.System.SockBind(ctx, fd, addr)
+}
+
+func (p *policyEnforcer) SockConnect(ctx context.Context, fd FD, peer SocketAddress) (SocketAddress, Errno) {
+	if errno := p.checkAddress(peer, connectAccess); errno != ESUCCESS {
+		return nil, errno
+	}
+	return p.System.SockConnect(ctx, fd, peer)
+}
+
+func (p *policyEnforcer) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	if errno := p.checkAddress(addr, connectAccess); errno != ESUCCESS {
+		return 0, errno
+	}
+	return p.System.SockSendTo(ctx, fd, iovecs, flags, addr)
+}
+
+func (p *policyEnforcer) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	n, errno := p.System.SockAddressInfo(ctx, name, service, hints, results)
+	if errno != ESUCCESS || !p.policy.restrictNetwork {
+		return n, errno
+	}
+	// Remember the name rules matching the name, so the guest can connect
+	// to the addresses that the name resolved to.
+	var rules []*networkRule
+	for _, r := range p.policy.network {
+		if r.name != "" {
+			if ok, _ := path.Match(r.name, strings.ToLower(name)); ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	if len(rules) > 0 {
+		p.mutex.Lock()
+		for _, res := range results[:n] {
+			if ip, ok := socketAddressIP(res.Address); ok {
+				p.resolved[ip] = appendRules(p.resolved[ip], rules)
+			}
+		}
+		p.mutex.Unlock()
+	}
+	return n, errno
+}
+
+func appendRules(rules, add []*networkRule) []*networkRule {
+	for _, r := range add {
+		found := false
+		for _, s := range rules {
+			if s == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
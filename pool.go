@@ -0,0 +1,161 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// Pool is a set of systems created ahead of time, which hosts running many
+// short-lived guests (e.g. one per request) can lease systems from instead
+// of creating them on the critical path of each invocation.
+//
+// Without a Reset function, systems returned to the pool are closed, and a
+// replacement is created in the background when a system is taken from the
+// pool. With a Reset function, the systems returned to the pool are reused,
+// and replacements are only created for systems that could not be reset.
+//
+// Only systems are pooled, not the module instances running on them: the
+// memory of a module instance retains the state of the guest, which must not
+// leak from one tenant to the next.
+//
+// A Pool is safe for concurrent use by multiple goroutines.
+type Pool struct {
+	// New creates the systems of the pool.
+	New func(ctx context.Context) (System, error)
+
+	// Reset is an optional function called when a system is returned to the
+	// pool, to clear the state left by the guest (e.g. close the files that
+	// it opened). The system is reused if Reset returns nil, otherwise it is
+	// closed.
+	Reset func(ctx context.Context, system System) error
+
+	// Size is the number of idle systems that the pool keeps ready. Defaults
+	// to runtime.GOMAXPROCS(0).
+	Size int
+
+	mutex   sync.Mutex
+	idle    []System
+	pending int
+	leased  int
+	closed  bool
+	creates sync.WaitGroup
+}
+
+// Get takes a system from the pool, or creates one with New if there are no
+// idle systems. The system is returned to the pool by calling Put.
+func (p *Pool) Get(ctx context.Context) (System, error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, errors.New("wasi: get from closed pool")
+	}
+	var s System
+	if n := len(p.idle); n > 0 {
+		s = p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+	}
+	p.leased++
+	p.fill()
+	p.mutex.Unlock()
+
+	if s != nil {
+		return s, nil
+	}
+	return p.New(ctx)
+}
+
+// Fill starts creating systems in the background until the pool has Size
+// idle systems. Hosts can call Fill when they start, so the first calls to
+// Get do not have to create systems.
+func (p *Pool) Fill() {
+	p.mutex.Lock()
+	if !p.closed {
+		p.fill()
+	}
+	p.mutex.Unlock()
+}
+
+// Put returns a system obtained from Get to the pool.
+func (p *Pool) Put(ctx context.Context, system System) {
+	reset := p.Reset != nil && p.Reset(ctx, system) == nil
+
+	p.mutex.Lock()
+	p.leased--
+	reused := reset && !p.closed && len(p.idle)+p.pending < p.size()
+	if reused {
+		p.idle = append(p.idle, system)
+	} else if !p.closed {
+		p.fill()
+	}
+	p.mutex.Unlock()
+
+	if !reused {
+		system.Close(ctx)
+	}
+}
+
+// Close closes the idle systems of the pool, and the systems created in the
+// background after they are ready. Systems leased from the pool are not
+// closed.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mutex.Unlock()
+
+	p.creates.Wait()
+
+	errs := make([]error, len(idle))
+	for i, s := range idle {
+		errs[i] = s.Close(ctx)
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool) size() int {
+	if p.Size > 0 {
+		return p.Size
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// fill starts the creation of systems in the background to bring the number
+// of idle systems up to the size of the pool, counting the leased systems
+// which will be returned if they can be reset. The mutex must be held.
+func (p *Pool) fill() {
+	n := p.size() - len(p.idle) - p.pending
+	if p.Reset != nil {
+		n -= p.leased
+	}
+	if n <= 0 {
+		return
+	}
+	p.pending += n
+	p.creates.Add(n)
+	for i := 0; i < n; i++ {
+		go p.create()
+	}
+}
+
+func (p *Pool) create() {
+	defer p.creates.Done()
+	// The systems outlive the call which triggered their creation, they
+	// cannot be bound to its context.
+	ctx := context.Background()
+	s, err := p.New(ctx)
+
+	p.mutex.Lock()
+	p.pending--
+	closed := p.closed
+	if err == nil && !closed {
+		p.idle = append(p.idle, s)
+	}
+	p.mutex.Unlock()
+
+	if err == nil && closed {
+		s.Close(ctx)
+	}
+}
@@ -0,0 +1,44 @@
+package wasi
+
+import "context"
+
+// ProcessID identifies the child processes spawned by a guest.
+type ProcessID uint32
+
+// WaitFlags are flags of ProcWait.
+type WaitFlags uint32
+
+const (
+	// WaitNoHang makes ProcWait return EAGAIN instead of blocking when the
+	// child process has not exited yet.
+	WaitNoHang WaitFlags = 1 << iota
+)
+
+// Has is true if the flag is set.
+func (flags WaitFlags) Has(f WaitFlags) bool {
+	return (flags & f) == f
+}
+
+// Processes is implemented by systems which let guests spawn child processes.
+//
+// The stdio of a child process is connected to pipes registered in the file
+// table of the guest: the guest writes to the stdin of the child and reads
+// from its stdout and stderr. Which programs guests can spawn is a decision
+// of the host (e.g. an allowlist of commands).
+type Processes interface {
+	// ProcSpawn spawns a child process running the program named by the
+	// first argument, returning the identifier of the process and the file
+	// descriptors of its stdin, stdout, and stderr, in this order.
+	//
+	// It returns EACCES if the guest is not allowed to run the program.
+	ProcSpawn(ctx context.Context, args []string) (ProcessID, [3]FD, Errno)
+
+	// ProcWait waits for a child process to exit and returns its exit code,
+	// after which the process identifier is released. Processes terminated
+	// by signals exit with 128 plus the number of the signal, as reported
+	// by shells (see Signal.ExitCode).
+	ProcWait(ctx context.Context, pid ProcessID, flags WaitFlags) (ExitCode, Errno)
+
+	// ProcKill sends a signal to a child process.
+	ProcKill(ctx context.Context, pid ProcessID, signal Signal) Errno
+}
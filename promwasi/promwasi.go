@@ -0,0 +1,526 @@
+// Package promwasi exposes Prometheus metrics about the system calls made by
+// guests to WASI systems.
+package promwasi
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stealthrocket/wasi-go"
+)
+
+// Metrics is a set of Prometheus collectors tracking system call activity.
+//
+// The same Metrics can instrument multiple systems, in which case the
+// values are aggregated across all of them.
+type Metrics struct {
+	syscalls     *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+	latency      *prometheus.HistogramVec
+	readBytes    prometheus.Counter
+	writtenBytes prometheus.Counter
+	openFDs      prometheus.Gauge
+}
+
+// NewMetrics creates the collectors and registers them against registerer.
+//
+// The following metrics are exposed:
+//
+//   - wasi_syscalls_total: number of system calls, by syscall
+//   - wasi_syscall_errors_total: number of system calls which returned an
+//     error, by syscall and errno
+//   - wasi_syscall_duration_seconds: latency of system calls, by syscall
+//   - wasi_read_bytes_total: bytes read from files and sockets
+//   - wasi_written_bytes_total: bytes written to files and sockets
+//   - wasi_open_fds: number of file descriptors opened by guests and not
+//     yet closed (preopens are not included)
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		syscalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wasi",
+			Name:      "syscalls_total",
+			Help:      "Number of WASI system calls.",
+		}, []string{"syscall"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wasi",
+			Name:      "syscall_errors_total",
+			Help:      "Number of WASI system calls which returned an error.",
+		}, []string{"syscall", "errno"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "wasi",
+			Name:      "syscall_duration_seconds",
+			Help:      "Latency of WASI system calls.",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 12),
+		}, []string{"syscall"}),
+		readBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "wasi",
+			Name:      "read_bytes_total",
+			Help:      "Number of bytes read from files and sockets.",
+		}),
+		writtenBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "wasi",
+			Name:      "written_bytes_total",
+			Help:      "Number of bytes written to files and sockets.",
+		}),
+		openFDs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "wasi",
+			Name:      "open_fds",
+			Help:      "Number of file descriptors opened by guests.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{
+		m.syscalls,
+		m.errors,
+		m.latency,
+		m.readBytes,
+		m.writtenBytes,
+		m.openFDs,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Instrument wraps a System to record the metrics of its system calls.
+func (m *Metrics) Instrument(s wasi.System) wasi.System {
+	return &system{System: s, metrics: m}
+}
+
+type system struct {
+	wasi.System
+	metrics *Metrics
+}
+
+func (s *system) observe(syscall string, start time.Time, errno wasi.Errno) {
+	s.metrics.syscalls.WithLabelValues(syscall).Inc()
+	s.metrics.latency.WithLabelValues(syscall).Observe(time.Since(start).Seconds())
+	if errno != wasi.ESUCCESS {
+		s.metrics.errors.WithLabelValues(syscall, errno.Name()).Inc()
+	}
+}
+
+func (s *system) ArgsSizesGet(ctx context.Context) (int, int, wasi.Errno) {
+	start := time.Now()
+	argCount, stringBytes, errno := s.System.ArgsSizesGet(ctx)
+	s.observe("args_sizes_get", start, errno)
+	return argCount, stringBytes, errno
+}
+
+func (s *system) ArgsGet(ctx context.Context) ([]string, wasi.Errno) {
+	start := time.Now()
+	args, errno := s.System.ArgsGet(ctx)
+	s.observe("args_get", start, errno)
+	return args, errno
+}
+
+func (s *system) EnvironSizesGet(ctx context.Context) (int, int, wasi.Errno) {
+	start := time.Now()
+	envCount, stringBytes, errno := s.System.EnvironSizesGet(ctx)
+	s.observe("environ_sizes_get", start, errno)
+	return envCount, stringBytes, errno
+}
+
+func (s *system) EnvironGet(ctx context.Context) ([]string, wasi.Errno) {
+	start := time.Now()
+	environ, errno := s.System.EnvironGet(ctx)
+	s.observe("environ_get", start, errno)
+	return environ, errno
+}
+
+func (s *system) ClockResGet(ctx context.Context, id wasi.ClockID) (wasi.Timestamp, wasi.Errno) {
+	start := time.Now()
+	precision, errno := s.System.ClockResGet(ctx, id)
+	s.observe("clock_res_get", start, errno)
+	return precision, errno
+}
+
+func (s *system) ClockTimeGet(ctx context.Context, id wasi.ClockID, precision wasi.Timestamp) (wasi.Timestamp, wasi.Errno) {
+	start := time.Now()
+	timestamp, errno := s.System.ClockTimeGet(ctx, id, precision)
+	s.observe("clock_time_get", start, errno)
+	return timestamp, errno
+}
+
+func (s *system) FDAdvise(ctx context.Context, fd wasi.FD, offset, length wasi.FileSize, advice wasi.Advice) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDAdvise(ctx, fd, offset, length, advice)
+	s.observe("fd_advise", start, errno)
+	return errno
+}
+
+func (s *system) FDAllocate(ctx context.Context, fd wasi.FD, offset, length wasi.FileSize) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDAllocate(ctx, fd, offset, length)
+	s.observe("fd_allocate", start, errno)
+	return errno
+}
+
+func (s *system) FDClose(ctx context.Context, fd wasi.FD) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDClose(ctx, fd)
+	s.observe("fd_close", start, errno)
+	if errno == wasi.ESUCCESS {
+		s.metrics.openFDs.Dec()
+	}
+	return errno
+}
+
+func (s *system) FDDataSync(ctx context.Context, fd wasi.FD) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDDataSync(ctx, fd)
+	s.observe("fd_datasync", start, errno)
+	return errno
+}
+
+func (s *system) FDStatGet(ctx context.Context, fd wasi.FD) (wasi.FDStat, wasi.Errno) {
+	start := time.Now()
+	fdstat, errno := s.System.FDStatGet(ctx, fd)
+	s.observe("fd_fdstat_get", start, errno)
+	return fdstat, errno
+}
+
+func (s *system) FDStatSetFlags(ctx context.Context, fd wasi.FD, flags wasi.FDFlags) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDStatSetFlags(ctx, fd, flags)
+	s.observe("fd_fdstat_set_flags", start, errno)
+	return errno
+}
+
+func (s *system) FDStatSetRights(ctx context.Context, fd wasi.FD, rightsBase, rightsInheriting wasi.Rights) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	s.observe("fd_fdstat_set_rights", start, errno)
+	return errno
+}
+
+func (s *system) FDFileStatGet(ctx context.Context, fd wasi.FD) (wasi.FileStat, wasi.Errno) {
+	start := time.Now()
+	filestat, errno := s.System.FDFileStatGet(ctx, fd)
+	s.observe("fd_filestat_get", start, errno)
+	return filestat, errno
+}
+
+func (s *system) FDFileStatSetSize(ctx context.Context, fd wasi.FD, size wasi.FileSize) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDFileStatSetSize(ctx, fd, size)
+	s.observe("fd_filestat_set_size", start, errno)
+	return errno
+}
+
+func (s *system) FDFileStatSetTimes(ctx context.Context, fd wasi.FD, accessTime, modifyTime wasi.Timestamp, flags wasi.FSTFlags) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	s.observe("fd_filestat_set_times", start, errno)
+	return errno
+}
+
+func (s *system) FDPread(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, offset wasi.FileSize) (wasi.Size, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.FDPread(ctx, fd, iovecs, offset)
+	s.observe("fd_pread", start, errno)
+	s.metrics.readBytes.Add(float64(n))
+	return n, errno
+}
+
+func (s *system) FDPreStatGet(ctx context.Context, fd wasi.FD) (wasi.PreStat, wasi.Errno) {
+	start := time.Now()
+	prestat, errno := s.System.FDPreStatGet(ctx, fd)
+	s.observe("fd_prestat_get", start, errno)
+	return prestat, errno
+}
+
+func (s *system) FDPreStatDirName(ctx context.Context, fd wasi.FD) (string, wasi.Errno) {
+	start := time.Now()
+	name, errno := s.System.FDPreStatDirName(ctx, fd)
+	s.observe("fd_prestat_dir_name", start, errno)
+	return name, errno
+}
+
+func (s *system) FDPwrite(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, offset wasi.FileSize) (wasi.Size, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.FDPwrite(ctx, fd, iovecs, offset)
+	s.observe("fd_pwrite", start, errno)
+	s.metrics.writtenBytes.Add(float64(n))
+	return n, errno
+}
+
+func (s *system) FDRead(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.FDRead(ctx, fd, iovecs)
+	s.observe("fd_read", start, errno)
+	s.metrics.readBytes.Add(float64(n))
+	return n, errno
+}
+
+func (s *system) FDReadDir(ctx context.Context, fd wasi.FD, entries []wasi.DirEntry, cookie wasi.DirCookie, bufferSizeBytes int) (int, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	s.observe("fd_readdir", start, errno)
+	return n, errno
+}
+
+func (s *system) FDRenumber(ctx context.Context, from, to wasi.FD) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDRenumber(ctx, from, to)
+	s.observe("fd_renumber", start, errno)
+	return errno
+}
+
+func (s *system) FDSeek(ctx context.Context, fd wasi.FD, offset wasi.FileDelta, whence wasi.Whence) (wasi.FileSize, wasi.Errno) {
+	start := time.Now()
+	result, errno := s.System.FDSeek(ctx, fd, offset, whence)
+	s.observe("fd_seek", start, errno)
+	return result, errno
+}
+
+func (s *system) FDSync(ctx context.Context, fd wasi.FD) wasi.Errno {
+	start := time.Now()
+	errno := s.System.FDSync(ctx, fd)
+	s.observe("fd_sync", start, errno)
+	return errno
+}
+
+func (s *system) FDTell(ctx context.Context, fd wasi.FD) (wasi.FileSize, wasi.Errno) {
+	start := time.Now()
+	result, errno := s.System.FDTell(ctx, fd)
+	s.observe("fd_tell", start, errno)
+	return result, errno
+}
+
+func (s *system) FDWrite(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.FDWrite(ctx, fd, iovecs)
+	s.observe("fd_write", start, errno)
+	s.metrics.writtenBytes.Add(float64(n))
+	return n, errno
+}
+
+func (s *system) PathCreateDirectory(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathCreateDirectory(ctx, fd, path)
+	s.observe("path_create_directory", start, errno)
+	return errno
+}
+
+func (s *system) PathFileStatGet(ctx context.Context, fd wasi.FD, lookupFlags wasi.LookupFlags, path string) (wasi.FileStat, wasi.Errno) {
+	start := time.Now()
+	filestat, errno := s.System.PathFileStatGet(ctx, fd, lookupFlags, path)
+	s.observe("path_filestat_get", start, errno)
+	return filestat, errno
+}
+
+func (s *system) PathFileStatSetTimes(ctx context.Context, fd wasi.FD, lookupFlags wasi.LookupFlags, path string, accessTime, modifyTime wasi.Timestamp, flags wasi.FSTFlags) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	s.observe("path_filestat_set_times", start, errno)
+	return errno
+}
+
+func (s *system) PathLink(ctx context.Context, oldFD wasi.FD, oldFlags wasi.LookupFlags, oldPath string, newFD wasi.FD, newPath string) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	s.observe("path_link", start, errno)
+	return errno
+}
+
+func (s *system) PathOpen(ctx context.Context, fd wasi.FD, dirFlags wasi.LookupFlags, path string, openFlags wasi.OpenFlags, rightsBase, rightsInheriting wasi.Rights, fdFlags wasi.FDFlags) (wasi.FD, wasi.Errno) {
+	start := time.Now()
+	newfd, errno := s.System.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	s.observe("path_open", start, errno)
+	if errno == wasi.ESUCCESS {
+		s.metrics.openFDs.Inc()
+	}
+	return newfd, errno
+}
+
+func (s *system) PathReadLink(ctx context.Context, fd wasi.FD, path string, buffer []byte) (int, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.PathReadLink(ctx, fd, path, buffer)
+	s.observe("path_readlink", start, errno)
+	return n, errno
+}
+
+func (s *system) PathRemoveDirectory(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathRemoveDirectory(ctx, fd, path)
+	s.observe("path_remove_directory", start, errno)
+	return errno
+}
+
+func (s *system) PathRename(ctx context.Context, fd wasi.FD, oldPath string, newFD wasi.FD, newPath string) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathRename(ctx, fd, oldPath, newFD, newPath)
+	s.observe("path_rename", start, errno)
+	return errno
+}
+
+func (s *system) PathSymlink(ctx context.Context, oldPath string, fd wasi.FD, newPath string) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathSymlink(ctx, oldPath, fd, newPath)
+	s.observe("path_symlink", start, errno)
+	return errno
+}
+
+func (s *system) PathUnlinkFile(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	start := time.Now()
+	errno := s.System.PathUnlinkFile(ctx, fd, path)
+	s.observe("path_unlink_file", start, errno)
+	return errno
+}
+
+func (s *system) PollOneOff(ctx context.Context, subscriptions []wasi.Subscription, events []wasi.Event) (int, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.PollOneOff(ctx, subscriptions, events)
+	s.observe("poll_oneoff", start, errno)
+	return n, errno
+}
+
+func (s *system) ProcExit(ctx context.Context, exitCode wasi.ExitCode) wasi.Errno {
+	// ProcExit is not expected to return, the call is counted before
+	// calling the underlying system.
+	s.observe("proc_exit", time.Now(), wasi.ESUCCESS)
+	return s.System.ProcExit(ctx, exitCode)
+}
+
+func (s *system) ProcRaise(ctx context.Context, signal wasi.Signal) wasi.Errno {
+	start := time.Now()
+	errno := s.System.ProcRaise(ctx, signal)
+	s.observe("proc_raise", start, errno)
+	return errno
+}
+
+func (s *system) SchedYield(ctx context.Context) wasi.Errno {
+	start := time.Now()
+	errno := s.System.SchedYield(ctx)
+	s.observe("sched_yield", start, errno)
+	return errno
+}
+
+func (s *system) RandomGet(ctx context.Context, b []byte) wasi.Errno {
+	start := time.Now()
+	errno := s.System.RandomGet(ctx, b)
+	s.observe("random_get", start, errno)
+	return errno
+}
+
+func (s *system) SockAccept(ctx context.Context, fd wasi.FD, flags wasi.FDFlags) (wasi.FD, wasi.SocketAddress, wasi.SocketAddress, wasi.Errno) {
+	start := time.Now()
+	newfd, peer, addr, errno := s.System.SockAccept(ctx, fd, flags)
+	s.observe("sock_accept", start, errno)
+	if errno == wasi.ESUCCESS {
+		s.metrics.openFDs.Inc()
+	}
+	return newfd, peer, addr, errno
+}
+
+func (s *system) SockShutdown(ctx context.Context, fd wasi.FD, flags wasi.SDFlags) wasi.Errno {
+	start := time.Now()
+	errno := s.System.SockShutdown(ctx, fd, flags)
+	s.observe("sock_shutdown", start, errno)
+	return errno
+}
+
+func (s *system) SockRecv(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.RIFlags) (wasi.Size, wasi.ROFlags, wasi.Errno) {
+	start := time.Now()
+	n, oflags, errno := s.System.SockRecv(ctx, fd, iovecs, iflags)
+	s.observe("sock_recv", start, errno)
+	s.metrics.readBytes.Add(float64(n))
+	return n, oflags, errno
+}
+
+func (s *system) SockSend(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.SIFlags) (wasi.Size, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.SockSend(ctx, fd, iovecs, iflags)
+	s.observe("sock_send", start, errno)
+	s.metrics.writtenBytes.Add(float64(n))
+	return n, errno
+}
+
+func (s *system) SockOpen(ctx context.Context, pf wasi.ProtocolFamily, socketType wasi.SocketType, protocol wasi.Protocol, rightsBase, rightsInheriting wasi.Rights) (wasi.FD, wasi.Errno) {
+	start := time.Now()
+	fd, errno := s.System.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	s.observe("sock_open", start, errno)
+	if errno == wasi.ESUCCESS {
+		s.metrics.openFDs.Inc()
+	}
+	return fd, errno
+}
+
+func (s *system) SockBind(ctx context.Context, fd wasi.FD, addr wasi.SocketAddress) (wasi.SocketAddress, wasi.Errno) {
+	start := time.Now()
+	result, errno := s.System.SockBind(ctx, fd, addr)
+	s.observe("sock_bind", start, errno)
+	return result, errno
+}
+
+func (s *system) SockConnect(ctx context.Context, fd wasi.FD, peer wasi.SocketAddress) (wasi.SocketAddress, wasi.Errno) {
+	start := time.Now()
+	addr, errno := s.System.SockConnect(ctx, fd, peer)
+	s.observe("sock_connect", start, errno)
+	return addr, errno
+}
+
+func (s *system) SockListen(ctx context.Context, fd wasi.FD, backlog int) wasi.Errno {
+	start := time.Now()
+	errno := s.System.SockListen(ctx, fd, backlog)
+	s.observe("sock_listen", start, errno)
+	return errno
+}
+
+func (s *system) SockSendTo(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.SIFlags, addr wasi.SocketAddress) (wasi.Size, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.SockSendTo(ctx, fd, iovecs, iflags, addr)
+	s.observe("sock_send_to", start, errno)
+	s.metrics.writtenBytes.Add(float64(n))
+	return n, errno
+}
+
+func (s *system) SockRecvFrom(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec, iflags wasi.RIFlags) (wasi.Size, wasi.ROFlags, wasi.SocketAddress, wasi.Errno) {
+	start := time.Now()
+	n, oflags, addr, errno := s.System.SockRecvFrom(ctx, fd, iovecs, iflags)
+	s.observe("sock_recv_from", start, errno)
+	s.metrics.readBytes.Add(float64(n))
+	return n, oflags, addr, errno
+}
+
+func (s *system) SockGetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketOption) (wasi.SocketOptionValue, wasi.Errno) {
+	start := time.Now()
+	value, errno := s.System.SockGetOpt(ctx, fd, option)
+	s.observe("sock_getsockopt", start, errno)
+	return value, errno
+}
+
+func (s *system) SockSetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketOption, value wasi.SocketOptionValue) wasi.Errno {
+	start := time.Now()
+	errno := s.System.SockSetOpt(ctx, fd, option, value)
+	s.observe("sock_setsockopt", start, errno)
+	return errno
+}
+
+func (s *system) SockLocalAddress(ctx context.Context, fd wasi.FD) (wasi.SocketAddress, wasi.Errno) {
+	start := time.Now()
+	addr, errno := s.System.SockLocalAddress(ctx, fd)
+	s.observe("sock_getlocaladdr", start, errno)
+	return addr, errno
+}
+
+func (s *system) SockRemoteAddress(ctx context.Context, fd wasi.FD) (wasi.SocketAddress, wasi.Errno) {
+	start := time.Now()
+	addr, errno := s.System.SockRemoteAddress(ctx, fd)
+	s.observe("sock_getpeeraddr", start, errno)
+	return addr, errno
+}
+
+func (s *system) SockAddressInfo(ctx context.Context, name, service string, hints wasi.AddressInfo, results []wasi.AddressInfo) (int, wasi.Errno) {
+	start := time.Now()
+	n, errno := s.System.SockAddressInfo(ctx, name, service, hints, results)
+	s.observe("sock_getaddrinfo", start, errno)
+	return n, errno
+}
+
+func (s *system) Close(ctx context.Context) error {
+	return s.System.Close(ctx)
+}
@@ -0,0 +1,118 @@
+package promwasi_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/promwasi"
+	"github.com/stealthrocket/wasi-go/wasitest"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+
+	metrics, err := promwasi.NewMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := promwasi.NewMetrics(registry); err == nil {
+		t.Error("registering the metrics twice did not fail")
+	}
+
+	mock := wasitest.NewMockSystem(t)
+	mock.On("path_open", wasi.FD(3), wasi.LookupFlags(0), "missing").Return(wasi.ENOENT)
+	mock.On("path_open").Return(wasi.ESUCCESS, wasi.FD(4))
+	mock.On("fd_read").Return(wasi.ESUCCESS, wasi.Size(3))
+	mock.On("fd_write").Return(wasi.ESUCCESS, wasi.Size(5))
+	mock.On("fd_close", wasi.FD(4)).Return(wasi.ESUCCESS)
+	mock.On("fd_close").Return(wasi.EBADF)
+
+	// Metrics instrumenting multiple systems are aggregated.
+	s1 := metrics.Instrument(mock)
+	s2 := metrics.Instrument(mock)
+
+	for _, s := range []wasi.System{s1, s2} {
+		if _, errno := s.PathOpen(ctx, 3, 0, "data", 0, wasi.AllRights, wasi.AllRights, 0); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+	}
+	if _, errno := s1.PathOpen(ctx, 3, 0, "missing", 0, wasi.AllRights, wasi.AllRights, 0); errno != wasi.ENOENT {
+		t.Fatalf("path_open: wrong errno: %s", errno)
+	}
+	s1.FDRead(ctx, 4, []wasi.IOVec{make([]byte, 8)})
+	s1.FDWrite(ctx, 4, []wasi.IOVec{[]byte("hello")})
+	s2.FDWrite(ctx, 4, []wasi.IOVec{[]byte("hello")})
+	s1.FDClose(ctx, 4)
+	if errno := s1.FDClose(ctx, 42); errno != wasi.EBADF {
+		t.Fatalf("fd_close: wrong errno: %s", errno)
+	}
+
+	const want = `
+# HELP wasi_open_fds Number of file descriptors opened by guests.
+# TYPE wasi_open_fds gauge
+wasi_open_fds 1
+# HELP wasi_read_bytes_total Number of bytes read from files and sockets.
+# TYPE wasi_read_bytes_total counter
+wasi_read_bytes_total 3
+# HELP wasi_syscall_errors_total Number of WASI system calls which returned an error.
+# TYPE wasi_syscall_errors_total counter
+wasi_syscall_errors_total{errno="EBADF",syscall="fd_close"} 1
+wasi_syscall_errors_total{errno="ENOENT",syscall="path_open"} 1
+# HELP wasi_syscalls_total Number of WASI system calls.
+# TYPE wasi_syscalls_total counter
+wasi_syscalls_total{syscall="fd_close"} 2
+wasi_syscalls_total{syscall="fd_read"} 1
+wasi_syscalls_total{syscall="fd_write"} 2
+wasi_syscalls_total{syscall="path_open"} 3
+# HELP wasi_written_bytes_total Number of bytes written to files and sockets.
+# TYPE wasi_written_bytes_total counter
+wasi_written_bytes_total 10
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want),
+		"wasi_open_fds",
+		"wasi_read_bytes_total",
+		"wasi_syscall_errors_total",
+		"wasi_syscalls_total",
+		"wasi_written_bytes_total",
+	); err != nil {
+		t.Error(err)
+	}
+
+	// The latencies vary between runs, so only the number of observations
+	// of the histograms is compared.
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "wasi_syscall_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "syscall" {
+					counts[label.GetValue()] = metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	for syscall, count := range map[string]uint64{
+		"path_open": 3,
+		"fd_read":   1,
+		"fd_write":  2,
+		"fd_close":  2,
+	} {
+		if counts[syscall] != count {
+			t.Errorf("%s: wrong number of latency observations: want=%d got=%d", syscall, count, counts[syscall])
+		}
+	}
+	if len(counts) != 4 {
+		t.Errorf("wrong number of latency histograms: want=4 got=%d", len(counts))
+	}
+}
@@ -0,0 +1,291 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PortMapping maps a port that the guest binds sockets to onto the address
+// that the host listens on instead, like the -p option of docker run.
+type PortMapping struct {
+	// Network restricts the mapping to "tcp" or "udp" sockets; the mapping
+	// applies to both when empty.
+	Network string
+	// GuestPort is the port that the guest binds to.
+	GuestPort int
+	// HostIP is the address of the interface that the host listens on. The
+	// address requested by the guest is used when it is the zero value.
+	HostIP netip.Addr
+	// HostPort is the port that the host listens on.
+	HostPort int
+}
+
+// ParsePortMapping parses a port mapping in the form
+// GUEST_PORT:[HOST_IP:]HOST_PORT[/NETWORK], for example 8080:9090 or
+// 8080:127.0.0.1:9090/tcp. IPv6 addresses are enclosed in square brackets.
+func ParsePortMapping(s string) (PortMapping, error) {
+	var m PortMapping
+	spec, network, hasNetwork := strings.Cut(s, "/")
+	if hasNetwork {
+		if network != "tcp" && network != "udp" {
+			return m, fmt.Errorf("invalid port mapping %q: unsupported network %q", s, network)
+		}
+		m.Network = network
+	}
+	guestPort, host, ok := strings.Cut(spec, ":")
+	if !ok {
+		return m, fmt.Errorf("invalid port mapping %q: missing host port", s)
+	}
+	hostPort := host
+	if strings.Contains(host, ":") {
+		hostIP, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return m, fmt.Errorf("invalid port mapping %q: %w", s, err)
+		}
+		ip, err := netip.ParseAddr(hostIP)
+		if err != nil {
+			return m, fmt.Errorf("invalid port mapping %q: %w", s, err)
+		}
+		m.HostIP, hostPort = ip.Unmap(), port
+	}
+	var err error
+	if m.GuestPort, err = parsePort(guestPort); err != nil {
+		return m, fmt.Errorf("invalid port mapping %q: %w", s, err)
+	}
+	if m.HostPort, err = parsePort(hostPort); err != nil {
+		return m, fmt.Errorf("invalid port mapping %q: %w", s, err)
+	}
+	return m, nil
+}
+
+func (m PortMapping) String() string {
+	s := strconv.Itoa(m.GuestPort) + ":"
+	if m.HostIP.IsValid() {
+		s += net.JoinHostPort(m.HostIP.String(), strconv.Itoa(m.HostPort))
+	} else {
+		s += strconv.Itoa(m.HostPort)
+	}
+	if m.Network != "" {
+		s += "/" + m.Network
+	}
+	return s
+}
+
+func (m *PortMapping) matches(network string, port int) bool {
+	return port == m.GuestPort && (m.Network == "" || m.Network == network)
+}
+
+// PublishPorts wraps a System to map the ports that the guest binds sockets
+// to onto the addresses that the host listens on, decoupling the ports that
+// the guest expects from the network layout of the host.
+//
+// The mappings apply to sock_bind, and to the sockets that path_open listens
+// on with unix.PathOpenSockets. The local addresses of the sockets, returned
+// by sock_bind, sock_accept and sock_getlocaladdr, report the ports that
+// the guest bound to; their IP addresses are those of the host interfaces.
+func PublishPorts(system System, ports ...PortMapping) System {
+	return &portPublisher{
+		System: system,
+		ports:  ports,
+		bound:  make(map[FD]*PortMapping),
+	}
+}
+
+type portPublisher struct {
+	System
+	ports []PortMapping
+	mutex sync.Mutex
+	// bound maps the file descriptors of sockets bound to host addresses to
+	// the port mappings which apply to them.
+	bound map[FD]*PortMapping
+}
+
+func (p *portPublisher) lookup(network string, port int) *PortMapping {
+	for i := range p.ports {
+		if m := &p.ports[i]; m.matches(network, port) {
+			return m
+		}
+	}
+	return nil
+}
+
+func (p *portPublisher) mapping(fd FD) *PortMapping {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.bound[fd]
+}
+
+func (p *portPublisher) setMapping(fd FD, m *PortMapping) {
+	p.mutex.Lock()
+	p.bound[fd] = m
+	p.mutex.Unlock()
+}
+
+// guestAddress translates the local address of a socket bound with m to
+// the address that the guest expects.
+func (m *PortMapping) guestAddress(addr SocketAddress) SocketAddress {
+	switch a := addr.(type) {
+	case *Inet4Address:
+		if a.Port == m.HostPort {
+			return &Inet4Address{Addr: a.Addr, Port: m.GuestPort}
+		}
+	case *Inet6Address:
+		if a.Port == m.HostPort {
+			return &Inet6Address{Addr: a.Addr, Port: m.GuestPort}
+		}
+	}
+	return addr
+}
+
+// hostAddress returns the address that the host binds to when the guest
+// binds to addr.
+func (m *PortMapping) hostAddress(addr SocketAddress) (SocketAddress, Errno) {
+	switch a := addr.(type) {
+	case *Inet4Address:
+		host := &Inet4Address{Addr: a.Addr, Port: m.HostPort}
+		if m.HostIP.IsValid() {
+			if !m.HostIP.Is4() {
+				return nil, EAFNOSUPPORT
+			}
+			host.Addr = m.HostIP.As4()
+		}
+		return host, ESUCCESS
+	case *Inet6Address:
+		host := &Inet6Address{Addr: a.Addr, Port: m.HostPort}
+		if m.HostIP.IsValid() {
+			host.Addr = m.HostIP.As16()
+		}
+		return host, ESUCCESS
+	default:
+		return addr, ESUCCESS
+	}
+}
+
+func (p *portPublisher) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	var port int
+	switch a := addr.(type) {
+	case *Inet4Address:
+		port = a.Port
+	case *Inet6Address:
+		port = a.Port
+	default:
+		return p.System.SockBind(ctx, fd, addr)
+	}
+	stat, errno := p.System.FDStatGet(ctx, fd)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	network := "tcp"
+	if stat.FileType == SocketDGramType {
+		network = "udp"
+	}
+	m := p.lookup(network, port)
+	if m == nil {
+		return p.System.SockBind(ctx, fd, addr)
+	}
+	hostAddr, errno := m.hostAddress(addr)
+	if errno != ESUCCESS {
+		return nil, errno
+	}
+	local, errno := p.System.SockBind(ctx, fd, hostAddr)
+	if errno != ESUCCESS {
+		return local, errno
+	}
+	p.setMapping(fd, m)
+	return m.guestAddress(local), ESUCCESS
+}
+
+func (p *portPublisher) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	newfd, peer, local, errno := p.System.SockAccept(ctx, fd, flags)
+	if errno == ESUCCESS {
+		if m := p.mapping(fd); m != nil {
+			p.setMapping(newfd, m)
+			local = m.guestAddress(local)
+		}
+	}
+	return newfd, peer, local, errno
+}
+
+func (p *portPublisher) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	local, errno := p.System.SockLocalAddress(ctx, fd)
+	if errno == ESUCCESS {
+		if m := p.mapping(fd); m != nil {
+			local = m.guestAddress(local)
+		}
+	}
+	return local, errno
+}
+
+// PathOpen rewrites the addresses of the sockets that unix.PathOpenSockets
+// listens on, in the form <network>+listen://<host>:<port>.
+func (p *portPublisher) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	var m *PortMapping
+	if fd < 0 {
+		path, m = p.rewriteSocketURI(path)
+	}
+	newfd, errno := p.System.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	if errno == ESUCCESS && m != nil {
+		p.setMapping(newfd, m)
+	}
+	return newfd, errno
+}
+
+func (p *portPublisher) rewriteSocketURI(uri string) (string, *PortMapping) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri, nil
+	}
+	network, op, _ := strings.Cut(u.Scheme, "+")
+	if op != "listen" {
+		return uri, nil
+	}
+	network = strings.TrimRight(network, "46")
+	if network != "tcp" && network != "udp" {
+		return uri, nil
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return uri, nil
+	}
+	m := p.lookup(network, port)
+	if m == nil {
+		return uri, nil
+	}
+	host := u.Hostname()
+	if m.HostIP.IsValid() {
+		host = m.HostIP.String()
+	}
+	u.Host = net.JoinHostPort(host, strconv.Itoa(m.HostPort))
+	return u.String(), m
+}
+
+func (p *portPublisher) FDClose(ctx context.Context, fd FD) Errno {
+	errno := p.System.FDClose(ctx, fd)
+	if errno == ESUCCESS {
+		p.mutex.Lock()
+		delete(p.bound, fd)
+		p.mutex.Unlock()
+	}
+	return errno
+}
+
+func (p *portPublisher) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := p.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS && from != to {
+		p.mutex.Lock()
+		m, ok := p.bound[from]
+		delete(p.bound, from)
+		delete(p.bound, to)
+		if ok {
+			p.bound[to] = m
+		}
+		p.mutex.Unlock()
+	}
+	return errno
+}
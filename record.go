@@ -0,0 +1,847 @@
+package wasi
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Record wraps a System to write a log of the system calls made by the guest
+// and their results to w. The log can be fed back to Replay to reproduce the
+// execution of the guest without accessing the host.
+//
+// Data returned to the guest (e.g. the content of files read with fd_read,
+// directory entries, or poll events) is part of the log, while data passed
+// by the guest to the host (e.g. the content written with fd_write) is not.
+//
+// Errors writing the log stop the recording, and are reported when the
+// system is closed.
+func Record(system System, w io.Writer) System {
+	return &recorder{system: system, encoder: gob.NewEncoder(w)}
+}
+
+// Replay returns a System which answers system calls with the results read
+// from a log written by Record instead of accessing the host.
+//
+// The guest is expected to make the same sequence of system calls as the
+// execution that was recorded. When it diverges (e.g. because the guest was
+// given different arguments, or the log is truncated), the system calls fail
+// with ENOTRECOVERABLE and the reason is reported when the system is closed.
+//
+// The system passed to Replay is only used to terminate the guest when it
+// calls proc_exit, and to forward the data written to stdout and stderr. It
+// is closed when the replayer is closed.
+func Replay(system System, r io.Reader) System {
+	return &replayer{system: system, decoder: gob.NewDecoder(r)}
+}
+
+func init() {
+	for _, v := range []any{
+		FD(0),
+		Size(0),
+		FileSize(0),
+		Timestamp(0),
+		ROFlags(0),
+		FDStat{},
+		FileStat{},
+		PreStat{},
+		[]DirEntry{},
+		[]Event{},
+		[]AddressInfo{},
+		&Inet4Address{},
+		&Inet6Address{},
+		&UnixAddress{},
+		IntValue(0),
+		TimeValue(0),
+		BytesValue{},
+	} {
+		gob.Register(v)
+	}
+}
+
+type syscallRecord struct {
+	Syscall string
+	Args    string
+	Errno   Errno
+	Results []any
+}
+
+type recorder struct {
+	mutex   sync.Mutex
+	encoder *gob.Encoder
+	err     error
+	system  System
+}
+
+func (r *recorder) record(syscall string, errno Errno, args []any, results ...any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.encoder.Encode(&syscallRecord{
+		Syscall: syscall,
+		Args:    formatRecordArgs(args),
+		Errno:   errno,
+		Results: results,
+	}); err != nil {
+		r.err = fmt.Errorf("record: %s: %w", syscall, err)
+	}
+}
+
+func (r *recorder) Close(ctx context.Context) error {
+	r.mutex.Lock()
+	err := r.err
+	r.mutex.Unlock()
+	return errors.Join(r.system.Close(ctx), err)
+}
+
+type replayer struct {
+	mutex   sync.Mutex
+	decoder *gob.Decoder
+	calls   int
+	err     error
+	system  System
+}
+
+func (r *replayer) replay(syscall string, args ...any) ([]any, Errno) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return nil, ENOTRECOVERABLE
+	}
+	r.calls++
+
+	var record syscallRecord
+	if err := r.decoder.Decode(&record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = fmt.Errorf("replay: call %d: %s: %w", r.calls, syscall, err)
+		return nil, ENOTRECOVERABLE
+	}
+	if a := formatRecordArgs(args); record.Syscall != syscall || record.Args != a {
+		r.err = fmt.Errorf("replay: call %d: diverged from the recording: %s(%s) was recorded, got %s(%s)",
+			r.calls, record.Syscall, record.Args, syscall, a)
+		return nil, ENOTRECOVERABLE
+	}
+	return record.Results, record.Errno
+}
+
+func (r *replayer) Close(ctx context.Context) error {
+	r.mutex.Lock()
+	err := r.err
+	r.mutex.Unlock()
+	return errors.Join(r.system.Close(ctx), err)
+}
+
+func formatRecordArgs(args []any) string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = fmt.Sprint(arg)
+	}
+	return strings.Join(s, ", ")
+}
+
+// valueAt returns the value at index i, or the zero value of T if the value
+// is missing (e.g. because the replay diverged) or nil.
+//
+// The function panics if the value has a different type, which happens when
+// hooks passed to Intercept replace arguments or results with values of the
+// wrong type; silently using the zero value would hide the bug.
+func valueAt[T any](values []any, i int) (v T) {
+	if i < len(values) && values[i] != nil {
+		var ok bool
+		if v, ok = values[i].(T); !ok {
+			panic(fmt.Sprintf("wasi: value at index %d has type %T, expected %T", i, values[i], v))
+		}
+	}
+	return v
+}
+
+// recordSlice returns the first n elements of s, or nil if the system call
+// failed, in which case the content of s is undefined.
+func recordSlice[T any](s []T, n int, errno Errno) []T {
+	if errno != ESUCCESS || n < 0 || n > len(s) {
+		return nil
+	}
+	return s[:n]
+}
+
+func iovecsSize(iovecs []IOVec) (size int) {
+	for _, iovec := range iovecs {
+		size += len(iovec)
+	}
+	return size
+}
+
+// readData returns the n bytes read in iovecs.
+func readData(iovecs []IOVec, n int) []byte {
+	data := make([]byte, 0, n)
+	for _, iovec := range iovecs {
+		if len(data) == n {
+			break
+		}
+		if len(iovec) > n-len(data) {
+			iovec = iovec[:n-len(data)]
+		}
+		data = append(data, iovec...)
+	}
+	return data
+}
+
+// copyData scatters data to iovecs.
+func copyData(iovecs []IOVec, data []byte) {
+	for _, iovec := range iovecs {
+		data = data[copy(iovec, data):]
+	}
+}
+
+func (r *recorder) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	count, stringBytes, errno := r.system.ArgsSizesGet(ctx)
+	r.record("args_sizes_get", errno, nil, count, stringBytes)
+	return count, stringBytes, errno
+}
+
+func (r *recorder) ArgsGet(ctx context.Context) ([]string, Errno) {
+	result, errno := r.system.ArgsGet(ctx)
+	r.record("args_get", errno, nil, result)
+	return result, errno
+}
+
+func (r *recorder) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	count, stringBytes, errno := r.system.EnvironSizesGet(ctx)
+	r.record("environ_sizes_get", errno, nil, count, stringBytes)
+	return count, stringBytes, errno
+}
+
+func (r *recorder) EnvironGet(ctx context.Context) ([]string, Errno) {
+	result, errno := r.system.EnvironGet(ctx)
+	r.record("environ_get", errno, nil, result)
+	return result, errno
+}
+
+func (r *recorder) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	result, errno := r.system.ClockResGet(ctx, id)
+	r.record("clock_res_get", errno, []any{id}, result)
+	return result, errno
+}
+
+func (r *recorder) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	result, errno := r.system.ClockTimeGet(ctx, id, precision)
+	r.record("clock_time_get", errno, []any{id, precision}, result)
+	return result, errno
+}
+
+func (r *recorder) FDAdvise(ctx context.Context, fd FD, offset FileSize, length FileSize, advice Advice) Errno {
+	errno := r.system.FDAdvise(ctx, fd, offset, length, advice)
+	r.record("fd_advise", errno, []any{fd, offset, length, advice})
+	return errno
+}
+
+func (r *recorder) FDAllocate(ctx context.Context, fd FD, offset FileSize, length FileSize) Errno {
+	errno := r.system.FDAllocate(ctx, fd, offset, length)
+	r.record("fd_allocate", errno, []any{fd, offset, length})
+	return errno
+}
+
+func (r *recorder) FDClose(ctx context.Context, fd FD) Errno {
+	errno := r.system.FDClose(ctx, fd)
+	r.record("fd_close", errno, []any{fd})
+	return errno
+}
+
+func (r *recorder) FDDataSync(ctx context.Context, fd FD) Errno {
+	errno := r.system.FDDataSync(ctx, fd)
+	r.record("fd_datasync", errno, []any{fd})
+	return errno
+}
+
+func (r *recorder) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	result, errno := r.system.FDStatGet(ctx, fd)
+	r.record("fd_fdstat_get", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	errno := r.system.FDStatSetFlags(ctx, fd, flags)
+	r.record("fd_fdstat_set_flags", errno, []any{fd, flags})
+	return errno
+}
+
+func (r *recorder) FDStatSetRights(ctx context.Context, fd FD, rightsBase Rights, rightsInheriting Rights) Errno {
+	errno := r.system.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	r.record("fd_fdstat_set_rights", errno, []any{fd, rightsBase, rightsInheriting})
+	return errno
+}
+
+func (r *recorder) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	result, errno := r.system.FDFileStatGet(ctx, fd)
+	r.record("fd_filestat_get", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	errno := r.system.FDFileStatSetSize(ctx, fd, size)
+	r.record("fd_filestat_set_size", errno, []any{fd, size})
+	return errno
+}
+
+func (r *recorder) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	errno := r.system.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	r.record("fd_filestat_set_times", errno, []any{fd, accessTime, modifyTime, flags})
+	return errno
+}
+
+func (r *recorder) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	n, errno := r.system.FDPread(ctx, fd, iovecs, offset)
+	r.record("fd_pread", errno, []any{fd, iovecsSize(iovecs), offset}, n, readData(iovecs, int(n)))
+	return n, errno
+}
+
+func (r *recorder) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	result, errno := r.system.FDPreStatGet(ctx, fd)
+	r.record("fd_prestat_get", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	result, errno := r.system.FDPreStatDirName(ctx, fd)
+	r.record("fd_prestat_dir_name", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	result, errno := r.system.FDPwrite(ctx, fd, iovecs, offset)
+	r.record("fd_pwrite", errno, []any{fd, iovecsSize(iovecs), offset}, result)
+	return result, errno
+}
+
+func (r *recorder) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n, errno := r.system.FDRead(ctx, fd, iovecs)
+	r.record("fd_read", errno, []any{fd, iovecsSize(iovecs)}, n, readData(iovecs, int(n)))
+	return n, errno
+}
+
+func (r *recorder) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	n, errno := r.system.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	r.record("fd_readdir", errno, []any{fd, len(entries), cookie, bufferSizeBytes}, n, recordSlice(entries, n, errno))
+	return n, errno
+}
+
+func (r *recorder) FDRenumber(ctx context.Context, from FD, to FD) Errno {
+	errno := r.system.FDRenumber(ctx, from, to)
+	r.record("fd_renumber", errno, []any{from, to})
+	return errno
+}
+
+func (r *recorder) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	result, errno := r.system.FDSeek(ctx, fd, offset, whence)
+	r.record("fd_seek", errno, []any{fd, offset, whence}, result)
+	return result, errno
+}
+
+func (r *recorder) FDSync(ctx context.Context, fd FD) Errno {
+	errno := r.system.FDSync(ctx, fd)
+	r.record("fd_sync", errno, []any{fd})
+	return errno
+}
+
+func (r *recorder) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	result, errno := r.system.FDTell(ctx, fd)
+	r.record("fd_tell", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	result, errno := r.system.FDWrite(ctx, fd, iovecs)
+	r.record("fd_write", errno, []any{fd, iovecsSize(iovecs)}, result)
+	return result, errno
+}
+
+func (r *recorder) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	errno := r.system.PathCreateDirectory(ctx, fd, path)
+	r.record("path_create_directory", errno, []any{fd, path})
+	return errno
+}
+
+func (r *recorder) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	result, errno := r.system.PathFileStatGet(ctx, fd, lookupFlags, path)
+	r.record("path_filestat_get", errno, []any{fd, lookupFlags, path}, result)
+	return result, errno
+}
+
+func (r *recorder) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	errno := r.system.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	r.record("path_filestat_set_times", errno, []any{fd, lookupFlags, path, accessTime, modifyTime, flags})
+	return errno
+}
+
+func (r *recorder) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	errno := r.system.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	r.record("path_link", errno, []any{oldFD, oldFlags, oldPath, newFD, newPath})
+	return errno
+}
+
+func (r *recorder) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase Rights, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	result, errno := r.system.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	r.record("path_open", errno, []any{fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags}, result)
+	return result, errno
+}
+
+func (r *recorder) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	n, errno := r.system.PathReadLink(ctx, fd, path, buffer)
+	r.record("path_readlink", errno, []any{fd, path, len(buffer)}, n, recordSlice(buffer, n, errno))
+	return n, errno
+}
+
+func (r *recorder) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	errno := r.system.PathRemoveDirectory(ctx, fd, path)
+	r.record("path_remove_directory", errno, []any{fd, path})
+	return errno
+}
+
+func (r *recorder) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	errno := r.system.PathRename(ctx, fd, oldPath, newFD, newPath)
+	r.record("path_rename", errno, []any{fd, oldPath, newFD, newPath})
+	return errno
+}
+
+func (r *recorder) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	errno := r.system.PathSymlink(ctx, oldPath, fd, newPath)
+	r.record("path_symlink", errno, []any{oldPath, fd, newPath})
+	return errno
+}
+
+func (r *recorder) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	errno := r.system.PathUnlinkFile(ctx, fd, path)
+	r.record("path_unlink_file", errno, []any{fd, path})
+	return errno
+}
+
+func (r *recorder) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	n, errno := r.system.PollOneOff(ctx, subscriptions, events)
+	r.record("poll_oneoff", errno, []any{subscriptions, len(events)}, n, recordSlice(events, n, errno))
+	return n, errno
+}
+
+func (r *recorder) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	// ProcExit is not expected to return, the call is recorded before
+	// calling the underlying system.
+	r.record("proc_exit", ESUCCESS, []any{exitCode})
+	return r.system.ProcExit(ctx, exitCode)
+}
+
+func (r *recorder) ProcRaise(ctx context.Context, signal Signal) Errno {
+	errno := r.system.ProcRaise(ctx, signal)
+	r.record("proc_raise", errno, []any{signal})
+	return errno
+}
+
+func (r *recorder) SchedYield(ctx context.Context) Errno {
+	errno := r.system.SchedYield(ctx)
+	r.record("sched_yield", errno, nil)
+	return errno
+}
+
+func (r *recorder) RandomGet(ctx context.Context, b []byte) Errno {
+	errno := r.system.RandomGet(ctx, b)
+	r.record("random_get", errno, []any{len(b)}, recordSlice(b, len(b), errno))
+	return errno
+}
+
+func (r *recorder) SockOpen(ctx context.Context, family ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase Rights, rightsInheriting Rights) (FD, Errno) {
+	result, errno := r.system.SockOpen(ctx, family, socketType, protocol, rightsBase, rightsInheriting)
+	r.record("sock_open", errno, []any{family, socketType, protocol, rightsBase, rightsInheriting}, result)
+	return result, errno
+}
+
+func (r *recorder) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	result, errno := r.system.SockBind(ctx, fd, addr)
+	r.record("sock_bind", errno, []any{fd, addr}, result)
+	return result, errno
+}
+
+func (r *recorder) SockConnect(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	result, errno := r.system.SockConnect(ctx, fd, addr)
+	r.record("sock_connect", errno, []any{fd, addr}, result)
+	return result, errno
+}
+
+func (r *recorder) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	errno := r.system.SockListen(ctx, fd, backlog)
+	r.record("sock_listen", errno, []any{fd, backlog})
+	return errno
+}
+
+func (r *recorder) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	newfd, peer, addr, errno := r.system.SockAccept(ctx, fd, flags)
+	r.record("sock_accept", errno, []any{fd, flags}, newfd, peer, addr)
+	return newfd, peer, addr, errno
+}
+
+func (r *recorder) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	n, oflags, errno := r.system.SockRecv(ctx, fd, iovecs, flags)
+	r.record("sock_recv", errno, []any{fd, iovecsSize(iovecs), flags}, n, oflags, readData(iovecs, int(n)))
+	return n, oflags, errno
+}
+
+func (r *recorder) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	result, errno := r.system.SockSend(ctx, fd, iovecs, flags)
+	r.record("sock_send", errno, []any{fd, iovecsSize(iovecs), flags}, result)
+	return result, errno
+}
+
+func (r *recorder) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	result, errno := r.system.SockSendTo(ctx, fd, iovecs, flags, addr)
+	r.record("sock_send_to", errno, []any{fd, iovecsSize(iovecs), flags, addr}, result)
+	return result, errno
+}
+
+func (r *recorder) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	n, oflags, addr, errno := r.system.SockRecvFrom(ctx, fd, iovecs, flags)
+	r.record("sock_recv_from", errno, []any{fd, iovecsSize(iovecs), flags}, n, oflags, addr, readData(iovecs, int(n)))
+	return n, oflags, addr, errno
+}
+
+func (r *recorder) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	result, errno := r.system.SockGetOpt(ctx, fd, option)
+	r.record("sock_getsockopt", errno, []any{fd, option}, result)
+	return result, errno
+}
+
+func (r *recorder) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	errno := r.system.SockSetOpt(ctx, fd, option, value)
+	r.record("sock_setsockopt", errno, []any{fd, option, value})
+	return errno
+}
+
+func (r *recorder) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	result, errno := r.system.SockLocalAddress(ctx, fd)
+	r.record("sock_getlocaladdr", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	result, errno := r.system.SockRemoteAddress(ctx, fd)
+	r.record("sock_getpeeraddr", errno, []any{fd}, result)
+	return result, errno
+}
+
+func (r *recorder) SockAddressInfo(ctx context.Context, name string, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	n, errno := r.system.SockAddressInfo(ctx, name, service, hints, results)
+	r.record("sock_getaddrinfo", errno, []any{name, service, hints, len(results)}, n, recordSlice(results, n, errno))
+	return n, errno
+}
+
+func (r *recorder) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	errno := r.system.SockShutdown(ctx, fd, flags)
+	r.record("sock_shutdown", errno, []any{fd, flags})
+	return errno
+}
+
+func (r *replayer) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	values, errno := r.replay("args_sizes_get")
+	return valueAt[int](values, 0), valueAt[int](values, 1), errno
+}
+
+func (r *replayer) ArgsGet(ctx context.Context) ([]string, Errno) {
+	values, errno := r.replay("args_get")
+	return valueAt[[]string](values, 0), errno
+}
+
+func (r *replayer) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	values, errno := r.replay("environ_sizes_get")
+	return valueAt[int](values, 0), valueAt[int](values, 1), errno
+}
+
+func (r *replayer) EnvironGet(ctx context.Context) ([]string, Errno) {
+	values, errno := r.replay("environ_get")
+	return valueAt[[]string](values, 0), errno
+}
+
+func (r *replayer) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	values, errno := r.replay("clock_res_get", id)
+	return valueAt[Timestamp](values, 0), errno
+}
+
+func (r *replayer) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	values, errno := r.replay("clock_time_get", id, precision)
+	return valueAt[Timestamp](values, 0), errno
+}
+
+func (r *replayer) FDAdvise(ctx context.Context, fd FD, offset FileSize, length FileSize, advice Advice) Errno {
+	_, errno := r.replay("fd_advise", fd, offset, length, advice)
+	return errno
+}
+
+func (r *replayer) FDAllocate(ctx context.Context, fd FD, offset FileSize, length FileSize) Errno {
+	_, errno := r.replay("fd_allocate", fd, offset, length)
+	return errno
+}
+
+func (r *replayer) FDClose(ctx context.Context, fd FD) Errno {
+	_, errno := r.replay("fd_close", fd)
+	return errno
+}
+
+func (r *replayer) FDDataSync(ctx context.Context, fd FD) Errno {
+	_, errno := r.replay("fd_datasync", fd)
+	return errno
+}
+
+func (r *replayer) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	values, errno := r.replay("fd_fdstat_get", fd)
+	return valueAt[FDStat](values, 0), errno
+}
+
+func (r *replayer) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	_, errno := r.replay("fd_fdstat_set_flags", fd, flags)
+	return errno
+}
+
+func (r *replayer) FDStatSetRights(ctx context.Context, fd FD, rightsBase Rights, rightsInheriting Rights) Errno {
+	_, errno := r.replay("fd_fdstat_set_rights", fd, rightsBase, rightsInheriting)
+	return errno
+}
+
+func (r *replayer) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	values, errno := r.replay("fd_filestat_get", fd)
+	return valueAt[FileStat](values, 0), errno
+}
+
+func (r *replayer) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	_, errno := r.replay("fd_filestat_set_size", fd, size)
+	return errno
+}
+
+func (r *replayer) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	_, errno := r.replay("fd_filestat_set_times", fd, accessTime, modifyTime, flags)
+	return errno
+}
+
+func (r *replayer) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	values, errno := r.replay("fd_pread", fd, iovecsSize(iovecs), offset)
+	copyData(iovecs, valueAt[[]byte](values, 1))
+	return valueAt[Size](values, 0), errno
+}
+
+func (r *replayer) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	values, errno := r.replay("fd_prestat_get", fd)
+	return valueAt[PreStat](values, 0), errno
+}
+
+func (r *replayer) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	values, errno := r.replay("fd_prestat_dir_name", fd)
+	return valueAt[string](values, 0), errno
+}
+
+func (r *replayer) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	values, errno := r.replay("fd_pwrite", fd, iovecsSize(iovecs), offset)
+	return valueAt[Size](values, 0), errno
+}
+
+func (r *replayer) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	values, errno := r.replay("fd_read", fd, iovecsSize(iovecs))
+	copyData(iovecs, valueAt[[]byte](values, 1))
+	return valueAt[Size](values, 0), errno
+}
+
+func (r *replayer) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	values, errno := r.replay("fd_readdir", fd, len(entries), cookie, bufferSizeBytes)
+	copy(entries, valueAt[[]DirEntry](values, 1))
+	return valueAt[int](values, 0), errno
+}
+
+func (r *replayer) FDRenumber(ctx context.Context, from FD, to FD) Errno {
+	_, errno := r.replay("fd_renumber", from, to)
+	return errno
+}
+
+func (r *replayer) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	values, errno := r.replay("fd_seek", fd, offset, whence)
+	return valueAt[FileSize](values, 0), errno
+}
+
+func (r *replayer) FDSync(ctx context.Context, fd FD) Errno {
+	_, errno := r.replay("fd_sync", fd)
+	return errno
+}
+
+func (r *replayer) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	values, errno := r.replay("fd_tell", fd)
+	return valueAt[FileSize](values, 0), errno
+}
+
+func (r *replayer) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	values, errno := r.replay("fd_write", fd, iovecsSize(iovecs))
+	n := valueAt[Size](values, 0)
+	if (fd == 1 || fd == 2) && n > 0 {
+		// Forward the output of the guest, so it can be observed as it was
+		// during the recording.
+		r.system.FDWrite(ctx, fd, []IOVec{readData(iovecs, int(n))})
+	}
+	return n, errno
+}
+
+func (r *replayer) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	_, errno := r.replay("path_create_directory", fd, path)
+	return errno
+}
+
+func (r *replayer) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	values, errno := r.replay("path_filestat_get", fd, lookupFlags, path)
+	return valueAt[FileStat](values, 0), errno
+}
+
+func (r *replayer) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	_, errno := r.replay("path_filestat_set_times", fd, lookupFlags, path, accessTime, modifyTime, flags)
+	return errno
+}
+
+func (r *replayer) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	_, errno := r.replay("path_link", oldFD, oldFlags, oldPath, newFD, newPath)
+	return errno
+}
+
+func (r *replayer) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase Rights, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	values, errno := r.replay("path_open", fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	return valueAt[FD](values, 0), errno
+}
+
+func (r *replayer) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	values, errno := r.replay("path_readlink", fd, path, len(buffer))
+	copy(buffer, valueAt[[]byte](values, 1))
+	return valueAt[int](values, 0), errno
+}
+
+func (r *replayer) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	_, errno := r.replay("path_remove_directory", fd, path)
+	return errno
+}
+
+func (r *replayer) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	_, errno := r.replay("path_rename", fd, oldPath, newFD, newPath)
+	return errno
+}
+
+func (r *replayer) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	_, errno := r.replay("path_symlink", oldPath, fd, newPath)
+	return errno
+}
+
+func (r *replayer) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	_, errno := r.replay("path_unlink_file", fd, path)
+	return errno
+}
+
+func (r *replayer) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	values, errno := r.replay("poll_oneoff", subscriptions, len(events))
+	copy(events, valueAt[[]Event](values, 1))
+	return valueAt[int](values, 0), errno
+}
+
+func (r *replayer) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	// The guest is terminated even if the replay diverged, since it does
+	// not expect proc_exit to return.
+	r.replay("proc_exit", exitCode)
+	return r.system.ProcExit(ctx, exitCode)
+}
+
+func (r *replayer) ProcRaise(ctx context.Context, signal Signal) Errno {
+	_, errno := r.replay("proc_raise", signal)
+	return errno
+}
+
+func (r *replayer) SchedYield(ctx context.Context) Errno {
+	_, errno := r.replay("sched_yield")
+	return errno
+}
+
+func (r *replayer) RandomGet(ctx context.Context, b []byte) Errno {
+	values, errno := r.replay("random_get", len(b))
+	copy(b, valueAt[[]byte](values, 0))
+	return errno
+}
+
+func (r *replayer) SockOpen(ctx context.Context, family ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase Rights, rightsInheriting Rights) (FD, Errno) {
+	values, errno := r.replay("sock_open", family, socketType, protocol, rightsBase, rightsInheriting)
+	return valueAt[FD](values, 0), errno
+}
+
+func (r *replayer) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	values, errno := r.replay("sock_bind", fd, addr)
+	return valueAt[SocketAddress](values, 0), errno
+}
+
+func (r *replayer) SockConnect(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	values, errno := r.replay("sock_connect", fd, addr)
+	return valueAt[SocketAddress](values, 0), errno
+}
+
+func (r *replayer) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	_, errno := r.replay("sock_listen", fd, backlog)
+	return errno
+}
+
+func (r *replayer) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	values, errno := r.replay("sock_accept", fd, flags)
+	return valueAt[FD](values, 0), valueAt[SocketAddress](values, 1), valueAt[SocketAddress](values, 2), errno
+}
+
+func (r *replayer) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	values, errno := r.replay("sock_recv", fd, iovecsSize(iovecs), flags)
+	copyData(iovecs, valueAt[[]byte](values, 2))
+	return valueAt[Size](values, 0), valueAt[ROFlags](values, 1), errno
+}
+
+func (r *replayer) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	values, errno := r.replay("sock_send", fd, iovecsSize(iovecs), flags)
+	return valueAt[Size](values, 0), errno
+}
+
+func (r *replayer) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	values, errno := r.replay("sock_send_to", fd, iovecsSize(iovecs), flags, addr)
+	return valueAt[Size](values, 0), errno
+}
+
+func (r *replayer) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	values, errno := r.replay("sock_recv_from", fd, iovecsSize(iovecs), flags)
+	copyData(iovecs, valueAt[[]byte](values, 3))
+	return valueAt[Size](values, 0), valueAt[ROFlags](values, 1), valueAt[SocketAddress](values, 2), errno
+}
+
+func (r *replayer) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	values, errno := r.replay("sock_getsockopt", fd, option)
+	return valueAt[SocketOptionValue](values, 0), errno
+}
+
+func (r *replayer) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	_, errno := r.replay("sock_setsockopt", fd, option, value)
+	return errno
+}
+
+func (r *replayer) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	values, errno := r.replay("sock_getlocaladdr", fd)
+	return valueAt[SocketAddress](values, 0), errno
+}
+
+func (r *replayer) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	values, errno := r.replay("sock_getpeeraddr", fd)
+	return valueAt[SocketAddress](values, 0), errno
+}
+
+func (r *replayer) SockAddressInfo(ctx context.Context, name string, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	values, errno := r.replay("sock_getaddrinfo", name, service, hints, len(results))
+	copy(results, valueAt[[]AddressInfo](values, 1))
+	return valueAt[int](values, 0), errno
+}
+
+func (r *replayer) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	_, errno := r.replay("sock_shutdown", fd, flags)
+	return errno
+}
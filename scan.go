@@ -0,0 +1,224 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+)
+
+// WriteScanner is a function called with the path and the content of files
+// written by the guest. Returning an error fails the operation which
+// triggered the scan.
+type WriteScanner func(ctx context.Context, path string, r io.Reader) error
+
+// ScanWrites wraps a System to invoke the scanner when the guest closes or
+// syncs files that it has written to, so the host can inspect the outputs of
+// the guest (e.g. to detect malware or secrets, or to validate the schema of
+// the data) before they are consumed.
+//
+// The path passed to the scanner is the path of the file in the mount
+// namespace of the guest, prefixed with the name of the preopened directory
+// that it was opened from.
+//
+// When the scanner returns an error, the system call fails with EIO (the
+// file descriptor is still closed by fd_close), and the errors are reported
+// when the system is closed, allowing the embedder to fail the run.
+func ScanWrites(system System, scan WriteScanner) System {
+	return &writeScanner{
+		System: system,
+		scan:   scan,
+		files:  make(map[FD]*scannedFile),
+	}
+}
+
+type writeScanner struct {
+	System
+	scan   WriteScanner
+	mutex  sync.Mutex
+	files  map[FD]*scannedFile
+	errors []error
+}
+
+type scannedFile struct {
+	dirfd FD
+	path  string // relative to dirfd
+	name  string // path in the mount namespace
+	dirty bool
+}
+
+func (s *writeScanner) dirName(ctx context.Context, fd FD) (string, bool) {
+	s.mutex.Lock()
+	f, ok := s.files[fd]
+	s.mutex.Unlock()
+	if ok {
+		return f.name, true
+	}
+	name, errno := s.System.FDPreStatDirName(ctx, fd)
+	return name, errno == ESUCCESS
+}
+
+func (s *writeScanner) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, p string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	newfd, errno := s.System.PathOpen(ctx, fd, dirFlags, p, openFlags, rightsBase, rightsInheriting, fdFlags)
+	if errno != ESUCCESS {
+		return newfd, errno
+	}
+	if dir, ok := s.dirName(ctx, fd); ok {
+		s.mutex.Lock()
+		s.files[newfd] = &scannedFile{
+			dirfd: fd,
+			path:  p,
+			name:  path.Join(dir, p),
+			// Truncating a file is a change of its content, even if the
+			// guest does not write to it afterwards.
+			dirty: openFlags.Has(OpenCreate) || openFlags.Has(OpenTruncate),
+		}
+		s.mutex.Unlock()
+	}
+	return newfd, ESUCCESS
+}
+
+func (s *writeScanner) markDirty(fd FD, errno Errno) {
+	if errno == ESUCCESS {
+		s.mutex.Lock()
+		if f, ok := s.files[fd]; ok {
+			f.dirty = true
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *writeScanner) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n, errno := s.System.FDWrite(ctx, fd, iovecs)
+	s.markDirty(fd, errno)
+	return n, errno
+}
+
+func (s *writeScanner) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	n, errno := s.System.FDPwrite(ctx, fd, iovecs, offset)
+	s.markDirty(fd, errno)
+	return n, errno
+}
+
+func (s *writeScanner) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	errno := s.System.FDAllocate(ctx, fd, offset, length)
+	s.markDirty(fd, errno)
+	return errno
+}
+
+func (s *writeScanner) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	errno := s.System.FDFileStatSetSize(ctx, fd, size)
+	s.markDirty(fd, errno)
+	return errno
+}
+
+func (s *writeScanner) FDSync(ctx context.Context, fd FD) Errno {
+	if errno := s.System.FDSync(ctx, fd); errno != ESUCCESS {
+		return errno
+	}
+	return s.scanFile(ctx, fd)
+}
+
+func (s *writeScanner) FDDataSync(ctx context.Context, fd FD) Errno {
+	if errno := s.System.FDDataSync(ctx, fd); errno != ESUCCESS {
+		return errno
+	}
+	return s.scanFile(ctx, fd)
+}
+
+func (s *writeScanner) FDClose(ctx context.Context, fd FD) Errno {
+	scanErrno := s.scanFile(ctx, fd)
+	s.mutex.Lock()
+	delete(s.files, fd)
+	s.mutex.Unlock()
+	if errno := s.System.FDClose(ctx, fd); errno != ESUCCESS {
+		return errno
+	}
+	return scanErrno
+}
+
+func (s *writeScanner) FDRenumber(ctx context.Context, from, to FD) Errno {
+	if errno := s.System.FDRenumber(ctx, from, to); errno != ESUCCESS {
+		return errno
+	}
+	s.mutex.Lock()
+	if f, ok := s.files[from]; ok {
+		s.files[to] = f
+	} else {
+		delete(s.files, to)
+	}
+	delete(s.files, from)
+	s.mutex.Unlock()
+	return ESUCCESS
+}
+
+// scanFile scans the file opened as fd if it was written to since the last
+// scan.
+func (s *writeScanner) scanFile(ctx context.Context, fd FD) Errno {
+	s.mutex.Lock()
+	f, ok := s.files[fd]
+	if !ok || !f.dirty {
+		s.mutex.Unlock()
+		return ESUCCESS
+	}
+	f.dirty = false
+	s.mutex.Unlock()
+
+	// Read the file through the file descriptor of the guest if it was
+	// opened with the rights to do so, otherwise open the file again.
+	const readRights = FDReadRight | FDSeekRight
+	r := &fileReader{ctx: ctx, system: s.System, fd: fd}
+	if stat, errno := s.System.FDStatGet(ctx, fd); errno != ESUCCESS || !stat.RightsBase.Has(readRights) {
+		readfd, errno := s.System.PathOpen(ctx, f.dirfd, SymlinkFollow, f.path, 0, readRights, 0, 0)
+		if errno != ESUCCESS {
+			return s.fail(fmt.Errorf("scan %s: %w", f.name, errno))
+		}
+		defer s.System.FDClose(ctx, readfd)
+		r.fd = readfd
+	}
+
+	if err := s.scan(ctx, f.name, r); err != nil {
+		return s.fail(fmt.Errorf("scan %s: %w", f.name, err))
+	}
+	return ESUCCESS
+}
+
+func (s *writeScanner) fail(err error) Errno {
+	s.mutex.Lock()
+	s.errors = append(s.errors, err)
+	s.mutex.Unlock()
+	return EIO
+}
+
+func (s *writeScanner) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	errs := s.errors
+	s.mutex.Unlock()
+	return errors.Join(append([]error{s.System.Close(ctx)}, errs...)...)
+}
+
+// fileReader is an io.Reader reading a file from the beginning with
+// fd_pread, so the offset of the file descriptor is left unchanged.
+type fileReader struct {
+	ctx    context.Context
+	system System
+	fd     FD
+	offset FileSize
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, errno := r.system.FDPread(r.ctx, r.fd, []IOVec{b}, r.offset)
+	if errno != ESUCCESS {
+		return 0, errno
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	r.offset += FileSize(n)
+	return int(n), nil
+}
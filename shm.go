@@ -0,0 +1,169 @@
+package wasi
+
+import "sync"
+
+// SharedMemoryFlags are flags used to open shared memory segments.
+type SharedMemoryFlags uint32
+
+const (
+	// SharedMemoryCreate creates the segment if it does not exist.
+	SharedMemoryCreate SharedMemoryFlags = 1 << iota
+
+	// SharedMemoryExclusive fails with EEXIST if the segment exists, when
+	// used with SharedMemoryCreate.
+	SharedMemoryExclusive
+)
+
+// Has is true if the flag is set.
+func (flags SharedMemoryFlags) Has(f SharedMemoryFlags) bool {
+	return (flags & f) == f
+}
+
+// SharedMemoryLimits are limits on the size of shared memory segments. Zero
+// values mean no limit.
+type SharedMemoryLimits struct {
+	// MaxSegmentSize is the maximum size of a segment, in bytes.
+	MaxSegmentSize int64
+	// MaxTotalSize is the maximum size of all the segments, in bytes.
+	MaxTotalSize int64
+}
+
+// SharedMemory is a set of named memory segments shared by the guests of the
+// host modules configured with it, which lets guests running on the same host
+// exchange data (e.g. in producer/consumer pipelines) without serializing it
+// over sockets.
+//
+// The segments live in the memory of the host, guests copy data in and out of
+// them; the reads and writes of a segment are atomic with respect to each
+// other. A segment is removed when the last guest which opened it closes it.
+type SharedMemory struct {
+	limits   SharedMemoryLimits
+	mutex    sync.Mutex
+	segments map[string]*SharedSegment
+	total    int64
+}
+
+// NewSharedMemory creates a set of shared memory segments with the given
+// limits.
+func NewSharedMemory(limits SharedMemoryLimits) *SharedMemory {
+	return &SharedMemory{
+		limits:   limits,
+		segments: make(map[string]*SharedSegment),
+	}
+}
+
+// Open opens the segment with the given name, creating it with the given size
+// if flags has SharedMemoryCreate and the segment does not exist. The size is
+// ignored when opening an existing segment, the size of segments never
+// changes. Each call to Open must be paired with a call to Close on the
+// returned segment.
+//
+// Open returns ENOENT if the segment does not exist and SharedMemoryCreate is
+// not set, and ENOMEM if creating the segment would exceed the limits.
+func (m *SharedMemory) Open(name string, size int64, flags SharedMemoryFlags) (*SharedSegment, Errno) {
+	if name == "" {
+		return nil, EINVAL
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if s, ok := m.segments[name]; ok {
+		if flags.Has(SharedMemoryCreate | SharedMemoryExclusive) {
+			return nil, EEXIST
+		}
+		s.refs++
+		return s, ESUCCESS
+	}
+	if !flags.Has(SharedMemoryCreate) {
+		return nil, ENOENT
+	}
+	if size <= 0 {
+		return nil, EINVAL
+	}
+	if m.limits.MaxSegmentSize > 0 && size > m.limits.MaxSegmentSize {
+		return nil, ENOMEM
+	}
+	if m.limits.MaxTotalSize > 0 && m.total+size > m.limits.MaxTotalSize {
+		return nil, ENOMEM
+	}
+	s := &SharedSegment{
+		memory: m,
+		name:   name,
+		data:   make([]byte, size),
+		refs:   1,
+	}
+	m.segments[name] = s
+	m.total += int64(len(s.data))
+	return s, ESUCCESS
+}
+
+// TotalSize returns the size of all the segments, in bytes.
+func (m *SharedMemory) TotalSize() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.total
+}
+
+// SharedSegment is a segment of a SharedMemory.
+type SharedSegment struct {
+	memory *SharedMemory
+	name   string
+	refs   int // guarded by the mutex of the SharedMemory
+	mutex  sync.RWMutex
+	data   []byte
+}
+
+// Name returns the name of the segment.
+func (s *SharedSegment) Name() string {
+	return s.name
+}
+
+// Size returns the size of the segment, in bytes.
+func (s *SharedSegment) Size() int64 {
+	return int64(len(s.data))
+}
+
+// ReadAt copies the content of the segment at offset to b. It returns the
+// number of bytes copied, which is less than len(b) when the range extends
+// past the end of the segment.
+func (s *SharedSegment) ReadAt(b []byte, offset int64) (int, Errno) {
+	if offset < 0 {
+		return 0, EINVAL
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if offset >= int64(len(s.data)) {
+		return 0, ESUCCESS
+	}
+	return copy(b, s.data[offset:]), ESUCCESS
+}
+
+// WriteAt copies b to the segment at offset. It returns the number of bytes
+// copied, which is less than len(b) when the range extends past the end of
+// the segment, or ENOSPC if no bytes could be copied.
+func (s *SharedSegment) WriteAt(b []byte, offset int64) (int, Errno) {
+	if offset < 0 {
+		return 0, EINVAL
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if offset >= int64(len(s.data)) {
+		if len(b) == 0 {
+			return 0, ESUCCESS
+		}
+		return 0, ENOSPC
+	}
+	return copy(s.data[offset:], b), ESUCCESS
+}
+
+// Close releases the segment, which is removed when it was closed as many
+// times as it was opened.
+func (s *SharedSegment) Close() {
+	m := s.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s.refs--; s.refs == 0 {
+		delete(m.segments, s.name)
+		m.total -= int64(len(s.data))
+	}
+}
@@ -318,8 +318,9 @@ func (st SocketType) String() string {
 type SocketOptionLevel int32
 
 const (
-	SocketLevel SocketOptionLevel = 0 // SOL_SOCKET
-	TcpLevel    SocketOptionLevel = 6 // IPPROTO_TCP
+	SocketLevel SocketOptionLevel = 0  // SOL_SOCKET
+	TcpLevel    SocketOptionLevel = 6  // IPPROTO_TCP
+	IPv6Level   SocketOptionLevel = 41 // IPPROTO_IPV6
 )
 
 func (sl SocketOptionLevel) String() string {
@@ -328,6 +329,8 @@ func (sl SocketOptionLevel) String() string {
 		return "SocketLevel"
 	case TcpLevel:
 		return "TcpLevel"
+	case IPv6Level:
+		return "IPv6Level"
 	default:
 		return fmt.Sprintf("SocketOptionLevel(%d)", sl)
 	}
@@ -365,7 +368,23 @@ const (
 
 // IPPROTO_TCP level options
 const (
-	TcpNoDelay SocketOption = (SocketOption(TcpLevel) << 32) | (15)
+	TcpNoDelay SocketOption = (SocketOption(TcpLevel) << 32) | (15 + iota)
+	// TcpKeepIdle is the idle time in seconds before the first keep-alive
+	// probe is sent (TCP_KEEPIDLE, or TCP_KEEPALIVE on darwin).
+	TcpKeepIdle
+	// TcpKeepInterval is the time in seconds between keep-alive probes.
+	TcpKeepInterval
+	// TcpKeepCount is the number of unanswered keep-alive probes after which
+	// the connection is dropped.
+	TcpKeepCount
+)
+
+// IPPROTO_IPV6 level options
+const (
+	// IPv6Only restricts IPv6 sockets to IPv6 peers (IPV6_V6ONLY). When it
+	// is not set, IPv6 sockets also communicate with IPv4 peers, which have
+	// v4-mapped addresses (e.g. ::ffff:192.0.2.1).
+	IPv6Only SocketOption = (SocketOption(IPv6Level) << 32) | (26)
 )
 
 func (so SocketOption) String() string {
@@ -402,6 +421,14 @@ func (so SocketOption) String() string {
 		return "BindToDevice"
 	case TcpNoDelay:
 		return "TcpNoDelay"
+	case TcpKeepIdle:
+		return "TcpKeepIdle"
+	case TcpKeepInterval:
+		return "TcpKeepInterval"
+	case TcpKeepCount:
+		return "TcpKeepCount"
+	case IPv6Only:
+		return "IPv6Only"
 	default:
 		return fmt.Sprintf("SocketOption(%d|%d)", so.Level(), int32(so))
 	}
@@ -545,11 +572,11 @@ func (SocketsNotSupported) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOV
 	return 0, 0, nil, ENOSYS
 }
 
-func (SocketsNotSupported) SockGetOpt(ctx context.Context, fd FD, level SocketOptionLevel, option SocketOption) (SocketOptionValue, Errno) {
+func (SocketsNotSupported) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
 	return nil, ENOSYS
 }
 
-func (SocketsNotSupported) SockSetOpt(ctx context.Context, fd FD, level SocketOptionLevel, option SocketOption, value SocketOptionValue) Errno {
+func (SocketsNotSupported) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
 	return ENOSYS
 }
 
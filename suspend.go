@@ -0,0 +1,145 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SuspendPolicy is the behavior of the clocks and of the timeouts of
+// poll_oneoff observed by guests when the host is suspended (e.g. a laptop
+// going to sleep) and resumed.
+type SuspendPolicy int
+
+const (
+	// PauseOnSuspend pauses the monotonic clock while the host is
+	// suspended, guests do not observe jumps of the monotonic time and the
+	// pending timeouts are delayed by the duration of the suspension. This
+	// is the default behavior.
+	PauseOnSuspend SuspendPolicy = iota
+	// FireOnResume keeps the monotonic clock advancing while the host is
+	// suspended, and fires the timeouts which expired during the suspension
+	// when the host resumes (see FireTimersOnResume).
+	FireOnResume
+)
+
+func (p SuspendPolicy) String() string {
+	switch p {
+	case PauseOnSuspend:
+		return "pause"
+	case FireOnResume:
+		return "fire"
+	default:
+		return fmt.Sprintf("SuspendPolicy(%d)", int(p))
+	}
+}
+
+// ParseSuspendPolicy parses the name of a suspend policy, either "pause" or
+// "fire".
+func ParseSuspendPolicy(name string) (SuspendPolicy, error) {
+	switch name {
+	case "pause":
+		return PauseOnSuspend, nil
+	case "fire":
+		return FireOnResume, nil
+	default:
+		return 0, fmt.Errorf("invalid suspend policy %q, expected pause or fire", name)
+	}
+}
+
+// FireTimersOnResume wraps a System so that the timeouts of poll_oneoff are
+// measured against the clocks of the system, instead of the time that the
+// host spends waiting for events.
+//
+// Hosts usually do not count the time during which they are suspended in
+// the timeouts of blocking calls. When the clocks of the system keep
+// advancing during the suspension (e.g. the realtime clock, or a monotonic
+// clock like unix.BootTime), the guest would observe its timers firing
+// late after the host resumed. The wrapper blocks for at most interval at a
+// time, and reports the clock events which expired in the meantime, so the
+// timers fire at most interval after the host resumes.
+func FireTimersOnResume(system System, interval time.Duration) System {
+	return &resumeTimers{System: system, interval: Timestamp(interval)}
+}
+
+type resumeTimers struct {
+	System
+	interval Timestamp
+}
+
+type resumeTimer struct {
+	userData UserData
+	clock    ClockID
+	deadline Timestamp
+}
+
+func (r *resumeTimers) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	if len(subscriptions) == 0 || len(events) < len(subscriptions) {
+		return 0, EINVAL
+	}
+
+	var fdSubscriptions []Subscription
+	var timers []resumeTimer
+	for i := range subscriptions {
+		s := &subscriptions[i]
+		if s.EventType != ClockEvent {
+			fdSubscriptions = append(fdSubscriptions, *s)
+			continue
+		}
+		c := s.GetClock()
+		t := c.Timeout
+		if !c.Flags.Has(Abstime) {
+			now, errno := r.System.ClockTimeGet(ctx, c.ID, 1)
+			if errno != ESUCCESS {
+				// Let the system report the error of the subscription.
+				return r.System.PollOneOff(ctx, subscriptions, events)
+			}
+			t += now
+		}
+		timers = append(timers, resumeTimer{userData: s.UserData, clock: c.ID, deadline: t})
+	}
+	if len(timers) == 0 {
+		return r.System.PollOneOff(ctx, subscriptions, events)
+	}
+
+	buffer := make([]Event, len(fdSubscriptions)+1)
+	for {
+		numEvents := 0
+		wait := r.interval
+		for _, t := range timers {
+			now, errno := r.System.ClockTimeGet(ctx, t.clock, 1)
+			if errno != ESUCCESS {
+				return 0, errno
+			}
+			if now >= t.deadline {
+				events[numEvents] = Event{UserData: t.userData, EventType: ClockEvent}
+				numEvents++
+			} else if remain := t.deadline - now; remain < wait {
+				wait = remain
+			}
+		}
+		if numEvents > 0 {
+			return numEvents, ESUCCESS
+		}
+
+		// The timeout is only an upper bound of the time spent blocking,
+		// the deadlines are verified against the clocks of the system.
+		subs := append(fdSubscriptions, MakeSubscriptionClock(0, SubscriptionClock{
+			ID:      Monotonic,
+			Timeout: wait,
+		}))
+		n, errno := r.System.PollOneOff(ctx, subs, buffer[:len(subs)])
+		if errno != ESUCCESS {
+			return n, errno
+		}
+		for _, e := range buffer[:n] {
+			if e.EventType != ClockEvent {
+				events[numEvents] = e
+				numEvents++
+			}
+		}
+		if numEvents > 0 {
+			return numEvents, ESUCCESS
+		}
+	}
+}
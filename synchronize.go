@@ -0,0 +1,369 @@
+package wasi
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Synchronize wraps a System to make it safe for concurrent use, which is
+// required when multiple threads of a guest (e.g. with wasi-threads), or
+// multiple concurrent invocations of its exports, make system calls.
+//
+// Rather than serializing all the system calls with a global mutex, the
+// wrapper uses a lock per file descriptor: calls on different file
+// descriptors run concurrently, as do calls reading or writing the same
+// file descriptor, while calls changing the state of a file descriptor
+// (fd_fdstat_set_flags, fd_fdstat_set_rights, fd_close, fd_renumber), and
+// calls using the state of a directory listing (fd_readdir, fd_seek), are
+// serialized with the other calls on it. Calls which do not use file
+// descriptors, including poll_oneoff, are not synchronized.
+//
+// The wrapped system must be safe for concurrent calls on different file
+// descriptors, and for concurrent reads and writes of the same file
+// descriptor, which is the case of the systems based on FileTable (e.g.
+// unix.System and iofs.System). Mux is not, since it tracks the file
+// descriptors that it routes in a table of its own.
+func Synchronize(system System) System {
+	return &synchronized{
+		System: system,
+		fds:    make(map[FD]*fdLock),
+	}
+}
+
+type synchronized struct {
+	System
+	mutex sync.Mutex
+	fds   map[FD]*fdLock
+}
+
+// fdLock is the lock of a file descriptor. It is marked closed when the file
+// descriptor is closed, so the calls which were in progress can tell.
+type fdLock struct {
+	sync.RWMutex
+	closed atomic.Bool
+}
+
+// fd returns the lock of a file descriptor. Since the lowest numbers are
+// reused first, the map stays bounded by the number of file descriptors that
+// the guest has open at the same time.
+func (s *synchronized) fd(fd FD) *fdLock {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l := s.fds[fd]
+	if l == nil {
+		l = new(fdLock)
+		s.fds[fd] = l
+	}
+	return l
+}
+
+// close marks the lock of a closed file descriptor closed, and removes it so
+// the calls on a new file descriptor reusing the number do not wait for the
+// calls still in progress on the closed one.
+func (s *synchronized) close(fd FD) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if l := s.fds[fd]; l != nil {
+		l.closed.Store(true)
+		delete(s.fds, fd)
+	}
+}
+
+func (s *synchronized) rlock(fd FD) *fdLock {
+	l := s.fd(fd)
+	l.RLock()
+	return l
+}
+
+func (s *synchronized) lock(fd FD) *fdLock {
+	l := s.fd(fd)
+	l.Lock()
+	return l
+}
+
+// rlock2 acquires the read locks of two file descriptors, in ascending order
+// to prevent deadlocks with other calls locking the same file descriptors.
+func (s *synchronized) rlock2(fd1, fd2 FD) []*fdLock {
+	if fd1 == fd2 {
+		return []*fdLock{s.rlock(fd1)}
+	}
+	if fd1 > fd2 {
+		fd1, fd2 = fd2, fd1
+	}
+	return []*fdLock{s.rlock(fd1), s.rlock(fd2)}
+}
+
+func (s *synchronized) FDClose(ctx context.Context, fd FD) Errno {
+	errno := s.System.FDClose(ctx, fd)
+	if errno == ESUCCESS {
+		s.close(fd)
+	}
+	return errno
+}
+
+func (s *synchronized) FDRenumber(ctx context.Context, from, to FD) Errno {
+	errno := s.System.FDRenumber(ctx, from, to)
+	if errno == ESUCCESS && from != to {
+		s.close(from)
+		s.close(to)
+	}
+	return errno
+}
+
+func (s *synchronized) FDAdvise(ctx context.Context, fd FD, offset FileSize, length FileSize, advice Advice) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDAdvise(ctx, fd, offset, length, advice)
+}
+
+func (s *synchronized) FDAllocate(ctx context.Context, fd FD, offset FileSize, length FileSize) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDAllocate(ctx, fd, offset, length)
+}
+
+func (s *synchronized) FDDataSync(ctx context.Context, fd FD) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDDataSync(ctx, fd)
+}
+
+func (s *synchronized) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDStatGet(ctx, fd)
+}
+
+func (s *synchronized) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDStatSetFlags(ctx, fd, flags)
+}
+
+func (s *synchronized) FDStatSetRights(ctx context.Context, fd FD, rightsBase Rights, rightsInheriting Rights) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+}
+
+func (s *synchronized) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDFileStatGet(ctx, fd)
+}
+
+func (s *synchronized) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDFileStatSetSize(ctx, fd, size)
+}
+
+func (s *synchronized) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+}
+
+func (s *synchronized) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDPread(ctx, fd, iovecs, offset)
+}
+
+func (s *synchronized) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDPreStatGet(ctx, fd)
+}
+
+func (s *synchronized) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDPreStatDirName(ctx, fd)
+}
+
+func (s *synchronized) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDPwrite(ctx, fd, iovecs, offset)
+}
+
+func (s *synchronized) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	n, errno := s.System.FDRead(ctx, fd, iovecs)
+	if l.closed.Load() {
+		return 0, EBADF
+	}
+	return n, errno
+}
+
+func (s *synchronized) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	defer s.lock(fd).Unlock()
+	return s.System.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+}
+
+func (s *synchronized) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	defer s.lock(fd).Unlock()
+	return s.System.FDSeek(ctx, fd, offset, whence)
+}
+
+func (s *synchronized) FDSync(ctx context.Context, fd FD) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDSync(ctx, fd)
+}
+
+func (s *synchronized) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.FDTell(ctx, fd)
+}
+
+func (s *synchronized) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	n, errno := s.System.FDWrite(ctx, fd, iovecs)
+	if l.closed.Load() {
+		return 0, EBADF
+	}
+	return n, errno
+}
+
+func (s *synchronized) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathCreateDirectory(ctx, fd, path)
+}
+
+func (s *synchronized) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathFileStatGet(ctx, fd, lookupFlags, path)
+}
+
+func (s *synchronized) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime Timestamp, modifyTime Timestamp, flags FSTFlags) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+}
+
+func (s *synchronized) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	for _, l := range s.rlock2(oldFD, newFD) {
+		defer l.RUnlock()
+	}
+	return s.System.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+}
+
+func (s *synchronized) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase Rights, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+}
+
+func (s *synchronized) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathReadLink(ctx, fd, path, buffer)
+}
+
+func (s *synchronized) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathRemoveDirectory(ctx, fd, path)
+}
+
+func (s *synchronized) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	for _, l := range s.rlock2(fd, newFD) {
+		defer l.RUnlock()
+	}
+	return s.System.PathRename(ctx, fd, oldPath, newFD, newPath)
+}
+
+func (s *synchronized) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathSymlink(ctx, oldPath, fd, newPath)
+}
+
+func (s *synchronized) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.PathUnlinkFile(ctx, fd, path)
+}
+
+func (s *synchronized) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockBind(ctx, fd, addr)
+}
+
+func (s *synchronized) SockConnect(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	local, errno := s.System.SockConnect(ctx, fd, addr)
+	if l.closed.Load() {
+		return nil, EBADF
+	}
+	return local, errno
+}
+
+func (s *synchronized) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockListen(ctx, fd, backlog)
+}
+
+func (s *synchronized) SockAccept(ctx context.Context, fd FD, flags FDFlags) (newfd FD, peer, addr SocketAddress, err Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	newfd, peer, addr, err = s.System.SockAccept(ctx, fd, flags)
+	if l.closed.Load() {
+		if err == ESUCCESS {
+			s.FDClose(ctx, newfd)
+		}
+		return -1, nil, nil, EBADF
+	}
+	return newfd, peer, addr, err
+}
+
+func (s *synchronized) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	n, oflags, errno := s.System.SockRecv(ctx, fd, iovecs, flags)
+	if l.closed.Load() {
+		return 0, 0, EBADF
+	}
+	return n, oflags, errno
+}
+
+func (s *synchronized) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	n, errno := s.System.SockSend(ctx, fd, iovecs, flags)
+	if l.closed.Load() {
+		return 0, EBADF
+	}
+	return n, errno
+}
+
+func (s *synchronized) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags, addr SocketAddress) (Size, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	n, errno := s.System.SockSendTo(ctx, fd, iovecs, flags, addr)
+	if l.closed.Load() {
+		return 0, EBADF
+	}
+	return n, errno
+}
+
+func (s *synchronized) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, flags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	l := s.rlock(fd)
+	defer l.RUnlock()
+	n, oflags, addr, errno := s.System.SockRecvFrom(ctx, fd, iovecs, flags)
+	if l.closed.Load() {
+		return 0, 0, nil, EBADF
+	}
+	return n, oflags, addr, errno
+}
+
+func (s *synchronized) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockGetOpt(ctx, fd, option)
+}
+
+func (s *synchronized) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockSetOpt(ctx, fd, option, value)
+}
+
+func (s *synchronized) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockLocalAddress(ctx, fd)
+}
+
+func (s *synchronized) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockRemoteAddress(ctx, fd)
+}
+
+func (s *synchronized) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	defer s.rlock(fd).RUnlock()
+	return s.System.SockShutdown(ctx, fd, flags)
+}
@@ -0,0 +1,408 @@
+package iofs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/stealthrocket/wasi-go"
+)
+
+// File is a file or directory of a fs.FS, implementing the wasi.File
+// interface.
+type File struct {
+	fsys fs.FS
+	name string  // path of the file in fsys
+	file fs.File // nil for directories, which are accessed by name
+	dir  bool
+}
+
+func (f *File) join(name string) (string, wasi.Errno) {
+	name = path.Join(f.name, name)
+	if !fs.ValidPath(name) {
+		return "", wasi.EPERM
+	}
+	return name, wasi.ESUCCESS
+}
+
+func (f *File) FDAdvise(ctx context.Context, offset, length wasi.FileSize, advice wasi.Advice) wasi.Errno {
+	return wasi.ESUCCESS
+}
+
+func (f *File) FDAllocate(ctx context.Context, offset, length wasi.FileSize) wasi.Errno {
+	return wasi.ENOTSUP
+}
+
+func (f *File) FDClose(ctx context.Context) wasi.Errno {
+	if f.file == nil {
+		return wasi.ESUCCESS
+	}
+	return makeErrno(f.file.Close())
+}
+
+func (f *File) FDDataSync(ctx context.Context) wasi.Errno {
+	return f.FDSync(ctx)
+}
+
+func (f *File) FDStatSetFlags(ctx context.Context, flags wasi.FDFlags) wasi.Errno {
+	// Files are always ready, the non-blocking flag has no effect.
+	if flags.Has(wasi.Append) {
+		return wasi.ENOTSUP
+	}
+	return wasi.ESUCCESS
+}
+
+func (f *File) FDFileStatGet(ctx context.Context) (wasi.FileStat, wasi.Errno) {
+	var info fs.FileInfo
+	var err error
+	if f.file != nil {
+		info, err = f.file.Stat()
+	} else {
+		info, err = fs.Stat(f.fsys, f.name)
+	}
+	if err != nil {
+		return wasi.FileStat{}, makeErrno(err)
+	}
+	return makeFileStat(info), wasi.ESUCCESS
+}
+
+func (f *File) FDFileStatSetSize(ctx context.Context, size wasi.FileSize) wasi.Errno {
+	t, ok := f.file.(interface{ Truncate(int64) error })
+	if !ok {
+		return f.unsupported(wasi.EROFS)
+	}
+	return makeErrno(t.Truncate(int64(size)))
+}
+
+func (f *File) FDFileStatSetTimes(ctx context.Context, accessTime, modifyTime wasi.Timestamp, flags wasi.FSTFlags) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+func (f *File) FDPread(ctx context.Context, iovecs []wasi.IOVec, offset wasi.FileSize) (wasi.Size, wasi.Errno) {
+	r, ok := f.file.(io.ReaderAt)
+	if !ok {
+		return 0, f.unsupported(wasi.ESPIPE)
+	}
+	size := wasi.Size(0)
+	for _, iov := range iovecs {
+		n, err := r.ReadAt(iov, int64(offset)+int64(size))
+		size += wasi.Size(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return size, makeErrno(err)
+		}
+	}
+	return size, wasi.ESUCCESS
+}
+
+func (f *File) FDPwrite(ctx context.Context, iovecs []wasi.IOVec, offset wasi.FileSize) (wasi.Size, wasi.Errno) {
+	w, ok := f.file.(io.WriterAt)
+	if !ok {
+		return 0, f.unsupported(wasi.EROFS)
+	}
+	size := wasi.Size(0)
+	for _, iov := range iovecs {
+		n, err := w.WriteAt(iov, int64(offset)+int64(size))
+		size += wasi.Size(n)
+		if err != nil {
+			return size, makeErrno(err)
+		}
+	}
+	return size, wasi.ESUCCESS
+}
+
+func (f *File) FDRead(ctx context.Context, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	if f.file == nil {
+		return 0, wasi.EISDIR
+	}
+	size := wasi.Size(0)
+	for _, iov := range iovecs {
+		n, err := io.ReadFull(f.file, iov)
+		size += wasi.Size(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return size, makeErrno(err)
+		}
+	}
+	return size, wasi.ESUCCESS
+}
+
+func (f *File) FDWrite(ctx context.Context, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	w, ok := f.file.(io.Writer)
+	if !ok {
+		return 0, f.unsupported(wasi.EROFS)
+	}
+	size := wasi.Size(0)
+	for _, iov := range iovecs {
+		n, err := w.Write(iov)
+		size += wasi.Size(n)
+		if err != nil {
+			return size, makeErrno(err)
+		}
+	}
+	return size, wasi.ESUCCESS
+}
+
+func (f *File) FDSync(ctx context.Context) wasi.Errno {
+	if s, ok := f.file.(interface{ Sync() error }); ok {
+		return makeErrno(s.Sync())
+	}
+	return wasi.ESUCCESS
+}
+
+func (f *File) FDSeek(ctx context.Context, delta wasi.FileDelta, whence wasi.Whence) (wasi.FileSize, wasi.Errno) {
+	s, ok := f.file.(io.Seeker)
+	if !ok {
+		return 0, f.unsupported(wasi.ESPIPE)
+	}
+	offset, err := s.Seek(int64(delta), int(whence))
+	return wasi.FileSize(offset), makeErrno(err)
+}
+
+// unsupported returns the errno of operations on files which are not
+// supported by the file system, or EISDIR for directories.
+func (f *File) unsupported(errno wasi.Errno) wasi.Errno {
+	if f.dir {
+		return wasi.EISDIR
+	}
+	return errno
+}
+
+func (f *File) FDOpenDir(ctx context.Context) (wasi.Dir, wasi.Errno) {
+	if !f.dir {
+		return nil, wasi.ENOTDIR
+	}
+	entries, err := fs.ReadDir(f.fsys, f.name)
+	if err != nil {
+		return nil, makeErrno(err)
+	}
+	return &dir{entries: entries}, wasi.ESUCCESS
+}
+
+func (f *File) PathCreateDirectory(ctx context.Context, name string) wasi.Errno {
+	name, errno := f.join(name)
+	if errno != wasi.ESUCCESS {
+		return errno
+	}
+	fsys, ok := f.fsys.(MkdirFS)
+	if !ok {
+		return wasi.EROFS
+	}
+	return makeErrno(fsys.Mkdir(name, 0755))
+}
+
+func (f *File) PathFileStatGet(ctx context.Context, flags wasi.LookupFlags, name string) (wasi.FileStat, wasi.Errno) {
+	name, errno := f.join(name)
+	if errno != wasi.ESUCCESS {
+		return wasi.FileStat{}, errno
+	}
+	info, err := fs.Stat(f.fsys, name)
+	if err != nil {
+		return wasi.FileStat{}, makeErrno(err)
+	}
+	return makeFileStat(info), wasi.ESUCCESS
+}
+
+func (f *File) PathFileStatSetTimes(ctx context.Context, lookupFlags wasi.LookupFlags, name string, accessTime, modifyTime wasi.Timestamp, flags wasi.FSTFlags) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+func (f *File) PathLink(ctx context.Context, flags wasi.LookupFlags, oldName string, newDir *File, newName string) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+func (f *File) PathOpen(ctx context.Context, lookupFlags wasi.LookupFlags, name string, openFlags wasi.OpenFlags, rightsBase, rightsInheriting wasi.Rights, fdFlags wasi.FDFlags) (*File, wasi.Errno) {
+	name, errno := f.join(name)
+	if errno != wasi.ESUCCESS {
+		return nil, errno
+	}
+
+	flag := 0
+	switch {
+	case openFlags.Has(wasi.OpenDirectory):
+	case rightsBase.Has(wasi.FDReadRight) && rightsBase.Has(wasi.FDWriteRight):
+		flag = os.O_RDWR
+	case rightsBase.Has(wasi.FDWriteRight):
+		flag = os.O_WRONLY
+	}
+	if openFlags.Has(wasi.OpenCreate) {
+		flag |= os.O_CREATE
+	}
+	if openFlags.Has(wasi.OpenExclusive) {
+		flag |= os.O_EXCL
+	}
+	if openFlags.Has(wasi.OpenTruncate) {
+		flag |= os.O_TRUNC
+	}
+	if fdFlags.Has(wasi.Append) {
+		flag |= os.O_APPEND
+	}
+
+	info, err := fs.Stat(f.fsys, name)
+	switch {
+	case err == nil:
+		if info.IsDir() {
+			if flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+				return nil, wasi.EISDIR
+			}
+			return &File{fsys: f.fsys, name: name, dir: true}, wasi.ESUCCESS
+		}
+		if openFlags.Has(wasi.OpenDirectory) {
+			return nil, wasi.ENOTDIR
+		}
+	case makeErrno(err) != wasi.ENOENT || flag&os.O_CREATE == 0:
+		return nil, makeErrno(err)
+	}
+
+	var file fs.File
+	if flag == 0 {
+		file, err = f.fsys.Open(name)
+	} else if fsys, ok := f.fsys.(OpenFileFS); ok {
+		file, err = fsys.OpenFile(name, flag, 0644)
+	} else {
+		return nil, wasi.EROFS
+	}
+	if err != nil {
+		return nil, makeErrno(err)
+	}
+	return &File{fsys: f.fsys, name: name, file: file}, wasi.ESUCCESS
+}
+
+func (f *File) PathReadLink(ctx context.Context, name string, buffer []byte) (int, wasi.Errno) {
+	name, errno := f.join(name)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	// The fs.FS interface does not expose symbolic links.
+	if _, err := fs.Stat(f.fsys, name); err != nil {
+		return 0, makeErrno(err)
+	}
+	return 0, wasi.EINVAL
+}
+
+func (f *File) PathRemoveDirectory(ctx context.Context, name string) wasi.Errno {
+	return f.remove(name, true)
+}
+
+func (f *File) PathUnlinkFile(ctx context.Context, name string) wasi.Errno {
+	return f.remove(name, false)
+}
+
+func (f *File) remove(name string, dir bool) wasi.Errno {
+	name, errno := f.join(name)
+	if errno != wasi.ESUCCESS {
+		return errno
+	}
+	info, err := fs.Stat(f.fsys, name)
+	if err != nil {
+		return makeErrno(err)
+	}
+	switch {
+	case dir && !info.IsDir():
+		return wasi.ENOTDIR
+	case !dir && info.IsDir():
+		return wasi.EISDIR
+	}
+	fsys, ok := f.fsys.(RemoveFS)
+	if !ok {
+		return wasi.EROFS
+	}
+	return makeErrno(fsys.Remove(name))
+}
+
+func (f *File) PathRename(ctx context.Context, oldName string, newDir *File, newName string) wasi.Errno {
+	oldName, errno := f.join(oldName)
+	if errno != wasi.ESUCCESS {
+		return errno
+	}
+	newName, errno = newDir.join(newName)
+	if errno != wasi.ESUCCESS {
+		return errno
+	}
+	if newDir.fsys != f.fsys {
+		return wasi.EXDEV
+	}
+	fsys, ok := f.fsys.(RenameFS)
+	if !ok {
+		return wasi.EROFS
+	}
+	return makeErrno(fsys.Rename(oldName, newName))
+}
+
+func (f *File) PathSymlink(ctx context.Context, oldName string, newName string) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+// dir is the state of fd_readdir on a directory, the entries are read when
+// the directory is opened and the cookies are their indexes.
+type dir struct {
+	entries []fs.DirEntry
+}
+
+func (d *dir) FDReadDir(ctx context.Context, entries []wasi.DirEntry, cookie wasi.DirCookie, bufferSizeBytes int) (int, wasi.Errno) {
+	n, size := 0, 0
+	// The first two entries are "." and "..", like on unix systems.
+	for i := int(cookie); i < len(d.entries)+2 && n < len(entries); i++ {
+		entry := wasi.DirEntry{Next: wasi.DirCookie(i + 1), Type: wasi.DirectoryType}
+		switch i {
+		case 0:
+			entry.Name = []byte(".")
+		case 1:
+			entry.Name = []byte("..")
+		default:
+			e := d.entries[i-2]
+			entry.Name = []byte(e.Name())
+			entry.Type = makeFileType(e.Type())
+		}
+		if n > 0 && size+wasi.SizeOfDirent+len(entry.Name) > bufferSizeBytes {
+			break
+		}
+		size += wasi.SizeOfDirent + len(entry.Name)
+		entries[n] = entry
+		n++
+	}
+	return n, wasi.ESUCCESS
+}
+
+func (d *dir) FDCloseDir(ctx context.Context) wasi.Errno {
+	return wasi.ESUCCESS
+}
+
+func makeFileStat(info fs.FileInfo) wasi.FileStat {
+	t := wasi.Timestamp(info.ModTime().UnixNano())
+	return wasi.FileStat{
+		FileType:   makeFileType(info.Mode()),
+		NLink:      1,
+		Size:       wasi.FileSize(info.Size()),
+		AccessTime: t,
+		ModifyTime: t,
+		ChangeTime: t,
+	}
+}
+
+func makeFileType(mode fs.FileMode) wasi.FileType {
+	switch mode.Type() {
+	case 0:
+		return wasi.RegularFileType
+	case fs.ModeDir:
+		return wasi.DirectoryType
+	case fs.ModeSymlink:
+		return wasi.SymbolicLinkType
+	case fs.ModeDevice:
+		return wasi.BlockDeviceType
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return wasi.CharacterDeviceType
+	case fs.ModeSocket:
+		return wasi.SocketStreamType
+	default:
+		return wasi.UnknownType
+	}
+}
+
+var _ wasi.File[*File] = (*File)(nil)
@@ -0,0 +1,200 @@
+// Package iofs implements a wasi.System exposing file systems implemented by
+// fs.FS values to the guest, instead of directories of the host.
+//
+// The system only implements the file system functions, it is intended to
+// be combined with a system providing the other functions (e.g. clocks or
+// sockets) with wasi.Mux.
+package iofs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+)
+
+// OpenFileFS is the interface implemented by file systems which support
+// opening files for writing, or creating files. The flags are those of
+// os.OpenFile, and the files must implement io.Writer to be written to.
+type OpenFileFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+// MkdirFS is the interface implemented by file systems which support
+// creating directories.
+type MkdirFS interface {
+	fs.FS
+	Mkdir(name string, perm fs.FileMode) error
+}
+
+// RemoveFS is the interface implemented by file systems which support
+// removing files and empty directories.
+type RemoveFS interface {
+	fs.FS
+	Remove(name string) error
+}
+
+// RenameFS is the interface implemented by file systems which support
+// renaming files and directories.
+type RenameFS interface {
+	fs.FS
+	Rename(oldName, newName string) error
+}
+
+// System is a WASI preview 1 implementation serving files from fs.FS values.
+//
+// File systems only supporting the fs.FS interface are read-only, the guest
+// is permitted to modify the files if they also implement OpenFileFS,
+// MkdirFS, RemoveFS or RenameFS; operations which are not supported fail
+// with EROFS.
+//
+// An instance of System is safe for concurrent calls on different file
+// descriptors, but not for all concurrent calls on the same file descriptor
+// (e.g. fd_close or fd_readdir); guests making concurrent system calls
+// require wrapping it with wasi.Synchronize.
+type System struct {
+	wasi.FileTable[*File]
+	wasi.SocketsNotSupported
+}
+
+var _ wasi.System = (*System)(nil)
+
+// Mount exposes fsys as a preopened directory at path, and returns its
+// file descriptor.
+func (s *System) Mount(fsys fs.FS, path string) wasi.FD {
+	return s.Preopen(&File{fsys: fsys, name: ".", dir: true}, path, wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.DirectoryRights,
+		RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+	})
+}
+
+// PreopenFile exposes file as a preopened file descriptor named name, and
+// returns it. This allows embedders to give the guest access to files which
+// are not part of a file system, for example to use in-memory buffers as
+// stdio; the file must implement io.Writer to be written to.
+func (s *System) PreopenFile(file fs.File, name string, stat wasi.FDStat) wasi.FD {
+	return s.Preopen(&File{file: file}, name, stat)
+}
+
+func (s *System) ArgsSizesGet(ctx context.Context) (int, int, wasi.Errno) {
+	return 0, 0, wasi.ESUCCESS
+}
+
+func (s *System) ArgsGet(ctx context.Context) ([]string, wasi.Errno) {
+	return nil, wasi.ESUCCESS
+}
+
+func (s *System) EnvironSizesGet(ctx context.Context) (int, int, wasi.Errno) {
+	return 0, 0, wasi.ESUCCESS
+}
+
+func (s *System) EnvironGet(ctx context.Context) ([]string, wasi.Errno) {
+	return nil, wasi.ESUCCESS
+}
+
+func (s *System) ClockResGet(ctx context.Context, id wasi.ClockID) (wasi.Timestamp, wasi.Errno) {
+	return 0, wasi.ENOSYS
+}
+
+func (s *System) ClockTimeGet(ctx context.Context, id wasi.ClockID, precision wasi.Timestamp) (wasi.Timestamp, wasi.Errno) {
+	return 0, wasi.ENOSYS
+}
+
+// PollOneOff reports the files as always ready for reading and writing. When
+// the guest only subscribes to relative monotonic timeouts, the call blocks
+// until the earliest one expires.
+func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscription, events []wasi.Event) (int, wasi.Errno) {
+	if len(subscriptions) == 0 || len(events) < len(subscriptions) {
+		return 0, wasi.EINVAL
+	}
+	numEvents := 0
+	for i := range subscriptions {
+		sub := &subscriptions[i]
+		if sub.EventType == wasi.ClockEvent {
+			continue
+		}
+		e := wasi.Event{UserData: sub.UserData, EventType: sub.EventType}
+		if _, _, errno := s.LookupFD(sub.GetFDReadWrite().FD, wasi.PollFDReadWriteRight); errno != wasi.ESUCCESS {
+			e.Errno = errno
+		}
+		events[numEvents] = e
+		numEvents++
+	}
+	if numEvents > 0 {
+		return numEvents, wasi.ESUCCESS
+	}
+
+	timeout := wasi.Timestamp(0)
+	for i := range subscriptions {
+		c := subscriptions[i].GetClock()
+		if c.ID != wasi.Monotonic || c.Flags.Has(wasi.Abstime) {
+			events[numEvents] = wasi.Event{UserData: subscriptions[i].UserData, EventType: wasi.ClockEvent, Errno: wasi.ENOTSUP}
+			numEvents++
+		} else if i == 0 || c.Timeout < timeout {
+			timeout = c.Timeout
+		}
+	}
+	if numEvents > 0 {
+		return numEvents, wasi.ESUCCESS
+	}
+
+	t := time.NewTimer(timeout.Duration())
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return 0, wasi.MakeErrno(ctx.Err())
+	}
+	for i := range subscriptions {
+		if subscriptions[i].GetClock().Timeout <= timeout {
+			events[numEvents] = wasi.Event{UserData: subscriptions[i].UserData, EventType: wasi.ClockEvent}
+			numEvents++
+		}
+	}
+	return numEvents, wasi.ESUCCESS
+}
+
+func (s *System) ProcExit(ctx context.Context, code wasi.ExitCode) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+func (s *System) ProcRaise(ctx context.Context, signal wasi.Signal) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+func (s *System) SchedYield(ctx context.Context) wasi.Errno {
+	return wasi.ESUCCESS
+}
+
+func (s *System) RandomGet(ctx context.Context, b []byte) wasi.Errno {
+	return wasi.ENOSYS
+}
+
+// makeErrno converts errors returned by the fs.FS interfaces, which are not
+// necessarily system errors, to errno values.
+func makeErrno(err error) wasi.Errno {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return wasi.ESUCCESS
+	case errors.As(err, &errno):
+		return wasi.MakeErrno(errno)
+	case errors.Is(err, fs.ErrNotExist):
+		return wasi.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return wasi.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return wasi.EPERM
+	case errors.Is(err, fs.ErrInvalid):
+		return wasi.EINVAL
+	case errors.Is(err, fs.ErrClosed):
+		return wasi.EBADF
+	default:
+		return wasi.EIO
+	}
+}
@@ -0,0 +1,76 @@
+package iofs_test
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/systems/iofs"
+)
+
+func TestSystem(t *testing.T) {
+	ctx := context.Background()
+	s := new(iofs.System)
+	defer s.Close(ctx)
+
+	root := s.Mount(fstest.MapFS{
+		"hello.txt":      {Data: []byte("hello world")},
+		"dir/nested.txt": {Data: []byte("nested")},
+	}, "/")
+
+	if name, errno := s.FDPreStatDirName(ctx, root); errno != wasi.ESUCCESS || name != "/" {
+		t.Fatalf("fd_prestat_dir_name: %q %s", name, errno)
+	}
+
+	fd, errno := s.PathOpen(ctx, root, 0, "hello.txt", 0, wasi.FDReadRight|wasi.FDSeekRight|wasi.FDFileStatGetRight, 0, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	buffer := make([]byte, 5)
+	if n, errno := s.FDPread(ctx, fd, []wasi.IOVec{buffer}, 6); errno != wasi.ESUCCESS || string(buffer[:n]) != "world" {
+		t.Errorf("fd_pread: %q %s", buffer[:n], errno)
+	}
+	if n, errno := s.FDRead(ctx, fd, []wasi.IOVec{buffer, buffer[:0]}); errno != wasi.ESUCCESS || string(buffer[:n]) != "hello" {
+		t.Errorf("fd_read: %q %s", buffer[:n], errno)
+	}
+	if stat, errno := s.FDFileStatGet(ctx, fd); errno != wasi.ESUCCESS || stat.FileType != wasi.RegularFileType || stat.Size != 11 {
+		t.Errorf("fd_filestat_get: %+v %s", stat, errno)
+	}
+	if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte("nope")}); errno != wasi.ENOTCAPABLE {
+		t.Errorf("fd_write: wrong errno: %s", errno)
+	}
+	if errno := s.FDClose(ctx, fd); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+
+	if _, errno := s.PathOpen(ctx, root, 0, "hello.txt", 0, wasi.FDWriteRight, 0, 0); errno != wasi.EROFS {
+		t.Errorf("path_open: opening for writing: wrong errno: %s", errno)
+	}
+	if _, errno := s.PathOpen(ctx, root, 0, "missing.txt", 0, wasi.FDReadRight, 0, 0); errno != wasi.ENOENT {
+		t.Errorf("path_open: missing file: wrong errno: %s", errno)
+	}
+	if _, errno := s.PathOpen(ctx, root, 0, "../escape", 0, wasi.FDReadRight, 0, 0); errno != wasi.EPERM {
+		t.Errorf("path_open: escaping the root: wrong errno: %s", errno)
+	}
+	if errno := s.PathUnlinkFile(ctx, root, "hello.txt"); errno != wasi.EROFS {
+		t.Errorf("path_unlink_file: wrong errno: %s", errno)
+	}
+
+	dirfd, errno := s.PathOpen(ctx, root, 0, "dir", wasi.OpenDirectory, wasi.FDReadDirRight, 0, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	entries := make([]wasi.DirEntry, 10)
+	n, errno := s.FDReadDir(ctx, dirfd, entries, 0, 4096)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	var names []string
+	for _, e := range entries[:n] {
+		names = append(names, string(e.Name))
+	}
+	if len(names) != 3 || names[2] != "nested.txt" || entries[2].Type != wasi.RegularFileType {
+		t.Errorf("fd_readdir: wrong entries: %q", names)
+	}
+}
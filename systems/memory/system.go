@@ -0,0 +1,179 @@
+// Package memory implements a wasi.System which runs entirely in memory, with
+// stdio backed by io.Reader and io.Writer values and file systems backed by
+// fs.FS values (e.g. fstest.MapFS).
+//
+// The package does not make system calls to the host, so it can be used on
+// any platform, including the ones where the unix system is not available,
+// and in sandboxes which restrict access to files or sockets. It is intended
+// for tests instantiating WebAssembly modules, for example:
+//
+//	stdout := new(bytes.Buffer)
+//	system := memory.New(nil, stdout, io.Discard)
+//	system.Args = []string{"app"}
+//	system.Mount(fstest.MapFS{"config.json": {Data: config}}, "/")
+package memory
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/systems/iofs"
+)
+
+// System is a wasi.System serving the file systems mounted with Mount, with
+// in-memory stdio. Sockets are not supported.
+//
+// An instance of System is not safe for concurrent use, guests making
+// concurrent system calls require wrapping it with wasi.Synchronize.
+type System struct {
+	iofs.System
+
+	// Args and Environ are the arguments and environment variables of the
+	// guest.
+	Args    []string
+	Environ []string
+
+	// Rand is the source of random_get. If Rand is nil, RandomGet returns
+	// ENOSYS.
+	Rand io.Reader
+
+	// Now returns the current time of the realtime and monotonic clocks, the
+	// monotonic clock starts at the first reading. If Now is nil, the clocks
+	// use the time of the host.
+	Now func() time.Time
+
+	epoch time.Time
+}
+
+var _ wasi.System = (*System)(nil)
+
+// New creates a System with stdin, stdout and stderr as the standard input
+// and outputs of the guest, at file descriptors 0, 1 and 2. A nil stdin is
+// empty, and the data written to nil outputs is discarded.
+func New(stdin io.Reader, stdout, stderr io.Writer) *System {
+	if stdin == nil {
+		stdin = eof{}
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	s := new(System)
+	s.PreopenFile(&stdinFile{stdin}, "/dev/stdin", wasi.FDStat{
+		FileType:   wasi.CharacterDeviceType,
+		RightsBase: wasi.FDReadRight | wasi.FDStatSetFlagsRight | wasi.FDFileStatGetRight | wasi.PollFDReadWriteRight,
+	})
+	for _, output := range []struct {
+		w    io.Writer
+		name string
+	}{
+		{stdout, "/dev/stdout"},
+		{stderr, "/dev/stderr"},
+	} {
+		s.PreopenFile(&stdoutFile{output.w, output.name}, output.name, wasi.FDStat{
+			FileType:   wasi.CharacterDeviceType,
+			RightsBase: wasi.FDWriteRight | wasi.FDStatSetFlagsRight | wasi.FDFileStatGetRight | wasi.PollFDReadWriteRight,
+		})
+	}
+	return s
+}
+
+func (s *System) ArgsSizesGet(ctx context.Context) (argCount, stringBytes int, errno wasi.Errno) {
+	argCount, stringBytes = wasi.SizesGet(s.Args)
+	return
+}
+
+func (s *System) ArgsGet(ctx context.Context) ([]string, wasi.Errno) {
+	return s.Args, wasi.ESUCCESS
+}
+
+func (s *System) EnvironSizesGet(ctx context.Context) (envCount, stringBytes int, errno wasi.Errno) {
+	envCount, stringBytes = wasi.SizesGet(s.Environ)
+	return
+}
+
+func (s *System) EnvironGet(ctx context.Context) ([]string, wasi.Errno) {
+	return s.Environ, wasi.ESUCCESS
+}
+
+func (s *System) ClockResGet(ctx context.Context, id wasi.ClockID) (wasi.Timestamp, wasi.Errno) {
+	switch id {
+	case wasi.Realtime, wasi.Monotonic:
+		return 1, wasi.ESUCCESS
+	case wasi.ProcessCPUTimeID, wasi.ThreadCPUTimeID:
+		return 0, wasi.ENOTSUP
+	default:
+		return 0, wasi.EINVAL
+	}
+}
+
+func (s *System) ClockTimeGet(ctx context.Context, id wasi.ClockID, precision wasi.Timestamp) (wasi.Timestamp, wasi.Errno) {
+	now := time.Now()
+	if s.Now != nil {
+		now = s.Now()
+	}
+	if s.epoch.IsZero() {
+		s.epoch = now
+	}
+	switch id {
+	case wasi.Realtime:
+		return wasi.Timestamp(now.UnixNano()), wasi.ESUCCESS
+	case wasi.Monotonic:
+		return wasi.Timestamp(now.Sub(s.epoch)), wasi.ESUCCESS
+	case wasi.ProcessCPUTimeID, wasi.ThreadCPUTimeID:
+		return 0, wasi.ENOTSUP
+	default:
+		return 0, wasi.EINVAL
+	}
+}
+
+// ProcExit returns ESUCCESS, the host module then terminates the guest with
+// the exit code.
+func (s *System) ProcExit(ctx context.Context, code wasi.ExitCode) wasi.Errno {
+	return wasi.ESUCCESS
+}
+
+func (s *System) RandomGet(ctx context.Context, b []byte) wasi.Errno {
+	if s.Rand == nil {
+		return wasi.ENOSYS
+	}
+	if _, err := io.ReadFull(s.Rand, b); err != nil {
+		return wasi.EIO
+	}
+	return wasi.ESUCCESS
+}
+
+// stdinFile and stdoutFile adapt the stdio of the guest to the fs.File
+// interface of iofs.System, which writes to files implementing io.Writer.
+type stdinFile struct{ io.Reader }
+
+func (f *stdinFile) Stat() (fs.FileInfo, error) { return stdioInfo("/dev/stdin"), nil }
+func (f *stdinFile) Close() error               { return nil }
+
+type stdoutFile struct {
+	w    io.Writer
+	name string
+}
+
+func (f *stdoutFile) Read([]byte) (int, error)    { return 0, fs.ErrInvalid }
+func (f *stdoutFile) Write(b []byte) (int, error) { return f.w.Write(b) }
+func (f *stdoutFile) Stat() (fs.FileInfo, error)  { return stdioInfo(f.name), nil }
+func (f *stdoutFile) Close() error                { return nil }
+
+type stdioInfo string
+
+func (name stdioInfo) Name() string       { return string(name) }
+func (name stdioInfo) Size() int64        { return 0 }
+func (name stdioInfo) Mode() fs.FileMode  { return fs.ModeDevice | fs.ModeCharDevice | 0666 }
+func (name stdioInfo) ModTime() time.Time { return time.Time{} }
+func (name stdioInfo) IsDir() bool        { return false }
+func (name stdioInfo) Sys() any           { return nil }
+
+type eof struct{}
+
+func (eof) Read([]byte) (int, error) { return 0, io.EOF }
@@ -0,0 +1,111 @@
+package memory_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/imports/wasi_snapshot_preview1"
+	"github.com/stealthrocket/wasi-go/systems/memory"
+	"github.com/stealthrocket/wazergo"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestSystem(t *testing.T) {
+	ctx := context.Background()
+	stdout := new(bytes.Buffer)
+	s := memory.New(strings.NewReader("hello"), stdout, nil)
+	s.Args = []string{"app", "arg"}
+	s.Now = func() time.Time { return time.Unix(42, 0) }
+	defer s.Close(ctx)
+
+	root := s.Mount(fstest.MapFS{"data.txt": {Data: []byte("data")}}, "/")
+	if root != 3 {
+		t.Errorf("wrong root file descriptor: %d", root)
+	}
+
+	buffer := make([]byte, 8)
+	if n, errno := s.FDRead(ctx, 0, []wasi.IOVec{buffer}); errno != wasi.ESUCCESS || string(buffer[:n]) != "hello" {
+		t.Errorf("fd_read: %q %s", buffer[:n], errno)
+	}
+	if _, errno := s.FDRead(ctx, 1, []wasi.IOVec{buffer}); errno != wasi.ENOTCAPABLE {
+		t.Errorf("fd_read: stdout: wrong errno: %s", errno)
+	}
+	if _, errno := s.FDWrite(ctx, 1, []wasi.IOVec{[]byte("world")}); errno != wasi.ESUCCESS || stdout.String() != "world" {
+		t.Errorf("fd_write: %q %s", stdout, errno)
+	}
+	if _, errno := s.FDWrite(ctx, 2, []wasi.IOVec{[]byte("discarded")}); errno != wasi.ESUCCESS {
+		t.Errorf("fd_write: stderr: %s", errno)
+	}
+	if stat, errno := s.FDStatGet(ctx, 2); errno != wasi.ESUCCESS || stat.FileType != wasi.CharacterDeviceType {
+		t.Errorf("fd_fdstat_get: %+v %s", stat, errno)
+	}
+
+	fd, errno := s.PathOpen(ctx, root, 0, "data.txt", 0, wasi.FDReadRight, 0, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n, errno := s.FDRead(ctx, fd, []wasi.IOVec{buffer}); errno != wasi.ESUCCESS || string(buffer[:n]) != "data" {
+		t.Errorf("fd_read: file: %q %s", buffer[:n], errno)
+	}
+
+	if now, errno := s.ClockTimeGet(ctx, wasi.Realtime, 1); errno != wasi.ESUCCESS || now != 42e9 {
+		t.Errorf("clock_time_get: realtime: %d %s", now, errno)
+	}
+	if now, errno := s.ClockTimeGet(ctx, wasi.Monotonic, 1); errno != wasi.ESUCCESS || now != 0 {
+		t.Errorf("clock_time_get: monotonic: %d %s", now, errno)
+	}
+	if errno := s.RandomGet(ctx, buffer); errno != wasi.ENOSYS {
+		t.Errorf("random_get: wrong errno: %s", errno)
+	}
+}
+
+func TestWASIP1(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/*/hello_world.wasm")
+	if len(files) == 0 {
+		t.Skip("nothing to test")
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(filepath.Dir(file)), func(t *testing.T) {
+			bytecode, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			stdout := new(bytes.Buffer)
+			s := memory.New(nil, stdout, nil)
+			s.Args = []string{"hello_world"}
+			s.Rand = rand.Reader
+			s.Mount(fstest.MapFS{}, "/")
+			defer s.Close(ctx)
+
+			runtime := wazero.NewRuntime(ctx)
+			defer runtime.Close(ctx)
+
+			ctx = wazergo.WithModuleInstance(ctx,
+				wazergo.MustInstantiate(ctx, runtime,
+					wasi_snapshot_preview1.NewHostModule(),
+					wasi_snapshot_preview1.WithWASI(s),
+				),
+			)
+			instance, err := runtime.Instantiate(ctx, bytecode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			instance.Close(ctx)
+
+			if stdout.String() != "Hello World!\n" {
+				t.Errorf("wrong output: %q", stdout)
+			}
+		})
+	}
+}
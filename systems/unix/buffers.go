@@ -0,0 +1,89 @@
+package unix
+
+import (
+	"sync"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+// The scratch buffers of the system calls which are too large to be allocated
+// on the stack are recycled with pools, so guests making many calls do not
+// put pressure on the garbage collector.
+var (
+	iovecPool    sync.Pool // *[maxIovec]unix.Iovec
+	direntPool   sync.Pool // *[bufferSize]byte
+	sockaddrPool sync.Pool // *sockaddrBuffer
+)
+
+// getIovecs returns a buffer for the iovecs of vectored I/O with more than
+// minIovec buffers.
+func getIovecs() *[maxIovec]unix.Iovec {
+	if p, _ := iovecPool.Get().(*[maxIovec]unix.Iovec); p != nil {
+		return p
+	}
+	return new([maxIovec]unix.Iovec)
+}
+
+// putIovecs returns a buffer obtained from getIovecs to the pool, after
+// clearing the first n iovecs so the pool does not retain the memory that they
+// pointed to.
+func putIovecs(p *[maxIovec]unix.Iovec, n int) {
+	if n > maxIovec {
+		n = maxIovec
+	}
+	for i := range p[:n] {
+		p[i] = unix.Iovec{}
+	}
+	iovecPool.Put(p)
+}
+
+func getDirent() *[bufferSize]byte {
+	if p, _ := direntPool.Get().(*[bufferSize]byte); p != nil {
+		return p
+	}
+	return new([bufferSize]byte)
+}
+
+func putDirent(p *[bufferSize]byte) {
+	direntPool.Put(p)
+}
+
+// sockaddrBuffer holds the socket addresses that the addresses of the guest
+// are converted to for the duration of a system call.
+type sockaddrBuffer struct {
+	inet4 unix.SockaddrInet4
+	inet6 unix.SockaddrInet6
+	unix  unix.SockaddrUnix
+}
+
+func getSockaddr() *sockaddrBuffer {
+	if b, _ := sockaddrPool.Get().(*sockaddrBuffer); b != nil {
+		return b
+	}
+	return new(sockaddrBuffer)
+}
+
+func putSockaddr(b *sockaddrBuffer) {
+	*b = sockaddrBuffer{}
+	sockaddrPool.Put(b)
+}
+
+// toUnixSockAddress converts addr to a socket address which remains valid
+// until the buffer is returned to the pool.
+func (b *sockaddrBuffer) toUnixSockAddress(addr wasi.SocketAddress) (sa unix.Sockaddr, ok bool) {
+	switch t := addr.(type) {
+	case *wasi.Inet4Address:
+		b.inet4 = unix.SockaddrInet4{Port: t.Port, Addr: t.Addr}
+		sa = &b.inet4
+	case *wasi.Inet6Address:
+		b.inet6 = unix.SockaddrInet6{Port: t.Port, Addr: t.Addr}
+		sa = &b.inet6
+	case *wasi.UnixAddress:
+		b.unix = unix.SockaddrUnix{Name: t.Name}
+		sa = &b.unix
+	default:
+		return nil, false
+	}
+	return sa, true
+}
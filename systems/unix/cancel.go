@@ -0,0 +1,71 @@
+package unix
+
+import (
+	"context"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+type cancellation struct {
+	fd     wasi.FD // guest file descriptor of the read end of the pipe
+	writer int     // host file descriptor of the write end of the pipe
+	open   bool    // whether fd was registered
+	done   bool    // whether Cancel was called
+}
+
+// CancellationFD returns a file descriptor that guests can poll to be notified
+// when the host cancels the work that they are performing.
+//
+// The file descriptor is the read end of a pipe which never carries data; it
+// becomes ready for reading (with reads returning EOF) after Cancel or
+// Shutdown are called. The same file descriptor is returned on subsequent
+// calls, until the guest closes it.
+func (s *System) CancellationFD(ctx context.Context) (wasi.FD, wasi.Errno) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cancel.open {
+		if _, _, errno := s.LookupFD(s.cancel.fd, 0); errno == wasi.ESUCCESS {
+			return s.cancel.fd, wasi.ESUCCESS
+		}
+		s.closeCancelWriter()
+	}
+
+	fds := make([]int, 2)
+	if err := pipe(fds, unix.O_NONBLOCK); err != nil {
+		return -1, makeErrno(err)
+	}
+	s.cancel.writer = fds[1]
+	s.cancel.open = true
+	s.cancel.fd = s.Register(FD(fds[0]), wasi.FDStat{
+		FileType:   wasi.UnknownType,
+		Flags:      wasi.NonBlock,
+		RightsBase: wasi.FDReadRight | wasi.PollFDReadWriteRight,
+	})
+	// The work was already canceled, make the handle ready immediately.
+	if s.cancel.done {
+		s.closeCancelWriter()
+	}
+	return s.cancel.fd, wasi.ESUCCESS
+}
+
+// Cancel makes the file descriptor returned by CancellationFD ready for
+// reading. Unlike Shutdown, blocking operations are not interrupted, the
+// guest is expected to observe the cancellation and stop cooperatively.
+//
+// Cancel may be called asynchronously, and calling it multiple times has
+// no effect.
+func (s *System) Cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cancel.done = true
+	s.closeCancelWriter()
+}
+
+func (s *System) closeCancelWriter() {
+	if s.cancel.writer > 0 {
+		_ = closeTraceEBADF(s.cancel.writer)
+	}
+	s.cancel.writer = 0
+}
@@ -0,0 +1,57 @@
+package unix
+
+import (
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// BootTime is a monotonic clock which, unlike the monotonic clock of the Go
+// runtime, keeps advancing while the host is suspended. It can be used as
+// the Monotonic clock of a System in combination with wasi.FireOnResume.
+func BootTime(ctx context.Context) (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(clockBoottime, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// ProcessCPUTime is a clock measuring the CPU time consumed by the host
+// process, which can be used as the ProcessCPUTime clock of a System. The
+// process may run other guests, whose CPU time is then included.
+func ProcessCPUTime(ctx context.Context) (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_PROCESS_CPUTIME_ID, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// NewThreadCPUTime returns a clock measuring the CPU time consumed by the
+// host thread running the guest, which can be used as the ThreadCPUTime clock
+// of a System.
+//
+// The goroutine running the guest may move between threads, so the values of
+// the clock do not account exactly for the CPU time of the guest; they are
+// made monotonic so that guests never measure negative durations.
+func NewThreadCPUTime() func(context.Context) (uint64, error) {
+	var last atomic.Uint64
+	return func(ctx context.Context) (uint64, error) {
+		var ts unix.Timespec
+		if err := unix.ClockGettime(unix.CLOCK_THREAD_CPUTIME_ID, &ts); err != nil {
+			return 0, err
+		}
+		t := uint64(ts.Nano())
+		for {
+			prev := last.Load()
+			if t <= prev {
+				return prev, nil
+			}
+			if last.CompareAndSwap(prev, t) {
+				return t, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package unix
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+// dirCache caches handles to the directories that paths opened by PathOpen
+// are in, so opening multiple files of the same directory resolves the path
+// of the directory only once. The least recently used handles are closed when
+// the cache is full.
+//
+// The cache is invalidated when the guest renames or removes files, but does
+// not observe changes made by other processes.
+type dirCache struct {
+	mutex   sync.Mutex
+	entries map[dirKey]*list.Element
+	lru     list.List
+}
+
+type dirKey struct {
+	dir  FD
+	path string
+}
+
+type dirHandle struct {
+	key dirKey
+	fd  int
+	// Number of calls using the handle, which is closed when it reaches zero
+	// after being evicted.
+	refs    int
+	evicted bool
+}
+
+// pathOpen returns a function opening files like FD.PathOpen, but from the
+// cached handle of their directory, which is passed to
+// wasi.FileTable.PathOpenFunc. The cache holds up to size handles.
+func (c *dirCache) pathOpen(size int) func(FD, context.Context, wasi.LookupFlags, string, wasi.OpenFlags, wasi.Rights, wasi.Rights, wasi.FDFlags) (FD, wasi.Errno) {
+	return func(dir FD, ctx context.Context, lookupFlags wasi.LookupFlags, path string, openFlags wasi.OpenFlags, rightsBase, rightsInheriting wasi.Rights, fdFlags wasi.FDFlags) (FD, wasi.Errno) {
+		i := strings.LastIndexByte(path, '/')
+		if i <= 0 || !isCleanPath(path) {
+			return dir.PathOpen(ctx, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+		}
+		h, err := c.acquire(dir, path[:i], size)
+		if err != nil {
+			return -1, makeErrno(err)
+		}
+		defer c.release(h)
+		fd, errno := FD(h.fd).PathOpen(ctx, lookupFlags, path[i+1:], openFlags, rightsBase, rightsInheriting, fdFlags)
+		if errno == wasi.EPERM {
+			// The file may be a symbolic link to a file which is outside of
+			// the cached directory but still in dir.
+			fd, errno = dir.PathOpen(ctx, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+		}
+		return fd, errno
+	}
+}
+
+func (c *dirCache) acquire(dir FD, path string, size int) (*dirHandle, error) {
+	key := dirKey{dir: dir, path: path}
+	c.mutex.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		h := e.Value.(*dirHandle)
+		h.refs++
+		c.mutex.Unlock()
+		return h, nil
+	}
+	c.mutex.Unlock()
+
+	fd, err := ignoreEINTR2(func() (int, error) {
+		return openat(int(dir), path, oPath|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	})
+	if err != nil {
+		if err == unix.EXDEV {
+			err = unix.EPERM
+		}
+		return nil, err
+	}
+	h := &dirHandle{key: key, fd: fd, refs: 1}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[key]; ok {
+		// Another call opened the directory concurrently, the handle is not
+		// cached and is closed when released.
+		h.evicted = true
+		c.lru.MoveToFront(e)
+		return h, nil
+	}
+	if c.entries == nil {
+		c.entries = make(map[dirKey]*list.Element)
+	}
+	c.entries[key] = c.lru.PushFront(h)
+	for c.lru.Len() > size {
+		c.evict(c.lru.Back())
+	}
+	return h, nil
+}
+
+func (c *dirCache) release(h *dirHandle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if h.refs--; h.refs == 0 && h.evicted {
+		closeTraceEBADF(h.fd)
+	}
+}
+
+func (c *dirCache) evict(e *list.Element) {
+	h := c.lru.Remove(e).(*dirHandle)
+	delete(c.entries, h.key)
+	h.evicted = true
+	if h.refs == 0 {
+		closeTraceEBADF(h.fd)
+	}
+}
+
+// forget must be called before dir is closed or replaced by another file.
+func (c *dirCache) forget(dir FD) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*dirHandle).key.dir == dir {
+			c.evict(e)
+		}
+		e = next
+	}
+}
+
+// reset evicts all the directory handles, it is called when the guest makes
+// changes which may invalidate the resolution of cached paths.
+func (c *dirCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.lru.Front(); e != nil; e = c.lru.Front() {
+		c.evict(e)
+	}
+}
+
+// isCleanPath reports whether path has no empty, "." or ".." components, so
+// the path of its directory can be resolved separately from its last
+// component.
+func isCleanPath(path string) bool {
+	if strings.HasSuffix(path, "/") {
+		return false
+	}
+	for path != "" {
+		var name string
+		name, path, _ = strings.Cut(path, "/")
+		switch name {
+		case "", ".", "..":
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package unix
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+var _ wasi.EventHandles = (*System)(nil)
+
+// events are the host ends of the event handles opened on a system, which
+// are closed when the system is closed.
+type events struct {
+	mutex   sync.Mutex
+	handles map[*eventHandle]struct{}
+}
+
+func (e *events) add(h *eventHandle) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.handles == nil {
+		e.handles = make(map[*eventHandle]struct{})
+	}
+	e.handles[h] = struct{}{}
+}
+
+func (e *events) remove(h *eventHandle) {
+	e.mutex.Lock()
+	delete(e.handles, h)
+	e.mutex.Unlock()
+}
+
+func (e *events) close() {
+	e.mutex.Lock()
+	handles := e.handles
+	e.handles = nil
+	e.mutex.Unlock()
+	for h := range handles {
+		h.close()
+	}
+}
+
+type eventHandle struct {
+	events *events
+	mutex  sync.Mutex
+	fd     int // host file descriptor of the sending end of the socket pair
+	stop   func()
+}
+
+// EventHandleOpen opens an event handle (see wasi.EventHandle).
+//
+// The handle is a pair of connected unix datagram sockets, which preserve
+// the boundaries of the messages, with the receiving end registered in the
+// file table of the guest.
+func (s *System) EventHandleOpen(ctx context.Context) (wasi.FD, wasi.EventHandle, wasi.Errno) {
+	h, guestfd, errno := s.eventHandleOpen()
+	if errno != wasi.ESUCCESS {
+		return -1, nil, errno
+	}
+	return guestfd, h, wasi.ESUCCESS
+}
+
+func (s *System) eventHandleOpen() (*eventHandle, wasi.FD, wasi.Errno) {
+	fds, err := socketpairCloseOnExec(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, -1, makeErrno(err)
+	}
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			closeTraceEBADF(fds[0])
+			closeTraceEBADF(fds[1])
+			return nil, -1, makeErrno(err)
+		}
+	}
+	// The guest only receives from its end of the handle.
+	_ = unix.Shutdown(fds[0], unix.SHUT_WR)
+
+	h := &eventHandle{events: &s.events, fd: fds[1]}
+	s.events.add(h)
+	guestfd := s.Register(FD(fds[0]), wasi.FDStat{
+		FileType:   wasi.UnknownType,
+		Flags:      wasi.NonBlock,
+		RightsBase: wasi.FDReadRight | wasi.PollFDReadWriteRight,
+	})
+	return h, guestfd, wasi.ESUCCESS
+}
+
+func socketpairCloseOnExec(domain, typ, proto int) ([2]int, error) {
+	syscall.ForkLock.Lock()
+	defer syscall.ForkLock.Unlock()
+
+	fds, err := unix.Socketpair(domain, typ, proto)
+	if err != nil {
+		return fds, err
+	}
+	unix.CloseOnExec(fds[0])
+	unix.CloseOnExec(fds[1])
+	return fds, nil
+}
+
+func (h *eventHandle) Send(msg []byte) wasi.Errno {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.fd < 0 {
+		return wasi.EBADF
+	}
+	_, err := ignoreEINTR2(func() (int, error) {
+		return unix.Write(h.fd, msg)
+	})
+	switch err {
+	case nil:
+		return wasi.ESUCCESS
+	case unix.ECONNREFUSED:
+		// Linux reports that the receiving end was closed by the guest
+		// with ECONNREFUSED, unlike Darwin which gives EPIPE.
+		return wasi.EPIPE
+	case unix.ENOBUFS:
+		// Darwin does not block datagram sockets when the receive buffer
+		// of the peer is full, it drops the message and reports ENOBUFS.
+		return wasi.EAGAIN
+	default:
+		return makeErrno(err)
+	}
+}
+
+func (h *eventHandle) Notify() {
+	_ = h.Send([]byte{0})
+}
+
+func (h *eventHandle) Close() error {
+	h.events.remove(h)
+	h.close()
+	return nil
+}
+
+func (h *eventHandle) close() {
+	h.mutex.Lock()
+	fd, stop := h.fd, h.stop
+	h.fd, h.stop = -1, nil
+	h.mutex.Unlock()
+	if stop != nil {
+		stop()
+	}
+	if fd >= 0 {
+		_ = closeTraceEBADF(fd)
+	}
+}
+
+// SignalHandleOpen opens an event handle which receives the signals of the
+// host process, letting guests react to the signals sent to the host (e.g.
+// reload their configuration on SIGHUP) from their event loop.
+//
+// Each signal is received as a message of one byte holding the WASI number
+// of the signal. Signals that the host cannot receive are ignored, and the
+// host stops receiving the signals when the guest closes the handle or the
+// system is closed. While the handle is open, the signals do not take their
+// default action on the host process (e.g. SIGINT does not terminate it).
+func (s *System) SignalHandleOpen(ctx context.Context, signals ...wasi.Signal) (wasi.FD, wasi.Errno) {
+	if len(signals) == 0 {
+		return -1, wasi.EINVAL
+	}
+	numbers := make(map[os.Signal]wasi.Signal, len(signals))
+	for _, sig := range signals {
+		if num := unix.SignalNum(sig.Name()); num != 0 {
+			numbers[num] = sig
+		}
+	}
+	h, guestfd, errno := s.eventHandleOpen()
+	if errno != wasi.ESUCCESS {
+		return -1, errno
+	}
+	if len(numbers) == 0 {
+		return guestfd, wasi.ESUCCESS
+	}
+	notify := make([]os.Signal, 0, len(numbers))
+	for num := range numbers {
+		notify = append(notify, num)
+	}
+	ch := make(chan os.Signal, len(notify))
+	signal.Notify(ch, notify...)
+
+	done := make(chan struct{})
+	h.mutex.Lock()
+	h.stop = func() { signal.Stop(ch); close(done) }
+	h.mutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case num := <-ch:
+				switch h.Send([]byte{byte(numbers[num])}) {
+				case wasi.ESUCCESS, wasi.EAGAIN:
+				default:
+					// The guest closed the handle.
+					h.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return guestfd, wasi.ESUCCESS
+}
@@ -141,25 +141,21 @@ func (fd FD) FDSeek(ctx context.Context, delta wasi.FileDelta, whence wasi.Whenc
 }
 
 func (fd FD) PathCreateDirectory(ctx context.Context, path string) wasi.Errno {
-	err := ignoreEINTR(func() error { return unix.Mkdirat(int(fd), path, 0755) })
+	err := fd.beneath(path, false, func(dirfd int, name string) error {
+		return unix.Mkdirat(dirfd, name, 0755)
+	})
 	return makeErrno(err)
 }
 
 func (fd FD) PathFileStatGet(ctx context.Context, flags wasi.LookupFlags, path string) (wasi.FileStat, wasi.Errno) {
 	var sysStat unix.Stat_t
-	var sysFlags int
-	if !flags.Has(wasi.SymlinkFollow) {
-		sysFlags |= unix.AT_SYMLINK_NOFOLLOW
-	}
-	err := ignoreEINTR(func() error { return unix.Fstatat(int(fd), path, &sysStat, sysFlags) })
+	err := fd.beneath(path, flags.Has(wasi.SymlinkFollow), func(dirfd int, name string) error {
+		return unix.Fstatat(dirfd, name, &sysStat, unix.AT_SYMLINK_NOFOLLOW)
+	})
 	return makeFileStat(&sysStat), makeErrno(err)
 }
 
 func (fd FD) PathFileStatSetTimes(ctx context.Context, lookupFlags wasi.LookupFlags, path string, accessTime, modifyTime wasi.Timestamp, fstFlags wasi.FSTFlags) wasi.Errno {
-	var sysFlags int
-	if !lookupFlags.Has(wasi.SymlinkFollow) {
-		sysFlags |= unix.AT_SYMLINK_NOFOLLOW
-	}
 	ts := [2]unix.Timespec{
 		{Nsec: __UTIME_OMIT},
 		{Nsec: __UTIME_OMIT},
@@ -178,19 +174,24 @@ func (fd FD) PathFileStatSetTimes(ctx context.Context, lookupFlags wasi.LookupFl
 			ts[1] = unix.NsecToTimespec(int64(modifyTime))
 		}
 	}
-	err := ignoreEINTR(func() error { return unix.UtimesNanoAt(int(fd), path, ts[:], sysFlags) })
+	err := fd.beneath(path, lookupFlags.Has(wasi.SymlinkFollow), func(dirfd int, name string) error {
+		return unix.UtimesNanoAt(dirfd, name, ts[:], unix.AT_SYMLINK_NOFOLLOW)
+	})
 	return makeErrno(err)
 }
 
 func (fd FD) PathLink(ctx context.Context, flags wasi.LookupFlags, oldPath string, newDir FD, newPath string) wasi.Errno {
-	var sysFlags int
-	if flags.Has(wasi.SymlinkFollow) {
-		sysFlags |= unix.AT_SYMLINK_FOLLOW
-	}
-	err := ignoreEINTR(func() error { return unix.Linkat(int(fd), oldPath, int(newDir), newPath, sysFlags) })
+	err := fd.beneath(oldPath, flags.Has(wasi.SymlinkFollow), func(olddirfd int, oldName string) error {
+		return newDir.beneath(newPath, false, func(newdirfd int, newName string) error {
+			return unix.Linkat(olddirfd, oldName, newdirfd, newName, 0)
+		})
+	})
 	return makeErrno(err)
 }
 
+// PathOpen opens path relative to the directory fd. The resolution of the path
+// cannot escape the directory, including through symbolic links, in which case
+// the method returns EPERM.
 func (fd FD) PathOpen(ctx context.Context, lookupFlags wasi.LookupFlags, path string, openFlags wasi.OpenFlags, rightsBase, rightsInheriting wasi.Rights, fdFlags wasi.FDFlags) (FD, wasi.Errno) {
 	oflags := unix.O_CLOEXEC
 	if openFlags.Has(wasi.OpenDirectory) {
@@ -244,14 +245,21 @@ func (fd FD) PathOpen(ctx context.Context, lookupFlags wasi.LookupFlags, path st
 		mode = 0
 	}
 	hostfd, err := ignoreEINTR2(func() (int, error) {
-		return unix.Openat(int(fd), path, oflags, mode)
+		return openat(int(fd), path, oflags, mode)
 	})
+	if err == unix.EXDEV {
+		// The path escapes the directory, like paths starting with ".."
+		// which are rejected by wasi.FileTable.
+		return -1, wasi.EPERM
+	}
 	return FD(hostfd), makeErrno(err)
 }
 
 func (fd FD) PathReadLink(ctx context.Context, path string, buffer []byte) (int, wasi.Errno) {
-	n, err := ignoreEINTR2(func() (int, error) {
-		return unix.Readlinkat(int(fd), path, buffer)
+	var n int
+	err := fd.beneath(path, false, func(dirfd int, name string) (err error) {
+		n, err = unix.Readlinkat(dirfd, name, buffer)
+		return err
 	})
 	if err != nil {
 		return n, makeErrno(err)
@@ -263,30 +271,58 @@ func (fd FD) PathReadLink(ctx context.Context, path string, buffer []byte) (int,
 }
 
 func (fd FD) PathRemoveDirectory(ctx context.Context, path string) wasi.Errno {
-	err := ignoreEINTR(func() error { return unix.Unlinkat(int(fd), path, unix.AT_REMOVEDIR) })
+	err := fd.beneath(path, false, func(dirfd int, name string) error {
+		return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	})
 	return makeErrno(err)
 }
 
 func (fd FD) PathRename(ctx context.Context, oldPath string, newDir FD, newPath string) wasi.Errno {
-	err := ignoreEINTR(func() error { return unix.Renameat(int(fd), oldPath, int(newDir), newPath) })
+	err := fd.beneath(oldPath, false, func(olddirfd int, oldName string) error {
+		return newDir.beneath(newPath, false, func(newdirfd int, newName string) error {
+			return unix.Renameat(olddirfd, oldName, newdirfd, newName)
+		})
+	})
 	return makeErrno(err)
 }
 
 func (fd FD) PathSymlink(ctx context.Context, oldPath string, newPath string) wasi.Errno {
-	err := ignoreEINTR(func() error { return unix.Symlinkat(oldPath, int(fd), newPath) })
+	err := fd.beneath(newPath, false, func(dirfd int, name string) error {
+		return unix.Symlinkat(oldPath, dirfd, name)
+	})
 	return makeErrno(err)
 }
 
 func (fd FD) PathUnlinkFile(ctx context.Context, path string) wasi.Errno {
-	err := ignoreEINTR(func() error { return unix.Unlinkat(int(fd), path, 0) })
+	err := fd.beneath(path, false, func(dirfd int, name string) error {
+		return unix.Unlinkat(dirfd, name, 0)
+	})
 	return makeErrno(err)
 }
 
+// beneath calls f with the directory and the name that path resolves to
+// beneath fd (see resolveBeneath), so the functions operating on paths cannot
+// escape the directory either.
+func (fd FD) beneath(path string, follow bool, f func(dirfd int, name string) error) error {
+	dirfd, name, err := resolveBeneath(int(fd), path, follow)
+	if err != nil {
+		return err
+	}
+	if dirfd != int(fd) {
+		defer closeTraceEBADF(dirfd)
+	}
+	return ignoreEINTR(func() error { return f(dirfd, name) })
+}
+
 func (d *dirbuf) FDReadDir(ctx context.Context, entries []wasi.DirEntry, cookie wasi.DirCookie, bufferSizeBytes int) (int, wasi.Errno) {
 	n, err := d.readDirEntries(entries, cookie, bufferSizeBytes)
 	return n, makeErrno(err)
 }
 
 func (d *dirbuf) FDCloseDir(ctx context.Context) wasi.Errno {
+	if d.buffer != nil {
+		putDirent(d.buffer)
+		d.buffer = nil
+	}
 	return wasi.ESUCCESS
 }
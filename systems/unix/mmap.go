@@ -0,0 +1,164 @@
+package unix
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+// FDMmap copies the content of a regular file to buffer from a read-only
+// mapping of the file (see wasi.FileMapper). The file is mapped with mmap(2)
+// on the first call and remains mapped until the file descriptor is closed.
+// It returns ENOTSUP for the other types of files.
+func (s *System) FDMmap(ctx context.Context, fd wasi.FD, offset wasi.FileSize, buffer []byte) (wasi.Size, wasi.Errno) {
+	f, stat, errno := s.LookupFD(fd, wasi.FDReadRight|wasi.FDSeekRight)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	if stat.FileType != wasi.RegularFileType {
+		return 0, wasi.ENOTSUP
+	}
+	n, err := s.mappings.get(int(f)).copy(int(f), offset, buffer)
+	if err != nil {
+		if err == unix.ENODEV {
+			return 0, wasi.ENOTSUP
+		}
+		return 0, makeErrno(err)
+	}
+	return wasi.Size(n), wasi.ESUCCESS
+}
+
+// fileMappings holds the mappings created by FDMmap, indexed by host file
+// descriptor.
+type fileMappings struct {
+	mutex sync.Mutex
+	files map[int]*fileMapping
+}
+
+type fileMapping struct {
+	// The lock is held for reading while data is copied from the mapping,
+	// and for writing when the file is remapped or unmapped.
+	mutex  sync.RWMutex
+	data   []byte
+	closed bool
+}
+
+func (fm *fileMappings) get(fd int) *fileMapping {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	m := fm.files[fd]
+	if m == nil {
+		if fm.files == nil {
+			fm.files = make(map[int]*fileMapping)
+		}
+		m = new(fileMapping)
+		fm.files[fd] = m
+	}
+	return m
+}
+
+// forget must be called before fd is closed or replaced by another file, it
+// waits for the copies from the mapping of the file to complete and unmaps it.
+func (fm *fileMappings) forget(fd int) {
+	fm.mutex.Lock()
+	m := fm.files[fd]
+	delete(fm.files, fd)
+	fm.mutex.Unlock()
+	if m != nil {
+		m.close()
+	}
+}
+
+func (fm *fileMappings) close() {
+	fm.mutex.Lock()
+	files := fm.files
+	fm.files = nil
+	fm.mutex.Unlock()
+	for _, m := range files {
+		m.close()
+	}
+}
+
+// copy copies the content of the file at offset to buffer. The file is
+// remapped when the range extends past the end of the mapping, in case the
+// file grew, or when the file was truncated after being mapped, which raises
+// SIGBUS when accessing the pages past the end of the file.
+func (m *fileMapping) copy(fd int, offset wasi.FileSize, buffer []byte) (int, error) {
+	m.mutex.RLock()
+	n, faulted := m.copyFrom(offset, buffer)
+	m.mutex.RUnlock()
+	if !faulted && n == len(buffer) {
+		return n, nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.remap(fd); err != nil {
+		return 0, err
+	}
+	n, faulted = m.copyFrom(offset, buffer)
+	if faulted {
+		return 0, unix.EIO
+	}
+	return n, nil
+}
+
+func (m *fileMapping) copyFrom(offset wasi.FileSize, buffer []byte) (n int, faulted bool) {
+	if offset >= wasi.FileSize(len(m.data)) {
+		return 0, false
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(interface{ Addr() uintptr }); !ok {
+				panic(e)
+			}
+			faulted = true
+		}
+	}()
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	return copy(buffer, m.data[offset:]), false
+}
+
+func (m *fileMapping) remap(fd int) error {
+	if m.closed {
+		return unix.EBADF
+	}
+	var stat unix.Stat_t
+	if err := ignoreEINTR(func() error { return unix.Fstat(fd, &stat) }); err != nil {
+		return err
+	}
+	size := int(stat.Size)
+	if int64(size) != stat.Size {
+		return unix.ENOMEM
+	}
+	if m.data != nil && size == len(m.data) {
+		return nil
+	}
+	m.unmap()
+	if size == 0 {
+		return nil
+	}
+	data, err := unix.Mmap(fd, 0, size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+func (m *fileMapping) unmap() {
+	if m.data != nil {
+		_ = unix.Munmap(m.data)
+		m.data = nil
+	}
+}
+
+func (m *fileMapping) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.unmap()
+	m.closed = true
+}
@@ -0,0 +1,246 @@
+package unix
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+// VirtualNetwork is an in-process network connecting the systems of several
+// module instances. When systems share a VirtualNetwork (see System.Network),
+// the TCP sockets that modules bind to loopback or wildcard addresses are
+// only reachable by the modules connecting to loopback addresses in the same
+// network, without using the network stack of the host.
+//
+// The ports of the virtual network are backed by unix sockets created in a
+// private directory, so the file descriptors of the modules remain usable
+// with poll_oneoff. The addresses that the modules observe are the loopback
+// addresses of the virtual ports. Connections to other addresses, and
+// datagram sockets, use the network of the host.
+type VirtualNetwork struct {
+	dir      string
+	nextPort atomic.Uint32
+}
+
+// firstEphemeralPort is the first port assigned when modules bind sockets to
+// port zero, or connect sockets which were not bound.
+const firstEphemeralPort = 49152
+
+// NewVirtualNetwork creates a virtual network. The network must be closed
+// when the instances which use it have exited.
+func NewVirtualNetwork() (*VirtualNetwork, error) {
+	dir, err := os.MkdirTemp("", "wasi-net-")
+	if err != nil {
+		return nil, err
+	}
+	n := &VirtualNetwork{dir: dir}
+	n.nextPort.Store(firstEphemeralPort)
+	return n, nil
+}
+
+// Close removes the directory holding the unix sockets of the network.
+func (n *VirtualNetwork) Close() error {
+	return os.RemoveAll(n.dir)
+}
+
+// includes returns true if connecting or binding to addr is done within the
+// virtual network.
+func (n *VirtualNetwork) includes(addr wasi.SocketAddress, bind bool) bool {
+	if n == nil {
+		return false
+	}
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *wasi.Inet4Address:
+		ip = netip.AddrFrom4(a.Addr)
+	case *wasi.Inet6Address:
+		ip = netip.AddrFrom16(a.Addr).Unmap()
+	default:
+		return false
+	}
+	return ip.IsLoopback() || (bind && ip.IsUnspecified())
+}
+
+func virtualPort(addr wasi.SocketAddress) (family string, port int) {
+	switch a := addr.(type) {
+	case *wasi.Inet4Address:
+		return "4", a.Port
+	case *wasi.Inet6Address:
+		return "6", a.Port
+	default:
+		return "", 0
+	}
+}
+
+// path returns the path of the unix socket backing a port. Listening sockets
+// are named <family>-<port>, and connecting sockets c<family>-<port>.
+func (n *VirtualNetwork) path(prefix, family string, port int) string {
+	return filepath.Join(n.dir, prefix+family+"-"+strconv.Itoa(port))
+}
+
+// owns returns true if sa is the address of a unix socket of the network.
+func (n *VirtualNetwork) owns(sa unix.Sockaddr) bool {
+	a, ok := sa.(*unix.SockaddrUnix)
+	return ok && n != nil && filepath.Dir(a.Name) == n.dir
+}
+
+// guestAddress translates the addresses of the unix sockets of the network
+// to the virtual addresses that they back.
+func (n *VirtualNetwork) guestAddress(addr wasi.SocketAddress) wasi.SocketAddress {
+	a, ok := addr.(*wasi.UnixAddress)
+	if n == nil || !ok || filepath.Dir(a.Name) != n.dir {
+		return addr
+	}
+	name := strings.TrimPrefix(filepath.Base(a.Name), "c")
+	family, portString, _ := strings.Cut(name, "-")
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return addr
+	}
+	if family == "6" {
+		return &wasi.Inet6Address{Addr: netip.IPv6Loopback().As16(), Port: port}
+	}
+	return &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: port}
+}
+
+// bind replaces socket with a unix socket bound to the virtual address.
+func (n *VirtualNetwork) bind(socket int, addr wasi.SocketAddress) wasi.Errno {
+	family, port := virtualPort(addr)
+	fd, err := newUnixSocket()
+	if err != nil {
+		return makeErrno(err)
+	}
+	defer closeTraceEBADF(fd)
+
+	if port == 0 {
+		err = n.bindEphemeral(fd, "", family)
+	} else {
+		path := n.path("", family, port)
+		err = bindUnix(fd, path)
+		if err == unix.EADDRINUSE && n.stale(family, port) {
+			os.Remove(path)
+			err = bindUnix(fd, path)
+		}
+	}
+	if err != nil {
+		return makeErrno(err)
+	}
+	return makeErrno(replaceSocket(fd, socket))
+}
+
+// connect replaces socket with a unix socket connected to the listening
+// socket of the virtual address.
+func (n *VirtualNetwork) connect(socket int, peer wasi.SocketAddress) wasi.Errno {
+	family, port := virtualPort(peer)
+	path := n.path("", family, port)
+	if family == "4" {
+		// IPv6 sockets listening on the wildcard address also accept
+		// connections to IPv4 addresses.
+		if _, err := os.Stat(path); err != nil {
+			path = n.path("", "6", port)
+		}
+	}
+
+	// Sockets that were bound in the virtual network are already unix
+	// sockets, others are bound to an ephemeral port.
+	sa, err := unix.Getsockname(socket)
+	if err != nil {
+		return makeErrno(err)
+	}
+	fd := socket
+	if _, ok := sa.(*unix.SockaddrUnix); !ok {
+		if fd, err = newUnixSocket(); err != nil {
+			return makeErrno(err)
+		}
+		defer closeTraceEBADF(fd)
+		if err := n.bindEphemeral(fd, "c", family); err != nil {
+			return makeErrno(err)
+		}
+		// The path is only needed for the peer to see the address of the
+		// socket; the name remains attached to the socket once removed.
+		if sa, err := unix.Getsockname(fd); err == nil {
+			defer os.Remove(sa.(*unix.SockaddrUnix).Name)
+		}
+	}
+
+	err = ignoreEINTR(func() error {
+		return unix.Connect(fd, &unix.SockaddrUnix{Name: path})
+	})
+	switch err {
+	case nil:
+	case unix.ENOENT:
+		return wasi.ECONNREFUSED
+	default:
+		return makeErrno(err)
+	}
+	if fd != socket {
+		return makeErrno(replaceSocket(fd, socket))
+	}
+	return wasi.ESUCCESS
+}
+
+func (n *VirtualNetwork) bindEphemeral(fd int, prefix, family string) error {
+	for i := 0; i < 65536-firstEphemeralPort; i++ {
+		port := n.nextPort.Add(1) - 1
+		if port > 65535 {
+			n.nextPort.CompareAndSwap(port+1, firstEphemeralPort)
+			continue
+		}
+		if _, err := os.Stat(n.path("", family, int(port))); err == nil {
+			continue
+		}
+		err := bindUnix(fd, n.path(prefix, family, int(port)))
+		if err != unix.EADDRINUSE {
+			return err
+		}
+	}
+	return unix.EADDRINUSE
+}
+
+// stale returns true if the unix socket of a virtual port exists but no
+// longer accepts connections, because the listening socket was closed.
+func (n *VirtualNetwork) stale(family string, port int) bool {
+	fd, err := newUnixSocket()
+	if err != nil {
+		return false
+	}
+	defer closeTraceEBADF(fd)
+	err = unix.Connect(fd, &unix.SockaddrUnix{Name: n.path("", family, port)})
+	return err == unix.ECONNREFUSED
+}
+
+func newUnixSocket() (int, error) {
+	fd, err := ignoreEINTR2(func() (int, error) {
+		return unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	})
+	if err != nil {
+		return -1, err
+	}
+	unix.CloseOnExec(fd)
+	return fd, nil
+}
+
+func bindUnix(fd int, path string) error {
+	return ignoreEINTR(func() error {
+		return unix.Bind(fd, &unix.SockaddrUnix{Name: path})
+	})
+}
+
+// replaceSocket replaces the socket with fd, retaining the non-blocking mode
+// of the socket.
+func replaceSocket(fd, socket int) error {
+	flags, err := unix.FcntlInt(uintptr(socket), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if err := dup2(fd, socket); err != nil {
+		return err
+	}
+	return unix.SetNonblock(socket, (flags&unix.O_NONBLOCK) != 0)
+}
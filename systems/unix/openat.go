@@ -0,0 +1,183 @@
+package unix
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the maximum number of symbolic links followed when resolving
+// a path, like MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
+// openBeneath is like openat(2), but fails with EXDEV if the resolution of
+// path escapes the directory dirfd, either with ".." components or by
+// following symbolic links to absolute paths or to parents of the directory.
+//
+// The path is resolved one component at a time, with O_NOFOLLOW, and symbolic
+// links are followed by reading their target, so concurrent changes to the
+// file system (e.g. replacing a directory by a symbolic link) cannot divert
+// the resolution outside of the directory.
+func openBeneath(dirfd int, path string, flags int, mode uint32) (int, error) {
+	if path == "" {
+		return -1, unix.ENOENT
+	}
+	if strings.HasPrefix(path, "/") {
+		return -1, unix.EXDEV
+	}
+	// dirs is the stack of directories opened to resolve the path, which is
+	// popped by ".." components; the first one is dirfd and is not closed.
+	dirs := []int{dirfd}
+	defer func() {
+		for _, fd := range dirs[1:] {
+			closeTraceEBADF(fd)
+		}
+	}()
+
+	components := strings.Split(path, "/")
+	symlinks := 0
+	for len(components) > 0 {
+		name := components[0]
+		components = components[1:]
+		last := len(components) == 0
+
+		switch name {
+		case "", ".":
+			if !last {
+				continue
+			}
+			name = "."
+		case "..":
+			if len(dirs) == 1 {
+				return -1, unix.EXDEV
+			}
+			closeTraceEBADF(dirs[len(dirs)-1])
+			dirs = dirs[:len(dirs)-1]
+			if !last {
+				continue
+			}
+			name = "."
+		}
+
+		dir := dirs[len(dirs)-1]
+		oflags, omode := unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, uint32(0)
+		if last {
+			oflags, omode = flags, mode
+		}
+		fd, err := ignoreEINTR2(func() (int, error) {
+			return unix.Openat(dir, name, oflags|unix.O_NOFOLLOW, omode)
+		})
+		if err == nil {
+			if last {
+				return fd, nil
+			}
+			dirs = append(dirs, fd)
+			continue
+		}
+		if last && (flags&unix.O_NOFOLLOW) != 0 {
+			return -1, err
+		}
+		// Opening a symbolic link with O_NOFOLLOW fails with ELOOP, or with
+		// ENOTDIR when O_DIRECTORY is also set on some systems.
+		if err != unix.ELOOP && err != unix.ENOTDIR {
+			return -1, err
+		}
+		target, lerr := readlinkat(dir, name)
+		if lerr != nil {
+			return -1, err // not a symbolic link
+		}
+		if symlinks++; symlinks > maxSymlinks {
+			return -1, unix.ELOOP
+		}
+		if strings.HasPrefix(target, "/") {
+			return -1, unix.EXDEV
+		}
+		components = append(strings.Split(target, "/"), components...)
+	}
+	return -1, unix.ENOENT
+}
+
+func readlinkat(dirfd int, path string) (string, error) {
+	var buffer [4096]byte
+	n, err := ignoreEINTR2(func() (int, error) {
+		return unix.Readlinkat(dirfd, path, buffer[:])
+	})
+	if err != nil {
+		return "", err
+	}
+	if n == len(buffer) {
+		return "", unix.ENAMETOOLONG
+	}
+	return string(buffer[:n]), nil
+}
+
+// resolveBeneath resolves the directory containing the last component of path
+// beneath dirfd, for the functions operating on paths relative to a directory
+// file descriptor other than openat(2). It returns a file descriptor to the
+// directory, which the caller must close if it differs from dirfd, and the
+// name of the file in this directory. The function fails with EPERM if the
+// resolution of path escapes dirfd.
+//
+// When follow is true, the symbolic links of the last component are resolved
+// as well, so the caller must not follow symbolic links when operating on the
+// returned name; if the file is replaced by a symbolic link concurrently, the
+// operation then applies to the link instead of escaping the directory.
+func resolveBeneath(dirfd int, path string, follow bool) (int, string, error) {
+	for symlinks := 0; ; symlinks++ {
+		if path == "" {
+			return -1, "", unix.ENOENT
+		}
+		if strings.HasPrefix(path, "/") {
+			return -1, "", unix.EPERM
+		}
+		dir, name := "", strings.TrimRight(path, "/")
+		if i := strings.LastIndexByte(name, '/'); i >= 0 {
+			dir, name = name[:i], name[i+1:]
+		}
+
+		var fd int
+		var err error
+		switch name {
+		case ".", "..":
+			// The path refers to a directory, which is opened entirely since
+			// ".." could not be resolved beneath its parent.
+			fd, err = openDirBeneath(dirfd, path)
+			name = "."
+		default:
+			fd = dirfd
+			if dir != "" {
+				fd, err = openDirBeneath(dirfd, dir)
+			}
+		}
+		if err != nil {
+			if err == unix.EXDEV {
+				err = unix.EPERM
+			}
+			return -1, "", err
+		}
+		if !follow || name == "." {
+			return fd, name, nil
+		}
+
+		target, err := readlinkat(fd, name)
+		if err != nil {
+			return fd, name, nil // not a symbolic link
+		}
+		if fd != dirfd {
+			closeTraceEBADF(fd)
+		}
+		if symlinks == maxSymlinks {
+			return -1, "", unix.ELOOP
+		}
+		if dir != "" && !strings.HasPrefix(target, "/") {
+			target = dir + "/" + target
+		}
+		path = target
+	}
+}
+
+func openDirBeneath(dirfd int, path string) (int, error) {
+	return ignoreEINTR2(func() (int, error) {
+		return openat(dirfd, path, oPath|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	})
+}
@@ -2,24 +2,33 @@ package unix
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/url"
 	"strings"
+	"syscall"
 
 	"github.com/stealthrocket/wasi-go"
 	"github.com/stealthrocket/wasi-go/internal/sockets"
 )
 
 // PathOpenSockets is an extension to WASI preview 1 that adds the ability to
-// create TCP sockets. It works by proxying calls to path_open. If fd<0
-// and the path is of the form:
+// create TCP, UDP and unix sockets. It works by proxying calls to path_open. If
+// fd<0 and the path is of the form:
 //
 //	<network>:<operation>://<host>:<port>[?options=value[&option=value]*
+//	unix:<operation>://<path>[?options=value[&option=value]*
 //
-// where network is one of "tcp", "tcp4" or "tcp6", and operation is either
-// "listen" or "dial", the extension will open a socket that either listens
-// on, or connects to, the specified host:port address. Otherwise, the
+// where network is one of "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6", and
+// operation is either "listen" or "dial", the extension will open a socket
+// that either listens on, or connects to, the specified host:port address or
+// unix socket path. Datagram sockets opened with "listen" are bound to the
+// address without listening for connections. Otherwise, the
 // extension passes the arguments to the underlying WASI implementation to open
-// a file or directory as normal.
+// a file or directory as normal. Host names are resolved with the Resolver of
+// the System; when they resolve to multiple addresses, connections are
+// attempted in parallel with the Happy Eyeballs algorithm (RFC 8305), and
+// the sockets are connected when path_open returns.
 //
 // The following options are available
 // - nonblock=<0|1>:  Open the socket in non-blocking mode. Default is 1.
@@ -37,25 +46,44 @@ func (p *PathOpenSockets) PathOpen(ctx context.Context, fd wasi.FD, lookupFlags
 	var err error
 	switch op {
 	case "listen":
-		sockfd, err = sockets.Listen(addr)
+		sockfd, err = sockets.Listen(ctx, addr, p.System.lookupIP)
 	case "dial":
-		sockfd, err = sockets.Dial(addr)
+		sockfd, err = sockets.Dial(ctx, addr, p.System.lookupIP)
 	}
 	errno := wasi.ESUCCESS
 	if err != nil {
-		errno = makeErrno(err)
+		errno = socketErrno(err)
 		if errno != wasi.EINPROGRESS {
 			return -1, errno
 		}
 	}
+	fileType := wasi.SocketStreamType
+	if sockets.IsDatagram(addr) {
+		fileType = wasi.SocketDGramType
+	}
 	return p.Register(FD(sockfd), wasi.FDStat{
-		FileType:         wasi.SocketStreamType,
+		FileType:         fileType,
 		Flags:            fdFlags,
 		RightsBase:       rightsBase,
 		RightsInheriting: rightsInheriting,
 	}), errno
 }
 
+// socketErrno converts errors returned when opening sockets to errno values.
+// Failures to parse or resolve the address are not system errors.
+func socketErrno(err error) wasi.Errno {
+	var dnsErr *net.DNSError
+	var sysErr syscall.Errno
+	switch {
+	case errors.As(err, &dnsErr):
+		return wasi.ENOENT
+	case errors.As(err, &sysErr):
+		return makeErrno(err)
+	default:
+		return wasi.EINVAL
+	}
+}
+
 func parseURI(path string) (network string, op string, ok bool) {
 	u, err := url.Parse(path)
 	if err != nil {
@@ -0,0 +1,83 @@
+package unix
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pollers is the set of pollers of a System. Each concurrent call to
+// PollOneOff uses a different poller, which the following calls reuse so
+// the file descriptors remain registered.
+type pollers struct {
+	mutex  sync.Mutex
+	all    []*poller
+	free   []*poller
+	closed bool
+}
+
+func (p *pollers) get() (*poller, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, unix.EBADF
+	}
+	if n := len(p.free); n > 0 {
+		poller := p.free[n-1]
+		p.free = p.free[:n-1]
+		return poller, nil
+	}
+	poller, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	p.all = append(p.all, poller)
+	return poller, nil
+}
+
+func (p *pollers) put(poller *poller) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		poller.close()
+	} else {
+		p.free = append(p.free, poller)
+	}
+}
+
+// forget must be called before fd is closed or replaced by another file.
+func (p *pollers) forget(fd int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, poller := range p.all {
+		poller.forget(fd)
+	}
+}
+
+func (p *pollers) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		for _, poller := range p.free {
+			poller.close()
+		}
+		p.all, p.free = nil, nil
+	}
+}
+
+// pollTimeout converts timeout to milliseconds for poll(2), rounding up so the
+// call does not return before the timeout expires. Negative timeouts block
+// indefinitely.
+func pollTimeout(timeout time.Duration) int {
+	if timeout < 0 {
+		return -1
+	}
+	ms := (timeout + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxInt32 {
+		ms = math.MaxInt32
+	}
+	return int(ms)
+}
@@ -0,0 +1,232 @@
+package unix
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller waits for events on file descriptors with a persistent kqueue(2)
+// instance. The file descriptors stay registered across calls to poll, and
+// the changes of the set of file descriptors are submitted with the same call
+// to kevent(2) which waits for events, so each call to poll takes a single
+// system call regardless of the number of file descriptors.
+type poller struct {
+	kq      int
+	changes []unix.Kevent_t
+	events  []unix.Kevent_t
+
+	mutex      sync.Mutex
+	generation uint64
+	registered map[int32]*pollRegistration
+}
+
+// Filters that file descriptors are registered for.
+const (
+	pollRead uint8 = 1 << iota
+	pollWrite
+)
+
+type pollRegistration struct {
+	// Generation of the last call to poll which included the file descriptor.
+	generation uint64
+	// Filters that the file descriptor is registered for, and that the
+	// current call to poll waits for.
+	filters uint8
+	want    uint8
+	// Filters that the file does not support, which poll(2) reports as always
+	// ready.
+	unsupported uint8
+	// Events reported for the file descriptor by the current call to poll.
+	revents int16
+	// Set when the file descriptor is not open.
+	invalid bool
+}
+
+func newPoller() (*poller, error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(kq)
+	return &poller{
+		kq:         kq,
+		registered: make(map[int32]*pollRegistration),
+	}, nil
+}
+
+func (p *poller) close() {
+	_ = unix.Close(p.kq)
+}
+
+// forget must be called before fd is closed or replaced, so the file
+// descriptor is registered again the next time it is polled. Closing a file
+// descriptor removes its events from the kqueue, so there is nothing to
+// unregister.
+func (p *poller) forget(fd int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.registered, int32(fd))
+}
+
+// poll is equivalent to poll(2).
+func (p *poller) poll(fds []unix.PollFd, timeout time.Duration) (int, error) {
+	if p.update(fds) > 0 {
+		timeout = 0
+	}
+	var ts *unix.Timespec
+	if timeout >= 0 {
+		t := unix.NsecToTimespec(int64(timeout))
+		ts = &t
+	}
+	numEvents, err := unix.Kevent(p.kq, p.changes, p.events, ts)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mutex.Lock()
+	for _, ev := range p.events[:numEvents] {
+		r := p.registered[int32(ev.Ident)]
+		if r == nil {
+			continue
+		}
+		filter := pollRead
+		if ev.Filter == unix.EVFILT_WRITE {
+			filter = pollWrite
+		}
+		if (ev.Flags & unix.EV_ERROR) != 0 {
+			// Errors of the changes which removed filters are ignored, the
+			// file descriptor may have been closed already.
+			if (r.filters & filter) != 0 {
+				r.filters &^= filter
+				switch unix.Errno(ev.Data) {
+				case unix.EBADF:
+					r.invalid = true
+				default:
+					r.unsupported |= filter
+				}
+			}
+			continue
+		}
+		if filter == pollRead {
+			r.revents |= unix.POLLIN
+		} else {
+			r.revents |= unix.POLLOUT
+		}
+		if (ev.Flags & unix.EV_EOF) != 0 {
+			r.revents |= unix.POLLHUP
+		}
+	}
+	p.mutex.Unlock()
+	return p.ready(fds), nil
+}
+
+// update prepares the changes registering the file descriptors of fds and
+// unregistering those which were not included, and returns the number of
+// entries of fds which are ready without waiting.
+func (p *poller) update(fds []unix.PollFd) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.generation++
+	p.changes = p.changes[:0]
+
+	for i := range fds {
+		pf := &fds[i]
+		pf.Revents = 0
+		if pf.Fd < 0 {
+			continue
+		}
+		r := p.registered[pf.Fd]
+		if r == nil {
+			r = new(pollRegistration)
+			p.registered[pf.Fd] = r
+		}
+		if r.generation != p.generation {
+			r.generation, r.want, r.revents, r.invalid = p.generation, 0, 0, false
+		}
+		if (pf.Events & (unix.POLLIN | unix.POLLPRI | unix.POLLHUP)) != 0 {
+			r.want |= pollRead
+		}
+		if (pf.Events & unix.POLLOUT) != 0 {
+			r.want |= pollWrite
+		}
+	}
+
+	numFilters := 0
+	for fd, r := range p.registered {
+		if r.generation != p.generation {
+			p.change(fd, r.filters, unix.EV_DELETE)
+			delete(p.registered, fd)
+			continue
+		}
+		add := r.want &^ r.filters &^ r.unsupported
+		del := r.filters &^ r.want
+		p.change(fd, add, unix.EV_ADD)
+		p.change(fd, del, unix.EV_DELETE)
+		r.filters = (r.filters | add) &^ del
+		if (r.filters & pollRead) != 0 {
+			numFilters++
+		}
+		if (r.filters & pollWrite) != 0 {
+			numFilters++
+		}
+	}
+
+	// The events must have room for the errors of the changes, otherwise
+	// kevent(2) fails instead of reporting them.
+	n := len(p.changes) + numFilters
+	if n == 0 {
+		n = 1
+	}
+	if cap(p.events) < n {
+		p.events = make([]unix.Kevent_t, n)
+	}
+	p.events = p.events[:n]
+	return p.readyLocked(fds)
+}
+
+func (p *poller) change(fd int32, filters uint8, flags int) {
+	if (filters & pollRead) != 0 {
+		p.changes = append(p.changes, unix.Kevent_t{})
+		unix.SetKevent(&p.changes[len(p.changes)-1], int(fd), unix.EVFILT_READ, flags)
+	}
+	if (filters & pollWrite) != 0 {
+		p.changes = append(p.changes, unix.Kevent_t{})
+		unix.SetKevent(&p.changes[len(p.changes)-1], int(fd), unix.EVFILT_WRITE, flags)
+	}
+}
+
+// ready sets the events reported for each entry of fds and returns the number
+// of entries with events.
+func (p *poller) ready(fds []unix.PollFd) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.readyLocked(fds)
+}
+
+func (p *poller) readyLocked(fds []unix.PollFd) (n int) {
+	for i := range fds {
+		pf := &fds[i]
+		r := p.registered[pf.Fd]
+		if r == nil {
+			continue
+		}
+		if r.invalid {
+			pf.Revents = unix.POLLNVAL
+		} else {
+			revents := r.revents
+			if (r.unsupported & pollRead) != 0 {
+				revents |= unix.POLLIN
+			}
+			if (r.unsupported & pollWrite) != 0 {
+				revents |= unix.POLLOUT
+			}
+			pf.Revents = revents & (pf.Events | unix.POLLERR | unix.POLLHUP)
+		}
+		if pf.Revents != 0 {
+			n++
+		}
+	}
+	return n
+}
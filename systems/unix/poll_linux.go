@@ -0,0 +1,237 @@
+package unix
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller waits for events on file descriptors with a persistent epoll(7)
+// instance. The file descriptors stay registered across calls to poll, so
+// only the changes of the set of file descriptors (and of the events that
+// they are polled for) cost system calls, instead of registering all of them
+// on each call like poll(2) does.
+//
+// Timeouts are implemented with a timerfd(2) registered in the epoll instance,
+// since epoll_wait(2) only supports timeouts in milliseconds.
+type poller struct {
+	epfd   int
+	events []unix.EpollEvent
+	timer  int
+	armed  bool
+
+	mutex      sync.Mutex
+	generation uint64
+	registered map[int32]*pollRegistration
+}
+
+type pollRegistration struct {
+	// Generation of the last call to poll which included the file descriptor.
+	generation uint64
+	// Events that the file descriptor is registered for, and that the current
+	// call to poll waits for.
+	events uint32
+	want   uint32
+	// Events reported for the file descriptor by the current call to poll.
+	revents uint32
+	added   bool
+	// Set for files that do not support epoll, which poll(2) reports as always
+	// ready for reading and writing (e.g. regular files).
+	unsupported bool
+	// Set when the file descriptor is not open.
+	invalid bool
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	timer, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_CLOEXEC|unix.TFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+	event := &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(timer)}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, timer, event); err != nil {
+		unix.Close(timer)
+		unix.Close(epfd)
+		return nil, err
+	}
+	return &poller{
+		epfd:       epfd,
+		timer:      timer,
+		registered: make(map[int32]*pollRegistration),
+	}, nil
+}
+
+func (p *poller) close() {
+	_ = unix.Close(p.epfd)
+	_ = unix.Close(p.timer)
+}
+
+// forget must be called before fd is closed or replaced, so the file
+// descriptor is registered again the next time it is polled.
+func (p *poller) forget(fd int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if r, ok := p.registered[int32(fd)]; ok {
+		if r.added {
+			_ = unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+		}
+		delete(p.registered, int32(fd))
+	}
+}
+
+// poll is equivalent to poll(2), but the timeout is expressed in nanoseconds.
+func (p *poller) poll(fds []unix.PollFd, timeout time.Duration) (int, error) {
+	if err := p.update(fds); err != nil {
+		return 0, err
+	}
+	n := p.ready(fds)
+	if n > 0 {
+		timeout = 0
+	}
+	msec := 0
+	if timeout != 0 {
+		if err := p.setTimer(timeout); err != nil {
+			return n, err
+		}
+		msec = -1
+	}
+	numEvents, err := unix.EpollWait(p.epfd, p.events, msec)
+	if err != nil {
+		return n, err
+	}
+	p.mutex.Lock()
+	for _, ev := range p.events[:numEvents] {
+		if r := p.registered[ev.Fd]; r != nil {
+			r.revents |= ev.Events
+		}
+	}
+	p.mutex.Unlock()
+	return p.ready(fds), nil
+}
+
+// setTimer arms the timer to expire after timeout, or disarms it if timeout
+// is negative. Setting the timer also clears its past expirations, so the
+// timer does not need to be read after it expires.
+func (p *poller) setTimer(timeout time.Duration) error {
+	if timeout < 0 && !p.armed {
+		return nil
+	}
+	var spec unix.ItimerSpec
+	if timeout > 0 {
+		spec.Value = unix.NsecToTimespec(int64(timeout))
+	}
+	if err := unix.TimerfdSettime(p.timer, 0, &spec, nil); err != nil {
+		return err
+	}
+	p.armed = timeout > 0
+	return nil
+}
+
+// update registers the file descriptors of fds, and unregisters those which
+// were not included.
+func (p *poller) update(fds []unix.PollFd) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.generation++
+
+	for i := range fds {
+		pf := &fds[i]
+		pf.Revents = 0
+		if pf.Fd < 0 {
+			continue
+		}
+		r := p.registered[pf.Fd]
+		if r == nil {
+			r = new(pollRegistration)
+			p.registered[pf.Fd] = r
+		}
+		if r.generation != p.generation {
+			r.generation, r.want, r.revents = p.generation, 0, 0
+		}
+		r.want |= uint32(uint16(pf.Events))
+	}
+
+	for fd, r := range p.registered {
+		var err error
+		switch {
+		case r.generation != p.generation:
+			if r.added {
+				err = unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, int(fd), nil)
+			}
+			delete(p.registered, fd)
+		case r.unsupported:
+		case !r.added:
+			err = p.ctl(unix.EPOLL_CTL_ADD, fd, r)
+		case r.events != r.want:
+			err = p.ctl(unix.EPOLL_CTL_MOD, fd, r)
+		}
+		switch err {
+		case nil, unix.ENOENT, unix.EBADF:
+		default:
+			return err
+		}
+	}
+
+	// The events have room for the timer.
+	n := len(p.registered) + 1
+	if cap(p.events) < n {
+		p.events = make([]unix.EpollEvent, n)
+	}
+	p.events = p.events[:n]
+	return nil
+}
+
+// ctl adds or modifies the registration of fd, recovering when the state of
+// the registration diverged from the one of the epoll instance.
+func (p *poller) ctl(op int, fd int32, r *pollRegistration) error {
+	event := &unix.EpollEvent{Events: r.want, Fd: fd}
+	err := unix.EpollCtl(p.epfd, op, int(fd), event)
+	switch {
+	case err == unix.EEXIST && op == unix.EPOLL_CTL_ADD:
+		err = unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, int(fd), event)
+	case err == unix.ENOENT && op == unix.EPOLL_CTL_MOD:
+		err = unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, int(fd), event)
+	}
+	switch err {
+	case nil:
+		r.events, r.added, r.invalid = r.want, true, false
+	case unix.EPERM:
+		r.unsupported = true
+		err = nil
+	case unix.EBADF:
+		r.invalid = true
+		err = nil
+	}
+	return err
+}
+
+// ready sets the events reported for each entry of fds and returns the number
+// of entries with events.
+func (p *poller) ready(fds []unix.PollFd) (n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range fds {
+		pf := &fds[i]
+		r := p.registered[pf.Fd]
+		if r == nil {
+			continue
+		}
+		switch {
+		case r.invalid:
+			pf.Revents = unix.POLLNVAL
+		case r.unsupported:
+			pf.Revents = pf.Events & (unix.POLLIN | unix.POLLOUT)
+		default:
+			pf.Revents = int16(r.revents & (uint32(uint16(pf.Events)) | unix.POLLERR | unix.POLLHUP))
+		}
+		if pf.Revents != 0 {
+			n++
+		}
+	}
+	return n
+}
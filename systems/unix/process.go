@@ -0,0 +1,281 @@
+package unix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+var _ wasi.Processes = (*System)(nil)
+
+// Process is a child process spawned by a guest.
+type Process interface {
+	// Wait blocks until the process exits, and returns its exit code.
+	Wait() (wasi.ExitCode, error)
+
+	// Signal sends a signal to the process.
+	Signal(signal wasi.Signal) error
+}
+
+// Spawner spawns the child processes of guests, with the given files as
+// their stdin, stdout, and stderr. The files are closed by the caller after
+// the spawner returns, spawners must duplicate them if they need to retain
+// them.
+//
+// Spawners return wasi.EACCES when the guest is not allowed to run the
+// program named by the first argument.
+type Spawner func(ctx context.Context, args []string, stdio [3]*os.File) (Process, error)
+
+type processes struct {
+	mutex    sync.Mutex
+	next     wasi.ProcessID
+	children map[wasi.ProcessID]*childProcess
+}
+
+type childProcess struct {
+	process Process
+	done    chan struct{}
+	code    wasi.ExitCode
+	err     error
+}
+
+func (p *processes) add(process Process) wasi.ProcessID {
+	c := &childProcess{process: process, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		c.code, c.err = process.Wait()
+	}()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.children == nil {
+		p.children = make(map[wasi.ProcessID]*childProcess)
+	}
+	for {
+		p.next++
+		if _, used := p.children[p.next]; !used && p.next != 0 {
+			break
+		}
+	}
+	p.children[p.next] = c
+	return p.next
+}
+
+func (p *processes) lookup(pid wasi.ProcessID) *childProcess {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.children[pid]
+}
+
+func (p *processes) remove(pid wasi.ProcessID) {
+	p.mutex.Lock()
+	delete(p.children, pid)
+	p.mutex.Unlock()
+}
+
+// close kills the child processes which are still running, so they do not
+// outlive the guest.
+func (p *processes) close() {
+	p.mutex.Lock()
+	children := p.children
+	p.children = nil
+	p.mutex.Unlock()
+	for _, c := range children {
+		select {
+		case <-c.done:
+		default:
+			_ = c.process.Signal(wasi.SIGKILL)
+		}
+	}
+}
+
+// ProcSpawn spawns a child process with the Spawn function of the system,
+// returning ENOSYS if it is nil.
+//
+// The stdio of the child process is connected to pipes; the file descriptors
+// of the guest are blocking, and can be put in non-blocking mode with
+// FDStatSetFlags to poll them.
+func (s *System) ProcSpawn(ctx context.Context, args []string) (wasi.ProcessID, [3]wasi.FD, wasi.Errno) {
+	stdio := [3]wasi.FD{-1, -1, -1}
+	if s.Spawn == nil {
+		return 0, stdio, wasi.ENOSYS
+	}
+	if len(args) == 0 {
+		return 0, stdio, wasi.EINVAL
+	}
+
+	// For each pipe, the host end is at index 0 and the end of the child
+	// at index 1.
+	var pipes [3][2]int
+	closePipes := func(end int) {
+		for _, p := range pipes {
+			if p[end] > 0 {
+				_ = closeTraceEBADF(p[end])
+			}
+		}
+	}
+	for i := range pipes {
+		fds := make([]int, 2)
+		if err := pipe(fds, 0); err != nil {
+			closePipes(0)
+			closePipes(1)
+			return 0, stdio, makeErrno(err)
+		}
+		if i == 0 {
+			pipes[i] = [2]int{fds[1], fds[0]}
+		} else {
+			pipes[i] = [2]int{fds[0], fds[1]}
+		}
+	}
+
+	var files [3]*os.File
+	for i, name := range [3]string{"stdin", "stdout", "stderr"} {
+		files[i] = os.NewFile(uintptr(pipes[i][1]), name)
+	}
+	process, err := s.Spawn(ctx, args, files)
+	for _, f := range files {
+		f.Close()
+	}
+	if err != nil {
+		closePipes(0)
+		return 0, stdio, spawnErrno(err)
+	}
+
+	for i, p := range pipes {
+		rights := wasi.FDReadRight
+		if i == 0 {
+			rights = wasi.FDWriteRight
+		}
+		stdio[i] = s.Register(FD(p[0]), wasi.FDStat{
+			FileType:   wasi.UnknownType,
+			RightsBase: rights | wasi.FDStatSetFlagsRight | wasi.PollFDReadWriteRight,
+		})
+	}
+	return s.processes.add(process), stdio, wasi.ESUCCESS
+}
+
+func (s *System) ProcWait(ctx context.Context, pid wasi.ProcessID, flags wasi.WaitFlags) (wasi.ExitCode, wasi.Errno) {
+	c := s.processes.lookup(pid)
+	if c == nil {
+		return 0, wasi.ECHILD
+	}
+	if flags.Has(wasi.WaitNoHang) {
+		select {
+		case <-c.done:
+		default:
+			return 0, wasi.EAGAIN
+		}
+	} else {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return 0, makeErrno(ctx.Err())
+		}
+	}
+	s.processes.remove(pid)
+	if c.err != nil {
+		return 0, spawnErrno(c.err)
+	}
+	return c.code, wasi.ESUCCESS
+}
+
+func (s *System) ProcKill(ctx context.Context, pid wasi.ProcessID, signal wasi.Signal) wasi.Errno {
+	c := s.processes.lookup(pid)
+	if c == nil {
+		return wasi.ESRCH
+	}
+	select {
+	case <-c.done:
+		// Like zombie processes, the process exists until it is waited.
+		return wasi.ESUCCESS
+	default:
+	}
+	if signal == wasi.SIGNONE {
+		return wasi.ESUCCESS
+	}
+	if err := c.process.Signal(signal); err != nil {
+		return spawnErrno(err)
+	}
+	return wasi.ESUCCESS
+}
+
+// spawnErrno converts the errors of spawners and processes, which may not
+// originate from system calls, to errno values.
+func spawnErrno(err error) wasi.Errno {
+	var errno wasi.Errno
+	var sysErrno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case errors.As(err, &sysErrno):
+		return makeErrno(sysErrno)
+	case errors.Is(err, os.ErrProcessDone):
+		return wasi.ESRCH
+	default:
+		return wasi.EIO
+	}
+}
+
+// CommandSpawner returns a Spawner running the host programs named by the
+// commands, which guests spawn by passing one of the names as first argument.
+// Commands which are not absolute paths are looked up in the PATH of the host.
+// The programs run in the working directory of the host, with the given
+// environment variables.
+func CommandSpawner(environ []string, commands ...string) Spawner {
+	allowed := make(map[string]struct{}, len(commands))
+	for _, name := range commands {
+		allowed[name] = struct{}{}
+	}
+	return func(ctx context.Context, args []string, stdio [3]*os.File) (Process, error) {
+		if _, ok := allowed[args[0]]; !ok {
+			return nil, wasi.EACCES
+		}
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			return nil, wasi.ENOENT
+		}
+		cmd := &exec.Cmd{
+			Path:   path,
+			Args:   args,
+			Env:    append([]string{}, environ...),
+			Stdin:  stdio[0],
+			Stdout: stdio[1],
+			Stderr: stdio[2],
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return (*command)(cmd), nil
+	}
+}
+
+type command exec.Cmd
+
+func (c *command) Wait() (wasi.ExitCode, error) {
+	err := (*exec.Cmd)(c).Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, err
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		if s, err := wasi.ParseSignal(unix.SignalName(status.Signal())); err == nil {
+			return s.ExitCode(), nil
+		}
+		return 128 + wasi.ExitCode(status.Signal()), nil
+	}
+	return wasi.ExitCode(exitErr.ExitCode()), nil
+}
+
+func (c *command) Signal(signal wasi.Signal) error {
+	num := unix.SignalNum(signal.Name())
+	if num == 0 {
+		return wasi.EINVAL
+	}
+	return c.Process.Signal(num)
+}
@@ -0,0 +1,70 @@
+package unix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/internal/proxy"
+	"golang.org/x/sys/unix"
+)
+
+// isProxied returns true if connections of the socket are routed through the
+// proxy, which is the case of TCP sockets.
+func isProxied(socket int) bool {
+	sotype, err := unix.GetsockoptInt(socket, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil || sotype != unix.SOCK_STREAM {
+		return false
+	}
+	sa, err := unix.Getsockname(socket)
+	if err != nil {
+		return false
+	}
+	switch sa.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrInet6:
+		return true
+	default:
+		return false
+	}
+}
+
+// proxyConnect connects socket to peer through the proxy, by replacing it
+// with a connection to the proxy server on which the handshake was made.
+func (s *System) proxyConnect(ctx context.Context, socket int, peer wasi.SocketAddress) wasi.Errno {
+	if _, err := unix.Getpeername(socket); err == nil {
+		return wasi.EISCONN
+	}
+	dialer := &net.Dialer{}
+	conn, err := proxy.Dial(ctx, s.Proxy, peer.String(), dialer.DialContext)
+	if err != nil {
+		return proxyErrno(err)
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return proxyErrno(err)
+	}
+	if ctrlErr := rawConn.Control(func(fd uintptr) {
+		err = replaceSocket(int(fd), socket)
+	}); ctrlErr != nil {
+		return proxyErrno(ctrlErr)
+	}
+	return makeErrno(err)
+}
+
+// proxyErrno converts errors from connecting through the proxy to errno
+// values. Failures to reach the proxy are reported as ECONNREFUSED.
+func proxyErrno(err error) wasi.Errno {
+	var sysErr syscall.Errno
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return wasi.MakeErrno(err)
+	case errors.As(err, &sysErr):
+		return makeErrno(sysErr)
+	default:
+		return wasi.ECONNREFUSED
+	}
+}
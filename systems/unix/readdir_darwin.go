@@ -31,7 +31,7 @@ type dirbuf struct {
 
 func (d *dirbuf) readDirEntries(entries []wasi.DirEntry, cookie wasi.DirCookie, bufferSizeBytes int) (int, error) {
 	if d.buffer == nil {
-		d.buffer = new([bufferSize]byte)
+		d.buffer = getDirent()
 	}
 
 	if cookie < d.cookie {
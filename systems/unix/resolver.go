@@ -0,0 +1,279 @@
+package unix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+)
+
+// SockAddressInfo implements getaddrinfo(3) for the sockets extensions.
+//
+// The results contain one entry per address and socket type: when the hints
+// do not select a socket type or protocol, each address is returned for
+// both stream (TCP) and datagram (UDP) sockets. IPv4 addresses are returned
+// before IPv6 addresses.
+//
+// When the name is empty, the results are the wildcard addresses if the
+// Passive flag is set, or the loopback addresses otherwise. The V4Mapped and
+// QueryAll flags control whether IPv4 addresses are returned as IPv4-mapped
+// IPv6 addresses when the Inet6Family is requested. The canonical name of
+// the first result is set to the name passed by the guest if the
+// CanonicalName flag is set; CNAME records are not resolved.
+//
+// Host names are resolved with the Resolver of the system, and the results
+// are cached for ResolverCacheTTL.
+func (s *System) SockAddressInfo(ctx context.Context, name, service string, hints wasi.AddressInfo, results []wasi.AddressInfo) (int, wasi.Errno) {
+	if len(results) == 0 {
+		return 0, wasi.EINVAL
+	}
+	if name == "" && service == "" {
+		return 0, wasi.EINVAL // EAI_NONAME
+	}
+	// TODO: support AI_ADDRCONFIG
+	switch hints.Family {
+	case wasi.UnspecifiedFamily, wasi.InetFamily, wasi.Inet6Family:
+	default:
+		return 0, wasi.ENOTSUP // EAI_FAMILY
+	}
+
+	type socketKind struct {
+		socketType wasi.SocketType
+		protocol   wasi.Protocol
+		network    string
+	}
+	stream := socketKind{wasi.StreamSocket, wasi.TCPProtocol, "tcp"}
+	datagram := socketKind{wasi.DatagramSocket, wasi.UDPProtocol, "udp"}
+
+	var kinds []socketKind
+	switch p := hints.Protocol; hints.SocketType {
+	case wasi.StreamSocket:
+		if p == wasi.UDPProtocol {
+			return 0, wasi.ENOTSUP // EAI_SOCKTYPE
+		}
+		kinds = []socketKind{stream}
+	case wasi.DatagramSocket:
+		if p == wasi.TCPProtocol {
+			return 0, wasi.ENOTSUP // EAI_SOCKTYPE
+		}
+		kinds = []socketKind{datagram}
+	case wasi.AnySocket:
+		switch p {
+		case wasi.TCPProtocol:
+			kinds = []socketKind{stream}
+		case wasi.UDPProtocol:
+			kinds = []socketKind{datagram}
+		default:
+			kinds = []socketKind{stream, datagram}
+		}
+	default:
+		return 0, wasi.ENOTSUP // EAI_SOCKTYPE
+	}
+
+	ports := make([]int, len(kinds))
+	if service != "" {
+		if port, err := strconv.Atoi(service); err == nil {
+			for i := range ports {
+				ports[i] = port
+			}
+		} else if hints.Flags.Has(wasi.NumericService) {
+			return 0, wasi.EINVAL // EAI_NONAME
+		} else {
+			// Services may only exist for one of the socket types, which
+			// are then excluded from the results.
+			n := 0
+			for i, kind := range kinds {
+				port, err := net.DefaultResolver.LookupPort(ctx, kind.network, service)
+				if err == nil {
+					kinds[n], ports[n] = kinds[i], port
+					n++
+				}
+			}
+			if n == 0 {
+				return 0, wasi.EINVAL // EAI_SERVICE
+			}
+			kinds, ports = kinds[:n], ports[:n]
+		}
+		for _, port := range ports {
+			if port < 0 || port > 65535 {
+				return 0, wasi.EINVAL // EAI_SERVICE
+			}
+		}
+	}
+
+	var ips []net.IP
+	switch {
+	case name == "":
+		if hints.Flags.Has(wasi.Passive) {
+			ips = []net.IP{net.IPv4zero, net.IPv6unspecified}
+		} else {
+			ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		}
+	case hints.Flags.Has(wasi.NumericHost) || net.ParseIP(name) != nil:
+		ip := net.ParseIP(name)
+		if ip == nil {
+			return 0, wasi.EINVAL // EAI_NONAME
+		}
+		ips = []net.IP{ip}
+	default:
+		var err error
+		ips, err = s.lookupIP(ctx, name)
+		if err != nil {
+			return 0, lookupErrno(err)
+		}
+	}
+
+	var addrs4, addrs6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			addrs4 = append(addrs4, ip)
+		} else {
+			addrs6 = append(addrs6, ip)
+		}
+	}
+	switch hints.Family {
+	case wasi.InetFamily:
+		addrs6 = nil
+	case wasi.Inet6Family:
+		if hints.Flags.Has(wasi.V4Mapped) && (len(addrs6) == 0 || hints.Flags.Has(wasi.QueryAll)) {
+			for _, ip := range addrs4 {
+				addrs6 = append(addrs6, ip.To16())
+			}
+		}
+		addrs4 = nil
+	}
+	if len(addrs4) == 0 && len(addrs6) == 0 {
+		return 0, wasi.ENOENT // EAI_NONAME
+	}
+
+	n := 0
+	for _, family := range [2]wasi.ProtocolFamily{wasi.InetFamily, wasi.Inet6Family} {
+		addrs := addrs4
+		if family == wasi.Inet6Family {
+			addrs = addrs6
+		}
+		for _, ip := range addrs {
+			for i, kind := range kinds {
+				if n == len(results) {
+					return n, wasi.ESUCCESS
+				}
+				r := wasi.AddressInfo{
+					Flags:      hints.Flags,
+					Family:     family,
+					SocketType: kind.socketType,
+					Protocol:   kind.protocol,
+				}
+				if family == wasi.InetFamily {
+					addr := &wasi.Inet4Address{Port: ports[i]}
+					copy(addr.Addr[:], ip.To4())
+					r.Address = addr
+				} else {
+					addr := &wasi.Inet6Address{Port: ports[i]}
+					copy(addr.Addr[:], ip.To16())
+					r.Address = addr
+				}
+				if n == 0 && hints.Flags.Has(wasi.CanonicalName) {
+					r.CanonicalName = strings.TrimSuffix(name, ".")
+				}
+				results[n] = r
+				n++
+			}
+		}
+	}
+	return n, wasi.ESUCCESS
+}
+
+// lookupErrno converts errors returned by name resolution to errno values,
+// following the EAI_* error codes of getaddrinfo(3).
+func lookupErrno(err error) wasi.Errno {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return wasi.MakeErrno(err)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return wasi.ENOENT // EAI_NONAME
+	case errors.As(err, &dnsErr) && (dnsErr.IsTimeout || dnsErr.IsTemporary):
+		return wasi.EAGAIN // EAI_AGAIN
+	default:
+		return wasi.EIO // EAI_FAIL
+	}
+}
+
+// maxResolverCacheSize is the maximum number of names that the resolver
+// cache holds.
+const maxResolverCacheSize = 1024
+
+type resolverCache struct {
+	mutex   sync.Mutex
+	entries map[string]resolverCacheEntry
+}
+
+type resolverCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func (c *resolverCache) get(name string, now time.Time) ([]net.IP, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[name]
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+	return e.ips, true
+}
+
+func (c *resolverCache) put(name string, ips []net.IP, now time.Time, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]resolverCacheEntry)
+	}
+	if len(c.entries) >= maxResolverCacheSize {
+		// Evict the expired entries, or arbitrary entries if there are not
+		// enough of them.
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxResolverCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[name] = resolverCacheEntry{ips: ips, expires: now.Add(ttl)}
+}
+
+// lookupIP resolves name to its IPv4 and IPv6 addresses, with the Resolver
+// of the system, or net.DefaultResolver if it is nil. Successful lookups are
+// cached for ResolverCacheTTL.
+func (s *System) lookupIP(ctx context.Context, name string) ([]net.IP, error) {
+	ttl := s.ResolverCacheTTL
+	if ttl > 0 {
+		if ips, ok := s.resolverCache.get(name, time.Now()); ok {
+			return ips, nil
+		}
+	}
+	var ips []net.IP
+	var err error
+	if s.Resolver != nil {
+		ips, err = s.Resolver(ctx, name)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		s.resolverCache.put(name, ips, time.Now(), ttl)
+	}
+	return ips, nil
+}
@@ -1,6 +1,9 @@
 package unix
 
 import (
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -8,6 +11,11 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
+
 func accept(socket, flags int) (int, unix.Sockaddr, error) {
 	conn, addr, err := acceptCloseOnExec(socket)
 	if err != nil {
@@ -117,18 +125,6 @@ func fsetattrlist(fd int, attrlist *unix.Attrlist, attrbuf unsafe.Pointer, attrb
 	return nil
 }
 
-const minIovec = 8
-
-func appendBytes(vecs []unix.Iovec, bs [][]byte) []unix.Iovec {
-	for _, b := range bs {
-		vecs = append(vecs, unix.Iovec{
-			Base: unsafe.SliceData(b),
-			Len:  uint64(len(b)),
-		})
-	}
-	return vecs
-}
-
 func fdadvise(fd int, offset, length int64, advice wasi.Advice) error {
 	// Since posix_fadvise is not available, just ignore the hint.
 	return nil
@@ -188,25 +184,23 @@ func lseek(fd int, offset int64, whence int) (int64, error) {
 }
 
 func readv(fd int, iovs [][]byte) (int, error) {
-	iovecs := make([]unix.Iovec, 0, minIovec)
-	iovecs = appendBytes(iovecs, iovs)
-	n, _, err := unix.Syscall(
-		uintptr(unix.SYS_READV),
-		uintptr(fd),
-		uintptr(unsafe.Pointer(unsafe.SliceData(iovecs))),
-		uintptr(len(iovecs)),
-	)
-	if err != 0 {
-		return int(n), err
-	}
-	return int(n), nil
+	return rwv(unix.SYS_READV, fd, iovs)
 }
 
 func writev(fd int, iovs [][]byte) (int, error) {
+	return rwv(unix.SYS_WRITEV, fd, iovs)
+}
+
+func rwv(trap uintptr, fd int, iovs [][]byte) (int, error) {
 	iovecs := make([]unix.Iovec, 0, minIovec)
+	if len(iovs) > minIovec {
+		buffer := getIovecs()
+		defer putIovecs(buffer, len(iovs))
+		iovecs = buffer[:0]
+	}
 	iovecs = appendBytes(iovecs, iovs)
 	n, _, err := unix.Syscall(
-		uintptr(unix.SYS_WRITEV),
+		trap,
 		uintptr(fd),
 		uintptr(unsafe.Pointer(unsafe.SliceData(iovecs))),
 		uintptr(len(iovecs)),
@@ -217,7 +211,39 @@ func writev(fd int, iovs [][]byte) (int, error) {
 	return int(n), nil
 }
 
+// System call numbers of preadv and pwritev, which were added in macOS 11
+// (Darwin 20) and are not yet defined by x/sys/unix.
+const (
+	sysPreadv  = 540
+	sysPwritev = 541
+)
+
+// hasPreadv reports whether the kernel supports preadv and pwritev. Calling
+// an unknown system call raises SIGSYS, which would crash the program, so the
+// kernel version is checked instead of probing the system calls.
+func hasPreadv() bool {
+	preadvOnce.Do(func() {
+		var uts unix.Utsname
+		if unix.Uname(&uts) != nil {
+			return
+		}
+		release := unix.ByteSliceToString(uts.Release[:])
+		major, _, _ := strings.Cut(release, ".")
+		n, err := strconv.Atoi(major)
+		preadvSupported = err == nil && n >= 20
+	})
+	return preadvSupported
+}
+
+var (
+	preadvOnce      sync.Once
+	preadvSupported bool
+)
+
 func preadv(fd int, iovs [][]byte, offset int64) (int, error) {
+	if hasPreadv() {
+		return prwv(sysPreadv, fd, iovs, offset)
+	}
 	read := 0
 	for _, iov := range iovs {
 		n, err := unix.Pread(fd, iov, offset)
@@ -231,6 +257,9 @@ func preadv(fd int, iovs [][]byte, offset int64) (int, error) {
 }
 
 func pwritev(fd int, iovs [][]byte, offset int64) (int, error) {
+	if hasPreadv() {
+		return prwv(sysPwritev, fd, iovs, offset)
+	}
 	written := 0
 	for _, iov := range iovs {
 		n, err := unix.Pwrite(fd, iov, offset)
@@ -243,6 +272,79 @@ func pwritev(fd int, iovs [][]byte, offset int64) (int, error) {
 	return written, nil
 }
 
+func prwv(trap uintptr, fd int, iovs [][]byte, offset int64) (int, error) {
+	iovecs := make([]unix.Iovec, 0, minIovec)
+	if len(iovs) > minIovec {
+		buffer := getIovecs()
+		defer putIovecs(buffer, len(iovs))
+		iovecs = buffer[:0]
+	}
+	iovecs = appendBytes(iovecs, iovs)
+	n, _, err := unix.Syscall6(
+		trap,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(unsafe.SliceData(iovecs))),
+		uintptr(len(iovecs)),
+		uintptr(offset),
+		0,
+		0,
+	)
+	if err != 0 {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// copyFile copies data from the file in to out with sendfile(2), which only
+// supports copying regular files to stream sockets on macOS.
+func copyFile(out, in, size int) (int, error) {
+	offset, err := lseek(in, 0, unix.SEEK_CUR)
+	if err != nil {
+		return -1, unix.ENOTSUP
+	}
+	// sendfile(2) does not use nor update the position of the file, and
+	// reports the number of bytes written even when it fails.
+	n, err := unix.Sendfile(out, in, &offset, size)
+	if n > 0 {
+		if _, err := lseek(in, offset+int64(n), unix.SEEK_SET); err != nil {
+			return -1, err
+		}
+		return n, nil
+	}
+	switch err {
+	case unix.ENOTSOCK, unix.EOPNOTSUPP, unix.EINVAL:
+		err = unix.ENOTSUP
+	}
+	return n, err
+}
+
+// oPath opens files to use as directory file descriptors; darwin has no
+// equivalent of O_PATH.
+const oPath = unix.O_RDONLY
+
+// openat opens path beneath the directory dirfd. Darwin has no equivalent of
+// openat2(2) on Linux, the path is resolved by openBeneath.
+func openat(dirfd int, path string, flags int, mode uint32) (int, error) {
+	return openBeneath(dirfd, path, flags, mode)
+}
+
+func dup2(oldfd, newfd int) error {
+	if err := unix.Dup2(oldfd, newfd); err != nil {
+		return err
+	}
+	unix.CloseOnExec(newfd)
+	return nil
+}
+
 func getsocketdomain(fd int) (int, error) {
 	return 0, unix.ENOSYS
 }
+
+// clockBoottime is the clock that includes the time during which the system
+// was suspended; unlike on Linux, CLOCK_MONOTONIC advances during sleep on
+// darwin.
+const clockBoottime = unix.CLOCK_MONOTONIC
+
+// tcpKeepIdle is the option setting the idle time before keep-alive probes,
+// named TCP_KEEPALIVE on darwin.
+const tcpKeepIdle = unix.TCP_KEEPALIVE
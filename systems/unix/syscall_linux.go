@@ -1,6 +1,7 @@
 package unix
 
 import (
+	"sync"
 	"unsafe"
 
 	"github.com/stealthrocket/wasi-go"
@@ -12,6 +13,11 @@ const (
 	__UTIME_OMIT = unix.UTIME_OMIT
 )
 
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
+
 func accept(socket, flags int) (int, unix.Sockaddr, error) {
 	return unix.Accept4(socket, flags|unix.O_CLOEXEC)
 }
@@ -74,22 +80,146 @@ func lseek(fd int, offset int64, whence int) (int64, error) {
 	return unix.Seek(fd, offset, whence)
 }
 
+// The vectored I/O functions make the system calls directly instead of using
+// unix.Readv and its siblings, which allocate the iovecs on the heap on each
+// call.
+
 func readv(fd int, iovs [][]byte) (int, error) {
-	return unix.Readv(fd, iovs)
+	return rwv(unix.SYS_READV, fd, iovs)
 }
 
 func writev(fd int, iovs [][]byte) (int, error) {
-	return unix.Writev(fd, iovs)
+	return rwv(unix.SYS_WRITEV, fd, iovs)
 }
 
 func preadv(fd int, iovs [][]byte, offset int64) (int, error) {
-	return unix.Preadv(fd, iovs, offset)
+	return prwv(unix.SYS_PREADV, fd, iovs, offset)
 }
 
 func pwritev(fd int, iovs [][]byte, offset int64) (int, error) {
-	return unix.Pwritev(fd, iovs, offset)
+	return prwv(unix.SYS_PWRITEV, fd, iovs, offset)
+}
+
+func rwv(trap uintptr, fd int, iovs [][]byte) (int, error) {
+	iovecs := make([]unix.Iovec, 0, minIovec)
+	if len(iovs) > minIovec {
+		buffer := getIovecs()
+		defer putIovecs(buffer, len(iovs))
+		iovecs = buffer[:0]
+	}
+	iovecs = appendBytes(iovecs, iovs)
+	n, _, err := unix.Syscall(
+		trap,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(unsafe.SliceData(iovecs))),
+		uintptr(len(iovecs)),
+	)
+	if err != 0 {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+func prwv(trap uintptr, fd int, iovs [][]byte, offset int64) (int, error) {
+	iovecs := make([]unix.Iovec, 0, minIovec)
+	if len(iovs) > minIovec {
+		buffer := getIovecs()
+		defer putIovecs(buffer, len(iovs))
+		iovecs = buffer[:0]
+	}
+	iovecs = appendBytes(iovecs, iovs)
+	// The offset is passed in two registers on 32 bits platforms, see
+	// https://man7.org/linux/man-pages/man2/preadv.2.html
+	const longBits = 32 << (^uintptr(0) >> 63)
+	n, _, err := unix.Syscall6(
+		trap,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(unsafe.SliceData(iovecs))),
+		uintptr(len(iovecs)),
+		uintptr(offset),
+		uintptr(uint64(offset)>>(longBits-1)>>1),
+		0,
+	)
+	if err != 0 {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// copyFile copies data from the file in to out with sendfile(2), which
+// requires in to be a file that can be mapped into memory (e.g. regular
+// files), or splice(2), which requires one of the files to be a pipe.
+func copyFile(out, in, size int) (int, error) {
+	n, err := unix.Sendfile(out, in, nil, size)
+	if err == unix.EINVAL {
+		// The type of the result of unix.Splice differs between platforms.
+		m, serr := unix.Splice(in, nil, out, nil, size, unix.SPLICE_F_MOVE)
+		n, err = int(m), serr
+		if err == unix.EINVAL {
+			err = unix.ENOTSUP
+		}
+	}
+	return n, err
+}
+
+// oPath opens files to use as directory file descriptors only.
+const oPath = unix.O_PATH
+
+// openat opens path beneath the directory dirfd with openat2(2), which
+// rejects the resolutions escaping the directory in the kernel, in a single
+// system call regardless of the depth of the path. When openat2 is not
+// available, the path is resolved by openBeneath.
+func openat(dirfd int, path string, flags int, mode uint32) (int, error) {
+	if !hasOpenat2() {
+		return openBeneath(dirfd, path, flags, mode)
+	}
+	how := unix.OpenHow{
+		Flags:   uint64(flags),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	// openat2 fails with EINVAL if a mode is set without O_CREAT.
+	if (flags & unix.O_CREAT) != 0 {
+		how.Mode = uint64(mode)
+	}
+	return unix.Openat2(dirfd, path, &how)
+}
+
+// hasOpenat2 probes once whether openat2 is available. Kernels older than
+// Linux 5.6 do not support it and fail with ENOSYS, and seccomp filters (e.g.
+// the default profiles of container runtimes) which do not know of it fail
+// with EPERM. The probe opens the current directory, so an EPERM is never
+// caused by the file being opened, which would disable openat2 for all the
+// calls that follow.
+func hasOpenat2() bool {
+	openat2Once.Do(func() {
+		fd, err := unix.Openat2(unix.AT_FDCWD, ".", &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_BENEATH,
+		})
+		if err == nil {
+			unix.Close(fd)
+		}
+		openat2Supported = err != unix.ENOSYS && err != unix.EPERM
+	})
+	return openat2Supported
+}
+
+var (
+	openat2Once      sync.Once
+	openat2Supported bool
+)
+
+func dup2(oldfd, newfd int) error {
+	return unix.Dup3(oldfd, newfd, unix.O_CLOEXEC)
 }
 
 func getsocketdomain(fd int) (int, error) {
 	return unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
 }
+
+// clockBoottime is the clock that includes the time during which the system
+// was suspended.
+const clockBoottime = unix.CLOCK_BOOTTIME
+
+// tcpKeepIdle is the option setting the idle time before keep-alive probes.
+const tcpKeepIdle = unix.TCP_KEEPIDLE
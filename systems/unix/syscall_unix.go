@@ -103,3 +103,148 @@ var _ []byte = (wasi.IOVec)(nil)
 func makeIOVecs(iovecs []wasi.IOVec) [][]byte {
 	return *(*[][]byte)(unsafe.Pointer(&iovecs))
 }
+
+const (
+	// minIovec is the number of iovecs that fit on the stack of the functions
+	// performing vectored I/O, so the common cases do not allocate.
+	minIovec = 8
+	// maxIovec is the limit on the number of iovecs of vectored I/O system
+	// calls (IOV_MAX), which fail with EINVAL when it is exceeded.
+	maxIovec = 1024
+)
+
+// appendBytes appends iovecs pointing directly to the buffers of bs, so the
+// guest memory is read or written without intermediary copies. Only the first
+// maxIovec buffers are used; the operation then transfers less bytes than
+// requested, which POSIX permits and guests must handle already.
+func appendBytes(vecs []unix.Iovec, bs [][]byte) []unix.Iovec {
+	if len(bs) > maxIovec {
+		bs = bs[:maxIovec]
+	}
+	for _, b := range bs {
+		vec := unix.Iovec{Base: unsafe.SliceData(b)}
+		vec.SetLen(len(b))
+		vecs = append(vecs, vec)
+	}
+	return vecs
+}
+
+// sendmsg sends the buffers of iovs and the control data oob on the connected
+// socket fd with a single call to sendmsg(2). Like with the other vectored I/O
+// functions, the iovecs point directly to the buffers and are not allocated on
+// the heap. Unlike them, the message is not truncated when there are more than
+// maxIovec buffers, the function fails with EMSGSIZE instead.
+func sendmsg(fd int, iovs [][]byte, oob []byte, flags int) (int, error) {
+	if len(iovs) > maxIovec {
+		return -1, unix.EMSGSIZE
+	}
+	iovecs := make([]unix.Iovec, 0, minIovec)
+	if len(iovs) > minIovec {
+		buffer := getIovecs()
+		defer putIovecs(buffer, len(iovs))
+		iovecs = buffer[:0]
+	}
+	iovecs = appendBytes(iovecs, iovs)
+
+	var msg unix.Msghdr
+	if len(iovecs) > 0 {
+		msg.Iov = &iovecs[0]
+		msg.SetIovlen(len(iovecs))
+	}
+	if len(oob) > 0 {
+		msg.Control = &oob[0]
+		msg.SetControllen(len(oob))
+	}
+	n, _, err := unix.Syscall(
+		uintptr(unix.SYS_SENDMSG),
+		uintptr(fd),
+		uintptr(unsafe.Pointer(&msg)),
+		uintptr(flags),
+	)
+	if err != 0 {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// recvmsg receives data in the buffers of iovs and control data in oob from
+// the socket fd with a single call to recvmsg(2). The address of the peer is
+// written to rsa if it is not nil; its length is zero if the socket did not
+// report an address. The function returns the number of bytes received, the
+// length of the control data, the message flags, and the address length.
+func recvmsg(fd int, iovs [][]byte, oob []byte, flags int, rsa *unix.RawSockaddrAny) (n, oobn, recvflags int, salen uint32, err error) {
+	if len(iovs) > maxIovec {
+		return -1, 0, 0, 0, unix.EMSGSIZE
+	}
+	iovecs := make([]unix.Iovec, 0, minIovec)
+	if len(iovs) > minIovec {
+		buffer := getIovecs()
+		defer putIovecs(buffer, len(iovs))
+		iovecs = buffer[:0]
+	}
+	iovecs = appendBytes(iovecs, iovs)
+
+	var msg unix.Msghdr
+	if len(iovecs) > 0 {
+		msg.Iov = &iovecs[0]
+		msg.SetIovlen(len(iovecs))
+	}
+	if len(oob) > 0 {
+		msg.Control = &oob[0]
+		msg.SetControllen(len(oob))
+	}
+	if rsa != nil {
+		msg.Name = (*byte)(unsafe.Pointer(rsa))
+		msg.Namelen = unix.SizeofSockaddrAny
+	}
+	r, _, errno := unix.Syscall(
+		uintptr(unix.SYS_RECVMSG),
+		uintptr(fd),
+		uintptr(unsafe.Pointer(&msg)),
+		uintptr(flags),
+	)
+	if errno != 0 {
+		return int(r), 0, 0, 0, errno
+	}
+	return int(r), int(msg.Controllen), int(msg.Flags), msg.Namelen, nil
+}
+
+func anyToSockaddr(rsa *unix.RawSockaddrAny, size uint32) (unix.Sockaddr, error) {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa := &unix.SockaddrInet4{Addr: pp.Addr}
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		sa.Port = int(p[0])<<8 + int(p[1])
+		return sa, nil
+	case unix.AF_INET6:
+		pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		sa := &unix.SockaddrInet6{Addr: pp.Addr, ZoneId: pp.Scope_id}
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		sa.Port = int(p[0])<<8 + int(p[1])
+		return sa, nil
+	case unix.AF_UNIX:
+		pp := (*unix.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		n := int(size) - int(unsafe.Offsetof(pp.Path))
+		if n < 0 {
+			n = 0
+		}
+		if n > len(pp.Path) {
+			n = len(pp.Path)
+		}
+		path := unsafe.Slice((*byte)(unsafe.Pointer(&pp.Path[0])), n)
+		if n > 0 && path[0] == 0 {
+			// Abstract socket names are reported with a leading '@'.
+			path = append([]byte{'@'}, path[1:]...)
+		} else {
+			for i, c := range path {
+				if c == 0 {
+					path = path[:i]
+					break
+				}
+			}
+		}
+		return &unix.SockaddrUnix{Name: string(path)}, nil
+	}
+	return nil, unix.EAFNOSUPPORT
+}
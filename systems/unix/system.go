@@ -5,9 +5,8 @@ import (
 	"errors"
 	"io"
 	"net"
-	"os"
+	"net/url"
 	"runtime"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,7 +17,14 @@ import (
 
 // System is a WASI preview 1 implementation for Unix.
 //
-// An instance of System is not safe for concurrent use.
+// An instance of System is safe for concurrent calls on different file
+// descriptors, but not for all concurrent calls on the same file descriptor
+// (e.g. fd_close or fd_readdir); guests making concurrent system calls
+// require wrapping it with wasi.Synchronize.
+//
+// Paths passed to the path_* functions are resolved beneath the directory
+// they are relative to; the functions fail with EPERM when the resolution
+// escapes the directory, including through symbolic links.
 type System struct {
 	// Args are the environment variables accessible via ArgsGet.
 	Args []string
@@ -34,6 +40,18 @@ type System struct {
 	Monotonic          func(context.Context) (uint64, error)
 	MonotonicPrecision time.Duration
 
+	// ProcessCPUTime returns the CPU time consumed by the process running
+	// the guest (see ProcessCPUTime). If ProcessCPUTime is nil, the clock
+	// is not supported.
+	ProcessCPUTime          func(context.Context) (uint64, error)
+	ProcessCPUTimePrecision time.Duration
+
+	// ThreadCPUTime returns the CPU time consumed by the thread running the
+	// guest (see NewThreadCPUTime). If ThreadCPUTime is nil, the clock is
+	// not supported.
+	ThreadCPUTime          func(context.Context) (uint64, error)
+	ThreadCPUTimePrecision time.Duration
+
 	// Yield is called when SchedYield is called. If Yield is nil,
 	// SchedYield is a noop.
 	Yield func(context.Context) error
@@ -46,19 +64,74 @@ type System struct {
 	// If Raise is nil, ProcRaise is a noop.
 	Raise func(context.Context, int) error
 
-	// Rand is the source for RandomGet.
+	// Rand is the source for RandomGet. If Rand is nil, RandomGet returns
+	// ENOSYS.
 	Rand io.Reader
 
+	// Resolver is called to resolve host names to IP addresses, in
+	// SockAddressInfo and when opening sockets with PathOpenSockets. If
+	// Resolver is nil, names are resolved with net.DefaultResolver.
+	Resolver func(ctx context.Context, name string) ([]net.IP, error)
+
+	// ResolverCacheTTL is the duration for which the addresses that host
+	// names resolve to are cached. Caching is disabled when zero.
+	ResolverCacheTTL time.Duration
+
+	// Proxy is the URL of a SOCKS5 (socks5://) or HTTP CONNECT (http://)
+	// proxy server that the outbound TCP connections of the guest are routed
+	// through, if not nil. See SockConnect for details.
+	Proxy *url.URL
+
+	// Network is the virtual network that the loopback TCP sockets of the
+	// guest are connected to, if not nil. See VirtualNetwork for details.
+	Network *VirtualNetwork
+
+	// IOUring enables the io_uring(7) implementation of FDRead, FDWrite,
+	// PollOneOff and SockAccept on Linux, which submits the operations to a
+	// ring shared with the kernel. The system falls back to the classic
+	// system calls when io_uring is not supported or not permitted, and on
+	// other platforms.
+	IOUring bool
+
+	// DirCacheSize is the number of handles to directories that PathOpen
+	// keeps open to resolve the paths of the files in those directories
+	// without walking the whole path again. The cache is invalidated when
+	// the guest renames or removes files, but not when other processes make
+	// changes to the file system. Caching is disabled when zero.
+	DirCacheSize int
+
+	// Spawn spawns the child processes of the guest in ProcSpawn (see
+	// CommandSpawner). If Spawn is nil, ProcSpawn returns ENOSYS.
+	Spawn Spawner
+
 	wasi.FileTable[FD]
 
-	pollfds []unix.PollFd
-	inet4   unix.SockaddrInet4
-	inet6   unix.SockaddrInet6
-	unix    unix.SockaddrUnix
+	// Buffers of poll file descriptors (*[]unix.PollFd) reused across calls
+	// to PollOneOff, which may be concurrent (see wasi.Synchronize).
+	pollfds sync.Pool
+
+	resolverCache resolverCache
+
+	pollers pollers
+
+	dirCache dirCache
+
+	mappings fileMappings
+
+	terminals terminals
+
+	events events
 
-	mutex sync.Mutex
-	wake  [2]*os.File
-	shut  atomic.Bool
+	processes processes
+
+	ring    *uring
+	ringErr error
+
+	mutex  sync.Mutex
+	wake   *waker
+	shut   atomic.Bool
+	cancel cancellation
+	resize windowResize
 }
 
 var _ wasi.System = (*System)(nil)
@@ -87,8 +160,16 @@ func (s *System) ClockResGet(ctx context.Context, id wasi.ClockID) (wasi.Timesta
 		return wasi.Timestamp(s.RealtimePrecision), wasi.ESUCCESS
 	case wasi.Monotonic:
 		return wasi.Timestamp(s.MonotonicPrecision), wasi.ESUCCESS
-	case wasi.ProcessCPUTimeID, wasi.ThreadCPUTimeID:
-		return 0, wasi.ENOTSUP
+	case wasi.ProcessCPUTimeID:
+		if s.ProcessCPUTime == nil {
+			return 0, wasi.ENOTSUP
+		}
+		return wasi.Timestamp(s.ProcessCPUTimePrecision), wasi.ESUCCESS
+	case wasi.ThreadCPUTimeID:
+		if s.ThreadCPUTime == nil {
+			return 0, wasi.ENOTSUP
+		}
+		return wasi.Timestamp(s.ThreadCPUTimePrecision), wasi.ESUCCESS
 	default:
 		return 0, wasi.EINVAL
 	}
@@ -108,28 +189,160 @@ func (s *System) ClockTimeGet(ctx context.Context, id wasi.ClockID, precision wa
 		}
 		t, err := s.Monotonic(ctx)
 		return wasi.Timestamp(t), makeErrno(err)
-	case wasi.ProcessCPUTimeID, wasi.ThreadCPUTimeID:
-		return 0, wasi.ENOTSUP
+	case wasi.ProcessCPUTimeID:
+		if s.ProcessCPUTime == nil {
+			return 0, wasi.ENOTSUP
+		}
+		t, err := s.ProcessCPUTime(ctx)
+		return wasi.Timestamp(t), makeErrno(err)
+	case wasi.ThreadCPUTimeID:
+		if s.ThreadCPUTime == nil {
+			return 0, wasi.ENOTSUP
+		}
+		t, err := s.ThreadCPUTime(ctx)
+		return wasi.Timestamp(t), makeErrno(err)
 	default:
 		return 0, wasi.EINVAL
 	}
 }
 
+func (s *System) FDRead(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	ring := s.uring()
+	if ring == nil {
+		return s.FileTable.FDRead(ctx, fd, iovecs)
+	}
+	f, stat, errno := s.LookupFD(fd, wasi.FDReadRight)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	nonblock := stat.Flags.Has(wasi.NonBlock)
+	n, err := handleEINTR(func() (int, error) { return ring.readv(int(f), makeIOVecs(iovecs), nonblock) })
+	return wasi.Size(n), makeErrno(err)
+}
+
+func (s *System) FDWrite(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec) (wasi.Size, wasi.Errno) {
+	ring := s.uring()
+	if ring == nil {
+		return s.FileTable.FDWrite(ctx, fd, iovecs)
+	}
+	f, stat, errno := s.LookupFD(fd, wasi.FDWriteRight)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	nonblock := stat.Flags.Has(wasi.NonBlock)
+	n, err := handleEINTR(func() (int, error) { return ring.writev(int(f), makeIOVecs(iovecs), nonblock) })
+	return wasi.Size(n), makeErrno(err)
+}
+
+// FDCopy copies data from the file descriptor in to out on the host (see
+// wasi.FileCopier), with sendfile(2) or splice(2) on Linux, and sendfile(2)
+// from files to sockets on macOS. It returns ENOTSUP for the other types of
+// files.
+func (s *System) FDCopy(ctx context.Context, out, in wasi.FD, size wasi.FileSize) (wasi.FileSize, wasi.Errno) {
+	src, _, errno := s.LookupFD(in, wasi.FDReadRight)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	dst, _, errno := s.LookupFD(out, wasi.FDWriteRight)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	if size > maxCopy {
+		size = maxCopy
+	}
+	n, err := handleEINTR(func() (int, error) { return copyFile(int(dst), int(src), int(size)) })
+	if err != nil {
+		return 0, makeErrno(err)
+	}
+	return wasi.FileSize(n), wasi.ESUCCESS
+}
+
+// maxCopy is the maximum number of bytes copied by a call to FDCopy, which
+// bounds the time that the call blocks on blocking file descriptors.
+const maxCopy = 1 << 30
+
+// FDClose closes the file descriptor. Since the file descriptors polled by
+// PollOneOff remain registered with the pollers of the system, they are
+// unregistered first, and the directory handles cached for the file
+// descriptor are closed, as well as the mapping created by FDMmap.
+func (s *System) FDClose(ctx context.Context, fd wasi.FD) wasi.Errno {
+	if f, _, errno := s.LookupFD(fd, 0); errno == wasi.ESUCCESS {
+		s.pollers.forget(int(f))
+		s.dirCache.forget(f)
+		s.mappings.forget(int(f))
+		s.terminals.forget(int(f))
+	}
+	return s.FileTable.FDClose(ctx, fd)
+}
+
+func (s *System) FDRenumber(ctx context.Context, from, to wasi.FD) wasi.Errno {
+	if f, _, errno := s.LookupFD(to, 0); errno == wasi.ESUCCESS {
+		s.pollers.forget(int(f))
+		s.dirCache.forget(f)
+		s.mappings.forget(int(f))
+		s.terminals.forget(int(f))
+	}
+	return s.FileTable.FDRenumber(ctx, from, to)
+}
+
+// PathOpen opens a file relative to the directory fd. When DirCacheSize is
+// set, the file is opened from the cached handle of its directory.
+func (s *System) PathOpen(ctx context.Context, fd wasi.FD, lookupFlags wasi.LookupFlags, path string, openFlags wasi.OpenFlags, rightsBase, rightsInheriting wasi.Rights, fdFlags wasi.FDFlags) (wasi.FD, wasi.Errno) {
+	if s.DirCacheSize <= 0 {
+		return s.FileTable.PathOpen(ctx, fd, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	}
+	return s.FileTable.PathOpenFunc(ctx, fd, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags, s.dirCache.pathOpen(s.DirCacheSize))
+}
+
+func (s *System) PathRemoveDirectory(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	errno := s.FileTable.PathRemoveDirectory(ctx, fd, path)
+	if errno == wasi.ESUCCESS {
+		s.dirCache.reset()
+	}
+	return errno
+}
+
+func (s *System) PathRename(ctx context.Context, fd wasi.FD, oldPath string, newFD wasi.FD, newPath string) wasi.Errno {
+	errno := s.FileTable.PathRename(ctx, fd, oldPath, newFD, newPath)
+	if errno == wasi.ESUCCESS {
+		s.dirCache.reset()
+	}
+	return errno
+}
+
+func (s *System) PathUnlinkFile(ctx context.Context, fd wasi.FD, path string) wasi.Errno {
+	errno := s.FileTable.PathUnlinkFile(ctx, fd, path)
+	if errno == wasi.ESUCCESS {
+		s.dirCache.reset()
+	}
+	return errno
+}
+
 func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscription, events []wasi.Event) (int, wasi.Errno) {
 	if len(subscriptions) == 0 || len(events) < len(subscriptions) {
 		return 0, wasi.EINVAL
 	}
-	r, _, err := s.init()
+	w, err := s.init()
 	if err != nil {
 		return 0, makeErrno(err)
 	}
-	s.pollfds = append(s.pollfds[:0], unix.PollFd{
-		Fd:     int32(r.Fd()),
+	buffer, _ := s.pollfds.Get().(*[]unix.PollFd)
+	if buffer == nil {
+		buffer = new([]unix.PollFd)
+	}
+	pollfds := append((*buffer)[:0], unix.PollFd{
+		Fd:     int32(w.pollfd()),
 		Events: unix.POLLIN | unix.POLLHUP,
 	})
+	defer func() {
+		*buffer = pollfds
+		s.pollfds.Put(buffer)
+	}()
 
 	realtimeEpoch := time.Duration(0)
 	monotonicEpoch := time.Duration(0)
+	processCPUTimeEpoch := time.Duration(0)
+	threadCPUTimeEpoch := time.Duration(0)
 
 	timeout := time.Duration(-1)
 	timeoutEventIndex := -1
@@ -155,7 +368,7 @@ func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscripti
 				numEvents++
 				continue
 			}
-			s.pollfds = append(s.pollfds, unix.PollFd{
+			pollfds = append(pollfds, unix.PollFd{
 				Fd:     int32(fd),
 				Events: pollEvent,
 			})
@@ -170,6 +383,13 @@ func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscripti
 				epoch, gettime = &realtimeEpoch, s.Realtime
 			case wasi.Monotonic:
 				epoch, gettime = &monotonicEpoch, s.Monotonic
+			// The CPU-time clocks do not advance while the guest waits, the
+			// timeouts are approximated with durations of the monotonic
+			// clock.
+			case wasi.ProcessCPUTimeID:
+				epoch, gettime = &processCPUTimeEpoch, s.ProcessCPUTime
+			case wasi.ThreadCPUTimeID:
+				epoch, gettime = &threadCPUTimeEpoch, s.ThreadCPUTime
 			}
 			if gettime == nil {
 				events[i] = errorEvent(sub, wasi.ENOTSUP)
@@ -226,15 +446,14 @@ func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscripti
 	// This loops until either the deadline is reached or at least one event is
 	// reported.
 	for {
-		timeoutMillis := 0
-		switch {
-		case timeout < 0:
-			timeoutMillis = -1
-		case !deadline.IsZero():
-			timeoutMillis = int(time.Until(deadline).Milliseconds())
+		remaining := timeout
+		if !deadline.IsZero() {
+			if remaining = time.Until(deadline); remaining < 0 {
+				remaining = 0
+			}
 		}
 
-		n, err := unix.Poll(s.pollfds, timeoutMillis)
+		n, err := s.poll(pollfds, remaining)
 		if err != nil && err != unix.EINTR {
 			return 0, makeErrno(err)
 		}
@@ -261,7 +480,7 @@ func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscripti
 			return len(subscriptions), wasi.ESUCCESS
 		}
 
-		if timeoutEventIndex >= 0 && deadline.Before(time.Now().Add(time.Millisecond)) {
+		if timeoutEventIndex >= 0 && !time.Now().Before(deadline) {
 			events[timeoutEventIndex] = wasi.Event{
 				UserData:  subscriptions[timeoutEventIndex].UserData,
 				EventType: subscriptions[timeoutEventIndex].EventType + 1,
@@ -275,7 +494,7 @@ func (s *System) PollOneOff(ctx context.Context, subscriptions []wasi.Subscripti
 			}
 			switch sub := &subscriptions[i]; sub.EventType {
 			case wasi.FDReadEvent, wasi.FDWriteEvent:
-				pf := &s.pollfds[j]
+				pf := &pollfds[j]
 				j++
 				if pf.Revents == 0 {
 					continue
@@ -351,6 +570,9 @@ func (s *System) SchedYield(ctx context.Context) wasi.Errno {
 }
 
 func (s *System) RandomGet(ctx context.Context, b []byte) wasi.Errno {
+	if s.Rand == nil {
+		return wasi.ENOSYS
+	}
 	if _, err := io.ReadFull(s.Rand, b); err != nil {
 		return wasi.EIO
 	}
@@ -365,7 +587,7 @@ func (s *System) SockAccept(ctx context.Context, fd wasi.FD, flags wasi.FDFlags)
 	if (flags & ^wasi.NonBlock) != 0 {
 		return -1, nil, nil, wasi.EINVAL
 	}
-	addr, errno := s.SockLocalAddress(ctx, fd)
+	listenAddr, errno := s.SockLocalAddress(ctx, fd)
 	if errno != wasi.ESUCCESS {
 		return -1, nil, nil, errno
 	}
@@ -373,15 +595,40 @@ func (s *System) SockAccept(ctx context.Context, fd wasi.FD, flags wasi.FDFlags)
 	if (flags & wasi.NonBlock) != 0 {
 		connflags |= unix.O_NONBLOCK
 	}
-	connfd, sa, err := accept(int(socket), connflags)
+	var connfd int
+	var sa unix.Sockaddr
+	var err error
+	if ring := s.uring(); ring != nil {
+		connfd, sa, err = ring.accept(int(socket), connflags)
+	} else {
+		connfd, sa, err = accept(int(socket), connflags)
+	}
 	if err != nil {
 		return -1, nil, nil, makeErrno(err)
 	}
-	peer := makeSocketAddress(sa)
+	peer := s.Network.guestAddress(makeSocketAddress(sa))
 	if peer == nil {
 		_ = closeTraceEBADF(connfd)
 		return -1, nil, nil, wasi.ENOTSUP
 	}
+	// When the listening socket is bound to a wildcard address, the local
+	// address of the connection is the address that the peer connected to.
+	// Connections accepted on unix sockets share the address of the listening
+	// socket, which not all platforms report.
+	addr := listenAddr
+	if _, isUnix := listenAddr.(*wasi.UnixAddress); !isUnix {
+		local, err := ignoreEINTR2(func() (unix.Sockaddr, error) {
+			return unix.Getsockname(connfd)
+		})
+		if err != nil {
+			_ = closeTraceEBADF(connfd)
+			return -1, nil, nil, makeErrno(err)
+		}
+		if addr = s.Network.guestAddress(makeSocketAddress(local)); addr == nil {
+			_ = closeTraceEBADF(connfd)
+			return -1, nil, nil, wasi.ENOTSUP
+		}
+	}
 	guestfd := s.Register(FD(connfd), wasi.FDStat{
 		FileType:         wasi.SocketStreamType,
 		Flags:            flags,
@@ -404,7 +651,7 @@ func (s *System) SockRecv(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec,
 		sysIFlags |= unix.MSG_WAITALL
 	}
 	for {
-		n, _, sysOFlags, _, err := unix.RecvmsgBuffers(int(socket), makeIOVecs(iovecs), nil, sysIFlags)
+		n, _, sysOFlags, _, err := recvmsg(int(socket), makeIOVecs(iovecs), nil, sysIFlags, nil)
 		if err == unix.EINTR {
 			continue
 		}
@@ -422,7 +669,7 @@ func (s *System) SockSend(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec,
 		return 0, errno
 	}
 	n, err := handleEINTR(func() (int, error) {
-		return unix.SendmsgBuffers(int(socket), makeIOVecs(iovecs), nil, nil, 0)
+		return sendmsg(int(socket), makeIOVecs(iovecs), nil, 0)
 	})
 	return wasi.Size(n), makeErrno(err)
 }
@@ -540,11 +787,29 @@ func (s *System) SockOpen(ctx context.Context, pf wasi.ProtocolFamily, socketTyp
 }
 
 func (s *System) SockBind(ctx context.Context, fd wasi.FD, addr wasi.SocketAddress) (wasi.SocketAddress, wasi.Errno) {
-	socket, _, errno := s.LookupSocketFD(fd, wasi.SockAcceptRight)
+	socket, stat, errno := s.LookupSocketFD(fd, 0)
 	if errno != wasi.ESUCCESS {
 		return nil, errno
 	}
-	sa, ok := s.toUnixSockAddress(addr)
+	// Datagram sockets are bound to receive messages rather than to accept
+	// connections, which only requires the right to read from the socket.
+	rights := wasi.SockAcceptRight
+	if stat.FileType == wasi.SocketDGramType {
+		rights = wasi.FDReadRight
+	}
+	if !stat.RightsBase.Has(rights) {
+		return nil, wasi.ENOTCAPABLE
+	}
+	if stat.FileType == wasi.SocketStreamType && s.Network.includes(addr, true) {
+		s.pollers.forget(int(socket))
+		if errno := s.Network.bind(int(socket), addr); errno != wasi.ESUCCESS {
+			return nil, errno
+		}
+		return s.SockLocalAddress(ctx, fd)
+	}
+	buffer := getSockaddr()
+	defer putSockaddr(buffer)
+	sa, ok := buffer.toUnixSockAddress(addr)
 	if !ok {
 		return nil, wasi.EINVAL
 	}
@@ -555,15 +820,33 @@ func (s *System) SockBind(ctx context.Context, fd wasi.FD, addr wasi.SocketAddre
 	return s.SockLocalAddress(ctx, fd)
 }
 
+// SockConnect connects the socket to the peer address.
+//
+// When a Proxy is configured, TCP connections are established through the
+// proxy server instead, transparently to the guest: the connection to the
+// proxy is made and the proxy handshake completed before the call returns,
+// then the file descriptor of the guest is replaced by the one of the
+// connection. The local address of the socket is then the one of the
+// connection to the proxy, and the options set on the socket before it was
+// connected are lost.
 func (s *System) SockConnect(ctx context.Context, fd wasi.FD, peer wasi.SocketAddress) (wasi.SocketAddress, wasi.Errno) {
-	socket, _, errno := s.LookupSocketFD(fd, 0)
+	socket, stat, errno := s.LookupSocketFD(fd, 0)
 	if errno != wasi.ESUCCESS {
 		return nil, errno
 	}
-	sa, ok := s.toUnixSockAddress(peer)
+	buffer := getSockaddr()
+	defer putSockaddr(buffer)
+	sa, ok := buffer.toUnixSockAddress(peer)
 	if !ok {
 		return nil, wasi.EINVAL
 	}
+	if stat.FileType == wasi.SocketStreamType && s.Network.includes(peer, false) {
+		s.pollers.forget(int(socket))
+		if errno := s.Network.connect(int(socket), peer); errno != wasi.ESUCCESS {
+			return nil, errno
+		}
+		return s.SockLocalAddress(ctx, fd)
+	}
 
 	// In some cases, Linux allows sockets to be connected to addresses of a
 	// different family (e.g. AF_INET datagram sockets connecting to AF_INET6
@@ -591,6 +874,14 @@ func (s *System) SockConnect(ctx context.Context, fd wasi.FD, peer wasi.SocketAd
 		}
 	}
 
+	if s.Proxy != nil && isProxied(int(socket)) {
+		s.pollers.forget(int(socket))
+		if errno := s.proxyConnect(ctx, int(socket), peer); errno != wasi.ESUCCESS {
+			return nil, errno
+		}
+		return s.SockLocalAddress(ctx, fd)
+	}
+
 	err := ignoreEINTR(func() error { return unix.Connect(int(socket), sa) })
 	if err != nil && err != unix.EINPROGRESS {
 		switch err {
@@ -629,6 +920,14 @@ func (s *System) SockSendTo(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec
 	if errno != wasi.ESUCCESS {
 		return 0, errno
 	}
+	// Without an address, messages are sent to the peer of a connected
+	// socket, as with sock_send.
+	if addr == nil {
+		n, err := handleEINTR(func() (int, error) {
+			return sendmsg(int(socket), makeIOVecs(iovecs), nil, 0)
+		})
+		return wasi.Size(n), makeErrno(err)
+	}
 	// Linux is more permissive than darwin and allows the use of sendto
 	// even when the socket is connected.
 	//
@@ -643,7 +942,9 @@ func (s *System) SockSendTo(ctx context.Context, fd wasi.FD, iovecs []wasi.IOVec
 			return 0, wasi.EISCONN
 		}
 	}
-	sa, ok := s.toUnixSockAddress(addr)
+	buffer := getSockaddr()
+	defer putSockaddr(buffer)
+	sa, ok := buffer.toUnixSockAddress(addr)
 	if !ok {
 		return 0, wasi.EINVAL
 	}
@@ -666,15 +967,18 @@ func (s *System) SockRecvFrom(ctx context.Context, fd wasi.FD, iovecs []wasi.IOV
 		sysIFlags |= unix.MSG_WAITALL
 	}
 	for {
-		n, _, sysOFlags, sa, err := unix.RecvmsgBuffers(int(socket), makeIOVecs(iovecs), nil, sysIFlags)
+		var rsa unix.RawSockaddrAny
+		n, _, sysOFlags, salen, err := recvmsg(int(socket), makeIOVecs(iovecs), nil, sysIFlags, &rsa)
 		if err == unix.EINTR {
 			continue
 		}
 		var addr wasi.SocketAddress
-		if sa != nil {
-			addr = makeSocketAddress(sa)
+		if err == nil && salen > 0 && rsa.Addr.Family != unix.AF_UNSPEC {
+			if sa, err := anyToSockaddr(&rsa, salen); err == nil {
+				addr = makeSocketAddress(sa)
+			}
 			if addr == nil {
-				errno = wasi.ENOTSUP
+				return wasi.Size(n), 0, nil, wasi.ENOTSUP
 			}
 		}
 		var roflags wasi.ROFlags
@@ -697,6 +1001,8 @@ func (s *System) SockGetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketO
 		sysLevel = unix.SOL_SOCKET
 	case wasi.TcpLevel:
 		sysLevel = unix.IPPROTO_TCP
+	case wasi.IPv6Level:
+		sysLevel = unix.IPPROTO_IPV6
 	default:
 		return nil, wasi.EINVAL
 	}
@@ -727,6 +1033,14 @@ func (s *System) SockGetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketO
 		sysOption = unix.SO_ACCEPTCONN
 	case wasi.TcpNoDelay:
 		sysOption = unix.TCP_NODELAY
+	case wasi.TcpKeepIdle:
+		sysOption = tcpKeepIdle
+	case wasi.TcpKeepInterval:
+		sysOption = unix.TCP_KEEPINTVL
+	case wasi.TcpKeepCount:
+		sysOption = unix.TCP_KEEPCNT
+	case wasi.IPv6Only:
+		sysOption = unix.IPV6_V6ONLY
 	case wasi.Linger:
 		// This returns a struct linger value.
 		return nil, wasi.ENOTSUP // TODO: implement SO_LINGER
@@ -774,6 +1088,13 @@ func (s *System) SockGetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketO
 		}
 	case wasi.QuerySocketError:
 		value = int(makeErrno(unix.Errno(value)))
+	case wasi.ReuseAddress, wasi.DontRoute, wasi.Broadcast, wasi.KeepAlive,
+		wasi.OOBInline, wasi.QueryAcceptConnections, wasi.TcpNoDelay, wasi.IPv6Only:
+		// Darwin returns the value of the flag instead of 1 for boolean
+		// options which are enabled.
+		if value != 0 {
+			value = 1
+		}
 	case wasi.RecvBufferSize, wasi.SendBufferSize:
 		// Linux doubles the socket buffer sizes, so we adjust the value here
 		// to ensure the behavior is portable across operating systems.
@@ -797,6 +1118,8 @@ func (s *System) SockSetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketO
 		sysLevel = unix.SOL_SOCKET
 	case wasi.TcpLevel:
 		sysLevel = unix.IPPROTO_TCP
+	case wasi.IPv6Level:
+		sysLevel = unix.IPPROTO_IPV6
 	default:
 		return wasi.EINVAL
 	}
@@ -827,6 +1150,14 @@ func (s *System) SockSetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketO
 		sysOption = unix.SO_ACCEPTCONN
 	case wasi.TcpNoDelay:
 		sysOption = unix.TCP_NODELAY
+	case wasi.TcpKeepIdle:
+		sysOption = tcpKeepIdle
+	case wasi.TcpKeepInterval:
+		sysOption = unix.TCP_KEEPINTVL
+	case wasi.TcpKeepCount:
+		sysOption = unix.TCP_KEEPCNT
+	case wasi.IPv6Only:
+		sysOption = unix.IPV6_V6ONLY
 	case wasi.Linger:
 		// This accepts a struct linger value.
 		return wasi.ENOTSUP // TODO: implement SO_LINGER
@@ -892,6 +1223,13 @@ func (s *System) SockSetOpt(ctx context.Context, fd wasi.FD, option wasi.SocketO
 			return unix.SetsockoptInt(int(socket), sysLevel, sysOption, int(intval))
 		})
 	}
+	// The sockets of the virtual network are unix sockets, which have no
+	// TCP options; setting them has no effect.
+	if err != nil && sysLevel == unix.IPPROTO_TCP && s.Network != nil {
+		if sa, _ := unix.Getsockname(int(socket)); s.Network.owns(sa) {
+			err = nil
+		}
+	}
 	return makeErrno(err)
 }
 
@@ -906,7 +1244,7 @@ func (s *System) SockLocalAddress(ctx context.Context, fd wasi.FD) (wasi.SocketA
 	if err != nil {
 		return nil, makeErrno(err)
 	}
-	addr := makeSocketAddress(sa)
+	addr := s.Network.guestAddress(makeSocketAddress(sa))
 	if addr == nil {
 		return nil, wasi.ENOTSUP
 	}
@@ -924,157 +1262,36 @@ func (s *System) SockRemoteAddress(ctx context.Context, fd wasi.FD) (wasi.Socket
 	if err != nil {
 		return nil, makeErrno(err)
 	}
-	addr := makeSocketAddress(sa)
+	addr := s.Network.guestAddress(makeSocketAddress(sa))
 	if addr == nil {
 		return nil, wasi.ENOTSUP
 	}
 	return addr, wasi.ESUCCESS
 }
 
-func (s *System) SockAddressInfo(ctx context.Context, name, service string, hints wasi.AddressInfo, results []wasi.AddressInfo) (int, wasi.Errno) {
-	if len(results) == 0 {
-		return 0, wasi.EINVAL
-	}
-	// TODO: support AI_ADDRCONFIG, AI_CANONNAME, AI_V4MAPPED, AI_V4MAPPED_CFG, AI_ALL
-
-	var network string
-	f, p, t := hints.Family, hints.Protocol, hints.SocketType
-	switch {
-	case t == wasi.StreamSocket && p != wasi.UDPProtocol:
-		switch f {
-		case wasi.UnspecifiedFamily:
-			network = "tcp"
-		case wasi.InetFamily:
-			network = "tcp4"
-		case wasi.Inet6Family:
-			network = "tcp6"
-		default:
-			return 0, wasi.ENOTSUP // EAI_FAMILY
-		}
-	case t == wasi.DatagramSocket && p != wasi.TCPProtocol:
-		switch f {
-		case wasi.UnspecifiedFamily:
-			network = "udp"
-		case wasi.InetFamily:
-			network = "udp4"
-		case wasi.Inet6Family:
-			network = "udp6"
-		default:
-			return 0, wasi.ENOTSUP // EAI_FAMILY
-		}
-	case t == wasi.AnySocket:
-		switch f {
-		case wasi.UnspecifiedFamily:
-			network = "ip"
-		case wasi.InetFamily:
-			network = "ip4"
-		case wasi.Inet6Family:
-			network = "ip6"
-		default:
-			return 0, wasi.ENOTSUP // EAI_FAMILY
-		}
-	default:
-		return 0, wasi.ENOTSUP // EAI_SOCKTYPE / EAI_PROTOCOL
-	}
-
-	var port int
-	var err error
-	if hints.Flags.Has(wasi.NumericService) {
-		port, err = strconv.Atoi(service)
-	} else {
-		port, err = net.DefaultResolver.LookupPort(ctx, network, service)
-	}
-	if err != nil || port < 0 || port > 65535 {
-		return 0, wasi.EINVAL // EAI_NONAME / EAI_SERVICE
-	}
-
-	var ip net.IP
-	if hints.Flags.Has(wasi.NumericHost) {
-		ip = net.ParseIP(name)
-		if ip == nil {
-			return 0, wasi.EINVAL
-		}
-	} else if name == "" {
-		if !hints.Flags.Has(wasi.Passive) {
-			return 0, wasi.EINVAL
-		}
-		if hints.Family == wasi.Inet6Family {
-			ip = net.IPv6zero
-		} else {
-			ip = net.IPv4zero
-		}
-	}
-
-	makeAddressInfo := func(ip net.IP, port int) wasi.AddressInfo {
-		addrInfo := wasi.AddressInfo{
-			Flags:      hints.Flags,
-			SocketType: hints.SocketType,
-			Protocol:   hints.Protocol,
-		}
-		if ipv4 := ip.To4(); ipv4 != nil {
-			inet4Addr := &wasi.Inet4Address{Port: port}
-			copy(inet4Addr.Addr[:], ipv4)
-			addrInfo.Family = wasi.InetFamily
-			addrInfo.Address = inet4Addr
-		} else {
-			inet6Addr := &wasi.Inet6Address{Port: port}
-			copy(inet6Addr.Addr[:], ip)
-			addrInfo.Family = wasi.Inet6Family
-			addrInfo.Address = inet6Addr
-		}
-		return addrInfo
-	}
-
-	if ip != nil {
-		results[0] = makeAddressInfo(ip, port)
-		return 1, wasi.ESUCCESS
-	}
-
-	// LookupIP requires the network to be one of "ip", "ip4", or "ip6".
-	switch network {
-	case "tcp", "udp":
-		network = "ip"
-	case "tcp4", "udp4":
-		network = "ip4"
-	case "tcp6", "udp6":
-		network = "ip6"
-	}
-
-	ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
-	if err != nil {
-		return 0, wasi.ECANCELED // TODO: better errors on name resolution failure
-	}
-
-	addrs4 := make([]wasi.AddressInfo, 0, 8)
-	addrs6 := make([]wasi.AddressInfo, 0, 8)
-
-	for _, ip := range ips {
-		if ip.To4() != nil {
-			addrs4 = append(addrs4, makeAddressInfo(ip, port))
-		} else {
-			addrs6 = append(addrs6, makeAddressInfo(ip, port))
-		}
-	}
-
-	n := copy(results[0:], addrs4)
-	n += copy(results[n:], addrs6)
-	return n, wasi.ESUCCESS
-}
-
 func (s *System) Close(ctx context.Context) error {
 	s.shut.Store(true)
 	s.mutex.Lock()
-	r := s.wake[0]
-	w := s.wake[1]
-	s.wake[0] = nil
-	s.wake[1] = nil
+	w := s.wake
+	s.wake = nil
+	s.closeCancelWriter()
+	s.stopWindowResize()
+	ring := s.ring
+	s.ring = nil
 	s.mutex.Unlock()
 
-	if r != nil {
-		r.Close()
+	if ring != nil {
+		ring.close()
 	}
+	s.pollers.close()
+	s.dirCache.reset()
+	s.mappings.close()
+	s.terminals.close()
+	s.events.close()
+	s.processes.close()
+
 	if w != nil {
-		w.Close()
+		w.close()
 	}
 	return s.FileTable.Close(ctx)
 }
@@ -1083,53 +1300,68 @@ func (s *System) Close(ctx context.Context) error {
 // the system, causing calls such as PollOneOff to unblock and return an
 // error indicating that the system is shutting down.
 func (s *System) Shutdown(ctx context.Context) error {
-	_, w, err := s.init()
-	if err != nil {
+	if _, err := s.init(); err != nil {
 		if err == context.Canceled {
 			err = nil // already shutdown
 		}
 		return err
 	}
 	s.shut.Store(true)
-	return w.Close()
+	s.Cancel()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.wake == nil {
+		return nil // closed concurrently
+	}
+	return s.wake.wake()
 }
 
-func (s *System) init() (*os.File, *os.File, error) {
+// uring returns the io_uring(7) instance of the system, or nil if it is not
+// enabled or not available.
+func (s *System) uring() *uring {
+	if !s.IOUring {
+		return nil
+	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.ring == nil && s.ringErr == nil && !s.shut.Load() {
+		s.ring, s.ringErr = newURing()
+	}
+	return s.ring
+}
 
-	if s.wake[0] == nil {
+// poll is like poll(2), but the timeout is expressed in nanoseconds, which the
+// pollers honor with timerfd(2) on Linux and kevent(2) on macOS.
+func (s *System) poll(fds []unix.PollFd, timeout time.Duration) (int, error) {
+	// Polling without blocking takes a single system call either way.
+	if ring := s.uring(); ring != nil && timeout != 0 {
+		return ring.poll(fds, timeout)
+	}
+	p, err := s.pollers.get()
+	if err != nil {
+		return unix.Poll(fds, pollTimeout(timeout))
+	}
+	defer s.pollers.put(p)
+	return p.poll(fds, timeout)
+}
+
+func (s *System) init() (*waker, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.wake == nil {
 		if s.shut.Load() {
-			return nil, nil, context.Canceled
+			return nil, context.Canceled
 		}
-		r, w, err := os.Pipe()
+		w, err := newWaker()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		s.wake[0] = r
-		s.wake[1] = w
+		s.wake = w
 	}
 
-	return s.wake[0], s.wake[1], nil
-}
-
-func (s *System) toUnixSockAddress(addr wasi.SocketAddress) (sa unix.Sockaddr, ok bool) {
-	switch t := addr.(type) {
-	case *wasi.Inet4Address:
-		s.inet4.Port = t.Port
-		s.inet4.Addr = t.Addr
-		sa = &s.inet4
-	case *wasi.Inet6Address:
-		s.inet6.Port = t.Port
-		s.inet6.Addr = t.Addr
-		sa = &s.inet6
-	case *wasi.UnixAddress:
-		s.unix.Name = t.Name
-		sa = &s.unix
-	default:
-		return nil, false
-	}
-	return sa, true
+	return s.wake, nil
 }
 
 func makeSocketAddress(sa unix.Sockaddr) wasi.SocketAddress {
@@ -0,0 +1,99 @@
+package unix_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/systems/unix"
+	sysunix "golang.org/x/sys/unix"
+)
+
+func TestSystemTerminal(t *testing.T) {
+	ctx := context.Background()
+	ptmx, err := sysunix.Open("/dev/ptmx", sysunix.O_RDWR|sysunix.O_NOCTTY|sysunix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skip("pseudo-terminals are not available:", err)
+	}
+	defer sysunix.Close(ptmx)
+	if err := sysunix.IoctlSetPointerInt(ptmx, sysunix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sysunix.IoctlGetInt(ptmx, sysunix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pts, err := sysunix.Open("/dev/pts/"+strconv.Itoa(n), sysunix.O_RDWR|sysunix.O_NOCTTY|sysunix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pseudo-terminal is kept open after the system closed its file
+	// descriptors to verify that its modes were restored.
+	host, err := sysunix.Dup(pts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysunix.Close(host)
+	sysunix.IoctlSetWinsize(ptmx, sysunix.TIOCSWINSZ, &sysunix.Winsize{Row: 24, Col: 80})
+
+	p := newSystem()
+	defer p.Close(ctx)
+	stat := wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.TTYRights}
+	tty := p.Preopen(unix.FD(pts), "/dev/tty", stat)
+
+	flags, errno := p.FDTermGet(ctx, tty)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if !flags.Has(wasi.TerminalEcho | wasi.TerminalCanonical) {
+		t.Fatalf("fd_tcgetattr: wrong default modes: %s", flags)
+	}
+	if errno := p.FDTermSet(ctx, tty, wasi.TerminalRaw); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if flags, _ := p.FDTermGet(ctx, tty); flags != wasi.TerminalRaw {
+		t.Fatalf("fd_tcsetattr: the terminal is not in raw mode: %s", flags)
+	}
+	size, errno := p.FDTermSize(ctx, tty)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if size != (wasi.TerminalSize{Rows: 24, Columns: 80}) {
+		t.Fatalf("fd_tcgetwinsize: wrong size: %s", size)
+	}
+
+	// In raw mode, keystrokes can be read one at a time.
+	if _, err := sysunix.Write(ptmx, []byte("q")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 10)
+	r, errno := p.FDRead(ctx, tty, []wasi.IOVec{buffer})
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if string(buffer[:r]) != "q" {
+		t.Fatalf("fd_read: wrong data: %q", buffer[:r])
+	}
+
+	if errno := p.FDClose(ctx, tty); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	termios, err := sysunix.IoctlGetTermios(host, sysunix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (termios.Lflag & sysunix.ICANON) == 0 {
+		t.Fatal("fd_close: the modes of the terminal were not restored")
+	}
+
+	fds, err := pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r0 := p.Preopen(unix.FD(fds[0]), "r", wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.FileRights})
+	p.Preopen(unix.FD(fds[1]), "w", wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.FileRights})
+	if _, errno := p.FDTermGet(ctx, r0); errno != wasi.ENOTTY {
+		t.Fatalf("fd_tcgetattr: expected ENOTTY for a pipe, got %s", errno)
+	}
+}
@@ -1,19 +1,35 @@
 package unix_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"testing/fstest"
 	"time"
 
 	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/systems/iofs"
 	"github.com/stealthrocket/wasi-go/systems/unix"
+	"github.com/stealthrocket/wasi-go/wasibench"
 	"github.com/stealthrocket/wasi-go/wasitest"
 	"github.com/tetratelabs/wazero/sys"
 	sysunix "golang.org/x/sys/unix"
@@ -46,7 +62,43 @@ func TestFS(t *testing.T) {
 }
 
 func TestSystem(t *testing.T) {
-	wasitest.TestSystem(t, makeSystem)
+	wasitest.TestProviders(t,
+		wasitest.Provider{Name: "unix", MakeSystem: makeSystem},
+		wasitest.Provider{Name: "mux", MakeSystem: makeMuxSystem},
+		wasitest.Provider{Name: "synchronized", MakeSystem: makeSynchronizedSystem},
+		wasitest.Provider{Name: "io_uring", MakeSystem: makeIOURingSystem},
+		wasitest.Provider{Name: "dircache", MakeSystem: makeDirCacheSystem},
+	)
+}
+
+// makeDirCacheSystem creates a system which opens files from cached handles
+// of their directories.
+func makeDirCacheSystem(config wasitest.TestConfig) (wasi.System, error) {
+	system, err := makeSystem(config)
+	if err != nil {
+		return nil, err
+	}
+	system.(*unix.System).DirCacheSize = 4
+	return system, nil
+}
+
+// makeIOURingSystem creates a system which performs I/O with io_uring on
+// Linux, and falls back to the classic system calls elsewhere.
+func makeIOURingSystem(config wasitest.TestConfig) (wasi.System, error) {
+	system, err := makeSystem(config)
+	if err != nil {
+		return nil, err
+	}
+	system.(*unix.System).IOUring = true
+	return system, nil
+}
+
+func makeSynchronizedSystem(config wasitest.TestConfig) (wasi.System, error) {
+	system, err := makeSystem(config)
+	if err != nil {
+		return nil, err
+	}
+	return wasi.Synchronize(system), nil
 }
 
 func TestWASIP1(t *testing.T) {
@@ -54,6 +106,46 @@ func TestWASIP1(t *testing.T) {
 	wasitest.TestWASIP1(t, files, makeSystem)
 }
 
+func TestGoldenTraces(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/c/*.wasm")
+	wasitest.TestGoldenTraces(t, files, makeSystem)
+}
+
+func TestWASITestSuite(t *testing.T) {
+	suites, _ := filepath.Glob("../../testdata/.wasi-testsuite/tests/*/testsuite")
+	if len(suites) == 0 {
+		t.Skip("wasi-testsuite not found, run: make testdata/.wasi-testsuite")
+	}
+	wasitest.TestWASITestSuite(t, suites, makeSystem)
+}
+
+func BenchmarkSystem(b *testing.B) {
+	wasibench.BenchmarkProviders(b,
+		wasitest.Provider{Name: "unix", MakeSystem: makeSystem},
+		wasitest.Provider{Name: "synchronized", MakeSystem: makeSynchronizedSystem},
+		wasitest.Provider{Name: "io_uring", MakeSystem: makeIOURingSystem},
+		wasitest.Provider{Name: "dircache", MakeSystem: makeDirCacheSystem},
+	)
+}
+
+func BenchmarkWASIP1(b *testing.B) {
+	files, _ := filepath.Glob("../../wasibench/testdata/*.wasm")
+	wasibench.BenchmarkWASIP1(b, files, makeSystem)
+}
+
+// makeMuxSystem creates a system serving files from an in-memory file system,
+// which validates that wasi.Mux preserves the behavior of the system that it
+// routes the other functions to.
+func makeMuxSystem(config wasitest.TestConfig) (wasi.System, error) {
+	system, err := makeSystem(config)
+	if err != nil {
+		return nil, err
+	}
+	files := new(iofs.System)
+	files.Mount(fstest.MapFS{}, "/")
+	return wasi.Mux(wasi.Routes{Default: system, Files: files}), nil
+}
+
 func makeSystem(config wasitest.TestConfig) (wasi.System, error) {
 	s := &unix.System{
 		Args:    config.Args,
@@ -85,6 +177,10 @@ func makeSystem(config wasitest.TestConfig) (wasi.System, error) {
 			return uint64(now().UnixNano()), nil
 		}
 		s.RealtimePrecision = time.Microsecond
+		s.ProcessCPUTime = unix.ProcessCPUTime
+		s.ProcessCPUTimePrecision = time.Nanosecond
+		s.ThreadCPUTime = unix.NewThreadCPUTime()
+		s.ThreadCPUTimePrecision = time.Nanosecond
 	}
 
 	stdin, err := pipe()
@@ -132,6 +228,18 @@ func makeSystem(config wasitest.TestConfig) (wasi.System, error) {
 		RightsBase: wasi.AllRights,
 	})
 
+	for _, dir := range config.Dirs {
+		fd, err := sysunix.Open(dir.Path, sysunix.O_DIRECTORY|sysunix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		s.Preopen(unix.FD(fd), dir.Name, wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.AllRights,
+			RightsInheriting: wasi.AllRights,
+		})
+	}
+
 	if config.RootFS != "" {
 		rootFS, err := sysunix.Open(config.RootFS, sysunix.O_DIRECTORY, 0)
 		if err != nil {
@@ -201,6 +309,40 @@ func TestSystemPollAndShutdown(t *testing.T) {
 	})
 }
 
+func TestSystemShutdownWhilePolling(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		fds, err := pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.AllRights}
+		r := p.Preopen(unix.FD(fds[0]), "r", stat)
+		p.Preopen(unix.FD(fds[1]), "w", stat)
+
+		subscriptions := []wasi.Subscription{subscribeFDRead(r)}
+		events := make([]wasi.Event, len(subscriptions))
+		done := make(chan wasi.Errno)
+		go func() {
+			_, errno := p.PollOneOff(ctx, subscriptions, events)
+			done <- errno
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		// Shutting down the system multiple times has no effect.
+		for i := 0; i < 2; i++ {
+			if err := p.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if errno := <-done; errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if events[0].Errno != wasi.ECANCELED {
+			t.Errorf("poll_oneoff: wrong event: %+v", events[0])
+		}
+	})
+}
+
 func TestSystemPollBadFileDescriptor(t *testing.T) {
 	testSystem(func(ctx context.Context, p *unix.System) {
 		subscriptions := []wasi.Subscription{
@@ -270,6 +412,45 @@ func TestSystemPollMissingMonotonicClock(t *testing.T) {
 	})
 }
 
+func TestSystemPollClockPrecision(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		fds, err := pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.AllRights}
+		r := p.Preopen(unix.FD(fds[0]), "r", stat)
+		p.Preopen(unix.FD(fds[1]), "w", stat)
+
+		// Timeouts shorter than a millisecond must neither expire early nor
+		// be rounded down to zero.
+		for _, timeout := range []time.Duration{
+			100 * time.Microsecond,
+			500 * time.Microsecond,
+			1500 * time.Microsecond,
+		} {
+			subscriptions := []wasi.Subscription{
+				subscribeFDRead(r),
+				subscribeTimeout(timeout),
+			}
+			events := make([]wasi.Event, len(subscriptions))
+
+			start := time.Now()
+			n, errno := p.PollOneOff(ctx, subscriptions, events)
+			elapsed := time.Since(start)
+			if errno != wasi.ESUCCESS {
+				t.Fatal(errno)
+			}
+			if n != 1 || events[0].EventType != wasi.ClockEvent {
+				t.Fatalf("poll_oneoff: wrong events: %+v", events[:n])
+			}
+			if elapsed < timeout {
+				t.Errorf("poll_oneoff: timeout of %s expired after %s", timeout, elapsed)
+			}
+		}
+	})
+}
+
 func TestSockAddressInfo(t *testing.T) {
 	testSystem(func(ctx context.Context, s *unix.System) {
 		results := make([]wasi.AddressInfo, 64)
@@ -327,6 +508,2752 @@ func TestSockAddressInfo(t *testing.T) {
 	})
 }
 
+func TestSystemResolver(t *testing.T) {
+	testSystem(func(ctx context.Context, s *unix.System) {
+		var names []string
+		s.Resolver = func(ctx context.Context, name string) ([]net.IP, error) {
+			names = append(names, name)
+			if name != "service.internal" {
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil
+		}
+
+		results := make([]wasi.AddressInfo, 4)
+		tcp4Hint := wasi.AddressInfo{Family: wasi.InetFamily, SocketType: wasi.StreamSocket, Protocol: wasi.TCPProtocol}
+		n, errno := s.SockAddressInfo(ctx, "service.internal", "80", tcp4Hint, results)
+		if n != 1 || errno != wasi.ESUCCESS {
+			t.Fatalf("SockAddressInfo => %d, %s", n, errno)
+		}
+		if addr := results[0].Address.String(); addr != "127.0.0.1:80" {
+			t.Fatalf("unexpected result: %s", addr)
+		}
+
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+
+		sockets := &unix.PathOpenSockets{System: s}
+		fd, errno := sockets.PathOpen(ctx, -1, 0, "tcp4+dial://service.internal:"+port, 0, wasi.AllRights, wasi.AllRights, 0)
+		if errno != wasi.ESUCCESS && errno != wasi.EINPROGRESS {
+			t.Fatalf("path_open => %s", errno)
+		}
+		s.FDClose(ctx, fd)
+
+		if _, errno := sockets.PathOpen(ctx, -1, 0, "tcp4+dial://unknown.internal:"+port, 0, wasi.AllRights, wasi.AllRights, 0); errno == wasi.ESUCCESS {
+			t.Fatal("path_open resolved an unknown name")
+		}
+
+		want := []string{"service.internal", "service.internal", "unknown.internal"}
+		if !reflect.DeepEqual(names, want) {
+			t.Fatalf("names resolved: got %q, want %q", names, want)
+		}
+	})
+}
+
+func TestSockAddressInfoHints(t *testing.T) {
+	testSystem(func(ctx context.Context, s *unix.System) {
+		lookups := 0
+		s.ResolverCacheTTL = time.Minute
+		s.Resolver = func(ctx context.Context, name string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+		}
+
+		lookup := func(name, service string, hints wasi.AddressInfo) []string {
+			t.Helper()
+			results := make([]wasi.AddressInfo, 8)
+			n, errno := s.SockAddressInfo(ctx, name, service, hints, results)
+			if errno != wasi.ESUCCESS {
+				t.Fatalf("SockAddressInfo(%q, %q) => %s", name, service, errno)
+			}
+			addrs := make([]string, n)
+			for i, r := range results[:n] {
+				addrs[i] = fmt.Sprintf("%s %s %s %s", r.Family, r.SocketType, r.Protocol, r.Address)
+			}
+			return addrs
+		}
+		expect := func(got []string, want ...string) {
+			t.Helper()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("wrong results:\ngot  %q\nwant %q", got, want)
+			}
+		}
+
+		// Without a socket type, the addresses are returned for each type
+		// that the service exists for.
+		expect(lookup("example.test", "53", wasi.AddressInfo{}),
+			"InetFamily StreamSocket TCPProtocol 192.0.2.1:53",
+			"InetFamily DatagramSocket UDPProtocol 192.0.2.1:53",
+			"Inet6Family StreamSocket TCPProtocol [2001:db8::1]:53",
+			"Inet6Family DatagramSocket UDPProtocol [2001:db8::1]:53",
+		)
+		expect(lookup("example.test", "http", wasi.AddressInfo{Family: wasi.InetFamily}),
+			"InetFamily StreamSocket TCPProtocol 192.0.2.1:80",
+		)
+		expect(lookup("example.test", "ntp", wasi.AddressInfo{Family: wasi.InetFamily}),
+			"InetFamily DatagramSocket UDPProtocol 192.0.2.1:123",
+		)
+
+		// IPv4 addresses are mapped to IPv6 addresses, which are formatted
+		// without the ::ffff: prefix.
+		inet6Hints := wasi.AddressInfo{
+			Family:     wasi.Inet6Family,
+			SocketType: wasi.StreamSocket,
+			Flags:      wasi.V4Mapped | wasi.QueryAll,
+		}
+		expect(lookup("example.test", "80", inet6Hints),
+			"Inet6Family StreamSocket TCPProtocol [2001:db8::1]:80",
+			"Inet6Family StreamSocket TCPProtocol 192.0.2.1:80",
+		)
+
+		// Without a name, the wildcard or loopback addresses are returned.
+		passiveHints := wasi.AddressInfo{SocketType: wasi.StreamSocket, Flags: wasi.Passive}
+		expect(lookup("", "80", passiveHints),
+			"InetFamily StreamSocket TCPProtocol 0.0.0.0:80",
+			"Inet6Family StreamSocket TCPProtocol [::]:80",
+		)
+		expect(lookup("", "80", wasi.AddressInfo{SocketType: wasi.StreamSocket}),
+			"InetFamily StreamSocket TCPProtocol 127.0.0.1:80",
+			"Inet6Family StreamSocket TCPProtocol [::1]:80",
+		)
+
+		// Addresses are not resolved.
+		expect(lookup("192.0.2.2", "80", wasi.AddressInfo{SocketType: wasi.StreamSocket}),
+			"InetFamily StreamSocket TCPProtocol 192.0.2.2:80",
+		)
+
+		if lookups != 1 {
+			t.Errorf("wrong number of lookups: %d", lookups)
+		}
+	})
+}
+
+func TestUnixSockets(t *testing.T) {
+	testSystem(func(ctx context.Context, s *unix.System) {
+		path := filepath.Join(t.TempDir(), "test.sock")
+		sockets := &unix.PathOpenSockets{System: s}
+
+		l, errno := sockets.PathOpen(ctx, -1, 0, "unix+listen://"+path, 0, wasi.AllRights, wasi.AllRights, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("path_open(listen) => %s", errno)
+		}
+		defer s.FDClose(ctx, l)
+
+		c, errno := s.SockOpen(ctx, wasi.UnixFamily, wasi.StreamSocket, wasi.IPProtocol, wasi.AllRights, wasi.AllRights)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_open => %s", errno)
+		}
+		defer s.FDClose(ctx, c)
+		if _, errno := s.SockConnect(ctx, c, &wasi.UnixAddress{Name: path}); errno != wasi.ESUCCESS {
+			t.Fatalf("sock_connect => %s", errno)
+		}
+
+		a, _, _, errno := s.SockAccept(ctx, l, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_accept => %s", errno)
+		}
+		defer s.FDClose(ctx, a)
+
+		if _, errno := s.SockSend(ctx, c, []wasi.IOVec{[]byte("hello")}, 0); errno != wasi.ESUCCESS {
+			t.Fatalf("sock_send => %s", errno)
+		}
+		buf := make([]byte, 16)
+		n, _, errno := s.SockRecv(ctx, a, []wasi.IOVec{buf}, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_recv => %s", errno)
+		}
+		if string(buf[:n]) != "hello" {
+			t.Fatalf("wrong data received: %q", buf[:n])
+		}
+
+		d, errno := sockets.PathOpen(ctx, -1, 0, "unix+dial://"+path, 0, wasi.AllRights, wasi.AllRights, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("path_open(dial) => %s", errno)
+		}
+		s.FDClose(ctx, d)
+	})
+}
+
+func TestDatagramSockets(t *testing.T) {
+	testSystem(func(ctx context.Context, s *unix.System) {
+		sockets := &unix.PathOpenSockets{System: s}
+
+		// Datagram sockets opened to listen are only bound.
+		l, errno := sockets.PathOpen(ctx, -1, 0, "udp4+listen://127.0.0.1:0", 0, wasi.SockConnectionRights, 0, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("path_open(listen) => %s", errno)
+		}
+		defer s.FDClose(ctx, l)
+		if stat, _ := s.FDStatGet(ctx, l); stat.FileType != wasi.SocketDGramType {
+			t.Fatalf("wrong file type: %s", stat.FileType)
+		}
+		addr, errno := s.SockLocalAddress(ctx, l)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_getlocaladdr => %s", errno)
+		}
+
+		// Binding datagram sockets does not require the right to accept
+		// connections.
+		c, errno := s.SockOpen(ctx, wasi.InetFamily, wasi.DatagramSocket, wasi.UDPProtocol, wasi.SockConnectionRights, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_open => %s", errno)
+		}
+		defer s.FDClose(ctx, c)
+		local, errno := s.SockBind(ctx, c, &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}})
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_bind => %s", errno)
+		}
+		if _, errno := s.SockConnect(ctx, c, addr); errno != wasi.ESUCCESS {
+			t.Fatalf("sock_connect => %s", errno)
+		}
+
+		// Connected sockets send to their peer when no address is given.
+		if _, errno := s.SockSendTo(ctx, c, []wasi.IOVec{[]byte("hello")}, 0, nil); errno != wasi.ESUCCESS {
+			t.Fatalf("sock_send_to => %s", errno)
+		}
+		if _, errno := s.SockSendTo(ctx, c, []wasi.IOVec{[]byte("hello")}, 0, addr); errno != wasi.EISCONN {
+			t.Fatalf("sock_send_to with an address on a connected socket => %s", errno)
+		}
+
+		buf := make([]byte, 16)
+		var n wasi.Size
+		var from wasi.SocketAddress
+		for {
+			n, _, from, errno = s.SockRecvFrom(ctx, l, []wasi.IOVec{buf}, 0)
+			if errno != wasi.EAGAIN {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_recv_from => %s", errno)
+		}
+		if string(buf[:n]) != "hello" {
+			t.Fatalf("wrong data received: %q", buf[:n])
+		}
+		if from.String() != local.String() {
+			t.Fatalf("wrong sender address: got %s, want %s", from, local)
+		}
+	})
+}
+
+func TestSystemProxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			proxy, destinations := startProxy(t, scheme)
+
+			testSystem(func(ctx context.Context, s *unix.System) {
+				s.Proxy = &url.URL{Scheme: scheme, Host: proxy}
+
+				fd, errno := s.SockOpen(ctx, wasi.InetFamily, wasi.StreamSocket, wasi.TCPProtocol, wasi.SockConnectionRights, 0)
+				if errno != wasi.ESUCCESS {
+					t.Fatalf("sock_open => %s", errno)
+				}
+				defer s.FDClose(ctx, fd)
+
+				addr := &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: echo.Addr().(*net.TCPAddr).Port}
+				if _, errno := s.SockConnect(ctx, fd, addr); errno != wasi.ESUCCESS {
+					t.Fatalf("sock_connect => %s", errno)
+				}
+				if dst := <-destinations; dst != addr.String() {
+					t.Fatalf("wrong destination: got %s, want %s", dst, addr)
+				}
+				if _, errno := s.SockConnect(ctx, fd, addr); errno != wasi.EISCONN {
+					t.Fatalf("sock_connect on a connected socket => %s", errno)
+				}
+
+				if _, errno := s.SockSend(ctx, fd, []wasi.IOVec{[]byte("hello")}, 0); errno != wasi.ESUCCESS {
+					t.Fatalf("sock_send => %s", errno)
+				}
+				buf := make([]byte, 16)
+				var n wasi.Size
+				for {
+					n, _, errno = s.SockRecv(ctx, fd, []wasi.IOVec{buf}, 0)
+					if errno != wasi.EAGAIN {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				if errno != wasi.ESUCCESS {
+					t.Fatalf("sock_recv => %s", errno)
+				}
+				if string(buf[:n]) != "hello" {
+					t.Fatalf("wrong data received: %q", buf[:n])
+				}
+			})
+		})
+	}
+}
+
+// startProxy starts a minimal SOCKS5 or HTTP CONNECT proxy server, returning
+// its address and a channel receiving the destinations of the connections.
+func startProxy(t *testing.T, scheme string) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	destinations := make(chan string, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				var dst string
+				switch scheme {
+				case "socks5":
+					greeting := make([]byte, 2)
+					io.ReadFull(r, greeting)
+					io.ReadFull(r, make([]byte, greeting[1]))
+					conn.Write([]byte{5, 0})
+					req := make([]byte, 4+4+2) // IPv4 destination
+					if _, err := io.ReadFull(r, req); err != nil {
+						return
+					}
+					port := int(req[8])<<8 | int(req[9])
+					dst = net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(port))
+					conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				case "http":
+					req, err := http.ReadRequest(r)
+					if err != nil || req.Method != "CONNECT" {
+						return
+					}
+					dst = req.Host
+					io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				}
+				destinations <- dst
+				upstream, err := net.Dial("tcp", dst)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, r)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String(), destinations
+}
+
+func TestPublishPorts(t *testing.T) {
+	// Find a free port for the host to listen on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	testSystem(func(ctx context.Context, s *unix.System) {
+		system := wasi.PublishPorts(s, wasi.PortMapping{
+			GuestPort: 8080,
+			HostIP:    netip.MustParseAddr("127.0.0.1"),
+			HostPort:  hostPort,
+		})
+
+		fd, errno := system.SockOpen(ctx, wasi.InetFamily, wasi.StreamSocket, wasi.TCPProtocol, wasi.SockListenRights, wasi.SockConnectionRights)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_open => %s", errno)
+		}
+		defer system.FDClose(ctx, fd)
+
+		// The guest binds to the wildcard address on port 8080, the host
+		// listens on the loopback interface on the host port.
+		local, errno := system.SockBind(ctx, fd, &wasi.Inet4Address{Port: 8080})
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_bind => %s", errno)
+		}
+		if want := "127.0.0.1:8080"; local.String() != want {
+			t.Fatalf("wrong local address: got %s, want %s", local, want)
+		}
+		if errno := system.SockListen(ctx, fd, 1); errno != wasi.ESUCCESS {
+			t.Fatalf("sock_listen => %s", errno)
+		}
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", hostPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var connfd wasi.FD
+		for {
+			connfd, _, local, errno = system.SockAccept(ctx, fd, 0)
+			if errno != wasi.EAGAIN {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_accept => %s", errno)
+		}
+		defer system.FDClose(ctx, connfd)
+		if want := "127.0.0.1:8080"; local.String() != want {
+			t.Fatalf("wrong local address of accepted socket: got %s, want %s", local, want)
+		}
+		local, errno = system.SockLocalAddress(ctx, connfd)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("sock_getlocaladdr => %s", errno)
+		}
+		if want := "127.0.0.1:8080"; local.String() != want {
+			t.Fatalf("wrong local address: got %s, want %s", local, want)
+		}
+	})
+}
+
+func TestVirtualNetwork(t *testing.T) {
+	network, err := unix.NewVirtualNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.Close()
+
+	ctx := context.Background()
+	server, client := newSystem(), newSystem()
+	server.Network, client.Network = network, network
+	defer server.Close(ctx)
+	defer client.Close(ctx)
+
+	lfd, errno := server.SockOpen(ctx, wasi.InetFamily, wasi.StreamSocket, wasi.TCPProtocol, wasi.SockListenRights, wasi.SockConnectionRights)
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("sock_open => %s", errno)
+	}
+	defer server.FDClose(ctx, lfd)
+	local, errno := server.SockBind(ctx, lfd, &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: 8080})
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("sock_bind => %s", errno)
+	}
+	if want := "127.0.0.1:8080"; local.String() != want {
+		t.Fatalf("wrong local address: got %s, want %s", local, want)
+	}
+	if errno := server.SockListen(ctx, lfd, 1); errno != wasi.ESUCCESS {
+		t.Fatalf("sock_listen => %s", errno)
+	}
+
+	cfd, errno := client.SockOpen(ctx, wasi.InetFamily, wasi.StreamSocket, wasi.TCPProtocol, wasi.SockConnectionRights, wasi.SockConnectionRights)
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("sock_open => %s", errno)
+	}
+	defer client.FDClose(ctx, cfd)
+
+	// Ports that nothing listens on in the network refuse connections.
+	if _, errno := client.SockConnect(ctx, cfd, &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: 8081}); errno != wasi.ECONNREFUSED {
+		t.Fatalf("sock_connect to unbound port => %s", errno)
+	}
+	if _, errno := client.SockConnect(ctx, cfd, &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: 8080}); errno != wasi.ESUCCESS && errno != wasi.EINPROGRESS {
+		t.Fatalf("sock_connect => %s", errno)
+	}
+	if errno := client.SockSetOpt(ctx, cfd, wasi.TcpNoDelay, wasi.IntValue(1)); errno != wasi.ESUCCESS {
+		t.Fatalf("sock_setsockopt(TCP_NODELAY) => %s", errno)
+	}
+	clientAddr, errno := client.SockLocalAddress(ctx, cfd)
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("sock_getlocaladdr => %s", errno)
+	}
+	peer, errno := client.SockRemoteAddress(ctx, cfd)
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("sock_getpeeraddr => %s", errno)
+	}
+	if want := "127.0.0.1:8080"; peer.String() != want {
+		t.Fatalf("wrong peer address: got %s, want %s", peer, want)
+	}
+
+	var afd wasi.FD
+	for {
+		afd, peer, local, errno = server.SockAccept(ctx, lfd, 0)
+		if errno != wasi.EAGAIN {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("sock_accept => %s", errno)
+	}
+	defer server.FDClose(ctx, afd)
+	if peer.String() != clientAddr.String() {
+		t.Fatalf("wrong peer address of accepted socket: got %s, want %s", peer, clientAddr)
+	}
+	if want := "127.0.0.1:8080"; local.String() != want {
+		t.Fatalf("wrong local address of accepted socket: got %s, want %s", local, want)
+	}
+
+	if _, errno := client.FDWrite(ctx, cfd, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS {
+		t.Fatalf("fd_write => %s", errno)
+	}
+	buf := make([]byte, 16)
+	var n wasi.Size
+	for {
+		n, errno = server.FDRead(ctx, afd, []wasi.IOVec{buf})
+		if errno != wasi.EAGAIN {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if errno != wasi.ESUCCESS {
+		t.Fatalf("fd_read => %s", errno)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("wrong data received: %q", buf[:n])
+	}
+}
+
+func TestSystemPollReusedFD(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		subscriptions := []wasi.Subscription{
+			subscribeFDRead(0),
+			subscribeTimeout(time.Millisecond),
+		}
+		events := make([]wasi.Event, len(subscriptions))
+
+		n, errno := p.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.ClockEvent {
+			t.Fatalf("poll_oneoff: pipe ready before write: %+v", events[:n])
+		}
+
+		// The file descriptors remain registered with the poller of the
+		// system after the call; closing them must unregister them so the
+		// new pipe, which likely reuses the same numbers, is polled.
+		if errno := p.FDClose(ctx, 0); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if errno := p.FDClose(ctx, 1); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		fds, err := pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := p.Preopen(unix.FD(fds[0]), "fd0", wasi.FDStat{RightsBase: wasi.AllRights})
+		w := p.Preopen(unix.FD(fds[1]), "fd1", wasi.FDStat{RightsBase: wasi.AllRights})
+
+		if _, errno := p.FDWrite(ctx, w, []wasi.IOVec{[]byte("Hello, World!")}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		subscriptions = []wasi.Subscription{
+			subscribeFDRead(r),
+			subscribeTimeout(time.Second),
+		}
+		n, errno = p.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.FDReadEvent {
+			t.Fatalf("poll_oneoff: pipe not ready after write: %+v", events[:n])
+		}
+	})
+}
+
+func TestSystemIOURingBlockingRead(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		p.IOUring = true
+
+		// The read blocks until the write submitted after it completes, which
+		// verifies that operations in flight do not prevent other operations
+		// from being submitted to the ring.
+		type result struct {
+			n     wasi.Size
+			errno wasi.Errno
+		}
+		buffer := make([]byte, 32)
+		done := make(chan result)
+		go func() {
+			n, errno := p.FDRead(ctx, 0, []wasi.IOVec{buffer})
+			done <- result{n, errno}
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		n, errno := p.FDWrite(ctx, 1, []wasi.IOVec{[]byte("Hello, World!")})
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 13 {
+			t.Fatalf("fd_write: wrong size: %d", n)
+		}
+
+		select {
+		case r := <-done:
+			if r.errno != wasi.ESUCCESS {
+				t.Fatal(r.errno)
+			}
+			if string(buffer[:r.n]) != "Hello, World!" {
+				t.Fatalf("fd_read: wrong data: %q", buffer[:r.n])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("fd_read: timeout")
+		}
+	})
+}
+
+func TestSystemCancellationFD(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		fd, errno := p.CancellationFD(ctx)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if fd2, _ := p.CancellationFD(ctx); fd2 != fd {
+			t.Fatalf("cancellation fd changed: %d != %d", fd2, fd)
+		}
+
+		subscriptions := []wasi.Subscription{
+			subscribeFDRead(fd),
+			subscribeTimeout(10 * time.Millisecond),
+		}
+		events := make([]wasi.Event, len(subscriptions))
+
+		n, errno := p.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.ClockEvent {
+			t.Fatalf("poll_oneoff: cancellation fd ready before cancel: %+v", events[:n])
+		}
+
+		p.Cancel()
+
+		n, errno = p.PollOneOff(ctx, subscriptions[:1], events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.FDReadEvent || events[0].Errno != wasi.ESUCCESS {
+			t.Fatalf("poll_oneoff: cancellation fd not ready after cancel: %+v", events[:n])
+		}
+	})
+}
+
+func TestSystemWindowResizeFD(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		fd, errno := p.WindowResizeFD(ctx)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if fd2, _ := p.WindowResizeFD(ctx); fd2 != fd {
+			t.Fatalf("window resize fd changed: %d != %d", fd2, fd)
+		}
+
+		subscriptions := []wasi.Subscription{
+			subscribeFDRead(fd),
+			subscribeTimeout(10 * time.Millisecond),
+		}
+		events := make([]wasi.Event, len(subscriptions))
+
+		n, errno := p.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.ClockEvent {
+			t.Fatalf("poll_oneoff: window resize fd ready before resize: %+v", events[:n])
+		}
+
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGWINCH); err != nil {
+			t.Fatal(err)
+		}
+
+		n, errno = p.PollOneOff(ctx, subscriptions[:1], events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.FDReadEvent || events[0].Errno != wasi.ESUCCESS {
+			t.Fatalf("poll_oneoff: window resize fd not ready after SIGWINCH: %+v", events[:n])
+		}
+		buffer := make([]byte, 16)
+		if n, errno := p.FDRead(ctx, fd, []wasi.IOVec{buffer}); errno != wasi.ESUCCESS || n == 0 {
+			t.Fatalf("fd_read: %d, %s", n, errno)
+		}
+		if _, errno := p.FDRead(ctx, fd, []wasi.IOVec{buffer}); errno != wasi.EAGAIN {
+			t.Fatalf("fd_read: expected EAGAIN after reading the notifications, got %s", errno)
+		}
+	})
+}
+
+func TestSystemEventHandle(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		fd, h, errno := p.EventHandleOpen(ctx)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		subscriptions := []wasi.Subscription{
+			subscribeFDRead(fd),
+			subscribeTimeout(10 * time.Millisecond),
+		}
+		events := make([]wasi.Event, len(subscriptions))
+
+		n, errno := p.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.ClockEvent {
+			t.Fatalf("poll_oneoff: event handle ready before sending: %+v", events[:n])
+		}
+
+		if errno := h.Send([]byte("hello")); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		h.Notify()
+
+		n, errno = p.PollOneOff(ctx, subscriptions[:1], events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.FDReadEvent || events[0].Errno != wasi.ESUCCESS {
+			t.Fatalf("poll_oneoff: event handle not ready after sending: %+v", events[:n])
+		}
+
+		// Messages are received with one read each.
+		buffer := make([]byte, 16)
+		for _, want := range []string{"hello", "\x00"} {
+			n, errno := p.FDRead(ctx, fd, []wasi.IOVec{buffer})
+			if errno != wasi.ESUCCESS {
+				t.Fatal(errno)
+			}
+			if got := string(buffer[:n]); got != want {
+				t.Fatalf("fd_read: wrong message: %q != %q", got, want)
+			}
+		}
+		if _, errno := p.FDRead(ctx, fd, []wasi.IOVec{buffer}); errno != wasi.EAGAIN {
+			t.Fatalf("fd_read: expected EAGAIN after reading the messages, got %s", errno)
+		}
+		if _, errno := p.FDWrite(ctx, fd, []wasi.IOVec{buffer}); errno != wasi.ENOTCAPABLE {
+			t.Fatalf("fd_write: expected ENOTCAPABLE on an event handle, got %s", errno)
+		}
+
+		// The guest cannot receive messages after closing the handle.
+		if errno := p.FDClose(ctx, fd); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if errno := h.Send([]byte("hello")); errno == wasi.ESUCCESS {
+			t.Fatal("send: expected an error after the guest closed the handle")
+		}
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSystemSignalHandle(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		if _, errno := p.SignalHandleOpen(ctx); errno != wasi.EINVAL {
+			t.Fatalf("signal handle without signals: expected EINVAL, got %s", errno)
+		}
+		fd, errno := p.SignalHandleOpen(ctx, wasi.SIGUSR1)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+
+		subscriptions := []wasi.Subscription{subscribeFDRead(fd)}
+		events := make([]wasi.Event, len(subscriptions))
+		n, errno := p.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.FDReadEvent || events[0].Errno != wasi.ESUCCESS {
+			t.Fatalf("poll_oneoff: signal handle not ready after SIGUSR1: %+v", events[:n])
+		}
+		buffer := make([]byte, 16)
+		size, errno := p.FDRead(ctx, fd, []wasi.IOVec{buffer})
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if size != 1 || wasi.Signal(buffer[0]) != wasi.SIGUSR1 {
+			t.Fatalf("fd_read: wrong signal: %v", buffer[:size])
+		}
+	})
+}
+
+func TestSystemProcSpawn(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		if _, _, errno := p.ProcSpawn(ctx, []string{"cat"}); errno != wasi.ENOSYS {
+			t.Fatalf("proc_spawn without spawner: expected ENOSYS, got %s", errno)
+		}
+		p.Spawn = unix.CommandSpawner(nil, "cat", "sleep")
+
+		if _, _, errno := p.ProcSpawn(ctx, []string{"ls"}); errno != wasi.EACCES {
+			t.Fatalf("proc_spawn of a command not allowed: expected EACCES, got %s", errno)
+		}
+
+		pid, stdio, errno := p.ProcSpawn(ctx, []string{"cat"})
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if _, errno := p.FDWrite(ctx, stdio[0], []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if errno := p.FDClose(ctx, stdio[0]); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		var output []byte
+		buffer := make([]byte, 16)
+		for {
+			n, errno := p.FDRead(ctx, stdio[1], []wasi.IOVec{buffer})
+			if errno != wasi.ESUCCESS {
+				t.Fatal(errno)
+			}
+			if n == 0 {
+				break
+			}
+			output = append(output, buffer[:n]...)
+		}
+		if string(output) != "hello" {
+			t.Fatalf("wrong output: %q", output)
+		}
+		code, errno := p.ProcWait(ctx, pid, 0)
+		if errno != wasi.ESUCCESS || code != 0 {
+			t.Fatalf("proc_wait: %d, %s", code, errno)
+		}
+		if _, errno := p.ProcWait(ctx, pid, 0); errno != wasi.ECHILD {
+			t.Fatalf("proc_wait after the process was waited: expected ECHILD, got %s", errno)
+		}
+
+		pid, _, errno = p.ProcSpawn(ctx, []string{"sleep", "10"})
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if _, errno := p.ProcWait(ctx, pid, wasi.WaitNoHang); errno != wasi.EAGAIN {
+			t.Fatalf("proc_wait with WaitNoHang: expected EAGAIN, got %s", errno)
+		}
+		if errno := p.ProcKill(ctx, pid, wasi.SIGKILL); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		code, errno = p.ProcWait(ctx, pid, 0)
+		if errno != wasi.ESUCCESS || code != wasi.SIGKILL.ExitCode() {
+			t.Fatalf("proc_wait: %d, %s", code, errno)
+		}
+	})
+}
+
+func TestSystemVectoredFileIO(t *testing.T) {
+	ctx := context.Background()
+
+	dirfd, err := sysunix.Open(t.TempDir(), sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	fd, errno := p.PathOpen(ctx, dir, 0, "data", wasi.OpenCreate, wasi.AllRights, wasi.AllRights, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+
+	n, errno := p.FDPwrite(ctx, fd, []wasi.IOVec{
+		[]byte("Hello"),
+		nil,
+		[]byte(", "),
+		[]byte("World!"),
+	}, 3)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n != 13 {
+		t.Fatalf("fd_pwrite: wrong size: %d", n)
+	}
+
+	a, b, c := make([]byte, 4), make([]byte, 0), make([]byte, 16)
+	n, errno = p.FDPread(ctx, fd, []wasi.IOVec{a, b, c}, 3)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n != 13 || string(a) != "Hell" || string(c[:9]) != "o, World!" {
+		t.Fatalf("fd_pread: wrong data: %d %q %q", n, a, c)
+	}
+
+	// Vectored I/O is limited to IOV_MAX buffers, the extra buffers are
+	// ignored and the operation is partial.
+	iovecs := make([]wasi.IOVec, 2000)
+	for i := range iovecs {
+		iovecs[i] = []byte{'x'}
+	}
+	n, errno = p.FDWrite(ctx, fd, iovecs)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n != 1024 {
+		t.Fatalf("fd_write: wrong size: %d", n)
+	}
+	n, errno = p.FDPread(ctx, fd, iovecs, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n != 1024 {
+		t.Fatalf("fd_pread: wrong size: %d", n)
+	}
+}
+
+func TestSystemAllocations(t *testing.T) {
+	ctx := context.Background()
+
+	dirfd, err := sysunix.Open(t.TempDir(), sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	fd, errno := p.PathOpen(ctx, dir, 0, "data", wasi.OpenCreate, wasi.AllRights, wasi.AllRights, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+
+	iovecs := make([]wasi.IOVec, 64)
+	for i := range iovecs {
+		iovecs[i] = make([]byte, 16)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, errno := p.FDPwrite(ctx, fd, iovecs, 0); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if _, errno := p.FDPread(ctx, fd, iovecs, 0); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("vectored I/O: %g allocations per call", allocs)
+	}
+
+	entries := make([]wasi.DirEntry, 4)
+	allocs = testing.AllocsPerRun(100, func() {
+		d, errno := unix.FD(dirfd).FDOpenDir(ctx)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if _, errno := d.FDReadDir(ctx, entries, 0, 4096); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		d.FDCloseDir(ctx)
+	})
+	if allocs != 0 {
+		t.Errorf("readdir: %g allocations per call", allocs)
+	}
+}
+
+func TestSystemSockSendRecvVectored(t *testing.T) {
+	ctx := context.Background()
+
+	fds, err := sysunix.Socketpair(sysunix.AF_UNIX, sysunix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	stat := wasi.FDStat{
+		FileType:   wasi.SocketDGramType,
+		RightsBase: wasi.SockListenRights | wasi.SockConnectionRights,
+	}
+	a := p.Register(unix.FD(fds[0]), stat)
+	b := p.Register(unix.FD(fds[1]), stat)
+
+	send := make([]wasi.IOVec, 16)
+	recv := make([]wasi.IOVec, 16)
+	for i := range send {
+		send[i] = []byte{'a' + byte(i)}
+		recv[i] = make([]byte, 1)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		n, errno := p.SockSend(ctx, a, send, 0)
+		if errno != wasi.ESUCCESS || n != 16 {
+			t.Fatalf("sock_send: %d, %s", n, errno)
+		}
+		n, roflags, errno := p.SockRecv(ctx, b, recv[:8], 0)
+		if errno != wasi.ESUCCESS || n != 8 || roflags != wasi.RecvDataTruncated {
+			t.Fatalf("sock_recv: %d, %s, %s", n, roflags, errno)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("sock_send/sock_recv: %g allocations per call", allocs)
+	}
+
+	if _, errno := p.SockSend(ctx, a, send, 0); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	n, _, errno := p.SockRecv(ctx, b, recv, 0)
+	if errno != wasi.ESUCCESS || n != 16 {
+		t.Fatalf("sock_recv: %d, %s", n, errno)
+	}
+	for i, iov := range recv {
+		if iov[0] != 'a'+byte(i) {
+			t.Fatalf("sock_recv: wrong data at index %d: %q", i, iov)
+		}
+	}
+}
+
+func TestSystemPathOpenBeneath(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(tmp, "secret"), filepath.Join(root, "a", "b", "data")} {
+		if err := os.WriteFile(file, []byte("Hello, World!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"inside":   "a/b",
+		"relative": "a/../../secret",
+		"absolute": filepath.Join(tmp, "secret"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirfd, err := sysunix.Open(root, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	for _, test := range []struct {
+		path  string
+		errno wasi.Errno
+	}{
+		{"a/b/data", wasi.ESUCCESS},
+		{"inside/data", wasi.ESUCCESS},
+		{"a/b/../../inside/data", wasi.ESUCCESS},
+		{"relative", wasi.EPERM},
+		{"absolute", wasi.EPERM},
+		{"a/../..", wasi.EPERM},
+	} {
+		fd, errno := p.PathOpen(ctx, dir, wasi.SymlinkFollow, test.path, 0, wasi.AllRights, wasi.AllRights, 0)
+		if errno != test.errno {
+			t.Errorf("%s: wrong errno: want=%s got=%s", test.path, test.errno, errno)
+		}
+		if errno == wasi.ESUCCESS {
+			p.FDClose(ctx, fd)
+		}
+	}
+}
+
+func TestSystemPathBeneath(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+
+	for _, dir := range []string{filepath.Join(root, "a"), filepath.Join(outside, "dir")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(outside, "secret"), filepath.Join(root, "a", "data")} {
+		if err := os.WriteFile(file, []byte("Hello, World!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(outside, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"relative": "../outside",
+		"absolute": outside,
+		"secret":   "../outside/secret",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirfd, err := sysunix.Open(root, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	calls := map[string]func(path string) wasi.Errno{
+		"path_create_directory": func(path string) wasi.Errno {
+			return p.PathCreateDirectory(ctx, dir, path+"/new")
+		},
+		"path_filestat_get": func(path string) wasi.Errno {
+			_, errno := p.PathFileStatGet(ctx, dir, 0, path+"/secret")
+			return errno
+		},
+		"path_filestat_set_times": func(path string) wasi.Errno {
+			return p.PathFileStatSetTimes(ctx, dir, 0, path+"/secret", 0, 0, wasi.AccessTimeNow|wasi.ModifyTimeNow)
+		},
+		"path_link": func(path string) wasi.Errno {
+			return p.PathLink(ctx, dir, 0, path+"/secret", dir, "a/hardlink")
+		},
+		"path_link(new)": func(path string) wasi.Errno {
+			return p.PathLink(ctx, dir, 0, "a/data", dir, path+"/hardlink")
+		},
+		"path_readlink": func(path string) wasi.Errno {
+			_, errno := p.PathReadLink(ctx, dir, path+"/link", make([]byte, 256))
+			return errno
+		},
+		"path_remove_directory": func(path string) wasi.Errno {
+			return p.PathRemoveDirectory(ctx, dir, path+"/dir")
+		},
+		"path_rename": func(path string) wasi.Errno {
+			return p.PathRename(ctx, dir, path+"/secret", dir, "a/renamed")
+		},
+		"path_rename(new)": func(path string) wasi.Errno {
+			return p.PathRename(ctx, dir, "a/data", dir, path+"/renamed")
+		},
+		"path_symlink": func(path string) wasi.Errno {
+			return p.PathSymlink(ctx, "data", dir, path+"/symlink")
+		},
+		"path_unlink_file": func(path string) wasi.Errno {
+			return p.PathUnlinkFile(ctx, dir, path+"/secret")
+		},
+	}
+	for name, call := range calls {
+		for _, path := range []string{"relative", "absolute", "a/../relative", "a/../.."} {
+			if errno := call(path); errno != wasi.EPERM {
+				t.Errorf("%s: %s: wrong errno: want=EPERM got=%s", name, path, errno)
+			}
+		}
+	}
+	// The last component is resolved beneath the directory as well when
+	// symbolic links are followed.
+	if _, errno := p.PathFileStatGet(ctx, dir, wasi.SymlinkFollow, "secret"); errno != wasi.EPERM {
+		t.Errorf("path_filestat_get: secret: wrong errno: want=EPERM got=%s", errno)
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("files were created or removed outside of the root directory: %v", entries)
+	}
+	if b, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(b) != "Hello, World!" {
+		t.Errorf("a file outside of the root directory was modified: %q", b)
+	}
+}
+
+func TestSystemDirCache(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "data"), []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "b", "c", "data"), []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../data", filepath.Join(root, "a", "b", "c", "link")); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := sysunix.Open(root, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	p.DirCacheSize = 1
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	open := func(path string, want wasi.Errno) {
+		t.Helper()
+		fd, errno := p.PathOpen(ctx, dir, wasi.SymlinkFollow, path, 0, wasi.AllRights, wasi.AllRights, 0)
+		if errno != want {
+			t.Fatalf("%s: wrong errno: want=%s got=%s", path, want, errno)
+		}
+		if errno == wasi.ESUCCESS {
+			p.FDClose(ctx, fd)
+		}
+	}
+
+	open("a/b/data", wasi.ENOENT)
+	open("a/b/c/data", wasi.ESUCCESS)
+	open("a/b/c/data", wasi.ESUCCESS)
+	open("a/b/c/link", wasi.ESUCCESS)
+	open("a/b/c/../../../../data", wasi.EPERM)
+
+	if errno := p.PathRename(ctx, dir, "a/b", dir, "a/x"); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	open("a/b/c/data", wasi.ENOENT)
+	open("a/x/c/data", wasi.ESUCCESS)
+}
+
+func TestSystemConcurrentFileTable(t *testing.T) {
+	ctx := context.Background()
+	p := newSystem()
+	defer p.Close(ctx)
+
+	fds, err := pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.AllRights}
+	rfd := p.Register(unix.FD(fds[0]), stat)
+	wfd := p.Register(unix.FD(fds[1]), stat)
+
+	const N = 1000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Open and close file descriptors while the other goroutine uses rfd,
+		// which must not observe the changes.
+		for i := 0; i < N; i++ {
+			fd := p.Register(unix.FD(-1), stat)
+			if errno := p.FDStatSetRights(ctx, fd, wasi.FDReadRight, 0); errno != wasi.ESUCCESS {
+				t.Error(errno)
+				return
+			}
+			p.FDClose(ctx, fd)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := []byte{0}
+		for i := 0; i < N; i++ {
+			if _, errno := p.FDWrite(ctx, wfd, []wasi.IOVec{buf}); errno != wasi.ESUCCESS {
+				t.Error(errno)
+				return
+			}
+			if _, errno := p.FDRead(ctx, rfd, []wasi.IOVec{buf}); errno != wasi.ESUCCESS {
+				t.Error(errno)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	s, errno := p.FDStatGet(ctx, rfd)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if s != stat {
+		t.Errorf("wrong fd stat: want=%+v got=%+v", stat, s)
+	}
+}
+
+func TestSystemGoldenTrace(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	if err := os.Mkdir(filepath.Join(tmp, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := sysunix.Open(tmp, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	s := wasitest.GoldenTrace(t, "testdata/golden.trace", p)
+
+	file, errno := s.PathOpen(ctx, dir, 0, "data", wasi.OpenCreate, wasi.AllRights, wasi.AllRights, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	s.FDWrite(ctx, file, []wasi.IOVec{[]byte("Hello, World!")})
+	s.FDFileStatGet(ctx, file)
+	s.FDRenumber(ctx, file, 42)
+	s.FDClose(ctx, 42)
+	s.PathFileStatGet(ctx, dir, 0, "dir")
+	s.PathOpen(ctx, dir, 0, "../secret", 0, wasi.AllRights, wasi.AllRights, 0)
+	s.ClockTimeGet(ctx, wasi.Realtime, 1)
+	s.FDReadDir(ctx, dir, make([]wasi.DirEntry, 10), 0, 4096)
+}
+
+func TestSystemFDCopy(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(tmp, "data"), []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := sysunix.Open(tmp, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	file, errno := p.PathOpen(ctx, dir, 0, "data", 0, wasi.AllRights, wasi.AllRights, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+
+	socks, err := sysunix.Socketpair(sysunix.AF_UNIX, sysunix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := wasi.FDStat{FileType: wasi.SocketStreamType, RightsBase: wasi.AllRights}
+	a := p.Preopen(unix.FD(socks[0]), "a", stat)
+	b := p.Preopen(unix.FD(socks[1]), "b", stat)
+
+	// The file is copied to the socket, from its current position.
+	if _, errno := p.FDSeek(ctx, file, 7, wasi.SeekStart); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	n, errno := p.FDCopy(ctx, a, file, 100)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n != 6 {
+		t.Fatalf("fd_copy: wrong size: %d", n)
+	}
+	if n, errno := p.FDCopy(ctx, a, file, 100); errno != wasi.ESUCCESS || n != 0 {
+		t.Fatalf("fd_copy: expected end of file: %d, %s", n, errno)
+	}
+
+	// Copies between sockets are not supported by the system, wasi.FDCopy
+	// copies the data through a buffer of the host instead.
+	if _, errno := p.FDCopy(ctx, a, b, 100); errno != wasi.ENOTSUP {
+		t.Fatalf("fd_copy: expected ENOTSUP, got %s", errno)
+	}
+	n, errno = wasi.FDCopy(ctx, p, a, b, 100)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if n != 6 {
+		t.Fatalf("fd_copy: wrong size: %d", n)
+	}
+	buffer := make([]byte, 32)
+	r, errno := p.FDRead(ctx, b, []wasi.IOVec{buffer})
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if string(buffer[:r]) != "World!" {
+		t.Fatalf("fd_copy: wrong data: %q", buffer[:r])
+	}
+}
+
+func TestSystemFDMmap(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "data")
+
+	if err := os.WriteFile(path, []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := sysunix.Open(tmp, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+	file, errno := p.PathOpen(ctx, dir, 0, "data", 0, wasi.AllRights, wasi.AllRights, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+
+	mmap := func(offset wasi.FileSize, size int) string {
+		t.Helper()
+		buffer := make([]byte, size)
+		n, errno := p.FDMmap(ctx, file, offset, buffer)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("fd_mmap: %s", errno)
+		}
+		return string(buffer[:n])
+	}
+
+	if s := mmap(7, 5); s != "World" {
+		t.Fatalf("fd_mmap: wrong content: %q", s)
+	}
+	if s := mmap(7, 100); s != "World!" {
+		t.Fatalf("fd_mmap: wrong content past the end of the file: %q", s)
+	}
+
+	// The file is remapped when it grows, and when it is truncated, which
+	// would otherwise raise SIGBUS when accessing the pages past its end.
+	if err := os.WriteFile(path, []byte("Hello, World! How are you?"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := mmap(14, 100); s != "How are you?" {
+		t.Fatalf("fd_mmap: wrong content after the file grew: %q", s)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if s := mmap(0, 100); s != "" {
+		t.Fatalf("fd_mmap: wrong content after the file was truncated: %q", s)
+	}
+
+	// Pipes cannot be mapped, wasi.FDMmap reads them with FDPread instead,
+	// which fails because they are not seekable.
+	fds, err := pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := p.Preopen(unix.FD(fds[0]), "r", wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.AllRights})
+	p.Preopen(unix.FD(fds[1]), "w", wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.AllRights})
+	if _, errno := p.FDMmap(ctx, r, 0, make([]byte, 1)); errno != wasi.ENOTSUP {
+		t.Fatalf("fd_mmap: expected ENOTSUP, got %s", errno)
+	}
+	if _, errno := wasi.FDMmap(ctx, p, r, 0, make([]byte, 1)); errno != wasi.ESPIPE {
+		t.Fatalf("fd_mmap: expected ESPIPE, got %s", errno)
+	}
+
+	if errno := p.FDClose(ctx, file); errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if _, errno := p.FDMmap(ctx, file, 0, make([]byte, 1)); errno != wasi.EBADF {
+		t.Fatalf("fd_mmap: expected EBADF after closing the file, got %s", errno)
+	}
+}
+
+func TestSystemReadDirObservesHostChanges(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	dirfd, err := sysunix.Open(tmp, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	defer p.Close(ctx)
+
+	fd := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+		FileType:   wasi.DirectoryType,
+		RightsBase: wasi.AllRights,
+	})
+
+	readDir := func() []string {
+		var names []string
+		var cookie wasi.DirCookie
+		entries := make([]wasi.DirEntry, 4)
+		for {
+			n, errno := p.FDReadDir(ctx, fd, entries, cookie, 4096)
+			if errno != wasi.ESUCCESS {
+				t.Fatal(errno)
+			}
+			if n == 0 {
+				return names
+			}
+			for _, e := range entries[:n] {
+				if name := string(e.Name); name != "." && name != ".." {
+					names = append(names, name)
+				}
+				cookie = e.Next
+			}
+		}
+	}
+
+	if names := readDir(); len(names) != 0 {
+		t.Fatalf("unexpected entries: %q", names)
+	}
+
+	// Directory listings are not cached across rewinds, files created by the
+	// host while the guest is running must be visible on the next listing.
+	if err := os.WriteFile(filepath.Join(tmp, "hello"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDir(); !reflect.DeepEqual(names, []string{"hello"}) {
+		t.Fatalf("host change not observed: %q", names)
+	}
+
+	if err := os.Remove(filepath.Join(tmp, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDir(); len(names) != 0 {
+		t.Fatalf("host change not observed: %q", names)
+	}
+
+	// Stat calls go straight to the host as well.
+	if err := os.WriteFile(filepath.Join(tmp, "data"), []byte("1234"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, errno := p.PathFileStatGet(ctx, fd, 0, "data")
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if stat.Size != 4 {
+		t.Fatalf("wrong size: %d", stat.Size)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "data"), []byte("12345678"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, errno = p.PathFileStatGet(ctx, fd, 0, "data")
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	if stat.Size != 8 {
+		t.Fatalf("host change not observed: size=%d", stat.Size)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "existing"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "old"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dirfd, err := sysunix.Open(tmp, sysunix.O_DIRECTORY|sysunix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSystem()
+	root := p.Preopen(unix.FD(dirfd), "/data", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.AllRights,
+		RightsInheriting: wasi.AllRights,
+	})
+
+	manifest := new(strings.Builder)
+	s := wasi.DryRun(p, manifest)
+
+	write := func(path string, openFlags wasi.OpenFlags, fdFlags wasi.FDFlags, data string) {
+		fd, errno := s.PathOpen(ctx, root, 0, path, openFlags, wasi.AllRights, 0, fdFlags)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("path_open(%s): %s", path, errno)
+		}
+		if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte(data)}); errno != wasi.ESUCCESS {
+			t.Fatalf("fd_write(%s): %s", path, errno)
+		}
+		s.FDClose(ctx, fd)
+	}
+	read := func(path string) string {
+		fd, errno := s.PathOpen(ctx, root, 0, path, 0, wasi.FDReadRight, 0, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("path_open(%s): %s", path, errno)
+		}
+		defer s.FDClose(ctx, fd)
+		buf := make([]byte, 64)
+		n, errno := s.FDRead(ctx, fd, []wasi.IOVec{buf})
+		if errno != wasi.ESUCCESS {
+			t.Fatalf("fd_read(%s): %s", path, errno)
+		}
+		return string(buf[:n])
+	}
+	check := func(errno wasi.Errno) {
+		t.Helper()
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+	}
+
+	write("new", wasi.OpenCreate, 0, "abc")
+	write("existing", 0, wasi.Append, ", world")
+	check(s.PathCreateDirectory(ctx, root, "dir"))
+	write("dir/file", wasi.OpenCreate|wasi.OpenExclusive, 0, "1")
+	check(s.PathRename(ctx, root, "dir/file", root, "dir/renamed"))
+	check(s.PathUnlinkFile(ctx, root, "old"))
+
+	if data := read("new"); data != "abc" {
+		t.Errorf("new: wrong content: %q", data)
+	}
+	if data := read("existing"); data != "hello, world" {
+		t.Errorf("existing: wrong content: %q", data)
+	}
+	if data := read("dir/renamed"); data != "1" {
+		t.Errorf("dir/renamed: wrong content: %q", data)
+	}
+	if _, errno := s.PathFileStatGet(ctx, root, 0, "old"); errno != wasi.ENOENT {
+		t.Errorf("old: expected ENOENT, got %s", errno)
+	}
+	if _, errno := s.PathFileStatGet(ctx, root, 0, "dir/file"); errno != wasi.ENOENT {
+		t.Errorf("dir/file: expected ENOENT, got %s", errno)
+	}
+	if errno := s.PathRemoveDirectory(ctx, root, "dir"); errno != wasi.ENOTEMPTY {
+		t.Errorf("dir: expected ENOTEMPTY, got %s", errno)
+	}
+
+	var names []string
+	entries := make([]wasi.DirEntry, 16)
+	for cookie := wasi.DirCookie(0); ; {
+		n, errno := s.FDReadDir(ctx, root, entries, cookie, 4096)
+		check(errno)
+		if n == 0 {
+			break
+		}
+		for _, e := range entries[:n] {
+			names = append(names, string(e.Name))
+			cookie = e.Next
+		}
+	}
+	sort.Strings(names)
+	if want := []string{".", "..", "dir", "existing", "new"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong directory entries: %q", names)
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing must have changed on the host.
+	files, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "existing" || files[1].Name() != "old" {
+		t.Errorf("host directory was modified: %v", files)
+	}
+	if b, _ := os.ReadFile(filepath.Join(tmp, "existing")); string(b) != "hello" {
+		t.Errorf("host file was modified: %q", b)
+	}
+
+	const want = `create  /data/new (3 bytes)
+write   /data/existing (12 bytes)
+mkdir   /data/dir
+create  /data/dir/file (1 bytes)
+rename  /data/dir/file -> /data/dir/renamed
+remove  /data/old
+`
+	if got := manifest.String(); got != want {
+		t.Errorf("wrong manifest:\n%s", got)
+	}
+}
+
+func TestInjectIOFaults(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		s := wasi.InjectIOFaults(p, wasi.IOFaults{
+			ShortRead:   1,
+			ShortWrite:  1,
+			SplitIOVecs: 0.5,
+			EAGAIN:      0.5,
+			EAGAINBurst: 2,
+		})
+		if errno := s.FDStatSetFlags(ctx, 0, wasi.NonBlock); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+
+		const message = "Hello, World! How are you doing?"
+		for data := []byte(message); len(data) > 0; {
+			n, errno := s.FDWrite(ctx, 1, []wasi.IOVec{data[:len(data)/2], data[len(data)/2:]})
+			if errno != wasi.ESUCCESS {
+				t.Fatal(errno)
+			}
+			if int(n) == len(data) && len(data) > 1 {
+				t.Errorf("fd_write: expected short write of %d bytes", len(data))
+			}
+			data = data[n:]
+		}
+
+		var output []byte
+		var eagain int
+		buffer := make([]byte, 8)
+		for len(output) < len(message) {
+			n, errno := s.FDRead(ctx, 0, []wasi.IOVec{buffer[:4], buffer[4:]})
+			switch errno {
+			case wasi.ESUCCESS:
+				output = append(output, buffer[:n]...)
+			case wasi.EAGAIN:
+				eagain++
+			default:
+				t.Fatal(errno)
+			}
+		}
+		if string(output) != message {
+			t.Errorf("fd_read: wrong data: %q", output)
+		}
+		if eagain == 0 {
+			t.Error("fd_read: no EAGAIN errors were injected")
+		}
+	})
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	log := new(bytes.Buffer)
+
+	type results struct {
+		data   string
+		random []byte
+		now    wasi.Timestamp
+		stat   wasi.FDStat
+	}
+
+	run := func(s wasi.System) (r results) {
+		if _, errno := s.FDWrite(ctx, 1, []wasi.IOVec{[]byte("Hello, World!")}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		buffer := make([]byte, 32)
+		n, errno := s.FDRead(ctx, 0, []wasi.IOVec{buffer[:5], buffer[5:]})
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		r.data = string(buffer[:n])
+		r.random = make([]byte, 16)
+		if errno := s.RandomGet(ctx, r.random); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		r.now, errno = s.ClockTimeGet(ctx, wasi.Realtime, 1)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		r.stat, errno = s.FDStatGet(ctx, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		return r
+	}
+
+	var recorded results
+	testSystem(func(ctx context.Context, p *unix.System) {
+		p.Rand = rand.Reader
+		s := wasi.Record(p, log)
+		recorded = run(s)
+	})
+	if recorded.data != "Hello, World!" {
+		t.Fatalf("wrong data read: %q", recorded.data)
+	}
+
+	s := wasi.Replay(newSystem(), bytes.NewReader(log.Bytes()))
+	if replayed := run(s); !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("wrong results replayed:\nwant: %+v\ngot:  %+v", recorded, replayed)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Error(err)
+	}
+
+	s = wasi.Replay(newSystem(), bytes.NewReader(log.Bytes()))
+	if _, errno := s.FDWrite(ctx, 2, []wasi.IOVec{[]byte("Hello, World!")}); errno != wasi.ENOTRECOVERABLE {
+		t.Errorf("fd_write: wrong errno after divergence: %s", errno)
+	}
+	if err := s.Close(ctx); err == nil {
+		t.Error("expected an error reporting the divergence")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	for _, name := range []string{"c", "a", "d", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(seed int64) (random []byte, names []string, elapsed wasi.Timestamp) {
+		p := newSystem()
+		defer p.Close(ctx)
+
+		dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Preopen(unix.FD(dirfd), dir, wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.DirectoryRights,
+			RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+		})
+		s := wasi.Deterministic(p, seed)
+
+		random = make([]byte, 16)
+		if errno := s.RandomGet(ctx, random); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+
+		// Read one entry at a time to exercise the cookies.
+		entries := make([]wasi.DirEntry, 1)
+		for cookie := wasi.DirCookie(0); ; {
+			n, errno := s.FDReadDir(ctx, 0, entries, cookie, 4096)
+			if errno != wasi.ESUCCESS {
+				t.Fatal(errno)
+			}
+			if n == 0 {
+				break
+			}
+			names = append(names, string(entries[0].Name))
+			cookie = entries[0].Next
+		}
+
+		start, errno := s.ClockTimeGet(ctx, wasi.Monotonic, 1)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if start != wasi.DeterministicEpoch {
+			t.Errorf("wrong initial time: %d", start)
+		}
+		subscriptions := []wasi.Subscription{subscribeTimeout(time.Hour)}
+		events := make([]wasi.Event, len(subscriptions))
+		begin := time.Now()
+		if _, errno := s.PollOneOff(ctx, subscriptions, events); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if time.Since(begin) > time.Minute {
+			t.Error("poll_oneoff: blocked on the virtual clock")
+		}
+		now, _ := s.ClockTimeGet(ctx, wasi.Realtime, 1)
+		return random, names, now - start
+	}
+
+	random1, names1, elapsed := run(42)
+	random2, names2, _ := run(42)
+	random3, _, _ := run(43)
+
+	if !bytes.Equal(random1, random2) {
+		t.Error("random_get: different bytes generated with the same seed")
+	}
+	if bytes.Equal(random1, random3) {
+		t.Error("random_get: same bytes generated with different seeds")
+	}
+	if want := []string{".", "..", "a", "b", "c", "d"}; !reflect.DeepEqual(names1, want) || !reflect.DeepEqual(names2, want) {
+		t.Errorf("fd_readdir: wrong order: %q", names1)
+	}
+	if elapsed != wasi.Timestamp(time.Hour) {
+		t.Errorf("wrong time elapsed: %s", time.Duration(elapsed))
+	}
+}
+
+func TestScanWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	p := newSystem()
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Preopen(unix.FD(dirfd), "/data", wasi.FDStat{
+		FileType:         wasi.DirectoryType,
+		RightsBase:       wasi.DirectoryRights,
+		RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+	})
+
+	scanned := map[string]string{}
+	s := wasi.ScanWrites(p, func(ctx context.Context, path string, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		scanned[path] = string(b)
+		if strings.Contains(string(b), "SECRET") {
+			return errors.New("secret detected")
+		}
+		return nil
+	})
+
+	writeFile := func(name, data string) wasi.Errno {
+		fd, errno := s.PathOpen(ctx, 0, 0, name, wasi.OpenCreate|wasi.OpenTruncate, wasi.FDWriteRight, 0, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte(data)}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		return s.FDClose(ctx, fd)
+	}
+
+	if errno := writeFile("hello.txt", "Hello, World!"); errno != wasi.ESUCCESS {
+		t.Errorf("fd_close: %s", errno)
+	}
+	if errno := writeFile("key.txt", "SECRET=42"); errno != wasi.EIO {
+		t.Errorf("fd_close: wrong errno: %s", errno)
+	}
+
+	// Files which are only read are not scanned.
+	fd, errno := s.PathOpen(ctx, 0, 0, "hello.txt", 0, wasi.FDReadRight, 0, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	s.FDClose(ctx, fd)
+
+	want := map[string]string{
+		"/data/hello.txt": "Hello, World!",
+		"/data/key.txt":   "SECRET=42",
+	}
+	if !reflect.DeepEqual(scanned, want) {
+		t.Errorf("wrong files scanned: %q", scanned)
+	}
+	if err := s.Close(ctx); err == nil || !strings.Contains(err.Error(), "secret detected") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		var calls []string
+		s := wasi.Intercept(p, wasi.Hooks{
+			Before: func(ctx context.Context, call *wasi.Call) {
+				switch call.Syscall {
+				case "sock_accept":
+					call.Return(wasi.EPERM)
+				case "fd_write":
+					// Redact the data written by the guest.
+					iovecs := call.Args[1].([]wasi.IOVec)
+					call.Args[1] = []wasi.IOVec{bytes.ToUpper(iovecs[0])}
+				}
+			},
+			After: func(ctx context.Context, call *wasi.Call) {
+				calls = append(calls, fmt.Sprintf("%s %d %s", call.Syscall, call.Results, call.Errno.Name()))
+				if call.Syscall == "clock_res_get" {
+					call.Results[0] = wasi.Timestamp(42)
+				}
+			},
+		})
+
+		if _, _, _, errno := s.SockAccept(ctx, 0, 0); errno != wasi.EPERM {
+			t.Errorf("sock_accept: wrong errno: %s", errno)
+		}
+		if _, errno := s.FDWrite(ctx, 1, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		buffer := make([]byte, 5)
+		if _, errno := s.FDRead(ctx, 0, []wasi.IOVec{buffer}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if string(buffer) != "HELLO" {
+			t.Errorf("fd_read: wrong data: %q", buffer)
+		}
+		if res, _ := s.ClockResGet(ctx, wasi.Monotonic); res != 42 {
+			t.Errorf("clock_res_get: result was not overridden: %d", res)
+		}
+
+		want := []string{
+			"sock_accept [] EPERM",
+			"fd_write [5] ESUCCESS",
+			"fd_read [5] ESUCCESS",
+			"clock_res_get [1] ESUCCESS",
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("wrong calls intercepted:\n%q", calls)
+		}
+
+		// Results of the wrong type are bugs in the hooks, which must not
+		// be hidden by returning zero values to the guest.
+		s = wasi.Intercept(p, wasi.Hooks{
+			Before: func(ctx context.Context, call *wasi.Call) {
+				call.Return(wasi.ESUCCESS, 42)
+			},
+		})
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("clock_res_get: wrong result type did not panic")
+			} else if msg := fmt.Sprint(r); !strings.Contains(msg, "has type int, expected wasi.Timestamp") {
+				t.Errorf("clock_res_get: wrong panic message: %s", msg)
+			}
+		}()
+		s.ClockResGet(ctx, wasi.Monotonic)
+	})
+}
+
+func TestMockSystem(t *testing.T) {
+	ctx := context.Background()
+	mock := wasitest.NewMockSystem(t)
+	mock.On("fd_write", wasi.FD(1)).Return(wasi.ENOSPC).Once()
+	mock.On("fd_write").Return(wasi.ESUCCESS, wasi.Size(5))
+	mock.On("fd_read", wasi.FD(0)).Do(func(ctx context.Context, call *wasi.Call) {
+		iovecs := call.Args[1].([]wasi.IOVec)
+		call.Return(wasi.ESUCCESS, wasi.Size(copy(iovecs[0], "hello")))
+	})
+	mock.On("poll_oneoff").Delay(time.Minute)
+	var s wasi.System = mock
+
+	if _, errno := s.FDWrite(ctx, 1, []wasi.IOVec{[]byte("hello")}); errno != wasi.ENOSPC {
+		t.Errorf("fd_write: wrong errno: %s", errno)
+	}
+	if n, errno := s.FDWrite(ctx, 1, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS || n != 5 {
+		t.Errorf("fd_write: wrong result: %d %s", n, errno)
+	}
+	buffer := make([]byte, 8)
+	if n, errno := s.FDRead(ctx, 0, []wasi.IOVec{buffer}); errno != wasi.ESUCCESS || string(buffer[:n]) != "hello" {
+		t.Errorf("fd_read: wrong result: %q %s", buffer[:n], errno)
+	}
+	if _, errno := s.FDRead(ctx, 3, []wasi.IOVec{buffer}); errno != wasi.ENOSYS {
+		t.Errorf("fd_read: wrong errno: %s", errno)
+	}
+
+	deadline, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, errno := s.PollOneOff(deadline, nil, nil); errno != wasi.ETIMEDOUT {
+		t.Errorf("poll_oneoff: wrong errno: %s", errno)
+	}
+
+	var calls []string
+	for _, call := range mock.Calls() {
+		calls = append(calls, call.Syscall+" "+call.Errno.Name())
+	}
+	want := []string{
+		"fd_write ENOSPC",
+		"fd_write ESUCCESS",
+		"fd_read ESUCCESS",
+		"fd_read ENOSYS",
+		"poll_oneoff ETIMEDOUT",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("wrong calls recorded:\n%q", calls)
+	}
+}
+
+func TestMux(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		files := newSystem()
+		dirfd, err := syscall.Open(t.TempDir(), syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files.Preopen(unix.FD(dirfd), "/data", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.DirectoryRights,
+			RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+		})
+		defer files.Close(ctx)
+
+		s := wasi.Mux(wasi.Routes{Default: p, Files: files})
+
+		// The pipes of the default system keep their numbers, the preopened
+		// directory of the other system is assigned the next one.
+		if name, errno := s.FDPreStatDirName(ctx, 2); errno != wasi.ESUCCESS || name != "/data" {
+			t.Fatalf("fd_prestat_dir_name: %q %s", name, errno)
+		}
+
+		fd, errno := s.PathOpen(ctx, 2, 0, "file", wasi.OpenCreate, wasi.FDReadRight|wasi.FDWriteRight, 0, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if fd != 3 {
+			t.Errorf("path_open: wrong file descriptor: %d", fd)
+		}
+		if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if errno := s.PathRename(ctx, 2, "file", 0, "file"); errno != wasi.EXDEV {
+			t.Errorf("path_rename: wrong errno: %s", errno)
+		}
+
+		// Poll file descriptors of both systems; only the file is ready.
+		subscriptions := []wasi.Subscription{
+			subscribeFDRead(0),
+			subscribeFDRead(fd),
+			subscribeTimeout(time.Second),
+		}
+		events := make([]wasi.Event, len(subscriptions))
+		n, errno := s.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].UserData != subscriptions[1].UserData {
+			t.Errorf("poll_oneoff: wrong events: %+v", events[:n])
+		}
+
+		// Only the timeout expires when none of the file descriptors are
+		// ready.
+		subscriptions = []wasi.Subscription{
+			subscribeFDRead(0),
+			subscribeTimeout(20 * time.Millisecond),
+		}
+		if n, errno := s.PollOneOff(ctx, subscriptions, events); errno != wasi.ESUCCESS || n != 1 || events[0].EventType != wasi.ClockEvent {
+			t.Errorf("poll_oneoff: wrong events: %+v %s", events[:n], errno)
+		}
+
+		if errno := s.FDClose(ctx, fd); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if _, errno := s.FDStatGet(ctx, fd); errno != wasi.EBADF {
+			t.Errorf("fd_stat_get: wrong errno after close: %s", errno)
+		}
+	})
+}
+
+func TestFireTimersOnResume(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		// Simulate the host being suspended for an hour by making the
+		// monotonic clock jump forward.
+		var suspended atomic.Int64
+		p.Monotonic = func(ctx context.Context) (uint64, error) {
+			return uint64(time.Since(epoch)) + uint64(suspended.Load()), nil
+		}
+		s := wasi.FireTimersOnResume(p, 10*time.Millisecond)
+
+		time.AfterFunc(20*time.Millisecond, func() { suspended.Store(int64(time.Hour)) })
+
+		start := time.Now()
+		subscriptions := []wasi.Subscription{
+			subscribeFDRead(0),
+			subscribeTimeout(10 * time.Minute),
+		}
+		events := make([]wasi.Event, len(subscriptions))
+		n, errno := s.PollOneOff(ctx, subscriptions, events)
+		if errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+		if n != 1 || events[0].EventType != wasi.ClockEvent {
+			t.Fatalf("poll_oneoff: wrong events: %+v", events[:n])
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("poll_oneoff: timeout fired too late: %s", elapsed)
+		}
+	})
+}
+
+func TestSynchronize(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		dirfd, err := syscall.Open(t.TempDir(), syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := p.Preopen(unix.FD(dirfd), "/tmp", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.DirectoryRights,
+			RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+		})
+		s := wasi.Synchronize(p)
+
+		// A thread blocked waiting for the pipe to be readable must not
+		// prevent the other threads from opening and closing files.
+		polled := make(chan wasi.Errno)
+		go func() {
+			subs := []wasi.Subscription{subscribeFDRead(0)}
+			evs := make([]wasi.Event, len(subs))
+			_, errno := s.PollOneOff(ctx, subs, evs)
+			polled <- errno
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := fmt.Sprintf("file-%d", i)
+				for j := 0; j < 10; j++ {
+					fd, errno := s.PathOpen(ctx, dir, 0, name, wasi.OpenCreate, wasi.FDWriteRight, 0, 0)
+					if errno != wasi.ESUCCESS {
+						t.Error("path_open:", errno)
+						return
+					}
+					if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte(name)}); errno != wasi.ESUCCESS {
+						t.Error("fd_write:", errno)
+					}
+					if errno := s.FDClose(ctx, fd); errno != wasi.ESUCCESS {
+						t.Error("fd_close:", errno)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if _, errno := s.FDWrite(ctx, 1, []wasi.IOVec{[]byte("!")}); errno != wasi.ESUCCESS {
+			t.Fatal("fd_write:", errno)
+		}
+		if errno := <-polled; errno != wasi.ESUCCESS {
+			t.Fatal("poll_oneoff:", errno)
+		}
+	})
+}
+
+func TestSynchronizeReadDir(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		tmp := t.TempDir()
+		for i := 0; i < 100; i++ {
+			if err := os.WriteFile(filepath.Join(tmp, fmt.Sprintf("file-%d", i)), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dirfd, err := syscall.Open(tmp, syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := p.Preopen(unix.FD(dirfd), "/tmp", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.DirectoryRights,
+			RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+		})
+		s := wasi.Synchronize(p)
+
+		// The listing of a directory is state of its file descriptor, which
+		// concurrent calls must not modify at the same time.
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				entries := make([]wasi.DirEntry, 8)
+				for j := 0; j < 20; j++ {
+					if _, errno := s.FDReadDir(ctx, dir, entries, 0, 4096); errno != wasi.ESUCCESS {
+						t.Error("fd_readdir:", errno)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestSynchronizeCloseWhileReading(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		fds, err := pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := wasi.FDStat{FileType: wasi.CharacterDeviceType, RightsBase: wasi.AllRights}
+		r := p.Preopen(unix.FD(fds[0]), "r", stat)
+		w := p.Preopen(unix.FD(fds[1]), "w", stat)
+		s := wasi.Synchronize(p)
+
+		read := make(chan wasi.Errno)
+		go func() {
+			_, errno := s.FDRead(ctx, r, []wasi.IOVec{make([]byte, 8)})
+			read <- errno
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// A thread blocked reading the pipe must not prevent the other
+		// threads from changing the flags of the file descriptor, closing
+		// it, or making calls on it after it was closed.
+		for _, test := range []struct {
+			syscall string
+			errno   wasi.Errno
+			call    func() wasi.Errno
+		}{
+			{"fd_fdstat_set_flags", wasi.ESUCCESS, func() wasi.Errno { return s.FDStatSetFlags(ctx, r, 0) }},
+			{"fd_close", wasi.ESUCCESS, func() wasi.Errno { return s.FDClose(ctx, r) }},
+			{"fd_fdstat_get", wasi.EBADF, func() wasi.Errno { _, errno := s.FDStatGet(ctx, r); return errno }},
+		} {
+			done := make(chan wasi.Errno, 1)
+			go func() { done <- test.call() }()
+			select {
+			case errno := <-done:
+				if errno != test.errno {
+					t.Errorf("%s: wrong errno: want=%s got=%s", test.syscall, test.errno, errno)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: blocked by fd_read", test.syscall)
+			}
+		}
+
+		// The read completes when data is written to the pipe, and fails
+		// since the file descriptor was closed.
+		if _, errno := s.FDWrite(ctx, w, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS {
+			t.Fatal("fd_write:", errno)
+		}
+		if errno := <-read; errno != wasi.EBADF {
+			t.Errorf("fd_read: wrong errno: want=%s got=%s", wasi.EBADF, errno)
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		dirfd, err := syscall.Open(t.TempDir(), syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readOnly := wasi.DirectoryRights &^ (wasi.PathCreateFileRight | wasi.PathCreateDirectoryRight)
+		dir := p.Preopen(unix.FD(dirfd), "/tmp", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       readOnly,
+			RightsInheriting: readOnly | wasi.FDReadRight,
+		})
+
+		var denials []wasi.Denial
+		s := wasi.Audit(p, func(ctx context.Context, denial wasi.Denial) {
+			denials = append(denials, denial)
+		})
+
+		s.PathOpen(ctx, dir, 0, "file", wasi.OpenCreate, wasi.FDReadRight, 0, 0)
+		s.PathOpen(ctx, dir, 0, "file", 0, wasi.FDWriteRight, 0, 0)
+		s.PathOpen(ctx, dir, 0, "../file", 0, wasi.FDReadRight, 0, 0)
+		s.FDWrite(ctx, dir, []wasi.IOVec{[]byte("hello")})
+		s.PathCreateDirectory(ctx, dir, "sub")
+
+		got := make([]string, len(denials))
+		for i, d := range denials {
+			got[i] = d.String()
+		}
+		want := []string{
+			fmt.Sprintf(`path_open(%d, "file"): ENOTCAPABLE, missing rights PathCreateFileRight`, dir),
+			fmt.Sprintf(`path_open(%d, "file"): ENOTCAPABLE, missing inheriting rights FDWriteRight`, dir),
+			fmt.Sprintf(`path_open(%d, "../file"): EPERM`, dir),
+			fmt.Sprintf(`fd_write(%d): ENOTCAPABLE, missing rights FDWriteRight`, dir),
+			fmt.Sprintf(`path_create_directory(%d, "sub"): ENOTCAPABLE, missing rights PathCreateDirectoryRight`, dir),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong denials:\n%s", strings.Join(got, "\n"))
+		}
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		tmp := t.TempDir()
+		if err := os.Mkdir(filepath.Join(tmp, "out"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, "in"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dirfd, err := syscall.Open(tmp, syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := p.Preopen(unix.FD(dirfd), "/data", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.DirectoryRights,
+			RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+		})
+		p.Environ = []string{"HOME=/home", "AWS_KEY=secret", "AWS_REGION=us-east-1", "LANG=C"}
+
+		policy, err := wasi.ParsePolicy([]byte(`{
+			"paths": [
+				{"path": "/data", "access": ["read"]},
+				{"path": "/data/out", "access": ["read", "write", "create", "delete"]}
+			],
+			"network": [
+				{"address": "127.0.0.1:8000-8999", "access": ["connect"]}
+			],
+			"env": ["HOME", "AWS_R*"]
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := wasi.Enforce(p, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			path  string
+			flags wasi.OpenFlags
+			errno wasi.Errno
+		}{
+			{"in", 0, wasi.ESUCCESS},
+			{"in", wasi.OpenTruncate, wasi.EPERM},
+			{"new", wasi.OpenCreate, wasi.EPERM},
+			{"out/new", wasi.OpenCreate, wasi.ESUCCESS},
+		} {
+			fd, errno := s.PathOpen(ctx, dir, 0, test.path, test.flags, wasi.FileRights, 0, 0)
+			if errno != test.errno {
+				t.Errorf("path_open(%q): %s != %s", test.path, errno, test.errno)
+			}
+			if errno == wasi.ESUCCESS {
+				s.FDClose(ctx, fd)
+			}
+		}
+
+		// Rights that the policy does not grant are removed from the file
+		// descriptors opened by the guest.
+		fd, errno := s.PathOpen(ctx, dir, 0, "in", 0, wasi.FileRights, 0, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatal("path_open:", errno)
+		}
+		if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte("hi")}); errno != wasi.ENOTCAPABLE {
+			t.Errorf("fd_write: %s != %s", errno, wasi.ENOTCAPABLE)
+		}
+
+		// Paths are resolved relative to the directories opened by the
+		// guest.
+		out, errno := s.PathOpen(ctx, dir, 0, "out", wasi.OpenDirectory, wasi.DirectoryRights, wasi.DirectoryRights|wasi.FileRights, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatal("path_open:", errno)
+		}
+		if errno := s.PathUnlinkFile(ctx, out, "new"); errno != wasi.ESUCCESS {
+			t.Error("path_unlink_file:", errno)
+		}
+		if errno := s.PathUnlinkFile(ctx, dir, "in"); errno != wasi.EPERM {
+			t.Errorf("path_unlink_file: %s != %s", errno, wasi.EPERM)
+		}
+		if errno := s.PathRename(ctx, out, "../in", out, "in"); errno != wasi.EPERM {
+			t.Errorf("path_rename: %s != %s", errno, wasi.EPERM)
+		}
+
+		sock, errno := s.SockOpen(ctx, wasi.InetFamily, wasi.StreamSocket, wasi.TCPProtocol, wasi.SockConnectionRights, wasi.SockConnectionRights)
+		if errno != wasi.ESUCCESS {
+			t.Fatal("sock_open:", errno)
+		}
+		if _, errno := s.SockConnect(ctx, sock, &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: 9000}); errno != wasi.EPERM {
+			t.Errorf("sock_connect: %s != %s", errno, wasi.EPERM)
+		}
+
+		environ, _ := s.EnvironGet(ctx)
+		if !reflect.DeepEqual(environ, []string{"HOME=/home", "AWS_REGION=us-east-1"}) {
+			t.Errorf("environ_get: wrong environment: %q", environ)
+		}
+	})
+}
+
+func TestPolicyDeny(t *testing.T) {
+	testSystem(func(ctx context.Context, p *unix.System) {
+		tmp := t.TempDir()
+		if err := os.Mkdir(filepath.Join(tmp, ".ssh"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{".ssh/id_rsa", "server.key", "index.html"} {
+			if err := os.WriteFile(filepath.Join(tmp, name), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dirfd, err := syscall.Open(tmp, syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := p.Preopen(unix.FD(dirfd), "/home", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.DirectoryRights,
+			RightsInheriting: wasi.DirectoryRights | wasi.FileRights,
+		})
+		s, err := wasi.Enforce(p, &wasi.Policy{Deny: []string{"**/.ssh", "*.key"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, errno := s.PathOpen(ctx, dir, 0, ".ssh/id_rsa", 0, wasi.FileRights, 0, 0); errno != wasi.EPERM {
+			t.Errorf("path_open: %s != %s", errno, wasi.EPERM)
+		}
+		if errno := s.PathUnlinkFile(ctx, dir, "server.key"); errno != wasi.EPERM {
+			t.Errorf("path_unlink_file: %s != %s", errno, wasi.EPERM)
+		}
+		if errno := s.PathRename(ctx, dir, "index.html", dir, "index.key"); errno != wasi.EPERM {
+			t.Errorf("path_rename: %s != %s", errno, wasi.EPERM)
+		}
+		fd, errno := s.PathOpen(ctx, dir, 0, "index.html", 0, wasi.FileRights, 0, 0)
+		if errno != wasi.ESUCCESS {
+			t.Fatal("path_open:", errno)
+		}
+		if _, errno := s.FDWrite(ctx, fd, []wasi.IOVec{[]byte("hello")}); errno != wasi.ESUCCESS {
+			t.Error("fd_write:", errno)
+		}
+
+		// Symbolic links to denied files cannot be created, they would let
+		// the guest open the files by following the links.
+		for _, target := range []string{"server.key", "./.ssh/id_rsa", "../home/server.key", filepath.Join(tmp, "server.key")} {
+			if errno := s.PathSymlink(ctx, target, dir, "link"); errno != wasi.EPERM {
+				t.Errorf("path_symlink(%q): %s != %s", target, errno, wasi.EPERM)
+			}
+		}
+		if _, errno := s.PathOpen(ctx, dir, wasi.SymlinkFollow, "link", 0, wasi.FileRights, 0, 0); errno != wasi.ENOENT {
+			t.Errorf("path_open: %s != %s", errno, wasi.ENOENT)
+		}
+		if errno := s.PathSymlink(ctx, "index.html", dir, "link"); errno != wasi.ESUCCESS {
+			t.Error("path_symlink:", errno)
+		}
+	})
+}
+
+// FuzzSystemPathOpen makes calls to the path functions of the system with
+// hostile paths, and verifies that they never resolve to files outside of the
+// preopened directory, including through symbolic links created by the guest.
+func FuzzSystemPathOpen(f *testing.F) {
+	ctx := context.Background()
+	tmp, err := filepath.EvalSymlinks(f.TempDir())
+	if err != nil {
+		f.Fatal(err)
+	}
+	root := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		f.Fatal(err)
+	}
+	if err := os.Mkdir(outside, 0755); err != nil {
+		f.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		f.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"inside":   "a/b",
+		"relative": "../outside/secret",
+		"absolute": filepath.Join(outside, "secret"),
+		"parent":   "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	f.Add(uint8(0), "a/b/data", "", uint32(wasi.OpenCreate))
+	f.Add(uint8(0), "relative", "", uint32(wasi.OpenTruncate))
+	f.Add(uint8(0), "parent/outside/secret", "", uint32(0))
+	f.Add(uint8(0), "/../outside/secret", "", uint32(0))
+	f.Add(uint8(1), "a/../../outside/x", "", uint32(0))
+	f.Add(uint8(2), "link", "../outside", uint32(0))
+	f.Add(uint8(3), "inside/../relative", "a/b/c", uint32(0))
+	f.Add(uint8(4), "absolute", "", uint32(0))
+	f.Add(uint8(5), "a\x00b", "", uint32(0))
+
+	f.Fuzz(func(t *testing.T, op uint8, path, path2 string, flags uint32) {
+		dirfd, err := sysunix.Open(root, sysunix.O_DIRECTORY|sysunix.O_RDONLY|sysunix.O_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newSystem()
+		defer p.Close(ctx)
+
+		dir := p.Preopen(unix.FD(dirfd), "/", wasi.FDStat{
+			FileType:         wasi.DirectoryType,
+			RightsBase:       wasi.AllRights,
+			RightsInheriting: wasi.AllRights,
+		})
+		lookupFlags := wasi.LookupFlags(flags >> 16)
+		openFlags := wasi.OpenFlags(flags)
+
+		switch op % 7 {
+		case 0:
+			fd, errno := p.PathOpen(ctx, dir, lookupFlags, path, openFlags, wasi.AllRights, wasi.AllRights, 0)
+			if errno == wasi.ESUCCESS {
+				assertBeneath(t, p, fd, root)
+			}
+		case 1:
+			p.PathCreateDirectory(ctx, dir, path)
+		case 2:
+			p.PathSymlink(ctx, path2, dir, path)
+		case 3:
+			p.PathRename(ctx, dir, path, dir, path2)
+		case 4:
+			p.PathFileStatSetTimes(ctx, dir, lookupFlags, path, 0, 0, wasi.AccessTimeNow|wasi.ModifyTimeNow)
+		case 5:
+			p.PathUnlinkFile(ctx, dir, path)
+		case 6:
+			p.PathRemoveDirectory(ctx, dir, path)
+		}
+
+		entries, err := os.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%q: files were created outside of the root directory", path)
+		}
+		if b, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(b) != "secret" {
+			t.Fatalf("%q: a file outside of the root directory was modified", path)
+		}
+	})
+}
+
+// assertBeneath verifies on Linux that the file opened at fd is in root.
+func assertBeneath(t *testing.T, p *unix.System, fd wasi.FD, root string) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		return
+	}
+	f, _, errno := p.LookupFD(fd, 0)
+	if errno != wasi.ESUCCESS {
+		t.Fatal(errno)
+	}
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != root && !strings.HasPrefix(path, root+"/") {
+		t.Fatalf("file opened outside of the root directory: %s", path)
+	}
+}
+
+// FuzzSystemFD makes calls to the file descriptor functions of the system
+// with out of range file descriptors and malformed io vectors.
+func FuzzSystemFD(f *testing.F) {
+	ctx := context.Background()
+	tmp := f.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "file"), []byte("Hello, World!"), 0644); err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(uint8(0), int32(0), []byte{0, 4, 255}, int64(0))
+	f.Add(uint8(1), int32(1), []byte{}, int64(0))
+	f.Add(uint8(2), int32(4), []byte{1, 2, 3}, int64(-1))
+	f.Add(uint8(3), int32(4), []byte{16}, int64(1<<62))
+	f.Add(uint8(4), int32(5), []byte{8}, int64(0))
+	f.Add(uint8(5), int32(-1), []byte{}, int64(0))
+	f.Add(uint8(6), int32(1<<30), []byte{}, int64(3))
+	f.Add(uint8(7), int32(2), []byte{}, int64(3))
+
+	f.Fuzz(func(t *testing.T, op uint8, fd int32, shape []byte, offset int64) {
+		p := newSystem()
+		defer p.Close(ctx)
+
+		fds, err := pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		socks, err := sysunix.Socketpair(sysunix.AF_UNIX, sysunix.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fd := range append(fds[:], socks[:]...) {
+			if err := sysunix.SetNonblock(fd, true); err != nil {
+				t.Fatal(err)
+			}
+			p.Preopen(unix.FD(fd), "", wasi.FDStat{
+				FileType:   wasi.SocketStreamType,
+				Flags:      wasi.NonBlock,
+				RightsBase: wasi.AllRights,
+			})
+		}
+		for _, open := range []struct {
+			path  string
+			flags int
+			typ   wasi.FileType
+		}{
+			{filepath.Join(tmp, "file"), sysunix.O_RDWR, wasi.RegularFileType},
+			{tmp, sysunix.O_DIRECTORY | sysunix.O_RDONLY, wasi.DirectoryType},
+		} {
+			fd, err := sysunix.Open(open.path, open.flags|sysunix.O_CLOEXEC, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Preopen(unix.FD(fd), open.path, wasi.FDStat{
+				FileType:   open.typ,
+				RightsBase: wasi.AllRights,
+			})
+		}
+
+		// Each byte of the shape is the length of an io vector, the zero
+		// value is a nil vector.
+		iovecs := make([]wasi.IOVec, len(shape))
+		for i, size := range shape {
+			if size != 0 {
+				iovecs[i] = make(wasi.IOVec, size)
+			}
+		}
+		buffer := make([]byte, len(shape))
+
+		switch fd := wasi.FD(fd); op % 10 {
+		case 0:
+			p.FDRead(ctx, fd, iovecs)
+		case 1:
+			p.FDWrite(ctx, fd, iovecs)
+		case 2:
+			p.FDPread(ctx, fd, iovecs, wasi.FileSize(offset))
+		case 3:
+			p.FDPwrite(ctx, fd, iovecs, wasi.FileSize(offset))
+		case 4:
+			p.FDSeek(ctx, fd, wasi.FileDelta(offset), wasi.Whence(len(shape)))
+		case 5:
+			p.FDReadDir(ctx, fd, make([]wasi.DirEntry, len(shape)), wasi.DirCookie(offset), int(offset))
+		case 6:
+			p.FDRenumber(ctx, fd, wasi.FD(offset))
+		case 7:
+			p.FDClose(ctx, fd)
+			p.FDRead(ctx, fd, iovecs)
+		case 8:
+			p.SockRecv(ctx, fd, iovecs, wasi.RIFlags(offset))
+		case 9:
+			p.FDMmap(ctx, fd, wasi.FileSize(offset), buffer)
+		}
+	})
+}
+
+// FuzzSystemSockAddress makes calls to the socket functions of the system
+// with malformed addresses. The internet addresses are restricted to the
+// loopback interface, and the unix addresses are only connected to.
+func FuzzSystemSockAddress(f *testing.F) {
+	ctx := context.Background()
+
+	f.Add(uint8(0), []byte{127, 0, 0, 1}, int64(0))
+	f.Add(uint8(1), []byte{127, 0, 0, 1}, int64(-1))
+	f.Add(uint8(2), []byte{}, int64(1<<16))
+	f.Add(uint8(3), []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, int64(1<<40))
+	f.Add(uint8(4), []byte("\x00"), int64(0))
+	f.Add(uint8(5), bytes.Repeat([]byte("a"), 200), int64(0))
+
+	f.Fuzz(func(t *testing.T, op uint8, addr []byte, port int64) {
+		p := newSystem()
+		defer p.Close(ctx)
+
+		var family wasi.ProtocolFamily
+		var sockaddr wasi.SocketAddress
+		switch op % 3 {
+		case 0:
+			a := &wasi.Inet4Address{Port: int(port)}
+			copy(a.Addr[:], addr)
+			a.Addr[0] = 127
+			family, sockaddr = wasi.InetFamily, a
+		case 1:
+			a := &wasi.Inet6Address{Port: int(port)}
+			a.Addr[15] = 1
+			family, sockaddr = wasi.Inet6Family, a
+		case 2:
+			family, sockaddr = wasi.UnixFamily, &wasi.UnixAddress{Name: string(addr)}
+		}
+		socketType := wasi.StreamSocket
+		if op&0x10 != 0 {
+			socketType = wasi.DatagramSocket
+		}
+
+		fd, errno := p.SockOpen(ctx, family, socketType, 0, wasi.AllRights, wasi.AllRights)
+		if errno != wasi.ESUCCESS {
+			t.Skip(errno)
+		}
+		if errno := p.FDStatSetFlags(ctx, fd, wasi.NonBlock); errno != wasi.ESUCCESS {
+			t.Fatal(errno)
+		}
+
+		switch op / 3 % 3 {
+		case 0:
+			if family != wasi.UnixFamily {
+				p.SockBind(ctx, fd, sockaddr)
+			}
+		case 1:
+			p.SockConnect(ctx, fd, sockaddr)
+		case 2:
+			p.SockSendTo(ctx, fd, []wasi.IOVec{addr}, 0, sockaddr)
+		}
+	})
+}
+
 func testSystem(f func(context.Context, *unix.System)) {
 	ctx := context.Background()
 
@@ -0,0 +1,259 @@
+package unix
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/sys/unix"
+)
+
+// FDTermGet returns the modes of the terminal that fd refers to (see
+// wasi.Terminal), or ENOTTY if it is not a terminal.
+func (s *System) FDTermGet(ctx context.Context, fd wasi.FD) (wasi.TerminalFlags, wasi.Errno) {
+	f, _, errno := s.LookupFD(fd, 0)
+	if errno != wasi.ESUCCESS {
+		return 0, errno
+	}
+	t, err := unix.IoctlGetTermios(int(f), ioctlGetTermios)
+	if err != nil {
+		return 0, makeErrno(err)
+	}
+	return makeTerminalFlags(t), wasi.ESUCCESS
+}
+
+// FDTermSet sets the modes of the terminal that fd refers to. The modes that
+// the terminal had before are restored when the last file descriptor of the
+// system referring to it is closed.
+func (s *System) FDTermSet(ctx context.Context, fd wasi.FD, flags wasi.TerminalFlags) wasi.Errno {
+	f, _, errno := s.LookupFD(fd, 0)
+	if errno != wasi.ESUCCESS {
+		return errno
+	}
+	t, err := unix.IoctlGetTermios(int(f), ioctlGetTermios)
+	if err != nil {
+		return makeErrno(err)
+	}
+	if err := s.terminals.save(int(f), t); err != nil {
+		return makeErrno(err)
+	}
+	setTerminalFlags(t, flags)
+	return makeErrno(unix.IoctlSetTermios(int(f), ioctlSetTermios, t))
+}
+
+// FDTermSize returns the size of the window of the terminal that fd refers
+// to.
+func (s *System) FDTermSize(ctx context.Context, fd wasi.FD) (wasi.TerminalSize, wasi.Errno) {
+	f, _, errno := s.LookupFD(fd, 0)
+	if errno != wasi.ESUCCESS {
+		return wasi.TerminalSize{}, errno
+	}
+	w, err := unix.IoctlGetWinsize(int(f), unix.TIOCGWINSZ)
+	if err != nil {
+		return wasi.TerminalSize{}, makeErrno(err)
+	}
+	return wasi.TerminalSize{Rows: w.Row, Columns: w.Col}, wasi.ESUCCESS
+}
+
+type windowResize struct {
+	fd      wasi.FD // guest file descriptor of the read end of the pipe
+	writer  int     // host file descriptor of the write end of the pipe
+	open    bool    // whether fd was registered
+	signals chan os.Signal
+}
+
+// WindowResizeFD returns a file descriptor that guests can poll to be
+// notified when the window of the terminal of the host is resized, after
+// which they get its new size with FDTermSize.
+//
+// The file descriptor is the read end of a pipe which receives a byte each
+// time the process receives SIGWINCH, or NotifyWindowResize is called; guests
+// read the bytes to wait for the next notification. The same file descriptor
+// is returned on subsequent calls, until the guest closes it.
+func (s *System) WindowResizeFD(ctx context.Context) (wasi.FD, wasi.Errno) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.resize.open {
+		if _, _, errno := s.LookupFD(s.resize.fd, 0); errno == wasi.ESUCCESS {
+			return s.resize.fd, wasi.ESUCCESS
+		}
+		s.closeResizeWriter()
+	}
+
+	fds := make([]int, 2)
+	if err := pipe(fds, unix.O_NONBLOCK); err != nil {
+		return -1, makeErrno(err)
+	}
+	s.resize.writer = fds[1]
+	s.resize.open = true
+	s.resize.fd = s.Register(FD(fds[0]), wasi.FDStat{
+		FileType:   wasi.UnknownType,
+		Flags:      wasi.NonBlock,
+		RightsBase: wasi.FDReadRight | wasi.PollFDReadWriteRight,
+	})
+	if s.resize.signals == nil {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, unix.SIGWINCH)
+		s.resize.signals = signals
+		go func() {
+			for range signals {
+				s.NotifyWindowResize()
+			}
+		}()
+	}
+	return s.resize.fd, wasi.ESUCCESS
+}
+
+// NotifyWindowResize makes the file descriptor returned by WindowResizeFD
+// ready for reading. Notifications are dropped while the guest does not read
+// them and the pipe is full.
+//
+// NotifyWindowResize may be called asynchronously.
+func (s *System) NotifyWindowResize() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.resize.writer > 0 {
+		_, _ = unix.Write(s.resize.writer, []byte{0})
+	}
+}
+
+func (s *System) closeResizeWriter() {
+	if s.resize.writer > 0 {
+		_ = closeTraceEBADF(s.resize.writer)
+	}
+	s.resize.writer = 0
+}
+
+// stopWindowResize stops the notifications of WindowResizeFD; must be called
+// with the mutex held.
+func (s *System) stopWindowResize() {
+	if s.resize.signals != nil {
+		signal.Stop(s.resize.signals)
+		close(s.resize.signals)
+		s.resize.signals = nil
+	}
+	s.closeResizeWriter()
+}
+
+func makeTerminalFlags(t *unix.Termios) (flags wasi.TerminalFlags) {
+	if (t.Lflag & unix.ECHO) != 0 {
+		flags |= wasi.TerminalEcho
+	}
+	if (t.Lflag & unix.ICANON) != 0 {
+		flags |= wasi.TerminalCanonical
+	}
+	if (t.Lflag & unix.ISIG) != 0 {
+		flags |= wasi.TerminalSignals
+	}
+	if (t.Iflag & unix.ICRNL) != 0 {
+		flags |= wasi.TerminalInputProcessing
+	}
+	if (t.Oflag & unix.OPOST) != 0 {
+		flags |= wasi.TerminalOutputProcessing
+	}
+	return flags
+}
+
+// setTerminalFlags changes the termios flags emulated by flags, clearing the
+// same flags as cfmakeraw(3) when they are not set.
+func setTerminalFlags(t *unix.Termios, flags wasi.TerminalFlags) {
+	setFlag(&t.Lflag, unix.ECHO, flags.Has(wasi.TerminalEcho))
+	if !flags.Has(wasi.TerminalEcho) {
+		t.Lflag &^= unix.ECHONL
+	}
+	setFlag(&t.Lflag, unix.ICANON|unix.IEXTEN, flags.Has(wasi.TerminalCanonical))
+	if !flags.Has(wasi.TerminalCanonical) {
+		// Reads return as soon as a character is available.
+		t.Cc[unix.VMIN] = 1
+		t.Cc[unix.VTIME] = 0
+	}
+	setFlag(&t.Lflag, unix.ISIG, flags.Has(wasi.TerminalSignals))
+	setFlag(&t.Iflag, unix.ICRNL|unix.IXON, flags.Has(wasi.TerminalInputProcessing))
+	if !flags.Has(wasi.TerminalInputProcessing) {
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR
+	}
+	setFlag(&t.Oflag, unix.OPOST, flags.Has(wasi.TerminalOutputProcessing))
+}
+
+func setFlag[T ~uint32 | ~uint64](v *T, flag T, set bool) {
+	if set {
+		*v |= flag
+	} else {
+		*v &^= flag
+	}
+}
+
+// terminals holds the modes that the terminals had before FDTermSet changed
+// them, indexed by device, so they can be restored when the system stops
+// using them.
+type terminals struct {
+	mutex   sync.Mutex
+	devices map[uint64]*terminal
+	fds     map[int]*terminal
+}
+
+type terminal struct {
+	device uint64
+	modes  unix.Termios
+	fds    map[int]struct{}
+}
+
+// save records the modes t of the terminal fd, unless the modes of the same
+// terminal were already recorded through another file descriptor.
+func (ts *terminals) save(fd int, t *unix.Termios) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.fds[fd] != nil {
+		return nil
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return err
+	}
+	device := uint64(stat.Rdev)
+	term := ts.devices[device]
+	if term == nil {
+		if ts.devices == nil {
+			ts.devices = make(map[uint64]*terminal)
+			ts.fds = make(map[int]*terminal)
+		}
+		term = &terminal{device: device, modes: *t, fds: make(map[int]struct{})}
+		ts.devices[device] = term
+	}
+	term.fds[fd] = struct{}{}
+	ts.fds[fd] = term
+	return nil
+}
+
+// forget must be called before fd is closed or replaced by another file, it
+// restores the modes of the terminal if fd was the last file descriptor
+// referring to it.
+func (ts *terminals) forget(fd int) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	term := ts.fds[fd]
+	if term == nil {
+		return
+	}
+	delete(ts.fds, fd)
+	delete(term.fds, fd)
+	if len(term.fds) == 0 {
+		delete(ts.devices, term.device)
+		unix.IoctlSetTermios(fd, ioctlSetTermios, &term.modes)
+	}
+}
+
+func (ts *terminals) close() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for _, term := range ts.devices {
+		for fd := range term.fds {
+			unix.IoctlSetTermios(fd, ioctlSetTermios, &term.modes)
+			break
+		}
+	}
+	ts.devices, ts.fds = nil, nil
+}
@@ -0,0 +1,25 @@
+package unix
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// io_uring(7) is only available on Linux, the System always uses the classic
+// system calls on other platforms.
+type uring struct{}
+
+func newURing() (*uring, error) { return nil, unix.ENOSYS }
+
+func (r *uring) close() {}
+
+func (r *uring) readv(fd int, iovs [][]byte, nonblock bool) (int, error) { return readv(fd, iovs) }
+
+func (r *uring) writev(fd int, iovs [][]byte, nonblock bool) (int, error) { return writev(fd, iovs) }
+
+func (r *uring) accept(socket, flags int) (int, unix.Sockaddr, error) { return accept(socket, flags) }
+
+func (r *uring) poll(fds []unix.PollFd, timeout time.Duration) (int, error) {
+	return unix.Poll(fds, pollTimeout(timeout))
+}
@@ -0,0 +1,573 @@
+package unix
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// This file implements a minimal io_uring(7) client used by System when the
+// IOUring option is enabled.
+//
+// Operations are submitted to the ring as soon as they are queued, and the
+// goroutines waiting for completions take turns reaping the completion queue:
+// the first waiter blocks in io_uring_enter(2) on behalf of all the others and
+// wakes them up after storing the results of the completed operations. This
+// lets blocking operations (e.g. reads on a pipe) run concurrently with the
+// others, which the kernel executes asynchronously.
+
+const (
+	ioringOpReadv         = 1
+	ioringOpWritev        = 2
+	ioringOpPollAdd       = 6
+	ioringOpPollRemove    = 7
+	ioringOpTimeout       = 11
+	ioringOpTimeoutRemove = 12
+	ioringOpAccept        = 13
+
+	ioringSetupCQSize = 1 << 3
+
+	ioringEnterGetEvents = 1 << 0
+
+	ioringFeatSingleMmap = 1 << 0
+	ioringFeatRWCurPos   = 1 << 3
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+)
+
+const (
+	// Number of entries of the submission queue, which bounds the number of
+	// file descriptors that a single call to poll can wait on.
+	uringEntries = 256
+	// Number of entries of the completion queue, which must be large enough
+	// for all the operations in flight at any given time.
+	uringCQEntries = 16 * uringEntries
+)
+
+type ioURingParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        ioSQRingOffsets
+	cqOff        ioCQRingOffsets
+}
+
+type ioSQRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type ioCQRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type ioURingSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+type ioURingCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type kernelTimespec struct {
+	sec  int64
+	nsec int64
+}
+
+type uring struct {
+	fd int
+	// Whether the kernel supports reading and writing at the current file
+	// position (IORING_FEAT_RW_CUR_POS).
+	curPos bool
+
+	sqRing []byte
+	cqRing []byte
+	sqMem  []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []ioURingSQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []ioURingCQE
+
+	mutex sync.Mutex
+	cond  sync.Cond
+	// Identifier of the last operation queued, used as the user data of the
+	// submission queue entries.
+	lastID uint64
+	// Number of entries queued but not yet submitted to the kernel.
+	unsubmitted uint32
+	// Number of operations submitted which have not completed yet.
+	inflight int
+	// Results of the completed operations, by identifier.
+	results map[uint64]int32
+	// Memory referenced by the operations in flight, which must not be
+	// collected or moved until they complete.
+	pinned  map[uint64]any
+	reaping bool
+	closed  bool
+}
+
+func newURing() (*uring, error) {
+	params := ioURingParams{
+		flags:     ioringSetupCQSize,
+		cqEntries: uringCQEntries,
+	}
+	fd, _, errno := unix.Syscall(
+		unix.SYS_IO_URING_SETUP,
+		uintptr(uringEntries),
+		uintptr(unsafe.Pointer(&params)),
+		0,
+	)
+	if errno != 0 {
+		return nil, errno
+	}
+	r := &uring{
+		fd:      int(fd),
+		curPos:  (params.features & ioringFeatRWCurPos) != 0,
+		results: make(map[uint64]int32),
+		pinned:  make(map[uint64]any),
+	}
+	r.cond.L = &r.mutex
+	if err := r.mmap(&params); err != nil {
+		r.release()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *uring) mmap(params *ioURingParams) (err error) {
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	cqSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(ioURingCQE{})))
+	if (params.features & ioringFeatSingleMmap) != 0 {
+		if cqSize > sqSize {
+			sqSize = cqSize
+		}
+	}
+	const prot = unix.PROT_READ | unix.PROT_WRITE
+	const flags = unix.MAP_SHARED | unix.MAP_POPULATE
+	r.sqRing, err = unix.Mmap(r.fd, ioringOffSQRing, sqSize, prot, flags)
+	if err != nil {
+		return err
+	}
+	if (params.features & ioringFeatSingleMmap) != 0 {
+		r.cqRing = r.sqRing
+	} else {
+		r.cqRing, err = unix.Mmap(r.fd, ioringOffCQRing, cqSize, prot, flags)
+		if err != nil {
+			return err
+		}
+	}
+	sqesSize := int(params.sqEntries) * int(unsafe.Sizeof(ioURingSQE{}))
+	r.sqMem, err = unix.Mmap(r.fd, ioringOffSQEs, sqesSize, prot, flags)
+	if err != nil {
+		return err
+	}
+
+	sq, cq := unsafe.Pointer(&r.sqRing[0]), unsafe.Pointer(&r.cqRing[0])
+	r.sqHead = (*uint32)(unsafe.Add(sq, params.sqOff.head))
+	r.sqTail = (*uint32)(unsafe.Add(sq, params.sqOff.tail))
+	r.sqMask = *(*uint32)(unsafe.Add(sq, params.sqOff.ringMask))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Add(sq, params.sqOff.array)), params.sqEntries)
+	r.sqes = unsafe.Slice((*ioURingSQE)(unsafe.Pointer(&r.sqMem[0])), params.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Add(cq, params.cqOff.head))
+	r.cqTail = (*uint32)(unsafe.Add(cq, params.cqOff.tail))
+	r.cqMask = *(*uint32)(unsafe.Add(cq, params.cqOff.ringMask))
+	r.cqes = unsafe.Slice((*ioURingCQE)(unsafe.Add(cq, params.cqOff.cqes)), params.cqEntries)
+	return nil
+}
+
+func (r *uring) release() {
+	if r.sqMem != nil {
+		_ = unix.Munmap(r.sqMem)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		_ = unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		_ = unix.Munmap(r.sqRing)
+	}
+	r.sqRing, r.cqRing, r.sqMem = nil, nil, nil
+	_ = unix.Close(r.fd)
+}
+
+// close closes the ring. The memory of the ring is released when the last
+// operation in flight completes, which may never happen if the operation is
+// blocked (e.g. reading a terminal).
+func (r *uring) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.closed = true
+		r.releaseIfIdle()
+	}
+}
+
+func (r *uring) releaseIfIdle() {
+	if r.closed && r.inflight == 0 && !r.reaping {
+		r.release()
+	}
+}
+
+func (r *uring) enter(toSubmit, minComplete, flags uint32) (uint32, error) {
+	n, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_ENTER,
+		uintptr(r.fd),
+		uintptr(toSubmit),
+		uintptr(minComplete),
+		uintptr(flags),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint32(n), nil
+}
+
+// queue adds an entry to the submission queue and returns the identifier of
+// the operation. The mutex must be held, and the queue must not be full.
+func (r *uring) queue(sqe ioURingSQE, pin any) uint64 {
+	r.lastID++
+	sqe.userData = r.lastID
+	tail := *r.sqTail
+	index := tail & r.sqMask
+	r.sqes[index] = sqe
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.unsubmitted++
+	r.inflight++
+	if pin != nil {
+		r.pinned[sqe.userData] = pin
+	}
+	return sqe.userData
+}
+
+// submit submits the queued entries to the kernel. On error, the entries
+// which were not submitted are removed from the queue. The mutex must be held.
+func (r *uring) submit() error {
+	for r.unsubmitted > 0 {
+		n, err := r.enter(r.unsubmitted, 0, 0)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			tail := *r.sqTail
+			for id := r.lastID - uint64(r.unsubmitted) + 1; id <= r.lastID; id++ {
+				delete(r.pinned, id)
+			}
+			atomic.StoreUint32(r.sqTail, tail-r.unsubmitted)
+			r.inflight -= int(r.unsubmitted)
+			r.unsubmitted = 0
+			return err
+		}
+		r.unsubmitted -= n
+	}
+	return nil
+}
+
+// wait blocks until done returns true. The mutex must be held, and is
+// released while waiting.
+func (r *uring) wait(done func() bool) error {
+	for !done() {
+		if r.reaping {
+			r.cond.Wait()
+			continue
+		}
+		r.reaping = true
+		r.mutex.Unlock()
+		_, err := r.enter(0, 1, ioringEnterGetEvents)
+		r.mutex.Lock()
+		r.reaping = false
+		r.reap()
+		r.cond.Broadcast()
+		switch err {
+		case nil, unix.EINTR, unix.EAGAIN, unix.EBUSY:
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// reap stores the results of the completed operations. The mutex must be
+// held.
+func (r *uring) reap() {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := &r.cqes[head&r.cqMask]
+		r.results[cqe.userData] = cqe.res
+		delete(r.pinned, cqe.userData)
+		r.inflight--
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+func (r *uring) result(id uint64) int32 {
+	res := r.results[id]
+	delete(r.results, id)
+	return res
+}
+
+// do submits an operation and waits for its completion, returning the result
+// of the operation.
+func (r *uring) do(sqe ioURingSQE, pin any) (int32, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return 0, unix.EBADF
+	}
+	id := r.queue(sqe, pin)
+	if err := r.submit(); err != nil {
+		return 0, err
+	}
+	err := r.wait(func() bool {
+		_, ok := r.results[id]
+		return ok
+	})
+	if err != nil {
+		return 0, err
+	}
+	res := r.result(id)
+	r.releaseIfIdle()
+	if res < 0 {
+		return 0, unix.Errno(-res)
+	}
+	return res, nil
+}
+
+func (r *uring) readv(fd int, iovs [][]byte, nonblock bool) (int, error) {
+	if !r.curPos {
+		return readv(fd, iovs)
+	}
+	return r.rw(ioringOpReadv, fd, iovs, nonblock)
+}
+
+func (r *uring) writev(fd int, iovs [][]byte, nonblock bool) (int, error) {
+	if !r.curPos {
+		return writev(fd, iovs)
+	}
+	return r.rw(ioringOpWritev, fd, iovs, nonblock)
+}
+
+// rw submits a readv or writev operation. The kernel does not honor O_NONBLOCK
+// on all file types (e.g. pipes), and would instead wait for the file to be
+// ready, so non-blocking operations are submitted with RWF_NOWAIT.
+func (r *uring) rw(opcode uint8, fd int, iovs [][]byte, nonblock bool) (int, error) {
+	var flags uint32
+	if nonblock {
+		flags = unix.RWF_NOWAIT
+	}
+	iovecs := appendBytes(make([]unix.Iovec, 0, len(iovs)+1), iovs)
+	if len(iovecs) == 0 {
+		iovecs = append(iovecs, unix.Iovec{})
+	}
+	n, err := r.do(ioURingSQE{
+		opcode:  opcode,
+		fd:      int32(fd),
+		off:     ^uint64(0), // current file position
+		addr:    uint64(uintptr(unsafe.Pointer(&iovecs[0]))),
+		len:     uint32(len(iovecs)),
+		opFlags: flags,
+	}, iovecs)
+	runtime.KeepAlive(iovs)
+	if err != nil {
+		return -1, err
+	}
+	return int(n), nil
+}
+
+func (r *uring) accept(socket, flags int) (int, unix.Sockaddr, error) {
+	type sockaddr struct {
+		addr unix.RawSockaddrAny
+		len  uint32
+	}
+	sa := &sockaddr{len: unix.SizeofSockaddrAny}
+	connfd, err := r.do(ioURingSQE{
+		opcode:  ioringOpAccept,
+		fd:      int32(socket),
+		addr:    uint64(uintptr(unsafe.Pointer(&sa.addr))),
+		off:     uint64(uintptr(unsafe.Pointer(&sa.len))),
+		opFlags: uint32(flags | unix.O_CLOEXEC),
+	}, sa)
+	if err != nil {
+		return -1, nil, err
+	}
+	addr, err := anyToSockaddr(&sa.addr, sa.len)
+	if err != nil {
+		_ = closeTraceEBADF(int(connfd))
+		return -1, nil, err
+	}
+	return int(connfd), addr, nil
+}
+
+// poll is equivalent to poll(2), but waits on all the file descriptors with
+// a single submission to the ring.
+func (r *uring) poll(fds []unix.PollFd, timeout time.Duration) (int, error) {
+	if len(fds)+1 > len(r.sqes) {
+		return unix.Poll(fds, pollTimeout(timeout))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return 0, unix.EBADF
+	}
+
+	ids := make([]uint64, len(fds))
+	for i := range fds {
+		fds[i].Revents = 0
+		if fds[i].Fd >= 0 {
+			ids[i] = r.queue(ioURingSQE{
+				opcode:  ioringOpPollAdd,
+				fd:      fds[i].Fd,
+				opFlags: uint32(uint16(fds[i].Events)),
+			}, nil)
+		}
+	}
+	var timeoutID uint64
+	if timeout >= 0 {
+		ts := &kernelTimespec{
+			sec:  int64(timeout / time.Second),
+			nsec: int64(timeout % time.Second),
+		}
+		timeoutID = r.queue(ioURingSQE{
+			opcode: ioringOpTimeout,
+			fd:     -1,
+			addr:   uint64(uintptr(unsafe.Pointer(ts))),
+			len:    1,
+		}, ts)
+	}
+	if err := r.submit(); err != nil {
+		return 0, err
+	}
+
+	completed := func(id uint64) bool {
+		_, ok := r.results[id]
+		return id == 0 || ok
+	}
+	err := r.wait(func() bool {
+		for _, id := range ids {
+			if id != 0 && completed(id) {
+				return true
+			}
+		}
+		return timeoutID != 0 && completed(timeoutID)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Cancel the operations which are still pending, and wait for all of them
+	// to complete so none of them remain in flight after returning.
+	var removes []uint64
+	for _, id := range ids {
+		if !completed(id) {
+			removes = append(removes, r.queue(ioURingSQE{
+				opcode: ioringOpPollRemove,
+				fd:     -1,
+				addr:   id,
+			}, nil))
+		}
+	}
+	if !completed(timeoutID) {
+		removes = append(removes, r.queue(ioURingSQE{
+			opcode: ioringOpTimeoutRemove,
+			fd:     -1,
+			addr:   timeoutID,
+		}, nil))
+	}
+	if err := r.submit(); err != nil {
+		return 0, err
+	}
+	err = r.wait(func() bool {
+		for _, id := range ids {
+			if !completed(id) {
+				return false
+			}
+		}
+		for _, id := range removes {
+			if !completed(id) {
+				return false
+			}
+		}
+		return completed(timeoutID)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range removes {
+		r.result(id)
+	}
+	if timeoutID != 0 {
+		r.result(timeoutID)
+	}
+	n := 0
+	for i, id := range ids {
+		if id == 0 {
+			continue
+		}
+		switch res := r.result(id); {
+		case res >= 0:
+			fds[i].Revents = int16(res)
+		case res == -int32(unix.EBADF):
+			fds[i].Revents = unix.POLLNVAL
+		case res == -int32(unix.ECANCELED):
+		default:
+			fds[i].Revents = unix.POLLERR
+		}
+		if fds[i].Revents != 0 {
+			n++
+		}
+	}
+	r.releaseIfIdle()
+	return n, nil
+}
@@ -0,0 +1,36 @@
+package unix
+
+// waker interrupts the calls to PollOneOff blocked waiting for events when
+// the system is shut down. On macOS, it is a pipe, which becomes ready for
+// reading when the write end is closed.
+type waker struct {
+	fds [2]int
+}
+
+func newWaker() (*waker, error) {
+	w := new(waker)
+	if err := pipe(w.fds[:], 0); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// pollfd returns the file descriptor which becomes ready for reading when
+// wake is called.
+func (w *waker) pollfd() int {
+	return w.fds[0]
+}
+
+func (w *waker) wake() error {
+	if w.fds[1] < 0 {
+		return nil
+	}
+	err := closeTraceEBADF(w.fds[1])
+	w.fds[1] = -1
+	return err
+}
+
+func (w *waker) close() error {
+	w.wake()
+	return closeTraceEBADF(w.fds[0])
+}
@@ -0,0 +1,45 @@
+package unix
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// waker interrupts the calls to PollOneOff blocked waiting for events when
+// the system is shut down. On Linux, it is an eventfd(2), which costs a single
+// file descriptor and is made ready with one write.
+type waker struct {
+	fd int
+}
+
+func newWaker() (*waker, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	return &waker{fd: fd}, nil
+}
+
+// pollfd returns the file descriptor which becomes ready for reading when
+// wake is called.
+func (w *waker) pollfd() int {
+	return w.fd
+}
+
+// wake makes the file descriptor ready for reading. The counter of the
+// eventfd is never read, so it remains ready until the waker is closed.
+func (w *waker) wake() error {
+	value := uint64(1)
+	_, err := ignoreEINTR2(func() (int, error) {
+		return unix.Write(w.fd, (*[8]byte)(unsafe.Pointer(&value))[:])
+	})
+	if err == unix.EAGAIN {
+		err = nil // the counter is already set
+	}
+	return err
+}
+
+func (w *waker) close() error {
+	return closeTraceEBADF(w.fd)
+}
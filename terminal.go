@@ -0,0 +1,144 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+)
+
+// TerminalFlags are the modes of a terminal, which emulate the subset of the
+// termios(3) flags that interactive programs (shells, editors, REPLs) change
+// to read single keystrokes.
+type TerminalFlags uint32
+
+const (
+	// TerminalEcho echoes the characters typed on the terminal (ECHO).
+	TerminalEcho TerminalFlags = 1 << iota
+
+	// TerminalCanonical buffers the input of the terminal until a line
+	// is complete, and interprets the line editing characters (ICANON).
+	TerminalCanonical
+
+	// TerminalSignals generates signals for the interrupt, quit, and
+	// suspend characters, instead of passing them to the reader (ISIG).
+	TerminalSignals
+
+	// TerminalInputProcessing translates carriage returns to newlines and
+	// enables flow control on input (ICRNL and IXON).
+	TerminalInputProcessing
+
+	// TerminalOutputProcessing translates newlines to carriage returns
+	// followed by newlines on output (OPOST).
+	TerminalOutputProcessing
+
+	// TerminalCooked are the flags of a terminal in its default mode.
+	TerminalCooked = TerminalEcho | TerminalCanonical | TerminalSignals | TerminalInputProcessing | TerminalOutputProcessing
+
+	// TerminalRaw are the flags of a terminal in raw mode, where input is
+	// available character by character and neither input nor output is
+	// processed, like cfmakeraw(3).
+	TerminalRaw TerminalFlags = 0
+)
+
+// Has is true if the flag is set. If multiple flags are specified, Has returns
+// true if all flags are set.
+func (flags TerminalFlags) Has(f TerminalFlags) bool {
+	return (flags & f) == f
+}
+
+var terminalFlagsStrings = [...]string{
+	"TerminalEcho",
+	"TerminalCanonical",
+	"TerminalSignals",
+	"TerminalInputProcessing",
+	"TerminalOutputProcessing",
+}
+
+func (flags TerminalFlags) String() (s string) {
+	switch flags {
+	case TerminalRaw:
+		return "TerminalRaw"
+	case TerminalCooked:
+		return "TerminalCooked"
+	}
+	for i, name := range terminalFlagsStrings {
+		if !flags.Has(1 << i) {
+			continue
+		}
+		if len(s) > 0 {
+			s += "|"
+		}
+		s += name
+	}
+	if len(s) == 0 {
+		return fmt.Sprintf("TerminalFlags(%d)", flags)
+	}
+	return
+}
+
+// TerminalSize is the size of a terminal window, in characters.
+type TerminalSize struct {
+	Rows    uint16
+	Columns uint16
+}
+
+func (s TerminalSize) String() string {
+	return fmt.Sprintf("%dx%d", s.Columns, s.Rows)
+}
+
+// Terminal is implemented by systems which give guests control of the
+// terminals that their file descriptors refer to.
+//
+// Changes made to the modes of a terminal affect the terminal of the host,
+// systems must restore the modes that the terminal had when the file
+// descriptor is closed.
+type Terminal interface {
+	// FDTermGet returns the modes of the terminal fd.
+	FDTermGet(ctx context.Context, fd FD) (TerminalFlags, Errno)
+
+	// FDTermSet sets the modes of the terminal fd. The flags that the
+	// system does not emulate are ignored.
+	FDTermSet(ctx context.Context, fd FD, flags TerminalFlags) Errno
+
+	// FDTermSize returns the size of the window of the terminal fd.
+	FDTermSize(ctx context.Context, fd FD) (TerminalSize, Errno)
+}
+
+// FDTermGet returns the modes of the terminal fd.
+//
+// It returns ENOTTY if the system does not implement Terminal, in which case
+// the guest cannot tell whether the file descriptor refers to a terminal.
+func FDTermGet(ctx context.Context, system System, fd FD) (TerminalFlags, Errno) {
+	if t, ok := system.(Terminal); ok {
+		return t.FDTermGet(ctx, fd)
+	}
+	if _, errno := system.FDStatGet(ctx, fd); errno != ESUCCESS {
+		return 0, errno
+	}
+	return 0, ENOTTY
+}
+
+// FDTermSet sets the modes of the terminal fd.
+//
+// It returns ENOTTY if the system does not implement Terminal.
+func FDTermSet(ctx context.Context, system System, fd FD, flags TerminalFlags) Errno {
+	if t, ok := system.(Terminal); ok {
+		return t.FDTermSet(ctx, fd, flags)
+	}
+	if _, errno := system.FDStatGet(ctx, fd); errno != ESUCCESS {
+		return errno
+	}
+	return ENOTTY
+}
+
+// FDTermSize returns the size of the window of the terminal fd.
+//
+// It returns ENOTTY if the system does not implement Terminal.
+func FDTermSize(ctx context.Context, system System, fd FD) (TerminalSize, Errno) {
+	if t, ok := system.(Terminal); ok {
+		return t.FDTermSize(ctx, fd)
+	}
+	if _, errno := system.FDStatGet(ctx, fd); errno != ESUCCESS {
+		return TerminalSize{}, errno
+	}
+	return TerminalSize{}, ENOTTY
+}
@@ -8,8 +8,8 @@ import (
 
 // Trace wraps a System to log all calls to its methods in a human-readable
 // format to the given io.Writer.
-func Trace(w io.Writer, s System) System {
-	return &tracer{writer: w, system: s}
+func Trace(w io.Writer, s System, options ...TraceOption) System {
+	return withTraceOptions(&tracer{writer: w, system: s}, s, options)
 }
 
 type tracer struct {
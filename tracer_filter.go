@@ -0,0 +1,375 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// TraceFilter selects the system calls logged by a tracer.
+//
+// Filters are made of glob patterns (see path.Match) matched against the
+// names of WASI functions, e.g. "fd_read" or "sock_*". Patterns prefixed with
+// "!" exclude the system calls that they match.
+//
+// A system call is traced if it matches at least one of the include patterns
+// (or if there are none) and does not match any of the exclude patterns.
+// The zero value is a filter that traces all system calls.
+type TraceFilter struct {
+	include []string
+	exclude []string
+}
+
+// NewTraceFilter creates a TraceFilter from a list of patterns.
+func NewTraceFilter(patterns ...string) (*TraceFilter, error) {
+	f := new(TraceFilter)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(pattern, "!")
+		if exclude {
+			pattern = pattern[1:]
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid trace filter pattern %q: %w", pattern, err)
+		}
+		if exclude {
+			f.exclude = append(f.exclude, pattern)
+		} else {
+			f.include = append(f.include, pattern)
+		}
+	}
+	return f, nil
+}
+
+// ParseTraceFilter parses a comma-separated list of patterns, for example
+// "fd_*,sock_*,!fd_fdstat_get".
+func ParseTraceFilter(s string) (*TraceFilter, error) {
+	return NewTraceFilter(strings.Split(s, ",")...)
+}
+
+// Match returns true if the system call should be traced.
+func (f *TraceFilter) Match(syscall string) bool {
+	if f == nil {
+		return true
+	}
+	for _, pattern := range f.exclude {
+		if ok, _ := path.Match(pattern, syscall); ok {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if ok, _ := path.Match(pattern, syscall); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// TraceSwitch enables or disables tracers at runtime.
+//
+// The zero value is an enabled switch.
+type TraceSwitch struct {
+	disabled atomic.Bool
+}
+
+// Enable enables the tracers using the switch.
+func (s *TraceSwitch) Enable() { s.disabled.Store(false) }
+
+// Disable disables the tracers using the switch, system calls are passed
+// directly to the underlying system until the switch is enabled again.
+func (s *TraceSwitch) Disable() { s.disabled.Store(true) }
+
+// Enabled returns true if the switch is enabled.
+func (s *TraceSwitch) Enabled() bool {
+	return s == nil || !s.disabled.Load()
+}
+
+// TraceOption configures the tracers returned by Trace and TraceJSON.
+type TraceOption func(*traceOptions)
+
+type traceOptions struct {
+	filter *TraceFilter
+	sw     *TraceSwitch
+}
+
+// WithTraceFilter sets the filter selecting the system calls to trace.
+func WithTraceFilter(filter *TraceFilter) TraceOption {
+	return func(o *traceOptions) { o.filter = filter }
+}
+
+// WithTraceSwitch sets a switch to enable or disable the tracer at runtime.
+func WithTraceSwitch(sw *TraceSwitch) TraceOption {
+	return func(o *traceOptions) { o.sw = sw }
+}
+
+// withTraceOptions applies the options to a tracer wrapping system.
+func withTraceOptions(traced, system System, options []TraceOption) System {
+	var opts traceOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.filter == nil && opts.sw == nil {
+		return traced
+	}
+	return &traceFilter{traced: traced, system: system, filter: opts.filter, sw: opts.sw}
+}
+
+// traceFilter dispatches each call either to the tracer or directly to the
+// underlying system, depending on whether the tracer is enabled and the
+// filter matches the call.
+type traceFilter struct {
+	traced System
+	system System
+	filter *TraceFilter
+	sw     *TraceSwitch
+}
+
+func (f *traceFilter) pick(syscall string) System {
+	if f.sw.Enabled() && f.filter.Match(syscall) {
+		return f.traced
+	}
+	return f.system
+}
+
+func (f *traceFilter) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	return f.pick("args_sizes_get").ArgsSizesGet(ctx)
+}
+
+func (f *traceFilter) ArgsGet(ctx context.Context) ([]string, Errno) {
+	return f.pick("args_get").ArgsGet(ctx)
+}
+
+func (f *traceFilter) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	return f.pick("environ_sizes_get").EnvironSizesGet(ctx)
+}
+
+func (f *traceFilter) EnvironGet(ctx context.Context) ([]string, Errno) {
+	return f.pick("environ_get").EnvironGet(ctx)
+}
+
+func (f *traceFilter) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	return f.pick("clock_res_get").ClockResGet(ctx, id)
+}
+
+func (f *traceFilter) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	return f.pick("clock_time_get").ClockTimeGet(ctx, id, precision)
+}
+
+func (f *traceFilter) FDAdvise(ctx context.Context, fd FD, offset, length FileSize, advice Advice) Errno {
+	return f.pick("fd_advise").FDAdvise(ctx, fd, offset, length, advice)
+}
+
+func (f *traceFilter) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	return f.pick("fd_allocate").FDAllocate(ctx, fd, offset, length)
+}
+
+func (f *traceFilter) FDClose(ctx context.Context, fd FD) Errno {
+	return f.pick("fd_close").FDClose(ctx, fd)
+}
+
+func (f *traceFilter) FDDataSync(ctx context.Context, fd FD) Errno {
+	return f.pick("fd_datasync").FDDataSync(ctx, fd)
+}
+
+func (f *traceFilter) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	return f.pick("fd_fdstat_get").FDStatGet(ctx, fd)
+}
+
+func (f *traceFilter) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	return f.pick("fd_fdstat_set_flags").FDStatSetFlags(ctx, fd, flags)
+}
+
+func (f *traceFilter) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
+	return f.pick("fd_fdstat_set_rights").FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+}
+
+func (f *traceFilter) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	return f.pick("fd_filestat_get").FDFileStatGet(ctx, fd)
+}
+
+func (f *traceFilter) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	return f.pick("fd_filestat_set_size").FDFileStatSetSize(ctx, fd, size)
+}
+
+func (f *traceFilter) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	return f.pick("fd_filestat_set_times").FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+}
+
+func (f *traceFilter) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	return f.pick("fd_pread").FDPread(ctx, fd, iovecs, offset)
+}
+
+func (f *traceFilter) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	return f.pick("fd_prestat_get").FDPreStatGet(ctx, fd)
+}
+
+func (f *traceFilter) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	return f.pick("fd_prestat_dir_name").FDPreStatDirName(ctx, fd)
+}
+
+func (f *traceFilter) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	return f.pick("fd_pwrite").FDPwrite(ctx, fd, iovecs, offset)
+}
+
+func (f *traceFilter) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	return f.pick("fd_read").FDRead(ctx, fd, iovecs)
+}
+
+func (f *traceFilter) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	return f.pick("fd_readdir").FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+}
+
+func (f *traceFilter) FDRenumber(ctx context.Context, from, to FD) Errno {
+	return f.pick("fd_renumber").FDRenumber(ctx, from, to)
+}
+
+func (f *traceFilter) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	return f.pick("fd_seek").FDSeek(ctx, fd, offset, whence)
+}
+
+func (f *traceFilter) FDSync(ctx context.Context, fd FD) Errno {
+	return f.pick("fd_sync").FDSync(ctx, fd)
+}
+
+func (f *traceFilter) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	return f.pick("fd_tell").FDTell(ctx, fd)
+}
+
+func (f *traceFilter) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	return f.pick("fd_write").FDWrite(ctx, fd, iovecs)
+}
+
+func (f *traceFilter) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	return f.pick("path_create_directory").PathCreateDirectory(ctx, fd, path)
+}
+
+func (f *traceFilter) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	return f.pick("path_filestat_get").PathFileStatGet(ctx, fd, lookupFlags, path)
+}
+
+func (f *traceFilter) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	return f.pick("path_filestat_set_times").PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+}
+
+func (f *traceFilter) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	return f.pick("path_link").PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+}
+
+func (f *traceFilter) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	return f.pick("path_open").PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+}
+
+func (f *traceFilter) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	return f.pick("path_readlink").PathReadLink(ctx, fd, path, buffer)
+}
+
+func (f *traceFilter) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	return f.pick("path_remove_directory").PathRemoveDirectory(ctx, fd, path)
+}
+
+func (f *traceFilter) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	return f.pick("path_rename").PathRename(ctx, fd, oldPath, newFD, newPath)
+}
+
+func (f *traceFilter) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	return f.pick("path_symlink").PathSymlink(ctx, oldPath, fd, newPath)
+}
+
+func (f *traceFilter) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	return f.pick("path_unlink_file").PathUnlinkFile(ctx, fd, path)
+}
+
+func (f *traceFilter) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	return f.pick("poll_oneoff").PollOneOff(ctx, subscriptions, events)
+}
+
+func (f *traceFilter) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	return f.pick("proc_exit").ProcExit(ctx, exitCode)
+}
+
+func (f *traceFilter) ProcRaise(ctx context.Context, signal Signal) Errno {
+	return f.pick("proc_raise").ProcRaise(ctx, signal)
+}
+
+func (f *traceFilter) SchedYield(ctx context.Context) Errno {
+	return f.pick("sched_yield").SchedYield(ctx)
+}
+
+func (f *traceFilter) RandomGet(ctx context.Context, b []byte) Errno {
+	return f.pick("random_get").RandomGet(ctx, b)
+}
+
+func (f *traceFilter) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	return f.pick("sock_accept").SockAccept(ctx, fd, flags)
+}
+
+func (f *traceFilter) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	return f.pick("sock_shutdown").SockShutdown(ctx, fd, flags)
+}
+
+func (f *traceFilter) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, Errno) {
+	return f.pick("sock_recv").SockRecv(ctx, fd, iovecs, iflags)
+}
+
+func (f *traceFilter) SockSend(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags) (Size, Errno) {
+	return f.pick("sock_send").SockSend(ctx, fd, iovecs, iflags)
+}
+
+func (f *traceFilter) SockOpen(ctx context.Context, pf ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	return f.pick("sock_open").SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+}
+
+func (f *traceFilter) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	return f.pick("sock_bind").SockBind(ctx, fd, addr)
+}
+
+func (f *traceFilter) SockConnect(ctx context.Context, fd FD, peer SocketAddress) (SocketAddress, Errno) {
+	return f.pick("sock_connect").SockConnect(ctx, fd, peer)
+}
+
+func (f *traceFilter) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	return f.pick("sock_listen").SockListen(ctx, fd, backlog)
+}
+
+func (f *traceFilter) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags, addr SocketAddress) (Size, Errno) {
+	return f.pick("sock_send_to").SockSendTo(ctx, fd, iovecs, iflags, addr)
+}
+
+func (f *traceFilter) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	return f.pick("sock_recv_from").SockRecvFrom(ctx, fd, iovecs, iflags)
+}
+
+func (f *traceFilter) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	return f.pick("sock_getsockopt").SockGetOpt(ctx, fd, option)
+}
+
+func (f *traceFilter) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	return f.pick("sock_setsockopt").SockSetOpt(ctx, fd, option, value)
+}
+
+func (f *traceFilter) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	return f.pick("sock_getlocaladdr").SockLocalAddress(ctx, fd)
+}
+
+func (f *traceFilter) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	return f.pick("sock_getpeeraddr").SockRemoteAddress(ctx, fd)
+}
+
+func (f *traceFilter) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	return f.pick("sock_getaddrinfo").SockAddressInfo(ctx, name, service, hints, results)
+}
+
+func (f *traceFilter) Close(ctx context.Context) error {
+	if !f.sw.Enabled() {
+		return f.system.Close(ctx)
+	}
+	return f.traced.Close(ctx)
+}
@@ -0,0 +1,585 @@
+package wasi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// TraceJSON wraps a System to log all calls to its methods to the given
+// io.Writer, as a stream of JSON objects (one per line) suitable for machine
+// analysis.
+//
+// Each object has the following fields:
+//
+//	{
+//	  "time":     "<RFC 3339 timestamp of the call>",
+//	  "syscall":  "<name of the WASI function, e.g. fd_read>",
+//	  "args":     {...},
+//	  "result":   {...},
+//	  "errno":    "<ESUCCESS, EBADF, ...>",
+//	  "duration": <duration of the call in nanoseconds>
+//	}
+//
+// The result field is omitted when the call returned an error.
+func TraceJSON(w io.Writer, s System, options ...TraceOption) System {
+	return withTraceOptions(&jsonTracer{encoder: json.NewEncoder(w), system: s}, s, options)
+}
+
+type jsonTracer struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	system  System
+}
+
+type jsonTraceRecord struct {
+	Time     time.Time      `json:"time"`
+	Syscall  string         `json:"syscall"`
+	Args     map[string]any `json:"args,omitempty"`
+	Result   map[string]any `json:"result,omitempty"`
+	Errno    string         `json:"errno"`
+	Duration time.Duration  `json:"duration"`
+}
+
+type jsonArgs = map[string]any
+
+func (t *jsonTracer) trace(start time.Time, syscall string, errno Errno, args, result jsonArgs) {
+	record := jsonTraceRecord{
+		Time:     start,
+		Syscall:  syscall,
+		Args:     args,
+		Errno:    errno.Name(),
+		Duration: time.Since(start),
+	}
+	if errno == ESUCCESS {
+		record.Result = result
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_ = t.encoder.Encode(&record)
+}
+
+func (t *jsonTracer) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	start := time.Now()
+	argCount, stringBytes, errno := t.system.ArgsSizesGet(ctx)
+	t.trace(start, "args_sizes_get", errno, nil, jsonArgs{"count": argCount, "size": stringBytes})
+	return argCount, stringBytes, errno
+}
+
+func (t *jsonTracer) ArgsGet(ctx context.Context) ([]string, Errno) {
+	start := time.Now()
+	args, errno := t.system.ArgsGet(ctx)
+	t.trace(start, "args_get", errno, nil, jsonArgs{"args": args})
+	return args, errno
+}
+
+func (t *jsonTracer) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	start := time.Now()
+	envCount, stringBytes, errno := t.system.EnvironSizesGet(ctx)
+	t.trace(start, "environ_sizes_get", errno, nil, jsonArgs{"count": envCount, "size": stringBytes})
+	return envCount, stringBytes, errno
+}
+
+func (t *jsonTracer) EnvironGet(ctx context.Context) ([]string, Errno) {
+	start := time.Now()
+	environ, errno := t.system.EnvironGet(ctx)
+	t.trace(start, "environ_get", errno, nil, jsonArgs{"environ": environ})
+	return environ, errno
+}
+
+func (t *jsonTracer) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	start := time.Now()
+	precision, errno := t.system.ClockResGet(ctx, id)
+	t.trace(start, "clock_res_get", errno, jsonArgs{"id": id.String()}, jsonArgs{"precision": precision})
+	return precision, errno
+}
+
+func (t *jsonTracer) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	start := time.Now()
+	timestamp, errno := t.system.ClockTimeGet(ctx, id, precision)
+	t.trace(start, "clock_time_get", errno, jsonArgs{"id": id.String(), "precision": precision}, jsonArgs{"timestamp": timestamp})
+	return timestamp, errno
+}
+
+func (t *jsonTracer) FDAdvise(ctx context.Context, fd FD, offset, length FileSize, advice Advice) Errno {
+	start := time.Now()
+	errno := t.system.FDAdvise(ctx, fd, offset, length, advice)
+	t.trace(start, "fd_advise", errno, jsonArgs{"fd": fd, "offset": offset, "length": length, "advice": advice.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	start := time.Now()
+	errno := t.system.FDAllocate(ctx, fd, offset, length)
+	t.trace(start, "fd_allocate", errno, jsonArgs{"fd": fd, "offset": offset, "length": length}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDClose(ctx context.Context, fd FD) Errno {
+	start := time.Now()
+	errno := t.system.FDClose(ctx, fd)
+	t.trace(start, "fd_close", errno, jsonArgs{"fd": fd}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDDataSync(ctx context.Context, fd FD) Errno {
+	start := time.Now()
+	errno := t.system.FDDataSync(ctx, fd)
+	t.trace(start, "fd_datasync", errno, jsonArgs{"fd": fd}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	start := time.Now()
+	fdstat, errno := t.system.FDStatGet(ctx, fd)
+	t.trace(start, "fd_fdstat_get", errno, jsonArgs{"fd": fd}, jsonArgs{"stat": jsonFDStat(fdstat)})
+	return fdstat, errno
+}
+
+func (t *jsonTracer) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	start := time.Now()
+	errno := t.system.FDStatSetFlags(ctx, fd, flags)
+	t.trace(start, "fd_fdstat_set_flags", errno, jsonArgs{"fd": fd, "flags": flags.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
+	start := time.Now()
+	errno := t.system.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	t.trace(start, "fd_fdstat_set_rights", errno, jsonArgs{"fd": fd, "rightsBase": rightsBase.String(), "rightsInheriting": rightsInheriting.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	start := time.Now()
+	filestat, errno := t.system.FDFileStatGet(ctx, fd)
+	t.trace(start, "fd_filestat_get", errno, jsonArgs{"fd": fd}, jsonArgs{"stat": jsonFileStat(filestat)})
+	return filestat, errno
+}
+
+func (t *jsonTracer) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	start := time.Now()
+	errno := t.system.FDFileStatSetSize(ctx, fd, size)
+	t.trace(start, "fd_filestat_set_size", errno, jsonArgs{"fd": fd, "size": size}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	start := time.Now()
+	errno := t.system.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	t.trace(start, "fd_filestat_set_times", errno, jsonArgs{"fd": fd, "accessTime": accessTime, "modifyTime": modifyTime, "flags": flags.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	start := time.Now()
+	n, errno := t.system.FDPread(ctx, fd, iovecs, offset)
+	t.trace(start, "fd_pread", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs), "offset": offset}, jsonArgs{"size": n})
+	return n, errno
+}
+
+func (t *jsonTracer) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	start := time.Now()
+	prestat, errno := t.system.FDPreStatGet(ctx, fd)
+	t.trace(start, "fd_prestat_get", errno, jsonArgs{"fd": fd}, jsonArgs{"type": prestat.Type.String(), "nameLength": prestat.PreStatDir.NameLength})
+	return prestat, errno
+}
+
+func (t *jsonTracer) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	start := time.Now()
+	name, errno := t.system.FDPreStatDirName(ctx, fd)
+	t.trace(start, "fd_prestat_dir_name", errno, jsonArgs{"fd": fd}, jsonArgs{"name": name})
+	return name, errno
+}
+
+func (t *jsonTracer) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	start := time.Now()
+	n, errno := t.system.FDPwrite(ctx, fd, iovecs, offset)
+	t.trace(start, "fd_pwrite", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs), "offset": offset}, jsonArgs{"size": n})
+	return n, errno
+}
+
+func (t *jsonTracer) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	start := time.Now()
+	n, errno := t.system.FDRead(ctx, fd, iovecs)
+	t.trace(start, "fd_read", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs)}, jsonArgs{"size": n})
+	return n, errno
+}
+
+func (t *jsonTracer) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	start := time.Now()
+	n, errno := t.system.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	var names []string
+	if errno == ESUCCESS {
+		names = make([]string, n)
+		for i, e := range entries[:n] {
+			names[i] = string(e.Name)
+		}
+	}
+	t.trace(start, "fd_readdir", errno, jsonArgs{"fd": fd, "entries": len(entries), "cookie": cookie, "bufferSize": bufferSizeBytes}, jsonArgs{"count": n, "names": names})
+	return n, errno
+}
+
+func (t *jsonTracer) FDRenumber(ctx context.Context, from, to FD) Errno {
+	start := time.Now()
+	errno := t.system.FDRenumber(ctx, from, to)
+	t.trace(start, "fd_renumber", errno, jsonArgs{"from": from, "to": to}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	start := time.Now()
+	result, errno := t.system.FDSeek(ctx, fd, offset, whence)
+	t.trace(start, "fd_seek", errno, jsonArgs{"fd": fd, "offset": offset, "whence": whence.String()}, jsonArgs{"offset": result})
+	return result, errno
+}
+
+func (t *jsonTracer) FDSync(ctx context.Context, fd FD) Errno {
+	start := time.Now()
+	errno := t.system.FDSync(ctx, fd)
+	t.trace(start, "fd_sync", errno, jsonArgs{"fd": fd}, nil)
+	return errno
+}
+
+func (t *jsonTracer) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	start := time.Now()
+	result, errno := t.system.FDTell(ctx, fd)
+	t.trace(start, "fd_tell", errno, jsonArgs{"fd": fd}, jsonArgs{"offset": result})
+	return result, errno
+}
+
+func (t *jsonTracer) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	start := time.Now()
+	n, errno := t.system.FDWrite(ctx, fd, iovecs)
+	t.trace(start, "fd_write", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs)}, jsonArgs{"size": n})
+	return n, errno
+}
+
+func (t *jsonTracer) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	start := time.Now()
+	errno := t.system.PathCreateDirectory(ctx, fd, path)
+	t.trace(start, "path_create_directory", errno, jsonArgs{"fd": fd, "path": path}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	start := time.Now()
+	filestat, errno := t.system.PathFileStatGet(ctx, fd, lookupFlags, path)
+	t.trace(start, "path_filestat_get", errno, jsonArgs{"fd": fd, "lookupFlags": lookupFlags.String(), "path": path}, jsonArgs{"stat": jsonFileStat(filestat)})
+	return filestat, errno
+}
+
+func (t *jsonTracer) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	start := time.Now()
+	errno := t.system.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	t.trace(start, "path_filestat_set_times", errno, jsonArgs{"fd": fd, "lookupFlags": lookupFlags.String(), "path": path, "accessTime": accessTime, "modifyTime": modifyTime, "flags": flags.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	start := time.Now()
+	errno := t.system.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	t.trace(start, "path_link", errno, jsonArgs{"oldFD": oldFD, "oldFlags": oldFlags.String(), "oldPath": oldPath, "newFD": newFD, "newPath": newPath}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	start := time.Now()
+	newfd, errno := t.system.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	t.trace(start, "path_open", errno, jsonArgs{"fd": fd, "dirFlags": dirFlags.String(), "path": path, "openFlags": openFlags.String(), "rightsBase": rightsBase.String(), "rightsInheriting": rightsInheriting.String(), "fdFlags": fdFlags.String()}, jsonArgs{"fd": newfd})
+	return newfd, errno
+}
+
+func (t *jsonTracer) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	start := time.Now()
+	n, errno := t.system.PathReadLink(ctx, fd, path, buffer)
+	var link string
+	if errno == ESUCCESS {
+		link = string(buffer[:n])
+	}
+	t.trace(start, "path_readlink", errno, jsonArgs{"fd": fd, "path": path, "bufferSize": len(buffer)}, jsonArgs{"link": link})
+	return n, errno
+}
+
+func (t *jsonTracer) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	start := time.Now()
+	errno := t.system.PathRemoveDirectory(ctx, fd, path)
+	t.trace(start, "path_remove_directory", errno, jsonArgs{"fd": fd, "path": path}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	start := time.Now()
+	errno := t.system.PathRename(ctx, fd, oldPath, newFD, newPath)
+	t.trace(start, "path_rename", errno, jsonArgs{"fd": fd, "oldPath": oldPath, "newFD": newFD, "newPath": newPath}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	start := time.Now()
+	errno := t.system.PathSymlink(ctx, oldPath, fd, newPath)
+	t.trace(start, "path_symlink", errno, jsonArgs{"oldPath": oldPath, "fd": fd, "newPath": newPath}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	start := time.Now()
+	errno := t.system.PathUnlinkFile(ctx, fd, path)
+	t.trace(start, "path_unlink_file", errno, jsonArgs{"fd": fd, "path": path}, nil)
+	return errno
+}
+
+func (t *jsonTracer) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	start := time.Now()
+	n, errno := t.system.PollOneOff(ctx, subscriptions, events)
+	subs := make([]jsonArgs, len(subscriptions))
+	for i, s := range subscriptions {
+		subs[i] = jsonSubscription(s)
+	}
+	var evs []jsonArgs
+	if errno == ESUCCESS {
+		evs = make([]jsonArgs, n)
+		for i, e := range events[:n] {
+			evs[i] = jsonEvent(e)
+		}
+	}
+	t.trace(start, "poll_oneoff", errno, jsonArgs{"subscriptions": subs}, jsonArgs{"events": evs})
+	return n, errno
+}
+
+func (t *jsonTracer) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	start := time.Now()
+	// ProcExit is not expected to return, the record is emitted before
+	// calling the underlying system.
+	t.trace(start, "proc_exit", ESUCCESS, jsonArgs{"exitCode": exitCode}, nil)
+	return t.system.ProcExit(ctx, exitCode)
+}
+
+func (t *jsonTracer) ProcRaise(ctx context.Context, signal Signal) Errno {
+	start := time.Now()
+	errno := t.system.ProcRaise(ctx, signal)
+	t.trace(start, "proc_raise", errno, jsonArgs{"signal": signal.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) SchedYield(ctx context.Context) Errno {
+	start := time.Now()
+	errno := t.system.SchedYield(ctx)
+	t.trace(start, "sched_yield", errno, nil, nil)
+	return errno
+}
+
+func (t *jsonTracer) RandomGet(ctx context.Context, b []byte) Errno {
+	start := time.Now()
+	errno := t.system.RandomGet(ctx, b)
+	t.trace(start, "random_get", errno, jsonArgs{"size": len(b)}, nil)
+	return errno
+}
+
+func (t *jsonTracer) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	start := time.Now()
+	newfd, peer, addr, errno := t.system.SockAccept(ctx, fd, flags)
+	t.trace(start, "sock_accept", errno, jsonArgs{"fd": fd, "flags": flags.String()}, jsonArgs{"fd": newfd, "peer": jsonAddress(peer), "addr": jsonAddress(addr)})
+	return newfd, peer, addr, errno
+}
+
+func (t *jsonTracer) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	start := time.Now()
+	errno := t.system.SockShutdown(ctx, fd, flags)
+	t.trace(start, "sock_shutdown", errno, jsonArgs{"fd": fd, "flags": flags.String()}, nil)
+	return errno
+}
+
+func (t *jsonTracer) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, Errno) {
+	start := time.Now()
+	n, oflags, errno := t.system.SockRecv(ctx, fd, iovecs, iflags)
+	t.trace(start, "sock_recv", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs), "flags": iflags.String()}, jsonArgs{"size": n, "flags": oflags.String()})
+	return n, oflags, errno
+}
+
+func (t *jsonTracer) SockSend(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags) (Size, Errno) {
+	start := time.Now()
+	n, errno := t.system.SockSend(ctx, fd, iovecs, iflags)
+	t.trace(start, "sock_send", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs), "flags": iflags.String()}, jsonArgs{"size": n})
+	return n, errno
+}
+
+func (t *jsonTracer) SockOpen(ctx context.Context, pf ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	start := time.Now()
+	fd, errno := t.system.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	t.trace(start, "sock_open", errno, jsonArgs{"family": pf.String(), "type": socketType.String(), "protocol": protocol.String(), "rightsBase": rightsBase.String(), "rightsInheriting": rightsInheriting.String()}, jsonArgs{"fd": fd})
+	return fd, errno
+}
+
+func (t *jsonTracer) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	start := time.Now()
+	result, errno := t.system.SockBind(ctx, fd, addr)
+	t.trace(start, "sock_bind", errno, jsonArgs{"fd": fd, "addr": jsonAddress(addr)}, jsonArgs{"addr": jsonAddress(result)})
+	return result, errno
+}
+
+func (t *jsonTracer) SockConnect(ctx context.Context, fd FD, peer SocketAddress) (SocketAddress, Errno) {
+	start := time.Now()
+	addr, errno := t.system.SockConnect(ctx, fd, peer)
+	t.trace(start, "sock_connect", errno, jsonArgs{"fd": fd, "peer": jsonAddress(peer)}, jsonArgs{"addr": jsonAddress(addr)})
+	return addr, errno
+}
+
+func (t *jsonTracer) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	start := time.Now()
+	errno := t.system.SockListen(ctx, fd, backlog)
+	t.trace(start, "sock_listen", errno, jsonArgs{"fd": fd, "backlog": backlog}, nil)
+	return errno
+}
+
+func (t *jsonTracer) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags, addr SocketAddress) (Size, Errno) {
+	start := time.Now()
+	n, errno := t.system.SockSendTo(ctx, fd, iovecs, iflags, addr)
+	t.trace(start, "sock_send_to", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs), "flags": iflags.String(), "addr": jsonAddress(addr)}, jsonArgs{"size": n})
+	return n, errno
+}
+
+func (t *jsonTracer) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	start := time.Now()
+	n, oflags, addr, errno := t.system.SockRecvFrom(ctx, fd, iovecs, iflags)
+	t.trace(start, "sock_recv_from", errno, jsonArgs{"fd": fd, "iovecs": jsonIOVecs(iovecs), "flags": iflags.String()}, jsonArgs{"size": n, "flags": oflags.String(), "addr": jsonAddress(addr)})
+	return n, oflags, addr, errno
+}
+
+func (t *jsonTracer) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	start := time.Now()
+	value, errno := t.system.SockGetOpt(ctx, fd, option)
+	t.trace(start, "sock_getsockopt", errno, jsonArgs{"fd": fd, "option": option.String()}, jsonArgs{"value": jsonOptionValue(value)})
+	return value, errno
+}
+
+func (t *jsonTracer) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	start := time.Now()
+	errno := t.system.SockSetOpt(ctx, fd, option, value)
+	t.trace(start, "sock_setsockopt", errno, jsonArgs{"fd": fd, "option": option.String(), "value": jsonOptionValue(value)}, nil)
+	return errno
+}
+
+func (t *jsonTracer) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	start := time.Now()
+	addr, errno := t.system.SockLocalAddress(ctx, fd)
+	t.trace(start, "sock_getlocaladdr", errno, jsonArgs{"fd": fd}, jsonArgs{"addr": jsonAddress(addr)})
+	return addr, errno
+}
+
+func (t *jsonTracer) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	start := time.Now()
+	addr, errno := t.system.SockRemoteAddress(ctx, fd)
+	t.trace(start, "sock_getpeeraddr", errno, jsonArgs{"fd": fd}, jsonArgs{"addr": jsonAddress(addr)})
+	return addr, errno
+}
+
+func (t *jsonTracer) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	start := time.Now()
+	n, errno := t.system.SockAddressInfo(ctx, name, service, hints, results)
+	var infos []jsonArgs
+	if errno == ESUCCESS {
+		infos = make([]jsonArgs, n)
+		for i, info := range results[:n] {
+			infos[i] = jsonAddressInfo(info)
+		}
+	}
+	t.trace(start, "sock_getaddrinfo", errno, jsonArgs{"name": name, "service": service, "hints": jsonAddressInfo(hints), "results": len(results)}, jsonArgs{"results": infos})
+	return n, errno
+}
+
+func (t *jsonTracer) Close(ctx context.Context) error {
+	return t.system.Close(ctx)
+}
+
+func jsonIOVecs(iovecs []IOVec) []int {
+	sizes := make([]int, len(iovecs))
+	for i, iovec := range iovecs {
+		sizes[i] = len(iovec)
+	}
+	return sizes
+}
+
+func jsonFDStat(s FDStat) jsonArgs {
+	return jsonArgs{
+		"fileType":         s.FileType.String(),
+		"flags":            s.Flags.String(),
+		"rightsBase":       s.RightsBase.String(),
+		"rightsInheriting": s.RightsInheriting.String(),
+	}
+}
+
+func jsonFileStat(s FileStat) jsonArgs {
+	return jsonArgs{
+		"device":     s.Device,
+		"inode":      s.INode,
+		"fileType":   s.FileType.String(),
+		"nlink":      s.NLink,
+		"size":       s.Size,
+		"accessTime": s.AccessTime,
+		"modifyTime": s.ModifyTime,
+		"changeTime": s.ChangeTime,
+	}
+}
+
+func jsonSubscription(s Subscription) jsonArgs {
+	sub := jsonArgs{
+		"userData":  s.UserData,
+		"eventType": s.EventType.String(),
+	}
+	if s.EventType == ClockEvent {
+		c := s.GetClock()
+		sub["id"] = c.ID.String()
+		sub["timeout"] = c.Timeout
+		sub["precision"] = c.Precision
+		sub["flags"] = c.Flags.String()
+	} else {
+		sub["fd"] = s.GetFDReadWrite().FD
+	}
+	return sub
+}
+
+func jsonEvent(e Event) jsonArgs {
+	event := jsonArgs{
+		"userData":  e.UserData,
+		"eventType": e.EventType.String(),
+		"errno":     e.Errno.Name(),
+	}
+	if e.EventType != ClockEvent {
+		event["nbytes"] = e.FDReadWrite.NBytes
+		event["flags"] = e.FDReadWrite.Flags.String()
+	}
+	return event
+}
+
+func jsonAddress(addr SocketAddress) any {
+	if addr == nil {
+		return nil
+	}
+	return addr.String()
+}
+
+func jsonAddressInfo(a AddressInfo) jsonArgs {
+	info := jsonArgs{
+		"flags":      a.Flags.String(),
+		"family":     a.Family.String(),
+		"socketType": a.SocketType.String(),
+		"protocol":   a.Protocol.String(),
+	}
+	if a.Address != nil {
+		info["address"] = a.Address.String()
+	}
+	if a.CanonicalName != "" {
+		info["canonicalName"] = a.CanonicalName
+	}
+	return info
+}
+
+func jsonOptionValue(value SocketOptionValue) any {
+	if value == nil {
+		return nil
+	}
+	return value.String()
+}
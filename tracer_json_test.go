@@ -0,0 +1,128 @@
+package wasi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+var updateTraceJSON = flag.Bool("update", false, "update the golden file of TestTraceJSON")
+
+func TestTraceJSON(t *testing.T) {
+	ctx := context.Background()
+	system := Intercept(nil, Hooks{
+		Before: func(ctx context.Context, call *Call) {
+			switch call.Syscall {
+			case "args_get":
+				call.Return(ESUCCESS, []string{"app", "-v"})
+			case "clock_time_get":
+				call.Return(ESUCCESS, Timestamp(42))
+			case "path_open":
+				if call.Args[2] == "missing" {
+					call.Return(ENOENT)
+				} else {
+					call.Return(ESUCCESS, FD(4))
+				}
+			case "fd_write":
+				call.Return(ESUCCESS, Size(11))
+			case "fd_read":
+				call.Return(EBADF)
+			case "fd_filestat_get":
+				call.Return(ESUCCESS, FileStat{
+					Device:     1,
+					INode:      2,
+					FileType:   RegularFileType,
+					NLink:      1,
+					Size:       11,
+					AccessTime: 3,
+					ModifyTime: 4,
+					ChangeTime: 5,
+				})
+			case "poll_oneoff":
+				events := call.Args[1].([]Event)
+				events[0] = Event{
+					UserData:    2,
+					EventType:   FDReadEvent,
+					FDReadWrite: EventFDReadWrite{NBytes: 5},
+				}
+				call.Return(ESUCCESS, 1)
+			case "sock_accept":
+				call.Return(ESUCCESS, FD(7),
+					&Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: 52000},
+					&Inet4Address{Addr: [4]byte{127, 0, 0, 1}, Port: 8080})
+			case "sock_connect":
+				call.Return(ECONNREFUSED)
+			default:
+				call.Return(ENOSYS)
+			}
+		},
+	})
+
+	trace := new(bytes.Buffer)
+	s := TraceJSON(trace, system)
+	s.ArgsGet(ctx)
+	s.ClockTimeGet(ctx, Monotonic, 1)
+	s.PathOpen(ctx, 3, SymlinkFollow, "data.txt", OpenCreate|OpenTruncate, FDReadRight|FDWriteRight, 0, Append)
+	s.PathOpen(ctx, 3, 0, "missing", 0, FDReadRight, 0, 0)
+	s.FDWrite(ctx, 4, []IOVec{[]byte("Hello, "), []byte("World")})
+	s.FDRead(ctx, 5, []IOVec{make([]byte, 8)})
+	s.FDFileStatGet(ctx, 4)
+	s.PollOneOff(ctx, []Subscription{
+		MakeSubscriptionClock(1, SubscriptionClock{ID: Monotonic, Timeout: 1e9, Precision: 1e3}),
+		MakeSubscriptionFDReadWrite(2, FDReadEvent, SubscriptionFDReadWrite{FD: 4}),
+	}, make([]Event, 2))
+	s.SockAccept(ctx, 6, NonBlock)
+	s.SockConnect(ctx, 7, &Inet6Address{Addr: [16]byte{15: 1}, Port: 443})
+	s.SchedYield(ctx)
+
+	// The time and duration of calls vary between runs, so they are removed
+	// from the trace compared to the golden file.
+	got := new(bytes.Buffer)
+	scanner := bufio.NewScanner(trace)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%s: %v", scanner.Bytes(), err)
+		}
+		for _, field := range []string{"time", "duration"} {
+			if _, ok := record[field]; !ok {
+				t.Errorf("%s: missing %q field", scanner.Bytes(), field)
+			}
+			delete(record, field)
+		}
+		b, _ := json.Marshal(record)
+		got.Write(b)
+		got.WriteByte('\n')
+	}
+
+	const golden = "testdata/trace.json"
+	if *updateTraceJSON {
+		if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(got.String(), "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			t.Fatalf("%s:%d: the trace differs from the golden file (run with -update to regenerate it)\nwant = %s\ngot  = %s", golden, i+1, w, g)
+		}
+	}
+}
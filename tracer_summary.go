@@ -0,0 +1,537 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyscallSummary accumulates the number of calls, errors, and the time spent
+// in each system call of a System wrapped by Summarize.
+//
+// It is safe to read the summary while the system is in use.
+type SyscallSummary struct {
+	mutex sync.Mutex
+	stats map[string]*SyscallStats
+}
+
+// SyscallStats are the statistics collected for a system call.
+type SyscallStats struct {
+	// Syscall is the name of the WASI function, e.g. fd_read.
+	Syscall string
+	// Calls is the number of times the system call was made.
+	Calls int
+	// Errors is the number of calls which returned an error.
+	Errors int
+	// Time is the total time spent in the system call.
+	Time time.Duration
+}
+
+func (s *SyscallSummary) add(syscall string, duration time.Duration, errno Errno) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stats == nil {
+		s.stats = make(map[string]*SyscallStats)
+	}
+	stats := s.stats[syscall]
+	if stats == nil {
+		stats = &SyscallStats{Syscall: syscall}
+		s.stats[syscall] = stats
+	}
+	stats.Calls++
+	stats.Time += duration
+	if errno != ESUCCESS {
+		stats.Errors++
+	}
+}
+
+// Stats returns the statistics of the system calls made so far, sorted by
+// decreasing time spent.
+func (s *SyscallSummary) Stats() []SyscallStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make([]SyscallStats, 0, len(s.stats))
+	for _, st := range s.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Time != stats[j].Time {
+			return stats[i].Time > stats[j].Time
+		}
+		return stats[i].Syscall < stats[j].Syscall
+	})
+	return stats
+}
+
+// WriteTo writes the summary to w as a table similar to the one printed by
+// strace -c.
+func (s *SyscallSummary) WriteTo(w io.Writer) (int64, error) {
+	const separator = "------ ----------- ----------- --------- --------- ----------------\n"
+
+	stats := s.Stats()
+	var total SyscallStats
+	for _, st := range stats {
+		total.Calls += st.Calls
+		total.Errors += st.Errors
+		total.Time += st.Time
+	}
+
+	var n int64
+	printf := func(format string, args ...any) error {
+		c, err := fmt.Fprintf(w, format, args...)
+		n += int64(c)
+		return err
+	}
+	if err := printf("%% time     seconds  usecs/call     calls    errors syscall\n" + separator); err != nil {
+		return n, err
+	}
+	for _, st := range stats {
+		percent := 0.0
+		if total.Time > 0 {
+			percent = 100 * float64(st.Time) / float64(total.Time)
+		}
+		usecs := st.Time.Microseconds() / int64(st.Calls)
+		if err := printf("%6.2f %11.6f %11d %9d %9s %s\n", percent, st.Time.Seconds(), usecs, st.Calls, errorCount(st.Errors), st.Syscall); err != nil {
+			return n, err
+		}
+	}
+	if err := printf(separator+"100.00 %11.6f %11s %9d %9s total\n", total.Time.Seconds(), "", total.Calls, errorCount(total.Errors)); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func errorCount(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprint(n)
+}
+
+// Summarize wraps a System to count the calls to its methods in summary.
+func Summarize(s System, summary *SyscallSummary) System {
+	return &summarizer{system: s, summary: summary}
+}
+
+// TraceSummary wraps a System to count the calls to its methods, and write
+// a summary table of the system calls to the given io.Writer when the
+// System is closed (like strace -c).
+func TraceSummary(w io.Writer, s System, options ...TraceOption) System {
+	return withTraceOptions(&summarizer{system: s, summary: new(SyscallSummary), writer: w}, s, options)
+}
+
+type summarizer struct {
+	system  System
+	summary *SyscallSummary
+	writer  io.Writer
+}
+
+func (s *summarizer) ArgsSizesGet(ctx context.Context) (int, int, Errno) {
+	start := time.Now()
+	argCount, stringBytes, errno := s.system.ArgsSizesGet(ctx)
+	s.summary.add("args_sizes_get", time.Since(start), errno)
+	return argCount, stringBytes, errno
+}
+
+func (s *summarizer) ArgsGet(ctx context.Context) ([]string, Errno) {
+	start := time.Now()
+	args, errno := s.system.ArgsGet(ctx)
+	s.summary.add("args_get", time.Since(start), errno)
+	return args, errno
+}
+
+func (s *summarizer) EnvironSizesGet(ctx context.Context) (int, int, Errno) {
+	start := time.Now()
+	envCount, stringBytes, errno := s.system.EnvironSizesGet(ctx)
+	s.summary.add("environ_sizes_get", time.Since(start), errno)
+	return envCount, stringBytes, errno
+}
+
+func (s *summarizer) EnvironGet(ctx context.Context) ([]string, Errno) {
+	start := time.Now()
+	environ, errno := s.system.EnvironGet(ctx)
+	s.summary.add("environ_get", time.Since(start), errno)
+	return environ, errno
+}
+
+func (s *summarizer) ClockResGet(ctx context.Context, id ClockID) (Timestamp, Errno) {
+	start := time.Now()
+	precision, errno := s.system.ClockResGet(ctx, id)
+	s.summary.add("clock_res_get", time.Since(start), errno)
+	return precision, errno
+}
+
+func (s *summarizer) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	start := time.Now()
+	timestamp, errno := s.system.ClockTimeGet(ctx, id, precision)
+	s.summary.add("clock_time_get", time.Since(start), errno)
+	return timestamp, errno
+}
+
+func (s *summarizer) FDAdvise(ctx context.Context, fd FD, offset, length FileSize, advice Advice) Errno {
+	start := time.Now()
+	errno := s.system.FDAdvise(ctx, fd, offset, length, advice)
+	s.summary.add("fd_advise", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDAllocate(ctx context.Context, fd FD, offset, length FileSize) Errno {
+	start := time.Now()
+	errno := s.system.FDAllocate(ctx, fd, offset, length)
+	s.summary.add("fd_allocate", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDClose(ctx context.Context, fd FD) Errno {
+	start := time.Now()
+	errno := s.system.FDClose(ctx, fd)
+	s.summary.add("fd_close", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDDataSync(ctx context.Context, fd FD) Errno {
+	start := time.Now()
+	errno := s.system.FDDataSync(ctx, fd)
+	s.summary.add("fd_datasync", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	start := time.Now()
+	fdstat, errno := s.system.FDStatGet(ctx, fd)
+	s.summary.add("fd_fdstat_get", time.Since(start), errno)
+	return fdstat, errno
+}
+
+func (s *summarizer) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
+	start := time.Now()
+	errno := s.system.FDStatSetFlags(ctx, fd, flags)
+	s.summary.add("fd_fdstat_set_flags", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
+	start := time.Now()
+	errno := s.system.FDStatSetRights(ctx, fd, rightsBase, rightsInheriting)
+	s.summary.add("fd_fdstat_set_rights", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDFileStatGet(ctx context.Context, fd FD) (FileStat, Errno) {
+	start := time.Now()
+	filestat, errno := s.system.FDFileStatGet(ctx, fd)
+	s.summary.add("fd_filestat_get", time.Since(start), errno)
+	return filestat, errno
+}
+
+func (s *summarizer) FDFileStatSetSize(ctx context.Context, fd FD, size FileSize) Errno {
+	start := time.Now()
+	errno := s.system.FDFileStatSetSize(ctx, fd, size)
+	s.summary.add("fd_filestat_set_size", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDFileStatSetTimes(ctx context.Context, fd FD, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	start := time.Now()
+	errno := s.system.FDFileStatSetTimes(ctx, fd, accessTime, modifyTime, flags)
+	s.summary.add("fd_filestat_set_times", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	start := time.Now()
+	n, errno := s.system.FDPread(ctx, fd, iovecs, offset)
+	s.summary.add("fd_pread", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) FDPreStatGet(ctx context.Context, fd FD) (PreStat, Errno) {
+	start := time.Now()
+	prestat, errno := s.system.FDPreStatGet(ctx, fd)
+	s.summary.add("fd_prestat_get", time.Since(start), errno)
+	return prestat, errno
+}
+
+func (s *summarizer) FDPreStatDirName(ctx context.Context, fd FD) (string, Errno) {
+	start := time.Now()
+	name, errno := s.system.FDPreStatDirName(ctx, fd)
+	s.summary.add("fd_prestat_dir_name", time.Since(start), errno)
+	return name, errno
+}
+
+func (s *summarizer) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	start := time.Now()
+	n, errno := s.system.FDPwrite(ctx, fd, iovecs, offset)
+	s.summary.add("fd_pwrite", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	start := time.Now()
+	n, errno := s.system.FDRead(ctx, fd, iovecs)
+	s.summary.add("fd_read", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) FDReadDir(ctx context.Context, fd FD, entries []DirEntry, cookie DirCookie, bufferSizeBytes int) (int, Errno) {
+	start := time.Now()
+	n, errno := s.system.FDReadDir(ctx, fd, entries, cookie, bufferSizeBytes)
+	s.summary.add("fd_readdir", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) FDRenumber(ctx context.Context, from, to FD) Errno {
+	start := time.Now()
+	errno := s.system.FDRenumber(ctx, from, to)
+	s.summary.add("fd_renumber", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDSeek(ctx context.Context, fd FD, offset FileDelta, whence Whence) (FileSize, Errno) {
+	start := time.Now()
+	result, errno := s.system.FDSeek(ctx, fd, offset, whence)
+	s.summary.add("fd_seek", time.Since(start), errno)
+	return result, errno
+}
+
+func (s *summarizer) FDSync(ctx context.Context, fd FD) Errno {
+	start := time.Now()
+	errno := s.system.FDSync(ctx, fd)
+	s.summary.add("fd_sync", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) FDTell(ctx context.Context, fd FD) (FileSize, Errno) {
+	start := time.Now()
+	result, errno := s.system.FDTell(ctx, fd)
+	s.summary.add("fd_tell", time.Since(start), errno)
+	return result, errno
+}
+
+func (s *summarizer) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	start := time.Now()
+	n, errno := s.system.FDWrite(ctx, fd, iovecs)
+	s.summary.add("fd_write", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	start := time.Now()
+	errno := s.system.PathCreateDirectory(ctx, fd, path)
+	s.summary.add("path_create_directory", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	start := time.Now()
+	filestat, errno := s.system.PathFileStatGet(ctx, fd, lookupFlags, path)
+	s.summary.add("path_filestat_get", time.Since(start), errno)
+	return filestat, errno
+}
+
+func (s *summarizer) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	start := time.Now()
+	errno := s.system.PathFileStatSetTimes(ctx, fd, lookupFlags, path, accessTime, modifyTime, flags)
+	s.summary.add("path_filestat_set_times", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	start := time.Now()
+	errno := s.system.PathLink(ctx, oldFD, oldFlags, oldPath, newFD, newPath)
+	s.summary.add("path_link", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	start := time.Now()
+	newfd, errno := s.system.PathOpen(ctx, fd, dirFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	s.summary.add("path_open", time.Since(start), errno)
+	return newfd, errno
+}
+
+func (s *summarizer) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	start := time.Now()
+	n, errno := s.system.PathReadLink(ctx, fd, path, buffer)
+	s.summary.add("path_readlink", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	start := time.Now()
+	errno := s.system.PathRemoveDirectory(ctx, fd, path)
+	s.summary.add("path_remove_directory", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	start := time.Now()
+	errno := s.system.PathRename(ctx, fd, oldPath, newFD, newPath)
+	s.summary.add("path_rename", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	start := time.Now()
+	errno := s.system.PathSymlink(ctx, oldPath, fd, newPath)
+	s.summary.add("path_symlink", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	start := time.Now()
+	errno := s.system.PathUnlinkFile(ctx, fd, path)
+	s.summary.add("path_unlink_file", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) PollOneOff(ctx context.Context, subscriptions []Subscription, events []Event) (int, Errno) {
+	start := time.Now()
+	n, errno := s.system.PollOneOff(ctx, subscriptions, events)
+	s.summary.add("poll_oneoff", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) ProcExit(ctx context.Context, exitCode ExitCode) Errno {
+	// ProcExit is not expected to return, the call is counted before
+	// calling the underlying system.
+	s.summary.add("proc_exit", 0, ESUCCESS)
+	return s.system.ProcExit(ctx, exitCode)
+}
+
+func (s *summarizer) ProcRaise(ctx context.Context, signal Signal) Errno {
+	start := time.Now()
+	errno := s.system.ProcRaise(ctx, signal)
+	s.summary.add("proc_raise", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) SchedYield(ctx context.Context) Errno {
+	start := time.Now()
+	errno := s.system.SchedYield(ctx)
+	s.summary.add("sched_yield", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) RandomGet(ctx context.Context, b []byte) Errno {
+	start := time.Now()
+	errno := s.system.RandomGet(ctx, b)
+	s.summary.add("random_get", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	start := time.Now()
+	newfd, peer, addr, errno := s.system.SockAccept(ctx, fd, flags)
+	s.summary.add("sock_accept", time.Since(start), errno)
+	return newfd, peer, addr, errno
+}
+
+func (s *summarizer) SockShutdown(ctx context.Context, fd FD, flags SDFlags) Errno {
+	start := time.Now()
+	errno := s.system.SockShutdown(ctx, fd, flags)
+	s.summary.add("sock_shutdown", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) SockRecv(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, Errno) {
+	start := time.Now()
+	n, oflags, errno := s.system.SockRecv(ctx, fd, iovecs, iflags)
+	s.summary.add("sock_recv", time.Since(start), errno)
+	return n, oflags, errno
+}
+
+func (s *summarizer) SockSend(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags) (Size, Errno) {
+	start := time.Now()
+	n, errno := s.system.SockSend(ctx, fd, iovecs, iflags)
+	s.summary.add("sock_send", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) SockOpen(ctx context.Context, pf ProtocolFamily, socketType SocketType, protocol Protocol, rightsBase, rightsInheriting Rights) (FD, Errno) {
+	start := time.Now()
+	fd, errno := s.system.SockOpen(ctx, pf, socketType, protocol, rightsBase, rightsInheriting)
+	s.summary.add("sock_open", time.Since(start), errno)
+	return fd, errno
+}
+
+func (s *summarizer) SockBind(ctx context.Context, fd FD, addr SocketAddress) (SocketAddress, Errno) {
+	start := time.Now()
+	result, errno := s.system.SockBind(ctx, fd, addr)
+	s.summary.add("sock_bind", time.Since(start), errno)
+	return result, errno
+}
+
+func (s *summarizer) SockConnect(ctx context.Context, fd FD, peer SocketAddress) (SocketAddress, Errno) {
+	start := time.Now()
+	addr, errno := s.system.SockConnect(ctx, fd, peer)
+	s.summary.add("sock_connect", time.Since(start), errno)
+	return addr, errno
+}
+
+func (s *summarizer) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	start := time.Now()
+	errno := s.system.SockListen(ctx, fd, backlog)
+	s.summary.add("sock_listen", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) SockSendTo(ctx context.Context, fd FD, iovecs []IOVec, iflags SIFlags, addr SocketAddress) (Size, Errno) {
+	start := time.Now()
+	n, errno := s.system.SockSendTo(ctx, fd, iovecs, iflags, addr)
+	s.summary.add("sock_send_to", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) SockRecvFrom(ctx context.Context, fd FD, iovecs []IOVec, iflags RIFlags) (Size, ROFlags, SocketAddress, Errno) {
+	start := time.Now()
+	n, oflags, addr, errno := s.system.SockRecvFrom(ctx, fd, iovecs, iflags)
+	s.summary.add("sock_recv_from", time.Since(start), errno)
+	return n, oflags, addr, errno
+}
+
+func (s *summarizer) SockGetOpt(ctx context.Context, fd FD, option SocketOption) (SocketOptionValue, Errno) {
+	start := time.Now()
+	value, errno := s.system.SockGetOpt(ctx, fd, option)
+	s.summary.add("sock_getsockopt", time.Since(start), errno)
+	return value, errno
+}
+
+func (s *summarizer) SockSetOpt(ctx context.Context, fd FD, option SocketOption, value SocketOptionValue) Errno {
+	start := time.Now()
+	errno := s.system.SockSetOpt(ctx, fd, option, value)
+	s.summary.add("sock_setsockopt", time.Since(start), errno)
+	return errno
+}
+
+func (s *summarizer) SockLocalAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	start := time.Now()
+	addr, errno := s.system.SockLocalAddress(ctx, fd)
+	s.summary.add("sock_getlocaladdr", time.Since(start), errno)
+	return addr, errno
+}
+
+func (s *summarizer) SockRemoteAddress(ctx context.Context, fd FD) (SocketAddress, Errno) {
+	start := time.Now()
+	addr, errno := s.system.SockRemoteAddress(ctx, fd)
+	s.summary.add("sock_getpeeraddr", time.Since(start), errno)
+	return addr, errno
+}
+
+func (s *summarizer) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	start := time.Now()
+	n, errno := s.system.SockAddressInfo(ctx, name, service, hints, results)
+	s.summary.add("sock_getaddrinfo", time.Since(start), errno)
+	return n, errno
+}
+
+func (s *summarizer) Close(ctx context.Context) error {
+	err := s.system.Close(ctx)
+	if s.writer != nil {
+		s.summary.WriteTo(s.writer)
+	}
+	return err
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/stealthrocket/wasi-go/internal/descriptor"
 )
@@ -93,10 +95,71 @@ type Dir interface {
 //	type File struct {
 //		...
 //	}
+//
+// The table is safe for concurrent calls on different file descriptors, but
+// calls on the same file descriptor must be synchronized (see Synchronize).
+// File descriptors are looked up without acquiring locks, so concurrent calls
+// do not contend on the table unless they open or close files, or change
+// their flags or rights.
 type FileTable[T File[T]] struct {
+	mutex    sync.RWMutex
 	files    descriptor.Table[FD, fileEntry[T]]
 	preopens descriptor.Table[FD, string]
 	dirs     map[FD]Dir
+	// view is the copy of files that lookups read from, which is replaced
+	// when the table is modified.
+	view atomic.Pointer[fileView[T]]
+}
+
+// fileView is an immutable snapshot of the entries of a FileTable. The entries
+// are grouped in chunks so updating the entry of a file descriptor only copies
+// the chunk that it is in, and the list of chunks.
+type fileView[T File[T]] struct {
+	chunks []*[fileViewChunkSize]*fileEntry[T]
+}
+
+const fileViewChunkSize = 64
+
+func (v *fileView[T]) lookup(fd FD) *fileEntry[T] {
+	if v != nil && fd >= 0 {
+		if i := int(fd) / fileViewChunkSize; i < len(v.chunks) {
+			if chunk := v.chunks[i]; chunk != nil {
+				return chunk[int(fd)%fileViewChunkSize]
+			}
+		}
+	}
+	return nil
+}
+
+// publish updates the view with the entry of fd in the table, or removes fd
+// from the view if it is not in the table. The table mutex must be held.
+func (t *FileTable[T]) publish(fd FD) {
+	var entry *fileEntry[T]
+	if f := t.files.Access(fd); f != nil {
+		e := *f
+		entry = &e
+	}
+	var chunks []*[fileViewChunkSize]*fileEntry[T]
+	if v := t.view.Load(); v != nil {
+		chunks = v.chunks
+	}
+	i := int(fd) / fileViewChunkSize
+	if i >= len(chunks) && entry == nil {
+		return
+	}
+	n := len(chunks)
+	if i >= n {
+		n = i + 1
+	}
+	newChunks := make([]*[fileViewChunkSize]*fileEntry[T], n)
+	copy(newChunks, chunks)
+	chunk := new([fileViewChunkSize]*fileEntry[T])
+	if c := newChunks[i]; c != nil {
+		*chunk = *c
+	}
+	chunk[int(fd)%fileViewChunkSize] = entry
+	newChunks[i] = chunk
+	t.view.Store(&fileView[T]{chunks: newChunks})
 }
 
 type fileEntry[T File[T]] struct {
@@ -105,12 +168,15 @@ type fileEntry[T File[T]] struct {
 }
 
 func (t *FileTable[T]) Close(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	t.files.Range(func(fd FD, f fileEntry[T]) bool {
 		f.file.FDClose(ctx)
 		return true
 	})
 	t.files.Reset()
 	t.preopens.Reset()
+	t.view.Store(nil)
 	for _, dir := range t.dirs {
 		dir.FDCloseDir(ctx)
 	}
@@ -121,19 +187,31 @@ func (t *FileTable[T]) Close(ctx context.Context) error {
 }
 
 func (t *FileTable[T]) Preopen(file T, path string, stat FDStat) FD {
-	fd := t.Register(file, stat)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fd := t.register(file, stat)
 	t.preopens.Assign(fd, path)
 	return fd
 }
 
 func (t *FileTable[T]) PreopenFD(fd FD) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	t.preopens.Assign(fd, "")
 }
 
 func (t *FileTable[T]) Register(file T, stat FDStat) FD {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.register(file, stat)
+}
+
+func (t *FileTable[T]) register(file T, stat FDStat) FD {
 	stat.RightsBase &= AllRights
 	stat.RightsInheriting &= AllRights
-	return t.files.Insert(fileEntry[T]{file: file, stat: stat})
+	fd := t.files.Insert(fileEntry[T]{file: file, stat: stat})
+	t.publish(fd)
+	return fd
 }
 
 func (t *FileTable[T]) LookupFD(fd FD, rights Rights) (file T, stat FDStat, errno Errno) {
@@ -158,8 +236,19 @@ func (t *FileTable[T]) isPreopen(fd FD) bool {
 	return t.preopens.Access(fd) != nil
 }
 
+// lookupFD returns the entry of fd from the view of the table, without
+// acquiring the table mutex. The entry must not be modified.
 func (t *FileTable[T]) lookupFD(fd FD, rights Rights) (*fileEntry[T], Errno) {
-	f := t.files.Access(fd)
+	return checkFD(t.view.Load().lookup(fd), rights)
+}
+
+// accessFD is like lookupFD but returns the entry of the table, which can be
+// modified and published, and the table mutex must be held.
+func (t *FileTable[T]) accessFD(fd FD, rights Rights) (*fileEntry[T], Errno) {
+	return checkFD(t.files.Access(fd), rights)
+}
+
+func checkFD[T File[T]](f *fileEntry[T], rights Rights) (*fileEntry[T], Errno) {
 	if f == nil {
 		return nil, EBADF
 	}
@@ -170,6 +259,8 @@ func (t *FileTable[T]) lookupFD(fd FD, rights Rights) (*fileEntry[T], Errno) {
 }
 
 func (t *FileTable[T]) lookupPreopenPath(fd FD) (string, Errno) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 	path, ok := t.preopens.Lookup(fd)
 	if !ok {
 		return "", EBADF
@@ -185,7 +276,7 @@ func (t *FileTable[T]) lookupPreopenPath(fd FD) (string, Errno) {
 }
 
 func (t *FileTable[T]) lookupSocketFD(fd FD, rights Rights) (*fileEntry[T], Errno) {
-	f := t.files.Access(fd)
+	f := t.view.Load().lookup(fd)
 	if f == nil {
 		return nil, EBADF
 	}
@@ -218,19 +309,25 @@ func (t *FileTable[T]) FDAllocate(ctx context.Context, fd FD, offset FileSize, l
 }
 
 func (t *FileTable[T]) FDClose(ctx context.Context, fd FD) Errno {
-	f, errno := t.lookupFD(fd, 0)
+	t.mutex.Lock()
+	f, errno := t.accessFD(fd, 0)
 	if errno != ESUCCESS {
+		t.mutex.Unlock()
 		return errno
 	}
 	// We capture the file before removing the table entry because f is a
 	// pointer into the table and gets erased when the descriptor is deleted.
 	file := f.file
 	t.files.Delete(fd)
+	t.publish(fd)
 	// Note: closing pre-opens is allowed.
 	// See github.com/WebAssembly/wasi-testsuite/blob/1b1d4a5/tests/rust/src/bin/close_preopen.rs
 	t.preopens.Delete(fd)
-	if dir := t.dirs[fd]; dir != nil {
-		delete(t.dirs, fd)
+	dir := t.dirs[fd]
+	delete(t.dirs, fd)
+	t.mutex.Unlock()
+
+	if dir != nil {
 		dir.FDCloseDir(ctx)
 	}
 	return file.FDClose(ctx)
@@ -253,7 +350,9 @@ func (t *FileTable[T]) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
 }
 
 func (t *FileTable[T]) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags) Errno {
-	f, errno := t.lookupFD(fd, FDStatSetFlagsRight)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f, errno := t.accessFD(fd, FDStatSetFlagsRight)
 	if errno != ESUCCESS {
 		return errno
 	}
@@ -268,11 +367,14 @@ func (t *FileTable[T]) FDStatSetFlags(ctx context.Context, fd FD, flags FDFlags)
 		return errno
 	}
 	f.stat.Flags ^= changes
+	t.publish(fd)
 	return ESUCCESS
 }
 
 func (t *FileTable[T]) FDStatSetRights(ctx context.Context, fd FD, rightsBase, rightsInheriting Rights) Errno {
-	f, errno := t.lookupFD(fd, 0)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f, errno := t.accessFD(fd, 0)
 	if errno != ESUCCESS {
 		return errno
 	}
@@ -287,6 +389,7 @@ func (t *FileTable[T]) FDStatSetRights(ctx context.Context, fd FD, rightsBase, r
 	}
 	f.stat.RightsBase &= rightsBase
 	f.stat.RightsInheriting &= rightsInheriting
+	t.publish(fd)
 	return ESUCCESS
 }
 
@@ -385,10 +488,18 @@ func (t *FileTable[T]) FDReadDir(ctx context.Context, fd FD, entries []DirEntry,
 	if len(entries) == 0 {
 		return 0, EINVAL
 	}
+	t.mutex.RLock()
 	d := t.dirs[fd]
+	t.mutex.RUnlock()
+	if d != nil {
+		return d.FDReadDir(ctx, entries, cookie, bufferSizeBytes)
+	}
+	t.mutex.Lock()
+	d = t.dirs[fd]
 	if d == nil {
 		d, errno = f.file.FDOpenDir(ctx)
 		if errno != ESUCCESS {
+			t.mutex.Unlock()
 			return 0, errno
 		}
 		if t.dirs == nil {
@@ -396,14 +507,17 @@ func (t *FileTable[T]) FDReadDir(ctx context.Context, fd FD, entries []DirEntry,
 		}
 		t.dirs[fd] = d
 	}
+	t.mutex.Unlock()
 	return d.FDReadDir(ctx, entries, cookie, bufferSizeBytes)
 }
 
 func (t *FileTable[T]) FDRenumber(ctx context.Context, from, to FD) Errno {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	if t.isPreopen(from) || t.isPreopen(to) {
 		return ENOTSUP
 	}
-	f, errno := t.lookupFD(from, 0)
+	f, errno := t.accessFD(from, 0)
 	if errno != ESUCCESS {
 		return errno
 	}
@@ -417,6 +531,8 @@ func (t *FileTable[T]) FDRenumber(ctx context.Context, from, to FD) Errno {
 		}
 	}
 	t.files.Delete(from)
+	t.publish(from)
+	t.publish(to)
 	if d != nil {
 		delete(t.dirs, from)
 		t.dirs[to] = d
@@ -490,6 +606,14 @@ func (t *FileTable[T]) PathLink(ctx context.Context, fd FD, flags LookupFlags, o
 }
 
 func (t *FileTable[T]) PathOpen(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	return t.PathOpenFunc(ctx, fd, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags, T.PathOpen)
+}
+
+// PathOpenFunc is like PathOpen, but the file is opened by calling open with
+// the directory of fd instead of its PathOpen method. This allows systems to
+// customize the resolution of paths, while the rights are checked and the new
+// file is registered like in PathOpen.
+func (t *FileTable[T]) PathOpenFunc(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags, open func(T, context.Context, LookupFlags, string, OpenFlags, Rights, Rights, FDFlags) (T, Errno)) (FD, Errno) {
 	d, errno := t.lookupFD(fd, PathOpenRight)
 	if errno != ESUCCESS {
 		return -1, errno
@@ -524,7 +648,7 @@ func (t *FileTable[T]) PathOpen(ctx context.Context, fd FD, lookupFlags LookupFl
 		}
 	}
 
-	newFile, errno := d.file.PathOpen(ctx, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
+	newFile, errno := open(d.file, ctx, lookupFlags, path, openFlags, rightsBase, rightsInheriting, fdFlags)
 	if errno != ESUCCESS {
 		return -1, errno
 	}
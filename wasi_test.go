@@ -1,10 +1,14 @@
 package wasi
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"math"
+	"net/netip"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -324,6 +328,20 @@ func TestExec(t *testing.T) {
 	assertEqual(t, SIGILL.Name(), "SIGILL")
 	assertEqual(t, SIGTRAP.Name(), "SIGTRAP")
 	assertEqual(t, SIGABRT.Name(), "SIGABRT")
+
+	assertEqual(t, SIGABRT.ExitCode(), 134)
+	assertEqual(t, SIGTERM.ExitCode(), 143)
+	assertEqual(t, SIGCHLD.ExitCode(), 145)
+	assertEqual(t, SIGABRT.DefaultAction(), SignalTerminate)
+	assertEqual(t, SIGWINCH.DefaultAction(), SignalIgnore)
+	for _, name := range []string{"SIGUSR1", "usr1", "10"} {
+		signal, err := ParseSignal(name)
+		assertEqual(t, err, nil)
+		assertEqual(t, signal, SIGUSR1)
+	}
+	if _, err := ParseSignal("SIGNOPE"); err == nil {
+		t.Error("ParseSignal: expected an error for an invalid signal")
+	}
 	assertEqual(t, SIGBUS.Name(), "SIGBUS")
 	assertEqual(t, SIGFPE.Name(), "SIGFPE")
 	assertEqual(t, SIGKILL.Name(), "SIGKILL")
@@ -695,6 +713,761 @@ func TestTime(t *testing.T) {
 	assertEqual(t, ThreadCPUTimeID.String(), "ThreadCPUTimeID")
 }
 
+func TestWindowsPath(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"file.txt", "file.txt"},
+		{"dir/file.txt", "dir/file.txt"},
+		{`dir\file.txt`, "dir/file.txt"},
+		{`C:\data\file.txt`, "data/file.txt"},
+		{`c:data\file.txt`, "data/file.txt"},
+		{`C:\`, "."},
+		{"C:", "."},
+		{`\\server\share`, "//server/share"},
+		{"1:file", "1:file"},
+	} {
+		assertEqual(t, fromWindowsPath(test.path), test.want)
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		syscall string
+		match   bool
+	}{
+		{"", "fd_read", true},
+		{"fd_read", "fd_read", true},
+		{"fd_read", "fd_write", false},
+		{"fd_read,sock_*", "sock_accept", true},
+		{"fd_read,sock_*", "poll_oneoff", false},
+		{"!poll_oneoff", "poll_oneoff", false},
+		{"!poll_oneoff", "fd_read", true},
+		{"!clock_*,!poll_oneoff", "clock_time_get", false},
+		{"fd_*,!fd_fdstat_get", "fd_fdstat_get", false},
+		{"fd_*,!fd_fdstat_get", "fd_write", true},
+	}
+	for _, test := range tests {
+		f, err := ParseTraceFilter(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := f.Match(test.syscall); match != test.match {
+			t.Errorf("%q: %s: expected match=%t, got %t", test.filter, test.syscall, test.match, match)
+		}
+	}
+	if _, err := ParseTraceFilter("fd_[read"); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
+
+func TestTraceSwitch(t *testing.T) {
+	var sw TraceSwitch
+	traced, system := WindowsPaths(nil), WindowsPaths(nil)
+	f := withTraceOptions(traced, system, []TraceOption{WithTraceSwitch(&sw)}).(*traceFilter)
+
+	if f.pick("fd_read") != traced {
+		t.Error("expected the call to be traced when the switch is enabled")
+	}
+	sw.Disable()
+	if f.pick("fd_read") != system {
+		t.Error("expected the call not to be traced when the switch is disabled")
+	}
+	sw.Enable()
+	if f.pick("fd_read") != traced {
+		t.Error("expected the call to be traced when the switch is enabled again")
+	}
+}
+
+func TestSyscallSummary(t *testing.T) {
+	summary := new(SyscallSummary)
+	summary.add("fd_read", 2*time.Millisecond, ESUCCESS)
+	summary.add("fd_read", 4*time.Millisecond, EAGAIN)
+	summary.add("fd_write", 2*time.Millisecond, ESUCCESS)
+
+	assertEqual(t, summary.Stats(), []SyscallStats{
+		{Syscall: "fd_read", Calls: 2, Errors: 1, Time: 6 * time.Millisecond},
+		{Syscall: "fd_write", Calls: 1, Time: 2 * time.Millisecond},
+	})
+
+	var b strings.Builder
+	if _, err := summary.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, b.String(), `% time     seconds  usecs/call     calls    errors syscall
+------ ----------- ----------- --------- --------- ----------------
+ 75.00    0.006000        3000         2         1 fd_read
+ 25.00    0.002000        2000         1           fd_write
+------ ----------- ----------- --------- --------- ----------------
+100.00    0.008000                     3         1 total
+`)
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+
+	var created, closed atomic.Int32
+	newSystem := func(context.Context) (System, error) {
+		created.Add(1)
+		return &poolSystem{closed: &closed}, nil
+	}
+	waitCreated := func(n int32) {
+		t.Helper()
+		for created.Load() != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("without reset", func(t *testing.T) {
+		created.Store(0)
+		closed.Store(0)
+		pool := &Pool{New: newSystem, Size: 1}
+
+		// The first call creates a system synchronously, and starts creating
+		// the idle system in the background.
+		s1, err := pool.Get(ctx)
+		assertEqual(t, err, nil)
+		waitCreated(2)
+
+		s2, err := pool.Get(ctx)
+		assertEqual(t, err, nil)
+		assertEqual(t, s1 != s2, true)
+		waitCreated(3)
+
+		pool.Put(ctx, s1)
+		pool.Put(ctx, s2)
+		assertEqual(t, closed.Load(), int32(2))
+
+		assertEqual(t, pool.Close(ctx), nil)
+		assertEqual(t, closed.Load(), int32(3))
+		if _, err := pool.Get(ctx); err == nil {
+			t.Error("get from closed pool must fail")
+		}
+	})
+
+	t.Run("with reset", func(t *testing.T) {
+		created.Store(0)
+		closed.Store(0)
+		resetErr := error(nil)
+		pool := &Pool{
+			New:   newSystem,
+			Reset: func(context.Context, System) error { return resetErr },
+			Size:  1,
+		}
+
+		s1, err := pool.Get(ctx)
+		assertEqual(t, err, nil)
+		pool.Put(ctx, s1)
+
+		s2, err := pool.Get(ctx)
+		assertEqual(t, err, nil)
+		assertEqual(t, s1 == s2, true)
+		assertEqual(t, created.Load(), int32(1))
+
+		// Systems which cannot be reset are closed and replaced.
+		resetErr = errors.New("cannot reset")
+		pool.Put(ctx, s2)
+		assertEqual(t, closed.Load(), int32(1))
+		waitCreated(2)
+
+		assertEqual(t, pool.Close(ctx), nil)
+		assertEqual(t, closed.Load(), int32(2))
+	})
+}
+
+type poolSystem struct {
+	System
+	closed *atomic.Int32
+}
+
+func (s *poolSystem) Close(context.Context) error {
+	s.closed.Add(1)
+	return nil
+}
+
+func TestResourceUsage(t *testing.T) {
+	ctx := context.Background()
+	usage := new(ResourceUsage)
+	system := Account(&usageSystem{}, usage)
+
+	// Writes to stdio are accounted as other I/O.
+	system.FDWrite(ctx, 1, []IOVec{make([]byte, 3)})
+
+	fd, errno := system.PathOpen(ctx, 3, 0, "file", 0, AllRights, AllRights, 0)
+	assertEqual(t, errno, ESUCCESS)
+	system.FDWrite(ctx, fd, []IOVec{make([]byte, 10)})
+	system.FDRead(ctx, fd, []IOVec{make([]byte, 4)})
+
+	sock, errno := system.SockOpen(ctx, InetFamily, StreamSocket, TCPProtocol, AllRights, AllRights)
+	assertEqual(t, errno, ESUCCESS)
+	system.SockConnect(ctx, sock, &Inet4Address{Port: 80})
+	system.SockSend(ctx, sock, []IOVec{make([]byte, 5)}, 0)
+
+	// Renumbering over an open file descriptor closes it.
+	assertEqual(t, system.FDRenumber(ctx, sock, fd), ESUCCESS)
+	assertEqual(t, system.FDClose(ctx, 5), EBADF)
+
+	assertEqual(t, usage.Stats(), Stats{
+		Syscalls:    9,
+		Errors:      2,
+		Files:       IOStats{BytesRead: 4, BytesWritten: 10},
+		Sockets:     IOStats{BytesWritten: 5},
+		Other:       IOStats{BytesWritten: 3},
+		OpenFDs:     1,
+		Connections: 1,
+	})
+
+	assertEqual(t, system.FDClose(ctx, fd), ESUCCESS)
+	assertEqual(t, usage.Stats().OpenFDs, 0)
+}
+
+// usageSystem is a system where all I/O completes, and path_open opens
+// regular files.
+type usageSystem struct {
+	System
+	nextFD FD
+}
+
+func (s *usageSystem) PathOpen(context.Context, FD, LookupFlags, string, OpenFlags, Rights, Rights, FDFlags) (FD, Errno) {
+	s.nextFD++
+	return 10 + s.nextFD, ESUCCESS
+}
+
+func (s *usageSystem) SockOpen(context.Context, ProtocolFamily, SocketType, Protocol, Rights, Rights) (FD, Errno) {
+	s.nextFD++
+	return 10 + s.nextFD, ESUCCESS
+}
+
+func (s *usageSystem) SockConnect(context.Context, FD, SocketAddress) (SocketAddress, Errno) {
+	return nil, EINPROGRESS
+}
+
+func (s *usageSystem) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	if fd <= 2 {
+		return FDStat{FileType: CharacterDeviceType}, ESUCCESS
+	}
+	return FDStat{FileType: RegularFileType}, ESUCCESS
+}
+
+func (s *usageSystem) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	return Size(len(iovecs[0])), ESUCCESS
+}
+
+func (s *usageSystem) FDPwrite(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	return Size(len(iovecs[0])), ESUCCESS
+}
+
+func (s *usageSystem) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	return Size(len(iovecs[0])), ESUCCESS
+}
+
+func (s *usageSystem) SockSend(ctx context.Context, fd FD, iovecs []IOVec, flags SIFlags) (Size, Errno) {
+	return Size(len(iovecs[0])), ESUCCESS
+}
+
+func (s *usageSystem) FDRenumber(context.Context, FD, FD) Errno {
+	return ESUCCESS
+}
+
+func (s *usageSystem) FDClose(ctx context.Context, fd FD) Errno {
+	if fd > 10 {
+		return ESUCCESS
+	}
+	return EBADF
+}
+
+func TestLimitBandwidth(t *testing.T) {
+	ctx := context.Background()
+	system := LimitBandwidth(&usageSystem{}, Bandwidth{Send: 10e3})
+
+	// Files are not limited.
+	fd, errno := system.PathOpen(ctx, 3, 0, "file", 0, AllRights, AllRights, 0)
+	assertEqual(t, errno, ESUCCESS)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		system.FDWrite(ctx, fd, []IOVec{make([]byte, 10e3)})
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("writes to files were delayed by %s", elapsed)
+	}
+
+	sock, errno := system.SockOpen(ctx, InetFamily, StreamSocket, TCPProtocol, AllRights, AllRights)
+	assertEqual(t, errno, ESUCCESS)
+
+	// The first call is not truncated, the bucket goes in debt of 5KB which
+	// delays the next call by 500ms.
+	size, errno := system.SockSend(ctx, sock, []IOVec{make([]byte, 15e3)}, 0)
+	assertEqual(t, size, Size(15e3))
+	assertEqual(t, errno, ESUCCESS)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, errno = system.SockSend(canceled, sock, []IOVec{make([]byte, 1)}, 0)
+	assertEqual(t, errno, ECANCELED)
+
+	start = time.Now()
+	_, errno = system.SockSend(ctx, sock, []IOVec{make([]byte, 1)}, 0)
+	assertEqual(t, errno, ESUCCESS)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("send was only delayed by %s", elapsed)
+	}
+}
+
+func TestLimitFileIO(t *testing.T) {
+	ctx := context.Background()
+	system := LimitFileIO(&usageSystem{}, FileIOLimits{WriteOps: 10})
+
+	fd, errno := system.PathOpen(ctx, 3, 0, "file", 0, AllRights, AllRights, 0)
+	assertEqual(t, errno, ESUCCESS)
+
+	// The bucket holds one second worth of operations.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		system.FDWrite(ctx, fd, []IOVec{make([]byte, 1)})
+		system.FDRead(ctx, fd, []IOVec{make([]byte, 1)})
+	}
+	// Writes to stdio are not limited.
+	system.FDWrite(ctx, 1, []IOVec{make([]byte, 1)})
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("operations were delayed by %s", elapsed)
+	}
+
+	start = time.Now()
+	_, errno = system.FDPwrite(ctx, fd, []IOVec{make([]byte, 1)}, 0)
+	assertEqual(t, errno, ESUCCESS)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("write was only delayed by %s", elapsed)
+	}
+}
+
+// copySystem is a system reading from a seekable file (fd 3) and writing
+// to a socket (fd 4) which accepts at most limit bytes per call.
+type copySystem struct {
+	System
+	data   []byte
+	offset int
+	output []byte
+	limit  int
+}
+
+func (s *copySystem) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	if fd == 3 {
+		return FDStat{FileType: RegularFileType}, ESUCCESS
+	}
+	return FDStat{FileType: SocketStreamType, Flags: NonBlock}, ESUCCESS
+}
+
+func (s *copySystem) FDRead(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n := copy(iovecs[0], s.data[s.offset:])
+	s.offset += n
+	return Size(n), ESUCCESS
+}
+
+func (s *copySystem) FDSeek(ctx context.Context, fd FD, delta FileDelta, whence Whence) (FileSize, Errno) {
+	s.offset += int(delta)
+	return FileSize(s.offset), ESUCCESS
+}
+
+func (s *copySystem) FDWrite(ctx context.Context, fd FD, iovecs []IOVec) (Size, Errno) {
+	n := len(iovecs[0])
+	if n > s.limit {
+		n = s.limit
+	}
+	if n == 0 {
+		return ^Size(0), EAGAIN
+	}
+	s.output = append(s.output, iovecs[0][:n]...)
+	s.limit -= n
+	return Size(n), ESUCCESS
+}
+
+func TestFDCopy(t *testing.T) {
+	ctx := context.Background()
+	system := &copySystem{data: []byte("Hello, World!"), limit: 5}
+
+	// The data which the socket did not accept is read again by the next
+	// call.
+	n, errno := FDCopy(ctx, system, 4, 3, 100)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, n, FileSize(5))
+	_, errno = FDCopy(ctx, system, 4, 3, 100)
+	assertEqual(t, errno, EAGAIN)
+
+	system.limit = 100
+	n, errno = FDCopy(ctx, system, 4, 3, 100)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, n, FileSize(8))
+	assertEqual(t, string(system.output), "Hello, World!")
+
+	n, errno = FDCopy(ctx, system, 4, 3, 100)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, n, FileSize(0))
+}
+
+// preadSystem is a system reading files with FDPread, at most limit bytes
+// per call.
+type preadSystem struct {
+	System
+	data  []byte
+	limit int
+}
+
+func (s *preadSystem) FDPread(ctx context.Context, fd FD, iovecs []IOVec, offset FileSize) (Size, Errno) {
+	if offset >= FileSize(len(s.data)) {
+		return 0, ESUCCESS
+	}
+	b := iovecs[0]
+	if len(b) > s.limit {
+		b = b[:s.limit]
+	}
+	return Size(copy(b, s.data[offset:])), ESUCCESS
+}
+
+func TestFDMmap(t *testing.T) {
+	ctx := context.Background()
+	system := &preadSystem{data: []byte("Hello, World!"), limit: 4}
+
+	// Systems which do not map files are read until the buffer is full or
+	// the end of the file is reached.
+	buffer := make([]byte, 8)
+	n, errno := FDMmap(ctx, system, 3, 2, buffer)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, string(buffer[:n]), "llo, Wor")
+
+	n, errno = FDMmap(ctx, system, 3, 10, buffer)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, string(buffer[:n]), "ld!")
+
+	n, errno = FDMmap(ctx, system, 3, 100, buffer)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, n, Size(0))
+}
+
+// connSystem is a system where sock_accept always accepts a connection,
+// and sockets are non-blocking when their file descriptor is odd.
+type connSystem struct {
+	System
+	nextFD  FD
+	backlog int
+}
+
+func (s *connSystem) SockListen(ctx context.Context, fd FD, backlog int) Errno {
+	s.backlog = backlog
+	return ESUCCESS
+}
+
+func (s *connSystem) SockAccept(ctx context.Context, fd FD, flags FDFlags) (FD, SocketAddress, SocketAddress, Errno) {
+	s.nextFD++
+	return 10 + s.nextFD, nil, nil, ESUCCESS
+}
+
+func (s *connSystem) FDStatGet(ctx context.Context, fd FD) (FDStat, Errno) {
+	stat := FDStat{FileType: SocketStreamType}
+	if fd%2 == 1 {
+		stat.Flags = NonBlock
+	}
+	return stat, ESUCCESS
+}
+
+func (s *connSystem) FDRenumber(context.Context, FD, FD) Errno {
+	return ESUCCESS
+}
+
+func (s *connSystem) FDClose(context.Context, FD) Errno {
+	return ESUCCESS
+}
+
+func TestLimitConnections(t *testing.T) {
+	ctx := context.Background()
+	s := &connSystem{}
+	system := LimitConnections(s, ConnectionLimits{MaxConnections: 2, MaxBacklog: 16})
+
+	assertEqual(t, system.SockListen(ctx, 3, 128), ESUCCESS)
+	assertEqual(t, s.backlog, 16)
+	assertEqual(t, system.SockListen(ctx, 3, 8), ESUCCESS)
+	assertEqual(t, s.backlog, 8)
+
+	conn1, _, _, errno := system.SockAccept(ctx, 3, 0)
+	assertEqual(t, errno, ESUCCESS)
+	conn2, _, _, errno := system.SockAccept(ctx, 3, 0)
+	assertEqual(t, errno, ESUCCESS)
+
+	// Past the limit, connections are left pending.
+	_, _, _, errno = system.SockAccept(ctx, 3, 0)
+	assertEqual(t, errno, EAGAIN)
+	_, _, _, errno = system.SockAccept(ctx, 4, 0)
+	assertEqual(t, errno, EMFILE)
+
+	// Renumbered connections still count towards the limit.
+	assertEqual(t, system.FDRenumber(ctx, conn1, 100), ESUCCESS)
+	assertEqual(t, system.FDClose(ctx, conn1), ESUCCESS)
+	_, _, _, errno = system.SockAccept(ctx, 3, 0)
+	assertEqual(t, errno, EAGAIN)
+
+	assertEqual(t, system.FDClose(ctx, conn2), ESUCCESS)
+	_, _, _, errno = system.SockAccept(ctx, 3, 0)
+	assertEqual(t, errno, ESUCCESS)
+}
+
+type yieldSystem struct {
+	System
+	yields int
+}
+
+func (s *yieldSystem) SchedYield(ctx context.Context) Errno {
+	s.yields++
+	return ESUCCESS
+}
+
+func (s *yieldSystem) ClockTimeGet(ctx context.Context, id ClockID, precision Timestamp) (Timestamp, Errno) {
+	return 42, ESUCCESS
+}
+
+func TestCooperate(t *testing.T) {
+	ctx := context.Background()
+	s := &yieldSystem{}
+	yields := 0
+	var yieldErr error
+	system := Cooperate(s, 3, func(context.Context) error {
+		yields++
+		return yieldErr
+	})
+
+	// The hook replaces the sched_yield of the underlying system.
+	assertEqual(t, system.SchedYield(ctx), ESUCCESS)
+	assertEqual(t, yields, 1)
+	assertEqual(t, s.yields, 0)
+
+	for i := 0; i < 6; i++ {
+		_, errno := system.ClockTimeGet(ctx, Monotonic, 1)
+		assertEqual(t, errno, ESUCCESS)
+	}
+	assertEqual(t, yields, 3)
+
+	// Yielding resets the count of system calls.
+	system.ClockTimeGet(ctx, Monotonic, 1)
+	assertEqual(t, system.SchedYield(ctx), ESUCCESS)
+	system.ClockTimeGet(ctx, Monotonic, 1)
+	system.ClockTimeGet(ctx, Monotonic, 1)
+	assertEqual(t, yields, 4)
+
+	// Errors of the hook fail the system call which triggered it.
+	yieldErr = context.Canceled
+	_, errno := system.ClockTimeGet(ctx, Monotonic, 1)
+	assertEqual(t, errno, ECANCELED)
+	assertEqual(t, system.SchedYield(ctx), ECANCELED)
+	assertEqual(t, yields, 6)
+}
+
+func TestSharedMemory(t *testing.T) {
+	m := NewSharedMemory(SharedMemoryLimits{MaxSegmentSize: 64, MaxTotalSize: 100})
+
+	_, errno := m.Open("queue", 64, 0)
+	assertEqual(t, errno, ENOENT)
+	_, errno = m.Open("queue", 65, SharedMemoryCreate)
+	assertEqual(t, errno, ENOMEM)
+
+	producer, errno := m.Open("queue", 64, SharedMemoryCreate)
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = m.Open("queue", 64, SharedMemoryCreate|SharedMemoryExclusive)
+	assertEqual(t, errno, EEXIST)
+	_, errno = m.Open("other", 64, SharedMemoryCreate)
+	assertEqual(t, errno, ENOMEM)
+
+	// The size is ignored when opening existing segments.
+	consumer, errno := m.Open("queue", 1, SharedMemoryCreate)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, consumer.Size(), int64(64))
+
+	n, errno := producer.WriteAt([]byte("hello"), 60)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, n, 4)
+	_, errno = producer.WriteAt([]byte("hello"), 64)
+	assertEqual(t, errno, ENOSPC)
+
+	b := make([]byte, 8)
+	n, errno = consumer.ReadAt(b, 60)
+	assertEqual(t, errno, ESUCCESS)
+	assertEqual(t, string(b[:n]), "hell")
+
+	// Segments are removed when closed by all the guests which opened them.
+	producer.Close()
+	assertEqual(t, m.TotalSize(), int64(64))
+	consumer.Close()
+	assertEqual(t, m.TotalSize(), int64(0))
+	_, errno = m.Open("queue", 64, 0)
+	assertEqual(t, errno, ENOENT)
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []string{
+		`{"paths": [{"path": "data", "access": ["read"]}]}`,
+		`{"paths": [{"path": "/data", "access": ["execute"]}]}`,
+		`{"network": [{"address": "10.0.0.0/33:80", "access": ["connect"]}]}`,
+		`{"network": [{"address": "localhost:9000-8000", "access": ["connect"]}]}`,
+		`{"network": [{"address": "localhost", "access": ["connect"]}]}`,
+		`{"network": [{"address": "*:*", "access": ["bind"]}]}`,
+		`{"environment": ["HOME"]}`,
+	} {
+		if _, err := ParsePolicy([]byte(policy)); err == nil {
+			t.Errorf("%s: expected an error", policy)
+		}
+	}
+}
+
+func TestPolicyNetwork(t *testing.T) {
+	ctx := context.Background()
+	policy, err := ParsePolicy([]byte(`{
+		"network": [
+			{"address": "*.example.com:443", "access": ["connect"]},
+			{"address": "[fd00::/8]:*", "access": ["connect", "listen"]},
+			{"address": "unix:/run/*.sock", "access": ["connect"]}
+		]
+	}`))
+	assertEqual(t, err, nil)
+	system, err := Enforce(&policySystem{}, policy)
+	assertEqual(t, err, nil)
+
+	example := &Inet4Address{Addr: [4]byte{93, 184, 216, 34}, Port: 443}
+	_, errno := system.SockConnect(ctx, 3, example)
+	assertEqual(t, errno, EPERM)
+
+	// Connecting is allowed once the address was resolved from a name
+	// matching the rule.
+	results := make([]AddressInfo, 1)
+	_, errno = system.SockAddressInfo(ctx, "www.Example.com", "https", AddressInfo{}, results)
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.SockConnect(ctx, 3, example)
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.SockConnect(ctx, 3, &Inet4Address{Addr: example.Addr, Port: 80})
+	assertEqual(t, errno, EPERM)
+
+	_, errno = system.SockBind(ctx, 3, &Inet6Address{Addr: [16]byte{0xfd, 15: 1}, Port: 8080})
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.SockBind(ctx, 3, &Inet6Address{Addr: [16]byte{0xfe, 15: 1}, Port: 8080})
+	assertEqual(t, errno, EPERM)
+
+	_, errno = system.SockConnect(ctx, 3, &UnixAddress{Name: "/run/app.sock"})
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.SockConnect(ctx, 3, &UnixAddress{Name: "/var/run/app.sock"})
+	assertEqual(t, errno, EPERM)
+}
+
+func TestPolicyDeny(t *testing.T) {
+	p, err := compilePolicy(&Policy{
+		Deny: []string{"**/.ssh", "*.key", "/data/tmp/**/*.log"},
+	})
+	assertEqual(t, err, nil)
+
+	for _, test := range []struct {
+		path   string
+		denied bool
+	}{
+		{"/home/.ssh", true},
+		{"/home/.ssh/id_rsa", true},
+		{"/.ssh/config", true},
+		{"/home/ssh", false},
+		{"/data/server.key", true},
+		{"/data/server.key.pub", false},
+		{"/data/tmp/app.log", true},
+		{"/data/tmp/a/b/app.log", true},
+		{"/data/app.log", false},
+	} {
+		if denied := p.pathAccess(test.path) == 0; denied != test.denied {
+			t.Errorf("%s: denied=%t, want %t", test.path, denied, test.denied)
+		}
+	}
+
+	_, err = compilePolicy(&Policy{Deny: []string{"[.ssh"}})
+	if err == nil {
+		t.Error("invalid deny pattern must be rejected")
+	}
+}
+
+func TestPolicyAllowDials(t *testing.T) {
+	ctx := context.Background()
+	policy := Policy{}.AllowDials("10.0.0.0/8:443", "*.example.com:*")
+	system, err := Enforce(&policySystem{}, &policy)
+	assertEqual(t, err, nil)
+
+	_, errno := system.SockConnect(ctx, 3, &Inet4Address{Addr: [4]byte{10, 1, 2, 3}, Port: 443})
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.SockConnect(ctx, 3, &Inet4Address{Addr: [4]byte{11, 1, 2, 3}, Port: 443})
+	assertEqual(t, errno, EPERM)
+	_, errno = system.SockSendTo(ctx, 3, nil, 0, &Inet4Address{Addr: [4]byte{10, 1, 2, 3}, Port: 53})
+	assertEqual(t, errno, EPERM)
+
+	// Only the destinations are restricted, sockets can be bound to any
+	// address.
+	_, errno = system.SockBind(ctx, 3, &Inet4Address{Port: 8080})
+	assertEqual(t, errno, ESUCCESS)
+
+	// Sockets opened with path_open are subject to the same rules.
+	_, errno = system.PathOpen(ctx, -1, 0, "tcp+dial://www.example.com:80", 0, 0, 0, 0)
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.PathOpen(ctx, -1, 0, "tcp+dial://1.1.1.1:80", 0, 0, 0, 0)
+	assertEqual(t, errno, EPERM)
+	_, errno = system.PathOpen(ctx, -1, 0, "tcp+listen://0.0.0.0:8080", 0, 0, 0, 0)
+	assertEqual(t, errno, ESUCCESS)
+	_, errno = system.PathOpen(ctx, -1, 0, "unix+dial:///var/run/docker.sock", 0, 0, 0, 0)
+	assertEqual(t, errno, EPERM)
+	_, errno = system.PathOpen(ctx, -1, 0, "unix+listen:///tmp/app.sock", 0, 0, 0, 0)
+	assertEqual(t, errno, ESUCCESS)
+
+	assertEqual(t, policy.AllowsDial("api.example.com:443"), true)
+	assertEqual(t, policy.AllowsDial("10.0.0.1:443"), true)
+	assertEqual(t, policy.AllowsDial("example.org:443"), false)
+}
+
+type policySystem struct{ System }
+
+func (*policySystem) SockAddressInfo(ctx context.Context, name, service string, hints AddressInfo, results []AddressInfo) (int, Errno) {
+	results[0] = AddressInfo{Address: &Inet4Address{Addr: [4]byte{93, 184, 216, 34}, Port: 443}}
+	return 1, ESUCCESS
+}
+
+func (*policySystem) SockConnect(context.Context, FD, SocketAddress) (SocketAddress, Errno) {
+	return nil, ESUCCESS
+}
+
+func (*policySystem) SockBind(context.Context, FD, SocketAddress) (SocketAddress, Errno) {
+	return nil, ESUCCESS
+}
+
+func (*policySystem) SockSendTo(context.Context, FD, []IOVec, SIFlags, SocketAddress) (Size, Errno) {
+	return 0, ESUCCESS
+}
+
+func (*policySystem) PathOpen(context.Context, FD, LookupFlags, string, OpenFlags, Rights, Rights, FDFlags) (FD, Errno) {
+	return 4, ESUCCESS
+}
+
+func TestParsePortMapping(t *testing.T) {
+	for _, test := range []struct {
+		spec    string
+		mapping PortMapping
+	}{
+		{"8080:9090", PortMapping{GuestPort: 8080, HostPort: 9090}},
+		{"8080:127.0.0.1:9090", PortMapping{GuestPort: 8080, HostIP: netip.MustParseAddr("127.0.0.1"), HostPort: 9090}},
+		{"53:[::1]:5353/udp", PortMapping{Network: "udp", GuestPort: 53, HostIP: netip.MustParseAddr("::1"), HostPort: 5353}},
+	} {
+		m, err := ParsePortMapping(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, m, test.mapping)
+		assertEqual(t, m.String(), test.spec)
+	}
+
+	for _, spec := range []string{"8080", "8080:", "x:9090", "8080:70000", "8080:localhost:9090", "8080:9090/sctp"} {
+		if _, err := ParsePortMapping(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
 func assertEqual[T any](t *testing.T, actual, expected T) {
 	t.Helper()
 
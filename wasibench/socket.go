@@ -0,0 +1,121 @@
+package wasibench
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/wasitest"
+)
+
+var socket = benchmarks{
+	"sock_open+fd_close tcp":        benchmarkSockOpen(wasi.StreamSocket),
+	"sock_open+fd_close udp":        benchmarkSockOpen(wasi.DatagramSocket),
+	"sock_connect+sock_accept tcp":  benchmarkSockConnectAccept,
+	"sock_send+sock_recv tcp 1KiB":  benchmarkSockSendRecv(wasi.StreamSocket, 1024),
+	"sock_send+sock_recv tcp 64KiB": benchmarkSockSendRecv(wasi.StreamSocket, 65536),
+	"sock_send+sock_recv udp 1KiB":  benchmarkSockSendRecv(wasi.DatagramSocket, 1024),
+}
+
+var localhost = &wasi.Inet4Address{Addr: [4]byte{127, 0, 0, 1}}
+
+func benchmarkSockOpen(typ wasi.SocketType) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(wasitest.TestConfig{})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			fd, errno := sys.SockOpen(ctx, wasi.InetFamily, typ, 0, wasi.AllRights, wasi.AllRights)
+			assertOK(b, errno)
+			assertOK(b, sys.FDClose(ctx, fd))
+		}
+	}
+}
+
+func benchmarkSockConnectAccept(b *testing.B, ctx context.Context, newSystem newSystem) {
+	sys := newSystem(wasitest.TestConfig{})
+	server := sockOpen(b, ctx, sys, wasi.StreamSocket)
+	addr, errno := sys.SockBind(ctx, server, localhost)
+	assertOK(b, errno)
+	assertOK(b, sys.SockListen(ctx, server, 128))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := sockOpen(b, ctx, sys, wasi.StreamSocket)
+		if _, errno := sys.SockConnect(ctx, client, addr); errno != wasi.EINPROGRESS {
+			assertOK(b, errno)
+		}
+		pollOneOff(b, ctx, sys, []wasi.Subscription{subscribeFDRead(server)}, make([]wasi.Event, 1))
+		conn, _, _, errno := sys.SockAccept(ctx, server, wasi.NonBlock)
+		assertOK(b, errno)
+		pollOneOff(b, ctx, sys, []wasi.Subscription{subscribeFDWrite(client)}, make([]wasi.Event, 1))
+		assertOK(b, sys.FDClose(ctx, conn))
+		assertOK(b, sys.FDClose(ctx, client))
+	}
+}
+
+// benchmarkSockSendRecv measures the round trip of messages of the given size
+// between two connected sockets, waiting for the receiver to be ready with
+// poll_oneoff like guests using non-blocking sockets do.
+func benchmarkSockSendRecv(typ wasi.SocketType, size int) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(wasitest.TestConfig{})
+		client, server := sockPair(b, ctx, sys, typ)
+		send := []wasi.IOVec{make([]byte, size)}
+		recv := []wasi.IOVec{make([]byte, size)}
+		subscriptions := []wasi.Subscription{subscribeFDRead(server)}
+		events := make([]wasi.Event, len(subscriptions))
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			n, errno := sys.SockSend(ctx, client, send, 0)
+			assertOK(b, errno)
+			for received := wasi.Size(0); received < n; {
+				pollOneOff(b, ctx, sys, subscriptions, events)
+				r, _, errno := sys.SockRecv(ctx, server, recv, 0)
+				if errno == wasi.EAGAIN {
+					continue
+				}
+				assertOK(b, errno)
+				received += r
+			}
+		}
+	}
+}
+
+func sockOpen(b *testing.B, ctx context.Context, sys wasi.System, typ wasi.SocketType) wasi.FD {
+	b.Helper()
+	fd, errno := sys.SockOpen(ctx, wasi.InetFamily, typ, 0, wasi.AllRights, wasi.AllRights)
+	assertOK(b, errno)
+	assertOK(b, sys.FDStatSetFlags(ctx, fd, wasi.NonBlock))
+	return fd
+}
+
+// sockPair returns two non-blocking sockets connected on the loopback
+// interface.
+func sockPair(b *testing.B, ctx context.Context, sys wasi.System, typ wasi.SocketType) (client, server wasi.FD) {
+	b.Helper()
+	server = sockOpen(b, ctx, sys, typ)
+	serverAddr, errno := sys.SockBind(ctx, server, localhost)
+	assertOK(b, errno)
+	client = sockOpen(b, ctx, sys, typ)
+
+	if typ == wasi.DatagramSocket {
+		clientAddr, errno := sys.SockBind(ctx, client, localhost)
+		assertOK(b, errno)
+		_, errno = sys.SockConnect(ctx, client, serverAddr)
+		assertOK(b, errno)
+		_, errno = sys.SockConnect(ctx, server, clientAddr)
+		assertOK(b, errno)
+		return client, server
+	}
+
+	assertOK(b, sys.SockListen(ctx, server, 1))
+	if _, errno := sys.SockConnect(ctx, client, serverAddr); errno != wasi.EINPROGRESS {
+		assertOK(b, errno)
+	}
+	pollOneOff(b, ctx, sys, []wasi.Subscription{subscribeFDRead(server)}, make([]wasi.Event, 1))
+	conn, _, _, errno := sys.SockAccept(ctx, server, wasi.NonBlock)
+	assertOK(b, errno)
+	pollOneOff(b, ctx, sys, []wasi.Subscription{subscribeFDWrite(client)}, make([]wasi.Event, 1))
+	assertOK(b, sys.FDClose(ctx, server))
+	return client, conn
+}
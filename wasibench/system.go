@@ -0,0 +1,278 @@
+package wasibench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/wasitest"
+)
+
+var file = benchmarks{
+	"fd_read stdin 4KiB":     benchmarkStdio(0, 4096, wasi.System.FDRead),
+	"fd_write stdout 4KiB":   benchmarkStdio(1, 4096, wasi.System.FDWrite),
+	"fd_pread 4KiB":          benchmarkFileIO(1, 4096, wasi.System.FDPread),
+	"fd_pread 16x256B":       benchmarkFileIO(16, 256, wasi.System.FDPread),
+	"fd_pwrite 4KiB":         benchmarkFileIO(1, 4096, wasi.System.FDPwrite),
+	"fd_pwrite 16x256B":      benchmarkFileIO(16, 256, wasi.System.FDPwrite),
+	"fd_filestat_get":        benchmarkFileStat,
+	"fd_read+fd_seek 64KiB":  benchmarkFileReadSeek(65536),
+	"fd_write+fd_seek 64KiB": benchmarkFileWriteSeek(65536),
+}
+
+var path = benchmarks{
+	"path_open+fd_close":          benchmarkPathOpen("data"),
+	"path_open+fd_close nested":   benchmarkPathOpen("a/b/c/d/data"),
+	"path_filestat_get":           benchmarkPathFileStat("data"),
+	"path_filestat_get nested":    benchmarkPathFileStat("a/b/c/d/data"),
+	"path_open+fd_readdir 64":     benchmarkReadDir(64),
+	"path_create+remove_dir":      benchmarkPathCreateRemoveDirectory,
+	"path_open creat+path_unlink": benchmarkPathCreateUnlinkFile,
+}
+
+var poll = benchmarks{
+	"poll_oneoff clock":          benchmarkPollClock,
+	"poll_oneoff fd_write 1":     benchmarkPollWrite(1),
+	"poll_oneoff fd_write 64":    benchmarkPollWrite(64),
+	"poll_oneoff fd_write+clock": benchmarkPollWriteClock,
+}
+
+func benchmarkStdio(fd wasi.FD, size int, op func(wasi.System, context.Context, wasi.FD, []wasi.IOVec) (wasi.Size, wasi.Errno)) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(wasitest.TestConfig{Stdin: zero{}, Stdout: discard{}})
+		iovecs := []wasi.IOVec{make([]byte, size)}
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, errno := op(sys, ctx, fd, iovecs)
+			assertOK(b, errno)
+		}
+	}
+}
+
+func benchmarkFileIO(count, size int, op func(wasi.System, context.Context, wasi.FD, []wasi.IOVec, wasi.FileSize) (wasi.Size, wasi.Errno)) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys, root := newFileSystem(b, ctx, newSystem)
+		fd := createFile(b, ctx, sys, root, "data", count*size)
+		iovecs := make([]wasi.IOVec, count)
+		for i := range iovecs {
+			iovecs[i] = make([]byte, size)
+		}
+		b.SetBytes(int64(count * size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, errno := op(sys, ctx, fd, iovecs, 0)
+			assertOK(b, errno)
+		}
+	}
+}
+
+func benchmarkFileStat(b *testing.B, ctx context.Context, newSystem newSystem) {
+	sys, root := newFileSystem(b, ctx, newSystem)
+	fd := createFile(b, ctx, sys, root, "data", 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, errno := sys.FDFileStatGet(ctx, fd)
+		assertOK(b, errno)
+	}
+}
+
+func benchmarkFileReadSeek(size int) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys, root := newFileSystem(b, ctx, newSystem)
+		fd := createFile(b, ctx, sys, root, "data", size)
+		iovecs := []wasi.IOVec{make([]byte, size)}
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, errno := sys.FDSeek(ctx, fd, 0, wasi.SeekStart)
+			assertOK(b, errno)
+			_, errno = sys.FDRead(ctx, fd, iovecs)
+			assertOK(b, errno)
+		}
+	}
+}
+
+func benchmarkFileWriteSeek(size int) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys, root := newFileSystem(b, ctx, newSystem)
+		fd := createFile(b, ctx, sys, root, "data", 0)
+		iovecs := []wasi.IOVec{make([]byte, size)}
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, errno := sys.FDSeek(ctx, fd, 0, wasi.SeekStart)
+			assertOK(b, errno)
+			_, errno = sys.FDWrite(ctx, fd, iovecs)
+			assertOK(b, errno)
+		}
+	}
+}
+
+func benchmarkPathOpen(path string) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys, root := newFileSystem(b, ctx, newSystem)
+		assertOK(b, sys.FDClose(ctx, createFile(b, ctx, sys, root, path, 0)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			fd, errno := sys.PathOpen(ctx, root, 0, path, 0, wasi.AllRights, wasi.AllRights, 0)
+			assertOK(b, errno)
+			assertOK(b, sys.FDClose(ctx, fd))
+		}
+	}
+}
+
+func benchmarkPathFileStat(path string) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys, root := newFileSystem(b, ctx, newSystem)
+		assertOK(b, sys.FDClose(ctx, createFile(b, ctx, sys, root, path, 0)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, errno := sys.PathFileStatGet(ctx, root, wasi.SymlinkFollow, path)
+			assertOK(b, errno)
+		}
+	}
+}
+
+func benchmarkReadDir(count int) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys, root := newFileSystem(b, ctx, newSystem)
+		for i := 0; i < count; i++ {
+			name := "dir/" + string(rune('a'+i/26)) + string(rune('a'+i%26))
+			assertOK(b, sys.FDClose(ctx, createFile(b, ctx, sys, root, name, 0)))
+		}
+		entries := make([]wasi.DirEntry, count+2)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			fd, errno := sys.PathOpen(ctx, root, 0, "dir", wasi.OpenDirectory, wasi.AllRights, wasi.AllRights, 0)
+			assertOK(b, errno)
+			n, errno := sys.FDReadDir(ctx, fd, entries, 0, 4096)
+			assertOK(b, errno)
+			if n == 0 {
+				b.Fatal("fd_readdir: no entries")
+			}
+			assertOK(b, sys.FDClose(ctx, fd))
+		}
+	}
+}
+
+func benchmarkPathCreateRemoveDirectory(b *testing.B, ctx context.Context, newSystem newSystem) {
+	sys, root := newFileSystem(b, ctx, newSystem)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assertOK(b, sys.PathCreateDirectory(ctx, root, "dir"))
+		assertOK(b, sys.PathRemoveDirectory(ctx, root, "dir"))
+	}
+}
+
+func benchmarkPathCreateUnlinkFile(b *testing.B, ctx context.Context, newSystem newSystem) {
+	sys, root := newFileSystem(b, ctx, newSystem)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fd, errno := sys.PathOpen(ctx, root, 0, "data", wasi.OpenCreate|wasi.OpenExclusive, wasi.AllRights, wasi.AllRights, 0)
+		assertOK(b, errno)
+		assertOK(b, sys.FDClose(ctx, fd))
+		assertOK(b, sys.PathUnlinkFile(ctx, root, "data"))
+	}
+}
+
+func benchmarkPollClock(b *testing.B, ctx context.Context, newSystem newSystem) {
+	sys := newSystem(wasitest.TestConfig{Now: time.Now})
+	subscriptions := []wasi.Subscription{subscribeTimeout(0)}
+	events := make([]wasi.Event, len(subscriptions))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pollOneOff(b, ctx, sys, subscriptions, events)
+	}
+}
+
+func benchmarkPollWrite(count int) benchmarkFunc {
+	return func(b *testing.B, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(wasitest.TestConfig{Stdout: discard{}})
+		subscriptions := make([]wasi.Subscription, count)
+		for i := range subscriptions {
+			subscriptions[i] = subscribeFDWrite(1)
+		}
+		events := make([]wasi.Event, len(subscriptions))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			pollOneOff(b, ctx, sys, subscriptions, events)
+		}
+	}
+}
+
+func benchmarkPollWriteClock(b *testing.B, ctx context.Context, newSystem newSystem) {
+	sys := newSystem(wasitest.TestConfig{Stdout: discard{}, Now: time.Now})
+	subscriptions := []wasi.Subscription{subscribeFDWrite(1), subscribeTimeout(time.Second)}
+	events := make([]wasi.Event, len(subscriptions))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pollOneOff(b, ctx, sys, subscriptions, events)
+	}
+}
+
+// newFileSystem creates a system with a temporary directory preopened as its
+// root file system, and returns the file descriptor of the directory.
+func newFileSystem(b *testing.B, ctx context.Context, newSystem newSystem) (wasi.System, wasi.FD) {
+	sys := newSystem(wasitest.TestConfig{RootFS: b.TempDir()})
+	for fd := wasi.FD(3); ; fd++ {
+		_, errno := sys.FDPreStatGet(ctx, fd)
+		if errno == wasi.EBADF {
+			b.Skip("system has no root file system")
+		}
+		if errno != wasi.ESUCCESS {
+			continue
+		}
+		if name, errno := sys.FDPreStatDirName(ctx, fd); errno == wasi.ESUCCESS && name == "/" {
+			return sys, fd
+		}
+	}
+}
+
+// createFile creates a file of the given size at path, as well as its parent
+// directories, and returns its file descriptor.
+func createFile(b *testing.B, ctx context.Context, sys wasi.System, root wasi.FD, path string, size int) wasi.FD {
+	b.Helper()
+	for i := range path {
+		if path[i] == '/' {
+			if errno := sys.PathCreateDirectory(ctx, root, path[:i]); errno != wasi.EEXIST {
+				assertOK(b, errno)
+			}
+		}
+	}
+	fd, errno := sys.PathOpen(ctx, root, 0, path, wasi.OpenCreate|wasi.OpenTruncate, wasi.AllRights, wasi.AllRights, 0)
+	assertOK(b, errno)
+	if size > 0 {
+		_, errno = sys.FDPwrite(ctx, fd, []wasi.IOVec{make([]byte, size)}, 0)
+		assertOK(b, errno)
+	}
+	return fd
+}
+
+func subscribeTimeout(timeout time.Duration) wasi.Subscription {
+	return wasi.MakeSubscriptionClock(0, wasi.SubscriptionClock{
+		ID:      wasi.Monotonic,
+		Timeout: wasi.Timestamp(timeout),
+	})
+}
+
+func subscribeFDWrite(fd wasi.FD) wasi.Subscription {
+	return wasi.MakeSubscriptionFDReadWrite(wasi.UserData(fd), wasi.FDWriteEvent, wasi.SubscriptionFDReadWrite{FD: fd})
+}
+
+func subscribeFDRead(fd wasi.FD) wasi.Subscription {
+	return wasi.MakeSubscriptionFDReadWrite(wasi.UserData(fd), wasi.FDReadEvent, wasi.SubscriptionFDReadWrite{FD: fd})
+}
+
+func pollOneOff(b *testing.B, ctx context.Context, sys wasi.System, subscriptions []wasi.Subscription, events []wasi.Event) int {
+	n, errno := sys.PollOneOff(ctx, subscriptions, events)
+	assertOK(b, errno)
+	for _, e := range events[:n] {
+		assertOK(b, e.Errno)
+	}
+	if n == 0 {
+		b.Fatal("poll_oneoff: no events")
+	}
+	return n
+}
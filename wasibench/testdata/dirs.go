@@ -0,0 +1,50 @@
+// This program creates a tree of small files, lists and stats them, then
+// removes the tree, like build tools and package managers do.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	numDirs  = 16
+	numFiles = 64
+)
+
+func main() {
+	for i := 0; i < numDirs; i++ {
+		dir := filepath.Join("tree", fmt.Sprintf("dir%02d", i))
+		check(os.MkdirAll(dir, 0755))
+		for j := 0; j < numFiles; j++ {
+			path := filepath.Join(dir, fmt.Sprintf("file%02d", j))
+			check(os.WriteFile(path, []byte(path), 0644))
+		}
+	}
+
+	count := 0
+	check(filepath.WalkDir("tree", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if _, err := os.ReadFile(path); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	}))
+	if count != numDirs*numFiles {
+		panic(fmt.Sprintf("found %d files", count))
+	}
+
+	check(os.RemoveAll("tree"))
+}
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,48 @@
+// This program writes a file in small chunks, then reads it back sequentially
+// and at random offsets, like programs processing data files do.
+package main
+
+import (
+	"io"
+	"math/rand"
+	"os"
+)
+
+const (
+	fileSize  = 4 << 20
+	chunkSize = 4096
+)
+
+func main() {
+	f, err := os.Create("data")
+	check(err)
+	defer f.Close()
+
+	chunk := make([]byte, chunkSize)
+	for i := 0; i < fileSize/chunkSize; i++ {
+		_, err := f.Write(chunk)
+		check(err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	check(err)
+	for {
+		_, err := f.Read(chunk)
+		if err == io.EOF {
+			break
+		}
+		check(err)
+	}
+
+	prng := rand.New(rand.NewSource(0))
+	for i := 0; i < fileSize/chunkSize; i++ {
+		_, err := f.ReadAt(chunk, prng.Int63n(fileSize-chunkSize))
+		check(err)
+	}
+}
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
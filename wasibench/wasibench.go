@@ -0,0 +1,120 @@
+// Package wasibench is a benchmark suite for wasi.System implementations.
+//
+// The benchmarks exercise the hot paths of the system calls that guests make
+// the most (file I/O, path resolution, polling and sockets) directly against
+// the System interface, and BenchmarkWASIP1 measures the execution of guest
+// programs, so the performance of different implementations, or of changes
+// to one implementation, can be compared with the same workloads:
+//
+//	func BenchmarkSystem(b *testing.B) {
+//		wasibench.BenchmarkSystem(b, makeSystem)
+//	}
+//
+// The systems are created with the wasitest.MakeSystem functions used to run
+// the conformance test suites.
+package wasibench
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/wasitest"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// BenchmarkSystem runs the benchmark suite against the systems created by
+// makeSystem.
+//
+// Benchmarks of features that the system does not support are skipped.
+func BenchmarkSystem(b *testing.B, makeSystem wasitest.MakeSystem) {
+	for _, suite := range []struct {
+		name string
+		benchmarks
+	}{
+		{"file", file},
+		{"path", path},
+		{"poll", poll},
+		{"socket", socket},
+	} {
+		b.Run(suite.name, suite.runFunc(makeSystem))
+	}
+}
+
+// BenchmarkProviders runs the BenchmarkSystem suite against each provider,
+// in sub-benchmarks named after the providers.
+func BenchmarkProviders(b *testing.B, providers ...wasitest.Provider) {
+	for _, p := range providers {
+		makeSystem := p.MakeSystem
+		b.Run(p.Name, func(b *testing.B) { BenchmarkSystem(b, makeSystem) })
+	}
+}
+
+// newSystem creates a system with the configuration, which is closed when the
+// benchmark completes.
+type newSystem func(wasitest.TestConfig) wasi.System
+
+type benchmarkFunc func(*testing.B, context.Context, newSystem)
+
+type benchmarks map[string]benchmarkFunc
+
+func (suite benchmarks) runFunc(makeSystem wasitest.MakeSystem) func(*testing.B) {
+	return func(b *testing.B) {
+		names := maps.Keys(suite)
+		slices.Sort(names)
+		for _, name := range names {
+			bench := suite[name]
+			b.Run(name, func(b *testing.B) {
+				ctx := context.Background()
+				bench(b, ctx, func(config wasitest.TestConfig) wasi.System {
+					s, err := makeSystem(config)
+					if err != nil {
+						b.Fatalf("system initialization failed: %s", err)
+					}
+					b.Cleanup(func() {
+						if err := s.Close(ctx); err != nil {
+							b.Errorf("system closure failed: %s", err)
+						}
+					})
+					return s
+				})
+			})
+		}
+	}
+}
+
+func assertOK(b *testing.B, errno wasi.Errno) {
+	switch errno {
+	case wasi.ESUCCESS:
+	case wasi.ENOSYS, wasi.ENOTSUP:
+		b.Helper()
+		b.Skipf("operation not supported by this system: %s", errno)
+	default:
+		b.Helper()
+		b.Fatal(errno)
+	}
+}
+
+// discard is the standard output and error of the systems.
+type discard struct{}
+
+func (discard) Write(b []byte) (int, error) { return len(b), nil }
+func (discard) Close() error                { return nil }
+
+// zero is the standard input of the systems, which never ends.
+type zero struct{}
+
+func (zero) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+func (zero) Close() error { return nil }
+
+var (
+	_ io.WriteCloser = discard{}
+	_ io.ReadCloser  = zero{}
+)
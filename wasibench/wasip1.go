@@ -0,0 +1,99 @@
+package wasibench
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go/imports/wasi_snapshot_preview1"
+	"github.com/stealthrocket/wasi-go/wasitest"
+	"github.com/stealthrocket/wazergo"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// BenchmarkWASIP1 measures the execution of the WebAssembly programs passed
+// as file paths, with a system created by makeSystem for each run.
+//
+// The programs are compiled once, so the benchmarks measure their
+// instantiation and execution. Each run has an empty temporary directory
+// preopened as its root file system, and the current working directory of
+// the programs.
+//
+// The representative workloads of the testdata directory of this package
+// are compiled with "make testdata".
+func BenchmarkWASIP1(b *testing.B, filePaths []string, makeSystem wasitest.MakeSystem) {
+	if len(filePaths) == 0 {
+		b.Skip("nothing to benchmark")
+	}
+
+	for _, path := range filePaths {
+		name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+		path := path
+
+		b.Run(name, func(b *testing.B) {
+			bytecode, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+
+			runtime := wazero.NewRuntime(ctx)
+			defer runtime.Close(ctx)
+
+			module, err := runtime.CompileModule(ctx, bytecode)
+			if err != nil {
+				b.Fatal(err)
+			}
+			hostModule := wasi_snapshot_preview1.NewHostModule()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				rootFS := b.TempDir()
+				b.StartTimer()
+				runWASIP1(b, ctx, runtime, module, hostModule, name, rootFS, makeSystem)
+			}
+		})
+	}
+}
+
+func runWASIP1(b *testing.B, ctx context.Context, runtime wazero.Runtime, module wazero.CompiledModule, hostModule wazergo.HostModule[*wasi_snapshot_preview1.Module], name, rootFS string, makeSystem wasitest.MakeSystem) {
+	system, err := makeSystem(wasitest.TestConfig{
+		Args:    []string{name},
+		Environ: []string{"PWD=/"},
+		Stdin:   zero{},
+		Stdout:  discard{},
+		Stderr:  discard{},
+		Rand:    rand.Reader,
+		Now:     time.Now,
+		RootFS:  rootFS,
+	})
+	if err != nil {
+		b.Fatal("system:", err)
+	}
+	defer system.Close(ctx)
+
+	instance := wazergo.MustInstantiate(ctx, runtime, hostModule, wasi_snapshot_preview1.WithWASI(system))
+	defer instance.Close(ctx)
+	ctx = wazergo.WithModuleInstance(ctx, instance)
+
+	guest, err := runtime.InstantiateModule(ctx, module, wazero.NewModuleConfig())
+	if err != nil {
+		switch e := err.(type) {
+		case *sys.ExitError:
+			if exitCode := e.ExitCode(); exitCode != 0 {
+				b.Fatal("exit code:", exitCode)
+			}
+		default:
+			b.Fatal("instantiating wasm module instance:", err)
+		}
+	}
+	if guest != nil {
+		guest.Close(ctx)
+	}
+}
@@ -0,0 +1,199 @@
+package wasirun
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// BundleConfigFile is the name of the file holding the configuration of the
+// module in a bundle.
+const BundleConfigFile = "wasirun.json"
+
+// BundleConfig is the configuration of the module packaged in a bundle.
+//
+// The options of the bundle are applied before those passed to Run: the
+// arguments of the bundle are placed before the arguments passed to Run,
+// and environment variables passed to Run override those of the bundle.
+type BundleConfig struct {
+	// Module is the path of the WebAssembly module in the bundle. Defaults
+	// to "module.wasm".
+	Module string `json:"module,omitempty"`
+	// Name is the name of the module, exposed to the module as argv[0].
+	Name string `json:"name,omitempty"`
+	// Args are the arguments passed to the module.
+	Args []string `json:"args,omitempty"`
+	// Env are the environment variables passed to the module.
+	Env []string `json:"env,omitempty"`
+	// Dirs are the directories of the bundle that the module is granted
+	// access to, with the same syntax as Options.Dirs but with host paths
+	// relative to the root of the bundle (e.g. "assets:/assets:ro").
+	Dirs []string `json:"dirs,omitempty"`
+}
+
+// Bundle is a WebAssembly module loaded by OpenBundle, either from a module
+// file or from a bundle archive.
+type Bundle struct {
+	// Module is the byte code of the WebAssembly module.
+	Module []byte
+	// Config is the configuration of the bundle, which is empty when the
+	// module was not loaded from a bundle.
+	Config BundleConfig
+	// Dir is the temporary directory that the files of the bundle were
+	// extracted to, or the empty string if the module was not loaded from
+	// a bundle.
+	Dir string
+}
+
+var (
+	wasmMagic = []byte("\x00asm")
+	zstdMagic = []byte("\x28\xb5\x2f\xfd")
+)
+
+// OpenBundle loads the WebAssembly module at path, which may be either:
+//
+//   - a WebAssembly module (e.g. app.wasm)
+//   - a WebAssembly module compressed with zstd (e.g. app.wasm.zst)
+//   - a bundle, which is a tar archive optionally compressed with zstd,
+//     containing the module, its configuration in a wasirun.json file (see
+//     BundleConfig), and the assets that it needs
+//
+// The format is detected from the content of the file, not its name. The
+// files of bundles are extracted to a temporary directory, which is removed
+// when the Bundle is closed.
+//
+// Bundles can be created with tar, for example:
+//
+//	tar --zstd -cf app.tar.zst wasirun.json module.wasm assets/
+func OpenBundle(path string) (*Bundle, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, zstdMagic) {
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		if b, err = d.DecodeAll(b, nil); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if bytes.HasPrefix(b, wasmMagic) {
+		return &Bundle{Module: b}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "wasirun-bundle-")
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{Dir: dir}
+	if err := bundle.extract(bytes.NewReader(b)); err != nil {
+		bundle.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return bundle, nil
+}
+
+func (b *Bundle) extract(r io.Reader) error {
+	t := tar.NewReader(r)
+	for {
+		header, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == tar.ErrHeader {
+				err = errors.New("not a WebAssembly module or bundle")
+			}
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path in bundle: %q", header.Name)
+		}
+		path := filepath.Join(b.Dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm()|0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, t)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			// Links could be used to escape the directory of the bundle,
+			// only regular files and directories are supported.
+			return fmt.Errorf("unsupported file type in bundle: %q", header.Name)
+		}
+	}
+
+	config, err := os.ReadFile(filepath.Join(b.Dir, BundleConfigFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(config, &b.Config); err != nil {
+			return fmt.Errorf("%s: %w", BundleConfigFile, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	module := filepath.Clean(filepath.FromSlash(defaultString(b.Config.Module, "module.wasm")))
+	if !filepath.IsLocal(module) {
+		return fmt.Errorf("invalid module path in bundle: %q", b.Config.Module)
+	}
+	if b.Module, err = os.ReadFile(filepath.Join(b.Dir, module)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Dirs returns the directories of the bundle configuration, with host paths
+// resolved to the directory that the bundle was extracted to.
+func (b *Bundle) Dirs() ([]string, error) {
+	dirs := make([]string, len(b.Config.Dirs))
+	for i, dir := range b.Config.Dirs {
+		host, guest, _ := strings.Cut(dir, ":")
+		host = filepath.Clean(filepath.FromSlash(host))
+		if !filepath.IsLocal(host) {
+			return nil, fmt.Errorf("invalid directory in bundle: %q", dir)
+		}
+		if guest == "" || guest == "ro" {
+			// Expose the directory to the guest with the path that it has
+			// in the bundle, rather than the temporary directory.
+			guest = strings.TrimSuffix(filepath.ToSlash(host)+":"+guest, ":")
+		}
+		dirs[i] = filepath.Join(b.Dir, host) + ":" + guest
+	}
+	return dirs, nil
+}
+
+// Close removes the files extracted from the bundle.
+func (b *Bundle) Close() error {
+	if b.Dir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.Dir)
+}
@@ -0,0 +1,258 @@
+package wasirun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// coreDumper is a function listener which tracks the call stack of the guest,
+// and captures a coredump when it traps.
+//
+// The coredump follows the format of the WebAssembly tool conventions
+// (https://github.com/WebAssembly/tool-conventions/blob/main/Coredump.md):
+// it is a WebAssembly module with the memory and globals of the instance,
+// and custom sections describing the process, the module, and the stack.
+//
+// The frames of the stack only record the parameters of functions as their
+// locals, and their code offsets are zero, since the runtime does not expose
+// the state of the functions.
+type coreDumper struct {
+	name   string
+	mutex  sync.Mutex
+	frames []coreFrame
+	dump   []byte
+}
+
+type coreFrame struct {
+	funcIndex uint32
+	types     []api.ValueType
+	params    []uint64
+}
+
+var _ experimental.FunctionListenerFactory = (*coreDumper)(nil)
+
+func (d *coreDumper) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() != nil {
+		return nil // host functions are not part of the guest stack
+	}
+	return d
+}
+
+func (d *coreDumper) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, _ experimental.StackIterator) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.frames = append(d.frames, coreFrame{
+		funcIndex: def.Index(),
+		types:     def.ParamTypes(),
+		params:    append([]uint64(nil), params...),
+	})
+}
+
+func (d *coreDumper) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pop()
+}
+
+func (d *coreDumper) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// Abort is called for each frame unwound by a trap, the coredump is
+	// captured at the first one when the whole stack is known. Exits of the
+	// guest also unwind the stack, but are not traps.
+	var exitErr *sys.ExitError
+	if d.dump == nil && !errors.As(err, &exitErr) {
+		d.dump = d.encode(mod)
+	}
+	d.pop()
+}
+
+func (d *coreDumper) pop() {
+	if n := len(d.frames); n > 0 {
+		d.frames = d.frames[:n-1]
+	}
+}
+
+// writeTo writes the coredump captured when the guest trapped to path, and
+// returns false if the guest did not trap.
+func (d *coreDumper) writeTo(path string) (bool, error) {
+	d.mutex.Lock()
+	dump := d.dump
+	d.mutex.Unlock()
+	if dump == nil {
+		return false, nil
+	}
+	return true, os.WriteFile(path, dump, 0644)
+}
+
+func (d *coreDumper) encode(mod api.Module) []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+
+	b = appendSection(b, 0, func(s []byte) []byte {
+		s = appendName(s, "core")
+		s = append(s, 0x00)
+		return appendName(s, d.name)
+	})
+	b = appendSection(b, 0, func(s []byte) []byte {
+		s = appendName(s, "coremodules")
+		s = appendU32(s, 1)
+		s = append(s, 0x00)
+		return appendName(s, mod.Name())
+	})
+
+	var globals []api.Global
+	if m, ok := mod.(experimental.InternalModule); ok {
+		for i := 0; i < m.NumGlobal(); i++ {
+			globals = append(globals, m.Global(i))
+		}
+	}
+	memory := mod.Memory()
+
+	b = appendSection(b, 0, func(s []byte) []byte {
+		s = appendName(s, "coreinstances")
+		s = appendU32(s, 1)
+		s = append(s, 0x00)
+		s = appendU32(s, 0) // module index
+		if memory != nil {
+			s = appendU32(s, 1)
+			s = appendU32(s, 0)
+		} else {
+			s = appendU32(s, 0)
+		}
+		s = appendU32(s, uint32(len(globals)))
+		for i := range globals {
+			s = appendU32(s, uint32(i))
+		}
+		return s
+	})
+	b = appendSection(b, 0, func(s []byte) []byte {
+		s = appendName(s, "corestack")
+		s = append(s, 0x00)
+		s = appendName(s, "main")
+		s = appendU32(s, uint32(len(d.frames)))
+		// Frames are ordered from the top of the stack, where the guest
+		// trapped.
+		for i := len(d.frames) - 1; i >= 0; i-- {
+			f := d.frames[i]
+			s = append(s, 0x00)
+			s = appendU32(s, 0) // instance index
+			s = appendU32(s, f.funcIndex)
+			s = appendU32(s, 0) // code offset
+			s = appendU32(s, uint32(len(f.params)))
+			for j, v := range f.params {
+				s = appendValue(s, f.types[j], v)
+			}
+			s = appendU32(s, 0) // stack
+		}
+		return s
+	})
+
+	if memory != nil {
+		size := memory.Size()
+		b = appendSection(b, 5, func(s []byte) []byte {
+			s = appendU32(s, 1)
+			s = append(s, 0x00)
+			return appendU32(s, size/65536)
+		})
+	}
+	if len(globals) > 0 {
+		b = appendSection(b, 6, func(s []byte) []byte {
+			s = appendU32(s, uint32(len(globals)))
+			for _, g := range globals {
+				_, mutable := g.(api.MutableGlobal)
+				t := g.Type()
+				switch t {
+				case api.ValueTypeI32, api.ValueTypeI64, api.ValueTypeF32, api.ValueTypeF64:
+				default:
+					t = api.ValueTypeExternref
+				}
+				s = append(s, t)
+				if mutable {
+					s = append(s, 0x01)
+				} else {
+					s = append(s, 0x00)
+				}
+				s = appendConst(s, t, g.Get())
+				s = append(s, 0x0B) // end
+			}
+			return s
+		})
+	}
+	if memory != nil {
+		data, _ := memory.Read(0, memory.Size())
+		b = appendSection(b, 11, func(s []byte) []byte {
+			s = appendU32(s, 1)
+			s = append(s, 0x00)
+			s = append(s, 0x41, 0x00, 0x0B) // i32.const 0; end
+			s = appendU32(s, uint32(len(data)))
+			return append(s, data...)
+		})
+	}
+	return b
+}
+
+func appendSection(b []byte, id byte, content func([]byte) []byte) []byte {
+	s := content(nil)
+	b = append(b, id)
+	b = appendU32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendName(b []byte, name string) []byte {
+	b = appendU32(b, uint32(len(name)))
+	return append(b, name...)
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendS64(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// appendValue appends a value of a frame of the corestack section.
+func appendValue(b []byte, t api.ValueType, v uint64) []byte {
+	switch t {
+	case api.ValueTypeI32:
+		return appendS64(append(b, 0x7F), int64(int32(v)))
+	case api.ValueTypeI64:
+		return appendS64(append(b, 0x7E), int64(v))
+	case api.ValueTypeF32:
+		return binary.LittleEndian.AppendUint32(append(b, 0x7D), uint32(v))
+	case api.ValueTypeF64:
+		return binary.LittleEndian.AppendUint64(append(b, 0x7C), v)
+	default:
+		return append(b, 0x01) // missing
+	}
+}
+
+// appendConst appends the constant instruction initializing a global.
+func appendConst(b []byte, t api.ValueType, v uint64) []byte {
+	switch t {
+	case api.ValueTypeI32:
+		return appendS64(append(b, 0x41), int64(int32(v)))
+	case api.ValueTypeI64:
+		return appendS64(append(b, 0x42), int64(v))
+	case api.ValueTypeF32:
+		return binary.LittleEndian.AppendUint32(append(b, 0x43), uint32(v))
+	case api.ValueTypeF64:
+		return binary.LittleEndian.AppendUint64(append(b, 0x44), v)
+	default:
+		return append(b, 0xD0, 0x6F) // ref.null extern
+	}
+}
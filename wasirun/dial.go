@@ -0,0 +1,108 @@
+package wasirun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/internal/proxy"
+)
+
+// dialPolicy returns the policy restricting the connections of the module,
+// or nil if they are unrestricted.
+func dialPolicy(options Options) *wasi.Policy {
+	if len(options.AllowDials) == 0 {
+		if options.Policy == nil || options.Policy.Network == nil {
+			return nil
+		}
+		return options.Policy
+	}
+	var policy wasi.Policy
+	if options.Policy != nil {
+		policy = *options.Policy
+	}
+	policy = policy.AllowDials(options.AllowDials...)
+	return &policy
+}
+
+// httpClient returns the HTTP client sending the requests that the module
+// makes with wasi-http, or nil if the default client can be used.
+//
+// The client resolves host names with the resolver of the options, only
+// connects to the destinations allowed by the policy, and routes the
+// connections through the proxy of the options.
+func httpClient(options Options) *http.Client {
+	policy := dialPolicy(options)
+	resolver := options.Resolver
+	if policy == nil && resolver == nil && options.Proxy == nil {
+		return nil
+	}
+
+	dialer := new(net.Dialer)
+	dial := dialer.DialContext
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.Proxy != nil {
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return proxy.Dial(ctx, options.Proxy, address, dialer.DialContext)
+		}
+		// The proxy replaces those configured in the environment.
+		transport.Proxy = nil
+	}
+	transport.DialContext = dial
+	if policy == nil && resolver == nil {
+		// Let the proxy resolve the host names.
+		return &http.Client{Transport: transport}
+	}
+
+	if resolver == nil {
+		resolver = func(ctx context.Context, name string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", name)
+		}
+	}
+	allowed := func(address string) bool {
+		return policy == nil || policy.AllowsDial(address)
+	}
+
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			if !allowed(address) {
+				return nil, fmt.Errorf("dial %s: %w", address, os.ErrPermission)
+			}
+			return dial(ctx, network, address)
+		}
+		ips, err := resolver(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		// The policy may grant access to the name, or to the addresses
+		// that it resolves to.
+		nameAllowed := allowed(address)
+		err = fmt.Errorf("dial %s: %w", address, os.ErrPermission)
+		for _, ip := range ips {
+			if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+				continue
+			}
+			ipPort := net.JoinHostPort(ip.String(), port)
+			if !nameAllowed && !allowed(ipPort) {
+				continue
+			}
+			conn, dialErr := dial(ctx, network, ipPort)
+			if dialErr == nil {
+				return conn, nil
+			}
+			err = dialErr
+		}
+		return nil, err
+	}
+	return &http.Client{Transport: transport}
+}
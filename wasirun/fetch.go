@@ -0,0 +1,182 @@
+package wasirun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fetchClient is the HTTP client downloading modules from URLs.
+var fetchClient = &http.Client{CheckRedirect: checkFetchRedirect}
+
+// checkFetchRedirect rejects redirects to URLs other than https, which would
+// download the module in clear text.
+func checkFetchRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported URL scheme '%s', expected https", req.URL.Scheme)
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// IsModuleURL returns true if module is the URL of a WebAssembly module
+// downloaded with FetchModule.
+func IsModuleURL(module string) bool {
+	return strings.HasPrefix(module, "https://")
+}
+
+// FetchModule downloads the WebAssembly module at the HTTPS URL, and returns
+// the path of the file that it was written to, which can be passed to
+// OpenBundle.
+//
+// Modules are cached in the user cache directory (e.g. ~/.cache/wasirun). If
+// checksum is not empty, it is the hex-encoded SHA-256 hash that the content
+// of the module must have, and the module is only downloaded if it is not in
+// the cache already. Otherwise, the cached module is revalidated with the
+// server using its ETag or modification time, and used as is if the server
+// cannot be reached.
+func FetchModule(ctx context.Context, moduleURL, checksum string) (string, error) {
+	u, err := url.Parse(moduleURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL scheme '%s', expected https", u.Scheme)
+	}
+	if checksum != "" {
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("invalid SHA-256 checksum '%s'", checksum)
+		}
+		checksum = strings.ToLower(checksum)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	// Pinned modules are cached by content, so they are shared by the URLs
+	// serving the same module. Other modules are cached by URL, along with
+	// the validators of their HTTP response.
+	var cachePath string
+	if checksum != "" {
+		cachePath = filepath.Join(cacheDir, "wasirun", "https", "sha256", checksum)
+		if _, err := os.Stat(cachePath); err == nil {
+			return cachePath, nil
+		}
+	} else {
+		key := sha256.Sum256([]byte(moduleURL))
+		cachePath = filepath.Join(cacheDir, "wasirun", "https", "url", hex.EncodeToString(key[:]))
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, moduleURL, nil)
+	if err != nil {
+		return "", err
+	}
+	cached := false
+	if checksum == "" {
+		var validators fetchValidators
+		if b, err := os.ReadFile(cachePath + ".json"); err == nil && json.Unmarshal(b, &validators) == nil {
+			if _, err := os.Stat(cachePath); err == nil {
+				cached = true
+				if validators.ETag != "" {
+					req.Header.Set("If-None-Match", validators.ETag)
+				}
+				if validators.LastModified != "" {
+					req.Header.Set("If-Modified-Since", validators.LastModified)
+				}
+			}
+		}
+	}
+
+	res, err := fetchClient.Do(req)
+	if err != nil {
+		if cached && ctx.Err() == nil {
+			return cachePath, nil
+		}
+		return "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if cached {
+			return cachePath, nil
+		}
+		fallthrough
+	default:
+		return "", fmt.Errorf("GET %s: %s", moduleURL, res.Status)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(cachePath), path.Base(cachePath)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, sum), res.Body); err != nil {
+		return "", fmt.Errorf("GET %s: %w", moduleURL, err)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); checksum != "" && got != checksum {
+		return "", fmt.Errorf("GET %s: checksum mismatch: want=%s got=%s", moduleURL, checksum, got)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), cachePath); err != nil {
+		return "", err
+	}
+	if checksum == "" {
+		validators := fetchValidators{
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+		}
+		b, _ := json.Marshal(validators)
+		if err := os.WriteFile(cachePath+".json", b, 0644); err != nil {
+			return "", err
+		}
+	}
+	return cachePath, nil
+}
+
+// fetchValidators are the values of the HTTP response of a module used to
+// revalidate its cached copy.
+type fetchValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// verifyChecksum returns an error if the content of the file at path does
+// not have the hex-encoded SHA-256 hash checksum.
+func verifyChecksum(path, checksum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); !strings.EqualFold(got, checksum) {
+		return fmt.Errorf("%s: checksum mismatch: want=%s got=%s", path, checksum, got)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package wasirun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFetchModule(t *testing.T) {
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	sum := sha256.Sum256(module)
+	checksum := hex.EncodeToString(sum[:])
+
+	requests, notModified := 0, 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/moved.wasm":
+			http.Redirect(w, r, "/app.wasm", http.StatusMovedPermanently)
+			return
+		case "/insecure.wasm":
+			http.Redirect(w, r, "http://"+r.Host+"/app.wasm", http.StatusMovedPermanently)
+			return
+		}
+		if r.URL.Path != "/app.wasm" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(module)
+	}))
+	defer server.Close()
+
+	client := fetchClient
+	fetchClient = server.Client()
+	fetchClient.CheckRedirect = checkFetchRedirect
+	defer func() { fetchClient = client }()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	ctx := context.Background()
+	moduleURL := server.URL + "/app.wasm"
+
+	for i := 0; i < 2; i++ {
+		path, err := FetchModule(ctx, moduleURL, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(path); string(b) != string(module) {
+			t.Errorf("wrong module content: %q", b)
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("the cached module was not revalidated: requests=%d not-modified=%d", requests, notModified)
+	}
+
+	// Pinned modules are downloaded once.
+	requests = 0
+	for i := 0; i < 2; i++ {
+		if _, err := FetchModule(ctx, moduleURL, strings.ToUpper(checksum)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("wrong number of requests: want=1 got=%d", requests)
+	}
+
+	wrong := strings.Repeat("0", len(checksum))
+	if _, err := FetchModule(ctx, moduleURL, wrong); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("downloading a module with the wrong checksum did not fail: %v", err)
+	}
+	if _, err := FetchModule(ctx, server.URL+"/missing.wasm", ""); err == nil {
+		t.Error("downloading a missing module did not fail")
+	}
+	if _, err := FetchModule(ctx, "http://example.com/app.wasm", ""); err == nil {
+		t.Error("downloading a module over HTTP did not fail")
+	}
+	if _, err := FetchModule(ctx, server.URL+"/moved.wasm", ""); err != nil {
+		t.Errorf("downloading a module redirected to HTTPS failed: %v", err)
+	}
+	if _, err := FetchModule(ctx, server.URL+"/insecure.wasm", ""); err == nil || !strings.Contains(err.Error(), "expected https") {
+		t.Errorf("downloading a module redirected to HTTP did not fail: %v", err)
+	}
+}
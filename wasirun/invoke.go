@@ -0,0 +1,98 @@
+package wasirun
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Invoke calls the function exported by module under name, with the
+// arguments parsed according to the types of its parameters, and returns its
+// results formatted as strings.
+//
+// Integer arguments can be given in decimal, or in hexadecimal, octal, or
+// binary with the 0x, 0o, or 0b prefixes; i32 and i64 arguments can be
+// either signed or unsigned, while results are formatted as signed integers.
+// Floating point arguments and results use the formats of strconv.ParseFloat
+// and strconv.FormatFloat.
+func Invoke(ctx context.Context, module api.Module, name string, args ...string) ([]string, error) {
+	fn := module.ExportedFunction(name)
+	if fn == nil {
+		return nil, fmt.Errorf("function '%s' is not exported by the module", name)
+	}
+	def := fn.Definition()
+	paramTypes := def.ParamTypes()
+	if len(args) != len(paramTypes) {
+		return nil, fmt.Errorf("function '%s' expects %d argument(s), got %d", name, len(paramTypes), len(args))
+	}
+
+	params := make([]uint64, len(args))
+	for i, arg := range args {
+		param, err := parseValue(paramTypes[i], arg)
+		if err != nil {
+			return nil, fmt.Errorf("function '%s': argument %d: %w", name, i, err)
+		}
+		params[i] = param
+	}
+
+	results, err := fn.Call(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	resultTypes := def.ResultTypes()
+	values := make([]string, len(results))
+	for i, result := range results {
+		values[i] = formatValue(resultTypes[i], result)
+	}
+	return values, nil
+}
+
+func parseValue(t api.ValueType, s string) (uint64, error) {
+	switch t {
+	case api.ValueTypeI32:
+		v, err := parseInt(s, 32)
+		return uint64(uint32(v)), err
+	case api.ValueTypeI64:
+		v, err := parseInt(s, 64)
+		return v, err
+	case api.ValueTypeF32:
+		v, err := strconv.ParseFloat(s, 32)
+		return api.EncodeF32(float32(v)), err
+	case api.ValueTypeF64:
+		v, err := strconv.ParseFloat(s, 64)
+		return api.EncodeF64(v), err
+	default:
+		return 0, fmt.Errorf("unsupported parameter type %s", api.ValueTypeName(t))
+	}
+}
+
+// parseInt parses s as a signed or unsigned integer of the given bit size,
+// returning its two's complement representation.
+func parseInt(s string, bitSize int) (uint64, error) {
+	if v, err := strconv.ParseInt(s, 0, bitSize); err == nil {
+		return uint64(v), nil
+	}
+	v, err := strconv.ParseUint(s, 0, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid i%d value '%s'", bitSize, s)
+	}
+	return v, nil
+}
+
+func formatValue(t api.ValueType, v uint64) string {
+	switch t {
+	case api.ValueTypeI32:
+		return strconv.FormatInt(int64(api.DecodeI32(v)), 10)
+	case api.ValueTypeI64:
+		return strconv.FormatInt(int64(v), 10)
+	case api.ValueTypeF32:
+		return strconv.FormatFloat(float64(api.DecodeF32(v)), 'g', -1, 32)
+	case api.ValueTypeF64:
+		return strconv.FormatFloat(api.DecodeF64(v), 'g', -1, 64)
+	default:
+		return fmt.Sprintf("0x%x", v)
+	}
+}
@@ -0,0 +1,358 @@
+package wasirun
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// memorySamplePeriod is the interval between the samples of the memory
+// monitor.
+const memorySamplePeriod = time.Second
+
+// MemoryMonitor samples the memory usage of the instances of the modules run
+// with Options.MemoryMonitor, to plan the capacity of hosts running fleets of
+// modules. The same monitor can be shared by multiple calls to Run.
+//
+// The usage of each instance is the size of its linear memory. The memory
+// allocated by the host to run the instances (e.g. for their compiled code,
+// buffers, and sockets) cannot be attributed to individual instances, it is
+// reported for the process as a whole.
+//
+// The monitor implements http.Handler, serving the memory usage as a profile
+// in the pprof format.
+type MemoryMonitor struct {
+	mutex     sync.Mutex
+	start     time.Time
+	running   int
+	stop      chan struct{}
+	done      chan struct{}
+	instances []*instanceMemory
+	host      uint64
+	peakHost  uint64
+	sample    []metrics.Sample
+}
+
+// instanceMemory is the memory usage of an instance. The linear memory is
+// only accessed by the goroutine running the instance, which publishes its
+// size for the monitor to read.
+type instanceMemory struct {
+	module   string
+	instance int
+	memory   api.Memory
+	size     atomic.Uint64
+	exited   bool
+}
+
+// sample publishes the size of the linear memory of the instance; it must be
+// called by the goroutine running the instance.
+func (i *instanceMemory) sample() {
+	if i.memory != nil {
+		i.size.Store(uint64(i.memory.Size()))
+	}
+}
+
+type instanceMemoryKey struct{}
+
+// memorySampler is a function listener which samples the linear memory of
+// the instances when they call host functions, on the goroutines running
+// them. The listeners of host modules are shared by the runtimes using the
+// same compilation cache, the instance is therefore found in the context of
+// the calls (see MemoryMonitor.track).
+type memorySampler struct{}
+
+var _ experimental.FunctionListenerFactory = memorySampler{}
+
+func (s memorySampler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() == nil {
+		return nil // only the calls to the host are sampled
+	}
+	return s
+}
+
+func (memorySampler) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if i, ok := ctx.Value(instanceMemoryKey{}).(*instanceMemory); ok {
+		i.sample()
+	}
+}
+
+func (memorySampler) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (memorySampler) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+// MemoryUsage is the memory usage of an instance of a module.
+type MemoryUsage struct {
+	// Module is the name of the module.
+	Module string
+	// Instance is the index of the instance, from zero.
+	Instance int
+	// LinearMemory is the size of the linear memory of the instance, in
+	// bytes. Linear memories never shrink, so it is also the peak size of
+	// the linear memory.
+	LinearMemory uint64
+	// Exited is true if the instance has exited, in which case LinearMemory
+	// is the size of its linear memory when it exited.
+	Exited bool
+}
+
+// MemoryReport is the memory usage of the instances tracked by a
+// MemoryMonitor.
+type MemoryReport struct {
+	// Instances is the memory usage of each instance, in the order they
+	// were started.
+	Instances []MemoryUsage
+	// HostMemory is the memory allocated by the host, excluding the linear
+	// memories of the running instances, in bytes.
+	HostMemory uint64
+	// PeakHostMemory is the peak of HostMemory since the monitor started
+	// sampling, in bytes.
+	PeakHostMemory uint64
+}
+
+// NewMemoryMonitor creates a memory monitor. It samples the memory usage
+// while modules run with it.
+func NewMemoryMonitor() *MemoryMonitor {
+	return &MemoryMonitor{
+		sample: []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}},
+	}
+}
+
+// LinearMemory returns the total size of the linear memories of the running
+// instances, in bytes.
+func (m *MemoryMonitor) LinearMemory() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.update()
+	total := uint64(0)
+	for _, i := range m.instances {
+		if !i.exited {
+			total += i.size.Load()
+		}
+	}
+	return total
+}
+
+// Report returns the memory usage of the instances tracked by the monitor.
+func (m *MemoryMonitor) Report() MemoryReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.update()
+	r := MemoryReport{
+		Instances:      make([]MemoryUsage, len(m.instances)),
+		HostMemory:     m.host,
+		PeakHostMemory: m.peakHost,
+	}
+	for n, i := range m.instances {
+		r.Instances[n] = MemoryUsage{
+			Module:       i.module,
+			Instance:     i.instance,
+			LinearMemory: i.size.Load(),
+			Exited:       i.exited,
+		}
+	}
+	return r
+}
+
+// ServeHTTP serves the memory usage as a profile in the pprof format, with a
+// sample for the linear memory of each instance and a sample for the memory
+// of the host.
+func (m *MemoryMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	m.update()
+	profile := m.encode(time.Now())
+	m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="wasm_memory"`)
+	z := gzip.NewWriter(w)
+	z.Write(profile)
+	z.Close()
+}
+
+// track adds an instance of a module to the monitor, and returns the context
+// to run the instance with, in which the memory is sampled when the instance
+// calls host functions (see memorySampler). It must be called by the
+// goroutine running the instance, and the returned function must be called
+// by the same goroutine when the instance exits.
+func (m *MemoryMonitor) track(ctx context.Context, module string, instance int, memory api.Memory) (_ context.Context, exit func()) {
+	i := &instanceMemory{module: module, instance: instance, memory: memory}
+	i.sample()
+	m.mutex.Lock()
+	m.instances = append(m.instances, i)
+	m.update()
+	m.mutex.Unlock()
+	return context.WithValue(ctx, instanceMemoryKey{}, i), func() {
+		i.sample()
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.update()
+		i.exited = true
+	}
+}
+
+// startSampling starts sampling the memory usage until stopSampling is
+// called. Calls can be nested, sampling stops when the last run exits.
+func (m *MemoryMonitor) startSampling() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.running++; m.running > 1 {
+		return
+	}
+	if m.start.IsZero() {
+		m.start = time.Now()
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	m.stop, m.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(memorySamplePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.mutex.Lock()
+				m.update()
+				m.mutex.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *MemoryMonitor) stopSampling() {
+	m.mutex.Lock()
+	if m.running--; m.running > 0 {
+		m.mutex.Unlock()
+		return
+	}
+	stop, done := m.stop, m.done
+	m.update()
+	m.mutex.Unlock()
+	close(stop)
+	<-done
+}
+
+// update samples the memory of the host, using the last sizes published by
+// the instances; must be called with the mutex held.
+func (m *MemoryMonitor) update() {
+	linear := uint64(0)
+	for _, i := range m.instances {
+		if !i.exited {
+			linear += i.size.Load()
+		}
+	}
+	// The linear memories are allocated on the heap of the host, which
+	// would otherwise count them twice.
+	metrics.Read(m.sample)
+	heap := m.sample[0].Value.Uint64()
+	if heap > linear {
+		m.host = heap - linear
+	} else {
+		m.host = 0
+	}
+	if m.host > m.peakHost {
+		m.peakHost = m.host
+	}
+}
+
+// encode encodes the memory usage in the protocol buffer format of pprof,
+// with each instance, and the host, as a function of the profile.
+func (m *MemoryMonitor) encode(now time.Time) []byte {
+	table := newStringTable()
+
+	var b []byte
+	b = appendProtoBytes(b, 1, table.valueType("memory", "bytes"))
+	b = appendProtoBytes(b, 1, table.valueType("peak_memory", "bytes"))
+	names := []string{"host"}
+	b = appendProtoBytes(b, 2, encodeSample(binary.AppendUvarint(nil, 1), int64(m.host), int64(m.peakHost)))
+	for _, i := range m.instances {
+		names = append(names, fmt.Sprintf("%s[%d]", i.module, i.instance))
+		size := int64(i.size.Load())
+		peak := size
+		if i.exited {
+			size = 0 // exited instances only contribute to the peak
+		}
+		b = appendProtoBytes(b, 2, encodeSample(binary.AppendUvarint(nil, uint64(len(names))), size, peak))
+	}
+	for n := range names {
+		b = appendProtoBytes(b, 4, encodeLocation(uint64(n+1)))
+	}
+	for n, name := range names {
+		b = appendProtoBytes(b, 5, table.function(uint64(n+1), name, ""))
+	}
+	periodType := table.valueType("space", "bytes")
+	b = table.appendTo(b)
+	b = appendProtoInt(b, 9, m.start.UnixNano())
+	b = appendProtoInt(b, 10, int64(now.Sub(m.start)))
+	b = appendProtoBytes(b, 11, periodType)
+	return b
+}
+
+// WriteTo writes the report in a human-readable format to w.
+func (r MemoryReport) WriteTo(w io.Writer) (int64, error) {
+	instances := append([]MemoryUsage(nil), r.Instances...)
+	sort.SliceStable(instances, func(i, j int) bool {
+		return instances[i].LinearMemory > instances[j].LinearMemory
+	})
+	var b []byte
+	total := uint64(0)
+	for _, i := range instances {
+		b = fmt.Appendf(b, "%-32s %10s linear memory", fmt.Sprintf("%s[%d]", i.Module, i.Instance), formatBytes(i.LinearMemory))
+		if i.Exited {
+			b = append(b, " (exited)"...)
+		}
+		b = append(b, '\n')
+		total += i.LinearMemory
+	}
+	if len(instances) > 1 {
+		b = fmt.Appendf(b, "%-32s %10s linear memory\n", "total", formatBytes(total))
+	}
+	b = fmt.Appendf(b, "%-32s %10s (peak %s)\n", "host", formatBytes(r.HostMemory), formatBytes(r.PeakHostMemory))
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for x := n / unit; x >= unit && exp < 3; x /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// startModule calls the _start function of a module instantiated without
+// start functions, with the same semantics as wazero.Runtime.InstantiateModule.
+func startModule(ctx context.Context, instance api.Module) error {
+	start := instance.ExportedFunction("_start")
+	if start == nil {
+		return nil
+	}
+	if _, err := start.Call(ctx); err != nil {
+		if exitErr, ok := err.(*sys.ExitError); ok {
+			if exitErr.ExitCode() == 0 {
+				return nil
+			}
+			return err
+		}
+		return fmt.Errorf("module[%s] function[_start] failed: %w", instance.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package wasirun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// OCIScheme is the prefix of the module paths referencing WebAssembly
+// modules stored in OCI registries (e.g. oci://ghcr.io/org/app:v1).
+const OCIScheme = "oci://"
+
+// Media types of the OCI manifests and of the layers holding WebAssembly
+// modules.
+const (
+	ociIndexType           = "application/vnd.oci.image.index.v1+json"
+	ociManifestType        = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var wasmLayerTypes = []string{
+	"application/wasm",
+	"application/vnd.wasm.content.layer.v1+wasm",
+	"application/vnd.module.wasm.content.layer.v1+wasm",
+}
+
+// ociTokenServices are the hosts of the token services of registries which
+// are not served by the registries themselves, and which the credentials of
+// the registries are sent to.
+var ociTokenServices = map[string]string{
+	"registry-1.docker.io": "auth.docker.io",
+}
+
+// maxManifestSize is the maximum size of the manifests downloaded from
+// registries.
+const maxManifestSize = 4 * 1024 * 1024
+
+// PullOCI downloads the WebAssembly module referenced by ref, in the form
+// registry/repository[:tag|@digest], and returns the path of the file that it
+// was written to, which can be passed to OpenBundle.
+//
+// The module is the layer of the artifact with a WebAssembly media type (e.g.
+// application/wasm), or its only layer, which may also be a bundle. Layers are
+// verified against their digest, and cached in the user cache directory (e.g.
+// ~/.cache/wasirun/oci), so a module is downloaded once. Manifests referenced
+// by digest are cached as well, while tags are resolved on each call.
+//
+// Credentials are read from the auths of the docker configuration file
+// (~/.docker/config.json, or in the directory of $DOCKER_CONFIG); credential
+// helpers are not supported. Registries on localhost are accessed over HTTP,
+// other registries over HTTPS. The credentials are only sent to the registry
+// and to its token service (e.g. auth.docker.io for Docker Hub); the tokens of
+// other authentication realms are requested anonymously.
+func PullOCI(ctx context.Context, ref string) (string, error) {
+	r, err := parseOCIReference(strings.TrimPrefix(ref, OCIScheme))
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	c := &ociClient{
+		ref:   r,
+		cache: filepath.Join(cacheDir, "wasirun", "oci"),
+		auth:  dockerAuth(r.registry),
+	}
+
+	manifest, err := c.manifest(ctx, r.reference())
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", ref, err)
+	}
+	layer, err := manifest.wasmLayer()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", ref, err)
+	}
+	path, err := c.blob(ctx, "blobs", layer.Digest)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", ref, err)
+	}
+	return path, nil
+}
+
+// OCIModuleName returns the default name of the module referenced by ref,
+// which is the last element of its repository.
+func OCIModuleName(ref string) string {
+	r, err := parseOCIReference(strings.TrimPrefix(ref, OCIScheme))
+	if err != nil {
+		return ref
+	}
+	return path.Base(r.repository)
+}
+
+type ociReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseOCIReference(ref string) (ociReference, error) {
+	var r ociReference
+	name := ref
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		name, r.digest = name[:i], name[i+1:]
+		if _, _, err := splitDigest(r.digest); err != nil {
+			return r, fmt.Errorf("invalid OCI reference '%s': %w", ref, err)
+		}
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name, r.tag = name[:i], name[i+1:]
+	}
+	registry, repository, ok := strings.Cut(name, "/")
+	if !ok || registry == "" || repository == "" {
+		return r, fmt.Errorf("invalid OCI reference '%s': expected REGISTRY/REPOSITORY[:TAG|@DIGEST]", ref)
+	}
+	if registry == "docker.io" {
+		registry = "registry-1.docker.io"
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	r.registry, r.repository = registry, repository
+	if r.tag == "" && r.digest == "" {
+		r.tag = "latest"
+	}
+	return r, nil
+}
+
+// isLocalhost returns true if the registry is on localhost, which is accessed
+// over HTTP.
+func (r ociReference) isLocalhost() bool {
+	host, _, _ := strings.Cut(r.registry, ":")
+	return isLocalhost(host)
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1"
+}
+
+// reference returns the digest of the reference if it has one, or its tag.
+func (r ociReference) reference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+func splitDigest(digest string) (algorithm, hash string, err error) {
+	algorithm, hash, _ = strings.Cut(digest, ":")
+	if algorithm != "sha256" || len(hash) != 2*sha256.Size {
+		return "", "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+	return algorithm, hash, nil
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+func (m *ociManifest) isIndex() bool {
+	return m.MediaType == ociIndexType || m.MediaType == dockerManifestListType || (m.MediaType == "" && len(m.Manifests) > 0)
+}
+
+// platformManifest returns the manifest of the index for the wasm platform,
+// or the first one.
+func (m *ociManifest) platformManifest() (ociDescriptor, error) {
+	for _, desc := range m.Manifests {
+		if p := desc.Platform; p != nil && (p.Architecture == "wasm" || strings.HasPrefix(p.OS, "wasi")) {
+			return desc, nil
+		}
+	}
+	if len(m.Manifests) == 0 {
+		return ociDescriptor{}, errors.New("empty OCI image index")
+	}
+	return m.Manifests[0], nil
+}
+
+func (m *ociManifest) wasmLayer() (ociDescriptor, error) {
+	for _, layer := range m.Layers {
+		for _, mediaType := range wasmLayerTypes {
+			if layer.MediaType == mediaType {
+				return layer, nil
+			}
+		}
+	}
+	if len(m.Layers) == 1 {
+		return m.Layers[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("no WebAssembly layer found in the %d layers of the OCI artifact", len(m.Layers))
+}
+
+type ociClient struct {
+	ref   ociReference
+	cache string
+	// auth is the value of the basic authorization of the registry, or the
+	// empty string if there are no credentials for it.
+	auth string
+	// authorization is the value of the Authorization header of requests.
+	authorization string
+}
+
+// manifest returns the manifest referenced by the tag or digest, resolving
+// image indexes to the manifest of their wasm platform.
+func (c *ociClient) manifest(ctx context.Context, reference string) (*ociManifest, error) {
+	for depth := 0; ; depth++ {
+		var b []byte
+		var err error
+		if strings.Contains(reference, ":") {
+			var path string
+			if path, err = c.blob(ctx, "manifests", reference); err == nil {
+				b, err = os.ReadFile(path)
+			}
+		} else {
+			b, err = c.fetchManifest(ctx, reference)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := new(ociManifest)
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, fmt.Errorf("invalid OCI manifest: %w", err)
+		}
+		if !m.isIndex() {
+			return m, nil
+		}
+		if depth > 0 {
+			return nil, errors.New("nested OCI image indexes are not supported")
+		}
+		desc, err := m.platformManifest()
+		if err != nil {
+			return nil, err
+		}
+		reference = desc.Digest
+	}
+}
+
+func (c *ociClient) fetchManifest(ctx context.Context, tag string) ([]byte, error) {
+	res, err := c.get(ctx, "manifests", tag)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(io.LimitReader(res.Body, maxManifestSize))
+}
+
+// blob returns the path of the cached file of the manifest or blob with the
+// given digest, downloading it if it is not in the cache.
+func (c *ociClient) blob(ctx context.Context, kind, digest string) (string, error) {
+	algorithm, hash, err := splitDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(c.cache, algorithm)
+	path := filepath.Join(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	res, err := c.get(ctx, kind, digest)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	f, err := os.CreateTemp(dir, hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := sha256.New()
+	body := io.Reader(res.Body)
+	if kind == "manifests" {
+		body = io.LimitReader(body, maxManifestSize)
+	}
+	if _, err := io.Copy(io.MultiWriter(f, sum), body); err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != hash {
+		return "", fmt.Errorf("digest mismatch of %s: got sha256:%s", digest, got)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// get sends a request for the manifest or blob of the repository, and
+// authenticates with the registry when it responds with 401 Unauthorized.
+func (c *ociClient) get(ctx context.Context, kind, reference string) (*http.Response, error) {
+	scheme := "https"
+	if c.ref.isLocalhost() {
+		scheme = "http"
+	}
+	u := scheme + "://" + c.ref.registry + "/v2/" + c.ref.repository + "/" + kind + "/" + reference
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "manifests" {
+			req.Header.Set("Accept", strings.Join([]string{
+				ociManifestType,
+				ociIndexType,
+				dockerManifestType,
+				dockerManifestListType,
+			}, ", "))
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case res.StatusCode == http.StatusOK:
+			return res, nil
+		case res.StatusCode == http.StatusUnauthorized && attempt == 0:
+			challenge := res.Header.Get("WWW-Authenticate")
+			res.Body.Close()
+			if err := c.authenticate(ctx, challenge); err != nil {
+				return nil, err
+			}
+		default:
+			res.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", u, res.Status)
+		}
+	}
+}
+
+// authenticate sets the authorization of the client in response to the
+// challenge of the WWW-Authenticate header of a registry.
+func (c *ociClient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.auth == "" {
+			return fmt.Errorf("%s: authentication required, no credentials found in the docker configuration", c.ref.registry)
+		}
+		c.authorization = "Basic " + c.auth
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("%s: unsupported authentication scheme '%s'", c.ref.registry, scheme)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("%s: invalid authentication realm '%s'", c.ref.registry, params["realm"])
+	}
+	// Registries on localhost may be served over HTTP, with their token
+	// service; the realms of the other registries must use HTTPS.
+	if realm.Scheme != "https" && !(realm.Scheme == "http" && c.ref.isLocalhost() && isLocalhost(realm.Hostname())) {
+		return fmt.Errorf("%s: insecure authentication realm '%s'", c.ref.registry, params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.auth != "" && c.sendsCredentials(realm) {
+		req.Header.Set("Authorization", "Basic "+c.auth)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: authentication failed: %s", c.ref.registry, res.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxManifestSize)).Decode(&token); err != nil {
+		return fmt.Errorf("%s: invalid authentication token: %w", c.ref.registry, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// sendsCredentials returns true if the credentials of the registry can be
+// sent to the authentication realm, which is the case when the realm is
+// served by the registry or by its token service.
+func (c *ociClient) sendsCredentials(realm *url.URL) bool {
+	registry, _, _ := strings.Cut(c.ref.registry, ":")
+	host := realm.Hostname()
+	return strings.EqualFold(host, registry) || strings.EqualFold(host, ociTokenServices[c.ref.registry])
+}
+
+// parseChallenge parses the value of a WWW-Authenticate header, for example:
+//
+//	Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:org/app:pull"
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params = make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return scheme, params
+}
+
+// dockerAuth returns the base64 encoded credentials of the registry in the
+// docker configuration file, or the empty string if there are none.
+func dockerAuth(registry string) string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(b, &config) != nil {
+		return ""
+	}
+	keys := []string{registry, "https://" + registry, "http://" + registry}
+	if registry == "registry-1.docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/", "docker.io")
+	}
+	for _, key := range keys {
+		if auth, ok := config.Auths[key]; ok {
+			if auth.Auth != "" {
+				return auth.Auth
+			}
+			if auth.Username != "" {
+				return base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+			}
+		}
+	}
+	return ""
+}
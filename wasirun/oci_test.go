@@ -0,0 +1,188 @@
+package wasirun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPullOCI(t *testing.T) {
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	layerDigest := digestOf(module)
+	manifest, _ := json.Marshal(ociManifest{
+		MediaType: ociManifestType,
+		Layers: []ociDescriptor{
+			{MediaType: "application/vnd.wasm.config.v0+json", Digest: digestOf(nil)},
+			{MediaType: "application/wasm", Digest: layerDigest, Size: int64(len(module))},
+		},
+	})
+	manifestDigest := digestOf(manifest)
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	requests := 0
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic "+credentials {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if scope := r.URL.Query().Get("scope"); scope != "repository:org/app:pull" {
+			t.Errorf("wrong scope: %q", scope)
+		}
+		w.Write([]byte(`{"token":"t0k3n"}`))
+	})
+	mux.HandleFunc("/v2/org/app/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:org/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/org/app/manifests/v1", "/v2/org/app/manifests/" + manifestDigest:
+			w.Write(manifest)
+		case "/v2/org/app/blobs/" + layerDigest:
+			w.Write(module)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	dockerConfig := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dockerConfig)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	config := `{"auths":{"` + registry + `":{"auth":"` + credentials + `"}}}`
+	if err := os.WriteFile(filepath.Join(dockerConfig, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	path, err := PullOCI(ctx, OCIScheme+registry+"/org/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(module) {
+		t.Errorf("wrong module content: %q", b)
+	}
+
+	// Modules referenced by digest are served from the cache.
+	requests = 0
+	if _, err := PullOCI(ctx, OCIScheme+registry+"/org/app@"+manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PullOCI(ctx, OCIScheme+registry+"/org/app@"+manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("wrong number of requests: want=2 (one challenged) got=%d", requests)
+	}
+
+	if _, err := PullOCI(ctx, OCIScheme+registry+"/org/app:v2"); err == nil {
+		t.Error("pulling a missing tag did not fail")
+	}
+	if name := OCIModuleName(OCIScheme + registry + "/org/app:v1"); name != "app" {
+		t.Errorf("wrong module name: %q", name)
+	}
+}
+
+func TestOCIAuthenticateRealm(t *testing.T) {
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"token":"t0k3n"}`))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	defaultClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	defer func() { http.DefaultClient = defaultClient }()
+
+	tests := []struct {
+		registry string
+		realm    string
+		// sent is true if the credentials are sent to the realm, and
+		// insecure if the realm is rejected.
+		sent, insecure bool
+	}{
+		{registry: host, realm: server.URL + "/token", sent: true},
+		{registry: "localhost:5000", realm: server.URL + "/token", sent: false},
+		{registry: "ghcr.io", realm: server.URL + "/token", sent: false},
+		{registry: "ghcr.io", realm: "http://ghcr.io/token", insecure: true},
+		{registry: "ghcr.io", realm: "http://127.0.0.1/token", insecure: true},
+		{registry: "localhost:5000", realm: "http://ghcr.io/token", insecure: true},
+	}
+	for _, test := range tests {
+		authorization = ""
+		c := &ociClient{
+			ref:  ociReference{registry: test.registry, repository: "org/app"},
+			auth: credentials,
+		}
+		err := c.authenticate(context.Background(), `Bearer realm="`+test.realm+`",service="registry"`)
+		if test.insecure {
+			if err == nil || !strings.Contains(err.Error(), "insecure") {
+				t.Errorf("%s: insecure realm %s accepted: %v", test.registry, test.realm, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.registry, err)
+			continue
+		}
+		if sent := authorization != ""; sent != test.sent {
+			t.Errorf("%s: credentials sent to %s: want=%t got=%t", test.registry, test.realm, test.sent, sent)
+		}
+		if c.authorization != "Bearer t0k3n" {
+			t.Errorf("%s: wrong authorization: %q", test.registry, c.authorization)
+		}
+	}
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := digestOf(nil)
+	tests := []struct {
+		ref  string
+		want ociReference
+	}{
+		{"ghcr.io/org/app", ociReference{registry: "ghcr.io", repository: "org/app", tag: "latest"}},
+		{"localhost:5000/app:v1", ociReference{registry: "localhost:5000", repository: "app", tag: "v1"}},
+		{"docker.io/app:v1", ociReference{registry: "registry-1.docker.io", repository: "library/app", tag: "v1"}},
+		{"ghcr.io/org/app:v1@" + digest, ociReference{registry: "ghcr.io", repository: "org/app", tag: "v1", digest: digest}},
+	}
+	for _, test := range tests {
+		got, err := parseOCIReference(test.ref)
+		if err != nil {
+			t.Errorf("%s: %v", test.ref, err)
+		} else if got != test.want {
+			t.Errorf("%s: want=%+v got=%+v", test.ref, test.want, got)
+		}
+	}
+	for _, ref := range []string{"app", "ghcr.io/", "ghcr.io/app@sha256:1234"} {
+		if _, err := parseOCIReference(ref); err == nil {
+			t.Errorf("%s: invalid reference parsed without error", ref)
+		}
+	}
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,310 @@
+package wasirun
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// cpuProfilePeriod is the interval between the samples of the CPU profiler.
+const cpuProfilePeriod = 10 * time.Millisecond
+
+// cpuProfiler is a function listener which tracks the call stacks of the
+// instances of a module, and samples them at regular intervals to produce a
+// CPU profile in the pprof format.
+//
+// The samples are taken on wall-clock time; stacks blocked in poll_oneoff are
+// idle and are not sampled. The stacks include the host functions called by
+// the guest, so the time spent in system calls is attributed to them.
+//
+// The listener is shared by all the instances of the module, since wazero
+// reuses the listeners of modules found in its compilation cache, so the
+// stacks are tracked per instance.
+type cpuProfiler struct {
+	bytecode   []byte
+	moduleName string
+
+	mutex     sync.Mutex
+	start     time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	stacks    map[api.Module][]*profileFunction
+	functions map[api.FunctionDefinition]*profileFunction
+	samples   map[string]*profileSample
+	order     []*profileSample
+	symbols   *symbolizer
+}
+
+type profileFunction struct {
+	id   uint64
+	name string
+	idle bool
+}
+
+type profileSample struct {
+	stack []*profileFunction // leaf first
+	count int64
+}
+
+var _ experimental.FunctionListenerFactory = (*cpuProfiler)(nil)
+
+func newCPUProfiler(moduleName string, bytecode []byte) *cpuProfiler {
+	return &cpuProfiler{
+		bytecode:   bytecode,
+		moduleName: moduleName,
+		stacks:     make(map[api.Module][]*profileFunction),
+		functions:  make(map[api.FunctionDefinition]*profileFunction),
+		samples:    make(map[string]*profileSample),
+	}
+}
+
+func (p *cpuProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	return p
+}
+
+func (p *cpuProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, _ experimental.StackIterator) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stacks[mod] = append(p.stacks[mod], p.function(mod, def))
+}
+
+func (p *cpuProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	p.pop(mod)
+}
+
+func (p *cpuProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	p.pop(mod)
+}
+
+func (p *cpuProfiler) pop(mod api.Module) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stack := p.stacks[mod]
+	if len(stack) <= 1 {
+		delete(p.stacks, mod)
+	} else {
+		p.stacks[mod] = stack[:len(stack)-1]
+	}
+}
+
+// function returns the function of the profile for def, which is called by
+// the instance mod; must be called with the mutex held.
+func (p *cpuProfiler) function(mod api.Module, def api.FunctionDefinition) *profileFunction {
+	f := p.functions[def]
+	if f != nil {
+		return f
+	}
+	f = &profileFunction{id: uint64(len(p.functions) + 1)}
+	switch {
+	case def.GoFunction() != nil:
+		f.name = def.ModuleName() + "." + def.Name()
+		f.idle = def.Name() == "poll_oneoff"
+	case def.Name() != "":
+		f.name = def.Name()
+	case mod.Name() == p.moduleName:
+		// Modules compiled from languages such as Rust or C often have no
+		// name section, the names are then looked up in DWARF sections.
+		if p.symbols == nil {
+			p.symbols, _ = newSymbolizer(p.bytecode)
+			if p.symbols == nil {
+				p.symbols = new(symbolizer)
+			}
+		}
+		f.name = p.symbols.functionName(def.Index())
+	}
+	if f.name == "" {
+		f.name = def.DebugName()
+	}
+	p.functions[def] = f
+	return f
+}
+
+// startSampling starts sampling the stacks of the instances until
+// stopSampling is called.
+func (p *cpuProfiler) startSampling() {
+	p.start = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(cpuProfilePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.sample()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *cpuProfiler) stopSampling() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *cpuProfiler) sample() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := make([]byte, 0, 64)
+	for _, stack := range p.stacks {
+		if stack[len(stack)-1].idle {
+			continue
+		}
+		key = key[:0]
+		for i := len(stack) - 1; i >= 0; i-- {
+			key = binary.AppendUvarint(key, stack[i].id)
+		}
+		s := p.samples[string(key)]
+		if s == nil {
+			s = &profileSample{stack: make([]*profileFunction, 0, len(stack))}
+			for i := len(stack) - 1; i >= 0; i-- {
+				s.stack = append(s.stack, stack[i])
+			}
+			p.samples[string(key)] = s
+			p.order = append(p.order, s)
+		}
+		s.count++
+	}
+}
+
+// writeTo writes the profile, compressed with gzip, to path.
+func (p *cpuProfiler) writeTo(path string) error {
+	p.mutex.Lock()
+	profile := p.encode(time.Since(p.start))
+	p.mutex.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	z := gzip.NewWriter(f)
+	if _, err := z.Write(profile); err != nil {
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// encode encodes the profile in the protocol buffer format of pprof
+// (https://github.com/google/pprof/blob/main/proto/profile.proto).
+func (p *cpuProfiler) encode(duration time.Duration) []byte {
+	table := newStringTable()
+
+	var b []byte
+	b = appendProtoBytes(b, 1, table.valueType("samples", "count"))
+	b = appendProtoBytes(b, 1, table.valueType("cpu", "nanoseconds"))
+	for _, s := range p.order {
+		var locations []byte
+		for _, f := range s.stack {
+			locations = binary.AppendUvarint(locations, f.id)
+		}
+		b = appendProtoBytes(b, 2, encodeSample(locations, s.count, s.count*int64(cpuProfilePeriod)))
+	}
+	// Each function has a single location, with the same id.
+	functions := make([]*profileFunction, len(p.functions))
+	for _, f := range p.functions {
+		functions[f.id-1] = f
+	}
+	for _, f := range functions {
+		b = appendProtoBytes(b, 4, encodeLocation(f.id))
+	}
+	for _, f := range functions {
+		b = appendProtoBytes(b, 5, table.function(f.id, f.name, p.moduleName))
+	}
+	periodType := table.valueType("cpu", "nanoseconds")
+	b = table.appendTo(b)
+	b = appendProtoInt(b, 9, p.start.UnixNano())
+	b = appendProtoInt(b, 10, int64(duration))
+	b = appendProtoBytes(b, 11, periodType)
+	b = appendProtoInt(b, 12, int64(cpuProfilePeriod))
+	return b
+}
+
+// stringTable is the table of strings of a pprof profile, which messages
+// reference by index.
+type stringTable struct {
+	indexes map[string]int64
+	strings []string
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{indexes: map[string]int64{"": 0}, strings: []string{""}}
+}
+
+func (t *stringTable) index(s string) int64 {
+	i, ok := t.indexes[s]
+	if !ok {
+		i = int64(len(t.strings))
+		t.indexes[s] = i
+		t.strings = append(t.strings, s)
+	}
+	return i
+}
+
+func (t *stringTable) valueType(typ, unit string) []byte {
+	var b []byte
+	b = appendProtoInt(b, 1, t.index(typ))
+	return appendProtoInt(b, 2, t.index(unit))
+}
+
+func (t *stringTable) function(id uint64, name, filename string) []byte {
+	var b []byte
+	i := t.index(name)
+	b = appendProtoInt(b, 1, int64(id))
+	b = appendProtoInt(b, 2, i)
+	b = appendProtoInt(b, 3, i)
+	return appendProtoInt(b, 4, t.index(filename))
+}
+
+// appendTo appends the string table to a profile, after which no strings
+// may be added.
+func (t *stringTable) appendTo(b []byte) []byte {
+	for _, s := range t.strings {
+		b = appendProtoBytes(b, 6, []byte(s))
+	}
+	return b
+}
+
+func encodeSample(locations []byte, values ...int64) []byte {
+	var b, v []byte
+	for _, value := range values {
+		v = binary.AppendUvarint(v, uint64(value))
+	}
+	b = appendProtoBytes(b, 1, locations)
+	return appendProtoBytes(b, 2, v)
+}
+
+// encodeLocation encodes a location of a single function, with the id of the
+// function.
+func encodeLocation(functionID uint64) []byte {
+	var b, line []byte
+	line = appendProtoInt(line, 1, int64(functionID))
+	b = appendProtoInt(b, 1, int64(functionID))
+	return appendProtoBytes(b, 4, line)
+}
+
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,288 @@
+package wasirun
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// symbolizeError rewrites the stack trace of errors returned when a module
+// traps, replacing the function indexes of the frames (e.g. app.$42), which
+// wazero reports when the module has no name section, with the names of the
+// functions found in the DWARF sections of the module.
+//
+// wazero already adds the source file and line of each frame when the module
+// has DWARF sections.
+func symbolizeError(bytecode []byte, err error) error {
+	msg := err.Error()
+	trace := strings.Index(msg, "wasm stack trace:")
+	if trace < 0 || !stackFrameIndex.MatchString(msg[trace:]) {
+		return err
+	}
+	s, parseErr := newSymbolizer(bytecode)
+	if parseErr != nil {
+		return err
+	}
+	symbolized := stackFrameIndex.ReplaceAllStringFunc(msg[trace:], func(frame string) string {
+		m := stackFrameIndex.FindStringSubmatch(frame)
+		index, _ := strconv.ParseUint(m[2], 10, 32)
+		name := s.functionName(uint32(index))
+		if name == "" {
+			return frame
+		}
+		return m[1] + name + "("
+	})
+	return &symbolizedError{err: err, msg: msg[:trace] + symbolized}
+}
+
+// stackFrameIndex matches the frames of stack traces which have the index of
+// the function instead of its name.
+var stackFrameIndex = regexp.MustCompile(`(?m)(^\t[^\t\n]*\.)\$(\d+)\(`)
+
+type symbolizedError struct {
+	err error
+	msg string
+}
+
+func (e *symbolizedError) Error() string { return e.msg }
+func (e *symbolizedError) Unwrap() error { return e.err }
+
+// symbolizer resolves the names of functions of a module from its DWARF
+// sections.
+type symbolizer struct {
+	importedFunctions uint32
+	// bodies are the ranges of the function bodies in the code section,
+	// which is how DWARF addresses code in WebAssembly modules.
+	bodies      [][2]uint64
+	subprograms []subprogram
+}
+
+type subprogram struct {
+	low, high uint64
+	name      string
+}
+
+func newSymbolizer(bytecode []byte) (*symbolizer, error) {
+	s := new(symbolizer)
+	sections := map[string][]byte{}
+	r := wasmReader{b: bytecode}
+	if !bytes.HasPrefix(bytecode, wasmMagic) || len(bytecode) < 8 {
+		return nil, errors.New("not a WebAssembly module")
+	}
+	r.b = r.b[8:]
+
+	for len(r.b) > 0 {
+		id := r.byte()
+		size := r.u32()
+		if r.err != nil || uint64(size) > uint64(len(r.b)) {
+			return nil, errors.New("malformed WebAssembly module")
+		}
+		section := wasmReader{b: r.b[:size]}
+		r.b = r.b[size:]
+
+		switch id {
+		case 0: // custom
+			name := section.name()
+			if strings.HasPrefix(name, ".debug_") {
+				sections[name] = section.b
+			}
+		case 2: // import
+			s.importedFunctions = section.importedFunctions()
+		case 10: // code
+			base := len(section.b)
+			count := section.u32()
+			for i := uint32(0); i < count && section.err == nil; i++ {
+				size := section.u32()
+				start := uint64(base - len(section.b))
+				if uint64(size) > uint64(len(section.b)) {
+					break
+				}
+				section.b = section.b[size:]
+				s.bodies = append(s.bodies, [2]uint64{start, start + uint64(size)})
+			}
+		}
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+	if sections[".debug_info"] == nil {
+		return nil, errors.New("no DWARF sections")
+	}
+
+	d, err := dwarf.New(
+		sections[".debug_abbrev"],
+		sections[".debug_aranges"],
+		sections[".debug_frame"],
+		sections[".debug_info"],
+		sections[".debug_line"],
+		sections[".debug_pubnames"],
+		sections[".debug_ranges"],
+		sections[".debug_str"],
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.readSubprograms(d); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *symbolizer) readSubprograms(d *dwarf.Data) error {
+	names := map[dwarf.Offset]string{}
+	var origins []struct {
+		subprogram int
+		origin     dwarf.Offset
+	}
+
+	r := d.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		if name != "" {
+			names[entry.Offset] = name
+		}
+		ranges, err := d.Ranges(entry)
+		if err != nil || len(ranges) == 0 {
+			continue
+		}
+		for _, rg := range ranges {
+			s.subprograms = append(s.subprograms, subprogram{low: rg[0], high: rg[1], name: name})
+			if name == "" {
+				// The name of concrete instances of inlined or declared
+				// functions is on the entry of their declaration.
+				for _, attr := range []dwarf.Attr{dwarf.AttrAbstractOrigin, dwarf.AttrSpecification} {
+					if origin, ok := entry.Val(attr).(dwarf.Offset); ok {
+						origins = append(origins, struct {
+							subprogram int
+							origin     dwarf.Offset
+						}{len(s.subprograms) - 1, origin})
+						break
+					}
+				}
+			}
+		}
+	}
+
+	for _, o := range origins {
+		s.subprograms[o.subprogram].name = names[o.origin]
+	}
+	sort.Slice(s.subprograms, func(i, j int) bool {
+		return s.subprograms[i].low < s.subprograms[j].low
+	})
+	return nil
+}
+
+// functionName returns the name of the function at index in the function
+// index space of the module, or the empty string if it is unknown.
+func (s *symbolizer) functionName(index uint32) string {
+	if index < s.importedFunctions || int(index-s.importedFunctions) >= len(s.bodies) {
+		return ""
+	}
+	body := s.bodies[index-s.importedFunctions]
+	// The subprogram of the function is the last one starting before the
+	// end of its body, if it covers the body.
+	i := sort.Search(len(s.subprograms), func(i int) bool {
+		return s.subprograms[i].low >= body[1]
+	})
+	for i--; i >= 0; i-- {
+		p := s.subprograms[i]
+		if p.high <= body[0] {
+			break
+		}
+		if p.name != "" {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// wasmReader decodes the values of WebAssembly sections.
+type wasmReader struct {
+	b   []byte
+	err error
+}
+
+func (r *wasmReader) byte() byte {
+	if len(r.b) == 0 {
+		r.fail()
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *wasmReader) u32() uint32 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 || v > 0xFFFFFFFF {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return uint32(v)
+}
+
+func (r *wasmReader) name() string {
+	n := r.u32()
+	if uint64(n) > uint64(len(r.b)) {
+		r.fail()
+		return ""
+	}
+	name := string(r.b[:n])
+	r.b = r.b[n:]
+	return name
+}
+
+func (r *wasmReader) limits() {
+	if flags := r.byte(); flags&1 != 0 {
+		r.u32()
+	}
+	r.u32()
+}
+
+// importedFunctions returns the number of functions of an import section.
+func (r *wasmReader) importedFunctions() (functions uint32) {
+	count := r.u32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		r.name()
+		r.name()
+		switch r.byte() {
+		case 0: // function
+			r.u32()
+			functions++
+		case 1: // table
+			r.byte()
+			r.limits()
+		case 2: // memory
+			r.limits()
+		case 3: // global
+			r.byte()
+			r.byte()
+		default:
+			r.fail()
+		}
+	}
+	return functions
+}
+
+func (r *wasmReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("malformed WebAssembly module")
+	}
+	r.b = nil
+}
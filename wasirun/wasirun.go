@@ -0,0 +1,695 @@
+// Package wasirun exposes the behavior of the wasirun command as a library,
+// so that tools can run WebAssembly modules with the same configuration
+// options without duplicating the wiring of the command line.
+package wasirun
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/stealthrocket/wasi-go/imports"
+	"github.com/stealthrocket/wasi-go/imports/wasi_http"
+	"github.com/stealthrocket/wasi-go/imports/wasi_parallel"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Options are the options to run a WebAssembly module. Each field matches
+// one of the flags of the wasirun command; the zero value of each field
+// is the default value of the corresponding flag.
+type Options struct {
+	// Module is the path of the WebAssembly module to run, which may also
+	// be compressed with zstd or packaged in a bundle (see OpenBundle), or
+	// a reference to a module in an OCI registry prefixed with oci:// (see
+	// PullOCI), or an HTTPS URL (see FetchModule).
+	Module string
+	// SHA256 is the hex-encoded SHA-256 hash that the content of the module
+	// file must have, if not empty. Modules downloaded from URLs with a
+	// checksum are cached by content.
+	SHA256 string
+	// Name is the name of the module, exposed to the module as argv[0].
+	// Defaults to the base name of the module path.
+	Name string
+	// Args are the arguments passed to the module, or to the function when
+	// Invoke is set.
+	Args []string
+	// Invoke is the name of a function exported by the module which is
+	// called instead of starting the module, with Args parsed according to
+	// the types of its parameters (see Invoke). The module is initialized
+	// as a WASI reactor, and the results of the function are written to
+	// Stdout, one per line.
+	Invoke string
+	// Env are the environment variables passed to the module.
+	Env []string
+	// Dirs are the host directories that the module is granted access to
+	// (see imports.Builder.WithDirs).
+	Dirs []string
+	// Listens are the addresses of sockets listening for connections that
+	// the module is granted access to, either host:port addresses or paths
+	// of unix sockets prefixed with unix: (e.g. unix:/tmp/app.sock).
+	Listens []string
+	// Dials are the addresses of sockets connected to a peer that the module
+	// is granted access to, with the same format as Listens.
+	Dials []string
+	// Publish maps the ports that the module binds sockets to onto the
+	// addresses that the host listens on (see wasi.PublishPorts).
+	Publish []wasi.PortMapping
+	// SocketActivation grants the module access to the sockets passed to
+	// the process with the systemd socket activation protocol (see
+	// imports.Builder.WithSocketActivation).
+	SocketActivation bool
+	// ConnectionLimits limits the connections that the module accepts and
+	// the backlog of the sockets that it listens on (see
+	// wasi.LimitConnections).
+	ConnectionLimits wasi.ConnectionLimits
+	// TLSListens are the addresses of sockets listening for TLS connections
+	// which are terminated on the host, with the configuration TLSConfig
+	// (see imports.Builder.WithTLSListens).
+	TLSListens []string
+	TLSConfig  *tls.Config
+	// TLSDials are the addresses of TLS servers that the module is granted
+	// access to, the connections are originated on the host with the
+	// configuration TLSDialConfig (see imports.Builder.WithTLSDials).
+	TLSDials      []string
+	TLSDialConfig *tls.Config
+	// Resolver resolves the host names that the module connects to, if not
+	// nil (see imports.Builder.WithResolver). It also applies to the
+	// requests made with wasi-http.
+	Resolver func(ctx context.Context, name string) ([]net.IP, error)
+	// Proxy is the URL of a SOCKS5 or HTTP CONNECT proxy server that the
+	// outbound TCP connections of the module are routed through, if not nil
+	// (see imports.Builder.WithProxy). It also applies to the requests made
+	// with wasi-http.
+	Proxy *url.URL
+	// Sockets is the name of the sockets extension (see
+	// imports.Builder.WithSocketsExtension). Defaults to "auto".
+	Sockets string
+	// Engine is the name of the WebAssembly engine (see
+	// imports.NewRuntimeConfig). Defaults to "auto".
+	Engine string
+	// HTTP selects the version of wasi-http client support, either "none",
+	// "auto" or "v1". Defaults to "auto".
+	HTTP string
+	// ParallelWorkers is the number of workers running the kernels of
+	// modules importing wasi-parallel (see wasi_parallel.WithWorkers).
+	// Defaults to the number of CPUs.
+	ParallelWorkers int
+	// Trace is the format of the system call trace, either "text", "json",
+	// or "summary". Tracing is disabled when empty.
+	Trace string
+	// TraceFilter restricts tracing to the system calls matching a
+	// comma-separated list of patterns (see wasi.ParseTraceFilter).
+	TraceFilter string
+	// TraceSwitch enables or disables tracing while the module is running,
+	// if not nil.
+	TraceSwitch *wasi.TraceSwitch
+	// TraceOutput is where the trace is written. Defaults to os.Stderr.
+	TraceOutput io.Writer
+	// Stdin is the standard input of the module. Defaults to the standard
+	// input of the process.
+	Stdin io.Reader
+	// Stdout is where the standard output of the module is written.
+	// Defaults to the standard output of the process.
+	Stdout io.Writer
+	// Stderr is where the standard error of the module is written. Defaults
+	// to the standard error of the process.
+	Stderr io.Writer
+	// NonBlockingStdio enables non-blocking stdio.
+	NonBlockingStdio bool
+	// IOURing enables the io_uring implementation of I/O operations on
+	// Linux (see imports.Builder.WithIOURing).
+	IOURing bool
+	// DirCache is the number of directory handles cached to resolve paths
+	// (see imports.Builder.WithDirCache).
+	DirCache int
+	// WindowsPaths enables the translation of Windows-style paths.
+	WindowsPaths bool
+	// DryRun applies the changes made by the module to the file system to
+	// an in-memory overlay only (see wasi.DryRun).
+	DryRun bool
+	// DryRunOutput is where the manifest of changes is written in dry-run
+	// mode. Defaults to os.Stderr.
+	DryRunOutput io.Writer
+	// ScanWrites is called with the content of the files written by the
+	// module when they are closed or synced, if not nil. Errors returned by
+	// the function fail the run (see wasi.ScanWrites).
+	ScanWrites wasi.WriteScanner
+	// Deterministic enables the deterministic mode (see wasi.Deterministic).
+	Deterministic bool
+	// Seed is the seed of the random source in deterministic mode.
+	Seed int64
+	// SuspendPolicy is the behavior of the clocks and timeouts when the host
+	// is suspended (see imports.Builder.WithSuspendPolicy).
+	SuspendPolicy wasi.SuspendPolicy
+	// Record is where the system calls made by the module and their results
+	// are recorded, if not nil (see wasi.Record).
+	Record io.Writer
+	// Replay is a recording of system calls, made with Record, that is
+	// replayed instead of accessing the host, if not nil (see wasi.Replay).
+	Replay io.Reader
+	// Policy restricts the paths, network addresses, and environment
+	// variables that the module can access, if not nil (see wasi.Enforce).
+	Policy *wasi.Policy
+	// DenyPaths are glob patterns of the paths that the module is denied
+	// access to (see imports.Builder.WithDenyPaths).
+	DenyPaths []string
+	// AllowDials are the patterns of the addresses that the module is allowed
+	// to connect to (see imports.Builder.WithAllowDials). The restriction
+	// also applies to the requests made with wasi-http.
+	AllowDials []string
+	// Audit is called with each operation denied to the module for lack of
+	// rights or by the sandbox, if not nil (see wasi.Audit).
+	Audit func(context.Context, wasi.Denial)
+	// SignalActions are the actions taken when the module raises signals with
+	// proc_raise (e.g. when it calls abort), instead of their default action
+	// (see imports.Builder.WithSignalAction).
+	SignalActions map[wasi.Signal]wasi.SignalAction
+	// SignalHandler is called with the signals raised by the module that have
+	// the action wasi.SignalHandle, if not nil.
+	SignalHandler func(context.Context, wasi.Signal) error
+	// Commands are the host programs that the module is allowed to spawn as
+	// child processes (see imports.Builder.WithCommands).
+	Commands []string
+	// ChildModules enables the module to spawn the WebAssembly modules of its
+	// directories as child processes (see imports.Builder.WithChildModules).
+	ChildModules bool
+	// SharedMemory are the named memory segments that the module can share
+	// with other modules, including the other instances of the module (see
+	// imports.Builder.WithSharedMemory).
+	SharedMemory *wasi.SharedMemory
+	// Yield is called when the module calls sched_yield, and every
+	// YieldEvery system calls if YieldEvery is positive, if not nil (see
+	// wasi.Cooperate). The default yields the goroutine running the module.
+	Yield func(context.Context) error
+	// YieldEvery is the number of system calls after which Yield is called,
+	// as if the module had yielded.
+	YieldEvery int
+	// Preloads are the WebAssembly modules instantiated as libraries before
+	// the main module, as NAME=PATH where NAME is the module name that the
+	// main module imports their exports from (see
+	// imports.Builder.WithPreloads).
+	Preloads []string
+	// CoreDump is the path that a wasm coredump is written to when the module
+	// traps, if not empty. The coredump holds the memory, globals, and call
+	// stack of the module in the format of the WebAssembly tool conventions,
+	// and can be inspected with tools such as wasmgdb. Tracking the call
+	// stack slows down function calls. With multiple instances, the index of
+	// the instance is appended to the path (e.g. core.wasm.0).
+	CoreDump string
+	// ProfileCPU is the path that a CPU profile of the module is written to
+	// in the pprof format, if not empty. The profile samples the call stacks
+	// of the guest, including the host functions that it calls, and is
+	// written when the module exits; with multiple instances, it combines
+	// the samples of all instances. Tracking the call stacks slows down
+	// function calls.
+	ProfileCPU string
+	// MemoryMonitor samples the memory usage of the instances of the module
+	// while they run, if not nil (see MemoryMonitor).
+	MemoryMonitor *MemoryMonitor
+	// Instances is the number of instances of the module run concurrently,
+	// sharing the compiled code of the module. Each instance has its own
+	// system, with the WASIRUN_INSTANCE environment variable set to its
+	// index, and the sockets of Listens and Dials created for it; the
+	// listening addresses must therefore differ or allow port reuse.
+	// The instances read Stdin concurrently, each reading part of the
+	// input, and write to Stdout and Stderr concurrently, which must
+	// therefore be safe for concurrent use. Defaults to 1.
+	//
+	// When instances fail, the error returned by Run joins an
+	// InstanceError for each of them.
+	Instances int
+	// Wrappers are applied to the system of the module, after the wrappers
+	// configured by the other options (see imports.Builder.WithWrappers).
+	Wrappers []func(wasi.System) wasi.System
+	// Interrupt is a channel closed to ask the module to terminate. Blocking
+	// system calls are interrupted, and the module is expected to exit on
+	// its own; the context passed to Run can be canceled to force its
+	// termination.
+	Interrupt <-chan struct{}
+}
+
+// Run runs the WebAssembly module and returns when it has exited.
+//
+// When the module calls proc_exit with a non-zero exit code, the error
+// returned is a *sys.ExitError carrying the exit code.
+func Run(ctx context.Context, options Options) (err error) {
+	wasmFile := options.Module
+	defaultName := filepath.Base(wasmFile)
+	switch {
+	case strings.HasPrefix(wasmFile, OCIScheme):
+		defaultName = OCIModuleName(wasmFile)
+		if wasmFile, err = PullOCI(ctx, wasmFile); err != nil {
+			return fmt.Errorf("could not pull WASM module: %w", err)
+		}
+	case IsModuleURL(wasmFile):
+		if u, err := url.Parse(wasmFile); err == nil {
+			defaultName = path.Base(u.Path)
+		}
+		if wasmFile, err = FetchModule(ctx, wasmFile, options.SHA256); err != nil {
+			return fmt.Errorf("could not download WASM module: %w", err)
+		}
+	}
+	if options.SHA256 != "" {
+		if err := verifyChecksum(wasmFile, options.SHA256); err != nil {
+			return err
+		}
+	}
+	bundle, err := OpenBundle(wasmFile)
+	if err != nil {
+		return fmt.Errorf("could not read WASM file '%s': %w", wasmFile, err)
+	}
+	defer bundle.Close()
+
+	wasmName := options.Name
+	if wasmName == "" {
+		wasmName = bundle.Config.Name
+	}
+	if wasmName == "" {
+		wasmName = defaultName
+	}
+	args := options.Args
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	var invokeArgs []string
+	if options.Invoke != "" {
+		invokeArgs, args = args, nil
+	}
+	args = append(bundle.Config.Args[:len(bundle.Config.Args):len(bundle.Config.Args)], args...)
+	env := append(bundle.Config.Env[:len(bundle.Config.Env):len(bundle.Config.Env)], options.Env...)
+	dirs, err := bundle.Dirs()
+	if err != nil {
+		return err
+	}
+	dirs = append(dirs, options.Dirs...)
+	traceOutput := options.TraceOutput
+	if traceOutput == nil {
+		traceOutput = os.Stderr
+	}
+	dryRunOutput := options.DryRunOutput
+	if dryRunOutput == nil {
+		dryRunOutput = os.Stderr
+	}
+
+	runtimeConfig, err := imports.NewRuntimeConfig(options.Engine)
+	if err != nil {
+		return err
+	}
+	run := &moduleRun{
+		options:       options,
+		runtimeConfig: runtimeConfig,
+		bytecode:      bundle.Module,
+		name:          wasmName,
+		args:          args,
+		invokeArgs:    invokeArgs,
+		env:           env,
+		dirs:          dirs,
+		traceOutput:   traceOutput,
+		dryRunOutput:  dryRunOutput,
+	}
+	if options.ProfileCPU != "" {
+		run.profiler = newCPUProfiler(wasmName, bundle.Module)
+		run.profiler.startSampling()
+		defer func() {
+			run.profiler.stopSampling()
+			if writeErr := run.profiler.writeTo(options.ProfileCPU); writeErr != nil {
+				err = errors.Join(err, fmt.Errorf("could not write CPU profile: %w", writeErr))
+			}
+		}()
+	}
+	if options.MemoryMonitor != nil {
+		options.MemoryMonitor.startSampling()
+		defer options.MemoryMonitor.stopSampling()
+	}
+	if options.Instances <= 1 {
+		return run.run(ctx)
+	}
+	return run.runInstances(ctx, options.Instances)
+}
+
+// moduleRun is the configuration of the instances of a module started by
+// Run.
+type moduleRun struct {
+	options       Options
+	runtimeConfig wazero.RuntimeConfig
+	bytecode      []byte
+	name          string
+	args          []string
+	invokeArgs    []string
+	env           []string
+	dirs          []string
+	traceOutput   io.Writer
+	dryRunOutput  io.Writer
+	profiler      *cpuProfiler
+	instance      int
+}
+
+// withListeners returns a context installing the function listeners of the
+// run and the listeners passed as arguments on the modules compiled with it.
+func (r *moduleRun) withListeners(ctx context.Context, listeners ...experimental.FunctionListenerFactory) context.Context {
+	if r.profiler != nil {
+		listeners = append(listeners, r.profiler)
+	}
+	if r.options.MemoryMonitor != nil {
+		listeners = append(listeners, memorySampler{})
+	}
+	switch len(listeners) {
+	case 0:
+		return ctx
+	case 1:
+		return context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, listeners[0])
+	default:
+		return context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, experimental.MultiFunctionListenerFactory(listeners...))
+	}
+}
+
+// runInstances runs n instances of the module concurrently, sharing the
+// compiled code of the module.
+func (r *moduleRun) runInstances(ctx context.Context, n int) error {
+	if r.options.Record != nil || r.options.Replay != nil {
+		return errors.New("system calls cannot be recorded or replayed with multiple instances")
+	}
+	cache := wazero.NewCompilationCache()
+	defer cache.Close(ctx)
+	r.runtimeConfig = r.runtimeConfig.WithCompilationCache(cache)
+
+	// Compile the modules once before starting the instances, which would
+	// otherwise all compile them concurrently.
+	if err := r.compile(ctx); err != nil {
+		return err
+	}
+
+	// Each instance copies the standard input to its pipe from a goroutine
+	// of its own (files are duplicated instead).
+	if _, isFile := r.options.Stdin.(*os.File); r.options.Stdin != nil && !isFile {
+		r.options.Stdin = &lockedReader{reader: r.options.Stdin}
+	}
+
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+	for i := range errs {
+		instance := *r
+		instance.instance = i
+		if r.options.CoreDump != "" {
+			instance.options.CoreDump += "." + strconv.Itoa(i)
+		}
+		instance.env = append(r.env[:len(r.env):len(r.env)], "WASIRUN_INSTANCE="+strconv.Itoa(i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := instance.run(ctx); err != nil {
+				errs[i] = &InstanceError{Instance: i, Err: err}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// lockedReader serializes the reads of a reader shared by instances.
+type lockedReader struct {
+	mutex  sync.Mutex
+	reader io.Reader
+}
+
+func (r *lockedReader) Read(b []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reader.Read(b)
+}
+
+func (r *moduleRun) compile(ctx context.Context) error {
+	ctx = r.withListeners(ctx)
+	runtime := wazero.NewRuntimeWithConfig(ctx, r.runtimeConfig)
+	defer runtime.Close(ctx)
+	if _, err := runtime.CompileModule(ctx, r.bytecode); err != nil {
+		return err
+	}
+	for _, preload := range r.options.Preloads {
+		name, path, ok := strings.Cut(preload, "=")
+		if !ok {
+			continue // reported by run
+		}
+		if _, err := compilePreload(ctx, runtime, path); err != nil {
+			return fmt.Errorf("could not compile preload '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// run runs an instance of the module and returns when it has exited.
+func (r *moduleRun) run(ctx context.Context) (err error) {
+	options := r.options
+	// The function listeners must be installed when the module is compiled.
+	var listeners []experimental.FunctionListenerFactory
+	if options.CoreDump != "" {
+		dumper := &coreDumper{name: r.name}
+		listeners = append(listeners, dumper)
+		defer func() {
+			if err == nil {
+				return
+			}
+			if trapped, writeErr := dumper.writeTo(options.CoreDump); writeErr != nil {
+				err = errors.Join(err, fmt.Errorf("could not write wasm coredump: %w", writeErr))
+			} else if trapped {
+				err = fmt.Errorf("%w (wasm coredump written to %s)", err, options.CoreDump)
+			}
+		}()
+	}
+	defer func() {
+		if err != nil {
+			err = symbolizeError(r.bytecode, err)
+		}
+	}()
+	ctx = r.withListeners(ctx, listeners...)
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, r.runtimeConfig.
+		WithCloseOnContextDone(true))
+	defer runtime.Close(ctx)
+
+	wasmModule, err := runtime.CompileModule(ctx, r.bytecode)
+	if err != nil {
+		return err
+	}
+	defer wasmModule.Close(ctx)
+
+	preloads := make([]imports.Preload, 0, len(options.Preloads))
+	for _, preload := range options.Preloads {
+		name, path, ok := strings.Cut(preload, "=")
+		if !ok || name == "" || path == "" {
+			return fmt.Errorf("invalid preload '%s', expected NAME=PATH", preload)
+		}
+		module, err := compilePreload(ctx, runtime, path)
+		if err != nil {
+			return fmt.Errorf("could not compile preload '%s': %w", name, err)
+		}
+		defer module.Close(ctx)
+		preloads = append(preloads, imports.Preload{Name: name, Module: module})
+	}
+
+	builder := imports.NewBuilder().
+		WithName(r.name).
+		WithArgs(r.args...).
+		WithEnv(r.env...).
+		WithDirs(r.dirs...).
+		WithListens(options.Listens...).
+		WithDials(options.Dials...).
+		WithPublish(options.Publish...).
+		WithSocketActivation(options.SocketActivation).
+		WithConnectionLimits(options.ConnectionLimits).
+		WithTLSListens(options.TLSListens...).
+		WithTLSConfig(options.TLSConfig).
+		WithTLSDials(options.TLSDials...).
+		WithTLSDialConfig(options.TLSDialConfig).
+		WithResolver(options.Resolver).
+		WithProxy(options.Proxy).
+		WithStdioStreams(options.Stdin, options.Stdout, options.Stderr).
+		WithNonBlockingStdio(options.NonBlockingStdio).
+		WithIOURing(options.IOURing).
+		WithDirCache(options.DirCache).
+		WithWindowsPaths(options.WindowsPaths).
+		WithDryRun(options.DryRun, r.dryRunOutput).
+		WithWriteScanner(options.ScanWrites).
+		WithDeterministic(options.Deterministic, options.Seed).
+		WithSuspendPolicy(options.SuspendPolicy).
+		WithRecord(options.Record).
+		WithReplay(options.Replay).
+		WithSocketsExtension(defaultString(options.Sockets, "auto"), wasmModule).
+		WithCancellation(ctx).
+		WithFileCopy(true).
+		WithFileMmap(true).
+		WithTerminal(true).
+		WithSignals(true).
+		WithCommands(options.Commands...).
+		WithSharedMemory(options.SharedMemory).
+		WithTracer(options.Trace != "", r.traceOutput).
+		WithTracerFormat(options.Trace).
+		WithTracerFilter(options.TraceFilter).
+		WithTracerSwitch(options.TraceSwitch).
+		WithPolicy(options.Policy).
+		WithDenyPaths(options.DenyPaths...).
+		WithAllowDials(options.AllowDials...).
+		WithAudit(options.Audit).
+		WithWrappers(options.Wrappers...).
+		WithPreloads(preloads...).
+		WithSignalHandler(options.SignalHandler).
+		WithYield(options.Yield).
+		WithYieldEvery(options.YieldEvery)
+	for signal, action := range options.SignalActions {
+		builder.WithSignalAction(action, signal)
+	}
+	if options.ChildModules {
+		builder.WithChildModules(r.runtimeConfig)
+	}
+
+	var system wasi.System
+	ctx, system, err = builder.Instantiate(ctx, runtime)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Errors reported when closing the system (e.g. by the write
+		// scanner) fail the run if the module exited successfully.
+		if closeErr := system.Close(ctx); err == nil {
+			err = closeErr
+		}
+	}()
+
+	// When the context is canceled, or the caller asks the module to
+	// terminate, unblock calls that the module may be waiting on so the
+	// instance can terminate promptly.
+	if shutdowner, ok := system.(interface{ Shutdown(context.Context) error }); ok {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-options.Interrupt:
+			case <-stop:
+				return
+			}
+			shutdowner.Shutdown(context.Background())
+		}()
+	}
+
+	importWasi := false
+	switch wasiHttp := defaultString(options.HTTP, "auto"); wasiHttp {
+	case "auto":
+		importWasi = wasi_http.DetectWasiHttp(wasmModule)
+	case "v1":
+		importWasi = true
+	case "none":
+		importWasi = false
+	default:
+		return fmt.Errorf("invalid value for -http '%v', expected 'auto', 'v1' or 'none'", wasiHttp)
+	}
+	if importWasi {
+		var httpOptions []wasi_http.Option
+		if client := httpClient(options); client != nil {
+			httpOptions = append(httpOptions, wasi_http.WithClient(client))
+		}
+		if err := wasi_http.Instantiate(ctx, runtime, httpOptions...); err != nil {
+			return err
+		}
+	}
+
+	if wasi_parallel.DetectWasiParallel(wasmModule) {
+		var parallelOptions []wasi_parallel.Option
+		if options.ParallelWorkers > 0 {
+			parallelOptions = append(parallelOptions, wasi_parallel.WithWorkers(options.ParallelWorkers))
+		}
+		if err := wasi_parallel.Instantiate(ctx, runtime, wasmModule, parallelOptions...); err != nil {
+			return err
+		}
+	}
+
+	moduleConfig := wazero.NewModuleConfig()
+	// The module is started after it was instantiated when its memory is
+	// monitored, so that it can be tracked while it runs.
+	monitor := options.MemoryMonitor
+	switch {
+	case options.Invoke != "":
+		moduleConfig = moduleConfig.WithStartFunctions("_initialize")
+	case monitor != nil:
+		moduleConfig = moduleConfig.WithStartFunctions()
+	}
+	instance, err := runtime.InstantiateModule(ctx, wasmModule, moduleConfig)
+	if err != nil {
+		return err
+	}
+	defer instance.Close(ctx)
+
+	// The memory of the instance is sampled in the context of its calls.
+	callCtx := ctx
+	if monitor != nil {
+		var exit func()
+		callCtx, exit = monitor.track(ctx, r.name, r.instance, instance.Memory())
+		defer exit()
+		if options.Invoke == "" {
+			if err := startModule(callCtx, instance); err != nil {
+				return err
+			}
+		}
+	}
+
+	if options.Invoke != "" {
+		results, err := Invoke(callCtx, instance, options.Invoke, r.invokeArgs...)
+		if err != nil {
+			return err
+		}
+		stdout := options.Stdout
+		if stdout == nil {
+			stdout = os.Stdout
+		}
+		for _, result := range results {
+			fmt.Fprintln(stdout, result)
+		}
+	}
+	return instance.Close(ctx)
+}
+
+// InstanceError is the error of an instance of a module when Run runs
+// multiple instances.
+type InstanceError struct {
+	// Instance is the index of the instance, from zero.
+	Instance int
+	// Err is the error returned by the instance, which is a *sys.ExitError
+	// when the instance exited with a non-zero exit code.
+	Err error
+}
+
+func (e *InstanceError) Error() string {
+	return fmt.Sprintf("instance %d: %v", e.Instance, e.Err)
+}
+
+func (e *InstanceError) Unwrap() error {
+	return e.Err
+}
+
+func compilePreload(ctx context.Context, runtime wazero.Runtime, path string) (wazero.CompiledModule, error) {
+	bundle, err := OpenBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.Close()
+	return runtime.CompileModule(ctx, bundle.Module)
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,703 @@
+package wasirun
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+func TestRunInstances(t *testing.T) {
+	stdout := new(syncBuffer)
+	err := Run(context.Background(), Options{
+		Module:    "../testdata/go/hello_world.wasm",
+		Instances: 3,
+		Stdin:     strings.NewReader(""),
+		Stdout:    stdout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), strings.Repeat("Hello World!\n", 3); got != want {
+		t.Errorf("wrong output:\nwant = %q\ngot  = %q", want, got)
+	}
+}
+
+func TestRunCoreDump(t *testing.T) {
+	// (module
+	//   (memory (export "memory") 1)
+	//   (global (mut i32) (i32.const 42))
+	//   (data (i32.const 16) "hello")
+	//   (func $crash (param i32) unreachable)
+	//   (func (export "_start") (call $crash (i32.const 7))))
+	module := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x08, 0x02, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x00, 0x00, // types
+		0x03, 0x03, 0x02, 0x00, 0x01, // functions
+		0x05, 0x03, 0x01, 0x00, 0x01, // memory
+		0x06, 0x06, 0x01, 0x7f, 0x01, 0x41, 0x2a, 0x0b, // globals
+		0x07, 0x13, 0x02, // exports
+		0x06, '_', 's', 't', 'a', 'r', 't', 0x00, 0x01,
+		0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+		0x0a, 0x0c, 0x02, // code
+		0x03, 0x00, 0x00, 0x0b,
+		0x06, 0x00, 0x41, 0x07, 0x10, 0x00, 0x0b,
+		0x0b, 0x0b, 0x01, 0x00, 0x41, 0x10, 0x0b, 0x05, 'h', 'e', 'l', 'l', 'o', // data
+	}
+	dir := t.TempDir()
+	wasmFile := filepath.Join(dir, "crash.wasm")
+	if err := os.WriteFile(wasmFile, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	coreDump := filepath.Join(dir, "core.wasm")
+
+	ctx := context.Background()
+	err := Run(ctx, Options{
+		Module:   wasmFile,
+		Stdin:    strings.NewReader(""),
+		CoreDump: coreDump,
+	})
+	if err == nil || !strings.Contains(err.Error(), "unreachable") || !strings.Contains(err.Error(), coreDump) {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	b, err := os.ReadFile(coreDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCustomSections(true))
+	defer runtime.Close(ctx)
+	dump, err := runtime.CompileModule(ctx, b)
+	if err != nil {
+		t.Fatal("invalid coredump:", err)
+	}
+	sections := map[string][]byte{}
+	for _, section := range dump.CustomSections() {
+		sections[section.Name()] = section.Data()
+	}
+	for name, want := range map[string]string{
+		"core":          "\x00\x0acrash.wasm",
+		"coremodules":   "\x01\x00\x00", // anonymous module
+		"coreinstances": "\x01\x00\x00\x01\x00\x01\x00",
+		// $crash with its parameter, then _start
+		"corestack": "\x00\x04main\x02" +
+			"\x00\x00\x00\x00\x01\x7f\x07\x00" +
+			"\x00\x00\x01\x00\x00\x00",
+	} {
+		if got := string(sections[name]); got != want {
+			t.Errorf("wrong %s section:\nwant = %q\ngot  = %q", name, want, got)
+		}
+	}
+
+	instance, err := runtime.InstantiateModule(ctx, dump, wazero.NewModuleConfig().WithName("core"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := instance.Memory().Read(16, 5); string(data) != "hello" {
+		t.Errorf("wrong memory content: %q", data)
+	}
+}
+
+func TestRunProfileCPU(t *testing.T) {
+	// (module
+	//   (func $spin (local i32)
+	//     (loop (br_if 0 (i32.ne (local.tee 0 (i32.add (local.get 0) (i32.const 1))) (i32.const 200000000)))))
+	//   (func $_start (export "_start") (call $spin)))
+	module := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x04, 0x01, 0x60, 0x00, 0x00, // types
+		0x03, 0x03, 0x02, 0x00, 0x00, // functions
+		0x07, 0x0a, 0x01, 0x06, '_', 's', 't', 'a', 'r', 't', 0x00, 0x01, // exports
+		0x0a, 0x1e, 0x02, // code
+		0x17, 0x01, 0x01, 0x7f, 0x03, 0x40, 0x20, 0x00, 0x41, 0x01, 0x6a, 0x22, 0x00,
+		0x41, 0x80, 0x84, 0xaf, 0xdf, 0x00, 0x47, 0x0d, 0x00, 0x0b, 0x0b,
+		0x04, 0x00, 0x10, 0x00, 0x0b,
+		0x00, 0x16, 0x04, 'n', 'a', 'm', 'e', // names
+		0x01, 0x0f, 0x02, 0x00, 0x04, 's', 'p', 'i', 'n', 0x01, 0x06, '_', 's', 't', 'a', 'r', 't',
+	}
+	dir := t.TempDir()
+	wasmFile := filepath.Join(dir, "spin.wasm")
+	if err := os.WriteFile(wasmFile, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile := filepath.Join(dir, "cpu.pb.gz")
+
+	err := Run(context.Background(), Options{
+		Module:     wasmFile,
+		Stdin:      strings.NewReader(""),
+		ProfileCPU: profile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, table := decodeProfile(t, b)
+	if samples == 0 {
+		t.Error("the profile has no samples")
+	}
+	for _, name := range []string{"cpu", "nanoseconds", "spin", "_start"} {
+		found := false
+		for _, s := range table {
+			found = found || s == name
+		}
+		if !found {
+			t.Errorf("the string table of the profile is missing %q: %q", name, table)
+		}
+	}
+}
+
+// abortModule raises SIGABRT:
+//
+//	(module
+//	  (import "wasi_snapshot_preview1" "proc_raise" (func $raise (param i32) (result i32)))
+//	  (memory (export "memory") 1)
+//	  (func (export "_start") (drop (call $raise (i32.const 6)))))
+var abortModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x09, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x00, 0x00, // types
+	0x02, 0x25, 0x01, // imports
+	0x16, 'w', 'a', 's', 'i', '_', 's', 'n', 'a', 'p', 's', 'h', 'o', 't', '_', 'p', 'r', 'e', 'v', 'i', 'e', 'w', '1',
+	0x0a, 'p', 'r', 'o', 'c', '_', 'r', 'a', 'i', 's', 'e', 0x00, 0x00,
+	0x03, 0x02, 0x01, 0x01, // functions
+	0x05, 0x03, 0x01, 0x00, 0x01, // memory
+	0x07, 0x13, 0x02, // exports
+	0x06, '_', 's', 't', 'a', 'r', 't', 0x00, 0x01,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x0a, 0x09, 0x01, 0x07, 0x00, 0x41, 0x06, 0x10, 0x00, 0x1a, 0x0b, // code
+}
+
+func TestRunSignalActions(t *testing.T) {
+	wasmFile := filepath.Join(t.TempDir(), "abort.wasm")
+	if err := os.WriteFile(wasmFile, abortModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Run(context.Background(), Options{
+		Module: wasmFile,
+		Stdin:  strings.NewReader(""),
+	})
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 134 {
+		t.Fatalf("SIGABRT did not terminate the module with exit code 134: %v", err)
+	}
+
+	err = Run(context.Background(), Options{
+		Module:        wasmFile,
+		Stdin:         strings.NewReader(""),
+		SignalActions: map[wasi.Signal]wasi.SignalAction{wasi.SIGABRT: wasi.SignalIgnore},
+	})
+	if err != nil {
+		t.Fatalf("SIGABRT was not ignored: %v", err)
+	}
+
+	var handled []wasi.Signal
+	err = Run(context.Background(), Options{
+		Module:        wasmFile,
+		Stdin:         strings.NewReader(""),
+		SignalActions: map[wasi.Signal]wasi.SignalAction{wasi.SIGABRT: wasi.SignalHandle},
+		SignalHandler: func(ctx context.Context, signal wasi.Signal) error {
+			handled = append(handled, signal)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0] != wasi.SIGABRT {
+		t.Fatalf("wrong signals handled: %v", handled)
+	}
+}
+
+// spawnModule spawns /dir/abort.wasm as a child process, and exits with the
+// exit status of the child, plus the errno of proc_spawn times 256 and the
+// errno of proc_wait times 65536:
+//
+//	(module
+//	  (import "wasi_snapshot_preview1" "proc_spawn" (func $spawn (param i32 i32 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_wait" (func $wait (param i32 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "/dir/abort.wasm\00")
+//	  (func (export "_start")
+//	    (i32.store (i32.const 96) (call $spawn (i32.const 0) (i32.const 16) (i32.const 64) (i32.const 80)))
+//	    (i32.store (i32.const 100) (call $wait (i32.load (i32.const 80)) (i32.const 0) (i32.const 84)))
+//	    (call $exit (i32.add (i32.add (i32.load (i32.const 84))
+//	      (i32.mul (i32.load (i32.const 96)) (i32.const 256)))
+//	      (i32.mul (i32.load (i32.const 100)) (i32.const 65536))))))
+var spawnModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x17, 0x04, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x03, 0x7f, 0x7f, 0x7f,
+	0x01, 0x7f, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x00, 0x00, // types
+	0x02, 0x6b, 0x03, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f,
+	0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x0a, 0x70, 0x72, 0x6f, 0x63, 0x5f,
+	0x73, 0x70, 0x61, 0x77, 0x6e, 0x00, 0x00, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61,
+	0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09, 0x70,
+	0x72, 0x6f, 0x63, 0x5f, 0x77, 0x61, 0x69, 0x74, 0x00, 0x01, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f,
+	0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77,
+	0x31, 0x09, 0x70, 0x72, 0x6f, 0x63, 0x5f, 0x65, 0x78, 0x69, 0x74, 0x00, 0x02, // imports
+	0x03, 0x02, 0x01, 0x03, // functions
+	0x05, 0x03, 0x01, 0x00, 0x01, // memory
+	0x07, 0x13, 0x02, 0x06, 0x5f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x00, 0x03, 0x06, 0x6d, 0x65, 0x6d,
+	0x6f, 0x72, 0x79, 0x02, 0x00, // exports
+	0x0a, 0x48, 0x01, 0x46, 0x00, 0x41, 0xe0, 0x00, 0x41, 0x00, 0x41, 0x10, 0x41, 0xc0, 0x00, 0x41,
+	0xd0, 0x00, 0x10, 0x00, 0x36, 0x02, 0x00, 0x41, 0xe4, 0x00, 0x41, 0xd0, 0x00, 0x28, 0x02, 0x00,
+	0x41, 0x00, 0x41, 0xd4, 0x00, 0x10, 0x01, 0x36, 0x02, 0x00, 0x41, 0xd4, 0x00, 0x28, 0x02, 0x00,
+	0x41, 0xe0, 0x00, 0x28, 0x02, 0x00, 0x41, 0x80, 0x02, 0x6c, 0x6a, 0x41, 0xe4, 0x00, 0x28, 0x02,
+	0x00, 0x41, 0x80, 0x80, 0x04, 0x6c, 0x6a, 0x10, 0x02, 0x0b, // code
+	0x0b, 0x16, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x10, 0x2f, 0x64, 0x69, 0x72, 0x2f, 0x61, 0x62, 0x6f,
+	0x72, 0x74, 0x2e, 0x77, 0x61, 0x73, 0x6d, 0x00, // data
+}
+
+func TestRunChildModules(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "abort.wasm"), abortModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wasmFile := filepath.Join(t.TempDir(), "spawn.wasm")
+	if err := os.WriteFile(wasmFile, spawnModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Run(context.Background(), Options{
+		Module:       wasmFile,
+		Dirs:         []string{dir + ":/dir"},
+		Stdin:        strings.NewReader(""),
+		ChildModules: true,
+	})
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 134 {
+		t.Fatalf("the exit status of the child module was not 134: %v", err)
+	}
+
+	err = Run(context.Background(), Options{
+		Module: wasmFile,
+		Dirs:   []string{dir + ":/dir"},
+		Stdin:  strings.NewReader(""),
+	})
+	if err == nil {
+		t.Fatal("the module was run without the process extension")
+	}
+}
+
+// pollModule blocks in poll_oneoff on a one hour timeout:
+//
+//	(module
+//	  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "<clock subscription on the monotonic clock, timeout of 1h>")
+//	  (func (export "_start")
+//	    (drop (call $poll (i32.const 0) (i32.const 64) (i32.const 1) (i32.const 128)))))
+var pollModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x02, 0x60, 0x04, 0x7f, 0x7f, 0x7f,
+	0x7f, 0x01, 0x7f, 0x60, 0x00, 0x00, 0x02, 0x26, 0x01, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73,
+	0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31,
+	0x0b, 0x70, 0x6f, 0x6c, 0x6c, 0x5f, 0x6f, 0x6e, 0x65, 0x6f, 0x66, 0x66, 0x00, 0x00, 0x03, 0x02,
+	0x01, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01, 0x07, 0x13, 0x02, 0x06, 0x5f, 0x73, 0x74, 0x61, 0x72,
+	0x74, 0x00, 0x01, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0a, 0x11, 0x01, 0x0f,
+	0x00, 0x41, 0x00, 0x41, 0xc0, 0x00, 0x41, 0x01, 0x41, 0x80, 0x01, 0x10, 0x00, 0x1a, 0x0b, 0x0b,
+	0x36, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xa0, 0xb8, 0x30, 0x46, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+func TestRunInterrupt(t *testing.T) {
+	wasmFile := filepath.Join(t.TempDir(), "poll.wasm")
+	if err := os.WriteFile(wasmFile, pollModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The system is wrapped by the tracer, interrupting the module must
+	// still unblock poll_oneoff.
+	interrupt := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), Options{
+			Module:      wasmFile,
+			Stdin:       strings.NewReader(""),
+			Trace:       "text",
+			TraceOutput: io.Discard,
+			Interrupt:   interrupt,
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(interrupt)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("poll_oneoff was not interrupted")
+	}
+}
+
+// killModule spawns /dir/poll.wasm as a child process, kills it with SIGKILL,
+// and exits with the exit status of the child, plus the errnos of proc_spawn,
+// proc_kill, and proc_wait or-ed and times 256:
+//
+//	(module
+//	  (import "wasi_snapshot_preview1" "proc_spawn" (func $spawn (param i32 i32 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_kill" (func $kill (param i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_wait" (func $wait (param i32 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "/dir/poll.wasm\00")
+//	  (func (export "_start")
+//	    (i32.store (i32.const 96) (call $spawn (i32.const 0) (i32.const 15) (i32.const 64) (i32.const 80)))
+//	    (i32.store (i32.const 100) (call $kill (i32.load (i32.const 80)) (i32.const 9)))
+//	    (i32.store (i32.const 104) (call $wait (i32.load (i32.const 80)) (i32.const 0) (i32.const 84)))
+//	    (call $exit (i32.add (i32.load (i32.const 84))
+//	      (i32.mul (i32.or (i32.or (i32.load (i32.const 96)) (i32.load (i32.const 100)))
+//	        (i32.load (i32.const 104))) (i32.const 256))))))
+var killModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x1d, 0x05, 0x60, 0x04, 0x7f, 0x7f, 0x7f,
+	0x7f, 0x01, 0x7f, 0x60, 0x03, 0x7f, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x00,
+	0x00, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f, 0x02, 0x8e, 0x01, 0x04, 0x16, 0x77, 0x61, 0x73, 0x69,
+	0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65,
+	0x77, 0x31, 0x0a, 0x70, 0x72, 0x6f, 0x63, 0x5f, 0x73, 0x70, 0x61, 0x77, 0x6e, 0x00, 0x00, 0x16,
+	0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72,
+	0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09, 0x70, 0x72, 0x6f, 0x63, 0x5f, 0x6b, 0x69, 0x6c, 0x6c,
+	0x00, 0x04, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74,
+	0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09, 0x70, 0x72, 0x6f, 0x63, 0x5f, 0x77,
+	0x61, 0x69, 0x74, 0x00, 0x01, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73,
+	0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09, 0x70, 0x72, 0x6f,
+	0x63, 0x5f, 0x65, 0x78, 0x69, 0x74, 0x00, 0x02, 0x03, 0x02, 0x01, 0x03, 0x05, 0x03, 0x01, 0x00,
+	0x01, 0x07, 0x13, 0x02, 0x06, 0x5f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x00, 0x04, 0x06, 0x6d, 0x65,
+	0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0a, 0x5a, 0x01, 0x58, 0x00, 0x41, 0xe0, 0x00, 0x41, 0x00,
+	0x41, 0x0f, 0x41, 0xc0, 0x00, 0x41, 0xd0, 0x00, 0x10, 0x00, 0x36, 0x02, 0x00, 0x41, 0xe4, 0x00,
+	0x41, 0xd0, 0x00, 0x28, 0x02, 0x00, 0x41, 0x09, 0x10, 0x01, 0x36, 0x02, 0x00, 0x41, 0xe8, 0x00,
+	0x41, 0xd0, 0x00, 0x28, 0x02, 0x00, 0x41, 0x00, 0x41, 0xd4, 0x00, 0x10, 0x02, 0x36, 0x02, 0x00,
+	0x41, 0xd4, 0x00, 0x28, 0x02, 0x00, 0x41, 0xe0, 0x00, 0x28, 0x02, 0x00, 0x41, 0xe4, 0x00, 0x28,
+	0x02, 0x00, 0x72, 0x41, 0xe8, 0x00, 0x28, 0x02, 0x00, 0x72, 0x41, 0x80, 0x02, 0x6c, 0x6a, 0x10,
+	0x03, 0x0b, 0x0b, 0x15, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x0f, 0x2f, 0x64, 0x69, 0x72, 0x2f, 0x70,
+	0x6f, 0x6c, 0x6c, 0x2e, 0x77, 0x61, 0x73, 0x6d, 0x00,
+}
+
+func TestRunKillChildModule(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "poll.wasm"), pollModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wasmFile := filepath.Join(t.TempDir(), "kill.wasm")
+	if err := os.WriteFile(wasmFile, killModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), Options{
+			Module:       wasmFile,
+			Dirs:         []string{dir + ":/dir"},
+			Stdin:        strings.NewReader(""),
+			ChildModules: true,
+		})
+	}()
+
+	select {
+	case err := <-done:
+		var exitErr *sys.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 137 {
+			t.Fatalf("the exit status of the killed child module was not 137: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the child module blocked in poll_oneoff was not killed")
+	}
+}
+
+// openModule opens the file "secret" of its first preopened directory, and
+// exits with the errno of path_open:
+//
+//	(module
+//	  (import "wasi_snapshot_preview1" "path_open" (func $open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "secret")
+//	  (func (export "_start")
+//	    (call $exit (call $open (i32.const 3) (i32.const 0) (i32.const 0) (i32.const 6)
+//	      (i32.const 0) (i64.const 2) (i64.const 0) (i32.const 0) (i32.const 16)))))
+var openModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x15, 0x03, 0x60, 0x09, 0x7f, 0x7f, 0x7f,
+	0x7f, 0x7f, 0x7e, 0x7e, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x00, 0x00, 0x02,
+	0x47, 0x02, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74,
+	0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09, 0x70, 0x61, 0x74, 0x68, 0x5f, 0x6f,
+	0x70, 0x65, 0x6e, 0x00, 0x00, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73,
+	0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09, 0x70, 0x72, 0x6f,
+	0x63, 0x5f, 0x65, 0x78, 0x69, 0x74, 0x00, 0x01, 0x03, 0x02, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00,
+	0x01, 0x07, 0x13, 0x02, 0x06, 0x5f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x00, 0x02, 0x06, 0x6d, 0x65,
+	0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0a, 0x1a, 0x01, 0x18, 0x00, 0x41, 0x03, 0x41, 0x00, 0x41,
+	0x00, 0x41, 0x06, 0x41, 0x00, 0x42, 0x02, 0x42, 0x00, 0x41, 0x00, 0x41, 0x10, 0x10, 0x00, 0x10,
+	0x01, 0x0b, 0x0b, 0x0c, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x06, 0x73, 0x65, 0x63, 0x72, 0x65, 0x74,
+}
+
+// spawnOpenModule spawns /dir/open.wasm as a child process, and exits with the
+// exit status of the child, plus the errnos of proc_spawn and proc_wait or-ed
+// and times 256:
+//
+//	(module
+//	  (import "wasi_snapshot_preview1" "proc_spawn" (func $spawn (param i32 i32 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_wait" (func $wait (param i32 i32 i32) (result i32)))
+//	  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "/dir/open.wasm\00")
+//	  (func (export "_start")
+//	    (i32.store (i32.const 96) (call $spawn (i32.const 0) (i32.const 15) (i32.const 64) (i32.const 80)))
+//	    (i32.store (i32.const 100) (call $wait (i32.load (i32.const 80)) (i32.const 0) (i32.const 84)))
+//	    (call $exit (i32.add (i32.load (i32.const 84))
+//	      (i32.mul (i32.or (i32.load (i32.const 96)) (i32.load (i32.const 100))) (i32.const 256))))))
+var spawnOpenModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x17, 0x04, 0x60, 0x04, 0x7f, 0x7f, 0x7f,
+	0x7f, 0x01, 0x7f, 0x60, 0x03, 0x7f, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x00,
+	0x00, 0x02, 0x6b, 0x03, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68,
+	0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x0a, 0x70, 0x72, 0x6f, 0x63,
+	0x5f, 0x73, 0x70, 0x61, 0x77, 0x6e, 0x00, 0x00, 0x16, 0x77, 0x61, 0x73, 0x69, 0x5f, 0x73, 0x6e,
+	0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x31, 0x09,
+	0x70, 0x72, 0x6f, 0x63, 0x5f, 0x77, 0x61, 0x69, 0x74, 0x00, 0x01, 0x16, 0x77, 0x61, 0x73, 0x69,
+	0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x70, 0x72, 0x65, 0x76, 0x69, 0x65,
+	0x77, 0x31, 0x09, 0x70, 0x72, 0x6f, 0x63, 0x5f, 0x65, 0x78, 0x69, 0x74, 0x00, 0x02, 0x03, 0x02,
+	0x01, 0x03, 0x05, 0x03, 0x01, 0x00, 0x01, 0x07, 0x13, 0x02, 0x06, 0x5f, 0x73, 0x74, 0x61, 0x72,
+	0x74, 0x00, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0a, 0x43, 0x01, 0x41,
+	0x00, 0x41, 0xe0, 0x00, 0x41, 0x00, 0x41, 0x0f, 0x41, 0xc0, 0x00, 0x41, 0xd0, 0x00, 0x10, 0x00,
+	0x36, 0x02, 0x00, 0x41, 0xe4, 0x00, 0x41, 0xd0, 0x00, 0x28, 0x02, 0x00, 0x41, 0x00, 0x41, 0xd4,
+	0x00, 0x10, 0x01, 0x36, 0x02, 0x00, 0x41, 0xd4, 0x00, 0x28, 0x02, 0x00, 0x41, 0xe0, 0x00, 0x28,
+	0x02, 0x00, 0x41, 0xe4, 0x00, 0x28, 0x02, 0x00, 0x72, 0x41, 0x80, 0x02, 0x6c, 0x6a, 0x10, 0x02,
+	0x0b, 0x0b, 0x15, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x0f, 0x2f, 0x64, 0x69, 0x72, 0x2f, 0x6f, 0x70,
+	0x65, 0x6e, 0x2e, 0x77, 0x61, 0x73, 0x6d, 0x00,
+}
+
+func TestRunChildModuleDenyPaths(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"open.wasm": openModule,
+		"secret":    []byte("password"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wasmFile := filepath.Join(t.TempDir(), "spawn.wasm")
+	if err := os.WriteFile(wasmFile, spawnOpenModule, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The child modules inherit the restrictions of the guest, which would
+	// otherwise escape them by spawning a module.
+	for _, test := range []struct {
+		denyPaths []string
+		errno     wasi.Errno
+	}{
+		{nil, wasi.ESUCCESS},
+		{[]string{"**/secret"}, wasi.EPERM},
+	} {
+		err := Run(context.Background(), Options{
+			Module:       wasmFile,
+			Dirs:         []string{dir + ":/dir"},
+			Stdin:        strings.NewReader(""),
+			DenyPaths:    test.denyPaths,
+			ChildModules: true,
+		})
+		code := 0
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) {
+			code = int(exitErr.ExitCode())
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != int(test.errno) {
+			t.Errorf("deny paths %q: wrong exit status of the child module: want=%d (%s) got=%d", test.denyPaths, test.errno, test.errno, code)
+		}
+	}
+}
+
+func TestMemorySampler(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	// (module (memory (export "memory") 1))
+	module, err := runtime.Instantiate(ctx, []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x05, 0x03, 0x01, 0x00, 0x01, // memory
+		0x07, 0x0a, 0x01, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, // exports
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monitor := NewMemoryMonitor()
+	callCtx, exit := monitor.track(ctx, "test", 0, module.Memory())
+	if size := monitor.LinearMemory(); size != 65536 {
+		t.Errorf("wrong linear memory: want=65536 got=%d", size)
+	}
+
+	// The memory grown by the instance is only observed when it calls the
+	// host, in the context returned by track.
+	module.Memory().Grow(1)
+	sampler := memorySampler{}
+	sampler.Before(ctx, module, nil, nil, nil)
+	if size := monitor.LinearMemory(); size != 65536 {
+		t.Errorf("the memory was sampled outside of the calls of the instance: %d", size)
+	}
+	sampler.Before(callCtx, module, nil, nil, nil)
+	if size := monitor.LinearMemory(); size != 131072 {
+		t.Errorf("wrong linear memory: want=131072 got=%d", size)
+	}
+
+	exit()
+	if report := monitor.Report(); !report.Instances[0].Exited || report.Instances[0].LinearMemory != 131072 {
+		t.Errorf("wrong memory usage: %+v", report.Instances[0])
+	}
+}
+
+func TestRunMemoryMonitor(t *testing.T) {
+	monitor := NewMemoryMonitor()
+	err := Run(context.Background(), Options{
+		Module:        "../testdata/go/hello_world.wasm",
+		Instances:     2,
+		Stdin:         strings.NewReader(""),
+		Stdout:        io.Discard,
+		MemoryMonitor: monitor,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := monitor.Report()
+	if len(report.Instances) != 2 {
+		t.Fatalf("wrong number of instances: %d", len(report.Instances))
+	}
+	for _, i := range report.Instances {
+		if i.Module != "hello_world.wasm" || !i.Exited || i.LinearMemory == 0 {
+			t.Errorf("wrong memory usage: %+v", i)
+		}
+	}
+	if monitor.LinearMemory() != 0 {
+		t.Errorf("exited instances are counted in the linear memory: %d", monitor.LinearMemory())
+	}
+
+	w := httptest.NewRecorder()
+	monitor.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/wasm_memory", nil))
+	z, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, table := decodeProfile(t, b)
+	if samples != 3 {
+		t.Errorf("wrong number of samples: %d", samples)
+	}
+	for _, name := range []string{"peak_memory", "bytes", "host", "hello_world.wasm[0]", "hello_world.wasm[1]"} {
+		found := false
+		for _, s := range table {
+			found = found || s == name
+		}
+		if !found {
+			t.Errorf("the string table of the profile is missing %q: %q", name, table)
+		}
+	}
+}
+
+// decodeProfile walks the fields of a profile message in the pprof format,
+// counting the samples and collecting the string table.
+func decodeProfile(t *testing.T, b []byte) (samples int, table []string) {
+	t.Helper()
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("malformed profile")
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("malformed profile")
+		}
+		b = b[n:]
+		if key&7 != 2 {
+			continue
+		}
+		if v > uint64(len(b)) {
+			t.Fatal("malformed profile")
+		}
+		switch key >> 3 {
+		case 2:
+			samples++
+		case 6:
+			table = append(table, string(b[:v]))
+		}
+		b = b[v:]
+	}
+	return samples, table
+}
+
+func TestSymbolizeError(t *testing.T) {
+	bytecode, err := os.ReadFile("../testdata/tinygo/hello_world.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+	module, err := runtime.CompileModule(ctx, bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := module.ExportedFunctions()["_start"].Index()
+
+	trap := fmt.Errorf("wasm error: unreachable\nwasm stack trace:\n\thello_world.$%d()\n\thello_world.$0(i32)", index)
+	err = symbolizeError(bytecode, trap)
+	want := "wasm error: unreachable\nwasm stack trace:\n\thello_world.runtime._start()\n\thello_world.$0(i32)"
+	if err.Error() != want {
+		t.Errorf("wrong error:\nwant = %q\ngot  = %q", want, err)
+	}
+	if !errors.Is(err, trap) {
+		t.Error("the symbolized error does not wrap the trap")
+	}
+}
+
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
@@ -0,0 +1,215 @@
+package wasitest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+)
+
+var updateGolden = flag.Bool("wasitest.update", false, "update the golden trace files of wasitest.GoldenTrace")
+
+// GoldenTrace wraps system to record the calls made to its methods, and
+// compares them to the golden trace file at path when the test completes.
+//
+// The trace is in the format of wasi.TraceJSON, with the values depending on
+// the host normalized so the golden files are reproducible:
+//
+//   - the time and duration of calls are removed
+//   - timestamps, device and inode numbers are set to zero
+//   - the sizes and link counts of directories are set to zero
+//   - file descriptors other than stdio are renumbered from 3 in the order
+//     they first appear
+//   - the names of directory entries are sorted
+//
+// Running the tests with -wasitest.update writes the trace to the golden file
+// instead, the changes to golden files then show the changes of behavior of
+// the system in review.
+func GoldenTrace(t testing.TB, path string, system wasi.System, options ...wasi.TraceOption) wasi.System {
+	trace := new(bytes.Buffer)
+	t.Cleanup(func() {
+		got, err := normalizeTrace(trace)
+		if err != nil {
+			t.Fatalf("normalizing trace: %v", err)
+		}
+		if *updateGolden {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("%s: golden trace not found, run the test with -wasitest.update to create it", path)
+			}
+			t.Fatal(err)
+		}
+		if line, w, g, ok := diffLines(string(want), string(got)); !ok {
+			t.Errorf("%s:%d: the trace differs from the golden trace\nwant = %s\ngot  = %s", path, line, w, g)
+		}
+	})
+	return wasi.TraceJSON(trace, system, options...)
+}
+
+// TestGoldenTraces runs the WebAssembly programs passed as file paths like
+// TestWASIP1, and compares the calls they make to the system to golden trace
+// files (see GoldenTrace). The golden trace of each program is in the same
+// directory, with the .trace extension instead of .wasm.
+//
+// The programs run with no environment variables and only their name as
+// argument, to be deterministic.
+func TestGoldenTraces(t *testing.T, filePaths []string, makeSystem MakeSystem) {
+	if len(filePaths) == 0 {
+		t.Log("nothing to test")
+	}
+
+	for _, test := range filePaths {
+		test := test
+		name := strings.TrimSuffix(filepath.Base(test), ".wasm")
+
+		t.Run(name, func(t *testing.T) {
+			bytecode, err := os.ReadFile(test)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			system, err := makeSystem(TestConfig{
+				Args:   []string{name},
+				Stdout: newOutputBuffer(),
+				Stderr: newOutputBuffer(),
+				Rand:   rand.Reader,
+				Now:    time.Now,
+			})
+			if err != nil {
+				t.Fatal("system:", err)
+			}
+			defer system.Close(context.Background())
+
+			golden := strings.TrimSuffix(test, ".wasm") + ".trace"
+			runWASIP1(t, bytecode, GoldenTrace(t, golden, system))
+		})
+	}
+}
+
+// fdKeys are the keys of the trace records holding file descriptors.
+var fdKeys = map[string]bool{
+	"fd":   true,
+	"from": true,
+	"to":   true,
+}
+
+// zeroKeys are the keys of the trace records holding values which depend on
+// the host.
+var zeroKeys = map[string]bool{
+	"timestamp":  true,
+	"accessTime": true,
+	"modifyTime": true,
+	"changeTime": true,
+	"device":     true,
+	"inode":      true,
+}
+
+func normalizeTrace(trace *bytes.Buffer) ([]byte, error) {
+	// The file descriptors of stdio are preserved, since the guest programs
+	// expect them at these numbers.
+	fds := map[string]int{"0": 0, "1": 1, "2": 2}
+	out := new(bytes.Buffer)
+	dec := json.NewDecoder(trace)
+	dec.UseNumber()
+	enc := json.NewEncoder(out)
+
+	for dec.More() {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			return nil, err
+		}
+		delete(record, "time")
+		delete(record, "duration")
+		normalizeValue(record, fds)
+		if result, ok := record["result"].(map[string]any); ok {
+			if names, ok := result["names"].([]any); ok {
+				sort.Slice(names, func(i, j int) bool {
+					return names[i].(string) < names[j].(string)
+				})
+			}
+		}
+		if err := enc.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func normalizeValue(value any, fds map[string]int) {
+	switch v := value.(type) {
+	case map[string]any:
+		// The keys are sorted so the file descriptors are renumbered in the
+		// same order when a record has more than one.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := v[key]
+			switch n, isNumber := field.(json.Number); {
+			case isNumber && fdKeys[key]:
+				fd, ok := fds[n.String()]
+				if !ok {
+					fd = len(fds)
+					fds[n.String()] = fd
+				}
+				v[key] = fd
+			case isNumber && zeroKeys[key]:
+				v[key] = 0
+			default:
+				normalizeValue(field, fds)
+			}
+		}
+		if v["fileType"] == wasi.DirectoryType.String() {
+			for _, key := range []string{"size", "nlink"} {
+				if _, ok := v[key]; ok {
+					v[key] = 0
+				}
+			}
+		}
+	case []any:
+		for _, elem := range v {
+			normalizeValue(elem, fds)
+		}
+	}
+}
+
+// diffLines returns the first line which differs between want and got, and
+// false if there is one.
+func diffLines(want, got string) (line int, w, g string, ok bool) {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		w, g = "<EOF>", "<EOF>"
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return i + 1, w, g, false
+		}
+	}
+	return 0, "", "", true
+}
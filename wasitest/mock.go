@@ -0,0 +1,227 @@
+package wasitest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+)
+
+// MockSystem is a wasi.System whose behavior is programmed by tests, which
+// allows applications embedding this package to test how they handle the
+// results of system calls without using real files or sockets.
+//
+// The behavior of system calls is programmed with On, for example:
+//
+//	mock := wasitest.NewMockSystem(t)
+//	mock.On("fd_write", wasi.FD(1)).Return(wasi.ENOSPC).Once()
+//	mock.On("clock_time_get").Return(wasi.ESUCCESS, wasi.Timestamp(42))
+//
+// The system calls which were not programmed return ENOSYS. Calls matching
+// only programmed calls which exhausted their expected number of calls fail
+// the test, and the expectations of each programmed call are verified when
+// the test completes.
+type MockSystem struct {
+	wasi.System
+	t     testing.TB
+	mutex sync.Mutex
+	mocks []*MockCall
+	calls []wasi.Call
+}
+
+// NewMockSystem creates a MockSystem reporting unexpected calls to t.
+func NewMockSystem(t testing.TB) *MockSystem {
+	m := &MockSystem{t: t}
+	m.System = wasi.Intercept(nil, wasi.Hooks{Before: m.before})
+	t.Cleanup(m.verify)
+	return m
+}
+
+// On programs the behavior of the calls to syscall (e.g. fd_read) with
+// arguments starting with args, which are compared to the arguments of calls
+// with reflect.DeepEqual. The arguments are those of the methods of
+// wasi.System, excluding the context.
+//
+// When multiple programmed calls match a call, the first one which did not
+// exhaust its expected number of calls is used.
+func (m *MockSystem) On(syscall string, args ...any) *MockCall {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := &MockCall{mock: m, syscall: syscall, args: args, times: -1}
+	m.mocks = append(m.mocks, c)
+	return c
+}
+
+// Calls returns the system calls made to the mock, in the order they were
+// made.
+func (m *MockSystem) Calls() []wasi.Call {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]wasi.Call(nil), m.calls...)
+}
+
+// Close satisfies the wasi.System interface, it does nothing.
+func (m *MockSystem) Close(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockSystem) before(ctx context.Context, call *wasi.Call) {
+	c := m.match(call)
+	if c == nil {
+		call.Return(wasi.ENOSYS)
+	} else {
+		c.call(ctx, call)
+	}
+	m.mutex.Lock()
+	m.calls = append(m.calls, *call)
+	m.mutex.Unlock()
+}
+
+func (m *MockSystem) match(call *wasi.Call) *MockCall {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var exhausted *MockCall
+	for _, c := range m.mocks {
+		if !c.matches(call) {
+			continue
+		}
+		if c.times < 0 || c.calls < c.times {
+			c.calls++
+			return c
+		}
+		exhausted = c
+	}
+	if exhausted != nil {
+		m.t.Errorf("unexpected call: %s", formatCall(call))
+		exhausted.calls++
+	}
+	return exhausted
+}
+
+func (m *MockSystem) verify() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, c := range m.mocks {
+		if c.times >= 0 && c.calls < c.times {
+			m.t.Errorf("%s: expected %d call(s), got %d", c, c.times, c.calls)
+		}
+	}
+}
+
+// MockCall is the behavior of calls programmed on a MockSystem. The methods
+// of MockCall return the receiver, so they can be chained.
+type MockCall struct {
+	mock    *MockSystem
+	syscall string
+	args    []any
+	errno   wasi.Errno
+	results []any
+	do      func(context.Context, *wasi.Call)
+	delay   time.Duration
+	times   int
+	calls   int
+}
+
+// Return sets the errno and results returned by the call, which must have
+// the types of the results of the wasi.System method, excluding the errno;
+// missing results are returned as zero values, and results of other types
+// cause the call to panic.
+func (c *MockCall) Return(errno wasi.Errno, results ...any) *MockCall {
+	c.mock.mutex.Lock()
+	defer c.mock.mutex.Unlock()
+	c.errno, c.results = errno, results
+	return c
+}
+
+// Do sets a function called to complete the call, instead of returning the
+// values set by Return. The function may inspect the arguments of the call
+// (e.g. to fill the buffers passed to fd_read), and must call its Return
+// method to set the results.
+func (c *MockCall) Do(do func(ctx context.Context, call *wasi.Call)) *MockCall {
+	c.mock.mutex.Lock()
+	defer c.mock.mutex.Unlock()
+	c.do = do
+	return c
+}
+
+// Delay sets the time that the call blocks before returning, which is useful
+// to test timeouts. If the context is canceled before, the call returns the
+// errno of the context error (e.g. ECANCELED).
+func (c *MockCall) Delay(delay time.Duration) *MockCall {
+	c.mock.mutex.Lock()
+	defer c.mock.mutex.Unlock()
+	c.delay = delay
+	return c
+}
+
+// Times sets the number of times that the call is expected to be made.
+func (c *MockCall) Times(n int) *MockCall {
+	c.mock.mutex.Lock()
+	defer c.mock.mutex.Unlock()
+	c.times = n
+	return c
+}
+
+// Once is like Times(1).
+func (c *MockCall) Once() *MockCall { return c.Times(1) }
+
+// Calls returns the number of calls that matched c.
+func (c *MockCall) Calls() int {
+	c.mock.mutex.Lock()
+	defer c.mock.mutex.Unlock()
+	return c.calls
+}
+
+func (c *MockCall) String() string {
+	return formatCall(&wasi.Call{Syscall: c.syscall, Args: c.args})
+}
+
+func (c *MockCall) matches(call *wasi.Call) bool {
+	if c.syscall != call.Syscall || len(c.args) > len(call.Args) {
+		return false
+	}
+	for i, arg := range c.args {
+		if !reflect.DeepEqual(arg, call.Args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *MockCall) call(ctx context.Context, call *wasi.Call) {
+	c.mock.mutex.Lock()
+	errno, results, do, delay := c.errno, c.results, c.do, c.delay
+	c.mock.mutex.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			call.Return(wasi.MakeErrno(ctx.Err()))
+			return
+		}
+	}
+	if do != nil {
+		do(ctx, call)
+		if !call.Done {
+			call.Return(wasi.ENOSYS)
+		}
+	} else {
+		call.Return(errno, results...)
+	}
+}
+
+func formatCall(call *wasi.Call) string {
+	args := make([]string, len(call.Args))
+	for i, arg := range call.Args {
+		args[i] = fmt.Sprint(arg)
+	}
+	return call.Syscall + "(" + strings.Join(args, ", ") + ")"
+}
@@ -0,0 +1,241 @@
+package wasitest
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go"
+	"golang.org/x/exp/slices"
+)
+
+// Platform describes the behavior of the host platform that a system runs
+// on, in the areas where WASI leaves the behavior unspecified and operating
+// systems disagree.
+//
+// The test suites adjust their expectations to the platform of the system
+// under test; the values declared in this package are the programmatic
+// documentation of the differences between platforms.
+type Platform struct {
+	// Name of the platform, which matches the values of runtime.GOOS.
+	Name string
+	// PollReadyBeforeConnect is true if poll_oneoff reports that stream
+	// sockets are ready for reading and writing before being connected.
+	PollReadyBeforeConnect bool
+}
+
+var (
+	// Linux is the platform of systems running on Linux.
+	Linux = Platform{
+		Name:                   "linux",
+		PollReadyBeforeConnect: true,
+	}
+
+	// Darwin is the platform of systems running on macOS.
+	Darwin = Platform{
+		Name:                   "darwin",
+		PollReadyBeforeConnect: false,
+	}
+
+	// Windows is the platform of systems running on Windows. There are no
+	// system implementations for Windows yet, the expectations follow the
+	// documented behavior of Winsock.
+	Windows = Platform{
+		Name:                   "windows",
+		PollReadyBeforeConnect: false,
+	}
+)
+
+// PlatformOf returns the platform for the given GOOS value. Unknown values
+// get the expectations of Linux, which are the least strict.
+func PlatformOf(goos string) Platform {
+	switch goos {
+	case "darwin":
+		return Darwin
+	case "windows":
+		return Windows
+	case "linux":
+		return Linux
+	default:
+		p := Linux
+		p.Name = goos
+		return p
+	}
+}
+
+// CurrentPlatform returns the platform that the program is running on.
+func CurrentPlatform() Platform { return PlatformOf(runtime.GOOS) }
+
+// Capabilities is the set of optional features supported by a system.
+//
+// Systems are not required to implement all of WASI (e.g. a system may only
+// serve files and leave the sockets unimplemented); the test suites skip
+// the tests of features that the system under test does not have, instead
+// of reporting failures.
+type Capabilities struct {
+	// Clocks is the list of clocks that clock_time_get supports.
+	Clocks []wasi.ClockID
+	// SocketFamilies is the list of protocol families that sock_open
+	// supports.
+	SocketFamilies []wasi.ProtocolFamily
+	// Random is true if random_get is implemented.
+	Random bool
+}
+
+// HasClock returns true if c contains the clock id.
+func (c Capabilities) HasClock(id wasi.ClockID) bool {
+	return slices.Contains(c.Clocks, id)
+}
+
+// HasSocketFamily returns true if c contains the protocol family.
+func (c Capabilities) HasSocketFamily(family wasi.ProtocolFamily) bool {
+	return slices.Contains(c.SocketFamilies, family)
+}
+
+func (c Capabilities) String() string {
+	var s strings.Builder
+	s.WriteString("clocks=")
+	for i, id := range c.Clocks {
+		if i > 0 {
+			s.WriteString(",")
+		}
+		s.WriteString(id.String())
+	}
+	s.WriteString(" sockets=")
+	for i, family := range c.SocketFamilies {
+		if i > 0 {
+			s.WriteString(",")
+		}
+		s.WriteString(family.String())
+	}
+	fmt.Fprintf(&s, " random=%t", c.Random)
+	return s.String()
+}
+
+// ProbeCapabilities detects the capabilities of a system by invoking the
+// system calls of each feature. The system must be newly created since the
+// probe opens and closes file descriptors.
+func ProbeCapabilities(ctx context.Context, system wasi.System) Capabilities {
+	var c Capabilities
+
+	for _, id := range []wasi.ClockID{
+		wasi.Realtime,
+		wasi.Monotonic,
+		wasi.ProcessCPUTimeID,
+		wasi.ThreadCPUTimeID,
+	} {
+		if _, errno := system.ClockTimeGet(ctx, id, 1); errno == wasi.ESUCCESS {
+			c.Clocks = append(c.Clocks, id)
+		}
+	}
+
+	for _, family := range []wasi.ProtocolFamily{
+		wasi.InetFamily,
+		wasi.Inet6Family,
+		wasi.UnixFamily,
+	} {
+		sock, errno := system.SockOpen(ctx, family, wasi.StreamSocket, 0, wasi.AllRights, wasi.AllRights)
+		if errno == wasi.ESUCCESS {
+			system.FDClose(ctx, sock)
+			c.SocketFamilies = append(c.SocketFamilies, family)
+		}
+	}
+
+	c.Random = system.RandomGet(ctx, make([]byte, 1)) == wasi.ESUCCESS
+	return c
+}
+
+// Provider is a system implementation that the test suites run against.
+type Provider struct {
+	// Name of the provider, used as name of the sub-test (e.g. "poll").
+	Name string
+	// Platform is the platform that the provider runs on, which defaults to
+	// the current platform if the name is empty.
+	Platform Platform
+	// MakeSystem creates instances of the system.
+	MakeSystem MakeSystem
+}
+
+// TestProviders runs the TestSystem suite against each provider, so a single
+// test corpus validates every system implementation. The capabilities of
+// each provider are probed before running the suite and logged, which
+// reports the differences between the providers.
+func TestProviders(t *testing.T, providers ...Provider) {
+	for _, p := range providers {
+		p := p
+		t.Run(p.Name, func(t *testing.T) { testProvider(t, p) })
+	}
+}
+
+func testProvider(t *testing.T, p Provider) {
+	if p.Platform.Name == "" {
+		p.Platform = CurrentPlatform()
+	}
+
+	ctx, cancel := testContext(t)
+	defer cancel()
+
+	s, err := p.MakeSystem(TestConfig{
+		Rand: rand.Reader,
+		Now:  time.Now,
+	})
+	if err != nil {
+		t.Fatalf("system initialization failed: %s", err)
+	}
+	caps := ProbeCapabilities(ctx, s)
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("system closure failed: %s", err)
+	}
+	t.Logf("platform=%s %s", p.Platform.Name, caps)
+
+	env := testEnv{platform: p.Platform, capabilities: caps}
+	t.Run("proc", proc.runFunc(env, p.MakeSystem))
+	t.Run("poll", poll.runFunc(env, p.MakeSystem))
+	t.Run("socket", func(t *testing.T) {
+		if len(caps.SocketFamilies) == 0 {
+			t.Skip("sockets not supported by this system")
+		}
+		socket.run(t, env, p.MakeSystem)
+	})
+}
+
+// testEnv carries the platform and capabilities of the system under test to
+// the test functions, via their context.
+type testEnv struct {
+	platform     Platform
+	capabilities Capabilities
+}
+
+type testEnvKey struct{}
+
+func withTestEnv(ctx context.Context, env testEnv) context.Context {
+	return context.WithValue(ctx, testEnvKey{}, env)
+}
+
+func platformOf(ctx context.Context) Platform {
+	env, _ := ctx.Value(testEnvKey{}).(testEnv)
+	return env.platform
+}
+
+func capabilitiesOf(ctx context.Context) Capabilities {
+	env, _ := ctx.Value(testEnvKey{}).(testEnv)
+	return env.capabilities
+}
+
+func skipIfNoClock(t *testing.T, ctx context.Context, id wasi.ClockID) {
+	if !capabilitiesOf(ctx).HasClock(id) {
+		t.Helper()
+		t.Skipf("clock %s not supported on this system", id)
+	}
+}
+
+func skipIfNoSocketFamily(t *testing.T, ctx context.Context, family wasi.ProtocolFamily) {
+	if !capabilitiesOf(ctx).HasSocketFamily(family) {
+		t.Helper()
+		t.Skipf("protocol family %s not supported on this system", family)
+	}
+}
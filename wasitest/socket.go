@@ -258,6 +258,26 @@ var socket = testSuite{
 		wasi.Inet6Family, wasi.StreamSocket, &wasi.Inet6Address{Addr: localIPv6},
 	),
 
+	"accepted ipv4 stream sockets report the address that the peer connected to": testSocketAcceptWildcard(
+		wasi.InetFamily, &wasi.Inet4Address{}, &wasi.Inet4Address{Addr: localIPv4},
+	),
+
+	"accepted ipv6 stream sockets report the address that the peer connected to": testSocketAcceptWildcard(
+		wasi.Inet6Family, &wasi.Inet6Address{}, &wasi.Inet6Address{Addr: localIPv6},
+	),
+
+	"ipv6 stream sockets accept connections from ipv4 peers": testSocketDualStack(false),
+
+	"ipv6 only stream sockets refuse connections from ipv4 peers": testSocketDualStack(true),
+
+	"connected ipv4 datagram sockets report their local and peer addresses": testSocketDatagramAddresses(
+		wasi.InetFamily, &wasi.Inet4Address{Addr: localIPv4},
+	),
+
+	"connected ipv6 datagram sockets report their local and peer addresses": testSocketDatagramAddresses(
+		wasi.Inet6Family, &wasi.Inet6Address{Addr: localIPv6},
+	),
+
 	"can connect a ipv4 datagram socket": testSocketConnectOK(
 		wasi.InetFamily, wasi.DatagramSocket, &wasi.Inet4Address{Addr: localIPv4, Port: nextPort()},
 	),
@@ -486,6 +506,14 @@ var socket = testSuite{
 		wasi.Inet6Family, wasi.DatagramSocket,
 	),
 
+	"can set and get the tcp options of ipv4 stream sockets": testSocketTCPOptions(
+		wasi.InetFamily,
+	),
+
+	"can set and get the tcp options of ipv6 stream sockets": testSocketTCPOptions(
+		wasi.Inet6Family,
+	),
+
 	"connected ipv4 stream sockets can send and receive data": testSocketSendAndReceiveStream(
 		wasi.InetFamily, &wasi.Inet4Address{Addr: localIPv4},
 	),
@@ -770,19 +798,8 @@ func testSocketPollBeforeConnectStream(family wasi.ProtocolFamily) testFunc {
 
 		n, errno := sys.PollOneOff(ctx, subs, evs)
 		assertEqual(t, errno, wasi.ESUCCESS)
-		switch n {
-		default:
-			t.Fatalf("wrong number of events: want 1 or 3 but got %d", n)
-		case 1:
-			// Darwin reports that sockets are not ready for read/write before
-			// being connected.
-			assertEqual(t, evs[0], wasi.Event{
-				UserData:  1,
-				EventType: wasi.ClockEvent,
-			})
-		case 3:
-			// Linux reports that sockets are ready for read/write before being
-			// connected.
+		if platformOf(ctx).PollReadyBeforeConnect {
+			assertEqual(t, n, 3)
 			assertEqual(t, evs[0], wasi.Event{
 				UserData:  1,
 				EventType: wasi.ClockEvent,
@@ -795,6 +812,12 @@ func testSocketPollBeforeConnectStream(family wasi.ProtocolFamily) testFunc {
 				UserData:  3,
 				EventType: wasi.FDWriteEvent,
 			})
+		} else {
+			assertEqual(t, n, 1)
+			assertEqual(t, evs[0], wasi.Event{
+				UserData:  1,
+				EventType: wasi.ClockEvent,
+			})
 		}
 	}
 }
@@ -1014,6 +1037,131 @@ func testSocketConnectAndAccept(family wasi.ProtocolFamily, typ wasi.SocketType,
 	}
 }
 
+func testSocketAcceptWildcard(family wasi.ProtocolFamily, bind, connect wasi.SocketAddress) testFunc {
+	return func(t *testing.T, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(TestConfig{})
+
+		server, errno := sockOpen(t, ctx, sys, family, wasi.StreamSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+
+		serverAddr, errno := sys.SockBind(ctx, server, bind)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertEqual(t, sys.SockListen(ctx, server, 10), wasi.ESUCCESS)
+
+		var peerAddr wasi.SocketAddress
+		switch a := connect.(type) {
+		case *wasi.Inet4Address:
+			peerAddr = &wasi.Inet4Address{Addr: a.Addr, Port: serverAddr.(*wasi.Inet4Address).Port}
+		case *wasi.Inet6Address:
+			peerAddr = &wasi.Inet6Address{Addr: a.Addr, Port: serverAddr.(*wasi.Inet6Address).Port}
+		}
+
+		client, errno := sockOpen(t, ctx, sys, family, wasi.StreamSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		clientAddr, errno := sys.SockConnect(ctx, client, peerAddr)
+		assertEqual(t, errno, wasi.EINPROGRESS)
+
+		sockPoll(t, ctx, sys, client, wasi.FDWriteEvent)
+		sockPoll(t, ctx, sys, server, wasi.FDReadEvent)
+
+		accept, remoteAddr, localAddr, errno := sys.SockAccept(ctx, server, wasi.NonBlock)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertDeepEqual(t, localAddr, peerAddr)
+		assertDeepEqual(t, remoteAddr, clientAddr)
+
+		localAddr, errno = sys.SockLocalAddress(ctx, accept)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertDeepEqual(t, localAddr, peerAddr)
+
+		remoteAddr, errno = sys.SockRemoteAddress(ctx, client)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertDeepEqual(t, remoteAddr, peerAddr)
+
+		assertEqual(t, sys.FDClose(ctx, accept), wasi.ESUCCESS)
+		assertEqual(t, sys.FDClose(ctx, client), wasi.ESUCCESS)
+		assertEqual(t, sys.FDClose(ctx, server), wasi.ESUCCESS)
+	}
+}
+
+func testSocketDualStack(v6only bool) testFunc {
+	return func(t *testing.T, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(TestConfig{})
+
+		server, errno := sockOpen(t, ctx, sys, wasi.Inet6Family, wasi.StreamSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+
+		option := wasi.IntValue(0)
+		if v6only {
+			option = 1
+		}
+		assertEqual(t, sys.SockSetOpt(ctx, server, wasi.IPv6Only, option), wasi.ESUCCESS)
+		assertEqual(t, sockOption[wasi.IntValue](t, ctx, sys, server, wasi.IPv6Only), option)
+
+		serverAddr, errno := sys.SockBind(ctx, server, &wasi.Inet6Address{})
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertEqual(t, sys.SockListen(ctx, server, 10), wasi.ESUCCESS)
+
+		client, errno := sockOpen(t, ctx, sys, wasi.InetFamily, wasi.StreamSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		clientAddr, errno := sys.SockConnect(ctx, client, &wasi.Inet4Address{
+			Addr: localIPv4,
+			Port: serverAddr.(*wasi.Inet6Address).Port,
+		})
+		assertEqual(t, errno, wasi.EINPROGRESS)
+		sockPoll(t, ctx, sys, client, wasi.FDWriteEvent)
+
+		if v6only {
+			assertEqual(t, sockErrno(t, ctx, sys, client), wasi.ECONNREFUSED)
+		} else {
+			sockPoll(t, ctx, sys, server, wasi.FDReadEvent)
+
+			// The peers have v4-mapped addresses on the IPv6 socket.
+			accept, remoteAddr, _, errno := sys.SockAccept(ctx, server, wasi.NonBlock)
+			assertEqual(t, errno, wasi.ESUCCESS)
+			v4 := clientAddr.(*wasi.Inet4Address)
+			mapped := &wasi.Inet6Address{Port: v4.Port}
+			mapped.Addr[10], mapped.Addr[11] = 0xff, 0xff
+			copy(mapped.Addr[12:], v4.Addr[:])
+			assertDeepEqual(t, remoteAddr, wasi.SocketAddress(mapped))
+			assertEqual(t, sys.FDClose(ctx, accept), wasi.ESUCCESS)
+		}
+
+		assertEqual(t, sys.FDClose(ctx, client), wasi.ESUCCESS)
+		assertEqual(t, sys.FDClose(ctx, server), wasi.ESUCCESS)
+	}
+}
+
+func testSocketDatagramAddresses(family wasi.ProtocolFamily, bind wasi.SocketAddress) testFunc {
+	return func(t *testing.T, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(TestConfig{})
+
+		server, errno := sockOpen(t, ctx, sys, family, wasi.DatagramSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		serverAddr, errno := sys.SockBind(ctx, server, bind)
+		assertEqual(t, errno, wasi.ESUCCESS)
+
+		client, errno := sockOpen(t, ctx, sys, family, wasi.DatagramSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+
+		_, errno = sys.SockRemoteAddress(ctx, client)
+		assertEqual(t, errno, wasi.ENOTCONN)
+
+		clientAddr, errno := sys.SockConnect(ctx, client, serverAddr)
+		assertEqual(t, errno, wasi.ESUCCESS)
+
+		localAddr, errno := sys.SockLocalAddress(ctx, client)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertDeepEqual(t, localAddr, clientAddr)
+
+		remoteAddr, errno := sys.SockRemoteAddress(ctx, client)
+		assertEqual(t, errno, wasi.ESUCCESS)
+		assertDeepEqual(t, remoteAddr, serverAddr)
+
+		assertEqual(t, sys.FDClose(ctx, client), wasi.ESUCCESS)
+		assertEqual(t, sys.FDClose(ctx, server), wasi.ESUCCESS)
+	}
+}
+
 func testSocketConnectAndAcceptBlocking(family wasi.ProtocolFamily, typ wasi.SocketType, bind wasi.SocketAddress) testFunc {
 	return func(t *testing.T, ctx context.Context, newSystem newSystem) {
 		sys := newSystem(TestConfig{})
@@ -2342,8 +2490,38 @@ func testSocketSetOptionInvalidArgument(family wasi.ProtocolFamily, typ wasi.Soc
 	}
 }
 
+func testSocketTCPOptions(family wasi.ProtocolFamily) testFunc {
+	return func(t *testing.T, ctx context.Context, newSystem newSystem) {
+		sys := newSystem(TestConfig{})
+		sock, errno := sockOpen(t, ctx, sys, family, wasi.StreamSocket, 0)
+		assertEqual(t, errno, wasi.ESUCCESS)
+
+		tests := []struct {
+			scenario string
+			option   wasi.SocketOption
+			value    wasi.IntValue
+		}{
+			{scenario: "no delay", option: wasi.TcpNoDelay, value: 1},
+			{scenario: "keep alive", option: wasi.KeepAlive, value: 1},
+			{scenario: "keep alive idle time", option: wasi.TcpKeepIdle, value: 30},
+			{scenario: "keep alive interval", option: wasi.TcpKeepInterval, value: 5},
+			{scenario: "keep alive count", option: wasi.TcpKeepCount, value: 3},
+		}
+
+		for _, test := range tests {
+			t.Run(test.scenario, func(t *testing.T) {
+				assertEqual(t, sys.SockSetOpt(ctx, sock, test.option, test.value), wasi.ESUCCESS)
+				assertEqual(t, sockOption[wasi.IntValue](t, ctx, sys, sock, test.option), test.value)
+			})
+		}
+
+		assertEqual(t, sys.FDClose(ctx, sock), wasi.ESUCCESS)
+	}
+}
+
 func sockOpen(t *testing.T, ctx context.Context, sys wasi.System, family wasi.ProtocolFamily, typ wasi.SocketType, proto wasi.Protocol) (wasi.FD, wasi.Errno) {
 	t.Helper()
+	skipIfNoSocketFamily(t, ctx, family)
 	sock, errno := sys.SockOpen(ctx, family, typ, proto, wasi.AllRights, wasi.AllRights)
 	skipIfNotImplemented(t, errno)
 	if errno == wasi.ESUCCESS {
@@ -11,10 +11,12 @@ import (
 
 // TestSystem is a test suite which validates the behavior of wasi.System
 // implementations.
+//
+// The expectations of the tests are those of the current platform, and the
+// tests of features that the system does not support are skipped; see
+// TestProviders to run the suite against multiple implementations.
 func TestSystem(t *testing.T, makeSystem MakeSystem) {
-	t.Run("proc", proc.runFunc(makeSystem))
-	t.Run("poll", poll.runFunc(makeSystem))
-	t.Run("socket", socket.runFunc(makeSystem))
+	testProvider(t, Provider{MakeSystem: makeSystem})
 }
 
 type skip string
@@ -33,15 +35,16 @@ func (tests testSuite) names() []string {
 	return names
 }
 
-func (tests testSuite) runFunc(makeSystem MakeSystem) func(*testing.T) {
-	return func(t *testing.T) { tests.run(t, makeSystem) }
+func (tests testSuite) runFunc(env testEnv, makeSystem MakeSystem) func(*testing.T) {
+	return func(t *testing.T) { tests.run(t, env, makeSystem) }
 }
 
-func (tests testSuite) run(t *testing.T, makeSystem MakeSystem) {
+func (tests testSuite) run(t *testing.T, env testEnv, makeSystem MakeSystem) {
 	for _, name := range tests.names() {
 		t.Run(name, func(t *testing.T) {
 			ctx, cancel := testContext(t)
 			defer cancel()
+			ctx = withTestEnv(ctx, env)
 
 			tests[name](t, ctx, func(c TestConfig) wasi.System {
 				s, err := makeSystem(c)
@@ -0,0 +1,163 @@
+package wasitest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/wasi-go/imports/wasi_snapshot_preview1"
+	"github.com/stealthrocket/wasi-go/internal/testsuite"
+	"github.com/stealthrocket/wazergo"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// TestWASITestSuite runs the test suites of WebAssembly/wasi-testsuite found
+// in the directories passed as arguments (e.g. tests/c/testsuite), with
+// systems created by makeSystem. Each module of a suite runs as a sub-test,
+// which passes if the program exited with the exit code and wrote the output
+// of its JSON specification.
+//
+// The tests run in the process of the test, the systems must preopen the
+// directories of TestConfig.Dirs, and close the stdio writers of the
+// configuration when they are closed.
+//
+// The suites are compiled from the prod/testsuite-base branch of the
+// repository, which is a submodule of this repository and can be checked out
+// with "make testdata/.wasi-testsuite".
+func TestWASITestSuite(t *testing.T, suites []string, makeSystem MakeSystem) {
+	if len(suites) == 0 {
+		t.Skip("no test suites to run")
+	}
+
+	for _, dir := range suites {
+		dir := dir
+		name, err := testsuite.Name(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(name, func(t *testing.T) {
+			tests, err := testsuite.Tests(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			runtime := wazero.NewRuntime(ctx)
+			defer runtime.Close(ctx)
+
+			for _, name := range tests {
+				name := name
+				t.Run(name, func(t *testing.T) {
+					runTestSuiteModule(t, ctx, runtime, dir, name, makeSystem)
+				})
+			}
+		})
+	}
+}
+
+func runTestSuiteModule(t *testing.T, ctx context.Context, runtime wazero.Runtime, dir, name string, makeSystem MakeSystem) {
+	spec, err := testsuite.ReadSpec(dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bytecode, err := os.ReadFile(filepath.Join(dir, name+".wasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig{
+		Args:    append([]string{name + ".wasm"}, spec.Args...),
+		Environ: spec.Environ(),
+		Stdout:  newOutputBuffer(),
+		Stderr:  newOutputBuffer(),
+		Rand:    rand.Reader,
+		Now:     time.Now,
+	}
+	for _, d := range spec.Dirs {
+		config.Dirs = append(config.Dirs, Dir{Name: d, Path: filepath.Join(dir, d)})
+	}
+	defer spec.Cleanup(dir)
+
+	system, err := makeSystem(config)
+	if err != nil {
+		t.Fatal("system:", err)
+	}
+
+	instance, err := wazergo.Instantiate(ctx, runtime,
+		wasi_snapshot_preview1.NewHostModule(),
+		wasi_snapshot_preview1.WithWASI(system),
+	)
+	if err != nil {
+		system.Close(ctx)
+		t.Fatal(err)
+	}
+
+	exitCode := 0
+	module, err := runtime.Instantiate(wazergo.WithModuleInstance(ctx, instance), bytecode)
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = int(exitErr.ExitCode())
+		} else {
+			t.Error(err)
+		}
+	}
+	if module != nil {
+		module.Close(ctx)
+	}
+	instance.Close(ctx)
+	system.Close(ctx)
+
+	stdout := config.Stdout.(*outputBuffer).String(t)
+	stderr := config.Stderr.(*outputBuffer).String(t)
+	if stderr != "" {
+		t.Logf("stderr:\n%s", stderr)
+	}
+	for _, failure := range spec.Compare(exitCode, stdout) {
+		t.Errorf("wrong %s: %s", failure.Type, failure.Message)
+	}
+}
+
+// outputBuffer collects the output written by a test to stdout or stderr,
+// which is complete when the system closes it.
+type outputBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newOutputBuffer() *outputBuffer {
+	return &outputBuffer{closed: make(chan struct{})}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *outputBuffer) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (b *outputBuffer) String(t *testing.T) string {
+	select {
+	case <-b.closed:
+	case <-time.After(10 * time.Second):
+		t.Error("the output of the test was not closed by the system")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
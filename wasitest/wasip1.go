@@ -27,9 +27,17 @@ type TestConfig struct {
 	Stderr  io.WriteCloser
 	Rand    io.Reader
 	RootFS  string
+	Dirs    []Dir
 	Now     func() time.Time
 }
 
+// Dir is a directory that the system preopens in addition to RootFS, which
+// is at Path on the host and named Name in the system.
+type Dir struct {
+	Name string
+	Path string
+}
+
 // MakeSystem is a function used to create a system to run the test suites
 // against.
 //
@@ -102,35 +110,40 @@ func TestWASIP1(t *testing.T, filePaths []string, makeSystem MakeSystem) {
 			if err != nil {
 				t.Fatal("system:", err)
 			}
-			ctx := context.Background()
-			defer system.Close(ctx)
+			defer system.Close(context.Background())
+			runWASIP1(t, bytecode, system)
+		})
+	}
+}
 
-			runtime := wazero.NewRuntime(ctx)
-			defer runtime.Close(ctx)
+// runWASIP1 runs the WebAssembly program with system, failing the test if it
+// trapped or exited with a non-zero code.
+func runWASIP1(t *testing.T, bytecode []byte, system wasi.System) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
 
-			ctx = wazergo.WithModuleInstance(ctx,
-				wazergo.MustInstantiate(ctx, runtime,
-					wasi_snapshot_preview1.NewHostModule(),
-					wasi_snapshot_preview1.WithWASI(system),
-				),
-			)
+	ctx = wazergo.WithModuleInstance(ctx,
+		wazergo.MustInstantiate(ctx, runtime,
+			wasi_snapshot_preview1.NewHostModule(),
+			wasi_snapshot_preview1.WithWASI(system),
+		),
+	)
 
-			instance, err := runtime.Instantiate(ctx, bytecode)
-			if err != nil {
-				switch e := err.(type) {
-				case *sys.ExitError:
-					if exitCode := e.ExitCode(); exitCode != 0 {
-						t.Error("exit code:", exitCode)
-					}
-				default:
-					t.Error("instantiating wasm module instance:", err)
-				}
+	instance, err := runtime.Instantiate(ctx, bytecode)
+	if err != nil {
+		switch e := err.(type) {
+		case *sys.ExitError:
+			if exitCode := e.ExitCode(); exitCode != 0 {
+				t.Error("exit code:", exitCode)
 			}
-			if instance != nil {
-				if err := instance.Close(ctx); err != nil {
-					t.Error("closing wasm module instance:", err)
-				}
-			}
-		})
+		default:
+			t.Error("instantiating wasm module instance:", err)
+		}
+	}
+	if instance != nil {
+		if err := instance.Close(ctx); err != nil {
+			t.Error("closing wasm module instance:", err)
+		}
 	}
 }
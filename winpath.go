@@ -0,0 +1,98 @@
+package wasi
+
+import (
+	"context"
+	"strings"
+)
+
+// WindowsPaths wraps a System to translate Windows-style paths passed by the
+// guest into paths that can be resolved in the mount namespace.
+//
+// Backslashes are converted to forward slashes, and drive letter prefixes
+// (e.g. "C:") are removed so the path is resolved relative to the directory
+// file descriptor that it was passed with. For example, the path
+// "C:\data\file.txt" is translated to "data/file.txt".
+//
+// Symbolic link targets returned by PathReadLink are translated back to use
+// backslashes as separators.
+//
+// Some guests compiled from codebases which target Windows emit such paths,
+// which would otherwise fail to resolve with ENOENT.
+func WindowsPaths(system System) System {
+	return &windowsPaths{system}
+}
+
+type windowsPaths struct{ System }
+
+func (w *windowsPaths) PathCreateDirectory(ctx context.Context, fd FD, path string) Errno {
+	return w.System.PathCreateDirectory(ctx, fd, fromWindowsPath(path))
+}
+
+func (w *windowsPaths) PathFileStatGet(ctx context.Context, fd FD, lookupFlags LookupFlags, path string) (FileStat, Errno) {
+	return w.System.PathFileStatGet(ctx, fd, lookupFlags, fromWindowsPath(path))
+}
+
+func (w *windowsPaths) PathFileStatSetTimes(ctx context.Context, fd FD, lookupFlags LookupFlags, path string, accessTime, modifyTime Timestamp, flags FSTFlags) Errno {
+	return w.System.PathFileStatSetTimes(ctx, fd, lookupFlags, fromWindowsPath(path), accessTime, modifyTime, flags)
+}
+
+func (w *windowsPaths) PathLink(ctx context.Context, oldFD FD, oldFlags LookupFlags, oldPath string, newFD FD, newPath string) Errno {
+	return w.System.PathLink(ctx, oldFD, oldFlags, fromWindowsPath(oldPath), newFD, fromWindowsPath(newPath))
+}
+
+func (w *windowsPaths) PathOpen(ctx context.Context, fd FD, dirFlags LookupFlags, path string, openFlags OpenFlags, rightsBase, rightsInheriting Rights, fdFlags FDFlags) (FD, Errno) {
+	return w.System.PathOpen(ctx, fd, dirFlags, fromWindowsPath(path), openFlags, rightsBase, rightsInheriting, fdFlags)
+}
+
+func (w *windowsPaths) PathReadLink(ctx context.Context, fd FD, path string, buffer []byte) (int, Errno) {
+	n, errno := w.System.PathReadLink(ctx, fd, fromWindowsPath(path), buffer)
+	if errno == ESUCCESS {
+		for i, c := range buffer[:n] {
+			if c == '/' {
+				buffer[i] = '\\'
+			}
+		}
+	}
+	return n, errno
+}
+
+func (w *windowsPaths) PathRemoveDirectory(ctx context.Context, fd FD, path string) Errno {
+	return w.System.PathRemoveDirectory(ctx, fd, fromWindowsPath(path))
+}
+
+func (w *windowsPaths) PathRename(ctx context.Context, fd FD, oldPath string, newFD FD, newPath string) Errno {
+	return w.System.PathRename(ctx, fd, fromWindowsPath(oldPath), newFD, fromWindowsPath(newPath))
+}
+
+func (w *windowsPaths) PathSymlink(ctx context.Context, oldPath string, fd FD, newPath string) Errno {
+	return w.System.PathSymlink(ctx, strings.ReplaceAll(oldPath, `\`, "/"), fd, fromWindowsPath(newPath))
+}
+
+func (w *windowsPaths) PathUnlinkFile(ctx context.Context, fd FD, path string) Errno {
+	return w.System.PathUnlinkFile(ctx, fd, fromWindowsPath(path))
+}
+
+// fromWindowsPath converts a Windows-style path to a path relative to the
+// directory it is resolved from. Paths which do not contain backslashes nor
+// drive letters are returned unchanged.
+func fromWindowsPath(path string) string {
+	hasDrive := len(path) >= 2 && path[1] == ':' && isDriveLetter(path[0])
+	if !hasDrive && !strings.Contains(path, `\`) {
+		return path
+	}
+	if hasDrive {
+		path = path[2:]
+	}
+	path = strings.ReplaceAll(path, `\`, "/")
+	if hasDrive {
+		path = strings.TrimLeft(path, "/")
+		if path == "" {
+			path = "."
+		}
+	}
+	return path
+}
+
+func isDriveLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}